@@ -18,76 +18,169 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"sort"
+	"strings"
+	"sync"
 )
 
+// Config is the configuration set at the setup. ServerAddresses are the additional addresses of the server, e.g. the
+// IPv6 address of a dual-stack vulnbox.
 type Config struct {
-	ServerAddress string `json:"server_address" binding:"required,ip|cidr" bson:"server_address"`
-	FlagRegex     string `json:"flag_regex" binding:"required,min=8" bson:"flag_regex"`
-	AuthRequired  bool   `json:"auth_required" bson:"auth_required"`
+	ServerAddress   string   `json:"server_address" binding:"required,ip|cidr" bson:"server_address"`
+	ServerAddresses []string `json:"server_addresses" binding:"dive,ip|cidr" bson:"server_addresses,omitempty"`
+	FlagRegex       string   `json:"flag_regex" binding:"required,min=8" bson:"flag_regex"`
+	AuthRequired    bool     `json:"auth_required" bson:"auth_required"`
 }
 
+// ServerNetworks returns the networks of all the addresses of the server, or nil if one of them is invalid.
+func (config Config) ServerNetworks() IPNetworks {
+	return ParseIPNetworks(append([]string{config.ServerAddress}, config.ServerAddresses...)...)
+}
+
+// ApplicationContext contains the components shared by all the projects, like the accounts and the notifications, and
+// the context of the active project. The context of a project is never modified after it is published: the changes
+// are applied to a copy, which replaces it, so the handlers must resolve the active project once for each request.
+// The accounts are replaced by the setup and by the reloads, so they must be read with Accounts.
 type ApplicationContext struct {
+	AuthController         *AuthController
+	NotificationController *NotificationController
+	ProjectsController     *ProjectsController
+	StorageMonitor         *StorageMonitor
+	Version                string
+	ClassifierExecutables  []string
+	ExploitsDirectory      string
+	accountsStorage        Storage
+	accounts               gin.Accounts
+	activeProject          *ProjectContext
+	projects               map[RowID]*ProjectContext
+	mActiveProject         sync.RWMutex
+	mAccounts              sync.RWMutex
+	mReload                sync.Mutex
+	mProjects              sync.Mutex
+}
+
+// ProjectContext contains the configuration and the components of a project, which read and write the documents of
+// the database of the project. The components of the projects which are not active keep running.
+type ProjectContext struct {
+	Project                     Project
 	Storage                     Storage
 	Config                      Config
-	Accounts                    gin.Accounts
 	RulesManager                RulesManager
+	RulesRescanner              *RulesRescanner
 	PcapImporter                *PcapImporter
+	CaptureSourcesController    *CaptureSourcesController
+	SensorIngestion             *SensorIngestion
+	InlineProxy                 *InlineProxy
 	ConnectionsController       ConnectionsController
 	ServicesController          *ServicesController
+	ServicesDetector            *ServicesDetector
+	ScriptsController           *ScriptsController
+	StorageLimits               *StorageLimits
+	IngestionFilters            *IngestionFilters
+	RetentionJanitor            *RetentionJanitor
+	GeoIP                       *GeoIP
+	LagWatchdog                 *LagWatchdog
+	PayloadClassifiers          *PayloadClassifiers
 	ConnectionStreamsController ConnectionStreamsController
 	SearchController            *SearchController
+	QueryLimits                 *QueryLimits
 	StatisticsController        StatisticsController
-	NotificationController      *NotificationController
+	BeaconsController           BeaconsController
+	RunnersController           RunnersController
+	ExploitsExporter            *ExploitsExporter
+	ExploitReplayer             *ExploitReplayer
 	IsConfigured                bool
-	Version                     string
+	reloadHandlers              map[string]func() error
 }
 
 func CreateApplicationContext(storage Storage, version string) (*ApplicationContext, error) {
-	var configWrapper struct {
-		Config Config
-	}
-	if err := storage.Find(Settings).Filter(OrderedDocument{{"_id", "config"}}).
-		First(&configWrapper); err != nil {
+	config, err := loadConfig(storage)
+	if err != nil {
 		return nil, err
 	}
-	var accountsWrapper struct {
-		Accounts gin.Accounts
-	}
-
-	if err := storage.Find(Settings).Filter(OrderedDocument{{"_id", "accounts"}}).
-		First(&accountsWrapper); err != nil {
+	accounts, err := loadAccounts(storage)
+	if err != nil {
 		return nil, err
 	}
-	if accountsWrapper.Accounts == nil {
-		accountsWrapper.Accounts = make(gin.Accounts)
-	}
 
+	projectContext := &ProjectContext{
+		Project:        DefaultProject(),
+		Storage:        storage,
+		Config:         config,
+		reloadHandlers: make(map[string]func() error),
+	}
 	applicationContext := &ApplicationContext{
-		Storage:                storage,
-		Config:                 configWrapper.Config,
-		Accounts:               accountsWrapper.Accounts,
-		Version:                version,
+		AuthController:  NewAuthController(storage),
+		Version:         version,
+		accountsStorage: storage,
+		accounts:        accounts,
+		activeProject:   projectContext,
+		projects:        map[RowID]*ProjectContext{projectContext.Project.ID: projectContext},
 	}
 
 	return applicationContext, nil
 }
 
+// ActiveProject returns the context of the active project.
+func (sm *ApplicationContext) ActiveProject() *ProjectContext {
+	sm.mActiveProject.RLock()
+	defer sm.mActiveProject.RUnlock()
+
+	return sm.activeProject
+}
+
+// publishProject replaces the context of a project with projectContext, and makes it the active project if active is
+// true or if it was already the active one. Must be called with mProjects held.
+func (sm *ApplicationContext) publishProject(projectContext *ProjectContext, active bool) {
+	sm.projects[projectContext.Project.ID] = projectContext
+
+	sm.mActiveProject.Lock()
+	if active || sm.activeProject.Project.ID == projectContext.Project.ID {
+		sm.activeProject = projectContext
+	}
+	sm.mActiveProject.Unlock()
+}
+
 func (sm *ApplicationContext) SetConfig(config Config) {
-	sm.Config = config
-	sm.Configure()
+	sm.mProjects.Lock()
+	defer sm.mProjects.Unlock()
+
+	projectContext := *sm.ActiveProject()
+	flagRegexChanged := projectContext.IsConfigured && projectContext.Config.FlagRegex != config.FlagRegex
+	projectContext.Config = config
+	sm.publishProject(sm.configureProject(&projectContext), false)
+	if flagRegexChanged {
+		if err := projectContext.RulesManager.SetFlag(context.Background(), config.FlagRegex); err != nil {
+			log.WithError(err).WithField("flag_regex", config.FlagRegex).Error("failed to update flag rules")
+		}
+	}
 	var upsertResults interface{}
-	if _, err := sm.Storage.Update(Settings).Upsert(&upsertResults).
+	if _, err := projectContext.Storage.Update(Settings).Upsert(&upsertResults).
 		Filter(OrderedDocument{{"_id", "config"}}).One(UnorderedDocument{"config": config}); err != nil {
 		log.WithError(err).WithField("config", config).Error("failed to update config")
 	}
 }
 
+// Accounts returns the accounts set during the setup. The returned map must not be modified.
+func (sm *ApplicationContext) Accounts() gin.Accounts {
+	sm.mAccounts.RLock()
+	defer sm.mAccounts.RUnlock()
+
+	return sm.accounts
+}
+
 func (sm *ApplicationContext) SetAccounts(accounts gin.Accounts) {
-	sm.Accounts = accounts
+	sm.mAccounts.Lock()
+	sm.accounts = accounts
+	sm.mAccounts.Unlock()
 	var upsertResults interface{}
-	if _, err := sm.Storage.Update(Settings).Upsert(&upsertResults).
+	if _, err := sm.accountsStorage.Update(Settings).Upsert(&upsertResults).
 		Filter(OrderedDocument{{"_id", "accounts"}}).One(UnorderedDocument{"accounts": accounts}); err != nil {
 		log.WithError(err).Error("failed to update accounts")
 	}
@@ -97,28 +190,279 @@ func (sm *ApplicationContext) SetNotificationController(notificationController *
 	sm.NotificationController = notificationController
 }
 
+// Configure starts the components of the active project, if its configuration is valid.
 func (sm *ApplicationContext) Configure() {
-	if sm.IsConfigured {
-		return
+	sm.mProjects.Lock()
+	defer sm.mProjects.Unlock()
+
+	projectContext := sm.ActiveProject()
+	if configured := sm.configureProject(projectContext); configured != projectContext {
+		sm.publishProject(configured, false)
 	}
-	if sm.Config.ServerAddress == "" || sm.Config.FlagRegex == "" {
-		return
+}
+
+// configureProject returns a copy of projectContext with the components started, or projectContext itself if it is
+// already configured or its configuration is not valid. The events of the components are tagged with the project.
+func (sm *ApplicationContext) configureProject(projectContext *ProjectContext) *ProjectContext {
+	if projectContext.IsConfigured {
+		return projectContext
+	}
+	if projectContext.Config.ServerAddress == "" || projectContext.Config.FlagRegex == "" {
+		return projectContext
 	}
-	serverNet := ParseIPNet(sm.Config.ServerAddress)
+	serverNet := projectContext.Config.ServerNetworks()
 	if serverNet == nil {
-		return
+		return projectContext
 	}
 
-	rulesManager, err := LoadRulesManager(sm.Storage, sm.Config.FlagRegex)
+	pc := *projectContext
+	notificationController := sm.NotificationController.ForProject(pc.Project.ID)
+	rulesManager, err := LoadRulesManager(pc.Storage, pc.Config.FlagRegex)
 	if err != nil {
 		log.WithError(err).Panic("failed to create a RulesManager")
 	}
-	sm.RulesManager = rulesManager
-	sm.PcapImporter = NewPcapImporter(sm.Storage, *serverNet, sm.RulesManager, sm.NotificationController)
-	sm.ServicesController = NewServicesController(sm.Storage)
-	sm.SearchController = NewSearchController(sm.Storage)
-	sm.ConnectionsController = NewConnectionsController(sm.Storage, sm.SearchController, sm.ServicesController)
-	sm.ConnectionStreamsController = NewConnectionStreamsController(sm.Storage)
-	sm.StatisticsController = NewStatisticsController(sm.Storage)
-	sm.IsConfigured = true
+	pc.RulesManager = rulesManager
+	pc.RulesRescanner = NewRulesRescanner(pc.Storage, pc.RulesManager, notificationController)
+	go pc.RulesRescanner.Run()
+	pc.ServicesController = NewServicesController(pc.Storage)
+	pc.ServicesDetector = NewServicesDetector(pc.Storage, pc.ServicesController, notificationController)
+	pc.StorageLimits = NewStorageLimits(pc.Storage)
+	pc.GeoIP = NewGeoIP(pc.Storage)
+	pc.IngestionFilters = NewIngestionFilters(pc.Storage)
+	pc.ScriptsController = NewScriptsController(pc.Storage, pc.RulesManager, notificationController)
+	go pc.ScriptsController.Run()
+	pc.PcapImporter = NewPcapImporter(pc.Storage, serverNet, pc.RulesManager, pc.ServicesDetector,
+		pc.StorageLimits, pc.GeoIP, pc.IngestionFilters, pc.ScriptsController, notificationController)
+	pc.LagWatchdog = NewLagWatchdog(pc.Storage, pc.PcapImporter, notificationController)
+	go pc.LagWatchdog.Run()
+	pc.CaptureSourcesController = NewCaptureSourcesController(pc.Storage, pc.PcapImporter, notificationController)
+	pc.SensorIngestion = NewSensorIngestion(pc.Storage, pc.PcapImporter, notificationController)
+	pc.InlineProxy = NewInlineProxy(pc.Storage, pc.PcapImporter, notificationController)
+	pc.QueryLimits = NewQueryLimits(pc.Storage)
+	pc.SearchController = NewSearchController(pc.Storage, pc.QueryLimits)
+	pc.ConnectionsController = NewConnectionsController(pc.Storage, pc.SearchController, pc.ServicesController,
+		pc.QueryLimits)
+	pc.ConnectionStreamsController = NewConnectionStreamsController(pc.Storage, pc.ServicesController)
+	pc.StatisticsController = NewStatisticsController(pc.Storage)
+	pc.BeaconsController = NewBeaconsController(pc.Storage, pc.ServicesController)
+	pc.RunnersController = NewRunnersController(pc.Storage, pc.ServicesController)
+	pc.ExploitsExporter = NewExploitsExporter(pc.Storage, sm.ExploitsDirectory, pc.ConnectionStreamsController,
+		pc.ServicesController, notificationController)
+	go pc.ExploitsExporter.Run()
+	pc.ExploitReplayer = NewExploitReplayer(pc.Storage, pc.ConnectionStreamsController, notificationController)
+	pc.RetentionJanitor = NewRetentionJanitor(pc.Storage, notificationController)
+	go pc.RetentionJanitor.Run()
+	pc.PayloadClassifiers = NewPayloadClassifiers(pc.Storage, sm.ClassifierExecutables, notificationController)
+	go pc.PayloadClassifiers.Run()
+	sm.registerReloadHandler(&pc, "exploits_exporter", pc.ExploitsExporter.ReloadSettings)
+	sm.registerReloadHandler(&pc, "services_detection", pc.ServicesDetector.ReloadSettings)
+	sm.registerReloadHandler(&pc, "storage_limits", pc.StorageLimits.ReloadSettings)
+	sm.registerReloadHandler(&pc, "ingestion_filters", pc.IngestionFilters.ReloadSettings)
+	sm.registerReloadHandler(&pc, "retention", pc.RetentionJanitor.ReloadSettings)
+	sm.registerReloadHandler(&pc, "geoip", pc.GeoIP.ReloadSettings)
+	sm.registerReloadHandler(&pc, "lag_watchdog", pc.LagWatchdog.ReloadSettings)
+	sm.registerReloadHandler(&pc, "classifiers", pc.PayloadClassifiers.ReloadSettings)
+	sm.registerReloadHandler(&pc, "query_limits", pc.QueryLimits.ReloadSettings)
+	sm.registerReloadHandler(&pc, "capture_sources", pc.CaptureSourcesController.ReloadSources)
+	sm.registerReloadHandler(&pc, "sensors", pc.SensorIngestion.ReloadSettings)
+	sm.registerReloadHandler(&pc, "proxy", pc.InlineProxy.ReloadSettings)
+	pc.IsConfigured = true
+
+	return &pc
+}
+
+// RegisterReloadHandler adds a function called on each Reload of the active project, used by the components which
+// keep their settings in memory to read them again from the database.
+func (sm *ApplicationContext) RegisterReloadHandler(name string, handler func() error) {
+	sm.registerReloadHandler(sm.ActiveProject(), name, handler)
+}
+
+func (sm *ApplicationContext) registerReloadHandler(projectContext *ProjectContext, name string,
+	handler func() error) {
+	sm.mReload.Lock()
+	defer sm.mReload.Unlock()
+
+	if projectContext.reloadHandlers == nil {
+		projectContext.reloadHandlers = make(map[string]func() error)
+	}
+	projectContext.reloadHandlers[name] = handler
+}
+
+// Reload reads again the accounts, the configuration and the settings of all the registered components of the active
+// project without restarting the application. The components which fail to reload keep the previous settings.
+func (sm *ApplicationContext) Reload() error {
+	sm.mProjects.Lock()
+	defer sm.mProjects.Unlock()
+
+	projectContext := *sm.ActiveProject()
+	config, err := loadConfig(projectContext.Storage)
+	if err != nil {
+		return err
+	}
+	accounts, err := loadAccounts(sm.accountsStorage)
+	if err != nil {
+		return err
+	}
+
+	if projectContext.IsConfigured && (config.ServerAddress != projectContext.Config.ServerAddress ||
+		strings.Join(config.ServerAddresses, ",") != strings.Join(projectContext.Config.ServerAddresses, ",")) {
+		log.WithField("server_address", config.ServerAddress).
+			Warn("server address can't be changed without restarting the application")
+		config.ServerAddress = projectContext.Config.ServerAddress
+		config.ServerAddresses = projectContext.Config.ServerAddresses
+	}
+	if projectContext.IsConfigured && config.FlagRegex != projectContext.Config.FlagRegex {
+		if err := projectContext.RulesManager.SetFlag(context.Background(), config.FlagRegex); err != nil {
+			log.WithError(err).WithField("flag_regex", config.FlagRegex).Error("failed to update flag rules")
+			config.FlagRegex = projectContext.Config.FlagRegex
+		}
+	}
+	projectContext.Config = config
+	sm.mAccounts.Lock()
+	sm.accounts = accounts
+	sm.mAccounts.Unlock()
+	// registers the reload handlers if the project was not configured yet, mReload must not be held
+	reloaded := sm.configureProject(&projectContext)
+	sm.publishProject(reloaded, false)
+
+	sm.mReload.Lock()
+	reloadHandlers := make(map[string]func() error, len(reloaded.reloadHandlers))
+	for name, handler := range reloaded.reloadHandlers {
+		reloadHandlers[name] = handler
+	}
+	sm.mReload.Unlock()
+
+	var failed []string
+	for name, handler := range reloadHandlers {
+		if err := handler(); err != nil {
+			log.WithError(err).WithField("component", name).Error("failed to reload settings")
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("failed to reload %s", strings.Join(failed, ", "))
+	}
+
+	log.Info("configuration reloaded")
+	return nil
+}
+
+// SwitchProject makes project the active project. The first time a project is activated its database is opened with
+// openStorage and its components are configured. The components of the previous project keep running.
+func (sm *ApplicationContext) SwitchProject(project Project, openStorage func(Project) (Storage, error)) error {
+	sm.mProjects.Lock()
+	defer sm.mProjects.Unlock()
+
+	projectContext, isPresent := sm.projects[project.ID]
+	if !isPresent {
+		storage, err := openStorage(project)
+		if err != nil {
+			return err
+		}
+		config, err := loadConfig(storage)
+		if err != nil {
+			return err
+		}
+		projectContext = &ProjectContext{
+			Project:        project,
+			Storage:        storage,
+			Config:         config,
+			reloadHandlers: make(map[string]func() error),
+		}
+	}
+
+	projectContext = sm.configureProject(projectContext)
+	if !projectContext.IsConfigured {
+		return errors.New("the project has an invalid configuration")
+	}
+	sm.publishProject(projectContext, true)
+	return nil
+}
+
+// Shutdown stops the capture sources, the sensors, the proxy and the rules rescans of all the projects, stops
+// accepting new pcaps and waits for the imports in progress to complete, then stops the rules workers.
+func (sm *ApplicationContext) Shutdown(c context.Context) error {
+	sm.mProjects.Lock()
+	defer sm.mProjects.Unlock()
+
+	var lastErr error
+	for _, projectContext := range sm.projects {
+		if err := projectContext.shutdown(c); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (pc *ProjectContext) shutdown(c context.Context) error {
+	if !pc.IsConfigured {
+		return nil
+	}
+
+	pc.CaptureSourcesController.StopAll()
+	pc.SensorIngestion.Stop()
+	pc.InlineProxy.Stop()
+	pc.RulesRescanner.Stop()
+	err := pc.PcapImporter.Drain(c)
+	pc.ScriptsController.Stop()
+	pc.LagWatchdog.Stop()
+	pc.ExploitsExporter.Stop()
+	pc.RetentionJanitor.Stop()
+	pc.PayloadClassifiers.Stop()
+	pc.RulesManager.Stop()
+	return err
+}
+
+func loadConfig(storage Storage) (Config, error) {
+	var configWrapper struct {
+		Config Config
+	}
+	if err := storage.Find(Settings).Filter(OrderedDocument{{"_id", "config"}}).
+		First(&configWrapper); err != nil {
+		return Config{}, err
+	}
+
+	return configWrapper.Config, nil
+}
+
+func loadAccounts(storage Storage) (gin.Accounts, error) {
+	var accountsWrapper struct {
+		Accounts gin.Accounts
+	}
+	if err := storage.Find(Settings).Filter(OrderedDocument{{"_id", "accounts"}}).
+		First(&accountsWrapper); err != nil {
+		return nil, err
+	}
+	if accountsWrapper.Accounts == nil {
+		accountsWrapper.Accounts = make(gin.Accounts)
+	}
+
+	return accountsWrapper.Accounts, nil
+}
+
+// LoadSettings reads the settings document identified by key and decodes it into value. If the settings have never
+// been saved value is left untouched, so callers can fill it with the defaults before.
+func LoadSettings(storage Storage, key string, value interface{}) error {
+	var document bson.Raw
+	if err := storage.Find(Settings).Filter(OrderedDocument{{"_id", key}}).First(&document); err != nil {
+		return err
+	}
+	if document == nil {
+		return nil
+	}
+
+	element, err := document.LookupErr(key)
+	if err != nil {
+		return nil
+	}
+	return element.Unmarshal(value)
+}
+
+// SaveSettings persists value as the settings document identified by key.
+func SaveSettings(storage Storage, key string, value interface{}) error {
+	var upsertResults interface{}
+	_, err := storage.Update(Settings).Upsert(&upsertResults).
+		Filter(OrderedDocument{{"_id", key}}).One(UnorderedDocument{key: value})
+	return err
 }
@@ -18,8 +18,11 @@
 package main
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
 	"testing"
 )
 
@@ -29,11 +32,11 @@ func TestCreateApplicationContext(t *testing.T) {
 
 	appContext, err := CreateApplicationContext(wrapper.Storage, "test")
 	assert.NoError(t, err)
-	assert.False(t, appContext.IsConfigured)
-	assert.Zero(t, appContext.Config)
-	assert.Len(t, appContext.Accounts, 0)
-	assert.Nil(t, appContext.PcapImporter)
-	assert.Nil(t, appContext.RulesManager)
+	assert.False(t, appContext.ActiveProject().IsConfigured)
+	assert.Zero(t, appContext.ActiveProject().Config)
+	assert.Len(t, appContext.Accounts(), 0)
+	assert.Nil(t, appContext.ActiveProject().PcapImporter)
+	assert.Nil(t, appContext.ActiveProject().RulesManager)
 
 	notificationController := NewNotificationController(appContext)
 	appContext.SetNotificationController(notificationController)
@@ -49,11 +52,11 @@ func TestCreateApplicationContext(t *testing.T) {
 	}
 	appContext.SetConfig(config)
 	appContext.SetAccounts(accounts)
-	assert.Equal(t, appContext.Config, config)
-	assert.Equal(t, appContext.Accounts, accounts)
-	assert.NotNil(t, appContext.PcapImporter)
-	assert.NotNil(t, appContext.RulesManager)
-	assert.True(t, appContext.IsConfigured)
+	assert.Equal(t, appContext.ActiveProject().Config, config)
+	assert.Equal(t, appContext.Accounts(), accounts)
+	assert.NotNil(t, appContext.ActiveProject().PcapImporter)
+	assert.NotNil(t, appContext.ActiveProject().RulesManager)
+	assert.True(t, appContext.ActiveProject().IsConfigured)
 
 	config.FlagRegex = "FLAG{test2}"
 	accounts["username"] = "password2"
@@ -64,12 +67,78 @@ func TestCreateApplicationContext(t *testing.T) {
 	assert.NoError(t, err)
 	checkAppContext.SetNotificationController(notificationController)
 	checkAppContext.Configure()
-	assert.True(t, checkAppContext.IsConfigured)
-	assert.Equal(t, checkAppContext.Config, config)
-	assert.Equal(t, checkAppContext.Accounts, accounts)
-	assert.NotNil(t, checkAppContext.PcapImporter)
-	assert.NotNil(t, checkAppContext.RulesManager)
+	assert.True(t, checkAppContext.ActiveProject().IsConfigured)
+	assert.Equal(t, checkAppContext.ActiveProject().Config, config)
+	assert.Equal(t, checkAppContext.Accounts(), accounts)
+	assert.NotNil(t, checkAppContext.ActiveProject().PcapImporter)
+	assert.NotNil(t, checkAppContext.ActiveProject().RulesManager)
 	assert.Equal(t, notificationController, appContext.NotificationController)
 
 	wrapper.Destroy(t)
 }
+
+func TestReloadApplicationContext(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Settings)
+
+	appContext, err := CreateApplicationContext(wrapper.Storage, "test")
+	require.NoError(t, err)
+	appContext.SetNotificationController(NewNotificationController(appContext))
+	appContext.SetConfig(Config{ServerAddress: "10.10.10.10", FlagRegex: "FLAG{test}"})
+	appContext.SetAccounts(gin.Accounts{"username": "password"})
+
+	reloaded := 0
+	appContext.RegisterReloadHandler("test", func() error {
+		reloaded++
+		return nil
+	})
+
+	require.NoError(t, SaveSettings(wrapper.Storage, "config",
+		Config{ServerAddress: "10.10.10.11", FlagRegex: "FLAG{test}", AuthRequired: true}))
+	require.NoError(t, SaveSettings(wrapper.Storage, "accounts", gin.Accounts{"username": "password2"}))
+
+	assert.NoError(t, appContext.Reload())
+	assert.Equal(t, 1, reloaded)
+	assert.Equal(t, Config{ServerAddress: "10.10.10.10", FlagRegex: "FLAG{test}", AuthRequired: true},
+		appContext.ActiveProject().Config)
+	assert.Equal(t, gin.Accounts{"username": "password2"}, appContext.Accounts())
+
+	appContext.RegisterReloadHandler("failing", func() error {
+		return errors.New("failed")
+	})
+	assert.Error(t, appContext.Reload())
+	assert.Equal(t, 2, reloaded)
+
+	wrapper.Destroy(t)
+}
+
+func TestReloadUnconfiguredApplicationContext(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Settings)
+
+	appContext, err := CreateApplicationContext(wrapper.Storage, "test")
+	require.NoError(t, err)
+	appContext.SetNotificationController(NewNotificationController(appContext))
+	require.False(t, appContext.ActiveProject().IsConfigured)
+
+	require.NoError(t, SaveSettings(wrapper.Storage, "config", Config{ServerAddress: "10.10.10.10",
+		FlagRegex: "FLAG{test}"}))
+	assert.NoError(t, appContext.Reload()) // Configure registers the reload handlers while reloading
+	assert.True(t, appContext.ActiveProject().IsConfigured)
+	assert.NotNil(t, appContext.ActiveProject().RulesManager)
+
+	wrapper.Destroy(t)
+}
+
+func TestServerNetworks(t *testing.T) {
+	networks := Config{ServerAddress: "10.60.1.1", ServerAddresses: []string{"fd00:60:1::/64"}}.ServerNetworks()
+	require.Len(t, networks, 2)
+	assert.True(t, networks.Contains(net.ParseIP("10.60.1.1")))
+	assert.True(t, networks.Contains(net.ParseIP("fd00:60:1::5")))
+	assert.False(t, networks.Contains(net.ParseIP("10.60.1.2")))
+	assert.False(t, networks.Contains(net.ParseIP("fd00:60:2::5")))
+
+	assert.Nil(t, Config{ServerAddress: "10.60.1.1", ServerAddresses: []string{"invalid"}}.ServerNetworks())
+	assert.Equal(t, []byte(net.ParseIP("::ffff:10.0.0.1")), ipBytes("10.0.0.1"))
+	assert.Nil(t, ipBytes("invalid"))
+}
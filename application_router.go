@@ -18,11 +18,14 @@
 package main
 
 import (
+	"crypto/subtle"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,11 +34,27 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const authUserKey = "auth_user"
+
+// projectContextKey is the key of the context of the active project, resolved once for each request
+const projectContextKey = "project_context"
+
+// partialResultsHeader is set when a list is incomplete because the query exceeded the query limits
+const partialResultsHeader = "X-Partial-Results"
+
+// nextCursorHeader contains the cursor of the next page of a list, when there can be other elements
+const nextCursorHeader = "X-Next-Cursor"
+
+// readOnlyPostPaths are the routes that the read-only users can call also if the method is not GET
+var readOnlyPostPaths = []string{"/api/auth/logout", "/api/searches/perform", "/api/rules/estimate",
+	"/api/connections/:id/similar"}
+
 func CreateApplicationRouter(applicationContext *ApplicationContext,
 	notificationController *NotificationController, resourcesController *ResourcesController) *gin.Engine {
 	router := gin.New()
 	router.Use(gin.Logger())
 	router.Use(gin.Recovery())
+	router.Use(ProjectContextMiddleware(applicationContext))
 	router.MaxMultipartMemory = 8 << 30
 
 	router.Use(static.Serve("/", static.LocalFile("./frontend/build", true)))
@@ -47,7 +66,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 	}
 
 	router.POST("/setup", func(c *gin.Context) {
-		if applicationContext.IsConfigured {
+		if activeProject(c).IsConfigured {
 			c.AbortWithStatus(http.StatusNotFound)
 			return
 		}
@@ -69,18 +88,162 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 		notificationController.Notify("setup", gin.H{})
 	})
 
-	router.GET("/ws", func(c *gin.Context) {
-		if err := notificationController.NotificationHandler(c.Writer, c.Request); err != nil {
+	router.POST("/api/auth/login", SetupRequiredMiddleware(applicationContext), func(c *gin.Context) {
+		var credentials struct {
+			Username string `json:"username" binding:"required"`
+			Password string `json:"password" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&credentials); err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		user, authenticated := checkCredentials(applicationContext, credentials.Username, credentials.Password)
+		if !authenticated {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+			return
+		}
+		if token, err := applicationContext.AuthController.IssueToken(c, user); err != nil {
 			serverError(c, err)
+		} else {
+			success(c, token)
 		}
 	})
 
+	router.GET("/metrics", SetupRequiredMiddleware(applicationContext), AuthRequiredMiddleware(applicationContext),
+		func(c *gin.Context) {
+			c.Data(http.StatusOK, metricsContentType, []byte(CollectMetrics(activeProject(c))))
+		})
+
 	api := router.Group("/api")
 	api.Use(SetupRequiredMiddleware(applicationContext))
 	api.Use(AuthRequiredMiddleware(applicationContext))
 	{
+		api.GET("/ws", func(c *gin.Context) {
+			if err := notificationController.NotificationHandler(c.Writer, c.Request); err != nil {
+				serverError(c, err)
+			}
+		})
+
+		api.POST("/auth/logout", func(c *gin.Context) {
+			authorization := c.GetHeader("Authorization")
+			if !strings.HasPrefix(authorization, "Bearer ") {
+				badRequest(c, errors.New("bearer token required"))
+				return
+			}
+
+			if applicationContext.AuthController.RevokeToken(c, strings.TrimPrefix(authorization, "Bearer ")) {
+				success(c, gin.H{})
+			} else {
+				notFound(c, gin.H{})
+			}
+		})
+
+		api.GET("/auth/me", func(c *gin.Context) {
+			if user, ok := c.Get(authUserKey); ok {
+				success(c, user)
+			} else {
+				success(c, User{Role: RoleAdmin}) // auth not required
+			}
+		})
+
+		users := api.Group("/users")
+		users.Use(AdminRequiredMiddleware(applicationContext))
+		{
+			users.GET("", func(c *gin.Context) {
+				success(c, applicationContext.AuthController.GetUsers())
+			})
+
+			users.POST("", func(c *gin.Context) {
+				var newUser NewUser
+				if err := c.ShouldBindJSON(&newUser); err != nil {
+					badRequest(c, err)
+					return
+				}
+
+				if user, err := applicationContext.AuthController.CreateUser(c, newUser); err != nil {
+					unprocessableEntity(c, err)
+				} else {
+					success(c, user)
+					notificationController.Notify("users.new", user)
+				}
+			})
+
+			users.DELETE("/:username", func(c *gin.Context) {
+				username := c.Param("username")
+				if applicationContext.AuthController.DeleteUser(c, username) {
+					success(c, gin.H{"username": username})
+					notificationController.Notify("users.delete", gin.H{"username": username})
+				} else {
+					notFound(c, gin.H{"username": username})
+				}
+			})
+		}
+
+		projects := api.Group("/projects")
+		{
+			projects.GET("", func(c *gin.Context) {
+				success(c, applicationContext.ProjectsController.GetProjects())
+			})
+
+			projects.GET("/active", func(c *gin.Context) {
+				success(c, applicationContext.ProjectsController.GetActiveProject())
+			})
+
+			projects.POST("", AdminRequiredMiddleware(applicationContext), func(c *gin.Context) {
+				var newProject NewProject
+				if err := c.ShouldBindJSON(&newProject); err != nil {
+					badRequest(c, err)
+					return
+				}
+
+				if project, err := applicationContext.ProjectsController.CreateProject(c, newProject); err != nil {
+					unprocessableEntity(c, err)
+				} else {
+					success(c, project)
+					notificationController.Notify("projects.new", project)
+				}
+			})
+
+			projects.POST("/:id/activate", AdminRequiredMiddleware(applicationContext), func(c *gin.Context) {
+				id, err := RowIDFromHex(c.Param("id"))
+				if err != nil {
+					badRequest(c, err)
+					return
+				}
+
+				if isPresent, err := applicationContext.ProjectsController.ActivateProject(id); err != nil {
+					unprocessableEntity(c, err)
+				} else if !isPresent {
+					notFound(c, gin.H{"id": id})
+				} else {
+					project := applicationContext.ProjectsController.GetActiveProject()
+					success(c, project)
+					notificationController.Notify("projects.activate", project)
+				}
+			})
+		}
+
 		api.GET("/rules", func(c *gin.Context) {
-			success(c, applicationContext.RulesManager.GetRules())
+			var filter struct {
+				Archived bool `form:"archived"`
+			}
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			rules := activeProject(c).RulesManager.GetRules()
+			if !filter.Archived {
+				active := make([]Rule, 0, len(rules))
+				for _, rule := range rules {
+					if !rule.Archived {
+						active = append(active, rule)
+					}
+				}
+				rules = active
+			}
+			success(c, rules)
 		})
 
 		api.POST("/rules", func(c *gin.Context) {
@@ -91,15 +254,163 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				return
 			}
 
-			if id, err := applicationContext.RulesManager.AddRule(c, rule); err != nil {
+			if id, err := activeProject(c).RulesManager.AddRule(c, rule); err == ErrRulesNotSaved {
+				serverError(c, err)
+			} else if err != nil {
 				unprocessableEntity(c, err)
 			} else {
-				response := UnorderedDocument{"id": id}
+				response := UnorderedDocument{"id": id, "status": activeProject(c).RulesManager.GetStatus().Status}
+				if rescan, err := activeProject(c).RulesRescanner.Rescan(id); err != nil {
+					log.WithError(err).WithField("rule_id", id).Warn("failed to schedule the rescan of a new rule")
+				} else {
+					response["rescan"] = rescan
+				}
 				success(c, response)
 				notificationController.Notify("rules.new", response)
 			}
 		})
 
+		api.POST("/rules/bulk", func(c *gin.Context) {
+			var request struct {
+				Operations []RuleOperation `json:"operations" binding:"required,min=1,dive"`
+			}
+			if err := c.ShouldBindJSON(&request); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			results, err := activeProject(c).RulesManager.BulkRules(c, request.Operations)
+			if err != nil {
+				c.JSON(http.StatusUnprocessableEntity, UnorderedDocument{"result": "error", "error": err.Error(),
+					"results": results})
+			} else {
+				response := UnorderedDocument{"results": results,
+					"status": activeProject(c).RulesManager.GetStatus().Status}
+				success(c, response)
+				notificationController.Notify("rules.bulk", response)
+			}
+		})
+
+		api.GET("/rules/status", func(c *gin.Context) {
+			success(c, activeProject(c).RulesManager.GetStatus())
+		})
+
+		api.GET("/rules/scanner", func(c *gin.Context) {
+			success(c, activeProject(c).PcapImporter.ScannerMetrics())
+		})
+
+		api.GET("/rules/budget", func(c *gin.Context) {
+			success(c, activeProject(c).RulesManager.GetBudget())
+		})
+
+		api.POST("/rules/estimate", func(c *gin.Context) {
+			var request struct {
+				Patterns []Pattern `json:"patterns" binding:"required,min=1"`
+			}
+			if err := c.ShouldBindJSON(&request); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if budget, err := activeProject(c).RulesManager.EstimateRule(Rule{Patterns: request.Patterns}); err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				success(c, budget)
+			}
+		})
+
+		api.GET("/rules/groups", func(c *gin.Context) {
+			success(c, activeProject(c).RulesManager.GetRuleGroups())
+		})
+
+		api.POST("/rules/groups", func(c *gin.Context) {
+			var group RuleGroup
+			if err := c.ShouldBindJSON(&group); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if id, err := activeProject(c).RulesManager.AddRuleGroup(c, group); err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				group.ID = id
+				success(c, group)
+				notificationController.Notify("rules.group_new", group)
+			}
+		})
+
+		api.GET("/rules/groups/:id", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			if group, isPresent := activeProject(c).RulesManager.GetRuleGroup(id); isPresent {
+				success(c, group)
+			} else {
+				notFound(c, UnorderedDocument{"id": id})
+			}
+		})
+
+		api.PUT("/rules/groups/:id", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			var group RuleGroup
+			if err := c.ShouldBindJSON(&group); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			isPresent, err := activeProject(c).RulesManager.UpdateRuleGroup(c, id, group)
+			if err != nil {
+				unprocessableEntity(c, err)
+			} else if !isPresent {
+				notFound(c, UnorderedDocument{"id": id})
+			} else {
+				group.ID = id
+				success(c, group)
+				notificationController.Notify("rules.group_edit", group)
+			}
+		})
+
+		api.DELETE("/rules/groups/:id", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if isPresent, _ := activeProject(c).RulesManager.DeleteRuleGroup(c, id); !isPresent {
+				notFound(c, UnorderedDocument{"id": id})
+			} else {
+				success(c, UnorderedDocument{"id": id})
+				notificationController.Notify("rules.group_delete", UnorderedDocument{"id": id})
+			}
+		})
+
+		for _, action := range []string{RuleOperationEnable, RuleOperationDisable} {
+			enabled := action == RuleOperationEnable
+			api.POST("/rules/groups/:id/"+action, func(c *gin.Context) {
+				id, err := RowIDFromHex(c.Param("id"))
+				if err != nil {
+					badRequest(c, err)
+					return
+				}
+
+				if changed, isPresent := activeProject(c).RulesManager.SetRuleGroupEnabled(c, id,
+					enabled); !isPresent {
+					notFound(c, UnorderedDocument{"id": id})
+				} else {
+					response := UnorderedDocument{"id": id, "enabled": enabled, "rules": changed}
+					success(c, response)
+					notificationController.Notify("rules.group_toggle", response)
+				}
+			})
+		}
+
 		api.GET("/rules/:id", func(c *gin.Context) {
 			hex := c.Param("id")
 			id, err := RowIDFromHex(hex)
@@ -107,7 +418,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				badRequest(c, err)
 				return
 			}
-			rule, found := applicationContext.RulesManager.GetRule(id)
+			rule, found := activeProject(c).RulesManager.GetRule(id)
 			if !found {
 				notFound(c, UnorderedDocument{"id": id})
 			} else {
@@ -128,8 +439,10 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				return
 			}
 
-			isPresent, err := applicationContext.RulesManager.UpdateRule(c, id, rule)
-			if err != nil {
+			isPresent, err := activeProject(c).RulesManager.UpdateRule(c, id, rule)
+			if err == ErrRulesNotSaved {
+				serverError(c, err)
+			} else if err != nil {
 				badRequest(c, err)
 			} else if !isPresent {
 				notFound(c, UnorderedDocument{"id": id})
@@ -139,6 +452,57 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
+		api.GET("/rules/rescans", func(c *gin.Context) {
+			success(c, activeProject(c).RulesRescanner.GetRescans())
+		})
+
+		api.POST("/rules/:id/rescan", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			if _, isPresent := activeProject(c).RulesManager.GetRule(id); !isPresent {
+				notFound(c, UnorderedDocument{"id": id})
+				return
+			}
+
+			if rescan, err := activeProject(c).RulesRescanner.Rescan(id); err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				c.JSON(http.StatusAccepted, rescan)
+				notificationController.Notify("rules.rescan", rescan)
+			}
+		})
+
+		api.GET("/rules/:id/rescan", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			if rescan, isPresent := activeProject(c).RulesRescanner.GetRescan(id); isPresent {
+				success(c, rescan)
+			} else {
+				notFound(c, UnorderedDocument{"id": id})
+			}
+		})
+
+		api.DELETE("/rules/:id/rescan", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			if activeProject(c).RulesRescanner.CancelRescan(id) {
+				rescan, _ := activeProject(c).RulesRescanner.GetRescan(id)
+				c.JSON(http.StatusAccepted, rescan)
+				notificationController.Notify("rules.rescan", rescan)
+			} else {
+				notFound(c, UnorderedDocument{"id": id})
+			}
+		})
+
 		api.POST("/pcap/upload", func(c *gin.Context) {
 			fileHeader, err := c.FormFile("file")
 			if err != nil {
@@ -147,12 +511,14 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 			flushAllValue, isPresent := c.GetPostForm("flush_all")
 			flushAll := isPresent && strings.ToLower(flushAllValue) == "true"
+			bpfFilter := c.PostForm("bpf_filter")
 			fileName := fmt.Sprintf("%v-%s", time.Now().UnixNano(), fileHeader.Filename)
 			if err := c.SaveUploadedFile(fileHeader, ProcessingPcapsBasePath+fileName); err != nil {
 				log.WithError(err).Panic("failed to save uploaded file")
 			}
 
-			if sessionID, err := applicationContext.PcapImporter.ImportPcap(fileName, flushAll); err != nil {
+			if sessionID, err := activeProject(c).PcapImporter.ImportPcapWithFilter(fileName, flushAll,
+				bpfFilter); err != nil {
 				unprocessableEntity(c, err)
 			} else {
 				response := gin.H{"session": sessionID}
@@ -166,6 +532,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				File               string `json:"file"`
 				FlushAll           bool   `json:"flush_all"`
 				DeleteOriginalFile bool   `json:"delete_original_file"`
+				BPFFilter          string `json:"bpf_filter" binding:"max=1024"`
 			}
 
 			if err := c.ShouldBindJSON(&request); err != nil {
@@ -181,7 +548,8 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			if err := CopyFile(ProcessingPcapsBasePath+fileName, request.File); err != nil {
 				log.WithError(err).Panic("failed to copy pcap file")
 			}
-			if sessionID, err := applicationContext.PcapImporter.ImportPcap(fileName, request.FlushAll); err != nil {
+			if sessionID, err := activeProject(c).PcapImporter.ImportPcapWithFilter(fileName, request.FlushAll,
+				request.BPFFilter); err != nil {
 				if request.DeleteOriginalFile {
 					if err := os.Remove(request.File); err != nil {
 						log.WithError(err).Panic("failed to remove processed file")
@@ -195,22 +563,37 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
-		api.GET("/pcap/sessions", func(c *gin.Context) {
-			success(c, applicationContext.PcapImporter.GetSessions())
-		})
-
-		api.GET("/pcap/sessions/:id", func(c *gin.Context) {
+		getSessions := func(c *gin.Context) {
+			success(c, activeProject(c).PcapImporter.GetSessions())
+		}
+		getSession := func(c *gin.Context) {
 			sessionID := c.Param("id")
-			if session, isPresent := applicationContext.PcapImporter.GetSession(sessionID); isPresent {
+			if session, isPresent := activeProject(c).PcapImporter.GetSession(sessionID); isPresent {
 				success(c, session)
 			} else {
 				notFound(c, gin.H{"session": sessionID})
 			}
-		})
+		}
+		cancelSession := func(c *gin.Context) {
+			sessionID := c.Param("id")
+			session := gin.H{"session": sessionID}
+			if cancelled := activeProject(c).PcapImporter.CancelSession(sessionID); cancelled {
+				c.JSON(http.StatusAccepted, session)
+				notificationController.Notify("sessions.delete", session)
+			} else {
+				notFound(c, session)
+			}
+		}
+
+		api.GET("/pcap/sessions", getSessions)
+		api.GET("/pcap/sessions/:id", getSession)
+		api.GET("/pcap/jobs", getSessions)
+		api.GET("/pcap/jobs/:id", getSession)
+		api.DELETE("/pcap/jobs/:id", cancelSession)
 
 		api.GET("/pcap/sessions/:id/download", func(c *gin.Context) {
 			sessionID := c.Param("id")
-			if _, isPresent := applicationContext.PcapImporter.GetSession(sessionID); isPresent {
+			if _, isPresent := activeProject(c).PcapImporter.GetSession(sessionID); isPresent {
 				if FileExists(PcapsBasePath + sessionID + ".pcap") {
 					c.FileAttachment(PcapsBasePath+sessionID+".pcap", sessionID[:16]+".pcap")
 				} else if FileExists(PcapsBasePath + sessionID + ".pcapng") {
@@ -223,64 +606,415 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
-		api.DELETE("/pcap/sessions/:id", func(c *gin.Context) {
-			sessionID := c.Param("id")
-			session := gin.H{"session": sessionID}
-			if cancelled := applicationContext.PcapImporter.CancelSession(sessionID); cancelled {
-				c.JSON(http.StatusAccepted, session)
-				notificationController.Notify("sessions.delete", session)
-			} else {
-				notFound(c, session)
-			}
+		api.DELETE("/pcap/sessions/:id", cancelSession)
+
+		api.GET("/capture_sources", func(c *gin.Context) {
+			success(c, activeProject(c).CaptureSourcesController.GetSources())
 		})
 
-		api.GET("/connections", func(c *gin.Context) {
-			var filter ConnectionsFilter
-			if err := c.ShouldBindQuery(&filter); err != nil {
+		api.POST("/capture_sources", func(c *gin.Context) {
+			var source CaptureSource
+			if err := c.ShouldBindJSON(&source); err != nil {
 				badRequest(c, err)
 				return
 			}
-			success(c, applicationContext.ConnectionsController.GetConnections(c, filter))
+
+			if id, err := activeProject(c).CaptureSourcesController.AddSource(c, source); err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				response := UnorderedDocument{"id": id}
+				success(c, response)
+				notificationController.Notify("capture_sources.new", response)
+			}
 		})
 
-		api.GET("/connections/:id", func(c *gin.Context) {
+		api.GET("/capture_sources/:id", func(c *gin.Context) {
 			if id, err := RowIDFromHex(c.Param("id")); err != nil {
 				badRequest(c, err)
+			} else if source, isPresent := activeProject(c).CaptureSourcesController.GetSource(id); isPresent {
+				success(c, source)
 			} else {
-				if connection, isPresent := applicationContext.ConnectionsController.GetConnection(c, id); isPresent {
-					success(c, connection)
-				} else {
-					notFound(c, gin.H{"connection": id})
-				}
+				notFound(c, gin.H{"id": id})
 			}
 		})
 
-		api.POST("/connections/:id/:action", func(c *gin.Context) {
+		api.PUT("/capture_sources/:id", func(c *gin.Context) {
 			id, err := RowIDFromHex(c.Param("id"))
 			if err != nil {
 				badRequest(c, err)
 				return
 			}
+			var source CaptureSource
+			if err := c.ShouldBindJSON(&source); err != nil {
+				badRequest(c, err)
+				return
+			}
 
-			var result bool
-			switch action := c.Param("action"); action {
-			case "hide":
-				result = applicationContext.ConnectionsController.SetHidden(c, id, true)
-			case "show":
-				result = applicationContext.ConnectionsController.SetHidden(c, id, false)
-			case "mark":
-				result = applicationContext.ConnectionsController.SetMarked(c, id, true)
-			case "unmark":
-				result = applicationContext.ConnectionsController.SetMarked(c, id, false)
-			case "comment":
-				var comment struct {
-					Comment string `json:"comment"`
-				}
-				if err := c.ShouldBindJSON(&comment); err != nil {
-					badRequest(c, err)
-					return
+			isPresent, err := activeProject(c).CaptureSourcesController.UpdateSource(c, id, source)
+			if err != nil {
+				unprocessableEntity(c, err)
+			} else if !isPresent {
+				notFound(c, gin.H{"id": id})
+			} else {
+				source, _ := activeProject(c).CaptureSourcesController.GetSource(id)
+				success(c, source)
+				notificationController.Notify("capture_sources.edit", source)
+			}
+		})
+
+		api.DELETE("/capture_sources/:id", func(c *gin.Context) {
+			if id, err := RowIDFromHex(c.Param("id")); err != nil {
+				badRequest(c, err)
+			} else if activeProject(c).CaptureSourcesController.DeleteSource(c, id) {
+				success(c, gin.H{"id": id})
+				notificationController.Notify("capture_sources.delete", gin.H{"id": id})
+			} else {
+				notFound(c, gin.H{"id": id})
+			}
+		})
+
+		api.POST("/capture_sources/:id/:action", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			var enabled bool
+			switch c.Param("action") {
+			case "enable":
+				enabled = true
+			case "disable":
+				enabled = false
+			default:
+				badRequest(c, errors.New("invalid action"))
+				return
+			}
+
+			if activeProject(c).CaptureSourcesController.SetEnabled(c, id, enabled) {
+				source, _ := activeProject(c).CaptureSourcesController.GetSource(id)
+				success(c, source)
+				notificationController.Notify("capture_sources.edit", source)
+			} else {
+				notFound(c, gin.H{"id": id})
+			}
+		})
+
+		api.GET("/sensors", func(c *gin.Context) {
+			success(c, activeProject(c).SensorIngestion.GetSensors())
+		})
+
+		api.GET("/settings/sensors", func(c *gin.Context) {
+			success(c, activeProject(c).SensorIngestion.GetSettings())
+		})
+
+		api.PUT("/settings/sensors", func(c *gin.Context) {
+			var settings SensorsSettings
+			if err := c.ShouldBindJSON(&settings); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if err := activeProject(c).SensorIngestion.SetSettings(settings); err == errEmptySensorsToken {
+				unprocessableEntity(c, err)
+			} else if err != nil {
+				serverError(c, err)
+			} else {
+				settings = activeProject(c).SensorIngestion.GetSettings()
+				success(c, settings)
+				notificationController.Notify("settings.sensors", settings)
+			}
+		})
+
+		api.GET("/proxy", func(c *gin.Context) {
+			success(c, activeProject(c).InlineProxy.GetListeners())
+		})
+
+		api.GET("/settings/proxy", func(c *gin.Context) {
+			success(c, activeProject(c).InlineProxy.GetSettings())
+		})
+
+		api.PUT("/settings/proxy", func(c *gin.Context) {
+			var settings ProxySettings
+			if err := c.ShouldBindJSON(&settings); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if err := activeProject(c).InlineProxy.SetSettings(settings); err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				settings = activeProject(c).InlineProxy.GetSettings()
+				success(c, settings)
+				notificationController.Notify("settings.proxy", settings)
+			}
+		})
+
+		scripts := api.Group("/scripts")
+		{
+			scripts.GET("", func(c *gin.Context) {
+				success(c, activeProject(c).ScriptsController.GetScripts())
+			})
+
+			scripts.POST("", AdminRequiredMiddleware(applicationContext), func(c *gin.Context) {
+				var script Script
+				if err := c.ShouldBindJSON(&script); err != nil {
+					badRequest(c, err)
+					return
+				}
+
+				if id, err := activeProject(c).ScriptsController.AddScript(c, script); err != nil {
+					unprocessableEntity(c, err)
+				} else {
+					response := UnorderedDocument{"id": id}
+					success(c, response)
+					notificationController.Notify("scripts.new", response)
+				}
+			})
+
+			scripts.GET("/:id", func(c *gin.Context) {
+				if id, err := RowIDFromHex(c.Param("id")); err != nil {
+					badRequest(c, err)
+				} else if script, isPresent := activeProject(c).ScriptsController.GetScript(id); isPresent {
+					success(c, script)
+				} else {
+					notFound(c, gin.H{"id": id})
+				}
+			})
+
+			scripts.PUT("/:id", AdminRequiredMiddleware(applicationContext), func(c *gin.Context) {
+				id, err := RowIDFromHex(c.Param("id"))
+				if err != nil {
+					badRequest(c, err)
+					return
+				}
+				var script Script
+				if err := c.ShouldBindJSON(&script); err != nil {
+					badRequest(c, err)
+					return
+				}
+
+				isPresent, err := activeProject(c).ScriptsController.UpdateScript(c, id, script)
+				if err != nil {
+					unprocessableEntity(c, err)
+				} else if !isPresent {
+					notFound(c, gin.H{"id": id})
+				} else {
+					script, _ := activeProject(c).ScriptsController.GetScript(id)
+					success(c, script)
+					notificationController.Notify("scripts.edit", script)
 				}
-				result = applicationContext.ConnectionsController.SetComment(c, id, comment.Comment)
+			})
+
+			scripts.DELETE("/:id", AdminRequiredMiddleware(applicationContext), func(c *gin.Context) {
+				if id, err := RowIDFromHex(c.Param("id")); err != nil {
+					badRequest(c, err)
+				} else if activeProject(c).ScriptsController.DeleteScript(c, id) {
+					success(c, gin.H{"id": id})
+					notificationController.Notify("scripts.delete", gin.H{"id": id})
+				} else {
+					notFound(c, gin.H{"id": id})
+				}
+			})
+		}
+
+		api.GET("/extractions", func(c *gin.Context) {
+			var filter ExtractionsFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			success(c, activeProject(c).ScriptsController.GetExtractions(c, filter))
+		})
+
+		api.GET("/connections", func(c *gin.Context) {
+			var filter ConnectionsFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+			filter = withRuleGroup(activeProject(c).RulesManager, filter)
+			page, err := activeProject(c).ConnectionsController.GetConnections(c, filter)
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			if page.Partial {
+				c.Header(partialResultsHeader, "true")
+			}
+			if page.NextCursor != "" {
+				c.Header(nextCursorHeader, page.NextCursor)
+			}
+			success(c, page.Connections)
+		})
+
+		api.GET("/connections/export", func(c *gin.Context) {
+			var filter ConnectionsFilter
+			var options struct {
+				Payloads bool `form:"payloads"`
+			}
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+			if err := c.ShouldBindQuery(&options); err != nil {
+				badRequest(c, err)
+				return
+			}
+			if err := filter.Validate(); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			filter = withRuleGroup(activeProject(c).RulesManager, filter)
+			c.Header("Content-Type", "application/zip")
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"connections-%d.zip\"",
+				time.Now().Unix()))
+			if err := activeProject(c).ConnectionsController.ExportConnections(c, filter, options.Payloads,
+				c.Writer); err != nil {
+				log.WithError(err).Error("failed to export connections")
+			}
+		})
+
+		api.GET("/connections/:id", func(c *gin.Context) {
+			var filter struct {
+				AsOf int64 `form:"as_of"`
+			}
+			if id, err := RowIDFromHex(c.Param("id")); err != nil {
+				badRequest(c, err)
+			} else if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+			} else {
+				connection, isPresent := activeProject(c).ConnectionsController.GetConnection(c, id)
+				if isPresent && filter.AsOf > 0 && connection.ProcessedAt.After(time.Unix(filter.AsOf, 0)) {
+					isPresent = false // the connection was not known yet at as_of
+				}
+				if isPresent {
+					success(c, connection)
+				} else {
+					notFound(c, gin.H{"connection": id})
+				}
+			}
+		})
+
+		api.GET("/connections/:id/diff", func(c *gin.Context) {
+			if id, err := RowIDFromHex(c.Param("id")); err != nil {
+				badRequest(c, err)
+			} else if diff, isPresent, err := activeProject(c).ConnectionStreamsController.
+				DiffWithGolden(c, id); !isPresent {
+				notFound(c, gin.H{"connection": id})
+			} else if err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				success(c, diff)
+			}
+		})
+
+		api.PATCH("/connections/:id", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			var update ConnectionUpdate
+			if err := c.ShouldBindJSON(&update); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if updated, err := activeProject(c).ConnectionsController.UpdateConnection(c, id, update); err != nil {
+				badRequest(c, err)
+			} else if !updated {
+				notFound(c, gin.H{"connection": id})
+			} else {
+				connection, _ := activeProject(c).ConnectionsController.GetConnection(c, id)
+				success(c, connection)
+				notificationController.Notify("connections.edit", connection)
+			}
+		})
+
+		api.POST("/connections/:id/similar", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			var options SimilarConnectionsOptions
+			if err := c.ShouldBindJSON(&options); err != nil && err != io.EOF {
+				badRequest(c, err)
+				return
+			}
+
+			if similar, found := activeProject(c).ConnectionsController.FindSimilarConnections(c, id,
+				options); !found {
+				notFound(c, gin.H{"connection": id})
+			} else {
+				success(c, similar)
+			}
+		})
+
+		api.POST("/connections/:id/replay", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			var options ReplayOptions
+			if err := c.ShouldBindJSON(&options); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if result, found := activeProject(c).ExploitReplayer.Replay(c, id, options); !found {
+				notFound(c, gin.H{"connection": id})
+			} else if result.ReplayedID.IsZero() {
+				unprocessableEntity(c, errors.New(result.Error))
+			} else {
+				success(c, result)
+			}
+		})
+
+		api.POST("/connections/:id/classify", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if classifications, found := activeProject(c).PayloadClassifiers.ClassifyConnection(c,
+				id); !found {
+				notFound(c, gin.H{"connection": id})
+			} else {
+				success(c, classifications)
+			}
+		})
+
+		api.POST("/connections/:id/:action", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			var result bool
+			switch action := c.Param("action"); action {
+			case "hide":
+				result = activeProject(c).ConnectionsController.SetHidden(c, id, true)
+			case "show":
+				result = activeProject(c).ConnectionsController.SetHidden(c, id, false)
+			case "mark":
+				result = activeProject(c).ConnectionsController.SetMarked(c, id, true)
+			case "unmark":
+				result = activeProject(c).ConnectionsController.SetMarked(c, id, false)
+			case "comment":
+				var comment struct {
+					Comment string `json:"comment"`
+				}
+				if err := c.ShouldBindJSON(&comment); err != nil {
+					badRequest(c, err)
+					return
+				}
+				result = activeProject(c).ConnectionsController.SetComment(c, id, comment.Comment)
 			default:
 				badRequest(c, errors.New("invalid action"))
 				return
@@ -296,7 +1030,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 		})
 
 		api.GET("/searches", func(c *gin.Context) {
-			success(c, applicationContext.SearchController.GetPerformedSearches())
+			success(c, activeProject(c).SearchController.GetPerformedSearches())
 		})
 
 		api.POST("/searches/perform", func(c *gin.Context) {
@@ -326,54 +1060,187 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				}
 			}
 
-			if badContentError != nil {
-				badRequest(c, badContentError)
+			if badContentError != nil {
+				badRequest(c, badContentError)
+				return
+			}
+
+			success(c, activeProject(c).SearchController.PerformSearch(c, options))
+		})
+
+		api.GET("/streams/:id", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			var format GetMessageFormat
+			if err := c.ShouldBindQuery(&format); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if messages, found := activeProject(c).ConnectionStreamsController.GetConnectionMessages(c, id, format); !found {
+				notFound(c, gin.H{"connection": id})
+			} else {
+				success(c, messages)
+			}
+		})
+
+		api.GET("/streams/:id/payload", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			var request PayloadRequest
+			if err := c.ShouldBindQuery(&request); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			payload, found, err := activeProject(c).ConnectionStreamsController.GetStreamPayload(c, id, request)
+			if !found {
+				notFound(c, gin.H{"connection": id})
+			} else if err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				success(c, payload)
+			}
+		})
+
+		api.GET("/streams/:id/http", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if exchanges, found := activeProject(c).ConnectionStreamsController.GetHTTPExchanges(c, id); !found {
+				notFound(c, gin.H{"connection": id})
+			} else {
+				success(c, exchanges)
+			}
+		})
+
+		api.POST("/streams/:id/http", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if exchanges, found := activeProject(c).ConnectionStreamsController.SaveHTTPExchanges(c, id); !found {
+				notFound(c, gin.H{"connection": id})
+			} else {
+				success(c, exchanges)
+			}
+		})
+
+		api.GET("/streams/:id/download", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			var format DownloadMessageFormat
+			if err := c.ShouldBindQuery(&format); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if blob, found := activeProject(c).ConnectionStreamsController.DownloadConnectionMessages(c, id, format); !found {
+				notFound(c, gin.H{"connection": id})
+			} else {
+				c.String(http.StatusOK, blob)
+			}
+		})
+
+		api.GET("/streams/:id/annotations", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			success(c, activeProject(c).ConnectionStreamsController.GetAnnotations(c, id))
+		})
+
+		api.POST("/streams/:id/annotations", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			var annotation StreamAnnotation
+			if err := c.ShouldBindJSON(&annotation); err != nil {
+				badRequest(c, err)
 				return
 			}
+			annotation.Author = c.GetString(gin.AuthUserKey)
 
-			success(c, applicationContext.SearchController.PerformSearch(c, options))
+			annotation, found, err := activeProject(c).ConnectionStreamsController.AddAnnotation(c, id, annotation)
+			if !found {
+				notFound(c, gin.H{"connection": id})
+			} else if err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				success(c, annotation)
+				notificationController.Notify("annotations.new", annotation)
+			}
 		})
 
-		api.GET("/streams/:id", func(c *gin.Context) {
+		api.PUT("/streams/:id/annotations/:annotation_id", func(c *gin.Context) {
 			id, err := RowIDFromHex(c.Param("id"))
 			if err != nil {
 				badRequest(c, err)
 				return
 			}
-			var format GetMessageFormat
-			if err := c.ShouldBindQuery(&format); err != nil {
+			annotationID, err := RowIDFromHex(c.Param("annotation_id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			var annotation StreamAnnotation
+			if err := c.ShouldBindJSON(&annotation); err != nil {
 				badRequest(c, err)
 				return
 			}
 
-			if messages, found := applicationContext.ConnectionStreamsController.GetConnectionMessages(c, id, format); !found {
-				notFound(c, gin.H{"connection": id})
+			annotation, found, err := activeProject(c).ConnectionStreamsController.UpdateAnnotation(c, id,
+				annotationID, annotation)
+			if !found {
+				notFound(c, gin.H{"annotation": annotationID})
+			} else if err != nil {
+				unprocessableEntity(c, err)
 			} else {
-				success(c, messages)
+				success(c, annotation)
+				notificationController.Notify("annotations.edit", annotation)
 			}
 		})
 
-		api.GET("/streams/:id/download", func(c *gin.Context) {
+		api.DELETE("/streams/:id/annotations/:annotation_id", func(c *gin.Context) {
 			id, err := RowIDFromHex(c.Param("id"))
 			if err != nil {
 				badRequest(c, err)
 				return
 			}
-			var format DownloadMessageFormat
-			if err := c.ShouldBindQuery(&format); err != nil {
+			annotationID, err := RowIDFromHex(c.Param("annotation_id"))
+			if err != nil {
 				badRequest(c, err)
 				return
 			}
 
-			if blob, found := applicationContext.ConnectionStreamsController.DownloadConnectionMessages(c, id, format); !found {
-				notFound(c, gin.H{"connection": id})
+			if activeProject(c).ConnectionStreamsController.DeleteAnnotation(c, id, annotationID) {
+				success(c, gin.H{})
+				notificationController.Notify("annotations.delete", gin.H{"connection_id": id, "id": annotationID})
 			} else {
-				c.String(http.StatusOK, blob)
+				notFound(c, gin.H{"annotation": annotationID})
 			}
 		})
 
 		api.GET("/services", func(c *gin.Context) {
-			success(c, applicationContext.ServicesController.GetServices())
+			success(c, activeProject(c).ServicesController.GetServices())
 		})
 
 		api.PUT("/services", func(c *gin.Context) {
@@ -382,7 +1249,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				badRequest(c, err)
 				return
 			}
-			if err := applicationContext.ServicesController.SetService(c, service); err == nil {
+			if err := activeProject(c).ServicesController.SetService(c, service); err == nil {
 				success(c, service)
 				notificationController.Notify("services.edit", service)
 			} else {
@@ -396,7 +1263,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				badRequest(c, err)
 				return
 			}
-			if err := applicationContext.ServicesController.DeleteService(c, service); err == nil {
+			if err := activeProject(c).ServicesController.DeleteService(c, service); err == nil {
 				success(c, service)
 				notificationController.Notify("services.edit", service)
 			} else {
@@ -404,14 +1271,89 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
+		api.PUT("/services/:port/handlers", func(c *gin.Context) {
+			port, err := strconv.ParseUint(c.Param("port"), 10, 16)
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			var endpoints map[string]string
+			if err := c.ShouldBindJSON(&endpoints); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			servicesController := activeProject(c).ServicesController
+			if found, err := servicesController.SetServiceHandlers(c, uint16(port), endpoints); err != nil {
+				unprocessableEntity(c, err)
+			} else if !found {
+				notFound(c, gin.H{"port": port})
+			} else {
+				service := servicesController.GetServices()[uint16(port)]
+				success(c, service)
+				notificationController.Notify("services.edit", service)
+			}
+		})
+
+		api.PUT("/services/:port/golden", func(c *gin.Context) {
+			port, err := strconv.ParseUint(c.Param("port"), 10, 16)
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			var request struct {
+				ConnectionID string `json:"connection_id" binding:"required,hexadecimal,len=24"`
+			}
+			if err := c.ShouldBindJSON(&request); err != nil {
+				badRequest(c, err)
+				return
+			}
+			connectionID, _ := RowIDFromHex(request.ConnectionID)
+			connection, isPresent := activeProject(c).ConnectionsController.GetConnection(c, connectionID)
+			if !isPresent {
+				notFound(c, gin.H{"connection_id": connectionID})
+				return
+			} else if connection.DestinationPort != uint16(port) {
+				unprocessableEntity(c, errors.New("the connection does not belong to the service"))
+				return
+			}
+
+			servicesController := activeProject(c).ServicesController
+			if !servicesController.SetGoldenConnection(c, uint16(port), &connectionID) {
+				notFound(c, gin.H{"port": port})
+			} else {
+				service := servicesController.GetServices()[uint16(port)]
+				success(c, service)
+				notificationController.Notify("services.edit", service)
+			}
+		})
+
+		api.DELETE("/services/:port/golden", func(c *gin.Context) {
+			port, err := strconv.ParseUint(c.Param("port"), 10, 16)
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			servicesController := activeProject(c).ServicesController
+			if !servicesController.SetGoldenConnection(c, uint16(port), nil) {
+				notFound(c, gin.H{"port": port})
+			} else {
+				service := servicesController.GetServices()[uint16(port)]
+				success(c, service)
+				notificationController.Notify("services.edit", service)
+			}
+		})
+
 		api.GET("/statistics", func(c *gin.Context) {
 			var filter StatisticsFilter
 			if err := c.ShouldBindQuery(&filter); err != nil {
 				badRequest(c, err)
 				return
 			}
+			filter.Connections = withRuleGroup(activeProject(c).RulesManager, filter.Connections)
 
-			success(c, applicationContext.StatisticsController.GetStatistics(c, filter))
+			success(c, activeProject(c).StatisticsController.GetStatistics(c, filter))
 		})
 
 		api.GET("/statistics/totals", func(c *gin.Context) {
@@ -420,8 +1362,274 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				badRequest(c, err)
 				return
 			}
+			filter.Connections = withRuleGroup(activeProject(c).RulesManager, filter.Connections)
+
+			success(c, activeProject(c).StatisticsController.GetTotalStatistics(c, filter))
+		})
+
+		api.GET("/statistics/timeline", func(c *gin.Context) {
+			var filter TimelineFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if timeline, err := activeProject(c).StatisticsController.GetTimeline(c, filter); err ==
+				errTooManyTimelineBuckets || err == errInvalidTimelineRule {
+				badRequest(c, err)
+			} else if err != nil {
+				serverError(c, err)
+			} else {
+				success(c, timeline)
+			}
+		})
+
+		api.GET("/beacons", func(c *gin.Context) {
+			var filter BeaconsFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			beacons, truncated := activeProject(c).BeaconsController.GetBeacons(c, filter)
+			if truncated {
+				c.Header(partialResultsHeader, "true")
+			}
+			success(c, beacons)
+		})
+
+		api.GET("/runners", func(c *gin.Context) {
+			var filter RunnersFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			success(c, activeProject(c).RunnersController.GetRunners(c, filter))
+		})
+
+		api.GET("/settings/services_detection", func(c *gin.Context) {
+			success(c, activeProject(c).ServicesDetector.GetSettings())
+		})
+
+		api.PUT("/settings/services_detection", func(c *gin.Context) {
+			var settings ServicesDetectionSettings
+			if err := c.ShouldBindJSON(&settings); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if err := activeProject(c).ServicesDetector.SetSettings(settings); err != nil {
+				serverError(c, err)
+			} else {
+				success(c, settings)
+				notificationController.Notify("settings.services_detection", settings)
+			}
+		})
+
+		api.GET("/settings/storage_limits", func(c *gin.Context) {
+			success(c, activeProject(c).StorageLimits.GetSettings())
+		})
+
+		api.PUT("/settings/storage_limits", func(c *gin.Context) {
+			var settings StorageLimitsSettings
+			if err := c.ShouldBindJSON(&settings); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if err := activeProject(c).StorageLimits.SetSettings(settings); err != nil {
+				serverError(c, err)
+			} else {
+				success(c, settings)
+				notificationController.Notify("settings.storage_limits", settings)
+			}
+		})
+
+		api.GET("/settings/geoip", func(c *gin.Context) {
+			success(c, activeProject(c).GeoIP.GetSettings())
+		})
+
+		api.PUT("/settings/geoip", func(c *gin.Context) {
+			var settings GeoIPSettings
+			if err := c.ShouldBindJSON(&settings); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if err := activeProject(c).GeoIP.SetSettings(settings); err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				success(c, settings)
+				notificationController.Notify("settings.geoip", settings)
+			}
+		})
+
+		api.GET("/settings/lag_watchdog", func(c *gin.Context) {
+			success(c, activeProject(c).LagWatchdog.GetSettings())
+		})
+
+		api.PUT("/settings/lag_watchdog", func(c *gin.Context) {
+			var settings LagWatchdogSettings
+			if err := c.ShouldBindJSON(&settings); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if err := activeProject(c).LagWatchdog.SetSettings(settings); err != nil {
+				serverError(c, err)
+			} else {
+				success(c, settings)
+				notificationController.Notify("settings.lag_watchdog", settings)
+			}
+		})
+
+		api.GET("/settings/classifiers", func(c *gin.Context) {
+			success(c, activeProject(c).PayloadClassifiers.GetSettings())
+		})
+
+		api.PUT("/settings/classifiers", AdminRequiredMiddleware(applicationContext), func(c *gin.Context) {
+			var settings ClassifiersSettings
+			if err := c.ShouldBindJSON(&settings); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if err := activeProject(c).PayloadClassifiers.SetSettings(settings); err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				success(c, settings)
+				notificationController.Notify("settings.classifiers", settings)
+			}
+		})
+
+		api.GET("/classifiers/statistics", func(c *gin.Context) {
+			success(c, activeProject(c).PayloadClassifiers.GetStatistics())
+		})
+
+		api.GET("/settings/ingestion_filters", func(c *gin.Context) {
+			success(c, activeProject(c).IngestionFilters.GetSettings())
+		})
+
+		api.PUT("/settings/ingestion_filters", func(c *gin.Context) {
+			var settings IngestionFiltersSettings
+			if err := c.ShouldBindJSON(&settings); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if err := activeProject(c).IngestionFilters.SetSettings(settings); err != nil {
+				serverError(c, err)
+			} else {
+				success(c, settings)
+				notificationController.Notify("settings.ingestion_filters", settings)
+			}
+		})
+
+		api.GET("/settings/query_limits", func(c *gin.Context) {
+			success(c, activeProject(c).QueryLimits.GetSettings())
+		})
+
+		api.PUT("/settings/query_limits", func(c *gin.Context) {
+			var settings QueryLimitsSettings
+			if err := c.ShouldBindJSON(&settings); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if err := activeProject(c).QueryLimits.SetSettings(settings); err != nil {
+				serverError(c, err)
+			} else {
+				success(c, settings)
+				notificationController.Notify("settings.query_limits", settings)
+			}
+		})
+
+		api.GET("/settings/retention", func(c *gin.Context) {
+			success(c, activeProject(c).RetentionJanitor.GetSettings())
+		})
+
+		api.PUT("/settings/retention", func(c *gin.Context) {
+			var settings RetentionSettings
+			if err := c.ShouldBindJSON(&settings); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if err := activeProject(c).RetentionJanitor.SetSettings(settings); err != nil {
+				serverError(c, err)
+			} else {
+				success(c, settings)
+				notificationController.Notify("settings.retention", settings)
+			}
+		})
+
+		api.GET("/settings/exploits_exporter", func(c *gin.Context) {
+			success(c, activeProject(c).ExploitsExporter.GetSettings())
+		})
+
+		api.PUT("/settings/exploits_exporter", func(c *gin.Context) {
+			var settings ExploitsExporterSettings
+			if err := c.ShouldBindJSON(&settings); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if err := activeProject(c).ExploitsExporter.SetSettings(settings); err == errRepositoryPathOutside ||
+				err == errInvalidRemoteURL || err == errInvalidBranch {
+				unprocessableEntity(c, err)
+			} else if err != nil {
+				serverError(c, err)
+			} else {
+				success(c, settings)
+				notificationController.Notify("settings.exploits_exporter", settings)
+			}
+		})
+
+		api.POST("/exploits/export", func(c *gin.Context) {
+			if result, err := activeProject(c).ExploitsExporter.Export(c); err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				success(c, result)
+			}
+		})
+
+		api.GET("/storage/status", func(c *gin.Context) {
+			if applicationContext.StorageMonitor == nil {
+				notFound(c, gin.H{})
+				return
+			}
+			success(c, applicationContext.StorageMonitor.GetStatus())
+		})
+
+		api.GET("/ingestion/status", func(c *gin.Context) {
+			success(c, activeProject(c).LagWatchdog.GetStatus())
+		})
+
+		api.GET("/storage/stats", func(c *gin.Context) {
+			if stats, err := activeProject(c).RetentionJanitor.GetStats(c); err != nil {
+				serverError(c, err)
+			} else {
+				success(c, stats)
+			}
+		})
+
+		api.POST("/storage/prune", func(c *gin.Context) {
+			report := activeProject(c).RetentionJanitor.Prune(c)
+			if report.Error != "" {
+				serverError(c, errors.New(report.Error))
+			} else {
+				success(c, report)
+			}
+		})
 
-			success(c, applicationContext.StatisticsController.GetTotalStatistics(c, filter))
+		api.POST("/reload", func(c *gin.Context) {
+			if err := applicationContext.Reload(); err != nil {
+				serverError(c, err)
+			} else {
+				success(c, gin.H{})
+				notificationController.Notify("reload", gin.H{})
+			}
 		})
 
 		api.GET("/resources/system", func(c *gin.Context) {
@@ -436,9 +1644,23 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 	return router
 }
 
+// ProjectContextMiddleware resolves the active project once for each request, so that a handler never uses the
+// components of two different projects while the active project is switched.
+func ProjectContextMiddleware(applicationContext *ApplicationContext) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(projectContextKey, applicationContext.ActiveProject())
+		c.Next()
+	}
+}
+
+// activeProject returns the context of the project which was active when the request was received.
+func activeProject(c *gin.Context) *ProjectContext {
+	return c.MustGet(projectContextKey).(*ProjectContext)
+}
+
 func SetupRequiredMiddleware(applicationContext *ApplicationContext) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !applicationContext.IsConfigured {
+		if !activeProject(c).IsConfigured {
 			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
 				"error": "setup required",
 				"url":   c.Request.Host + "/setup",
@@ -449,15 +1671,80 @@ func SetupRequiredMiddleware(applicationContext *ApplicationContext) gin.Handler
 	}
 }
 
+// AuthRequiredMiddleware authenticates the requests, if auth is required, with a bearer token issued by the login
+// endpoint or with basic auth, using either the accounts set during setup or the users credentials. The users with
+// read-only role can only make requests which do not modify the state.
 func AuthRequiredMiddleware(applicationContext *ApplicationContext) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !applicationContext.Config.AuthRequired {
+		if !activeProject(c).Config.AuthRequired {
+			c.Next()
+			return
+		}
+
+		var user User
+		var authenticated bool
+		if authorization := c.GetHeader("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+			user, authenticated = applicationContext.AuthController.Authenticate(
+				strings.TrimPrefix(authorization, "Bearer "))
+		} else if username, password, ok := c.Request.BasicAuth(); ok {
+			user, authenticated = checkCredentials(applicationContext, username, password)
+		}
+		if !authenticated {
+			c.Header("WWW-Authenticate", `Basic realm="Authorization Required"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+			return
+		}
+		if user.Role == RoleReadOnly && !isReadOnlyRequest(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "read-only user"})
+			return
+		}
+
+		c.Set(gin.AuthUserKey, user.Username)
+		c.Set(authUserKey, user)
+		c.Next()
+	}
+}
+
+// AdminRequiredMiddleware allows the requests only to the admin users. Must be used after AuthRequiredMiddleware.
+func AdminRequiredMiddleware(applicationContext *ApplicationContext) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !activeProject(c).Config.AuthRequired {
 			c.Next()
 			return
 		}
 
-		gin.BasicAuth(applicationContext.Accounts)(c)
+		if user, ok := c.Get(authUserKey); !ok || user.(User).Role != RoleAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin role required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkCredentials checks username and password against the accounts set during setup, which have the admin role,
+// and then against the users saved in the database.
+func checkCredentials(applicationContext *ApplicationContext, username, password string) (User, bool) {
+	if accountPassword, isPresent := applicationContext.Accounts()[username]; isPresent {
+		if subtle.ConstantTimeCompare([]byte(accountPassword), []byte(password)) == 1 {
+			return User{Username: username, Role: RoleAdmin}, true
+		}
+		return User{}, false
+	}
+
+	return applicationContext.AuthController.CheckPassword(username, password)
+}
+
+func isReadOnlyRequest(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	for _, path := range readOnlyPostPaths {
+		if c.FullPath() == path {
+			return true
+		}
 	}
+	return false
 }
 
 func success(c *gin.Context, obj interface{}) {
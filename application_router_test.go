@@ -19,6 +19,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -49,11 +50,109 @@ func TestAuthRequired(t *testing.T) {
 	toolkit := NewRouterTestToolkit(t, true)
 
 	assert.Equal(t, http.StatusOK, toolkit.MakeRequest("GET", "/api/rules", nil).Code)
-	config := toolkit.appContext.Config
+	config := toolkit.appContext.ActiveProject().Config
 	config.AuthRequired = true
 	toolkit.appContext.SetConfig(config)
 	toolkit.appContext.SetAccounts(gin.Accounts{"username": "password"})
 	assert.Equal(t, http.StatusUnauthorized, toolkit.MakeRequest("GET", "/api/rules", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, toolkit.MakeRequest("GET", "/api/ws", nil).Code)
+
+	toolkit.wrapper.Destroy(t)
+}
+
+func TestReadOnlyRequests(t *testing.T) {
+	router := gin.New()
+	handler := func(c *gin.Context) {
+		c.JSON(http.StatusOK, isReadOnlyRequest(c))
+	}
+	router.POST("/api/connections/:id/similar", handler)
+	router.POST("/api/connections/:id/:action", handler)
+	router.GET("/api/connections/:id", handler)
+
+	for url, readOnly := range map[string]string{
+		"/api/connections/5f1ab3a1cbb4fc9b7e11bf4c/similar": "true",
+		"/api/connections/5f1ab3a1cbb4fc9b7e11bf4c/hide":    "false",
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, url, nil))
+		assert.Equal(t, readOnly, w.Body.String(), url)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/connections/5f1ab3a1cbb4fc9b7e11bf4c", nil))
+	assert.Equal(t, "true", w.Body.String())
+}
+
+func TestUsersAndTokensApi(t *testing.T) {
+	toolkit := NewRouterTestToolkit(t, true)
+	config := toolkit.appContext.ActiveProject().Config
+	config.AuthRequired = true
+	toolkit.appContext.SetConfig(config)
+	toolkit.appContext.SetAccounts(gin.Accounts{"admin": "password"})
+
+	basicAuth := func(username, password string) map[string]string {
+		return map[string]string{"Authorization": "Basic " +
+			base64.StdEncoding.EncodeToString([]byte(username+":"+password))}
+	}
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+	login := func(username, password string) (int, string) {
+		w := toolkit.MakeRequest("POST", "/api/auth/login", gin.H{"username": username, "password": password})
+		var token AuthToken
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &token))
+		}
+		return w.Code, token.Token
+	}
+
+	admin := basicAuth("admin", "password")
+	assert.Equal(t, http.StatusUnauthorized, toolkit.MakeRequestWithHeaders("GET", "/api/users", nil,
+		basicAuth("admin", "wrong")).Code)
+	assert.Equal(t, http.StatusOK, toolkit.MakeRequestWithHeaders("GET", "/api/users", nil, admin).Code)
+	assert.Equal(t, http.StatusBadRequest, toolkit.MakeRequestWithHeaders("POST", "/api/users",
+		NewUser{Username: "viewer", Password: "short", Role: RoleReadOnly}, admin).Code)
+	assert.Equal(t, http.StatusBadRequest, toolkit.MakeRequestWithHeaders("POST", "/api/users",
+		NewUser{Username: "viewer", Password: "viewer_password", Role: "invalid"}, admin).Code)
+	assert.Equal(t, http.StatusOK, toolkit.MakeRequestWithHeaders("POST", "/api/users",
+		NewUser{Username: "viewer", Password: "viewer_password", Role: RoleReadOnly}, admin).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, toolkit.MakeRequestWithHeaders("POST", "/api/users",
+		NewUser{Username: "viewer", Password: "viewer_password", Role: RoleReadOnly}, admin).Code)
+
+	code, _ := login("viewer", "wrong_password")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, token := login("viewer", "viewer_password")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, token)
+
+	viewer := bearer(token)
+	assert.Equal(t, http.StatusOK, toolkit.MakeRequestWithHeaders("GET", "/api/rules", nil, viewer).Code)
+	assert.Equal(t, http.StatusOK, toolkit.MakeRequestWithHeaders("GET", "/api/rules", nil,
+		basicAuth("viewer", "viewer_password")).Code)
+	assert.Equal(t, http.StatusForbidden, toolkit.MakeRequestWithHeaders("POST", "/api/rules",
+		Rule{Name: "testRule", Color: "#fff"}, viewer).Code)
+	assert.Equal(t, http.StatusForbidden, toolkit.MakeRequestWithHeaders("GET", "/api/users", nil, viewer).Code)
+	w := toolkit.MakeRequestWithHeaders("GET", "/api/auth/me", nil, viewer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var me User
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &me))
+	assert.Equal(t, "viewer", me.Username)
+	assert.Equal(t, RoleReadOnly, me.Role)
+
+	assert.Equal(t, http.StatusOK, toolkit.MakeRequestWithHeaders("POST", "/api/auth/logout", nil, viewer).Code)
+	assert.Equal(t, http.StatusUnauthorized, toolkit.MakeRequestWithHeaders("GET", "/api/rules", nil, viewer).Code)
+
+	code, token = login("admin", "password")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusOK, toolkit.MakeRequestWithHeaders("POST", "/api/rules",
+		Rule{Name: "testRule", Color: "#fff"}, bearer(token)).Code)
+
+	code, token = login("viewer", "viewer_password")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusOK, toolkit.MakeRequestWithHeaders("DELETE", "/api/users/viewer", nil, admin).Code)
+	assert.Equal(t, http.StatusNotFound, toolkit.MakeRequestWithHeaders("DELETE", "/api/users/viewer", nil,
+		admin).Code)
+	assert.Equal(t, http.StatusUnauthorized, toolkit.MakeRequestWithHeaders("GET", "/api/rules", nil,
+		bearer(token)).Code)
 
 	toolkit.wrapper.Destroy(t)
 }
@@ -143,7 +242,16 @@ func TestPcapImporterApi(t *testing.T) {
 	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
 	assert.Equal(t, sessionID.Session, session.ID)
 
+	// Get job
+	var job ImportingSession
+	w = toolkit.MakeRequest("GET", "/api/pcap/jobs/"+sessionID.Session, nil)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	assert.Equal(t, sessionID.Session, job.ID)
+	assert.NotZero(t, job.Status)
+
 	// Cancel session
+	assert.Equal(t, http.StatusNotFound, toolkit.MakeRequest("DELETE", "/api/pcap/jobs/invalidSession",
+		nil).Code)
 	assert.Equal(t, http.StatusNotFound, toolkit.MakeRequest("DELETE", "/api/pcap/sessions/invalidSession",
 		nil).Code)
 	assert.Equal(t, http.StatusAccepted, toolkit.MakeRequest("DELETE", "/api/pcap/sessions/"+sessionID.Session,
@@ -192,6 +300,11 @@ func NewRouterTestToolkit(t *testing.T, withSetup bool) *RouterTestToolkit {
 }
 
 func (rtt *RouterTestToolkit) MakeRequest(method string, url string, body interface{}) *httptest.ResponseRecorder {
+	return rtt.MakeRequestWithHeaders(method, url, body, nil)
+}
+
+func (rtt *RouterTestToolkit) MakeRequestWithHeaders(method string, url string, body interface{},
+	headers map[string]string) *httptest.ResponseRecorder {
 	var r io.Reader
 
 	if body != nil {
@@ -203,6 +316,9 @@ func (rtt *RouterTestToolkit) MakeRequest(method string, url string, body interf
 	w := httptest.NewRecorder()
 	req, err := http.NewRequest(method, url, r)
 	require.NoError(rtt.t, err)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
 	rtt.router.ServeHTTP(w, req)
 
 	return w
@@ -0,0 +1,244 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	RoleAdmin    = "admin"
+	RoleReadOnly = "readonly"
+)
+
+const authTokenDuration = 24 * time.Hour
+const authTokenSize = 32
+
+type User struct {
+	ID           RowID     `json:"id" bson:"_id"`
+	Username     string    `json:"username" bson:"username"`
+	PasswordHash []byte    `json:"-" bson:"password_hash"`
+	Role         string    `json:"role" bson:"role"`
+	CreatedAt    time.Time `json:"created_at" bson:"created_at"`
+}
+
+type NewUser struct {
+	Username string `json:"username" binding:"required,min=3,max=32,alphanum"`
+	Password string `json:"password" binding:"required,min=8,max=72"`
+	Role     string `json:"role" binding:"required,oneof=admin readonly"`
+}
+
+// AuthToken is an opaque token issued on login. Only the sha256 of the token is saved in the database, the token
+// itself is returned once to the client.
+type AuthToken struct {
+	Hash      string    `json:"-" bson:"_id"`
+	Token     string    `json:"token" bson:"-"`
+	Username  string    `json:"username" bson:"username"`
+	Role      string    `json:"role" bson:"role"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+type AuthController struct {
+	storage Storage
+	users   map[string]User
+	tokens  map[string]AuthToken
+	mutex   sync.Mutex
+}
+
+func NewAuthController(storage Storage) *AuthController {
+	var users []User
+	if err := storage.Find(Users).All(&users); err != nil {
+		log.WithError(err).Panic("failed to retrieve users")
+	}
+	var tokens []AuthToken
+	if err := storage.Find(AuthTokens).Filter(OrderedDocument{{"expires_at", UnorderedDocument{"$gt": time.Now()}}}).
+		All(&tokens); err != nil {
+		log.WithError(err).Panic("failed to retrieve auth tokens")
+	}
+
+	controller := &AuthController{
+		storage: storage,
+		users:   make(map[string]User, len(users)),
+		tokens:  make(map[string]AuthToken, len(tokens)),
+	}
+	for _, user := range users {
+		controller.users[user.Username] = user
+	}
+	for _, token := range tokens {
+		controller.tokens[token.Hash] = token
+	}
+
+	return controller
+}
+
+func (ac *AuthController) CreateUser(c context.Context, newUser NewUser) (User, error) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	if _, isPresent := ac.users[newUser.Username]; isPresent {
+		return User{}, errors.New("user already exists")
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(newUser.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+	user := User{
+		ID:           NewRowID(),
+		Username:     newUser.Username,
+		PasswordHash: passwordHash,
+		Role:         newUser.Role,
+		CreatedAt:    time.Now(),
+	}
+	if _, err := ac.storage.Insert(Users).Context(c).One(user); err != nil {
+		log.WithError(err).WithField("username", user.Username).Panic("failed to insert user")
+	}
+	ac.users[user.Username] = user
+
+	return user, nil
+}
+
+func (ac *AuthController) GetUsers() []User {
+	ac.mutex.Lock()
+	users := make([]User, 0, len(ac.users))
+	for _, user := range ac.users {
+		users = append(users, user)
+	}
+	ac.mutex.Unlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+// DeleteUser removes the user and revokes all its tokens. Returns false if the user does not exist.
+func (ac *AuthController) DeleteUser(c context.Context, username string) bool {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	if _, isPresent := ac.users[username]; !isPresent {
+		return false
+	}
+
+	if err := ac.storage.Delete(Users).Context(c).Filter(OrderedDocument{{"username", username}}).One(); err != nil {
+		log.WithError(err).WithField("username", username).Panic("failed to delete user")
+	}
+	_ = ac.storage.Delete(AuthTokens).Context(c).Filter(OrderedDocument{{"username", username}}).Many()
+
+	delete(ac.users, username)
+	for hash, token := range ac.tokens {
+		if token.Username == username {
+			delete(ac.tokens, hash)
+		}
+	}
+
+	return true
+}
+
+// CheckPassword returns the user with the specified credentials, if exists.
+func (ac *AuthController) CheckPassword(username, password string) (User, bool) {
+	ac.mutex.Lock()
+	user, isPresent := ac.users[username]
+	ac.mutex.Unlock()
+
+	if !isPresent || bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)) != nil {
+		return User{}, false
+	}
+	return user, true
+}
+
+// IssueToken creates a new token for the user, valid for authTokenDuration.
+func (ac *AuthController) IssueToken(c context.Context, user User) (AuthToken, error) {
+	buffer := make([]byte, authTokenSize)
+	if _, err := rand.Read(buffer); err != nil {
+		return AuthToken{}, err
+	}
+
+	token := AuthToken{
+		Hash:      hashToken(hex.EncodeToString(buffer)),
+		Token:     hex.EncodeToString(buffer),
+		Username:  user.Username,
+		Role:      user.Role,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(authTokenDuration),
+	}
+	if _, err := ac.storage.Insert(AuthTokens).Context(c).One(token); err != nil {
+		return AuthToken{}, err
+	}
+
+	ac.mutex.Lock()
+	ac.tokens[token.Hash] = token
+	ac.mutex.Unlock()
+
+	return token, nil
+}
+
+// RevokeToken invalidates a token before its expiration. Returns false if the token does not exist.
+func (ac *AuthController) RevokeToken(c context.Context, token string) bool {
+	hash := hashToken(token)
+
+	ac.mutex.Lock()
+	_, isPresent := ac.tokens[hash]
+	delete(ac.tokens, hash)
+	ac.mutex.Unlock()
+
+	if isPresent {
+		_ = ac.storage.Delete(AuthTokens).Context(c).Filter(OrderedDocument{{"_id", hash}}).One()
+	}
+	return isPresent
+}
+
+// Authenticate returns the user owning the token, if the token is valid. The role of the users saved in the database
+// is always the current one, also if it is changed after the token has been issued.
+func (ac *AuthController) Authenticate(token string) (User, bool) {
+	hash := hashToken(token)
+
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	authToken, isPresent := ac.tokens[hash]
+	if !isPresent {
+		return User{}, false
+	}
+	if time.Now().After(authToken.ExpiresAt) {
+		delete(ac.tokens, hash)
+		return User{}, false
+	}
+
+	if user, isPresent := ac.users[authToken.Username]; isPresent {
+		return user, true
+	}
+	return User{Username: authToken.Username, Role: authToken.Role}, true
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,148 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthTokens(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Users)
+	wrapper.AddCollection(AuthTokens)
+
+	authController := NewAuthController(wrapper.Storage)
+	user, err := authController.CreateUser(wrapper.Context, NewUser{Username: "viewer", Password: "viewer_password",
+		Role: RoleReadOnly})
+	require.NoError(t, err)
+	_, err = authController.CreateUser(wrapper.Context, NewUser{Username: "viewer", Password: "other_password",
+		Role: RoleAdmin})
+	assert.Error(t, err)
+
+	_, isValid := authController.CheckPassword("viewer", "wrong_password")
+	assert.False(t, isValid)
+	checkedUser, isValid := authController.CheckPassword("viewer", "viewer_password")
+	assert.True(t, isValid)
+	assert.Equal(t, user.ID, checkedUser.ID)
+
+	token, err := authController.IssueToken(wrapper.Context, user)
+	require.NoError(t, err)
+	assert.Len(t, token.Token, 2*authTokenSize)
+	assert.Equal(t, hashToken(token.Token), token.Hash)
+	assert.WithinDuration(t, time.Now().Add(authTokenDuration), token.ExpiresAt, time.Minute)
+	authenticatedUser, isAuthenticated := authController.Authenticate(token.Token)
+	assert.True(t, isAuthenticated)
+	assert.Equal(t, "viewer", authenticatedUser.Username)
+	assert.Equal(t, RoleReadOnly, authenticatedUser.Role)
+	_, isAuthenticated = authController.Authenticate(token.Hash)
+	assert.False(t, isAuthenticated, "the hash of the token is not a token")
+
+	// the tokens not expired are loaded again, only their hash is saved
+	otherController := NewAuthController(wrapper.Storage)
+	_, isAuthenticated = otherController.Authenticate(token.Token)
+	assert.True(t, isAuthenticated)
+	var storedToken AuthToken
+	require.NoError(t, wrapper.Storage.Find(AuthTokens).Context(wrapper.Context).
+		Filter(OrderedDocument{{"_id", token.Hash}}).First(&storedToken))
+	assert.Empty(t, storedToken.Token)
+
+	assert.True(t, authController.RevokeToken(wrapper.Context, token.Token))
+	assert.False(t, authController.RevokeToken(wrapper.Context, token.Token))
+	_, isAuthenticated = authController.Authenticate(token.Token)
+	assert.False(t, isAuthenticated)
+	_, isAuthenticated = NewAuthController(wrapper.Storage).Authenticate(token.Token)
+	assert.False(t, isAuthenticated)
+
+	// the expired tokens are discarded
+	expiredToken, err := authController.IssueToken(wrapper.Context, user)
+	require.NoError(t, err)
+	_, err = wrapper.Storage.Update(AuthTokens).Context(wrapper.Context).
+		Filter(OrderedDocument{{"_id", expiredToken.Hash}}).
+		One(UnorderedDocument{"expires_at": time.Now().Add(-time.Minute)})
+	require.NoError(t, err)
+	_, isAuthenticated = NewAuthController(wrapper.Storage).Authenticate(expiredToken.Token)
+	assert.False(t, isAuthenticated)
+	expiredToken.ExpiresAt = time.Now().Add(-time.Minute)
+	authController.tokens[expiredToken.Hash] = expiredToken
+	_, isAuthenticated = authController.Authenticate(expiredToken.Token)
+	assert.False(t, isAuthenticated)
+	assert.NotContains(t, authController.tokens, expiredToken.Hash)
+
+	// the tokens of the deleted users are revoked
+	token, err = authController.IssueToken(wrapper.Context, user)
+	require.NoError(t, err)
+	assert.True(t, authController.DeleteUser(wrapper.Context, "viewer"))
+	assert.False(t, authController.DeleteUser(wrapper.Context, "viewer"))
+	_, isAuthenticated = authController.Authenticate(token.Token)
+	assert.False(t, isAuthenticated)
+	assert.Empty(t, authController.GetUsers())
+
+	wrapper.Destroy(t)
+}
+
+func TestReadOnlyRole(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Users)
+	wrapper.AddCollection(AuthTokens)
+
+	applicationContext := &ApplicationContext{AuthController: NewAuthController(wrapper.Storage)}
+	tokens := make(map[string]string)
+	for username, role := range map[string]string{"viewer": RoleReadOnly, "admin": RoleAdmin} {
+		user, err := applicationContext.AuthController.CreateUser(wrapper.Context, NewUser{Username: username,
+			Password: username + "_password", Role: role})
+		require.NoError(t, err)
+		token, err := applicationContext.AuthController.IssueToken(wrapper.Context, user)
+		require.NoError(t, err)
+		tokens[username] = token.Token
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set(projectContextKey, &ProjectContext{Config: Config{AuthRequired: true}})
+	})
+	router.Use(AuthRequiredMiddleware(applicationContext))
+	handler := func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{})
+	}
+	router.GET("/api/rules", handler)
+	router.POST("/api/rules", handler)
+	router.POST("/api/rules/estimate", handler)
+
+	request := func(method, url, username string) int {
+		r := httptest.NewRequest(method, url, nil)
+		r.Header.Set("Authorization", "Bearer "+tokens[username])
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/api/rules", "viewer"))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/api/rules", "viewer"))
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/api/rules/estimate", "viewer"))
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/api/rules", "admin"))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/api/rules", "unknown"))
+
+	wrapper.Destroy(t)
+}
@@ -0,0 +1,195 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultBeaconsMinConnections = 6
+const defaultBeaconsMaxJitter = 0.1
+const defaultBeaconsMaxAverageBytes = 4096
+const maxBeaconsAnalyzedConnections = 200000
+
+// Beacon is a group of connections with the same source, destination and service port which are opened at regular
+// intervals. Jitter is the coefficient of variation of the intervals between two consecutive connections: values
+// close to zero mean that the connections are highly periodic.
+type Beacon struct {
+	SourceIP        string    `json:"ip_src"`
+	DestinationIP   string    `json:"ip_dst"`
+	DestinationPort uint16    `json:"port_dst"`
+	Connections     int       `json:"connections"`
+	MeanInterval    int64     `json:"mean_interval"`
+	StdDevInterval  int64     `json:"stddev_interval"`
+	Jitter          float64   `json:"jitter"`
+	AverageBytes    float64   `json:"average_bytes"`
+	FirstSeen       time.Time `json:"first_seen"`
+	LastSeen        time.Time `json:"last_seen"`
+	Service         Service   `json:"service"`
+}
+
+type BeaconsFilter struct {
+	StartedAfter    int64   `form:"started_after"`
+	StartedBefore   int64   `form:"started_before" binding:"omitempty,gtefield=StartedAfter"`
+	ServicePort     uint16  `form:"service_port"`
+	MinConnections  int     `form:"min_connections" binding:"omitempty,min=3"`
+	MaxJitter       float64 `form:"max_jitter" binding:"omitempty,min=0"`
+	MaxAverageBytes float64 `form:"max_average_bytes" binding:"omitempty,min=0"`
+	AsOf            int64   `form:"as_of"`
+}
+
+type BeaconsController struct {
+	storage            Storage
+	servicesController *ServicesController
+}
+
+type beaconKey struct {
+	sourceIP        string
+	destinationIP   string
+	destinationPort uint16
+}
+
+func NewBeaconsController(storage Storage, servicesController *ServicesController) BeaconsController {
+	return BeaconsController{
+		storage:            storage,
+		servicesController: servicesController,
+	}
+}
+
+// GetBeacons analyzes the connections in the selected time range and returns the periodic and low-volume ones,
+// sorted by jitter. Only the timings and the sizes of the connections are used, so encrypted traffic is detected too.
+// At most the most recent maxBeaconsAnalyzedConnections connections are analyzed: if there are more connections in
+// the time range the older ones are ignored, and the returned flag is true.
+func (bc BeaconsController) GetBeacons(c context.Context, filter BeaconsFilter) ([]Beacon, bool) {
+	var connections []Connection
+	query := bc.storage.Find(Connections).Context(c).Sort("started_at", false).
+		Projection(OrderedDocument{{"ip_src", 1}, {"ip_dst", 1}, {"port_dst", 1}, {"started_at", 1},
+			{"client_bytes", 1}, {"server_bytes", 1}}).Limit(maxBeaconsAnalyzedConnections + 1)
+	if filter.StartedAfter > 0 {
+		query = query.Filter(OrderedDocument{{"started_at", UnorderedDocument{"$gt": time.Unix(filter.StartedAfter, 0)}}})
+	}
+	if filter.StartedBefore > 0 {
+		query = query.Filter(OrderedDocument{{"started_at", UnorderedDocument{"$lt": time.Unix(filter.StartedBefore, 0)}}})
+	}
+	if filter.ServicePort > 0 {
+		query = query.Filter(OrderedDocument{{"port_dst", filter.ServicePort}})
+	}
+	if filter.AsOf > 0 {
+		query = query.Filter(OrderedDocument{{"processed_at", UnorderedDocument{"$lte": time.Unix(filter.AsOf, 0)}}})
+	}
+
+	if err := query.All(&connections); err != nil {
+		log.WithError(err).WithField("filter", filter).Panic("failed to get connections")
+	}
+	truncated := len(connections) > maxBeaconsAnalyzedConnections
+	if truncated {
+		connections = connections[:maxBeaconsAnalyzedConnections]
+	}
+	for i, j := 0, len(connections)-1; i < j; i, j = i+1, j-1 {
+		connections[i], connections[j] = connections[j], connections[i]
+	}
+
+	beacons := detectBeacons(connections, filter)
+	services := bc.servicesController.GetServices()
+	for i, beacon := range beacons {
+		if service, isPresent := services[beacon.DestinationPort]; isPresent {
+			beacons[i].Service = service
+		}
+	}
+
+	return beacons, truncated
+}
+
+// detectBeacons groups the connections, which must be sorted by started_at, and computes the statistics of the
+// intervals between them. The groups which respect the filter thresholds are returned.
+func detectBeacons(connections []Connection, filter BeaconsFilter) []Beacon {
+	if filter.MinConnections == 0 {
+		filter.MinConnections = defaultBeaconsMinConnections
+	}
+	if filter.MaxJitter == 0 {
+		filter.MaxJitter = defaultBeaconsMaxJitter
+	}
+	if filter.MaxAverageBytes == 0 {
+		filter.MaxAverageBytes = defaultBeaconsMaxAverageBytes
+	}
+
+	groups := make(map[beaconKey][]Connection)
+	for _, connection := range connections {
+		key := beaconKey{connection.SourceIP, connection.DestinationIP, connection.DestinationPort}
+		groups[key] = append(groups[key], connection)
+	}
+
+	beacons := make([]Beacon, 0)
+	for key, group := range groups {
+		if len(group) < filter.MinConnections {
+			continue
+		}
+
+		intervals := make([]float64, 0, len(group)-1)
+		var totalBytes float64
+		for i, connection := range group {
+			totalBytes += float64(connection.ClientBytes + connection.ServerBytes)
+			if i > 0 {
+				intervals = append(intervals, float64(connection.StartedAt.Sub(group[i-1].StartedAt).Milliseconds()))
+			}
+		}
+
+		mean := Average(intervals)
+		if mean <= 0 {
+			continue
+		}
+		var variance float64
+		for _, interval := range intervals {
+			variance += (interval - mean) * (interval - mean)
+		}
+		stdDev := math.Sqrt(variance / float64(len(intervals)))
+		jitter := stdDev / mean
+		averageBytes := totalBytes / float64(len(group))
+
+		if jitter > filter.MaxJitter || averageBytes > filter.MaxAverageBytes {
+			continue
+		}
+
+		beacons = append(beacons, Beacon{
+			SourceIP:        key.sourceIP,
+			DestinationIP:   key.destinationIP,
+			DestinationPort: key.destinationPort,
+			Connections:     len(group),
+			MeanInterval:    int64(mean),
+			StdDevInterval:  int64(stdDev),
+			Jitter:          jitter,
+			AverageBytes:    averageBytes,
+			FirstSeen:       group[0].StartedAt,
+			LastSeen:        group[len(group)-1].StartedAt,
+		})
+	}
+
+	sort.Slice(beacons, func(i, j int) bool {
+		if beacons[i].Jitter == beacons[j].Jitter {
+			return beacons[i].Connections > beacons[j].Connections
+		}
+		return beacons[i].Jitter < beacons[j].Jitter
+	})
+
+	return beacons
+}
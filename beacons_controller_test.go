@@ -0,0 +1,89 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBeacons(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(Services)
+
+	servicesController := NewServicesController(wrapper.Storage)
+	require.NoError(t, servicesController.SetService(wrapper.Context, Service{Port: 4444, Name: "implant", Color: "#fff"}))
+	beaconsController := NewBeaconsController(wrapper.Storage, servicesController)
+
+	startTime := time.Unix(1600000000, 0)
+	var connections []interface{}
+	addConnection := func(sourceIP string, port uint16, startedAt time.Time, bytes int) {
+		connections = append(connections, Connection{
+			ID:              NewRowID(),
+			SourceIP:        sourceIP,
+			DestinationIP:   "10.10.10.10",
+			DestinationPort: port,
+			StartedAt:       startedAt,
+			ClosedAt:        startedAt.Add(time.Second),
+			ClientBytes:     bytes,
+			ServerBytes:     bytes,
+		})
+	}
+	for i := 0; i < 10; i++ {
+		// periodic and small: beacon
+		addConnection("10.10.10.1", 4444, startTime.Add(time.Duration(i*30)*time.Second+
+			time.Duration(i%2)*100*time.Millisecond), 64)
+		// periodic but big: not a beacon
+		addConnection("10.10.10.2", 4444, startTime.Add(time.Duration(i*30)*time.Second), 1<<20)
+		// not periodic
+		addConnection("10.10.10.3", 4444, startTime.Add(time.Duration(i*i*7)*time.Second), 64)
+	}
+	// too few connections
+	for i := 0; i < 3; i++ {
+		addConnection("10.10.10.4", 8080, startTime.Add(time.Duration(i*10)*time.Second), 64)
+	}
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).Many(connections)
+	require.NoError(t, err)
+
+	beacons, truncated := beaconsController.GetBeacons(wrapper.Context, BeaconsFilter{})
+	assert.False(t, truncated)
+	require.Len(t, beacons, 1)
+	assert.Equal(t, "10.10.10.1", beacons[0].SourceIP)
+	assert.Equal(t, uint16(4444), beacons[0].DestinationPort)
+	assert.Equal(t, 10, beacons[0].Connections)
+	assert.InDelta(t, 30000, beacons[0].MeanInterval, 100)
+	assert.Less(t, beacons[0].Jitter, 0.01)
+	assert.Equal(t, float64(128), beacons[0].AverageBytes)
+	assert.Equal(t, "implant", beacons[0].Service.Name)
+
+	beacons, _ = beaconsController.GetBeacons(wrapper.Context, BeaconsFilter{MaxAverageBytes: 1 << 22})
+	assert.Len(t, beacons, 2)
+
+	beacons, _ = beaconsController.GetBeacons(wrapper.Context, BeaconsFilter{ServicePort: 8080, MinConnections: 3})
+	require.Len(t, beacons, 1)
+	assert.Equal(t, "10.10.10.4", beacons[0].SourceIP)
+
+	beacons, _ = beaconsController.GetBeacons(wrapper.Context, BeaconsFilter{StartedAfter: startTime.Unix() + 3600})
+	assert.Len(t, beacons, 0)
+
+	wrapper.Destroy(t)
+}
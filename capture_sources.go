@@ -0,0 +1,815 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	CaptureSourceInterface  = "interface"
+	CaptureSourceWatchDir   = "watch_dir"
+	CaptureSourcePcapOverIP = "pcap_over_ip"
+	CaptureSourceS3         = "s3"
+)
+
+const (
+	AfterImportKeep   = "keep"
+	AfterImportMove   = "move"
+	AfterImportDelete = "delete"
+)
+
+const (
+	defaultRotationInterval = 60
+	defaultPollInterval     = 30
+	captureSnapshotLength   = 65536
+	captureReadTimeout      = time.Second
+	// captureSourceRetryInterval is the time waited before restarting a source which stopped with an error
+	captureSourceRetryInterval = 10 * time.Second
+)
+
+// CaptureSource is a configured input of pcaps. The packets captured on a network interface or received from a
+// PCAP-over-IP client are written in files rotated every RotationInterval seconds, while the pcaps found in a
+// directory or in an S3 bucket are polled every PollInterval seconds. All the pcaps are imported by the PcapImporter.
+// The files of a directory matching Glob (by default *.pcap and *.pcapng) are imported in order of modification time,
+// and then they are kept, moved in MoveDirectory or deleted, according to AfterImport.
+type CaptureSource struct {
+	ID               RowID             `json:"id" bson:"_id"`
+	Name             string            `json:"name" binding:"required,min=3" bson:"name"`
+	Type             string            `json:"type" binding:"required,oneof=interface watch_dir pcap_over_ip s3" bson:"type"`
+	Enabled          bool              `json:"enabled" bson:"enabled"`
+	FlushAll         bool              `json:"flush_all" bson:"flush_all"`
+	Interface        string            `json:"interface,omitempty" bson:"interface,omitempty"`
+	BPFFilter        string            `json:"bpf_filter,omitempty" bson:"bpf_filter,omitempty"`
+	Directory        string            `json:"directory,omitempty" bson:"directory,omitempty"`
+	Glob             string            `json:"glob,omitempty" bson:"glob,omitempty"`
+	AfterImport      string            `json:"after_import,omitempty" binding:"omitempty,oneof=keep move delete" bson:"after_import,omitempty"`
+	MoveDirectory    string            `json:"move_directory,omitempty" bson:"move_directory,omitempty"`
+	ListenAddress    string            `json:"listen_address,omitempty" bson:"listen_address,omitempty"`
+	RotationInterval int               `json:"rotation_interval,omitempty" binding:"omitempty,min=1" bson:"rotation_interval,omitempty"`
+	PollInterval     int               `json:"poll_interval,omitempty" binding:"omitempty,min=1" bson:"poll_interval,omitempty"`
+	S3               *S3SourceSettings `json:"s3,omitempty" bson:"s3,omitempty"`
+}
+
+// S3SourceSettings are the settings of the buckets polled by the s3 sources. Endpoint can be set to use a service
+// compatible with S3 (e.g. MinIO), in that case PathStyle is usually required. SecretAccessKey is never returned by
+// the API, and it is left unchanged if it is empty when a source is updated.
+type S3SourceSettings struct {
+	Endpoint        string `json:"endpoint,omitempty" binding:"omitempty,url" bson:"endpoint,omitempty"`
+	Region          string `json:"region" binding:"required" bson:"region"`
+	Bucket          string `json:"bucket" binding:"required" bson:"bucket"`
+	Prefix          string `json:"prefix,omitempty" bson:"prefix,omitempty"`
+	AccessKeyID     string `json:"access_key_id" binding:"required" bson:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key,omitempty" bson:"secret_access_key"`
+	PathStyle       bool   `json:"path_style" bson:"path_style"`
+}
+
+type CaptureSourceStatistics struct {
+	Running         bool      `json:"running"`
+	StartedAt       time.Time `json:"started_at,omitempty"`
+	LastActivity    time.Time `json:"last_activity,omitempty"`
+	CapturedPackets int64     `json:"captured_packets"`
+	CapturedBytes   int64     `json:"captured_bytes"`
+	ImportedFiles   int       `json:"imported_files"`
+	LastError       string    `json:"last_error,omitempty"`
+}
+
+type CaptureSourceStatus struct {
+	CaptureSource
+	Statistics CaptureSourceStatistics `json:"statistics"`
+}
+
+type CaptureSourcesController struct {
+	storage                Storage
+	importPcap             func(fileName string, flushAll bool) (string, error)
+	notificationController *NotificationController
+	sources                map[RowID]CaptureSource
+	runners                map[RowID]*captureSourceRunner
+	statistics             map[RowID]*CaptureSourceStatistics
+	mutex                  sync.Mutex
+	// mStatistics protects the values of statistics, which are updated by the runners
+	mStatistics sync.Mutex
+}
+
+func NewCaptureSourcesController(storage Storage, pcapImporter *PcapImporter,
+	notificationController *NotificationController) *CaptureSourcesController {
+	csc := &CaptureSourcesController{
+		storage:                storage,
+		importPcap:             pcapImporter.ImportPcap,
+		notificationController: notificationController,
+		sources:                make(map[RowID]CaptureSource),
+		runners:                make(map[RowID]*captureSourceRunner),
+		statistics:             make(map[RowID]*CaptureSourceStatistics),
+	}
+	if err := csc.ReloadSources(); err != nil {
+		log.WithError(err).Panic("failed to load capture sources")
+	}
+
+	return csc
+}
+
+// ReloadSources reads again the sources from the database and restarts the enabled ones.
+func (csc *CaptureSourcesController) ReloadSources() error {
+	var sources []CaptureSource
+	if err := csc.storage.Find(CaptureSources).All(&sources); err != nil {
+		return err
+	}
+
+	csc.mutex.Lock()
+	defer csc.mutex.Unlock()
+	for id := range csc.runners {
+		csc.stopSource(id)
+	}
+	csc.sources = make(map[RowID]CaptureSource, len(sources))
+	for _, source := range sources {
+		csc.sources[source.ID] = source
+		if source.Enabled {
+			csc.startSource(source)
+		}
+	}
+
+	return nil
+}
+
+func (csc *CaptureSourcesController) GetSources() []CaptureSourceStatus {
+	csc.mutex.Lock()
+	defer csc.mutex.Unlock()
+
+	sources := make([]CaptureSourceStatus, 0, len(csc.sources))
+	for id := range csc.sources {
+		sources = append(sources, csc.sourceStatus(id))
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Name < sources[j].Name
+	})
+	return sources
+}
+
+func (csc *CaptureSourcesController) GetSource(id RowID) (CaptureSourceStatus, bool) {
+	csc.mutex.Lock()
+	defer csc.mutex.Unlock()
+
+	if _, isPresent := csc.sources[id]; !isPresent {
+		return CaptureSourceStatus{}, false
+	}
+	return csc.sourceStatus(id), true
+}
+
+func (csc *CaptureSourcesController) AddSource(c context.Context, source CaptureSource) (RowID, error) {
+	if err := validateCaptureSource(source); err != nil {
+		return EmptyRowID(), err
+	}
+	source.ID = NewRowID()
+
+	csc.mutex.Lock()
+	defer csc.mutex.Unlock()
+	if _, err := csc.storage.Insert(CaptureSources).Context(c).One(source); err != nil {
+		return EmptyRowID(), errors.New("duplicate name")
+	}
+	csc.sources[source.ID] = source
+	if source.Enabled {
+		csc.startSource(source)
+	}
+
+	return source.ID, nil
+}
+
+// UpdateSource replaces the settings of a source, restarting it if it is enabled. Returns false if the source does
+// not exist.
+func (csc *CaptureSourcesController) UpdateSource(c context.Context, id RowID, source CaptureSource) (bool, error) {
+	source.ID = id
+
+	csc.mutex.Lock()
+	defer csc.mutex.Unlock()
+	previous, isPresent := csc.sources[id]
+	if !isPresent {
+		return false, nil
+	}
+	if source.S3 != nil && source.S3.SecretAccessKey == "" && previous.S3 != nil {
+		source.S3.SecretAccessKey = previous.S3.SecretAccessKey
+	}
+	if err := validateCaptureSource(source); err != nil {
+		return true, err
+	}
+
+	if _, err := csc.storage.Update(CaptureSources).Context(c).Filter(byID(id)).One(source); err != nil {
+		return true, errors.New("duplicate name")
+	}
+	csc.sources[id] = source
+	csc.stopSource(id)
+	if source.Enabled {
+		csc.startSource(source)
+	}
+
+	return true, nil
+}
+
+// SetEnabled starts or stops a source. Returns false if the source does not exist.
+func (csc *CaptureSourcesController) SetEnabled(c context.Context, id RowID, enabled bool) bool {
+	csc.mutex.Lock()
+	defer csc.mutex.Unlock()
+	source, isPresent := csc.sources[id]
+	if !isPresent {
+		return false
+	}
+
+	if _, err := csc.storage.Update(CaptureSources).Context(c).Filter(byID(id)).
+		One(UnorderedDocument{"enabled": enabled}); err != nil {
+		log.WithError(err).WithField("id", id).Panic("failed to update capture source")
+	}
+	source.Enabled = enabled
+	csc.sources[id] = source
+	csc.stopSource(id)
+	if enabled {
+		csc.startSource(source)
+	}
+
+	return true
+}
+
+func (csc *CaptureSourcesController) DeleteSource(c context.Context, id RowID) bool {
+	csc.mutex.Lock()
+	defer csc.mutex.Unlock()
+	if _, isPresent := csc.sources[id]; !isPresent {
+		return false
+	}
+
+	if err := csc.storage.Delete(CaptureSources).Context(c).Filter(byID(id)).One(); err != nil {
+		log.WithError(err).WithField("id", id).Panic("failed to delete capture source")
+	}
+	if err := csc.storage.Delete(IngestedFiles).Context(c).Filter(OrderedDocument{{"source_id", id}}).
+		Many(); err != nil && err != ErrNothingToDelete {
+		log.WithError(err).WithField("id", id).Panic("failed to delete the ingested files of capture source")
+	}
+	csc.stopSource(id)
+	delete(csc.sources, id)
+	delete(csc.statistics, id)
+
+	return true
+}
+
+// StopAll stops all the running sources, without changing their settings. It is used when shutting down.
+func (csc *CaptureSourcesController) StopAll() {
+	csc.mutex.Lock()
+	defer csc.mutex.Unlock()
+	for id := range csc.runners {
+		csc.stopSource(id)
+	}
+}
+
+// startSource must be called with the mutex held.
+func (csc *CaptureSourcesController) startSource(source CaptureSource) {
+	statistics, isPresent := csc.statistics[source.ID]
+	if !isPresent {
+		statistics = &CaptureSourceStatistics{}
+		csc.statistics[source.ID] = statistics
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	runner := &captureSourceRunner{
+		source:     source,
+		storage:    csc.storage,
+		importPcap: csc.importPcap,
+		statistics: statistics,
+		mutex:      &csc.mStatistics,
+		cancelFunc: cancelFunc,
+		stopped:    make(chan struct{}),
+		seenFiles:  make(map[string]seenFile),
+	}
+	csc.runners[source.ID] = runner
+	runner.updateStatistics(func(statistics *CaptureSourceStatistics) {
+		statistics.Running = true
+		statistics.StartedAt = time.Now()
+		statistics.LastError = ""
+	})
+
+	go runner.run(ctx, csc.notificationController)
+}
+
+// stopSource must be called with the mutex held. It waits the runner to stop, so that the files being written are
+// imported before returning.
+func (csc *CaptureSourcesController) stopSource(id RowID) {
+	runner, isPresent := csc.runners[id]
+	if !isPresent {
+		return
+	}
+	delete(csc.runners, id)
+
+	runner.cancelFunc()
+	<-runner.stopped
+	runner.updateStatistics(func(statistics *CaptureSourceStatistics) {
+		statistics.Running = false
+	})
+}
+
+func (csc *CaptureSourcesController) sourceStatus(id RowID) CaptureSourceStatus {
+	status := CaptureSourceStatus{CaptureSource: csc.sources[id]}
+	if status.S3 != nil {
+		s3Settings := *status.S3
+		s3Settings.SecretAccessKey = ""
+		status.S3 = &s3Settings
+	}
+	csc.mStatistics.Lock()
+	if statistics, isPresent := csc.statistics[id]; isPresent {
+		status.Statistics = *statistics
+	}
+	csc.mStatistics.Unlock()
+	return status
+}
+
+func validateCaptureSource(source CaptureSource) error {
+	switch source.Type {
+	case CaptureSourceInterface:
+		if source.Interface == "" {
+			return errors.New("interface is required")
+		}
+	case CaptureSourceWatchDir:
+		if source.Directory == "" {
+			return errors.New("directory is required")
+		}
+		if info, err := os.Stat(source.Directory); err != nil || !info.IsDir() {
+			return fmt.Errorf("directory %s not exists", source.Directory)
+		}
+		if _, err := filepath.Match(source.Glob, ""); err != nil {
+			return fmt.Errorf("invalid glob %s", source.Glob)
+		}
+		if source.AfterImport == AfterImportMove {
+			if info, err := os.Stat(source.MoveDirectory); err != nil || !info.IsDir() {
+				return fmt.Errorf("move directory %s not exists", source.MoveDirectory)
+			}
+			if filepath.Clean(source.MoveDirectory) == filepath.Clean(source.Directory) {
+				return errors.New("move directory must be different from the watched directory")
+			}
+		}
+	case CaptureSourcePcapOverIP:
+		if _, _, err := net.SplitHostPort(source.ListenAddress); err != nil {
+			return fmt.Errorf("invalid listen address: %v", err)
+		}
+	case CaptureSourceS3:
+		if source.S3 == nil || source.S3.SecretAccessKey == "" {
+			return errors.New("s3 settings and secret access key are required")
+		}
+	default:
+		return fmt.Errorf("invalid source type %s", source.Type)
+	}
+	return nil
+}
+
+// seenFile is a file found by the sources which poll a directory or a bucket. The files in a directory are
+// identified by size and modification time, the objects in a bucket by etag.
+type seenFile struct {
+	size    int64
+	modTime time.Time
+	etag    string
+	handled bool
+}
+
+// ingestedFile is a file of a watched directory which was already imported. It is persisted, so that the files
+// are not imported again when the source is restarted. ModTime is in nanoseconds.
+type ingestedFile struct {
+	SourceID   RowID     `bson:"source_id"`
+	Name       string    `bson:"name"`
+	Size       int64     `bson:"size"`
+	ModTime    int64     `bson:"mod_time"`
+	ImportedAt time.Time `bson:"imported_at"`
+}
+
+type captureSourceRunner struct {
+	source     CaptureSource
+	storage    Storage
+	importPcap func(fileName string, flushAll bool) (string, error)
+	statistics *CaptureSourceStatistics
+	mutex      *sync.Mutex
+	cancelFunc context.CancelFunc
+	stopped    chan struct{}
+	seenFiles  map[string]seenFile
+}
+
+// run executes the source until ctx is cancelled. If the source stops with an error, it is restarted after
+// captureSourceRetryInterval.
+func (r *captureSourceRunner) run(ctx context.Context, notificationController *NotificationController) {
+	defer close(r.stopped)
+
+	for {
+		var err error
+		switch r.source.Type {
+		case CaptureSourceInterface:
+			err = r.captureInterface(ctx)
+		case CaptureSourceWatchDir:
+			if err = r.loadIngestedFiles(); err == nil {
+				err = r.poll(ctx, r.pollDirectory)
+			}
+		case CaptureSourcePcapOverIP:
+			err = r.listenPcapOverIP(ctx)
+		case CaptureSourceS3:
+			err = r.poll(ctx, r.pollS3Bucket)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.WithError(err).WithField("source", r.source.Name).Error("capture source failed")
+			r.updateStatistics(func(statistics *CaptureSourceStatistics) {
+				statistics.LastError = err.Error()
+			})
+			notificationController.Notify("capture_sources.error", gin.H{"id": r.source.ID, "error": err.Error()})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(captureSourceRetryInterval):
+		}
+	}
+}
+
+func (r *captureSourceRunner) updateStatistics(update func(statistics *CaptureSourceStatistics)) {
+	r.mutex.Lock()
+	update(r.statistics)
+	r.mutex.Unlock()
+}
+
+// importFile imports a pcap of the processing directory. The pcaps already imported are ignored. Returns true if
+// the pcap is imported now or it was imported before.
+func (r *captureSourceRunner) importFile(fileName string) bool {
+	hash, err := r.importPcap(fileName, r.source.FlushAll)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"source": r.source.Name, "file": fileName}).
+			Warn("capture source pcap not imported")
+		return hash != ""
+	}
+	r.updateStatistics(func(statistics *CaptureSourceStatistics) {
+		statistics.ImportedFiles++
+		statistics.LastActivity = time.Now()
+	})
+	return true
+}
+
+func (r *captureSourceRunner) poll(ctx context.Context, pollFunc func(ctx context.Context) error) error {
+	interval := r.source.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	for {
+		if err := pollFunc(ctx); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Duration(interval) * time.Second):
+		}
+	}
+}
+
+// pollDirectory imports the new pcaps found in the directory of the source, in order of modification time. A file is
+// imported when its size and its modification time did not change since the previous poll, or when a newer file
+// was created after it, as it happens when the capture files are rotated (e.g. with tcpdump -G). In this way the
+// files still being written are not imported partially.
+func (r *captureSourceRunner) pollDirectory(ctx context.Context) error {
+	files, err := ioutil.ReadDir(r.source.Directory)
+	if err != nil {
+		return err
+	}
+	files = filterWatchedFiles(files, r.source.Glob)
+
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		previous, isPresent := r.seenFiles[file.Name()]
+		current := seenFile{size: file.Size(), modTime: file.ModTime()}
+		changed := !isPresent || previous.size != current.size || !previous.modTime.Equal(current.modTime)
+		if !changed && previous.handled {
+			continue
+		}
+		r.seenFiles[file.Name()] = current
+		if changed && !files[len(files)-1].ModTime().After(file.ModTime()) {
+			continue
+		}
+
+		fileName := fmt.Sprintf("%v-%s", time.Now().UnixNano(), file.Name())
+		if err := CopyFile(ProcessingPcapsBasePath+fileName, filepath.Join(r.source.Directory, file.Name())); err != nil {
+			return err
+		}
+		current.handled = true
+		r.seenFiles[file.Name()] = current
+		if !r.importFile(fileName) {
+			continue
+		}
+		if err := r.saveIngestedFile(file); err != nil {
+			return err
+		}
+		if err := r.processImportedFile(file.Name()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// filterWatchedFiles returns the files matching glob, or the pcaps if glob is empty, sorted by modification time.
+// The files with the same modification time are sorted by name.
+func filterWatchedFiles(files []os.FileInfo, glob string) []os.FileInfo {
+	watched := make([]os.FileInfo, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		var matched bool
+		if glob != "" {
+			matched, _ = filepath.Match(glob, file.Name())
+		} else {
+			extension := filepath.Ext(file.Name())
+			matched = extension == ".pcap" || extension == ".pcapng"
+		}
+		if matched {
+			watched = append(watched, file)
+		}
+	}
+
+	sort.Slice(watched, func(i, j int) bool {
+		if !watched[i].ModTime().Equal(watched[j].ModTime()) {
+			return watched[i].ModTime().Before(watched[j].ModTime())
+		}
+		return watched[i].Name() < watched[j].Name()
+	})
+	return watched
+}
+
+// processImportedFile keeps, moves or deletes a file of the watched directory after it is imported.
+func (r *captureSourceRunner) processImportedFile(name string) error {
+	filePath := filepath.Join(r.source.Directory, name)
+	switch r.source.AfterImport {
+	case AfterImportMove:
+		destination := filepath.Join(r.source.MoveDirectory, name)
+		if err := os.Rename(filePath, destination); err != nil {
+			// the directories can be on different devices
+			if err := CopyFile(destination, filePath); err != nil {
+				return err
+			}
+			if err := os.Remove(filePath); err != nil {
+				return err
+			}
+		}
+	case AfterImportDelete:
+		if err := os.Remove(filePath); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	delete(r.seenFiles, name)
+	return r.deleteIngestedFile(name)
+}
+
+// loadIngestedFiles reads the files of the watched directory imported before the source was started.
+func (r *captureSourceRunner) loadIngestedFiles() error {
+	if r.storage == nil {
+		return nil
+	}
+
+	var files []ingestedFile
+	if err := r.storage.Find(IngestedFiles).Filter(OrderedDocument{{"source_id", r.source.ID}}).All(&files); err != nil {
+		return err
+	}
+	for _, file := range files {
+		r.seenFiles[file.Name] = seenFile{size: file.Size, modTime: time.Unix(0, file.ModTime), handled: true}
+	}
+	return nil
+}
+
+func (r *captureSourceRunner) saveIngestedFile(file os.FileInfo) error {
+	if r.storage == nil {
+		return nil
+	}
+
+	var upsertResults interface{}
+	_, err := r.storage.Update(IngestedFiles).Filter(OrderedDocument{{"source_id", r.source.ID}, {"name", file.Name()}}).
+		Upsert(&upsertResults).One(ingestedFile{
+		SourceID:   r.source.ID,
+		Name:       file.Name(),
+		Size:       file.Size(),
+		ModTime:    file.ModTime().UnixNano(),
+		ImportedAt: time.Now(),
+	})
+	return err
+}
+
+func (r *captureSourceRunner) deleteIngestedFile(name string) error {
+	if r.storage == nil {
+		return nil
+	}
+
+	err := r.storage.Delete(IngestedFiles).Filter(OrderedDocument{{"source_id", r.source.ID}, {"name", name}}).One()
+	if err == ErrNothingToDelete {
+		return nil
+	}
+	return err
+}
+
+func (r *captureSourceRunner) captureInterface(ctx context.Context) error {
+	handle, err := pcap.OpenLive(r.source.Interface, captureSnapshotLength, true, captureReadTimeout)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if r.source.BPFFilter != "" {
+		if err := handle.SetBPFFilter(r.source.BPFFilter); err != nil {
+			return err
+		}
+	}
+
+	writer := r.newRotatingWriter(handle.LinkType())
+	defer writer.Close()
+	go writer.rotateEvery(ctx)
+
+	for ctx.Err() == nil {
+		data, captureInfo, err := handle.ReadPacketData()
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := writer.WritePacket(captureInfo, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listenPcapOverIP accepts the connections of the clients which send a pcap stream, e.g. with
+// tcpdump -w - | nc caronte 57012. Only the pcap format is supported.
+func (r *captureSourceRunner) listenPcapOverIP(ctx context.Context) error {
+	listener, err := net.Listen("tcp", r.source.ListenAddress)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			if err := r.receivePcapStream(ctx, conn); err != nil && err != io.EOF && ctx.Err() == nil {
+				log.WithError(err).WithFields(log.Fields{"source": r.source.Name, "client": conn.RemoteAddr()}).
+					Warn("pcap-over-ip client disconnected")
+			}
+		}()
+	}
+}
+
+func (r *captureSourceRunner) receivePcapStream(ctx context.Context, conn net.Conn) error {
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	defer conn.Close()
+
+	reader, err := pcapgo.NewReader(conn)
+	if err != nil {
+		return err
+	}
+	writer := r.newRotatingWriter(reader.LinkType())
+	defer writer.Close()
+	writerCtx, cancelWriter := context.WithCancel(ctx)
+	defer cancelWriter()
+	go writer.rotateEvery(writerCtx)
+
+	for {
+		data, captureInfo, err := reader.ReadPacketData()
+		if err != nil {
+			return err
+		}
+		if err := writer.WritePacket(captureInfo, data); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *captureSourceRunner) newRotatingWriter(linkType layers.LinkType) *rotatingPcapWriter {
+	interval := r.source.RotationInterval
+	if interval <= 0 {
+		interval = defaultRotationInterval
+	}
+	return &rotatingPcapWriter{
+		runner:   r,
+		linkType: linkType,
+		interval: time.Duration(interval) * time.Second,
+	}
+}
+
+// rotatingPcapWriter writes the captured packets in the processing directory, and imports the file every interval.
+type rotatingPcapWriter struct {
+	runner   *captureSourceRunner
+	linkType layers.LinkType
+	interval time.Duration
+	file     *os.File
+	fileName string
+	writer   *pcapgo.Writer
+	mutex    sync.Mutex
+}
+
+func (w *rotatingPcapWriter) WritePacket(captureInfo gopacket.CaptureInfo, data []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		w.fileName = fmt.Sprintf("%v-%s.pcap", time.Now().UnixNano(), w.runner.source.ID.Hex())
+		file, err := os.Create(ProcessingPcapsBasePath + w.fileName)
+		if err != nil {
+			return err
+		}
+		w.file = file
+		w.writer = pcapgo.NewWriter(file)
+		if err := w.writer.WriteFileHeader(captureSnapshotLength, w.linkType); err != nil {
+			return err
+		}
+	}
+	if err := w.writer.WritePacket(captureInfo, data); err != nil {
+		return err
+	}
+
+	w.runner.updateStatistics(func(statistics *CaptureSourceStatistics) {
+		statistics.CapturedPackets++
+		statistics.CapturedBytes += int64(len(data))
+		statistics.LastActivity = time.Now()
+	})
+	return nil
+}
+
+func (w *rotatingPcapWriter) rotateEvery(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Close()
+		}
+	}
+}
+
+// Close imports the file currently written, if any. The next packets are written in a new file.
+func (w *rotatingPcapWriter) Close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return
+	}
+	if err := w.file.Close(); err != nil {
+		log.WithError(err).WithField("file", w.fileName).Error("failed to close capture file")
+	}
+	w.file = nil
+	w.runner.importFile(w.fileName)
+}
@@ -0,0 +1,254 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const s3RequestTimeout = 5 * time.Minute
+
+// emptyPayloadHash is the sha256 of an empty body, sent by the GET requests
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		ETag string `xml:"ETag"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// pollS3Bucket downloads and imports the pcaps in the bucket of the source which have not been seen before. The
+// objects are identified by key and etag, so an object which is overwritten is imported again.
+func (r *captureSourceRunner) pollS3Bucket(ctx context.Context) error {
+	settings := r.source.S3
+	client := &http.Client{Timeout: s3RequestTimeout}
+
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if settings.Prefix != "" {
+			query.Set("prefix", settings.Prefix)
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		response, err := s3Request(ctx, client, settings, "", query)
+		if err != nil {
+			return err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		_ = response.Body.Close()
+		if err != nil {
+			return fmt.Errorf("invalid list bucket response: %v", err)
+		}
+
+		for _, object := range result.Contents {
+			extension := path.Ext(object.Key)
+			if extension != ".pcap" && extension != ".pcapng" {
+				continue
+			}
+			if seen, isPresent := r.seenFiles[object.Key]; isPresent && seen.etag == object.ETag {
+				continue
+			}
+			if err := r.downloadS3Object(ctx, client, object.Key); err != nil {
+				return err
+			}
+			r.seenFiles[object.Key] = seenFile{size: object.Size, etag: object.ETag, handled: true}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (r *captureSourceRunner) downloadS3Object(ctx context.Context, client *http.Client, key string) error {
+	response, err := s3Request(ctx, client, r.source.S3, key, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	fileName := fmt.Sprintf("%v-%s", time.Now().UnixNano(), path.Base(key))
+	file, err := os.Create(ProcessingPcapsBasePath + fileName)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, response.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		deleteProcessingFile(fileName)
+		return err
+	}
+
+	r.importFile(fileName)
+	return nil
+}
+
+// s3Request sends a signed GET request for the object with key, or for the bucket if key is empty.
+func s3Request(ctx context.Context, client *http.Client, settings *S3SourceSettings, key string,
+	query url.Values) (*http.Response, error) {
+	endpoint := settings.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", settings.Region)
+	}
+	requestURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if settings.PathStyle {
+		requestURL.Path = "/" + settings.Bucket + "/" + key
+	} else {
+		requestURL.Host = settings.Bucket + "." + requestURL.Host
+		requestURL.Path = "/" + key
+	}
+	requestURL.RawPath = s3EscapePath(requestURL.Path)
+	requestURL.RawQuery = s3EncodeQuery(query)
+
+	request, err := http.NewRequest(http.MethodGet, requestURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	signS3Request(request, settings, time.Now())
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("s3 request failed with status %s: %s", response.Status, body)
+	}
+	return response, nil
+}
+
+// signS3Request adds to request the headers of the AWS Signature Version 4. All the headers already present in the
+// request are signed.
+func signS3Request(request *http.Request, settings *S3SourceSettings, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		s3EscapePath(request.URL.Path),
+		s3EncodeQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	scope := date + "/" + settings.Region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+settings.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, settings.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		settings.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath encodes each segment of the path as required by the signature, without encoding the slashes.
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3EncodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape encodes all the characters except the unreserved ones, as defined by RFC 3986.
+func s3Escape(value string) string {
+	var builder strings.Builder
+	for _, c := range []byte(value) {
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			builder.WriteByte(c)
+		} else {
+			builder.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return builder.String()
+}
@@ -18,9 +18,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var Version string
@@ -28,15 +35,30 @@ var Version string
 func main() {
 	mongoHost := flag.String("mongo-host", "localhost", "address of MongoDB")
 	mongoPort := flag.Int("mongo-port", 27017, "port of MongoDB")
+	mongoURI := flag.String("mongo-uri", "", "connection string of MongoDB, overrides mongo-host and mongo-port "+
+		"(e.g. mongodb://mongo1,mongo2,mongo3/?replicaSet=rs0)")
 	dbName := flag.String("db-name", "caronte", "name of database to use")
 
 	bindAddress := flag.String("bind-address", "0.0.0.0", "address where server is bind")
 	bindPort := flag.Int("bind-port", 3333, "port where server is bind")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 60*time.Second,
+		"time to wait for the imports in progress before exiting")
+	classifierExecutables := flag.String("classifier-executables", "",
+		"comma separated absolute paths of the executables which can be started by the process classifiers")
+	exploitsDirectory := flag.String("exploits-directory", "exploits",
+		"directory where the exploits exporter can create the git repositories")
 
 	flag.Parse()
 
 	logFields := log.Fields{"host": *mongoHost, "port": *mongoPort, "dbName": *dbName}
-	storage, err := NewMongoStorage(*mongoHost, *mongoPort, *dbName)
+	var storage *MongoStorage
+	var err error
+	if *mongoURI != "" {
+		logFields = log.Fields{"uri": *mongoURI, "dbName": *dbName}
+		storage, err = NewMongoStorageFromURI(*mongoURI, *dbName)
+	} else {
+		storage, err = NewMongoStorage(*mongoHost, *mongoPort, *dbName)
+	}
 	if err != nil {
 		log.WithError(err).WithFields(logFields).Fatal("failed to connect to MongoDB")
 	}
@@ -49,16 +71,52 @@ func main() {
 		log.WithError(err).WithFields(logFields).Fatal("failed to create application context")
 	}
 
+	if *classifierExecutables != "" {
+		applicationContext.ClassifierExecutables = strings.Split(*classifierExecutables, ",")
+	}
+	applicationContext.ExploitsDirectory = *exploitsDirectory
+
 	notificationController := NewNotificationController(applicationContext)
 	go notificationController.Run()
 	applicationContext.SetNotificationController(notificationController)
 
+	applicationContext.StorageMonitor = NewStorageMonitor(storage, notificationController)
+	go applicationContext.StorageMonitor.Run()
+
 	resourcesController := NewResourcesController(notificationController)
 	go resourcesController.Run()
 
 	applicationContext.Configure()
+	applicationContext.ProjectsController = NewProjectsController(storage, applicationContext)
 	applicationRouter := CreateApplicationRouter(applicationContext, notificationController, resourcesController)
-	if applicationRouter.Run(fmt.Sprintf("%s:%v", *bindAddress, *bindPort)) != nil {
-		log.WithError(err).WithFields(logFields).Fatal("failed to create the server")
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%v", *bindAddress, *bindPort),
+		Handler: applicationRouter,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).WithFields(logFields).Fatal("failed to create the server")
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := applicationContext.Reload(); err != nil {
+			log.WithError(err).Error("failed to reload configuration")
+		}
+	}
+
+	log.Info("shutting down the server")
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.WithError(err).Error("failed to shutdown the server gracefully")
+	}
+	if err := applicationContext.Shutdown(ctx); err != nil {
+		log.WithError(err).Error("imports in progress have been cancelled before completion")
 	}
 }
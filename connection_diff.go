@@ -0,0 +1,267 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	DiffStatusEqual   = "equal"
+	DiffStatusChanged = "changed"
+	DiffStatusAdded   = "added"
+	DiffStatusMissing = "missing"
+)
+
+// maxDiffLines is the maximum number of lines of two messages compared line by line
+const maxDiffLines = 1000
+
+// maxDiffMessages is the maximum number of messages of each connection which are compared
+const maxDiffMessages = 1000
+
+// maxSignatureLength is the maximum length of the first line of the messages used to align them
+const maxSignatureLength = 128
+
+var signatureDigitsRegex = regexp.MustCompile(`[0-9]+`)
+
+// ConnectionDiff is the comparison of a connection with the golden connection of its service. The consecutive
+// messages sent by the same side are compared as a single message. The messages are aligned by their signature (the
+// first line without the query string and the numbers, or the first bytes of the binary messages): the aligned
+// messages are equal or changed, the others are added (present only in the connection) or missing (present only
+// in the golden connection). The requests added or missing are the deviations from the normal checker behavior.
+type ConnectionDiff struct {
+	ConnectionID       RowID         `json:"connection_id"`
+	GoldenConnectionID RowID         `json:"golden_connection_id"`
+	Messages           []MessageDiff `json:"messages"`
+	Deviations         int           `json:"deviations"`
+	FirstDeviation     int           `json:"first_deviation"`
+}
+
+type MessageDiff struct {
+	Status        string     `json:"status"`
+	FromClient    bool       `json:"from_client"`
+	Content       string     `json:"content,omitempty"`
+	GoldenContent string     `json:"golden_content,omitempty"`
+	Lines         []LineDiff `json:"lines,omitempty"`
+}
+
+// LineDiff is a line of a changed message. Operation is = for the lines present in both messages, + for the lines
+// present only in the connection and - for the lines present only in the golden connection.
+type LineDiff struct {
+	Operation string `json:"operation"`
+	Line      string `json:"line"`
+}
+
+type diffTurn struct {
+	fromClient bool
+	content    string
+	signature  string
+}
+
+// DiffWithGolden compares the connection with the golden connection of its service. Returns false if the connection
+// does not exist, and an error if its service has no golden connection.
+func (csc ConnectionStreamsController) DiffWithGolden(c context.Context, connectionID RowID) (ConnectionDiff,
+	bool, error) {
+	connection := csc.getConnection(c, connectionID)
+	if connection.ID.IsZero() {
+		return ConnectionDiff{}, false, nil
+	}
+
+	var service Service
+	if csc.servicesController != nil {
+		service = csc.servicesController.GetServices()[connection.DestinationPort]
+	}
+	if service.GoldenConnection == nil {
+		return ConnectionDiff{}, true, errors.New("the service of the connection has no golden connection")
+	}
+
+	messages, _ := csc.GetConnectionMessages(c, connectionID, GetMessageFormat{})
+	goldenMessages, isPresent := csc.GetConnectionMessages(c, *service.GoldenConnection, GetMessageFormat{})
+	if !isPresent {
+		return ConnectionDiff{}, true, errors.New("the golden connection does not exist anymore")
+	}
+
+	diff := DiffMessages(goldenMessages, messages)
+	diff.ConnectionID = connectionID
+	diff.GoldenConnectionID = *service.GoldenConnection
+	return diff, true, nil
+}
+
+// DiffMessages compares the messages of a connection with the messages of the golden connection.
+func DiffMessages(goldenMessages, messages []*Message) ConnectionDiff {
+	golden, other := messagesTurns(goldenMessages), messagesTurns(messages)
+	if len(golden) > maxDiffMessages {
+		golden = golden[:maxDiffMessages]
+	}
+	if len(other) > maxDiffMessages {
+		other = other[:maxDiffMessages]
+	}
+	diff := ConnectionDiff{Messages: make([]MessageDiff, 0, len(other)), FirstDeviation: -1}
+
+	addDeviation := func(turn diffTurn) {
+		if turn.fromClient {
+			if diff.FirstDeviation < 0 {
+				diff.FirstDeviation = len(diff.Messages)
+			}
+			diff.Deviations++
+		}
+	}
+
+	alignment := longestCommonSubsequence(len(golden), len(other), func(i, j int) bool {
+		return golden[i].signature == other[j].signature
+	})
+	i, j := 0, 0
+	for _, pair := range append(alignment, [2]int{len(golden), len(other)}) {
+		for ; i < pair[0]; i++ {
+			addDeviation(golden[i])
+			diff.Messages = append(diff.Messages, MessageDiff{Status: DiffStatusMissing,
+				FromClient: golden[i].fromClient, GoldenContent: golden[i].content})
+		}
+		for ; j < pair[1]; j++ {
+			addDeviation(other[j])
+			diff.Messages = append(diff.Messages, MessageDiff{Status: DiffStatusAdded,
+				FromClient: other[j].fromClient, Content: other[j].content})
+		}
+		if i == len(golden) && j == len(other) {
+			break
+		}
+
+		messageDiff := MessageDiff{Status: DiffStatusEqual, FromClient: other[j].fromClient,
+			Content: other[j].content, GoldenContent: golden[i].content}
+		if golden[i].content != other[j].content {
+			messageDiff.Status = DiffStatusChanged
+			messageDiff.Lines = diffLines(golden[i].content, other[j].content)
+		}
+		diff.Messages = append(diff.Messages, messageDiff)
+		i, j = i+1, j+1
+	}
+
+	return diff
+}
+
+// messagesTurns joins the consecutive messages sent by the same side.
+func messagesTurns(messages []*Message) []diffTurn {
+	turns := make([]diffTurn, 0)
+	var sb strings.Builder
+	for i, message := range messages {
+		sb.WriteString(message.Content)
+		if i == len(messages)-1 || messages[i+1].FromClient != message.FromClient {
+			content := sb.String()
+			turns = append(turns, diffTurn{
+				fromClient: message.FromClient,
+				content:    content,
+				signature:  messageSignature(message.FromClient, content),
+			})
+			sb.Reset()
+		}
+	}
+	return turns
+}
+
+// messageSignature returns the string used to align the messages of two connections. The values which change
+// between the checker sessions, like the query strings and the numbers, are removed from the first line.
+func messageSignature(fromClient bool, content string) string {
+	side := "s:"
+	if fromClient {
+		side = "c:"
+	}
+
+	firstLine := content
+	if index := strings.IndexByte(firstLine, '\n'); index >= 0 {
+		firstLine = firstLine[:index]
+	}
+	firstLine = strings.TrimSuffix(firstLine, "\r")
+	if len(firstLine) > maxSignatureLength || !isTextual([]byte(firstLine)) {
+		if len(content) > 4 {
+			return side + "binary:" + content[:4]
+		}
+		return side + "binary:" + content
+	}
+
+	if index := strings.IndexByte(firstLine, '?'); index >= 0 {
+		if end := strings.IndexByte(firstLine[index:], ' '); end >= 0 {
+			firstLine = firstLine[:index] + firstLine[index+end:]
+		} else {
+			firstLine = firstLine[:index]
+		}
+	}
+	return side + signatureDigitsRegex.ReplaceAllString(firstLine, "0")
+}
+
+// diffLines compares the lines of two messages. Returns nil if the messages are too long to be compared.
+func diffLines(golden, other string) []LineDiff {
+	goldenLines, otherLines := strings.Split(golden, "\n"), strings.Split(other, "\n")
+	if len(goldenLines) > maxDiffLines || len(otherLines) > maxDiffLines {
+		return nil
+	}
+
+	alignment := longestCommonSubsequence(len(goldenLines), len(otherLines), func(i, j int) bool {
+		return goldenLines[i] == otherLines[j]
+	})
+	lines := make([]LineDiff, 0, len(otherLines))
+	i, j := 0, 0
+	for _, pair := range append(alignment, [2]int{len(goldenLines), len(otherLines)}) {
+		for ; i < pair[0]; i++ {
+			lines = append(lines, LineDiff{Operation: "-", Line: goldenLines[i]})
+		}
+		for ; j < pair[1]; j++ {
+			lines = append(lines, LineDiff{Operation: "+", Line: otherLines[j]})
+		}
+		if i < len(goldenLines) && j < len(otherLines) {
+			lines = append(lines, LineDiff{Operation: "=", Line: otherLines[j]})
+			i, j = i+1, j+1
+		}
+	}
+	return lines
+}
+
+// longestCommonSubsequence returns the pairs of indexes of the elements of two sequences, of length n and m, which
+// form their longest common subsequence.
+func longestCommonSubsequence(n, m int, equals func(i, j int) bool) [][2]int {
+	lengths := make([][]int, n+1)
+	for i := range lengths {
+		lengths[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if equals(i, j) {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	pairs := make([][2]int, 0, lengths[0][0])
+	for i, j := 0, 0; i < n && j < m; {
+		if equals(i, j) {
+			pairs = append(pairs, [2]int{i, j})
+			i, j = i+1, j+1
+		} else if lengths[i+1][j] >= lengths[i][j+1] {
+			i++
+		} else {
+			j++
+		}
+	}
+	return pairs
+}
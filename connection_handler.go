@@ -21,11 +21,12 @@ import (
 	"encoding/binary"
 	"fmt"
 	"github.com/flier/gohs/hyperscan"
+	"github.com/gin-gonic/gin"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/tcpassembly"
 	log "github.com/sirupsen/logrus"
 	"hash/fnv"
-	"net"
+	"sort"
 	"sync"
 	"time"
 )
@@ -34,38 +35,97 @@ const initialConnectionsCapacity = 1024
 const initialScannersCapacity = 1024
 
 type BiDirectionalStreamFactory struct {
-	storage        Storage
-	serverNet      net.IPNet
-	connections    map[StreamFlow]ConnectionHandler
-	mConnections   sync.Mutex
-	rulesManager   RulesManager
-	rulesDatabase  RulesDatabase
-	mRulesDatabase sync.Mutex
-	scanners       []Scanner
+	storage                Storage
+	serverNet              IPNetworks
+	connections            map[StreamFlow]ConnectionHandler
+	mConnections           sync.Mutex
+	rulesManager           RulesManager
+	rulesDatabase          RulesDatabase
+	mRulesDatabase         sync.Mutex
+	scanners               []Scanner
+	detector               *ServicesDetector
+	scriptsController      *ScriptsController
+	notificationController *NotificationController
+	storageLimits          *StorageLimits
+	geoIP                  *GeoIP
+	scannerMetrics         ScannerMetrics
+	assemblyMetrics        AssemblyMetrics
+	mMetrics               sync.Mutex
 }
 
 type StreamFlow [4]gopacket.Endpoint
 
+// Scanner is a scratch space of the pool, allocated for the database with the given version. The stream handlers take
+// a scanner only while they process the reassembled bytes, and account the scanned bytes and the scan time on it.
 type Scanner struct {
-	scratch *hyperscan.Scratch
-	version RowID
+	scratch      *hyperscan.Scratch
+	version      RowID
+	scannedBytes int64
+	scanTime     time.Duration
+}
+
+// ScannerMetrics measure the reuse of the scratch spaces and the throughput of the patterns scans. ScanTime is in
+// milliseconds, Throughput is in bytes per second of scan time.
+type ScannerMetrics struct {
+	ScratchAllocations int64   `json:"scratch_allocations"`
+	ScratchReuses      int64   `json:"scratch_reuses"`
+	ReuseRate          float64 `json:"reuse_rate"`
+	IdleScratches      int     `json:"idle_scratches"`
+	ScannedBytes       int64   `json:"scanned_bytes"`
+	ScanTime           int64   `json:"scan_time"`
+	Throughput         float64 `json:"throughput"`
+	scanTime           time.Duration
+}
+
+// AssemblyMetrics count the streams reassembled, the connections saved and the connections matched by each rule.
+type AssemblyMetrics struct {
+	ReassembledStreams int64           `json:"reassembled_streams"`
+	SavedConnections   int64           `json:"saved_connections"`
+	RuleMatches        map[RowID]int64 `json:"rule_matches"`
+}
+
+// StreamPatterns is the database which a stream is scanned with, taken together with the options of its patterns
+// when the stream is opened, so that they don't change if a new database is compiled while the stream is open. The
+// maps must not be modified.
+type StreamPatterns struct {
+	Database      hyperscan.StreamDatabase
+	Version       RowID
+	Size          int
+	DecodeLayers  map[uint][]string
+	ExtendCapture map[uint]bool // the patterns of the rules which extend the storage limits
+	Redact        map[uint]bool // the patterns of the rules which redact their matches
 }
 
 type ConnectionHandler interface {
 	Complete(handler *StreamHandler)
 	Storage() Storage
-	PatternsDatabase() hyperscan.StreamDatabase
-	PatternsDatabaseSize() int
+	PatternsDatabase(servicePort uint16) StreamPatterns
+	TakeScanner() Scanner
+	ReleaseScanner(scanner Scanner)
+	PatternsServices() map[uint]map[uint16]bool
+	StorageLimits() StorageLimitsSettings
 }
 
 type connectionHandlerImpl struct {
 	factory        *BiDirectionalStreamFactory
 	connectionFlow StreamFlow
+	sensor         string
 	mComplete      sync.Mutex
 	otherStream    *StreamHandler
 }
 
-func NewBiDirectionalStreamFactory(storage Storage, serverNet net.IPNet,
+// sensorStreamFactory creates the streams of the packets received from a remote sensor, so that the connections are
+// tagged with the name of the sensor.
+type sensorStreamFactory struct {
+	factory *BiDirectionalStreamFactory
+	sensor  string
+}
+
+func (ssf sensorStreamFactory) New(netFlow, transportFlow gopacket.Flow) tcpassembly.Stream {
+	return ssf.factory.newStream(netFlow, transportFlow, ssf.sensor)
+}
+
+func NewBiDirectionalStreamFactory(storage Storage, serverNet IPNetworks,
 	rulesManager RulesManager) *BiDirectionalStreamFactory {
 
 	factory := &BiDirectionalStreamFactory{
@@ -89,12 +149,30 @@ func (factory *BiDirectionalStreamFactory) updateRulesDatabaseService() {
 			if !ok {
 				return
 			}
+			// the scratch of the new database must be allocable, otherwise the previous database is kept
+			scratch, err := hyperscan.NewScratch(rulesDatabase.database)
+			if err == nil {
+				err = rulesDatabase.allocScratch(scratch)
+			}
+			if scratch != nil {
+				_ = scratch.Free()
+			}
+			if err != nil {
+				log.WithError(err).WithField("version", rulesDatabase.version).
+					Error("failed to alloc the scratch of the new rules database, the previous one is kept")
+				factory.notificationController.Notify("rules.database_rejected", gin.H{
+					"version": rulesDatabase.version,
+					"error":   err.Error(),
+				})
+				continue
+			}
+
 			factory.mRulesDatabase.Lock()
 			scanners := factory.scanners
 			factory.scanners = factory.scanners[:0]
 
 			for _, s := range scanners {
-				err := s.scratch.Realloc(rulesDatabase.database)
+				err := rulesDatabase.allocScratch(s.scratch)
 				if err != nil {
 					log.WithError(err).Error("failed to realloc an existing scanner")
 				} else {
@@ -105,6 +183,11 @@ func (factory *BiDirectionalStreamFactory) updateRulesDatabaseService() {
 
 			factory.rulesDatabase = rulesDatabase
 			factory.mRulesDatabase.Unlock()
+
+			factory.notificationController.Notify("rules.database_updated", gin.H{
+				"version":        rulesDatabase.version,
+				"patterns_count": rulesDatabase.databaseSize,
+			})
 		}
 	}
 }
@@ -115,9 +198,13 @@ func (factory *BiDirectionalStreamFactory) takeScanner() Scanner {
 
 	if len(factory.scanners) == 0 {
 		scratch, err := hyperscan.NewScratch(factory.rulesDatabase.database)
+		if err == nil {
+			err = factory.rulesDatabase.allocScratch(scratch)
+		}
 		if err != nil {
 			log.WithError(err).Fatal("failed to alloc a new scratch")
 		}
+		factory.scannerMetrics.ScratchAllocations++
 
 		return Scanner{
 			scratch: scratch,
@@ -128,6 +215,7 @@ func (factory *BiDirectionalStreamFactory) takeScanner() Scanner {
 	index := len(factory.scanners) - 1
 	scanner := factory.scanners[index]
 	factory.scanners = factory.scanners[:index]
+	factory.scannerMetrics.ScratchReuses++
 
 	return scanner
 }
@@ -136,8 +224,12 @@ func (factory *BiDirectionalStreamFactory) releaseScanner(scanner Scanner) {
 	factory.mRulesDatabase.Lock()
 	defer factory.mRulesDatabase.Unlock()
 
+	factory.scannerMetrics.ScannedBytes += scanner.scannedBytes
+	factory.scannerMetrics.scanTime += scanner.scanTime
+	scanner.scannedBytes = 0
+	scanner.scanTime = 0
 	if scanner.version != factory.rulesDatabase.version {
-		err := scanner.scratch.Realloc(factory.rulesDatabase.database)
+		err := factory.rulesDatabase.allocScratch(scanner.scratch)
 		if err != nil {
 			log.WithError(err).Error("failed to realloc an existing scanner")
 			return
@@ -147,7 +239,42 @@ func (factory *BiDirectionalStreamFactory) releaseScanner(scanner Scanner) {
 	factory.scanners = append(factory.scanners, scanner)
 }
 
+// ScannerMetrics returns the metrics of the scratch spaces pool and of the scans since the factory was created.
+func (factory *BiDirectionalStreamFactory) ScannerMetrics() ScannerMetrics {
+	factory.mRulesDatabase.Lock()
+	defer factory.mRulesDatabase.Unlock()
+
+	metrics := factory.scannerMetrics
+	metrics.IdleScratches = len(factory.scanners)
+	metrics.ScanTime = metrics.scanTime.Milliseconds()
+	if taken := metrics.ScratchAllocations + metrics.ScratchReuses; taken > 0 {
+		metrics.ReuseRate = float64(metrics.ScratchReuses) / float64(taken)
+	}
+	if metrics.scanTime > 0 {
+		metrics.Throughput = float64(metrics.ScannedBytes) / metrics.scanTime.Seconds()
+	}
+	return metrics
+}
+
+// AssemblyMetrics returns the metrics of the reassembly since the factory was created.
+func (factory *BiDirectionalStreamFactory) AssemblyMetrics() AssemblyMetrics {
+	factory.mMetrics.Lock()
+	defer factory.mMetrics.Unlock()
+
+	metrics := factory.assemblyMetrics
+	metrics.RuleMatches = make(map[RowID]int64, len(factory.assemblyMetrics.RuleMatches))
+	for id, matches := range factory.assemblyMetrics.RuleMatches {
+		metrics.RuleMatches[id] = matches
+	}
+	return metrics
+}
+
 func (factory *BiDirectionalStreamFactory) New(netFlow, transportFlow gopacket.Flow) tcpassembly.Stream {
+	return factory.newStream(netFlow, transportFlow, "")
+}
+
+func (factory *BiDirectionalStreamFactory) newStream(netFlow, transportFlow gopacket.Flow,
+	sensor string) tcpassembly.Stream {
 	flow := StreamFlow{netFlow.Src(), netFlow.Dst(), transportFlow.Src(), transportFlow.Dst()}
 	invertedFlow := StreamFlow{netFlow.Dst(), netFlow.Src(), transportFlow.Dst(), transportFlow.Src()}
 
@@ -165,6 +292,7 @@ func (factory *BiDirectionalStreamFactory) New(netFlow, transportFlow gopacket.F
 		}
 		connection = &connectionHandlerImpl{
 			connectionFlow: connectionFlow,
+			sensor:         sensor,
 			mComplete:      sync.Mutex{},
 			factory:        factory,
 		}
@@ -172,13 +300,16 @@ func (factory *BiDirectionalStreamFactory) New(netFlow, transportFlow gopacket.F
 	}
 	factory.mConnections.Unlock()
 
-	streamHandler := NewStreamHandler(connection, flow, factory.takeScanner(), !isServer)
+	streamHandler := NewStreamHandler(connection, flow, !isServer)
 
 	return &streamHandler
 }
 
 func (ch *connectionHandlerImpl) Complete(handler *StreamHandler) {
-	ch.factory.releaseScanner(handler.scanner)
+	ch.factory.mMetrics.Lock()
+	ch.factory.assemblyMetrics.ReassembledStreams++
+	ch.factory.mMetrics.Unlock()
+
 	ch.mComplete.Lock()
 	if ch.otherStream == nil {
 		ch.otherStream = handler
@@ -213,30 +344,75 @@ func (ch *connectionHandlerImpl) Complete(handler *StreamHandler) {
 	connection := Connection{
 		ID:              connectionID,
 		SourceIP:        ch.connectionFlow[0].String(),
+		SourceIPBytes:   ipBytes(ch.connectionFlow[0].String()),
 		DestinationIP:   ch.connectionFlow[1].String(),
 		SourcePort:      binary.BigEndian.Uint16(ch.connectionFlow[2].Raw()),
 		DestinationPort: binary.BigEndian.Uint16(ch.connectionFlow[3].Raw()),
 		StartedAt:       startedAt,
 		ClosedAt:        closedAt,
-		ClientBytes:     client.streamLength,
-		ServerBytes:     server.streamLength,
-		ClientDocuments: len(client.documentsIDs),
-		ServerDocuments: len(server.documentsIDs),
+		StartedAtNanos:  startedAt.UnixNano(),
+		ClosedAtNanos:   closedAt.UnixNano(),
+		ClientBytes:     client.streamLength + client.droppedBytes,
+		ServerBytes:     server.streamLength + server.droppedBytes,
 		ProcessedAt:     time.Now(),
+		ClientLocation:  ch.factory.geoIP.Lookup(ch.connectionFlow[0].String()),
+		ServerLocation:  ch.factory.geoIP.Lookup(ch.connectionFlow[1].String()),
+		Truncated:       client.truncated || server.truncated,
+		CaptureExtended: client.captureExtended || server.captureExtended,
+		Sensor:          ch.sensor,
+		TLSFingerprint:  ja3Fingerprint(client.prefix),
 	}
 	ch.factory.rulesManager.FillWithMatchedRules(&connection, client.patternMatches, server.patternMatches)
+	// the scripts run before the connection is saved, so that the rules they suppress are never acted on
+	if ch.factory.scriptsController == nil || len(connection.MatchedRules) == 0 ||
+		!ch.factory.scriptsController.EnqueueHooks(connection, client, server, func(connection Connection) {
+			ch.saveConnection(connection, client, server)
+		}) {
+		ch.saveConnection(connection, client, server)
+	}
+}
+
+// saveConnection redacts and stores the documents of the streams, completes the connection with the fingerprints, the
+// previews and the references of the streams, and saves it.
+func (ch *connectionHandlerImpl) saveConnection(connection Connection, client, server *StreamHandler) {
+	connection.MatchedLayers = ch.matchedLayers(connection.MatchedRules, client, server)
+	redactedPatterns := ch.factory.rulesManager.RedactedPatterns(connection.MatchedRules)
+	if len(redactedPatterns) > 0 {
+		client.redactMatches(redactedPatterns, DirectionToClient)
+		server.redactMatches(redactedPatterns, DirectionToServer)
+	}
+	// the documents kept in memory are stored after the redaction, already linked to the connection
+	var streamsIDs []RowID
+	for _, stream := range []*StreamHandler{client, server} {
+		if len(stream.pendingDocuments) == 0 {
+			streamsIDs = append(streamsIDs, stream.documentsIDs...)
+		}
+		stream.storePendingDocuments(connection.ID)
+	}
+	connection.ClientDocuments = len(client.documentsIDs)
+	connection.ServerDocuments = len(server.documentsIDs)
+	// the fingerprints, the references and the previews are built after the redaction, which removes the secrets
+	connection.ClientMinHash = client.fingerprint.Signature()
+	connection.ServerMinHash = server.fingerprint.Signature()
+	connection.MinHashBands = fingerprintBands(connection.ClientMinHash, connection.ServerMinHash)
+	connection.References = mergeReferences(client.references, server.references)
+	connection.ClientPreview = buildStreamPreview(client.prefix, client.firstBlockSize, client.previewStrings)
+	connection.ServerPreview = buildStreamPreview(server.prefix, server.firstBlockSize, server.previewStrings)
+	if ch.factory.detector != nil {
+		ch.factory.detector.Detect(connection, client.prefix, server.prefix)
+	}
 
 	_, err := ch.Storage().Insert(Connections).One(connection)
 	if err != nil {
 		log.WithError(err).WithField("connection", connection).Error("failed to insert a connection")
 		return
 	}
+	ch.factory.connectionSaved(connection)
 
-	streamsIDs := append(client.documentsIDs, server.documentsIDs...)
 	if len(streamsIDs) > 0 {
 		n, err := ch.Storage().Update(ConnectionStreams).
 			Filter(OrderedDocument{{"_id", UnorderedDocument{"$in": streamsIDs}}}).
-			Many(UnorderedDocument{"connection_id": connectionID})
+			Many(UnorderedDocument{"connection_id": connection.ID})
 		if err != nil {
 			log.WithError(err).WithField("connection", connection).Error("failed to update connection streams")
 		} else if int(n) != len(streamsIDs) {
@@ -247,6 +423,27 @@ func (ch *connectionHandlerImpl) Complete(handler *StreamHandler) {
 	ch.UpdateStatistics(connection)
 }
 
+// connectionSaved notifies a new connection and the rules it matched, and updates the assembly metrics.
+func (factory *BiDirectionalStreamFactory) connectionSaved(connection Connection) {
+	factory.notificationController.Notify("connections.new", connection)
+	factory.mMetrics.Lock()
+	factory.assemblyMetrics.SavedConnections++
+	if len(connection.MatchedRules) > 0 && factory.assemblyMetrics.RuleMatches == nil {
+		factory.assemblyMetrics.RuleMatches = make(map[RowID]int64)
+	}
+	for _, id := range connection.MatchedRules {
+		factory.assemblyMetrics.RuleMatches[id]++
+	}
+	factory.mMetrics.Unlock()
+	if len(connection.MatchedRules) > 0 {
+		factory.notificationController.Notify("rules.matched", gin.H{
+			"connection_id": connection.ID,
+			"service_port":  connection.DestinationPort,
+			"matched_rules": connection.MatchedRules,
+		})
+	}
+}
+
 func (ch *connectionHandlerImpl) UpdateStatistics(connection Connection) {
 	rangeStart := connection.StartedAt.Unix() / 60 // group statistic records by minutes
 	duration := connection.ClosedAt.Sub(connection.StartedAt)
@@ -262,6 +459,8 @@ func (ch *connectionHandlerImpl) UpdateStatistics(connection Connection) {
 		fmt.Sprintf("server_bytes_per_service.%d", servicePort): connection.ServerBytes,
 		fmt.Sprintf("total_bytes_per_service.%d", servicePort):  connection.ClientBytes + connection.ServerBytes,
 		fmt.Sprintf("duration_per_service.%d", servicePort):     duration.Milliseconds(),
+		fmt.Sprintf("flags_in_per_service.%d", servicePort):     connection.FlagsIn,
+		fmt.Sprintf("flags_out_per_service.%d", servicePort):    connection.FlagsOut,
 	}
 
 	for _, ruleID := range connection.MatchedRules {
@@ -280,12 +479,76 @@ func (ch *connectionHandlerImpl) Storage() Storage {
 	return ch.factory.storage
 }
 
-func (ch *connectionHandlerImpl) PatternsDatabase() hyperscan.StreamDatabase {
-	return ch.factory.rulesDatabase.database
+func (ch *connectionHandlerImpl) PatternsDatabase(servicePort uint16) StreamPatterns {
+	ch.factory.mRulesDatabase.Lock()
+	defer ch.factory.mRulesDatabase.Unlock()
+
+	return StreamPatterns{
+		Database:      ch.factory.rulesDatabase.streamDatabase(servicePort),
+		Version:       ch.factory.rulesDatabase.version,
+		Size:          ch.factory.rulesDatabase.databaseSize,
+		DecodeLayers:  ch.factory.rulesDatabase.decodeLayers,
+		ExtendCapture: ch.factory.rulesDatabase.extendCapturePatterns,
+		Redact:        ch.factory.rulesDatabase.redactPatterns,
+	}
+}
+
+func (ch *connectionHandlerImpl) TakeScanner() Scanner {
+	return ch.factory.takeScanner()
+}
+
+func (ch *connectionHandlerImpl) ReleaseScanner(scanner Scanner) {
+	ch.factory.releaseScanner(scanner)
+}
+
+func (ch *connectionHandlerImpl) PatternsServices() map[uint]map[uint16]bool {
+	return ch.factory.rulesManager.PatternsServices()
+}
+
+func (ch *connectionHandlerImpl) StorageLimits() StorageLimitsSettings {
+	return ch.factory.storageLimits.GetSettings()
 }
 
-func (ch *connectionHandlerImpl) PatternsDatabaseSize() int {
-	return ch.factory.rulesDatabase.databaseSize
+// matchedLayers returns, for each matched rule with matches found in the decoded payloads, the decoding layers which
+// produced them.
+func (ch *connectionHandlerImpl) matchedLayers(matchedRules []RowID, client, server *StreamHandler) map[string][]string {
+	if len(client.decodedLayers) == 0 && len(server.decodedLayers) == 0 {
+		return nil
+	}
+
+	matchedLayers := make(map[string][]string)
+	for _, id := range matchedRules {
+		rule, isPresent := ch.factory.rulesManager.GetRule(id)
+		if !isPresent {
+			continue
+		}
+		layers := make(map[string]bool)
+		for _, pattern := range rule.Patterns {
+			if pattern.Direction != DirectionToClient {
+				for layer := range client.decodedLayers[pattern.internalID] {
+					layers[layer] = true
+				}
+			}
+			if pattern.Direction != DirectionToServer {
+				for layer := range server.decodedLayers[pattern.internalID] {
+					layers[layer] = true
+				}
+			}
+		}
+		if len(layers) > 0 {
+			sortedLayers := make([]string, 0, len(layers))
+			for layer := range layers {
+				sortedLayers = append(sortedLayers, layer)
+			}
+			sort.Strings(sortedLayers)
+			matchedLayers[id.Hex()] = sortedLayers
+		}
+	}
+
+	if len(matchedLayers) == 0 {
+		return nil
+	}
+	return matchedLayers
 }
 
 func (sf StreamFlow) Hash() uint64 {
@@ -42,9 +42,9 @@ func TestTakeReleaseScanners(t *testing.T) {
 	database, err := hyperscan.NewStreamDatabase(hyperscan.NewPattern("/nope/", 0))
 	require.NoError(t, err)
 
-	factory := NewBiDirectionalStreamFactory(wrapper.Storage, *serverNet, &ruleManager)
+	factory := NewBiDirectionalStreamFactory(wrapper.Storage, IPNetworks{serverNet}, &ruleManager)
 	version := NewRowID()
-	ruleManager.DatabaseUpdateChannel() <- RulesDatabase{database, 0, version}
+	ruleManager.DatabaseUpdateChannel() <- RulesDatabase{database, 0, version, nil, nil, nil, nil}
 	time.Sleep(10 * time.Millisecond)
 
 	n := 1000
@@ -54,12 +54,16 @@ func TestTakeReleaseScanners(t *testing.T) {
 
 		if i%50 == 0 {
 			version = NewRowID()
-			ruleManager.DatabaseUpdateChannel() <- RulesDatabase{database, 0, version}
+			ruleManager.DatabaseUpdateChannel() <- RulesDatabase{database, 0, version, nil, nil, nil, nil}
 			time.Sleep(10 * time.Millisecond)
 		}
 		factory.releaseScanner(scanner)
 	}
 	assert.Len(t, factory.scanners, 1)
+	metrics := factory.ScannerMetrics()
+	assert.Equal(t, int64(1), metrics.ScratchAllocations)
+	assert.Equal(t, int64(n-1), metrics.ScratchReuses)
+	assert.Equal(t, 1, metrics.IdleScratches)
 
 	scanners := make([]Scanner, n)
 	for i := 0; i < n; i++ {
@@ -72,7 +76,7 @@ func TestTakeReleaseScanners(t *testing.T) {
 	assert.Len(t, factory.scanners, n)
 
 	version = NewRowID()
-	ruleManager.DatabaseUpdateChannel() <- RulesDatabase{database, 0, version}
+	ruleManager.DatabaseUpdateChannel() <- RulesDatabase{database, 0, version, nil, nil, nil, nil}
 	time.Sleep(10 * time.Millisecond)
 
 	for i := 0; i < n; i++ {
@@ -105,9 +109,9 @@ func TestConnectionFactory(t *testing.T) {
 	database, err := hyperscan.NewStreamDatabase(hyperscan.NewPattern("/nope/", 0))
 	require.NoError(t, err)
 
-	factory := NewBiDirectionalStreamFactory(wrapper.Storage, *ParseIPNet(testDstIP), &ruleManager)
+	factory := NewBiDirectionalStreamFactory(wrapper.Storage, ParseIPNetworks(testDstIP), &ruleManager)
 	version := NewRowID()
-	ruleManager.DatabaseUpdateChannel() <- RulesDatabase{database, 0, version}
+	ruleManager.DatabaseUpdateChannel() <- RulesDatabase{database, 0, version, nil, nil, nil, nil}
 	time.Sleep(10 * time.Millisecond)
 
 	testInteraction := func(netFlow gopacket.Flow, transportFlow gopacket.Flow, otherSeenChan chan time.Time,
@@ -145,13 +149,15 @@ func TestConnectionFactory(t *testing.T) {
 		require.NoError(t, err)
 
 		assert.NotNil(t, result)
-		assert.Equal(t, CustomRowID(connectionFlow.Hash(), result.StartedAt), result.ID)
+		assert.Equal(t, CustomRowID(connectionFlow.Hash(), time.Unix(0, result.StartedAtNanos)), result.ID)
 		assert.Equal(t, netFlow.Src().String(), result.SourceIP)
 		assert.Equal(t, netFlow.Dst().String(), result.DestinationIP)
 		assert.Equal(t, binary.BigEndian.Uint16(transportFlow.Src().Raw()), result.SourcePort)
 		assert.Equal(t, binary.BigEndian.Uint16(transportFlow.Dst().Raw()), result.DestinationPort)
 		assert.Equal(t, startedAt.Unix(), result.StartedAt.Unix())
 		assert.Equal(t, closedAt.Unix(), result.ClosedAt.Unix())
+		assert.Equal(t, startedAt.UnixNano(), result.StartedAtNanos)
+		assert.Equal(t, closedAt.UnixNano(), result.ClosedAtNanos)
 
 		completed <- true
 	}
@@ -215,9 +221,67 @@ func (rm TestRulesManager) SetFlag(_ context.Context, _ string) error {
 	return nil
 }
 
+func (rm TestRulesManager) GetStatus() RulesDatabaseStatus {
+	return RulesDatabaseStatus{}
+}
+
+func (rm TestRulesManager) GetBudget() RulesBudget {
+	return RulesBudget{}
+}
+
+func (rm TestRulesManager) EstimateRule(_ Rule) (RulesBudget, error) {
+	return RulesBudget{}, nil
+}
+
 func (rm TestRulesManager) FillWithMatchedRules(_ *Connection, _ map[uint][]PatternSlice, _ map[uint][]PatternSlice) {
 }
 
+func (rm TestRulesManager) BulkRules(_ context.Context, _ []RuleOperation) ([]RuleOperationResult, error) {
+	return nil, nil
+}
+
+func (rm TestRulesManager) RedactedPatterns(_ []RowID) map[uint]uint8 {
+	return nil
+}
+
+func (rm TestRulesManager) RulePatterns(_ RowID) map[uint]uint8 {
+	return nil
+}
+
+func (rm TestRulesManager) SuppressMatchedRules(_ *Connection, _ []RowID) {
+}
+
+func (rm TestRulesManager) PatternsServices() map[uint]map[uint16]bool {
+	return nil
+}
+
 func (rm TestRulesManager) DatabaseUpdateChannel() chan RulesDatabase {
 	return rm.databaseUpdated
 }
+
+func (rm TestRulesManager) Stop() {
+}
+
+func (rm TestRulesManager) AddRuleGroup(_ context.Context, _ RuleGroup) (RowID, error) {
+	return RowID{}, nil
+}
+
+func (rm TestRulesManager) GetRuleGroup(_ RowID) (RuleGroup, bool) {
+	return RuleGroup{}, false
+}
+
+func (rm TestRulesManager) GetRuleGroups() []RuleGroup {
+	return nil
+}
+
+func (rm TestRulesManager) UpdateRuleGroup(_ context.Context, _ RowID, _ RuleGroup) (bool, error) {
+	return false, nil
+}
+
+func (rm TestRulesManager) DeleteRuleGroup(_ context.Context, _ RowID) (bool, error) {
+	return false, nil
+}
+
+func (rm TestRulesManager) SetRuleGroupEnabled(_ context.Context, _ RowID, _ bool) ([]RowID, bool) {
+	return nil, false
+}
@@ -49,14 +49,16 @@ type ConnectionStream struct {
 type PatternSlice [2]uint64
 
 type Message struct {
-	FromClient             bool             `json:"from_client"`
-	Content                string           `json:"content"`
-	Metadata               parsers.Metadata `json:"metadata"`
-	IsMetadataContinuation bool             `json:"is_metadata_continuation"`
-	Index                  int              `json:"index"`
-	Timestamp              time.Time        `json:"timestamp"`
-	IsRetransmitted        bool             `json:"is_retransmitted"`
-	RegexMatches           []RegexSlice     `json:"regex_matches"`
+	FromClient             bool                `json:"from_client"`
+	Content                string              `json:"content"`
+	Metadata               parsers.Metadata    `json:"metadata"`
+	IsMetadataContinuation bool                `json:"is_metadata_continuation"`
+	Index                  int                 `json:"index"`
+	Timestamp              time.Time           `json:"timestamp"`
+	IsRetransmitted        bool                `json:"is_retransmitted"`
+	RegexMatches           []RegexSlice        `json:"regex_matches"`
+	Handler                *HandlerAnnotation  `json:"handler,omitempty"`
+	Annotations            []MessageAnnotation `json:"annotations,omitempty"`
 }
 
 type RegexSlice struct {
@@ -73,13 +75,24 @@ type DownloadMessageFormat struct {
 	Type   string `form:"type"`
 }
 
+// httpExchangeDocument is an http exchange stored in the database. The exchanges of a connection are parsed when
+// they are requested for the first time, then they are read from the database.
+type httpExchangeDocument struct {
+	ID                   string `bson:"_id"`
+	ConnectionID         RowID  `bson:"connection_id"`
+	parsers.HTTPExchange `bson:",inline"`
+}
+
 type ConnectionStreamsController struct {
-	storage Storage
+	storage            Storage
+	servicesController *ServicesController
 }
 
-func NewConnectionStreamsController(storage Storage) ConnectionStreamsController {
+func NewConnectionStreamsController(storage Storage,
+	servicesController *ServicesController) ConnectionStreamsController {
 	return ConnectionStreamsController{
-		storage: storage,
+		storage:            storage,
+		servicesController: servicesController,
 	}
 }
 
@@ -90,8 +103,23 @@ func (csc ConnectionStreamsController) GetConnectionMessages(c context.Context,
 		return nil, false
 	}
 
+	var service Service
+	if csc.servicesController != nil {
+		service = csc.servicesController.GetServices()[connection.DestinationPort]
+	}
+
 	messages := make([]*Message, 0, initialMessagesSize)
 	var clientIndex, serverIndex uint64
+	// the offsets from the start of the streams, where the annotations are placed
+	var clientOffset, serverOffset uint64
+	var clientAnnotations, serverAnnotations []StreamAnnotation
+	for _, annotation := range csc.GetAnnotations(c, connectionID) {
+		if annotation.FromClient {
+			clientAnnotations = append(clientAnnotations, annotation)
+		} else {
+			serverAnnotations = append(serverAnnotations, annotation)
+		}
+	}
 
 	var clientBlocksIndex, serverBlocksIndex int
 	var clientDocumentIndex, serverDocumentIndex int
@@ -130,8 +158,10 @@ func (csc ConnectionStreamsController) GetConnectionMessages(c context.Context,
 				Timestamp:       clientStream.BlocksTimestamps[clientBlocksIndex],
 				IsRetransmitted: clientStream.BlocksLoss[clientBlocksIndex],
 				RegexMatches:    findMatchesBetween(clientStream.PatternMatches, clientIndex, clientIndex+size),
+				Annotations:     findAnnotationsBetween(clientAnnotations, clientOffset, clientOffset+size),
 			}
 			clientIndex += size
+			clientOffset += size
 			clientBlocksIndex++
 
 			lastContentSlice = clientStream.Payload[start:end]
@@ -153,8 +183,10 @@ func (csc ConnectionStreamsController) GetConnectionMessages(c context.Context,
 				Timestamp:       serverStream.BlocksTimestamps[serverBlocksIndex],
 				IsRetransmitted: serverStream.BlocksLoss[serverBlocksIndex],
 				RegexMatches:    findMatchesBetween(serverStream.PatternMatches, serverIndex, serverIndex+size),
+				Annotations:     findAnnotationsBetween(serverAnnotations, serverOffset, serverOffset+size),
 			}
 			serverIndex += size
+			serverOffset += size
 			serverBlocksIndex++
 
 			lastContentSlice = serverStream.Payload[start:end]
@@ -176,10 +208,17 @@ func (csc ConnectionStreamsController) GetConnectionMessages(c context.Context,
 
 		updateMetadata := func() {
 			metadata := parsers.Parse(contentChunkBuffer.Bytes())
+			var handler *HandlerAnnotation
+			if request, isRequest := metadata.(parsers.HTTPRequestMetadata); isRequest && len(service.Handlers) > 0 {
+				if annotation, isPresent := service.FindHandler(request.Method, request.URL); isPresent {
+					handler = &annotation
+				}
+			}
 			var isMetadataContinuation bool
 			for _, elem := range messagesBuffer {
 				elem.Metadata = metadata
 				elem.IsMetadataContinuation = metadata != nil && isMetadataContinuation
+				elem.Handler = handler
 				isMetadataContinuation = true
 			}
 
@@ -301,6 +340,80 @@ func (csc ConnectionStreamsController) DownloadConnectionMessages(c context.Cont
 	return sb.String(), true
 }
 
+// GetHTTPExchanges returns the http requests and responses of a connection, with the bodies decompressed and
+// without the transfer encoding. The exchanges saved with SaveHTTPExchanges are returned if present, otherwise the
+// streams are parsed without saving the result. Returns false if the connection does not exist.
+func (csc ConnectionStreamsController) GetHTTPExchanges(c context.Context,
+	connectionID RowID) ([]parsers.HTTPExchange, bool) {
+	connection := csc.getConnection(c, connectionID)
+	if connection.ID.IsZero() {
+		return nil, false
+	}
+
+	var documents []httpExchangeDocument
+	if err := csc.storage.Find(HTTPExchanges).Context(c).Filter(OrderedDocument{{"connection_id", connectionID}}).
+		Sort("index", true).All(&documents); err != nil {
+		log.WithError(err).WithField("connection_id", connectionID).Panic("failed to get http exchanges")
+	}
+	if len(documents) > 0 {
+		exchanges := make([]parsers.HTTPExchange, len(documents))
+		for i, document := range documents {
+			exchanges[i] = document.HTTPExchange
+		}
+		return exchanges, true
+	}
+
+	return csc.parseHTTPExchanges(c, connectionID), true
+}
+
+// SaveHTTPExchanges parses the http requests and responses of a connection and saves them, so that they are not
+// parsed again by GetHTTPExchanges. Returns false if the connection does not exist.
+func (csc ConnectionStreamsController) SaveHTTPExchanges(c context.Context,
+	connectionID RowID) ([]parsers.HTTPExchange, bool) {
+	connection := csc.getConnection(c, connectionID)
+	if connection.ID.IsZero() {
+		return nil, false
+	}
+
+	exchanges := csc.parseHTTPExchanges(c, connectionID)
+	for _, exchange := range exchanges {
+		document := httpExchangeDocument{
+			ID:           fmt.Sprintf("%s-%d", connectionID.Hex(), exchange.Index),
+			ConnectionID: connectionID,
+			HTTPExchange: exchange,
+		}
+		var upsertResults interface{}
+		if _, err := csc.storage.Update(HTTPExchanges).Context(c).Upsert(&upsertResults).
+			Filter(OrderedDocument{{"_id", document.ID}}).One(document); err != nil {
+			log.WithError(err).WithField("connection_id", connectionID).Panic("failed to save an http exchange")
+		}
+	}
+
+	return exchanges, true
+}
+
+func (csc ConnectionStreamsController) parseHTTPExchanges(c context.Context,
+	connectionID RowID) []parsers.HTTPExchange {
+	exchanges := parsers.ParseHTTPExchanges(csc.getStreamPayload(c, connectionID, true),
+		csc.getStreamPayload(c, connectionID, false))
+	if exchanges == nil {
+		exchanges = []parsers.HTTPExchange{}
+	}
+	return exchanges
+}
+
+// getStreamPayload returns the payload of one side of a connection, concatenating all the stream documents.
+func (csc ConnectionStreamsController) getStreamPayload(c context.Context, connectionID RowID, fromClient bool) []byte {
+	var payload []byte
+	for documentIndex := 0; ; documentIndex++ {
+		stream := csc.getConnectionStream(c, connectionID, fromClient, documentIndex)
+		if stream.ID.IsZero() {
+			return payload
+		}
+		payload = append(payload, stream.Payload...)
+	}
+}
+
 func (csc ConnectionStreamsController) getConnection(c context.Context, connectionID RowID) Connection {
 	var connection Connection
 	if err := csc.storage.Find(Connections).Context(c).Filter(OrderedDocument{{"_id", connectionID}}).
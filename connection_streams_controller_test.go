@@ -0,0 +1,258 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eciavatta/caronte/parsers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHTTPExchanges(t *testing.T) {
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	_, err := gzipWriter.Write([]byte("welcome back, admin"))
+	require.NoError(t, err)
+	require.NoError(t, gzipWriter.Close())
+
+	body := gzipped.String()
+	clientPayload := "POST /login HTTP/1.1\r\nHost: web\r\nContent-Length: 9\r\n\r\nuser=root" +
+		"GET /dashboard HTTP/1.1\r\nHost: web\r\n\r\n" +
+		"GET /logo.png HTTP/1.1\r\nHost: web\r\n\r\n" +
+		"GET /archive HTTP/1.1\r\nHost: web\r\n\r\n"
+	serverPayload := "HTTP/1.1 302 Found\r\nLocation: /dashboard\r\nContent-Length: 0\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nContent-Encoding: gzip\r\n\r\n" +
+		fmt.Sprintf("a\r\n%s\r\n%x\r\n%s\r\n0\r\n\r\n", body[:10], len(body)-10, body[10:]) +
+		"HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\n\x89PNG" +
+		"HTTP/1.1 200 OK\r\nContent-Encoding: br\r\nContent-Length: 26\r\n\r\n" +
+		"\x1b\x15\x00\xf8\xc5\x79\x78\xbd\xdd\x77\xea\x88\x88\x59\x69\x02\x4f\x15\xd1\xd1\x79\xfb\x06\x41\x67\x01"
+
+	exchanges := parsers.ParseHTTPExchanges([]byte(clientPayload), []byte(serverPayload))
+	require.Len(t, exchanges, 4)
+
+	assert.Equal(t, "POST", exchanges[0].Request.Method)
+	assert.Equal(t, "/login", exchanges[0].Request.URL)
+	assert.Equal(t, "user=root", exchanges[0].Request.Body)
+	assert.Equal(t, 302, exchanges[0].Response.StatusCode)
+	assert.Equal(t, "/dashboard", exchanges[0].Response.Headers["Location"])
+
+	assert.Equal(t, "/dashboard", exchanges[1].Request.URL)
+	assert.Equal(t, "welcome back, admin", exchanges[1].Response.Body)
+	assert.Equal(t, parsers.BodyEncodingText, exchanges[1].Response.BodyEncoding)
+	assert.Equal(t, "gzip", exchanges[1].Response.ContentEncoding)
+	assert.Empty(t, exchanges[1].Response.DecodingError)
+
+	assert.Equal(t, parsers.BodyEncodingBase64, exchanges[2].Response.BodyEncoding)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("\x89PNG")), exchanges[2].Response.Body)
+
+	assert.Equal(t, "br", exchanges[3].Response.ContentEncoding)
+	assert.Equal(t, "brotli compressed page", exchanges[3].Response.Body)
+	assert.Empty(t, exchanges[3].Response.DecodingError)
+	exchanges = parsers.ParseHTTPExchanges([]byte("GET / HTTP/1.1\r\nHost: web\r\n\r\n"),
+		[]byte("HTTP/1.1 200 OK\r\nContent-Encoding: br\r\nContent-Length: 4\r\n\r\ngzip"))
+	require.Len(t, exchanges, 1)
+	assert.NotEmpty(t, exchanges[0].Response.DecodingError)
+	assert.Equal(t, "gzip", exchanges[0].Response.Body)
+
+	assert.Empty(t, parsers.ParseHTTPExchanges([]byte("SSH-2.0-OpenSSH_8.2\r\n"), nil))
+	exchanges = parsers.ParseHTTPExchanges([]byte("GET / HTTP/1.1\r\nHost: web\r\n\r\n"), nil)
+	require.Len(t, exchanges, 1)
+	assert.Nil(t, exchanges[0].Response)
+}
+
+func TestGetHTTPExchanges(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+	wrapper.AddCollection(HTTPExchanges)
+
+	controller := NewConnectionStreamsController(wrapper.Storage, nil)
+	connectionID := NewRowID()
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(Connection{ID: connectionID})
+	require.NoError(t, err)
+	_, err = wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).Many([]interface{}{
+		ConnectionStream{ID: NewRowID(), ConnectionID: connectionID, FromClient: true, DocumentIndex: 0,
+			Payload: []byte("GET /flag HTTP/1.1\r\nHost: web\r\n\r\nGET /fl")},
+		ConnectionStream{ID: NewRowID(), ConnectionID: connectionID, FromClient: true, DocumentIndex: 1,
+			Payload: []byte("ag HTTP/1.1\r\nHost: web\r\n\r\n")},
+		ConnectionStream{ID: NewRowID(), ConnectionID: connectionID, FromClient: false, DocumentIndex: 0,
+			Payload: []byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nflag")},
+	})
+	require.NoError(t, err)
+
+	_, found := controller.GetHTTPExchanges(wrapper.Context, NewRowID())
+	assert.False(t, found)
+
+	_, found = controller.SaveHTTPExchanges(wrapper.Context, NewRowID())
+	assert.False(t, found)
+
+	var documents []httpExchangeDocument
+	for i := 0; i < 3; i++ { // the first time the exchanges are parsed without saving them, then they are saved
+		var exchanges []parsers.HTTPExchange
+		if i == 1 {
+			exchanges, found = controller.SaveHTTPExchanges(wrapper.Context, connectionID)
+		} else {
+			exchanges, found = controller.GetHTTPExchanges(wrapper.Context, connectionID)
+		}
+		require.True(t, found)
+		require.Len(t, exchanges, 2)
+		assert.Equal(t, 403, exchanges[0].Response.StatusCode)
+		assert.Equal(t, "/flag", exchanges[1].Request.URL)
+		assert.Equal(t, "flag", exchanges[1].Response.Body)
+
+		require.NoError(t, wrapper.Storage.Find(HTTPExchanges).Context(wrapper.Context).All(&documents))
+		if i == 0 {
+			assert.Empty(t, documents)
+		} else {
+			assert.Len(t, documents, 2)
+		}
+	}
+
+	wrapper.Destroy(t)
+}
+
+func TestStreamAnnotations(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+	wrapper.AddCollection(StreamAnnotations)
+
+	controller := NewConnectionStreamsController(wrapper.Storage, nil)
+	connectionID := NewRowID()
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(Connection{ID: connectionID,
+		ClientBytes: 19, ServerBytes: 2})
+	require.NoError(t, err)
+	timestamp := time.Date(2020, 11, 28, 12, 0, 0, 0, time.UTC)
+	_, err = wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).Many([]interface{}{
+		ConnectionStream{ID: NewRowID(), ConnectionID: connectionID, FromClient: true, DocumentIndex: 0,
+			Payload: []byte("hello world"), BlocksIndexes: []int{0, 6},
+			BlocksTimestamps: []time.Time{timestamp, timestamp.Add(time.Second)}, BlocksLoss: []bool{false, false}},
+		ConnectionStream{ID: NewRowID(), ConnectionID: connectionID, FromClient: true, DocumentIndex: 1,
+			Payload: []byte("AAAABBBB"), BlocksIndexes: []int{0},
+			BlocksTimestamps: []time.Time{timestamp.Add(3 * time.Second)}, BlocksLoss: []bool{false}},
+		ConnectionStream{ID: NewRowID(), ConnectionID: connectionID, FromClient: false, DocumentIndex: 0,
+			Payload: []byte("ok"), BlocksIndexes: []int{0},
+			BlocksTimestamps: []time.Time{timestamp.Add(2 * time.Second)}, BlocksLoss: []bool{false}},
+	})
+	require.NoError(t, err)
+
+	_, found, _ := controller.AddAnnotation(wrapper.Context, NewRowID(), StreamAnnotation{Length: 1, Text: "a"})
+	assert.False(t, found)
+	_, found, err = controller.AddAnnotation(wrapper.Context, connectionID, StreamAnnotation{Offset: 1, Length: 2,
+		Text: "out of range"})
+	assert.True(t, found)
+	assert.Error(t, err)
+
+	overflow, found, err := controller.AddAnnotation(wrapper.Context, connectionID, StreamAnnotation{FromClient: true,
+		Offset: 8, Length: 6, Text: "this is the overflow", Color: "#ff0000", Author: "admin"})
+	require.True(t, found)
+	require.NoError(t, err)
+	assert.False(t, overflow.ID.IsZero())
+	assert.Equal(t, connectionID, overflow.ConnectionID)
+	canary, _, err := controller.AddAnnotation(wrapper.Context, connectionID, StreamAnnotation{Offset: 0, Length: 2,
+		Text: "leaked canary"})
+	require.NoError(t, err)
+
+	annotations := controller.GetAnnotations(wrapper.Context, connectionID)
+	require.Len(t, annotations, 2)
+	assert.Equal(t, overflow.ID, annotations[0].ID)
+	assert.Equal(t, "admin", annotations[0].Author)
+	assert.Empty(t, controller.GetAnnotations(wrapper.Context, NewRowID()))
+
+	messages, found := controller.GetConnectionMessages(wrapper.Context, connectionID, GetMessageFormat{})
+	require.True(t, found)
+	require.Len(t, messages, 4)
+	assert.Empty(t, messages[0].Annotations)
+	assert.Equal(t, []MessageAnnotation{{overflow.ID, 2, 5, "this is the overflow", "#ff0000"}},
+		messages[1].Annotations)
+	assert.Equal(t, []MessageAnnotation{{canary.ID, 0, 2, "leaked canary", ""}}, messages[2].Annotations)
+	assert.Equal(t, []MessageAnnotation{{overflow.ID, 0, 3, "this is the overflow", "#ff0000"}},
+		messages[3].Annotations)
+
+	updated, found, err := controller.UpdateAnnotation(wrapper.Context, connectionID, canary.ID,
+		StreamAnnotation{Offset: 1, Length: 1, Text: "canary byte"})
+	require.True(t, found)
+	require.NoError(t, err)
+	assert.Equal(t, "canary byte", updated.Text)
+	_, found, _ = controller.UpdateAnnotation(wrapper.Context, NewRowID(), canary.ID, updated)
+	assert.False(t, found)
+	_, _, err = controller.UpdateAnnotation(wrapper.Context, connectionID, canary.ID,
+		StreamAnnotation{Offset: 1, Length: 5, Text: "too long"})
+	assert.Error(t, err)
+
+	assert.True(t, controller.DeleteAnnotation(wrapper.Context, connectionID, canary.ID))
+	assert.False(t, controller.DeleteAnnotation(wrapper.Context, connectionID, canary.ID))
+	annotations = controller.GetAnnotations(wrapper.Context, connectionID)
+	require.Len(t, annotations, 1)
+	assert.Equal(t, overflow.ID, annotations[0].ID)
+
+	wrapper.Destroy(t)
+}
+
+func TestDiffMessages(t *testing.T) {
+	message := func(fromClient bool, content string) *Message {
+		return &Message{FromClient: fromClient, Content: content}
+	}
+
+	golden := []*Message{
+		message(true, "POST /register HTTP/1.1\r\n"), message(true, "\r\nuser=checker1&password=x"),
+		message(false, "HTTP/1.1 200 OK\r\n\r\nwelcome"),
+		message(true, "GET /notes/12?token=abc HTTP/1.1\r\n\r\n"),
+		message(false, "HTTP/1.1 200 OK\r\n\r\nFLAG{a}"),
+	}
+	other := []*Message{
+		message(true, "POST /register HTTP/1.1\r\n\r\nuser=checker2&password=x"),
+		message(false, "HTTP/1.1 200 OK\r\n\r\nwelcome"),
+		message(true, "GET /admin HTTP/1.1\r\n\r\n"),
+		message(false, "HTTP/1.1 200 OK\r\n\r\nFLAG{a}"),
+	}
+
+	diff := DiffMessages(golden, other)
+	statuses := make([]string, len(diff.Messages))
+	for i, messageDiff := range diff.Messages {
+		statuses[i] = messageDiff.Status
+	}
+	assert.Equal(t, []string{DiffStatusChanged, DiffStatusEqual, DiffStatusMissing, DiffStatusAdded,
+		DiffStatusEqual}, statuses)
+	assert.Equal(t, 2, diff.Deviations)
+	assert.Equal(t, 2, diff.FirstDeviation)
+	assert.Equal(t, "GET /notes/12?token=abc HTTP/1.1\r\n\r\n", diff.Messages[2].GoldenContent)
+	assert.Equal(t, "GET /admin HTTP/1.1\r\n\r\n", diff.Messages[3].Content)
+	assert.Equal(t, []LineDiff{
+		{"=", "POST /register HTTP/1.1\r"},
+		{"=", "\r"},
+		{"-", "user=checker1&password=x"},
+		{"+", "user=checker2&password=x"},
+	}, diff.Messages[0].Lines)
+
+	diff = DiffMessages(golden, golden)
+	assert.Zero(t, diff.Deviations)
+	assert.Equal(t, -1, diff.FirstDeviation)
+	assert.Len(t, diff.Messages, 4)
+
+	assert.Equal(t, "c:GET /notes/0 HTTP/0.0", messageSignature(true, "GET /notes/42?id=1 HTTP/1.1\r\nHost: x"))
+	assert.Equal(t, "s:binary:\x00\x01\x02\x03", messageSignature(false, "\x00\x01\x02\x03\x04\x05"))
+}
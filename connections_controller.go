@@ -19,32 +19,67 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"strings"
 	"time"
 )
 
 const DefaultQueryLimit = 50
 const MaxQueryLimit = 200
 
+// connectionsSortFields are the fields which can be used to sort the connections, other than the id
+var connectionsSortFields = map[string]bool{
+	"started_at":   true,
+	"closed_at":    true,
+	"client_bytes": true,
+	"server_bytes": true,
+	"port_src":     true,
+	"port_dst":     true,
+}
+
 type Connection struct {
-	ID              RowID     `json:"id" bson:"_id"`
-	SourceIP        string    `json:"ip_src" bson:"ip_src"`
-	DestinationIP   string    `json:"ip_dst" bson:"ip_dst"`
-	SourcePort      uint16    `json:"port_src" bson:"port_src"`
-	DestinationPort uint16    `json:"port_dst" bson:"port_dst"`
-	StartedAt       time.Time `json:"started_at" bson:"started_at"`
-	ClosedAt        time.Time `json:"closed_at" bson:"closed_at"`
-	ClientBytes     int       `json:"client_bytes" bson:"client_bytes"`
-	ServerBytes     int       `json:"server_bytes" bson:"server_bytes"`
-	ClientDocuments int       `json:"client_documents" bson:"client_documents"`
-	ServerDocuments int       `json:"server_documents" bson:"server_documents"`
-	ProcessedAt     time.Time `json:"processed_at" bson:"processed_at"`
-	MatchedRules    []RowID   `json:"matched_rules" bson:"matched_rules"`
-	Hidden          bool      `json:"hidden" bson:"hidden,omitempty"`
-	Marked          bool      `json:"marked" bson:"marked,omitempty"`
-	Comment         string    `json:"comment" bson:"comment,omitempty"`
-	Service         Service   `json:"service" bson:"-"`
+	ID              RowID               `json:"id" bson:"_id"`
+	SourceIP        string              `json:"ip_src" bson:"ip_src"`
+	SourceIPBytes   []byte              `json:"-" bson:"ip_src_bytes,omitempty"`
+	DestinationIP   string              `json:"ip_dst" bson:"ip_dst"`
+	SourcePort      uint16              `json:"port_src" bson:"port_src"`
+	DestinationPort uint16              `json:"port_dst" bson:"port_dst"`
+	StartedAt       time.Time           `json:"started_at" bson:"started_at"`
+	ClosedAt        time.Time           `json:"closed_at" bson:"closed_at"`
+	StartedAtNanos  int64               `json:"started_at_ns,omitempty" bson:"started_at_ns,omitempty"`
+	ClosedAtNanos   int64               `json:"closed_at_ns,omitempty" bson:"closed_at_ns,omitempty"`
+	ClientBytes     int                 `json:"client_bytes" bson:"client_bytes"`
+	ServerBytes     int                 `json:"server_bytes" bson:"server_bytes"`
+	ClientDocuments int                 `json:"client_documents" bson:"client_documents"`
+	ServerDocuments int                 `json:"server_documents" bson:"server_documents"`
+	ProcessedAt     time.Time           `json:"processed_at" bson:"processed_at"`
+	MatchedRules    []RowID             `json:"matched_rules" bson:"matched_rules"`
+	MatchedLayers   map[string][]string `json:"matched_layers,omitempty" bson:"matched_layers,omitempty"`
+	FlagsIn         int                 `json:"flags_in" bson:"flags_in,omitempty"`
+	FlagsOut        int                 `json:"flags_out" bson:"flags_out,omitempty"`
+	Hidden          bool                `json:"hidden" bson:"hidden,omitempty"`
+	Marked          bool                `json:"marked" bson:"marked,omitempty"`
+	Comment         string              `json:"comment" bson:"comment,omitempty"`
+	Tags            []string            `json:"tags" bson:"tags,omitempty"`
+	Starred         bool                `json:"starred" bson:"starred,omitempty"`
+	References      []string            `json:"references" bson:"references,omitempty"`
+	ReplayOf        *RowID              `json:"replay_of,omitempty" bson:"replay_of,omitempty"`
+	ClientLocation  *IPLocation         `json:"client_location,omitempty" bson:"client_location,omitempty"`
+	ServerLocation  *IPLocation         `json:"server_location,omitempty" bson:"server_location,omitempty"`
+	ClientMinHash   []byte              `json:"-" bson:"client_minhash,omitempty"`
+	ServerMinHash   []byte              `json:"-" bson:"server_minhash,omitempty"`
+	MinHashBands    []int64             `json:"-" bson:"minhash_bands,omitempty"`
+	Classifications Classifications     `json:"classifications,omitempty" bson:"classifications,omitempty"`
+	ClientPreview   *StreamPreview      `json:"client_preview,omitempty" bson:"client_preview,omitempty"`
+	ServerPreview   *StreamPreview      `json:"server_preview,omitempty" bson:"server_preview,omitempty"`
+	Truncated       bool                `json:"truncated" bson:"truncated,omitempty"`
+	CaptureExtended bool                `json:"capture_extended" bson:"capture_extended,omitempty"`
+	Sensor          string              `json:"sensor,omitempty" bson:"sensor,omitempty"`
+	TLSFingerprint  string              `json:"tls_fingerprint,omitempty" bson:"tls_fingerprint,omitempty"`
+	Protocol        string              `json:"protocol,omitempty" bson:"protocol,omitempty"`
+	Service         Service             `json:"service" bson:"-"`
 }
 
 type ConnectionsFilter struct {
@@ -52,102 +87,152 @@ type ConnectionsFilter struct {
 	To              string   `form:"to" binding:"omitempty,hexadecimal,len=24"`
 	ServicePort     uint16   `form:"service_port"`
 	ClientAddress   string   `form:"client_address" binding:"omitempty,ip"`
+	ClientSubnet    string   `form:"client_subnet" binding:"omitempty,cidr"`
 	ClientPort      uint16   `form:"client_port"`
+	ClientCountry   string   `form:"client_country" binding:"omitempty,len=2,alpha"`
+	ClientASN       uint     `form:"client_asn"`
 	MinDuration     uint     `form:"min_duration"`
 	MaxDuration     uint     `form:"max_duration" binding:"omitempty,gtefield=MinDuration"`
 	MinBytes        uint     `form:"min_bytes"`
 	MaxBytes        uint     `form:"max_bytes" binding:"omitempty,gtefield=MinBytes"`
+	MinClientBytes  uint     `form:"min_client_bytes"`
+	MaxClientBytes  uint     `form:"max_client_bytes" binding:"omitempty,gtefield=MinClientBytes"`
+	MinServerBytes  uint     `form:"min_server_bytes"`
+	MaxServerBytes  uint     `form:"max_server_bytes" binding:"omitempty,gtefield=MinServerBytes"`
 	StartedAfter    int64    `form:"started_after" `
 	StartedBefore   int64    `form:"started_before" binding:"omitempty,gtefield=StartedAfter"`
 	ClosedAfter     int64    `form:"closed_after" `
 	ClosedBefore    int64    `form:"closed_before" binding:"omitempty,gtefield=ClosedAfter"`
 	Hidden          bool     `form:"hidden"`
 	Marked          bool     `form:"marked"`
+	Starred         bool     `form:"starred"`
+	Commented       bool     `form:"commented"`
+	Tags            []string `form:"tags" binding:"dive,min=1,max=64"`
+	Reference       string   `form:"reference" binding:"omitempty,max=2048"`
+	Sensor          string   `form:"sensor" binding:"omitempty,max=64"`
+	TLSFingerprint  string   `form:"tls_fingerprint" binding:"omitempty,hexadecimal,len=32"`
+	Protocol        string   `form:"protocol" binding:"omitempty,oneof=tcp icmp"`
 	MatchedRules    []string `form:"matched_rules" binding:"dive,hexadecimal,len=24"`
+	MatchedRulesAny bool     `form:"matched_rules_any"`
+	RuleGroup       string   `form:"rule_group" binding:"omitempty,hexadecimal,len=24"`
 	PerformedSearch string   `form:"performed_search" binding:"omitempty,hexadecimal,len=24"`
+	AsOf            int64    `form:"as_of"`
+	SortBy          string   `form:"sort_by"`
+	SortOrder       string   `form:"sort_order" binding:"omitempty,oneof=asc desc"`
+	Cursor          string   `form:"cursor" binding:"omitempty,max=256"`
 	Limit           int64    `form:"limit"`
+	groupRules      []RowID
+}
+
+// ConnectionsPage is a page of the list of the connections. Partial is true if the query exceeded the maximum
+// execution time, NextCursor is the cursor of the next page, empty if there are no other connections.
+type ConnectionsPage struct {
+	Connections []Connection
+	Partial     bool
+	NextCursor  string
+}
+
+// ConnectionUpdate contains the properties of a connection that can be changed by the users. Only the fields not nil
+// are updated.
+type ConnectionUpdate struct {
+	Comment *string   `json:"comment" binding:"omitempty,max=4096"`
+	Tags    *[]string `json:"tags" binding:"omitempty,dive,min=1,max=64"`
+	Starred *bool     `json:"starred"`
 }
 
 type ConnectionsController struct {
 	storage            Storage
 	searchController   *SearchController
 	servicesController *ServicesController
+	queryLimits        *QueryLimits
 }
 
 func NewConnectionsController(storage Storage, searchesController *SearchController,
-	servicesController *ServicesController) ConnectionsController {
+	servicesController *ServicesController, queryLimits *QueryLimits) ConnectionsController {
 	return ConnectionsController{
 		storage:            storage,
 		searchController:   searchesController,
 		servicesController: servicesController,
+		queryLimits:        queryLimits,
 	}
 }
 
-func (cc ConnectionsController) GetConnections(c context.Context, filter ConnectionsFilter) []Connection {
+// GetConnections returns a page of the connections which satisfy the filter, sorted by filter.SortBy or by id. The
+// next page is requested with the cursor of the page. If the query exceeds the maximum execution time the connections
+// read until then are returned and the page is partial.
+func (cc ConnectionsController) GetConnections(c context.Context, filter ConnectionsFilter) (ConnectionsPage, error) {
 	var connections []Connection
-	query := cc.storage.Find(Connections).Context(c)
-
-	from, _ := RowIDFromHex(filter.From)
-	if !from.IsZero() {
-		query = query.Filter(OrderedDocument{{"_id", UnorderedDocument{"$lte": from}}})
-	}
-	to, _ := RowIDFromHex(filter.To)
-	if !to.IsZero() {
-		query = query.Filter(OrderedDocument{{"_id", UnorderedDocument{"$gte": to}}})
-	} else {
-		query = query.Sort("_id", false)
-	}
-	if filter.ServicePort > 0 {
-		query = query.Filter(OrderedDocument{{"port_dst", filter.ServicePort}})
-	}
-	if len(filter.ClientAddress) > 0 {
-		query = query.Filter(OrderedDocument{{"ip_src", filter.ClientAddress}})
+	query, err := cc.connectionsQuery(c, filter)
+	if err != nil {
+		return ConnectionsPage{}, err
 	}
-	if filter.ClientPort > 0 {
-		query = query.Filter(OrderedDocument{{"port_src", filter.ClientPort}})
+	limit := int64(DefaultQueryLimit)
+	if filter.Limit > 0 && filter.Limit <= MaxQueryLimit {
+		limit = filter.Limit
 	}
-	if filter.MinDuration > 0 {
-		query = query.Filter(OrderedDocument{{"$where", fmt.Sprintf("this.closed_at - this.started_at >= %v", filter.MinDuration)}})
+	query = query.Limit(limit)
+	if maxTime := cc.queryLimits.MaxTime(); maxTime > 0 {
+		query = query.MaxTime(maxTime)
 	}
-	if filter.MaxDuration > 0 {
-		query = query.Filter(OrderedDocument{{"$where", fmt.Sprintf("this.closed_at - this.started_at <= %v", filter.MaxDuration)}})
+
+	partial, err := query.AllPartial(&connections)
+	if err != nil {
+		log.WithError(err).WithField("filter", filter).Panic("failed to get connections")
 	}
-	if filter.MinBytes > 0 {
-		query = query.Filter(OrderedDocument{{"$where", fmt.Sprintf("this.client_bytes + this.server_bytes >= %v", filter.MinBytes)}})
+
+	if len(connections) == 0 {
+		return ConnectionsPage{Connections: []Connection{}, Partial: partial}, nil
 	}
-	if filter.MaxBytes > 0 {
-		query = query.Filter(OrderedDocument{{"$where", fmt.Sprintf("this.client_bytes + this.server_bytes <= %v", filter.MaxBytes)}})
+
+	services := cc.servicesController.GetServices()
+	for i, connection := range connections {
+		if service, isPresent := services[connection.DestinationPort]; isPresent {
+			connections[i].Service = service
+		}
 	}
-	if filter.StartedAfter > 0 {
-		query = query.Filter(OrderedDocument{{"started_at", UnorderedDocument{"$gt": time.Unix(filter.StartedAfter, 0)}}})
+
+	page := ConnectionsPage{Connections: connections, Partial: partial}
+	if isLegacyAscending(filter) {
+		page.Connections = reverseConnections(connections)
+	} else if int64(len(connections)) == limit {
+		last := connections[len(connections)-1]
+		cursor := connectionsCursor{ID: last.ID}
+		if filter.SortBy != "" {
+			cursor.Value = connectionSortValue(last, filter.SortBy)
+		}
+		page.NextCursor = encodeConnectionsCursor(cursor)
 	}
-	if filter.StartedBefore > 0 {
-		query = query.Filter(OrderedDocument{{"started_at", UnorderedDocument{"$lt": time.Unix(filter.StartedBefore, 0)}}})
+
+	return page, nil
+}
+
+// connectionsQuery returns the query of the connections which satisfy the filter, sorted and without limits.
+func (cc ConnectionsController) connectionsQuery(c context.Context, filter ConnectionsFilter) (FindOperation, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
 	}
-	if filter.ClosedAfter > 0 {
-		query = query.Filter(OrderedDocument{{"closed_at", UnorderedDocument{"$gt": time.Unix(filter.ClosedAfter, 0)}}})
+	connectionsQuery := filter.Query()
+	if !filter.Hidden { // hidden connections are shown only on request
+		connectionsQuery = connectionsQuery.Where("hidden", UnorderedDocument{"$ne": true})
 	}
-	if filter.ClosedBefore > 0 {
-		query = query.Filter(OrderedDocument{{"closed_at", UnorderedDocument{"$lt": time.Unix(filter.ClosedBefore, 0)}}})
+
+	sortField, ascending := "_id", filter.SortOrder == "asc"
+	if filter.SortBy != "" {
+		sortField = filter.SortBy
 	}
-	if filter.Hidden {
-		query = query.Filter(OrderedDocument{{"hidden", true}})
+	if isLegacyAscending(filter) {
+		ascending = true
 	}
-	if filter.Marked {
-		query = query.Filter(OrderedDocument{{"marked", true}})
+	if filter.Cursor != "" {
+		cursor, _ := decodeConnectionsCursor(filter.Cursor)
+		connectionsQuery = connectionsQuery.and(cursor.after(sortField, ascending))
 	}
-	if filter.MatchedRules != nil && len(filter.MatchedRules) > 0 {
-		matchedRules := make([]RowID, len(filter.MatchedRules))
-		for i, elem := range filter.MatchedRules {
-			if id, err := RowIDFromHex(elem); err != nil {
-				log.WithError(err).WithField("filter", filter).Panic("failed to convert matched_rules ids")
-			} else {
-				matchedRules[i] = id
-			}
-		}
 
-		query = query.Filter(OrderedDocument{{"matched_rules", UnorderedDocument{"$all": matchedRules}}})
+	query := connectionsQuery.Apply(cc.storage.Find(Connections).Context(c)).Sort(sortField, ascending)
+	if sortField != "_id" {
+		query = query.Sort("_id", ascending)
 	}
+
 	performedSearchID, _ := RowIDFromHex(filter.PerformedSearch)
 	if !performedSearchID.IsZero() {
 		performedSearch := cc.searchController.GetPerformedSearch(performedSearchID)
@@ -155,32 +240,28 @@ func (cc ConnectionsController) GetConnections(c context.Context, filter Connect
 			query = query.Filter(OrderedDocument{{"_id", UnorderedDocument{"$in": performedSearch.AffectedConnections}}})
 		}
 	}
-	if filter.Limit > 0 && filter.Limit <= MaxQueryLimit {
-		query = query.Limit(filter.Limit)
-	} else {
-		query = query.Limit(DefaultQueryLimit)
-	}
 
-	if err := query.All(&connections); err != nil {
-		log.WithError(err).WithField("filter", filter).Panic("failed to get connections")
-	}
+	return query, nil
+}
 
-	if connections == nil {
-		return []Connection{}
+// Validate checks the sorting and the cursor of the filter, which are not validated when the filter is bound.
+func (filter ConnectionsFilter) Validate() error {
+	if filter.SortBy != "" && !connectionsSortFields[filter.SortBy] {
+		return fmt.Errorf("connections can't be sorted by %q", filter.SortBy)
 	}
-
-	services := cc.servicesController.GetServices()
-	for i, connection := range connections {
-		if service, isPresent := services[connection.DestinationPort]; isPresent {
-			connections[i].Service = service
+	if filter.Cursor != "" {
+		if _, err := decodeConnectionsCursor(filter.Cursor); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	if !to.IsZero() {
-		connections = reverseConnections(connections)
-	}
-
-	return connections
+// isLegacyAscending reports whether the connections are requested with the to filter without a sorting: in that case
+// the connections following to are read in ascending order and then returned in descending order, without a cursor.
+func isLegacyAscending(filter ConnectionsFilter) bool {
+	to, _ := RowIDFromHex(filter.To)
+	return !to.IsZero() && filter.SortBy == "" && filter.SortOrder == ""
 }
 
 func (cc ConnectionsController) GetConnection(c context.Context, id RowID) (Connection, bool) {
@@ -204,6 +285,44 @@ func (cc ConnectionsController) SetComment(c context.Context, id RowID, comment
 	return cc.setProperty(c, id, "comment", comment)
 }
 
+// UpdateConnection changes the comment, the tags and the starred flag of a connection. The tags are trimmed and
+// duplicates are removed. Returns false if the connection does not exist.
+func (cc ConnectionsController) UpdateConnection(c context.Context, id RowID, update ConnectionUpdate) (bool, error) {
+	document := UnorderedDocument{}
+	if update.Comment != nil {
+		document["comment"] = *update.Comment
+	}
+	if update.Tags != nil {
+		tags := make([]string, 0, len(*update.Tags))
+		presentTags := make(map[string]bool)
+		for _, tag := range *update.Tags {
+			tag = strings.TrimSpace(tag)
+			if tag == "" || presentTags[tag] {
+				continue
+			}
+			presentTags[tag] = true
+			tags = append(tags, tag)
+		}
+		document["tags"] = tags
+	}
+	if update.Starred != nil {
+		document["starred"] = *update.Starred
+	}
+	if len(document) == 0 {
+		return false, errors.New("nothing to update")
+	}
+
+	updated, err := cc.storage.Update(Connections).Context(c).Filter(byID(id)).One(document)
+	if err != nil {
+		log.WithError(err).WithField("id", id).Panic("failed to update a connection")
+	}
+	if !updated { // the connection may exist but have already the same properties
+		_, isPresent := cc.GetConnection(c, id)
+		return isPresent, nil
+	}
+	return true, nil
+}
+
 func (cc ConnectionsController) setProperty(c context.Context, id RowID, propertyName string, propertyValue interface{}) bool {
 	updated, err := cc.storage.Update(Connections).Context(c).Filter(byID(id)).
 		One(UnorderedDocument{propertyName: propertyValue})
@@ -0,0 +1,338 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateConnection(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(Services)
+
+	servicesController := NewServicesController(wrapper.Storage)
+	connectionsController := NewConnectionsController(wrapper.Storage, nil, servicesController, nil)
+
+	firstID, secondID, hiddenID := NewRowID(), NewRowID(), NewRowID()
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).Many([]interface{}{
+		Connection{ID: firstID}, Connection{ID: secondID}, Connection{ID: hiddenID, Hidden: true},
+	})
+	require.NoError(t, err)
+
+	_, err = connectionsController.UpdateConnection(wrapper.Context, firstID, ConnectionUpdate{})
+	assert.Error(t, err)
+
+	comment := "exploit for the login bypass"
+	tags := []string{" sqli ", "login", "sqli", ""}
+	starred := true
+	update := ConnectionUpdate{Comment: &comment, Tags: &tags, Starred: &starred}
+	updated, err := connectionsController.UpdateConnection(wrapper.Context, firstID, update)
+	require.NoError(t, err)
+	assert.True(t, updated)
+
+	connection, isPresent := connectionsController.GetConnection(wrapper.Context, firstID)
+	require.True(t, isPresent)
+	assert.Equal(t, comment, connection.Comment)
+	assert.Equal(t, []string{"sqli", "login"}, connection.Tags)
+	assert.True(t, connection.Starred)
+
+	updated, err = connectionsController.UpdateConnection(wrapper.Context, firstID, update)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+
+	updated, err = connectionsController.UpdateConnection(wrapper.Context, NewRowID(), update)
+	assert.NoError(t, err)
+	assert.False(t, updated)
+
+	tags = []string{"login"}
+	starred = false
+	updated, err = connectionsController.UpdateConnection(wrapper.Context, secondID,
+		ConnectionUpdate{Tags: &tags, Starred: &starred})
+	require.NoError(t, err)
+	assert.True(t, updated)
+
+	checkConnections := func(filter ConnectionsFilter, expected ...RowID) {
+		page, err := connectionsController.GetConnections(wrapper.Context, filter)
+		require.NoError(t, err)
+		assert.False(t, page.Partial)
+		ids := make([]RowID, len(page.Connections))
+		for i, connection := range page.Connections {
+			ids[i] = connection.ID
+		}
+		assert.ElementsMatch(t, expected, ids)
+	}
+	checkConnections(ConnectionsFilter{}, firstID, secondID)
+	checkConnections(ConnectionsFilter{Hidden: true}, hiddenID)
+	checkConnections(ConnectionsFilter{Starred: true}, firstID)
+	checkConnections(ConnectionsFilter{Commented: true}, firstID)
+	checkConnections(ConnectionsFilter{Tags: []string{"login"}}, firstID, secondID)
+	checkConnections(ConnectionsFilter{Tags: []string{"login", "sqli"}}, firstID)
+	checkConnections(ConnectionsFilter{Tags: []string{"xss"}})
+
+	wrapper.Destroy(t)
+}
+
+func TestConnectionsAndStatisticsAsOf(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(Services)
+
+	servicesController := NewServicesController(wrapper.Storage)
+	connectionsController := NewConnectionsController(wrapper.Storage, nil, servicesController, nil)
+	statisticsController := NewStatisticsController(wrapper.Storage)
+
+	startedAt := time.Unix(1600000000, 0)
+	processedAt := time.Unix(1600000600, 0)
+	ruleID := NewRowID()
+	oldID, newID := NewRowID(), NewRowID()
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).Many([]interface{}{
+		Connection{ID: oldID, DestinationPort: 80, StartedAt: startedAt, ClosedAt: startedAt.Add(time.Second),
+			ClientBytes: 10, ServerBytes: 20, FlagsOut: 1, MatchedRules: []RowID{ruleID}, ProcessedAt: processedAt},
+		Connection{ID: newID, DestinationPort: 80, StartedAt: startedAt, ClosedAt: startedAt.Add(time.Second),
+			ClientBytes: 100, ServerBytes: 200, ProcessedAt: processedAt.Add(time.Hour)},
+	})
+	require.NoError(t, err)
+
+	page, err := connectionsController.GetConnections(wrapper.Context, ConnectionsFilter{AsOf: processedAt.Unix()})
+	require.NoError(t, err)
+	require.Len(t, page.Connections, 1)
+	assert.Equal(t, oldID, page.Connections[0].ID)
+	page, err = connectionsController.GetConnections(wrapper.Context, ConnectionsFilter{})
+	require.NoError(t, err)
+	assert.Len(t, page.Connections, 2)
+
+	totals := statisticsController.GetTotalStatistics(wrapper.Context, StatisticsFilter{AsOf: processedAt.Unix()})
+	assert.Equal(t, map[uint16]int64{80: 1}, totals.ConnectionsPerService)
+	assert.Equal(t, map[uint16]int64{80: 30}, totals.TotalBytesPerService)
+	assert.Equal(t, map[uint16]int64{80: 1000}, totals.DurationPerService)
+	assert.Equal(t, map[uint16]int64{80: 1}, totals.FlagsOutPerService)
+	assert.Equal(t, map[string]int64{ruleID.Hex(): 1}, totals.MatchedRules)
+
+	statistics := statisticsController.GetStatistics(wrapper.Context, StatisticsFilter{AsOf: processedAt.Unix(),
+		Ports: []uint16{80, 443}, Metric: "client_bytes_per_service"})
+	require.Len(t, statistics, 1)
+	assert.Equal(t, time.Unix(startedAt.Unix()/60*60, 0), statistics[0].RangeStart)
+	assert.Equal(t, map[uint16]int64{80: 10}, statistics[0].ClientBytesPerService)
+	assert.Nil(t, statistics[0].ServerBytesPerService)
+	assert.Nil(t, statistics[0].MatchedRules)
+
+	assert.Empty(t, statisticsController.GetStatistics(wrapper.Context, StatisticsFilter{
+		AsOf: processedAt.Add(-time.Second).Unix()}))
+
+	wrapper.Destroy(t)
+}
+
+func TestStatisticsPipeline(t *testing.T) {
+	query := ConnectionsFilter{AsOf: 1600000600}.Query()
+	rangeTo := time.Unix(1600000000, 0)
+	pipeline := statisticsPipeline(StatisticsFilter{RangeTo: rangeTo}, query, false)
+	require.Len(t, pipeline, 3)
+	assert.Equal(t, OrderedDocument{{"$match", query.Document()}}, pipeline[0])
+	group := pipeline[1][0].Value.(UnorderedDocument)
+	assert.Equal(t, UnorderedDocument{"range_start": rangeStartExpression(60), "port": "$port_dst"}, group["_id"])
+	assert.Equal(t, OrderedDocument{{"$match", OrderedDocument{{"_id.range_start",
+		UnorderedDocument{"$gt": rangeTo}}}}}, pipeline[2])
+
+	pipeline = statisticsPipeline(StatisticsFilter{}, query, true)
+	require.Len(t, pipeline, 4)
+	assert.Equal(t, OrderedDocument{{"$unwind", "$matched_rules"}}, pipeline[2])
+}
+
+func TestExportConnections(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+	wrapper.AddCollection(Services)
+
+	servicesController := NewServicesController(wrapper.Storage)
+	require.NoError(t, servicesController.SetService(wrapper.Context, Service{Port: 80, Name: "web", Color: "#fff"}))
+	connectionsController := NewConnectionsController(wrapper.Storage, nil, servicesController, nil)
+
+	startedAt := time.Date(2020, 11, 28, 12, 0, 0, 0, time.UTC)
+	webID, sshID := CustomRowID(1, startedAt), CustomRowID(2, startedAt)
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).Many([]interface{}{
+		Connection{ID: webID, SourceIP: "10.10.10.10", SourcePort: 50000, DestinationIP: "10.10.10.1",
+			DestinationPort: 80, StartedAt: startedAt, ClosedAt: startedAt.Add(1500 * time.Millisecond),
+			ClientBytes: 5, ServerBytes: 3, Tags: []string{"sqli", "login"}, Comment: "first, \"quoted\"",
+			ClientLocation: &IPLocation{Country: "IT", ASN: 137, Organization: "GARR"}},
+		Connection{ID: sshID, DestinationPort: 22, StartedAt: startedAt, ClosedAt: startedAt},
+	})
+	require.NoError(t, err)
+	_, err = wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).Many([]interface{}{
+		ConnectionStream{ID: NewRowID(), ConnectionID: webID, FromClient: true, PayloadString: "GET /\n"},
+		ConnectionStream{ID: NewRowID(), ConnectionID: webID, FromClient: false, PayloadString: "200"},
+		ConnectionStream{ID: NewRowID(), ConnectionID: sshID, FromClient: true, PayloadString: "SSH-2.0"},
+	})
+	require.NoError(t, err)
+
+	export := func(filter ConnectionsFilter, includePayloads bool) map[string][]byte {
+		buffer := new(bytes.Buffer)
+		require.NoError(t, connectionsController.ExportConnections(wrapper.Context, filter, includePayloads, buffer))
+		archive, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+		require.NoError(t, err)
+
+		files := make(map[string][]byte)
+		for _, file := range archive.File {
+			reader, err := file.Open()
+			require.NoError(t, err)
+			files[file.Name], err = ioutil.ReadAll(reader)
+			require.NoError(t, err)
+		}
+		return files
+	}
+
+	files := export(ConnectionsFilter{ServicePort: 80}, true)
+	require.Len(t, files, 3)
+	var schema struct {
+		Version int
+		Files   map[string][]exportColumn
+	}
+	require.NoError(t, json.Unmarshal(files["schema.json"], &schema))
+	assert.Equal(t, exportSchemaVersion, schema.Version)
+	assert.Equal(t, exportConnectionsColumns, schema.Files["connections.csv"])
+
+	rows, err := csv.NewReader(bytes.NewReader(files["connections.csv"])).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, exportColumnsNames(exportConnectionsColumns), rows[0])
+	assert.Equal(t, []string{webID.Hex(), "80", "web", "10.10.10.10", "50000", "10.10.10.1", "80",
+		"2020-11-28T12:00:00Z", "2020-11-28T12:00:01.5Z", "1500", "5", "3", "0001-01-01T00:00:00Z", "", "0", "0",
+		"false", "false", "false", "sqli;login", "first, \"quoted\"", "", "IT", "137", "GARR"}, rows[1])
+
+	rows, err = csv.NewReader(bytes.NewReader(files["payloads.csv"])).ReadAll()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, [][]string{exportColumnsNames(exportPayloadsColumns),
+		{webID.Hex(), "true", "0", "GET /\n"}, {webID.Hex(), "false", "0", "200"}}, rows)
+
+	files = export(ConnectionsFilter{}, false)
+	assert.Len(t, files, 2)
+	rows, err = csv.NewReader(bytes.NewReader(files["connections.csv"])).ReadAll()
+	require.NoError(t, err)
+	assert.Len(t, rows, 3)
+
+	files = export(ConnectionsFilter{ClientCountry: "it", ClientASN: 137}, false)
+	rows, err = csv.NewReader(bytes.NewReader(files["connections.csv"])).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, webID.Hex(), rows[1][0])
+
+	wrapper.Destroy(t)
+}
+
+func TestMinHash(t *testing.T) {
+	signature := func(chunks ...string) []byte {
+		mh := newMinHash()
+		for _, chunk := range chunks {
+			mh.Write([]byte(chunk))
+		}
+		return mh.Signature()
+	}
+
+	exploit := "POST /api/notes HTTP/1.1\r\nHost: vulnbox\r\nContent-Type: application/json\r\n\r\n" +
+		`{"title": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", "content": "{{config.items()}}"}`
+	variant := "POST /api/notes HTTP/1.1\r\nHost: vulnbox\r\nContent-Type: application/json\r\n\r\n" +
+		`{"title": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAB", "content": "{{config.items()}}"}`
+	other := "SSH-2.0-OpenSSH_8.2p1 Ubuntu-4ubuntu0.1\r\n"
+
+	assert.Nil(t, signature("abc"))
+	assert.Len(t, signature("abcd"), minHashSize*4)
+	assert.Equal(t, signature(exploit), signature(exploit[:10], exploit[10:11], exploit[11:]))
+	assert.Equal(t, 1.0, minHashSimilarity(signature(exploit), signature(exploit)))
+	assert.Greater(t, minHashSimilarity(signature(exploit), signature(variant)), 0.8)
+	assert.Less(t, minHashSimilarity(signature(exploit), signature(other)), 0.2)
+	assert.Zero(t, minHashSimilarity(signature(exploit), nil))
+
+	bands := fingerprintBands(signature(exploit), nil)
+	assert.Len(t, bands, minHashBands)
+	assert.Len(t, fingerprintBands(signature(exploit), signature(other)), 2*minHashBands)
+	assert.Subset(t, fingerprintBands(signature(exploit), signature(other)), bands)
+	assert.NotEqual(t, bands, fingerprintBands(nil, signature(exploit)))
+}
+
+func TestFindSimilarConnections(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+
+	controller := NewConnectionsController(wrapper.Storage, nil, nil, nil)
+	newConnection := func(port uint16, client, server string) RowID {
+		connection := Connection{ID: NewRowID(), DestinationPort: port}
+		if client != "" {
+			mh := newMinHash()
+			mh.Write([]byte(client))
+			connection.ClientMinHash = mh.Signature()
+		}
+		if server != "" {
+			mh := newMinHash()
+			mh.Write([]byte(server))
+			connection.ServerMinHash = mh.Signature()
+		}
+		connection.MinHashBands = fingerprintBands(connection.ClientMinHash, connection.ServerMinHash)
+		_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(connection)
+		require.NoError(t, err)
+		return connection.ID
+	}
+
+	request := "GET /notes?id=1%20UNION%20SELECT%20flag%20FROM%20notes HTTP/1.1\r\nHost: vulnbox\r\n\r\n"
+	response := "HTTP/1.1 200 OK\r\nContent-Length: 32\r\n\r\nFLAG{AAAAAAAAAAAAAAAAAAAAAAAAAA}"
+	exploitID := newConnection(80, request, response)
+	sameID := newConnection(80, request, response)
+	variantID := newConnection(80, strings.Replace(request, "id=1", "id=2", 1),
+		strings.Replace(response, "AAAAA", "BBBBB", 1))
+	otherServiceID := newConnection(8080, request, response)
+	newConnection(80, "GET / HTTP/1.1\r\nHost: vulnbox\r\n\r\n", "HTTP/1.1 404 Not Found\r\n\r\n")
+	emptyID := newConnection(80, "", "")
+
+	_, found := controller.FindSimilarConnections(wrapper.Context, NewRowID(), SimilarConnectionsOptions{})
+	assert.False(t, found)
+
+	similar, found := controller.FindSimilarConnections(wrapper.Context, exploitID, SimilarConnectionsOptions{})
+	require.True(t, found)
+	require.Len(t, similar, 2)
+	assert.Equal(t, sameID, similar[0].Connection.ID)
+	assert.Equal(t, 1.0, similar[0].Similarity)
+	assert.Equal(t, variantID, similar[1].Connection.ID)
+	assert.Less(t, similar[1].Similarity, 1.0)
+	assert.Equal(t, (similar[1].ClientSimilarity+similar[1].ServerSimilarity)/2, similar[1].Similarity)
+
+	similar, _ = controller.FindSimilarConnections(wrapper.Context, exploitID,
+		SimilarConnectionsOptions{Limit: 1, AllServices: true})
+	require.Len(t, similar, 1)
+	assert.Equal(t, 1.0, similar[0].Similarity)
+	similar, _ = controller.FindSimilarConnections(wrapper.Context, exploitID,
+		SimilarConnectionsOptions{MinSimilarity: 1, AllServices: true})
+	assert.Len(t, similar, 2)
+	assert.NotContains(t, []RowID{similar[0].Connection.ID, similar[1].Connection.ID}, variantID)
+	assert.Contains(t, []RowID{similar[0].Connection.ID, similar[1].Connection.ID}, otherServiceID)
+
+	similar, found = controller.FindSimilarConnections(wrapper.Context, emptyID, SimilarConnectionsOptions{})
+	assert.True(t, found)
+	assert.Empty(t, similar)
+
+	wrapper.Destroy(t)
+}
@@ -0,0 +1,247 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxExportedConnections is the maximum number of connections of an export
+const MaxExportedConnections = 100000
+
+// exportBatchSize is the number of connections whose payloads are read from the database at once
+const exportBatchSize = 100
+
+// exportSchemaVersion must be incremented when the columns of the exported files change
+const exportSchemaVersion = 2
+
+type exportColumn struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+// The columns of the exported files. The columns are only appended, so that the notebooks which read the exports
+// keep working. The lists are joined with ; and the timestamps are in RFC 3339 format, with nanoseconds.
+var exportConnectionsColumns = []exportColumn{
+	{"id", "string", "id of the connection"},
+	{"service_port", "int", "port of the service"},
+	{"service_name", "string", "name of the service, empty if the port is not registered as service"},
+	{"ip_src", "string", "address of the client"},
+	{"port_src", "int", "port of the client"},
+	{"ip_dst", "string", "address of the server"},
+	{"port_dst", "int", "port of the server"},
+	{"started_at", "timestamp", "time of the first packet"},
+	{"closed_at", "timestamp", "time of the last packet"},
+	{"duration_ms", "int", "duration of the connection in milliseconds"},
+	{"client_bytes", "int", "bytes sent by the client"},
+	{"server_bytes", "int", "bytes sent by the server"},
+	{"processed_at", "timestamp", "time when the connection was imported"},
+	{"matched_rules", "list", "ids of the rules matched by the connection"},
+	{"flags_in", "int", "flags sent to the server"},
+	{"flags_out", "int", "flags sent to the client"},
+	{"hidden", "bool", "true if the connection is hidden"},
+	{"marked", "bool", "true if the connection is marked"},
+	{"starred", "bool", "true if the connection is starred"},
+	{"tags", "list", "tags of the connection"},
+	{"comment", "string", "comment of the connection"},
+	{"references", "list", "urls, hostnames and addresses referenced in the payloads"},
+	{"client_country", "string", "iso code of the country of the client, empty if unknown"},
+	{"client_asn", "int", "autonomous system number of the client, zero if unknown"},
+	{"client_organization", "string", "organization of the autonomous system of the client"},
+}
+
+var exportPayloadsColumns = []exportColumn{
+	{"connection_id", "string", "id of the connection"},
+	{"from_client", "bool", "true if the payload is sent by the client"},
+	{"document_index", "int", "index of the chunk of the stream, the streams longer than 1 MiB are split in chunks"},
+	{"payload", "string", "payload of the chunk as text, with the invalid UTF-8 sequences removed"},
+}
+
+// ExportConnections writes to writer a zip archive with the connections which satisfy the filter, ready to be loaded
+// in a dataframe (e.g. pandas.read_csv). The archive contains connections.csv, payloads.csv if includePayloads is
+// true, and schema.json which describes the columns of the files.
+func (cc ConnectionsController) ExportConnections(c context.Context, filter ConnectionsFilter, includePayloads bool,
+	writer io.Writer) error {
+	query, err := cc.connectionsQuery(c, filter)
+	if err != nil {
+		return err
+	}
+	if filter.Limit > 0 && filter.Limit <= MaxExportedConnections {
+		query = query.Limit(filter.Limit)
+	} else {
+		query = query.Limit(MaxExportedConnections)
+	}
+
+	var connections []Connection
+	if err := query.All(&connections); err != nil {
+		log.WithError(err).WithField("filter", filter).Panic("failed to get connections")
+	}
+
+	archive := zip.NewWriter(writer)
+	if err := writeExportSchema(archive, includePayloads); err != nil {
+		return err
+	}
+	if err := cc.writeExportConnections(archive, connections); err != nil {
+		return err
+	}
+	if includePayloads {
+		if err := cc.writeExportPayloads(c, archive, connections); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+func writeExportSchema(archive *zip.Writer, includePayloads bool) error {
+	files := map[string][]exportColumn{"connections.csv": exportConnectionsColumns}
+	if includePayloads {
+		files["payloads.csv"] = exportPayloadsColumns
+	}
+
+	file, err := archive.Create("schema.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(UnorderedDocument{"version": exportSchemaVersion, "files": files})
+}
+
+func (cc ConnectionsController) writeExportConnections(archive *zip.Writer, connections []Connection) error {
+	file, err := archive.Create("connections.csv")
+	if err != nil {
+		return err
+	}
+	csvWriter := csv.NewWriter(file)
+	if err := csvWriter.Write(exportColumnsNames(exportConnectionsColumns)); err != nil {
+		return err
+	}
+
+	services := cc.servicesController.GetServices()
+	for _, connection := range connections {
+		var clientLocation IPLocation
+		if connection.ClientLocation != nil {
+			clientLocation = *connection.ClientLocation
+		}
+		matchedRules := make([]string, len(connection.MatchedRules))
+		for i, id := range connection.MatchedRules {
+			matchedRules[i] = id.Hex()
+		}
+
+		if err := csvWriter.Write([]string{
+			connection.ID.Hex(),
+			strconv.Itoa(int(connection.DestinationPort)),
+			services[connection.DestinationPort].Name,
+			connection.SourceIP,
+			strconv.Itoa(int(connection.SourcePort)),
+			connection.DestinationIP,
+			strconv.Itoa(int(connection.DestinationPort)),
+			connection.StartedAt.UTC().Format(time.RFC3339Nano),
+			connection.ClosedAt.UTC().Format(time.RFC3339Nano),
+			strconv.FormatInt(connection.ClosedAt.Sub(connection.StartedAt).Milliseconds(), 10),
+			strconv.Itoa(connection.ClientBytes),
+			strconv.Itoa(connection.ServerBytes),
+			connection.ProcessedAt.UTC().Format(time.RFC3339Nano),
+			strings.Join(matchedRules, ";"),
+			strconv.Itoa(connection.FlagsIn),
+			strconv.Itoa(connection.FlagsOut),
+			strconv.FormatBool(connection.Hidden),
+			strconv.FormatBool(connection.Marked),
+			strconv.FormatBool(connection.Starred),
+			strings.Join(connection.Tags, ";"),
+			connection.Comment,
+			strings.Join(connection.References, ";"),
+			clientLocation.Country,
+			strconv.Itoa(int(clientLocation.ASN)),
+			clientLocation.Organization,
+		}); err != nil {
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+func (cc ConnectionsController) writeExportPayloads(c context.Context, archive *zip.Writer,
+	connections []Connection) error {
+	file, err := archive.Create("payloads.csv")
+	if err != nil {
+		return err
+	}
+	csvWriter := csv.NewWriter(file)
+	if err := csvWriter.Write(exportColumnsNames(exportPayloadsColumns)); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(connections); start += exportBatchSize {
+		end := start + exportBatchSize
+		if end > len(connections) {
+			end = len(connections)
+		}
+		ids := make([]RowID, 0, end-start)
+		for _, connection := range connections[start:end] {
+			ids = append(ids, connection.ID)
+		}
+
+		var streams []ConnectionStream
+		if err := cc.storage.Find(ConnectionStreams).Context(c).
+			Filter(OrderedDocument{{"connection_id", UnorderedDocument{"$in": ids}}}).
+			Projection(OrderedDocument{{"connection_id", 1}, {"from_client", 1}, {"document_index", 1},
+				{"payload_string", 1}}).
+			Sort("_id", true).All(&streams); err != nil {
+			log.WithError(err).Panic("failed to get connection streams")
+		}
+
+		for _, stream := range streams {
+			if err := csvWriter.Write([]string{
+				stream.ConnectionID.Hex(),
+				strconv.FormatBool(stream.FromClient),
+				strconv.Itoa(stream.DocumentIndex),
+				stream.PayloadString,
+			}); err != nil {
+				return err
+			}
+		}
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func exportColumnsNames(columns []exportColumn) []string {
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+	}
+	return names
+}
@@ -0,0 +1,327 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ConnectionsQuery builds the filter of the queries on the connections. The conditions are combined with $and, so
+// that more conditions can be put on the same field. It is shared by the list and the export of the connections and
+// by the statistics, so that they accept the same filters.
+type ConnectionsQuery struct {
+	conditions []OrderedDocument
+}
+
+// Where adds the condition field: value, where value can be a document of operators.
+func (cq ConnectionsQuery) Where(field string, value interface{}) ConnectionsQuery {
+	return cq.and(OrderedDocument{{field, value}})
+}
+
+func (cq ConnectionsQuery) and(condition OrderedDocument) ConnectionsQuery {
+	conditions := make([]OrderedDocument, len(cq.conditions), len(cq.conditions)+1)
+	copy(conditions, cq.conditions)
+	cq.conditions = append(conditions, condition)
+	return cq
+}
+
+// ClientSubnet selects the connections whose client address is in the subnet. The IPv4 addresses are matched with a
+// regex because they are stored as strings, the IPv6 addresses are compared in the 16 bytes form, which is not stored
+// in the connections saved before the IPv6 support.
+func (cq ConnectionsQuery) ClientSubnet(subnet *net.IPNet) ConnectionsQuery {
+	if subnet.IP.To4() == nil {
+		first, last := ipv6SubnetRange(subnet)
+		if first == nil {
+			return cq
+		}
+		return cq.Where("ip_src_bytes", UnorderedDocument{"$gte": first, "$lte": last})
+	}
+
+	pattern := ipv4SubnetPattern(subnet)
+	if pattern == "" {
+		return cq
+	}
+	return cq.Where("ip_src", UnorderedDocument{"$regex": pattern})
+}
+
+// MatchedRules selects the connections which matched all the rules, or at least one of them if any is true.
+func (cq ConnectionsQuery) MatchedRules(rulesIDs []RowID, any bool) ConnectionsQuery {
+	if len(rulesIDs) == 0 {
+		return cq
+	}
+	operator := "$all"
+	if any {
+		operator = "$in"
+	}
+	return cq.Where("matched_rules", UnorderedDocument{operator: rulesIDs})
+}
+
+func (cq ConnectionsQuery) IsEmpty() bool {
+	return len(cq.conditions) == 0
+}
+
+func (cq ConnectionsQuery) Document() OrderedDocument {
+	switch len(cq.conditions) {
+	case 0:
+		return OrderedDocument{}
+	case 1:
+		return cq.conditions[0]
+	default:
+		return OrderedDocument{{"$and", cq.conditions}}
+	}
+}
+
+// Apply adds the conditions of the query to the filter of a find operation on the connections.
+func (cq ConnectionsQuery) Apply(query FindOperation) FindOperation {
+	if cq.IsEmpty() {
+		return query
+	}
+	return query.Filter(cq.Document())
+}
+
+// Query returns the conditions on the connections selected by the filter. The performed search, the sorting and the
+// pagination are handled by the ConnectionsController, and the hidden connections are not excluded by default.
+func (filter ConnectionsFilter) Query() ConnectionsQuery {
+	var query ConnectionsQuery
+
+	if from, _ := RowIDFromHex(filter.From); !from.IsZero() {
+		query = query.Where("_id", UnorderedDocument{"$lte": from})
+	}
+	if to, _ := RowIDFromHex(filter.To); !to.IsZero() {
+		query = query.Where("_id", UnorderedDocument{"$gte": to})
+	}
+	if filter.ServicePort > 0 {
+		query = query.Where("port_dst", filter.ServicePort)
+	}
+	if ip := net.ParseIP(filter.ClientAddress); ip != nil {
+		query = query.Where("ip_src", ip.String()) // the IPv6 addresses are stored in the canonical form
+	}
+	if _, subnet, err := net.ParseCIDR(filter.ClientSubnet); err == nil {
+		query = query.ClientSubnet(subnet)
+	}
+	if filter.ClientPort > 0 {
+		query = query.Where("port_src", filter.ClientPort)
+	}
+	if filter.ClientCountry != "" {
+		query = query.Where("client_location.country", strings.ToUpper(filter.ClientCountry))
+	}
+	if filter.ClientASN > 0 {
+		query = query.Where("client_location.asn", filter.ClientASN)
+	}
+	if filter.MinDuration > 0 {
+		query = query.Where("$where", fmt.Sprintf("this.closed_at - this.started_at >= %v", filter.MinDuration))
+	}
+	if filter.MaxDuration > 0 {
+		query = query.Where("$where", fmt.Sprintf("this.closed_at - this.started_at <= %v", filter.MaxDuration))
+	}
+	if filter.MinBytes > 0 {
+		query = query.Where("$where", fmt.Sprintf("this.client_bytes + this.server_bytes >= %v", filter.MinBytes))
+	}
+	if filter.MaxBytes > 0 {
+		query = query.Where("$where", fmt.Sprintf("this.client_bytes + this.server_bytes <= %v", filter.MaxBytes))
+	}
+	if filter.MinClientBytes > 0 {
+		query = query.Where("client_bytes", UnorderedDocument{"$gte": filter.MinClientBytes})
+	}
+	if filter.MaxClientBytes > 0 {
+		query = query.Where("client_bytes", UnorderedDocument{"$lte": filter.MaxClientBytes})
+	}
+	if filter.MinServerBytes > 0 {
+		query = query.Where("server_bytes", UnorderedDocument{"$gte": filter.MinServerBytes})
+	}
+	if filter.MaxServerBytes > 0 {
+		query = query.Where("server_bytes", UnorderedDocument{"$lte": filter.MaxServerBytes})
+	}
+	if filter.StartedAfter > 0 {
+		query = query.Where("started_at", UnorderedDocument{"$gt": time.Unix(filter.StartedAfter, 0)})
+	}
+	if filter.StartedBefore > 0 {
+		query = query.Where("started_at", UnorderedDocument{"$lt": time.Unix(filter.StartedBefore, 0)})
+	}
+	if filter.ClosedAfter > 0 {
+		query = query.Where("closed_at", UnorderedDocument{"$gt": time.Unix(filter.ClosedAfter, 0)})
+	}
+	if filter.ClosedBefore > 0 {
+		query = query.Where("closed_at", UnorderedDocument{"$lt": time.Unix(filter.ClosedBefore, 0)})
+	}
+	if filter.AsOf > 0 {
+		query = query.Where("processed_at", UnorderedDocument{"$lte": time.Unix(filter.AsOf, 0)})
+	}
+	if filter.Hidden {
+		query = query.Where("hidden", true)
+	}
+	if filter.Marked {
+		query = query.Where("marked", true)
+	}
+	if filter.Starred {
+		query = query.Where("starred", true)
+	}
+	if filter.Commented {
+		query = query.Where("comment", UnorderedDocument{"$exists": true, "$ne": ""})
+	}
+	if filter.Reference != "" {
+		query = query.Where("references", UnorderedDocument{"$in": []string{filter.Reference,
+			strings.ToLower(filter.Reference)}})
+	}
+	if len(filter.Tags) > 0 {
+		query = query.Where("tags", UnorderedDocument{"$all": filter.Tags})
+	}
+	if filter.Sensor != "" {
+		query = query.Where("sensor", filter.Sensor)
+	}
+	if filter.TLSFingerprint != "" {
+		query = query.Where("tls_fingerprint", strings.ToLower(filter.TLSFingerprint))
+	}
+	if filter.Protocol == ProtocolTCP {
+		query = query.Where("protocol", UnorderedDocument{"$exists": false}) // tcp connections have no protocol
+	} else if filter.Protocol != "" {
+		query = query.Where("protocol", filter.Protocol)
+	}
+	if len(filter.MatchedRules) > 0 {
+		matchedRules := make([]RowID, len(filter.MatchedRules))
+		for i, elem := range filter.MatchedRules {
+			if id, err := RowIDFromHex(elem); err != nil {
+				log.WithError(err).WithField("filter", filter).Panic("failed to convert matched_rules ids")
+			} else {
+				matchedRules[i] = id
+			}
+		}
+		query = query.MatchedRules(matchedRules, filter.MatchedRulesAny)
+	}
+	if filter.groupRules != nil {
+		query = query.Where("matched_rules", UnorderedDocument{"$in": filter.groupRules})
+	}
+
+	return query
+}
+
+// ipv4SubnetPattern returns the regex matching the string representation of the addresses of an IPv4 subnet, or an
+// empty string if all the addresses are matched. The octet partially covered by the mask is matched listing all the
+// values it can have.
+func ipv4SubnetPattern(subnet *net.IPNet) string {
+	ip := subnet.IP.To4()
+	ones, bits := subnet.Mask.Size()
+	if ip == nil || bits != 8*net.IPv4len || ones == 0 {
+		return ""
+	}
+
+	octets := make([]string, 0, net.IPv4len)
+	for i := 0; i < net.IPv4len && ones > 8*i; i++ {
+		if ones >= 8*(i+1) {
+			octets = append(octets, strconv.Itoa(int(ip[i])))
+			continue
+		}
+		values := make([]string, 1<<(8*(i+1)-ones))
+		for j := range values {
+			values[j] = strconv.Itoa(int(ip[i]) + j)
+		}
+		octets = append(octets, "("+strings.Join(values, "|")+")")
+	}
+
+	pattern := "^" + strings.Join(octets, `\.`)
+	if len(octets) < net.IPv4len {
+		return pattern + `\.`
+	}
+	return pattern + "$"
+}
+
+// ipv6SubnetRange returns the first and the last address of an IPv6 subnet, or nil if all the addresses are matched.
+func ipv6SubnetRange(subnet *net.IPNet) ([]byte, []byte) {
+	ip := subnet.IP.To16()
+	ones, bits := subnet.Mask.Size()
+	if ip == nil || bits != 8*net.IPv6len || ones == 0 {
+		return nil, nil
+	}
+
+	first, last := make([]byte, net.IPv6len), make([]byte, net.IPv6len)
+	for i := range ip {
+		first[i] = ip[i] & subnet.Mask[i]
+		last[i] = first[i] | ^subnet.Mask[i]
+	}
+	return first, last
+}
+
+// connectionsCursor is the position of the last connection of a page: the value of the field used to sort the
+// connections and the id of the connection, which breaks the ties.
+type connectionsCursor struct {
+	Value interface{} `bson:"v"`
+	ID    RowID       `bson:"id"`
+}
+
+func encodeConnectionsCursor(cursor connectionsCursor) string {
+	document, err := bson.Marshal(cursor)
+	if err != nil {
+		log.WithError(err).WithField("cursor", cursor).Panic("failed to encode a connections cursor")
+	}
+	return base64.RawURLEncoding.EncodeToString(document)
+}
+
+func decodeConnectionsCursor(encoded string) (connectionsCursor, error) {
+	var cursor connectionsCursor
+	document, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err == nil {
+		err = bson.Unmarshal(document, &cursor)
+	}
+	if err != nil || cursor.ID.IsZero() {
+		return connectionsCursor{}, fmt.Errorf("invalid cursor %q", encoded)
+	}
+	return cursor, nil
+}
+
+// after selects the connections which follow the cursor, sorting by field in the given order.
+func (cursor connectionsCursor) after(field string, ascending bool) OrderedDocument {
+	operator := "$lt"
+	if ascending {
+		operator = "$gt"
+	}
+	if field == "_id" {
+		return OrderedDocument{{"_id", UnorderedDocument{operator: cursor.ID}}}
+	}
+	return OrderedDocument{{"$or", []OrderedDocument{
+		{{field, UnorderedDocument{operator: cursor.Value}}},
+		{{field, cursor.Value}, {"_id", UnorderedDocument{operator: cursor.ID}}},
+	}}}
+}
+
+// connectionSortValue returns the value of the field used to sort the connections.
+func connectionSortValue(connection Connection, field string) interface{} {
+	switch field {
+	case "started_at":
+		return connection.StartedAt
+	case "closed_at":
+		return connection.ClosedAt
+	case "client_bytes":
+		return connection.ClientBytes
+	case "server_bytes":
+		return connection.ServerBytes
+	case "port_src":
+		return connection.SourcePort
+	case "port_dst":
+		return connection.DestinationPort
+	default:
+		return connection.ID
+	}
+}
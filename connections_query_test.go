@@ -0,0 +1,151 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPv4SubnetPattern(t *testing.T) {
+	checkSubnet := func(cidr string, matched []string, notMatched []string) {
+		_, subnet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		pattern := regexp.MustCompile(ipv4SubnetPattern(subnet))
+		for _, address := range matched {
+			assert.True(t, pattern.MatchString(address), "%s should be in %s", address, cidr)
+		}
+		for _, address := range notMatched {
+			assert.False(t, pattern.MatchString(address), "%s should not be in %s", address, cidr)
+		}
+	}
+
+	checkSubnet("10.0.0.0/8", []string{"10.0.0.1", "10.255.1.2"}, []string{"100.0.0.1", "110.0.0.1"})
+	checkSubnet("10.10.0.0/16", []string{"10.10.3.4"}, []string{"10.100.3.4", "10.1.0.1"})
+	checkSubnet("10.0.16.0/20", []string{"10.0.16.1", "10.0.31.255"}, []string{"10.0.15.1", "10.0.32.1",
+		"10.0.160.1"})
+	checkSubnet("192.168.1.128/25", []string{"192.168.1.128", "192.168.1.255"}, []string{"192.168.1.12",
+		"192.168.1.127"})
+	checkSubnet("192.168.1.7/32", []string{"192.168.1.7"}, []string{"192.168.1.70"})
+
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+	assert.Empty(t, ipv4SubnetPattern(all))
+}
+
+func TestConnectionsCursor(t *testing.T) {
+	id := NewRowID()
+	cursor, err := decodeConnectionsCursor(encodeConnectionsCursor(connectionsCursor{Value: 1024, ID: id}))
+	require.NoError(t, err)
+	assert.Equal(t, id, cursor.ID)
+	assert.EqualValues(t, 1024, cursor.Value)
+
+	_, err = decodeConnectionsCursor("invalid")
+	assert.Error(t, err)
+	_, err = decodeConnectionsCursor(encodeConnectionsCursor(connectionsCursor{}))
+	assert.Error(t, err)
+
+	assert.Equal(t, OrderedDocument{{"_id", UnorderedDocument{"$gt": id}}}, cursor.after("_id", true))
+	assert.Error(t, ConnectionsFilter{SortBy: "payload"}.Validate())
+	assert.NoError(t, ConnectionsFilter{SortBy: "client_bytes"}.Validate())
+}
+
+func TestConnectionsQuery(t *testing.T) {
+	assert.Equal(t, OrderedDocument{}, ConnectionsFilter{}.Query().Document())
+	assert.Equal(t, OrderedDocument{{"port_dst", uint16(80)}}, ConnectionsFilter{ServicePort: 80}.Query().Document())
+
+	assert.Equal(t, OrderedDocument{{"protocol", "icmp"}}, ConnectionsFilter{Protocol: ProtocolICMP}.Query().Document())
+	assert.Equal(t, OrderedDocument{{"protocol", UnorderedDocument{"$exists": false}}},
+		ConnectionsFilter{Protocol: ProtocolTCP}.Query().Document())
+
+	assert.Equal(t, OrderedDocument{{"ip_src", "fd00::1"}},
+		ConnectionsFilter{ClientAddress: "fd00:0::0001"}.Query().Document())
+	assert.Equal(t, OrderedDocument{{"ip_src_bytes", UnorderedDocument{
+		"$gte": []byte{0xfd, 0, 0, 0, 0, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		"$lte": []byte{0xfd, 0, 0, 0, 0, 0x10, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}}}, ConnectionsFilter{ClientSubnet: "fd00:0:10::/48"}.Query().Document())
+	assert.Equal(t, OrderedDocument{}, ConnectionsFilter{ClientSubnet: "::/0"}.Query().Document())
+
+	query := ConnectionsFilter{MinDuration: 10, MaxDuration: 20}.Query()
+	assert.Equal(t, OrderedDocument{{"$and", []OrderedDocument{
+		{{"$where", "this.closed_at - this.started_at >= 10"}},
+		{{"$where", "this.closed_at - this.started_at <= 20"}},
+	}}}, query.Document())
+}
+
+func TestConnectionsFiltersAndSorting(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(Services)
+
+	servicesController := NewServicesController(wrapper.Storage)
+	connectionsController := NewConnectionsController(wrapper.Storage, nil, servicesController, nil)
+	statisticsController := NewStatisticsController(wrapper.Storage)
+
+	startedAt := time.Unix(1600000000, 0)
+	firstRule, secondRule := NewRowID(), NewRowID()
+	ids := []RowID{NewRowID(), NewRowID(), NewRowID(), NewRowID()}
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).Many([]interface{}{
+		Connection{ID: ids[0], SourceIP: "10.0.1.1", DestinationPort: 80, StartedAt: startedAt, ClientBytes: 300,
+			MatchedRules: []RowID{firstRule}},
+		Connection{ID: ids[1], SourceIP: "10.0.2.1", DestinationPort: 80, StartedAt: startedAt, ClientBytes: 100,
+			MatchedRules: []RowID{firstRule, secondRule}},
+		Connection{ID: ids[2], SourceIP: "10.1.1.1", DestinationPort: 443, StartedAt: startedAt, ClientBytes: 200,
+			MatchedRules: []RowID{secondRule}},
+		Connection{ID: ids[3], SourceIP: "10.0.1.2", DestinationPort: 80, StartedAt: startedAt, ClientBytes: 200},
+	})
+	require.NoError(t, err)
+
+	checkConnections := func(filter ConnectionsFilter, expected ...RowID) string {
+		page, err := connectionsController.GetConnections(wrapper.Context, filter)
+		require.NoError(t, err)
+		actual := make([]RowID, len(page.Connections))
+		for i, connection := range page.Connections {
+			actual[i] = connection.ID
+		}
+		assert.Equal(t, expected, actual)
+		return page.NextCursor
+	}
+
+	checkConnections(ConnectionsFilter{ClientSubnet: "10.0.0.0/16", SortBy: "client_bytes"}, ids[0], ids[3], ids[1])
+	checkConnections(ConnectionsFilter{MatchedRules: []string{firstRule.Hex(), secondRule.Hex()}}, ids[1])
+	checkConnections(ConnectionsFilter{MatchedRules: []string{firstRule.Hex(), secondRule.Hex()},
+		MatchedRulesAny: true, SortBy: "client_bytes", SortOrder: "asc"}, ids[1], ids[2], ids[0])
+	checkConnections(ConnectionsFilter{MinClientBytes: 150, MaxClientBytes: 250, ServicePort: 80}, ids[3])
+
+	// client_bytes desc, then id desc: 0 (300), 3 (200), 2 (200), 1 (100)
+	cursor := checkConnections(ConnectionsFilter{SortBy: "client_bytes", Limit: 2}, ids[0], ids[3])
+	require.NotEmpty(t, cursor)
+	cursor = checkConnections(ConnectionsFilter{SortBy: "client_bytes", Limit: 2, Cursor: cursor}, ids[2], ids[1])
+	require.NotEmpty(t, cursor)
+	assert.Empty(t, checkConnections(ConnectionsFilter{SortBy: "client_bytes", Limit: 2, Cursor: cursor}))
+
+	_, err = connectionsController.GetConnections(wrapper.Context, ConnectionsFilter{Cursor: "invalid"})
+	assert.Error(t, err)
+
+	totals := statisticsController.GetTotalStatistics(wrapper.Context, StatisticsFilter{
+		Connections: ConnectionsFilter{ClientSubnet: "10.0.0.0/16"}})
+	assert.Equal(t, map[uint16]int64{80: 3}, totals.ConnectionsPerService)
+	assert.Equal(t, map[uint16]int64{80: 600}, totals.ClientBytesPerService)
+
+	wrapper.Destroy(t)
+}
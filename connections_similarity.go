@@ -0,0 +1,226 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The fingerprints of the streams are MinHash signatures of the 4-bytes shingles of the first bytes of the payloads.
+// The signatures are split in bands which are indexed, so that only the connections which share at least one band,
+// which are likely to have a similarity greater than 0.5, are compared.
+const (
+	minHashSize          = 64
+	minHashShingleSize   = 4
+	minHashBands         = 16
+	minHashBandRows      = minHashSize / minHashBands
+	fingerprintMaxBytes  = 64 * 1024
+	maxSimilarCandidates = 5000
+)
+
+const (
+	DefaultSimilarConnections      = 10
+	DefaultMinConnectionSimilarity = 0.5
+)
+
+type SimilarConnectionsOptions struct {
+	Limit         int     `json:"limit" binding:"omitempty,min=1,max=100"`
+	MinSimilarity float64 `json:"min_similarity" binding:"omitempty,min=0,max=1"`
+	AllServices   bool    `json:"all_services"`
+}
+
+type SimilarConnection struct {
+	Connection       Connection `json:"connection"`
+	Similarity       float64    `json:"similarity"`
+	ClientSimilarity float64    `json:"client_similarity"`
+	ServerSimilarity float64    `json:"server_similarity"`
+}
+
+// FindSimilarConnections returns the connections whose payloads are the most similar to the ones of the connection
+// with the given id, ordered by similarity. By default only the connections of the same service are compared.
+// Returns false if the connection does not exist.
+func (cc ConnectionsController) FindSimilarConnections(c context.Context, id RowID,
+	options SimilarConnectionsOptions) ([]SimilarConnection, bool) {
+	var connection Connection
+	if err := cc.storage.Find(Connections).Context(c).Filter(byID(id)).First(&connection); err != nil {
+		log.WithError(err).WithField("id", id).Panic("failed to get connection")
+	}
+	if connection.ID.IsZero() {
+		return nil, false
+	}
+	if options.Limit == 0 {
+		options.Limit = DefaultSimilarConnections
+	}
+	if options.MinSimilarity == 0 {
+		options.MinSimilarity = DefaultMinConnectionSimilarity
+	}
+
+	similarConnections := make([]SimilarConnection, 0, options.Limit)
+	if len(connection.MinHashBands) == 0 {
+		return similarConnections, true
+	}
+
+	query := cc.storage.Find(Connections).Context(c).Filter(OrderedDocument{
+		{"_id", UnorderedDocument{"$ne": id}},
+		{"minhash_bands", UnorderedDocument{"$in": connection.MinHashBands}},
+	})
+	if !options.AllServices {
+		query = query.Filter(OrderedDocument{{"port_dst", connection.DestinationPort}})
+	}
+	var candidates []Connection
+	if err := query.Sort("_id", false).Limit(maxSimilarCandidates).All(&candidates); err != nil {
+		log.WithError(err).WithField("id", id).Panic("failed to get similar connections")
+	}
+
+	for _, candidate := range candidates {
+		similar := compareFingerprints(connection, candidate)
+		if similar.Similarity >= options.MinSimilarity {
+			similarConnections = append(similarConnections, similar)
+		}
+	}
+	sort.SliceStable(similarConnections, func(i, j int) bool {
+		return similarConnections[i].Similarity > similarConnections[j].Similarity
+	})
+	if len(similarConnections) > options.Limit {
+		similarConnections = similarConnections[:options.Limit]
+	}
+
+	return similarConnections, true
+}
+
+// compareFingerprints estimates the similarity of the streams of candidate with the ones of connection. The overall
+// similarity is the mean of the similarities of the streams which are not empty in connection.
+func compareFingerprints(connection, candidate Connection) SimilarConnection {
+	similar := SimilarConnection{
+		Connection:       candidate,
+		ClientSimilarity: minHashSimilarity(connection.ClientMinHash, candidate.ClientMinHash),
+		ServerSimilarity: minHashSimilarity(connection.ServerMinHash, candidate.ServerMinHash),
+	}
+
+	var streams int
+	if len(connection.ClientMinHash) > 0 {
+		similar.Similarity += similar.ClientSimilarity
+		streams++
+	}
+	if len(connection.ServerMinHash) > 0 {
+		similar.Similarity += similar.ServerSimilarity
+		streams++
+	}
+	if streams > 0 {
+		similar.Similarity /= float64(streams)
+	}
+
+	return similar
+}
+
+// minHash computes the MinHash signature of the first fingerprintMaxBytes bytes written, across the writes.
+type minHash struct {
+	values   [minHashSize]uint32
+	shingle  uint32
+	length   int
+	shingles int
+}
+
+func newMinHash() *minHash {
+	mh := &minHash{}
+	for i := range mh.values {
+		mh.values[i] = ^uint32(0)
+	}
+	return mh
+}
+
+func (mh *minHash) Write(data []byte) {
+	for _, b := range data {
+		if mh.length >= fingerprintMaxBytes {
+			return
+		}
+		mh.shingle = mh.shingle<<8 | uint32(b)
+		mh.length++
+		if mh.length < minHashShingleSize {
+			continue
+		}
+
+		// the hash functions are derived from a single 64 bit hash of the shingle
+		hash := mixHash(uint64(mh.shingle))
+		h1, h2 := uint32(hash), uint32(hash>>32)|1
+		for i := range mh.values {
+			if value := h1 + uint32(i)*h2; value < mh.values[i] {
+				mh.values[i] = value
+			}
+		}
+		mh.shingles++
+	}
+}
+
+// Signature returns the signature encoded as bytes, or nil if the payload is shorter than a shingle.
+func (mh *minHash) Signature() []byte {
+	if mh == nil || mh.shingles == 0 {
+		return nil
+	}
+	signature := make([]byte, minHashSize*4)
+	for i, value := range mh.values {
+		binary.LittleEndian.PutUint32(signature[i*4:], value)
+	}
+	return signature
+}
+
+// mixHash is the finalizer of splitmix64
+func mixHash(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// minHashSimilarity estimates the Jaccard similarity of the shingles of two payloads from their signatures.
+func minHashSimilarity(a, b []byte) float64 {
+	if len(a) != minHashSize*4 || len(b) != minHashSize*4 {
+		return 0
+	}
+	var equals int
+	for i := 0; i < len(a); i += 4 {
+		if binary.LittleEndian.Uint32(a[i:]) == binary.LittleEndian.Uint32(b[i:]) {
+			equals++
+		}
+	}
+	return float64(equals) / minHashSize
+}
+
+// fingerprintBands returns the hashes of the bands of the signatures of the client and of the server streams.
+func fingerprintBands(clientSignature, serverSignature []byte) []int64 {
+	var bands []int64
+	for direction, signature := range [][]byte{clientSignature, serverSignature} {
+		if len(signature) != minHashSize*4 {
+			continue
+		}
+		for band := 0; band < minHashBands; band++ {
+			hash := fnv.New64a()
+			_, _ = hash.Write([]byte{byte(direction), byte(band)})
+			_, _ = hash.Write(signature[band*minHashBandRows*4 : (band+1)*minHashBandRows*4])
+			bands = append(bands, int64(hash.Sum64()))
+		}
+	}
+	return bands
+}
@@ -0,0 +1,318 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	replayDialTimeout       = 10 * time.Second
+	defaultReplayTimeout    = 5
+	maxReplayPreservedDelay = 10 * time.Second
+	replayReadBufferSize    = 4096
+)
+
+// ReplaySubstitution replaces all the occurrences of From with To in the client payload before sending it, for example
+// to change the address of the attacked team or the flag id.
+type ReplaySubstitution struct {
+	From string `json:"from" binding:"required"`
+	To   string `json:"to"`
+}
+
+// ReplayOptions contain the target of the replay and how the client payload is sent. Delay is the number of
+// milliseconds between each chunk sent, while PreserveTiming waits the same time elapsed between the original chunks.
+// Timeout is the number of seconds to wait for the responses after the last chunk is sent.
+type ReplayOptions struct {
+	Host           string               `json:"host" binding:"required,hostname|ip"`
+	Port           uint16               `json:"port" binding:"required,min=1"`
+	Delay          int                  `json:"delay" binding:"min=0,max=60000"`
+	PreserveTiming bool                 `json:"preserve_timing"`
+	Substitutions  []ReplaySubstitution `json:"substitutions" binding:"dive"`
+	Timeout        int                  `json:"timeout" binding:"min=0,max=300"`
+}
+
+type ReplayResult struct {
+	ConnectionID RowID  `json:"connection_id"`
+	ReplayedID   RowID  `json:"replayed_id,omitempty"`
+	ClientBytes  int    `json:"client_bytes"`
+	ServerBytes  int    `json:"server_bytes"`
+	Error        string `json:"error,omitempty"`
+}
+
+// replayStream contains the payload sent or received during a replay, with the same blocks layout of the streams
+// reassembled from the captured packets.
+type replayStream struct {
+	payload    []byte
+	indexes    []int
+	timestamps []time.Time
+	truncated  bool
+}
+
+// ExploitReplayer sends again the client payload of a captured connection to another target and stores the replayed
+// session as a new connection, so that the responses can be inspected as the ones captured.
+type ExploitReplayer struct {
+	storage                     Storage
+	connectionStreamsController ConnectionStreamsController
+	notificationController      *NotificationController
+}
+
+func NewExploitReplayer(storage Storage, connectionStreamsController ConnectionStreamsController,
+	notificationController *NotificationController) *ExploitReplayer {
+	return &ExploitReplayer{
+		storage:                     storage,
+		connectionStreamsController: connectionStreamsController,
+		notificationController:      notificationController,
+	}
+}
+
+// Replay sends the client payload of the connection to the target specified in options. Returns false if the connection
+// does not exist. If the target can't be reached the result contains the error and no connection is stored.
+func (er *ExploitReplayer) Replay(c context.Context, connectionID RowID, options ReplayOptions) (ReplayResult, bool) {
+	connection := er.connectionStreamsController.getConnection(c, connectionID)
+	if connection.ID.IsZero() {
+		return ReplayResult{}, false
+	}
+
+	chunks, timestamps := er.clientChunks(c, connectionID, options.Substitutions)
+	result := ReplayResult{ConnectionID: connectionID}
+
+	dialer := net.Dialer{Timeout: replayDialTimeout}
+	conn, err := dialer.DialContext(c, "tcp", net.JoinHostPort(options.Host, strconv.Itoa(int(options.Port))))
+	if err != nil {
+		result.Error = err.Error()
+		return result, true
+	}
+	defer conn.Close()
+
+	startedAt := time.Now()
+	serverStream := &replayStream{}
+	readDone := make(chan error, 1)
+	go func() {
+		readDone <- readReplayResponses(conn, serverStream)
+	}()
+
+	clientStream := &replayStream{}
+	var sendErr error
+	for i, chunk := range chunks {
+		if i > 0 {
+			if err := sleepContext(c, replayDelay(options, timestamps[i-1], timestamps[i])); err != nil {
+				sendErr = err
+				break
+			}
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			sendErr = err
+			break
+		}
+		clientStream.append(chunk, time.Now())
+	}
+
+	timeout := options.Timeout
+	if timeout == 0 {
+		timeout = defaultReplayTimeout
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second)); err != nil {
+		log.WithError(err).Warn("failed to set replay read deadline")
+	}
+	var readErr error
+	select {
+	case readErr = <-readDone:
+	case <-c.Done():
+		_ = conn.Close()
+		readErr = <-readDone
+	}
+	closedAt := time.Now()
+
+	if sendErr != nil {
+		result.Error = sendErr.Error()
+	} else if readErr != nil && readErr != io.EOF && !isTimeout(readErr) {
+		result.Error = readErr.Error()
+	}
+
+	replayed := er.storeReplay(c, connection, conn, clientStream, serverStream, startedAt, closedAt)
+	result.ReplayedID = replayed.ID
+	result.ClientBytes = replayed.ClientBytes
+	result.ServerBytes = replayed.ServerBytes
+
+	return result, true
+}
+
+// clientChunks returns the blocks of the client payload of a connection, with the substitutions applied, and the
+// timestamps when the blocks have been captured.
+func (er *ExploitReplayer) clientChunks(c context.Context, connectionID RowID,
+	substitutions []ReplaySubstitution) ([][]byte, []time.Time) {
+	var chunks [][]byte
+	var timestamps []time.Time
+	for documentIndex := 0; ; documentIndex++ {
+		stream := er.connectionStreamsController.getConnectionStream(c, connectionID, true, documentIndex)
+		if stream.ID.IsZero() {
+			break
+		}
+
+		for i, start := range stream.BlocksIndexes {
+			end := len(stream.Payload)
+			if i < len(stream.BlocksIndexes)-1 {
+				end = stream.BlocksIndexes[i+1]
+			}
+			chunk := stream.Payload[start:end]
+			for _, substitution := range substitutions {
+				chunk = bytes.ReplaceAll(chunk, []byte(substitution.From), []byte(substitution.To))
+			}
+			chunks = append(chunks, chunk)
+			timestamps = append(timestamps, stream.BlocksTimestamps[i])
+		}
+	}
+
+	return chunks, timestamps
+}
+
+func (er *ExploitReplayer) storeReplay(c context.Context, original Connection, conn net.Conn,
+	clientStream, serverStream *replayStream, startedAt, closedAt time.Time) Connection {
+	connection := Connection{
+		ID:              NewRowID(),
+		SourceIP:        original.SourceIP,
+		SourceIPBytes:   ipBytes(original.SourceIP),
+		DestinationIP:   original.DestinationIP,
+		SourcePort:      original.SourcePort,
+		DestinationPort: original.DestinationPort,
+		StartedAt:       startedAt,
+		ClosedAt:        closedAt,
+		StartedAtNanos:  startedAt.UnixNano(),
+		ClosedAtNanos:   closedAt.UnixNano(),
+		ClientBytes:     len(clientStream.payload),
+		ServerBytes:     len(serverStream.payload),
+		ProcessedAt:     time.Now(),
+		MatchedRules:    []RowID{},
+		ReplayOf:        &original.ID,
+		Truncated:       clientStream.truncated || serverStream.truncated,
+	}
+	if address, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		connection.SourceIP, connection.SourcePort = address.IP.String(), uint16(address.Port)
+	}
+	if address, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		connection.DestinationIP, connection.DestinationPort = address.IP.String(), uint16(address.Port)
+	}
+
+	var streams []interface{}
+	for _, stream := range []*replayStream{clientStream, serverStream} {
+		if len(stream.payload) == 0 {
+			continue
+		}
+		fromClient := stream == clientStream
+		streams = append(streams, ConnectionStream{
+			ID:               NewRowID(),
+			ConnectionID:     connection.ID,
+			FromClient:       fromClient,
+			DocumentIndex:    0,
+			Payload:          stream.payload,
+			PayloadString:    strings.ToValidUTF8(string(stream.payload), ""),
+			BlocksIndexes:    stream.indexes,
+			BlocksTimestamps: stream.timestamps,
+			BlocksLoss:       make([]bool, len(stream.indexes)),
+			PatternMatches:   map[uint][]PatternSlice{},
+		})
+		if fromClient {
+			connection.ClientDocuments = 1
+		} else {
+			connection.ServerDocuments = 1
+		}
+	}
+
+	if len(streams) > 0 {
+		if _, err := er.storage.Insert(ConnectionStreams).Context(c).Many(streams); err != nil {
+			log.WithError(err).WithField("connection_id", connection.ID).Panic("failed to insert replay streams")
+		}
+	}
+	if _, err := er.storage.Insert(Connections).Context(c).One(connection); err != nil {
+		log.WithError(err).WithField("connection", connection).Panic("failed to insert replay connection")
+	}
+	er.notificationController.Notify("connections.new", connection)
+	er.notificationController.Notify("connections.replayed", connection)
+
+	return connection
+}
+
+func (rs *replayStream) append(chunk []byte, timestamp time.Time) {
+	if len(chunk) == 0 {
+		return
+	}
+	if available := MaxDocumentSize - len(rs.payload); len(chunk) > available {
+		rs.truncated = true
+		chunk = chunk[:available]
+		if len(chunk) == 0 {
+			return
+		}
+	}
+
+	rs.indexes = append(rs.indexes, len(rs.payload))
+	rs.timestamps = append(rs.timestamps, timestamp)
+	rs.payload = append(rs.payload, chunk...)
+}
+
+// readReplayResponses reads from conn until the connection is closed or the read deadline expires.
+func readReplayResponses(conn net.Conn, stream *replayStream) error {
+	buffer := make([]byte, replayReadBufferSize)
+	for {
+		n, err := conn.Read(buffer)
+		if n > 0 {
+			stream.append(buffer[:n], time.Now())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func replayDelay(options ReplayOptions, previous, current time.Time) time.Duration {
+	if options.PreserveTiming {
+		delay := current.Sub(previous)
+		if delay > maxReplayPreservedDelay {
+			return maxReplayPreservedDelay
+		}
+		return delay
+	}
+	return time.Duration(options.Delay) * time.Millisecond
+}
+
+func sleepContext(c context.Context, duration time.Duration) error {
+	if duration <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.Done():
+		return c.Err()
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,124 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayDelay(t *testing.T) {
+	previous := time.Now()
+	assert.Equal(t, 100*time.Millisecond, replayDelay(ReplayOptions{Delay: 100}, previous, previous.Add(time.Second)))
+	assert.Equal(t, time.Second, replayDelay(ReplayOptions{PreserveTiming: true}, previous, previous.Add(time.Second)))
+	assert.Equal(t, maxReplayPreservedDelay, replayDelay(ReplayOptions{PreserveTiming: true}, previous,
+		previous.Add(time.Hour)))
+
+	stream := &replayStream{}
+	stream.append([]byte("abc"), previous)
+	stream.append(nil, previous)
+	stream.append(make([]byte, MaxDocumentSize), previous)
+	assert.Equal(t, []int{0, 3}, stream.indexes)
+	assert.Len(t, stream.payload, MaxDocumentSize)
+	assert.True(t, stream.truncated)
+}
+
+func TestExploitReplayer(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+
+	// the server responds to each line with the uppercase line
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	received := make(chan string, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			received <- line
+			_, _ = conn.Write([]byte("OK " + line))
+		}
+	}()
+
+	connectionID := NewRowID()
+	capturedAt := time.Now().Add(-time.Hour)
+	_, err = wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(Connection{ID: connectionID,
+		SourceIP: "10.10.1.1", DestinationIP: "10.10.2.1", SourcePort: 40000, DestinationPort: 8080})
+	require.NoError(t, err)
+	_, err = wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).Many([]interface{}{
+		ConnectionStream{ID: NewRowID(), ConnectionID: connectionID, FromClient: true,
+			Payload: []byte("login 10.10.2.1\nget FLAGID\n"), BlocksIndexes: []int{0, 16},
+			BlocksTimestamps: []time.Time{capturedAt, capturedAt.Add(time.Second)}, BlocksLoss: []bool{false, false}},
+		ConnectionStream{ID: NewRowID(), ConnectionID: connectionID, FromClient: false,
+			Payload: []byte("ignored\n"), BlocksIndexes: []int{0},
+			BlocksTimestamps: []time.Time{capturedAt}, BlocksLoss: []bool{false}},
+	})
+	require.NoError(t, err)
+
+	replayer := NewExploitReplayer(wrapper.Storage, NewConnectionStreamsController(wrapper.Storage, nil), nil)
+	address := listener.Addr().(*net.TCPAddr)
+	options := ReplayOptions{Host: "127.0.0.1", Port: uint16(address.Port), Delay: 10, Timeout: 1,
+		Substitutions: []ReplaySubstitution{{From: "10.10.2.1", To: "10.10.3.1"}, {From: "FLAGID", To: "abc"}}}
+	result, found := replayer.Replay(wrapper.Context, connectionID, options)
+	require.True(t, found)
+	assert.Empty(t, result.Error)
+	assert.Equal(t, "login 10.10.3.1\n", <-received)
+	assert.Equal(t, "get abc\n", <-received)
+	assert.Equal(t, 24, result.ClientBytes)
+	assert.Equal(t, 30, result.ServerBytes)
+
+	var replayed Connection
+	require.NoError(t, wrapper.Storage.Find(Connections).Context(wrapper.Context).Filter(byID(result.ReplayedID)).
+		First(&replayed))
+	require.NotNil(t, replayed.ReplayOf)
+	assert.Equal(t, connectionID, *replayed.ReplayOf)
+	assert.Equal(t, uint16(address.Port), replayed.DestinationPort)
+	assert.Equal(t, 1, replayed.ServerDocuments)
+
+	var serverStream ConnectionStream
+	require.NoError(t, wrapper.Storage.Find(ConnectionStreams).Context(wrapper.Context).Filter(OrderedDocument{
+		{"connection_id", result.ReplayedID}, {"from_client", false}}).First(&serverStream))
+	assert.Equal(t, "OK login 10.10.3.1\nOK get abc\n", string(serverStream.Payload))
+
+	_, found = replayer.Replay(wrapper.Context, NewRowID(), options)
+	assert.False(t, found)
+
+	// the target is not reachable
+	require.NoError(t, listener.Close())
+	result, found = replayer.Replay(wrapper.Context, connectionID, options)
+	assert.True(t, found)
+	assert.NotEmpty(t, result.Error)
+	assert.True(t, result.ReplayedID.IsZero())
+
+	wrapper.Destroy(t)
+}
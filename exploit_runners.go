@@ -0,0 +1,242 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultRunnersMinConnections = 10
+const defaultRunnersMaxJitter = 0.2
+const maxRunnersAnalyzedConnections = 200000
+
+// runnerMinStrideRatio is the fraction of the consecutive connections whose source ports must differ by the same
+// stride to consider the stride a signal of a runner
+const runnerMinStrideRatio = 0.5
+
+// Signals which identify an exploit runner
+const (
+	RunnerSignalPortStride     = "port_stride"
+	RunnerSignalFixedDelay     = "fixed_delay"
+	RunnerSignalTLSFingerprint = "tls_fingerprint"
+)
+
+// ExploitRunner is a group of connections opened by the same client to the same service which are likely made by one
+// attacking script. A group is a runner if the source ports of consecutive connections grow by a fixed stride, if the
+// connections are opened with a fixed delay, or if they have the same TLS fingerprint. The connections of a runner are
+// listed with the client_address, service_port and tls_fingerprint filters of the connections.
+type ExploitRunner struct {
+	SourceIP        string         `json:"ip_src"`
+	DestinationPort uint16         `json:"port_dst"`
+	TLSFingerprint  string         `json:"tls_fingerprint,omitempty"`
+	Signals         []string       `json:"signals"`
+	Connections     int            `json:"connections"`
+	PortStride      int            `json:"port_stride,omitempty"`
+	MeanInterval    int64          `json:"mean_interval"`
+	Jitter          float64        `json:"jitter"`
+	ClientBytes     int64          `json:"client_bytes"`
+	ServerBytes     int64          `json:"server_bytes"`
+	AverageDuration int64          `json:"average_duration"`
+	MatchedRules    map[string]int `json:"matched_rules"`
+	FlagsOut        int            `json:"flags_out"`
+	FirstSeen       time.Time      `json:"first_seen"`
+	LastSeen        time.Time      `json:"last_seen"`
+	Service         Service        `json:"service"`
+}
+
+type RunnersFilter struct {
+	StartedAfter   int64   `form:"started_after"`
+	StartedBefore  int64   `form:"started_before" binding:"omitempty,gtefield=StartedAfter"`
+	ServicePort    uint16  `form:"service_port"`
+	MinConnections int     `form:"min_connections" binding:"omitempty,min=3"`
+	MaxJitter      float64 `form:"max_jitter" binding:"omitempty,min=0"`
+	AsOf           int64   `form:"as_of"`
+}
+
+type RunnersController struct {
+	storage            Storage
+	servicesController *ServicesController
+}
+
+type runnerKey struct {
+	sourceIP        string
+	destinationPort uint16
+	tlsFingerprint  string
+}
+
+func NewRunnersController(storage Storage, servicesController *ServicesController) RunnersController {
+	return RunnersController{
+		storage:            storage,
+		servicesController: servicesController,
+	}
+}
+
+// GetRunners analyzes the connections in the selected time range and returns the exploit runners, sorted by number of
+// connections.
+func (rc RunnersController) GetRunners(c context.Context, filter RunnersFilter) []ExploitRunner {
+	var connections []Connection
+	query := rc.storage.Find(Connections).Context(c).Sort("started_at", true).
+		Projection(OrderedDocument{{"ip_src", 1}, {"port_src", 1}, {"port_dst", 1}, {"started_at", 1},
+			{"closed_at", 1}, {"client_bytes", 1}, {"server_bytes", 1}, {"matched_rules", 1}, {"flags_out", 1},
+			{"tls_fingerprint", 1}}).Limit(maxRunnersAnalyzedConnections)
+	if filter.StartedAfter > 0 {
+		query = query.Filter(OrderedDocument{{"started_at", UnorderedDocument{"$gt": time.Unix(filter.StartedAfter, 0)}}})
+	}
+	if filter.StartedBefore > 0 {
+		query = query.Filter(OrderedDocument{{"started_at", UnorderedDocument{"$lt": time.Unix(filter.StartedBefore, 0)}}})
+	}
+	if filter.ServicePort > 0 {
+		query = query.Filter(OrderedDocument{{"port_dst", filter.ServicePort}})
+	}
+	if filter.AsOf > 0 {
+		query = query.Filter(OrderedDocument{{"processed_at", UnorderedDocument{"$lte": time.Unix(filter.AsOf, 0)}}})
+	}
+
+	if err := query.All(&connections); err != nil {
+		log.WithError(err).WithField("filter", filter).Panic("failed to get connections")
+	}
+
+	runners := detectRunners(connections, filter)
+	services := rc.servicesController.GetServices()
+	for i, runner := range runners {
+		if service, isPresent := services[runner.DestinationPort]; isPresent {
+			runners[i].Service = service
+		}
+	}
+
+	return runners
+}
+
+// detectRunners groups the connections, which must be sorted by started_at, by client, service and TLS fingerprint,
+// and returns the groups which show at least one of the signals of a runner.
+func detectRunners(connections []Connection, filter RunnersFilter) []ExploitRunner {
+	if filter.MinConnections == 0 {
+		filter.MinConnections = defaultRunnersMinConnections
+	}
+	if filter.MaxJitter == 0 {
+		filter.MaxJitter = defaultRunnersMaxJitter
+	}
+
+	groups := make(map[runnerKey][]Connection)
+	for _, connection := range connections {
+		key := runnerKey{connection.SourceIP, connection.DestinationPort, connection.TLSFingerprint}
+		groups[key] = append(groups[key], connection)
+	}
+
+	runners := make([]ExploitRunner, 0)
+	for key, group := range groups {
+		if len(group) < filter.MinConnections {
+			continue
+		}
+
+		runner := ExploitRunner{
+			SourceIP:        key.sourceIP,
+			DestinationPort: key.destinationPort,
+			TLSFingerprint:  key.tlsFingerprint,
+			Signals:         []string{},
+			Connections:     len(group),
+			MatchedRules:    make(map[string]int),
+			FirstSeen:       group[0].StartedAt,
+			LastSeen:        group[len(group)-1].StartedAt,
+		}
+
+		if stride := portStride(group); stride != 0 {
+			runner.PortStride = stride
+			runner.Signals = append(runner.Signals, RunnerSignalPortStride)
+		}
+		intervals := make([]float64, 0, len(group)-1)
+		for i := 1; i < len(group); i++ {
+			intervals = append(intervals, float64(group[i].StartedAt.Sub(group[i-1].StartedAt).Milliseconds()))
+		}
+		if mean := Average(intervals); mean > 0 {
+			var variance float64
+			for _, interval := range intervals {
+				variance += (interval - mean) * (interval - mean)
+			}
+			runner.MeanInterval = int64(mean)
+			runner.Jitter = math.Sqrt(variance/float64(len(intervals))) / mean
+			if runner.Jitter <= filter.MaxJitter {
+				runner.Signals = append(runner.Signals, RunnerSignalFixedDelay)
+			}
+		}
+		if key.tlsFingerprint != "" {
+			runner.Signals = append(runner.Signals, RunnerSignalTLSFingerprint)
+		}
+		if len(runner.Signals) == 0 {
+			continue
+		}
+
+		var totalDuration time.Duration
+		for _, connection := range group {
+			runner.ClientBytes += int64(connection.ClientBytes)
+			runner.ServerBytes += int64(connection.ServerBytes)
+			runner.FlagsOut += connection.FlagsOut
+			totalDuration += connection.ClosedAt.Sub(connection.StartedAt)
+			for _, ruleID := range connection.MatchedRules {
+				runner.MatchedRules[ruleID.Hex()]++
+			}
+		}
+		runner.AverageDuration = (totalDuration / time.Duration(len(group))).Milliseconds()
+
+		runners = append(runners, runner)
+	}
+
+	sort.Slice(runners, func(i, j int) bool {
+		if runners[i].Connections == runners[j].Connections {
+			return runners[i].FirstSeen.Before(runners[j].FirstSeen)
+		}
+		return runners[i].Connections > runners[j].Connections
+	})
+
+	return runners
+}
+
+// portStride returns the most frequent difference between the source ports of consecutive connections, if it is
+// shared by at least runnerMinStrideRatio of the connections, otherwise zero.
+func portStride(group []Connection) int {
+	if len(group) < 2 {
+		return 0
+	}
+
+	strides := make(map[int]int)
+	var stride, count int
+	for i := 1; i < len(group); i++ {
+		current := int(group[i].SourcePort) - int(group[i-1].SourcePort)
+		strides[current]++
+		if strides[current] > count || strides[current] == count && abs(current) < abs(stride) {
+			stride, count = current, strides[current]
+		}
+	}
+
+	if float64(count) < runnerMinStrideRatio*float64(len(group)-1) {
+		return 0
+	}
+	return stride
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,141 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectRunners(t *testing.T) {
+	startTime := time.Unix(1600000000, 0)
+	ruleID := NewRowID()
+	var connections []Connection
+	addConnection := func(sourceIP string, sourcePort uint16, startedAt time.Time, fingerprint string) {
+		connections = append(connections, Connection{
+			SourceIP:        sourceIP,
+			SourcePort:      sourcePort,
+			DestinationPort: 8080,
+			StartedAt:       startedAt,
+			ClosedAt:        startedAt.Add(500 * time.Millisecond),
+			ClientBytes:     100,
+			ServerBytes:     200,
+			FlagsOut:        1,
+			MatchedRules:    []RowID{ruleID},
+			TLSFingerprint:  fingerprint,
+		})
+	}
+	randomPorts := []uint16{41873, 52011, 40457, 61230, 47702, 43318, 58964, 49120, 55532, 40091, 63377, 45809}
+	for i := 0; i < 12; i++ {
+		irregular := startTime.Add(time.Duration(i*i*3) * time.Second)
+		// sequential source ports: runner
+		addConnection("10.0.0.1", uint16(40000+2*i), irregular, "")
+		// fixed delay: runner
+		addConnection("10.0.0.2", randomPorts[i], startTime.Add(time.Duration(i*5)*time.Second), "")
+		// same tls fingerprint: runner
+		addConnection("10.0.0.3", randomPorts[i], irregular, "d41d8cd98f00b204e9800998ecf8427e")
+		// no signal: not a runner
+		addConnection("10.0.0.4", randomPorts[i], irregular, "")
+	}
+	for i := 0; i < 3; i++ { // too few connections
+		addConnection("10.0.0.5", uint16(50000+i), startTime.Add(time.Duration(i)*time.Second), "")
+	}
+	sort.SliceStable(connections, func(i, j int) bool {
+		return connections[i].StartedAt.Before(connections[j].StartedAt)
+	})
+
+	runners := detectRunners(connections, RunnersFilter{})
+	require.Len(t, runners, 3)
+	runnersBySource := make(map[string]ExploitRunner)
+	for _, runner := range runners {
+		assert.Equal(t, 12, runner.Connections)
+		runnersBySource[runner.SourceIP] = runner
+	}
+
+	assert.Equal(t, []string{RunnerSignalPortStride}, runnersBySource["10.0.0.1"].Signals)
+	assert.Equal(t, 2, runnersBySource["10.0.0.1"].PortStride)
+	assert.Equal(t, []string{RunnerSignalFixedDelay}, runnersBySource["10.0.0.2"].Signals)
+	assert.Equal(t, int64(5000), runnersBySource["10.0.0.2"].MeanInterval)
+	assert.Equal(t, []string{RunnerSignalTLSFingerprint}, runnersBySource["10.0.0.3"].Signals)
+
+	runner := runnersBySource["10.0.0.1"]
+	assert.Equal(t, int64(1200), runner.ClientBytes)
+	assert.Equal(t, int64(2400), runner.ServerBytes)
+	assert.Equal(t, int64(500), runner.AverageDuration)
+	assert.Equal(t, 12, runner.FlagsOut)
+	assert.Equal(t, map[string]int{ruleID.Hex(): 12}, runner.MatchedRules)
+
+	assert.Len(t, detectRunners(connections, RunnersFilter{MinConnections: 3}), 4)
+}
+
+func TestPortStride(t *testing.T) {
+	group := func(ports ...uint16) []Connection {
+		connections := make([]Connection, len(ports))
+		for i, port := range ports {
+			connections[i].SourcePort = port
+		}
+		return connections
+	}
+
+	assert.Equal(t, 1, portStride(group(1000, 1001, 1002, 1003)))
+	assert.Equal(t, 4, portStride(group(1000, 1004, 1008, 2000, 2004)))
+	assert.Equal(t, 0, portStride(group(1000, 3000, 1500, 60000)))
+	assert.Equal(t, 0, portStride(group(1000, 1000, 1000)))
+	assert.Equal(t, 0, portStride(group(1000)))
+}
+
+func TestGetRunners(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(Services)
+
+	servicesController := NewServicesController(wrapper.Storage)
+	require.NoError(t, servicesController.SetService(wrapper.Context, Service{Port: 8080, Name: "shop", Color: "#fff"}))
+	runnersController := NewRunnersController(wrapper.Storage, servicesController)
+
+	startTime := time.Unix(1600000000, 0)
+	var connections []interface{}
+	for i := 0; i < 10; i++ {
+		connections = append(connections, Connection{
+			ID:              NewRowID(),
+			SourceIP:        "10.0.0.1",
+			SourcePort:      uint16(40000 + i),
+			DestinationPort: 8080,
+			StartedAt:       startTime.Add(time.Duration(i*i) * time.Second),
+			ClosedAt:        startTime.Add(time.Duration(i*i+1) * time.Second),
+		})
+	}
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).Many(connections)
+	require.NoError(t, err)
+
+	runners := runnersController.GetRunners(wrapper.Context, RunnersFilter{})
+	require.Len(t, runners, 1)
+	assert.Equal(t, "10.0.0.1", runners[0].SourceIP)
+	assert.Equal(t, 1, runners[0].PortStride)
+	assert.Equal(t, "shop", runners[0].Service.Name)
+
+	assert.Empty(t, runnersController.GetRunners(wrapper.Context, RunnersFilter{ServicePort: 80}))
+	assert.Empty(t, runnersController.GetRunners(wrapper.Context, RunnersFilter{
+		StartedAfter: startTime.Add(time.Hour).Unix()}))
+
+	wrapper.Destroy(t)
+}
@@ -0,0 +1,431 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	exploitsExporterSettingsKey    = "exploits_exporter"
+	exploitsExporterStateKey       = "exploits_exporter_state"
+	defaultExportInterval          = 60
+	maxExportedConnectionsPerRound = 100
+	gitCommandTimeout              = 60 * time.Second
+)
+
+var invalidPathChars = regexp.MustCompile(`[^a-z0-9_\-]+`)
+
+var (
+	errRepositoryPathOutside = errors.New("repository_path must be inside the exploits directory")
+	errInvalidRemoteURL      = errors.New("remote_url can't start with -")
+	errInvalidBranch         = errors.New("branch is not a valid branch name")
+)
+
+type ExploitsExporterSettings struct {
+	Enabled        bool     `json:"enabled" bson:"enabled"`
+	RepositoryPath string   `json:"repository_path" binding:"required_if=Enabled true" bson:"repository_path"`
+	RemoteURL      string   `json:"remote_url" bson:"remote_url,omitempty"`
+	Branch         string   `json:"branch" bson:"branch,omitempty"`
+	RulesIDs       []string `json:"rules_ids" binding:"dive,hexadecimal,len=24" bson:"rules_ids"`
+	IncludeMarked  bool     `json:"include_marked" bson:"include_marked"`
+	Interval       uint     `json:"interval" bson:"interval"` // seconds between two exports
+	AuthorName     string   `json:"author_name" bson:"author_name,omitempty"`
+	AuthorEmail    string   `json:"author_email" binding:"omitempty,email" bson:"author_email,omitempty"`
+}
+
+type ExportResult struct {
+	ExportedConnections []RowID   `json:"exported_connections"`
+	Commit              bool      `json:"commit"`
+	Pushed              bool      `json:"pushed"`
+	ExportedAt          time.Time `json:"exported_at"`
+}
+
+type exploitsExporterState struct {
+	LastExportedID RowID     `bson:"last_exported_id"`
+	LastExportAt   time.Time `bson:"last_export_at"`
+	PendingPush    bool      `bson:"pending_push"` // a commit has not been pushed yet
+}
+
+// ExploitsExporter periodically writes the pwntools scripts of the connections matched by the configured rules into
+// a git repository, one directory per service, and pushes them to the team remote.
+type ExploitsExporter struct {
+	storage                     Storage
+	baseDirectory               string // the repositories can be created only in this directory
+	connectionStreamsController ConnectionStreamsController
+	servicesController          *ServicesController
+	notificationController      *NotificationController
+	settings                    ExploitsExporterSettings
+	state                       exploitsExporterState
+	mSettings                   sync.Mutex
+	mExport                     sync.Mutex
+	settingsUpdated             chan bool
+	ctx                         context.Context
+	cancelFunc                  context.CancelFunc
+}
+
+func NewExploitsExporter(storage Storage, baseDirectory string, connectionStreamsController ConnectionStreamsController,
+	servicesController *ServicesController, notificationController *NotificationController) *ExploitsExporter {
+	if absolute, err := filepath.Abs(baseDirectory); err == nil {
+		baseDirectory = absolute
+	}
+	exporter := &ExploitsExporter{
+		storage:                     storage,
+		baseDirectory:               filepath.Clean(baseDirectory),
+		connectionStreamsController: connectionStreamsController,
+		servicesController:          servicesController,
+		notificationController:      notificationController,
+		settings:                    ExploitsExporterSettings{Interval: defaultExportInterval},
+		settingsUpdated:             make(chan bool, 1),
+	}
+	exporter.ctx, exporter.cancelFunc = context.WithCancel(context.Background())
+
+	if err := LoadSettings(storage, exploitsExporterSettingsKey, &exporter.settings); err != nil {
+		log.WithError(err).Panic("failed to retrieve exploits exporter settings")
+	}
+	if err := LoadSettings(storage, exploitsExporterStateKey, &exporter.state); err != nil {
+		log.WithError(err).Panic("failed to retrieve exploits exporter state")
+	}
+
+	return exporter
+}
+
+func (ee *ExploitsExporter) GetSettings() ExploitsExporterSettings {
+	ee.mSettings.Lock()
+	defer ee.mSettings.Unlock()
+
+	return ee.settings
+}
+
+func (ee *ExploitsExporter) SetSettings(settings ExploitsExporterSettings) error {
+	if settings.Interval == 0 {
+		settings.Interval = defaultExportInterval
+	}
+	if settings.RulesIDs == nil {
+		settings.RulesIDs = []string{}
+	}
+	if err := ee.validateSettings(settings); err != nil {
+		return err
+	}
+	if err := SaveSettings(ee.storage, exploitsExporterSettingsKey, settings); err != nil {
+		return err
+	}
+
+	ee.applySettings(settings)
+	return nil
+}
+
+// ReloadSettings reads the settings again from the database, discarding the ones in memory.
+func (ee *ExploitsExporter) ReloadSettings() error {
+	settings := ExploitsExporterSettings{Interval: defaultExportInterval}
+	if err := LoadSettings(ee.storage, exploitsExporterSettingsKey, &settings); err != nil {
+		return err
+	}
+
+	ee.applySettings(settings)
+	return nil
+}
+
+func (ee *ExploitsExporter) applySettings(settings ExploitsExporterSettings) {
+	ee.mSettings.Lock()
+	ee.settings = settings
+	ee.mSettings.Unlock()
+
+	select {
+	case ee.settingsUpdated <- true:
+	default:
+	}
+}
+
+// Run exports the exploits periodically, and returns when the exporter is stopped.
+func (ee *ExploitsExporter) Run() {
+	for {
+		settings := ee.GetSettings()
+		timer := time.NewTimer(time.Duration(settings.Interval) * time.Second)
+
+		select {
+		case <-timer.C:
+			if !settings.Enabled {
+				continue
+			}
+			if _, err := ee.Export(ee.ctx); err != nil {
+				log.WithError(err).Error("failed to export exploits")
+			}
+		case <-ee.settingsUpdated:
+			timer.Stop()
+		case <-ee.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Stop stops the periodic exports and the export running.
+func (ee *ExploitsExporter) Stop() {
+	ee.cancelFunc()
+}
+
+// Export writes the scripts of the connections matched since the last export and commits them to the repository.
+// The exported connections are saved once committed, so if the push fails only the push is retried by the next export.
+func (ee *ExploitsExporter) Export(c context.Context) (ExportResult, error) {
+	ee.mExport.Lock()
+	defer ee.mExport.Unlock()
+
+	settings := ee.GetSettings()
+	result := ExportResult{ExportedConnections: []RowID{}, ExportedAt: time.Now()}
+	if settings.RepositoryPath == "" {
+		return result, errors.New("repository_path is not configured")
+	}
+	// the settings loaded from the database, for example of an imported project, are not validated by SetSettings
+	if err := ee.validateSettings(settings); err != nil {
+		return result, err
+	}
+	if len(settings.RulesIDs) == 0 && !settings.IncludeMarked {
+		return result, nil
+	}
+
+	if err := ee.prepareRepository(c, settings); err != nil {
+		return result, err
+	}
+
+	connections, err := ee.findConnectionsToExport(c, settings)
+	if err != nil {
+		return result, err
+	}
+	if len(connections) == 0 {
+		return result, ee.pushPending(c, settings, &result)
+	}
+
+	services := ee.servicesController.GetServices()
+	for _, connection := range connections {
+		script, found := ee.connectionStreamsController.DownloadConnectionMessages(c, connection.ID,
+			DownloadMessageFormat{Type: "pwntools"})
+		if !found {
+			continue
+		}
+
+		directory := filepath.Join(settings.RepositoryPath, serviceDirectoryName(services, connection.DestinationPort))
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			return result, err
+		}
+		fileName := fmt.Sprintf("%s_%s_%s.py", connection.StartedAt.UTC().Format("20060102-150405"),
+			invalidPathChars.ReplaceAllString(connection.SourceIP, "_"), connection.ID.Hex())
+		header := fmt.Sprintf("# connection %s from %s:%d to %s:%d at %s\n", connection.ID.Hex(),
+			connection.SourceIP, connection.SourcePort, connection.DestinationIP, connection.DestinationPort,
+			connection.StartedAt.UTC().Format(time.RFC3339))
+		if err := ioutil.WriteFile(filepath.Join(directory, fileName), []byte(header+script), 0644); err != nil {
+			return result, err
+		}
+
+		result.ExportedConnections = append(result.ExportedConnections, connection.ID)
+	}
+
+	if len(result.ExportedConnections) > 0 {
+		if _, err := ee.git(c, settings, "add", "--all"); err != nil {
+			return result, err
+		}
+		// the scripts may be already committed if the state was not saved after the last commit
+		status, err := ee.git(c, settings, "status", "--porcelain")
+		if err != nil {
+			return result, err
+		}
+		if strings.TrimSpace(status) != "" {
+			message := fmt.Sprintf("Add %d exploits captured by caronte", len(result.ExportedConnections))
+			if _, err := ee.git(c, settings, "commit", "--quiet", "-m", message); err != nil {
+				return result, err
+			}
+			result.Commit = true
+			ee.state.PendingPush = settings.RemoteURL != ""
+		}
+	}
+
+	ee.state.LastExportedID = connections[len(connections)-1].ID
+	ee.state.LastExportAt = result.ExportedAt
+	ee.saveState()
+
+	if err := ee.pushPending(c, settings, &result); err != nil {
+		return result, err
+	}
+
+	ee.notificationController.Notify("exploits.exported", gin.H{
+		"exported_connections": len(result.ExportedConnections),
+		"pushed":               result.Pushed,
+	})
+
+	return result, nil
+}
+
+// pushPending pushes the commits which have not been pushed yet to the remote, if configured.
+func (ee *ExploitsExporter) pushPending(c context.Context, settings ExploitsExporterSettings,
+	result *ExportResult) error {
+	if !ee.state.PendingPush || settings.RemoteURL == "" {
+		return nil
+	}
+
+	if _, err := ee.git(c, settings, "push", "--quiet", "--", "origin",
+		"HEAD:"+branchOrDefault(settings)); err != nil {
+		return err
+	}
+	result.Pushed = true
+	ee.state.PendingPush = false
+	ee.saveState()
+
+	return nil
+}
+
+func (ee *ExploitsExporter) saveState() {
+	if err := SaveSettings(ee.storage, exploitsExporterStateKey, ee.state); err != nil {
+		log.WithError(err).Error("failed to save exploits exporter state")
+	}
+}
+
+func (ee *ExploitsExporter) findConnectionsToExport(c context.Context, settings ExploitsExporterSettings) ([]Connection,
+	error) {
+	conditions := make([]UnorderedDocument, 0, 2)
+	if len(settings.RulesIDs) > 0 {
+		rulesIDs := make([]RowID, 0, len(settings.RulesIDs))
+		for _, hex := range settings.RulesIDs {
+			if id, err := RowIDFromHex(hex); err == nil {
+				rulesIDs = append(rulesIDs, id)
+			}
+		}
+		conditions = append(conditions, UnorderedDocument{"matched_rules": UnorderedDocument{"$in": rulesIDs}})
+	}
+	if settings.IncludeMarked {
+		conditions = append(conditions, UnorderedDocument{"marked": true})
+	}
+
+	var connections []Connection
+	query := ee.storage.Find(Connections).Context(c).Filter(OrderedDocument{{"$or", conditions}}).
+		Sort("_id", true).Limit(maxExportedConnectionsPerRound)
+	if !ee.state.LastExportedID.IsZero() {
+		query = query.Filter(OrderedDocument{{"_id", UnorderedDocument{"$gt": ee.state.LastExportedID}}})
+	}
+	if err := query.All(&connections); err != nil {
+		return nil, err
+	}
+
+	return connections, nil
+}
+
+// prepareRepository makes sure that RepositoryPath is a git working tree, cloning the remote or initializing an empty
+// repository the first time, and pulls the latest changes from the remote.
+func (ee *ExploitsExporter) prepareRepository(c context.Context, settings ExploitsExporterSettings) error {
+	if _, err := os.Stat(filepath.Join(settings.RepositoryPath, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(settings.RepositoryPath, 0755); err != nil {
+			return err
+		}
+
+		if settings.RemoteURL != "" {
+			if _, err := ee.git(c, settings, "clone", "--quiet", "--", settings.RemoteURL, "."); err != nil {
+				return err
+			}
+		} else if _, err := ee.git(c, settings, "init", "--quiet"); err != nil {
+			return err
+		}
+	}
+
+	if settings.RemoteURL != "" {
+		if _, err := ee.git(c, settings, "pull", "--quiet", "--rebase", "--", "origin",
+			branchOrDefault(settings)); err != nil {
+			log.WithError(err).Warn("failed to pull exploits repository")
+		}
+	}
+
+	return nil
+}
+
+// validateSettings checks that the repository is inside the base directory and that the remote and the branch can't
+// be confused with the options of git.
+func (ee *ExploitsExporter) validateSettings(settings ExploitsExporterSettings) error {
+	if settings.RepositoryPath != "" {
+		relative, err := filepath.Rel(ee.baseDirectory, filepath.Clean(settings.RepositoryPath))
+		if err != nil || !filepath.IsAbs(settings.RepositoryPath) || relative == ".." ||
+			strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return errRepositoryPathOutside
+		}
+	}
+	if strings.HasPrefix(settings.RemoteURL, "-") {
+		return errInvalidRemoteURL
+	}
+	if settings.Branch != "" {
+		if strings.HasPrefix(settings.Branch, "-") {
+			return errInvalidBranch
+		}
+		if err := exec.Command("git", "check-ref-format", "--branch", settings.Branch).Run(); err != nil {
+			return errInvalidBranch
+		}
+	}
+
+	return nil
+}
+
+func (ee *ExploitsExporter) git(c context.Context, settings ExploitsExporterSettings, args ...string) (string,
+	error) {
+	ctx, cancel := context.WithTimeout(c, gitCommandTimeout)
+	defer cancel()
+
+	authorName, authorEmail := settings.AuthorName, settings.AuthorEmail
+	if authorName == "" {
+		authorName = "caronte"
+	}
+	if authorEmail == "" {
+		authorEmail = "caronte@localhost"
+	}
+
+	command := exec.CommandContext(ctx, "git", append([]string{"-c", "user.name=" + authorName,
+		"-c", "user.email=" + authorEmail}, args...)...)
+	command.Dir = settings.RepositoryPath
+	command.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	output, err := command.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(string(output)))
+	}
+
+	return string(output), nil
+}
+
+func serviceDirectoryName(services map[uint16]Service, port uint16) string {
+	if service, isPresent := services[port]; isPresent {
+		if name := strings.Trim(invalidPathChars.ReplaceAllString(strings.ToLower(service.Name), "_"), "_"); name != "" {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("port_%d", port)
+}
+
+func branchOrDefault(settings ExploitsExporterSettings) string {
+	if settings.Branch == "" {
+		return "master"
+	}
+	return settings.Branch
+}
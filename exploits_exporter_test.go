@@ -0,0 +1,166 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportExploits(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+	wrapper.AddCollection(Services)
+	wrapper.AddCollection(Settings)
+
+	repositoryPath, err := ioutil.TempDir("", "caronte-exploits")
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(repositoryPath)
+	}()
+
+	notificationController := NewNotificationController(nil)
+	go notificationController.Run()
+	servicesController := NewServicesController(wrapper.Storage)
+	require.NoError(t, servicesController.SetService(wrapper.Context, Service{Port: 8080, Name: "Web Shop",
+		Color: "#fff"}))
+	exporter := NewExploitsExporter(wrapper.Storage, filepath.Dir(repositoryPath),
+		NewConnectionStreamsController(wrapper.Storage, servicesController), servicesController, notificationController)
+
+	ruleID := NewRowID()
+	matched := Connection{ID: NewRowID(), SourceIP: "10.10.10.100", DestinationIP: "10.10.10.1", SourcePort: 44444,
+		DestinationPort: 8080, StartedAt: time.Unix(1000, 0), ClosedAt: time.Unix(1001, 0), MatchedRules: []RowID{ruleID}}
+	notMatched := Connection{ID: NewRowID(), SourceIP: "10.10.10.101", DestinationIP: "10.10.10.1", SourcePort: 44445,
+		DestinationPort: 8080, StartedAt: time.Unix(1000, 0), ClosedAt: time.Unix(1001, 0), MatchedRules: []RowID{}}
+	_, err = wrapper.Storage.Insert(Connections).Context(wrapper.Context).Many([]interface{}{matched, notMatched})
+	require.NoError(t, err)
+	_, err = wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).One(ConnectionStream{
+		ID:               NewRowID(),
+		ConnectionID:     matched.ID,
+		FromClient:       true,
+		Payload:          []byte("GET /flag\n"),
+		BlocksIndexes:    []int{0},
+		BlocksTimestamps: []time.Time{time.Unix(1000, 0)},
+		BlocksLoss:       []bool{false},
+		PatternMatches:   map[uint][]PatternSlice{},
+	})
+	require.NoError(t, err)
+
+	_, err = exporter.Export(wrapper.Context)
+	assert.Error(t, err) // repository not configured
+
+	require.NoError(t, exporter.SetSettings(ExploitsExporterSettings{
+		Enabled:        true,
+		RepositoryPath: repositoryPath,
+		RulesIDs:       []string{ruleID.Hex()},
+	}))
+
+	result, err := exporter.Export(wrapper.Context)
+	require.NoError(t, err)
+	assert.Equal(t, []RowID{matched.ID}, result.ExportedConnections)
+	assert.True(t, result.Commit)
+	assert.False(t, result.Pushed)
+
+	files, err := filepath.Glob(filepath.Join(repositoryPath, "web_shop", "*.py"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.True(t, strings.HasSuffix(files[0], matched.ID.Hex()+".py"))
+	content, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "p.send('GET /flag\\n')")
+
+	output, err := exec.Command("git", "-C", repositoryPath, "log", "--oneline").CombinedOutput()
+	require.NoError(t, err)
+	assert.Contains(t, string(output), "Add 1 exploits captured by caronte")
+
+	// already exported connections are skipped
+	result, err = exporter.Export(wrapper.Context)
+	require.NoError(t, err)
+	assert.Empty(t, result.ExportedConnections)
+
+	// if the push fails the connections are not exported again, and only the push is retried
+	remotePath, err := ioutil.TempDir("", "caronte-exploits-remote")
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(remotePath)
+	}()
+	require.NoError(t, exporter.SetSettings(ExploitsExporterSettings{
+		Enabled:        true,
+		RepositoryPath: repositoryPath,
+		RemoteURL:      remotePath,
+		RulesIDs:       []string{ruleID.Hex()},
+	}))
+	other := matched
+	other.ID = NewRowID()
+	_, err = wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(other)
+	require.NoError(t, err)
+	result, err = exporter.Export(wrapper.Context)
+	assert.Error(t, err) // the remote doesn't exist
+	assert.True(t, result.Commit)
+	assert.False(t, result.Pushed)
+
+	require.NoError(t, exec.Command("git", "init", "--quiet", "--bare", remotePath).Run())
+	require.NoError(t, exec.Command("git", "-C", repositoryPath, "remote", "add", "origin", remotePath).Run())
+	result, err = exporter.Export(wrapper.Context)
+	require.NoError(t, err)
+	assert.Empty(t, result.ExportedConnections)
+	assert.False(t, result.Commit)
+	assert.True(t, result.Pushed)
+	output, err = exec.Command("git", "-C", remotePath, "log", "--oneline", "master").CombinedOutput()
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(output), "Add 1 exploits captured by caronte"))
+
+	wrapper.Destroy(t)
+}
+
+func TestExploitsExporterSettingsValidation(t *testing.T) {
+	exporter := &ExploitsExporter{baseDirectory: "/var/lib/caronte/exploits"}
+	valid := ExploitsExporterSettings{
+		RepositoryPath: "/var/lib/caronte/exploits/team",
+		RemoteURL:      "git@github.com:team/exploits.git",
+		Branch:         "exploits/caronte",
+	}
+	assert.NoError(t, exporter.validateSettings(valid))
+	assert.NoError(t, exporter.validateSettings(ExploitsExporterSettings{}))
+
+	for _, path := range []string{"/var/lib/caronte/other", "/var/lib/caronte/exploits/../other", "/",
+		"team", "../exploits/team"} {
+		settings := valid
+		settings.RepositoryPath = path
+		assert.Equal(t, errRepositoryPathOutside, exporter.validateSettings(settings), path)
+	}
+
+	settings := valid
+	settings.RemoteURL = "--upload-pack=touch /tmp/pwned"
+	assert.Equal(t, errInvalidRemoteURL, exporter.validateSettings(settings))
+
+	for _, branch := range []string{"--upload-pack=touch", "-f", "a..b", "a b", "a~1", "refs/heads/"} {
+		settings := valid
+		settings.Branch = branch
+		assert.Equal(t, errInvalidBranch, exporter.validateSettings(settings), branch)
+	}
+}
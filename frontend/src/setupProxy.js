@@ -18,7 +18,6 @@
 const {createProxyMiddleware} = require("http-proxy-middleware");
 
 module.exports = function (app) {
-    app.use(createProxyMiddleware("/api", {target: "http://localhost:3333"}));
+    app.use(createProxyMiddleware("/api", {target: "http://localhost:3333", ws: true}));
     app.use(createProxyMiddleware("/setup", {target: "http://localhost:3333"}));
-    app.use(createProxyMiddleware("/ws", {target: "http://localhost:3333", ws: true}));
 };
@@ -0,0 +1,179 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const geoIPSettingsKey = "geoip"
+
+// GeoIPSettings contain the paths of the MaxMind DB files used to enrich the connections, e.g. GeoLite2-Country.mmdb
+// and GeoLite2-ASN.mmdb. Empty paths disable the lookups.
+type GeoIPSettings struct {
+	CountryDatabase string `json:"country_database" binding:"max=4096" bson:"country_database"`
+	ASNDatabase     string `json:"asn_database" binding:"max=4096" bson:"asn_database"`
+}
+
+type IPLocation struct {
+	Country      string `json:"country,omitempty" bson:"country,omitempty"`
+	ASN          uint   `json:"asn,omitempty" bson:"asn,omitempty"`
+	Organization string `json:"organization,omitempty" bson:"organization,omitempty"`
+}
+
+// GeoIP looks up the country and the autonomous system of the endpoints of the connections.
+type GeoIP struct {
+	storage   Storage
+	settings  GeoIPSettings
+	countryDB *mmdbReader
+	asnDB     *mmdbReader
+	mutex     sync.RWMutex
+}
+
+func NewGeoIP(storage Storage) *GeoIP {
+	geoIP := &GeoIP{storage: storage}
+
+	var settings GeoIPSettings
+	if err := LoadSettings(storage, geoIPSettingsKey, &settings); err != nil {
+		log.WithError(err).Panic("failed to retrieve geoip settings")
+	}
+	if err := geoIP.openDatabases(settings); err != nil {
+		log.WithError(err).WithField("settings", settings).Warn("failed to open geoip databases, lookups disabled")
+	}
+
+	return geoIP
+}
+
+func (gi *GeoIP) GetSettings() GeoIPSettings {
+	gi.mutex.RLock()
+	defer gi.mutex.RUnlock()
+
+	return gi.settings
+}
+
+// SetSettings opens the new databases and saves the settings only if they are valid.
+func (gi *GeoIP) SetSettings(settings GeoIPSettings) error {
+	countryDB, asnDB, err := openGeoIPDatabases(settings)
+	if err != nil {
+		return err
+	}
+	if err := SaveSettings(gi.storage, geoIPSettingsKey, settings); err != nil {
+		return err
+	}
+
+	gi.mutex.Lock()
+	gi.settings, gi.countryDB, gi.asnDB = settings, countryDB, asnDB
+	gi.mutex.Unlock()
+
+	return nil
+}
+
+// ReloadSettings reads the settings again from the database and reopens the databases, which may have been updated.
+func (gi *GeoIP) ReloadSettings() error {
+	var settings GeoIPSettings
+	if err := LoadSettings(gi.storage, geoIPSettingsKey, &settings); err != nil {
+		return err
+	}
+
+	return gi.openDatabases(settings)
+}
+
+func (gi *GeoIP) openDatabases(settings GeoIPSettings) error {
+	countryDB, asnDB, err := openGeoIPDatabases(settings)
+	if err != nil {
+		return err
+	}
+
+	gi.mutex.Lock()
+	gi.settings, gi.countryDB, gi.asnDB = settings, countryDB, asnDB
+	gi.mutex.Unlock()
+
+	return nil
+}
+
+func openGeoIPDatabases(settings GeoIPSettings) (countryDB *mmdbReader, asnDB *mmdbReader, err error) {
+	if settings.CountryDatabase != "" {
+		if countryDB, err = openMMDB(settings.CountryDatabase); err != nil {
+			return nil, nil, err
+		}
+	}
+	if settings.ASNDatabase != "" {
+		if asnDB, err = openMMDB(settings.ASNDatabase); err != nil {
+			return nil, nil, err
+		}
+	}
+	return
+}
+
+// Lookup returns the location of address, or nil if it is not contained in the databases. A nil GeoIP has no
+// databases.
+func (gi *GeoIP) Lookup(address string) *IPLocation {
+	if gi == nil {
+		return nil
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil
+	}
+
+	gi.mutex.RLock()
+	countryDB, asnDB := gi.countryDB, gi.asnDB
+	gi.mutex.RUnlock()
+
+	var location IPLocation
+	for _, reader := range []*mmdbReader{countryDB, asnDB} {
+		if reader == nil {
+			continue
+		}
+		record, err := reader.lookup(ip)
+		if err != nil {
+			log.WithError(err).WithField("address", address).Warn("failed to lookup address")
+			continue
+		}
+		fillIPLocation(&location, record)
+	}
+
+	if location == (IPLocation{}) {
+		return nil
+	}
+	return &location
+}
+
+// fillIPLocation reads the fields of the GeoLite2 databases from record. The country is the one where the address is
+// located, or the one where it is registered if not known.
+func fillIPLocation(location *IPLocation, record interface{}) {
+	fields, ok := record.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	for _, countryKey := range []string{"country", "registered_country"} {
+		if country, ok := fields[countryKey].(map[string]interface{}); ok && location.Country == "" {
+			location.Country, _ = country["iso_code"].(string)
+		}
+	}
+	if asn, ok := fields["autonomous_system_number"].(uint64); ok {
+		location.ASN = uint(asn)
+	}
+	if organization, ok := fields["autonomous_system_organization"].(string); ok {
+		location.Organization = organization
+	}
+}
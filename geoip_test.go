@@ -0,0 +1,226 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMMDBPointer is encoded as a pointer to an offset of the data section
+type testMMDBPointer uint
+
+func TestMMDBReader(t *testing.T) {
+	networks := map[string]interface{}{
+		"10.0.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "IT"}},
+		"10.1.0.0/16": map[string]interface{}{
+			"registered_country":             map[string]interface{}{"iso_code": "DE"},
+			"autonomous_system_number":       uint64(3320),
+			"autonomous_system_organization": testMMDBPointer(0),
+		},
+		"2001:db8::/32": map[string]interface{}{"country": map[string]interface{}{"iso_code": "FR"}},
+	}
+
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			reader, err := newMMDBReader(buildTestMMDB(t, ipVersion, recordSize, networks))
+			require.NoError(t, err)
+			assert.Equal(t, "Test-DB", reader.databaseType)
+
+			check := func(address string, expected interface{}) {
+				record, err := reader.lookup(net.ParseIP(address))
+				require.NoError(t, err)
+				assert.Equal(t, expected, record, "%s in v%d/%d", address, ipVersion, recordSize)
+			}
+			check("10.0.255.1", networks["10.0.0.0/16"])
+			check("10.1.2.3", map[string]interface{}{
+				"registered_country":             map[string]interface{}{"iso_code": "DE"},
+				"autonomous_system_number":       uint64(3320),
+				"autonomous_system_organization": "Deutsche Telekom AG",
+			})
+			check("10.2.0.1", nil)
+			check("172.16.0.1", nil)
+			if ipVersion == 6 {
+				check("2001:db8::1", networks["2001:db8::/32"])
+			} else {
+				check("2001:db8::1", nil)
+			}
+		}
+	}
+
+	_, err := newMMDBReader([]byte("not a database"))
+	assert.Error(t, err)
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	directory, err := ioutil.TempDir("", "geoip")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	countryDatabase := filepath.Join(directory, "country.mmdb")
+	require.NoError(t, ioutil.WriteFile(countryDatabase, buildTestMMDB(t, 6, 28, map[string]interface{}{
+		"10.0.0.0/8": map[string]interface{}{"country": map[string]interface{}{"iso_code": "IT"}},
+	}), 0644))
+	asnDatabase := filepath.Join(directory, "asn.mmdb")
+	require.NoError(t, ioutil.WriteFile(asnDatabase, buildTestMMDB(t, 6, 24, map[string]interface{}{
+		"10.10.0.0/16": map[string]interface{}{"autonomous_system_number": uint64(137),
+			"autonomous_system_organization": "GARR"},
+	}), 0644))
+
+	var nilGeoIP *GeoIP
+	assert.Nil(t, nilGeoIP.Lookup("10.10.10.10"))
+
+	geoIP := &GeoIP{}
+	assert.Nil(t, geoIP.Lookup("10.10.10.10"))
+	assert.Error(t, geoIP.openDatabases(GeoIPSettings{CountryDatabase: filepath.Join(directory, "missing.mmdb")}))
+	require.NoError(t, geoIP.openDatabases(GeoIPSettings{CountryDatabase: countryDatabase, ASNDatabase: asnDatabase}))
+
+	assert.Equal(t, &IPLocation{Country: "IT", ASN: 137, Organization: "GARR"}, geoIP.Lookup("10.10.10.10"))
+	assert.Equal(t, &IPLocation{Country: "IT"}, geoIP.Lookup("10.20.10.10"))
+	assert.Nil(t, geoIP.Lookup("192.168.1.1"))
+	assert.Nil(t, geoIP.Lookup("invalid"))
+}
+
+// buildTestMMDB writes a MaxMind DB which contains networks. The networks must not overlap. The data section starts
+// with the string "Deutsche Telekom AG", which can be referenced with testMMDBPointer(0).
+func buildTestMMDB(t *testing.T, ipVersion, recordSize int, networks map[string]interface{}) []byte {
+	type record struct {
+		node, data int
+	}
+	nodes := [][2]record{{{-1, -1}, {-1, -1}}}
+
+	data := new(bytes.Buffer)
+	encodeTestMMDBValue(t, data, "Deutsche Telekom AG")
+	cidrs := make([]string, 0, len(networks))
+	for cidr := range networks {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		ones, _ := network.Mask.Size()
+		ip := network.IP
+		if ipVersion == 6 {
+			if ip.To4() != nil {
+				ip = append(make(net.IP, 12), ip.To4()...)
+				ones += 96
+			}
+		} else if ip.To4() == nil {
+			continue
+		}
+
+		dataOffset := data.Len()
+		encodeTestMMDBValue(t, data, networks[cidr])
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node][bit] = record{-1, dataOffset}
+			} else if nodes[node][bit].node >= 0 {
+				node = nodes[node][bit].node
+			} else {
+				nodes = append(nodes, [2]record{{-1, -1}, {-1, -1}})
+				nodes[node][bit] = record{len(nodes) - 1, -1}
+				node = len(nodes) - 1
+			}
+		}
+	}
+
+	nodeCount := len(nodes)
+	buffer := new(bytes.Buffer)
+	for _, node := range nodes {
+		var values [2]uint32
+		for i, record := range node {
+			if record.node >= 0 {
+				values[i] = uint32(record.node)
+			} else if record.data >= 0 {
+				values[i] = uint32(nodeCount + 16 + record.data)
+			} else {
+				values[i] = uint32(nodeCount)
+			}
+		}
+		switch recordSize {
+		case 24:
+			buffer.Write([]byte{byte(values[0] >> 16), byte(values[0] >> 8), byte(values[0]),
+				byte(values[1] >> 16), byte(values[1] >> 8), byte(values[1])})
+		case 28:
+			buffer.Write([]byte{byte(values[0] >> 16), byte(values[0] >> 8), byte(values[0]),
+				byte(values[0]>>24)<<4 | byte(values[1]>>24), byte(values[1] >> 16), byte(values[1] >> 8),
+				byte(values[1])})
+		default:
+			require.NoError(t, binary.Write(buffer, binary.BigEndian, values))
+		}
+	}
+	buffer.Write(make([]byte, 16))
+	buffer.Write(data.Bytes())
+	buffer.Write(mmdbMetadataMarker)
+	encodeTestMMDBValue(t, buffer, map[string]interface{}{
+		"node_count":    uint64(nodeCount),
+		"record_size":   uint64(recordSize),
+		"ip_version":    uint64(ipVersion),
+		"database_type": "Test-DB",
+	})
+
+	return buffer.Bytes()
+}
+
+func encodeTestMMDBValue(t *testing.T, buffer *bytes.Buffer, value interface{}) {
+	writeControl := func(fieldType byte, size int) {
+		require.Less(t, size, 285)
+		if size < 29 {
+			buffer.WriteByte(fieldType<<5 | byte(size))
+		} else {
+			buffer.Write([]byte{fieldType<<5 | 29, byte(size - 29)})
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		writeControl(mmdbString, len(v))
+		buffer.WriteString(v)
+	case uint64:
+		writeControl(mmdbUint32, 4)
+		require.NoError(t, binary.Write(buffer, binary.BigEndian, uint32(v)))
+	case testMMDBPointer:
+		buffer.Write([]byte{mmdbPointer<<5 | byte(v>>8)&0x7, byte(v)})
+	case map[string]interface{}:
+		writeControl(mmdbMap, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			encodeTestMMDBValue(t, buffer, key)
+			encodeTestMMDBValue(t, buffer, v[key])
+		}
+	default:
+		require.FailNow(t, fmt.Sprintf("unsupported type %T", value))
+	}
+}
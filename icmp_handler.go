@@ -0,0 +1,373 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolICMP = "icmp"
+)
+
+// icmpConnectionIdle is the time after the last echo message of a pseudo-connection when it is saved, measured on the
+// timestamps of the packets. The idle pseudo-connections are checked at most once per icmpExpirationInterval.
+const icmpConnectionIdle = time.Minute
+const icmpExpirationInterval = 10 * time.Second
+
+// icmpEcho is an echo request or an echo reply, of both ICMPv4 and ICMPv6.
+type icmpEcho struct {
+	netFlow    gopacket.Flow
+	identifier uint16
+	isRequest  bool
+	payload    []byte
+	timestamp  time.Time
+}
+
+// icmpFlow identifies a pseudo-connection, which groups the echo requests sent by the requester to the responder with
+// the same identifier and their replies.
+type icmpFlow struct {
+	requester  string
+	responder  string
+	identifier uint16
+	sensor     string
+}
+
+type icmpConnection struct {
+	flow            icmpFlow
+	requests        icmpPayloads
+	replies         icmpPayloads
+	firstPacketSeen time.Time
+	lastPacketSeen  time.Time
+}
+
+// icmpPayloads are the payloads of the echo messages of a direction, concatenated as the blocks of a tcp stream.
+type icmpPayloads struct {
+	payload      []byte
+	indexes      []int
+	timestamps   []time.Time
+	droppedBytes int
+}
+
+// ICMPHandler groups the echo requests and replies in pseudo-connections, so that the tunnels over ICMP are stored
+// and matched by the rules as the tcp connections. The requester is the client and the responder is the server.
+type ICMPHandler struct {
+	factory        *BiDirectionalStreamFactory
+	connections    map[icmpFlow]*icmpConnection
+	lastExpiration time.Time
+	mConnections   sync.Mutex
+}
+
+func NewICMPHandler(factory *BiDirectionalStreamFactory) *ICMPHandler {
+	return &ICMPHandler{
+		factory:      factory,
+		connections:  make(map[icmpFlow]*icmpConnection),
+		mConnections: sync.Mutex{},
+	}
+}
+
+// parseICMPEcho returns the echo message contained in the packet, if any.
+func parseICMPEcho(packet gopacket.Packet) (icmpEcho, bool) {
+	if packet.NetworkLayer() == nil {
+		return icmpEcho{}, false
+	}
+	echo := icmpEcho{
+		netFlow:   packet.NetworkLayer().NetworkFlow(),
+		timestamp: packet.Metadata().Timestamp,
+	}
+
+	if icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+		switch icmp.TypeCode.Type() {
+		case layers.ICMPv4TypeEchoRequest:
+			echo.isRequest = true
+		case layers.ICMPv4TypeEchoReply:
+		default:
+			return icmpEcho{}, false
+		}
+		echo.identifier = icmp.Id
+		echo.payload = icmp.Payload
+		return echo, true
+	}
+
+	icmp, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+	if !ok {
+		return icmpEcho{}, false
+	}
+	message, ok := packet.Layer(layers.LayerTypeICMPv6Echo).(*layers.ICMPv6Echo)
+	if !ok {
+		return icmpEcho{}, false
+	}
+	switch icmp.TypeCode.Type() {
+	case layers.ICMPv6TypeEchoRequest:
+		echo.isRequest = true
+	case layers.ICMPv6TypeEchoReply:
+	default:
+		return icmpEcho{}, false
+	}
+	echo.identifier = message.Identifier
+	echo.payload = icmp.Payload[4:] // the echo layer does not keep its payload, which follows identifier and sequence
+	return echo, true
+}
+
+// Handle adds the echo message to its pseudo-connection, and saves the pseudo-connections idle since
+// icmpConnectionIdle before the message. The messages are discarded if the handler is nil.
+func (handler *ICMPHandler) Handle(echo icmpEcho, sensor string) {
+	if handler == nil {
+		return
+	}
+	flow := icmpFlow{
+		requester:  echo.netFlow.Src().String(),
+		responder:  echo.netFlow.Dst().String(),
+		identifier: echo.identifier,
+		sensor:     sensor,
+	}
+	if !echo.isRequest {
+		flow.requester, flow.responder = flow.responder, flow.requester
+	}
+
+	handler.mConnections.Lock()
+	connection, isPresent := handler.connections[flow]
+	if !isPresent {
+		connection = &icmpConnection{
+			flow:            flow,
+			firstPacketSeen: echo.timestamp,
+		}
+		handler.connections[flow] = connection
+	}
+	if echo.timestamp.After(connection.lastPacketSeen) {
+		connection.lastPacketSeen = echo.timestamp
+	}
+	if echo.isRequest {
+		connection.requests.append(echo.payload, echo.timestamp)
+	} else {
+		connection.replies.append(echo.payload, echo.timestamp)
+	}
+
+	var expired []*icmpConnection
+	if echo.timestamp.Sub(handler.lastExpiration) > icmpExpirationInterval {
+		handler.lastExpiration = echo.timestamp
+		expired = handler.takeConnections(echo.timestamp.Add(-icmpConnectionIdle))
+	}
+	handler.mConnections.Unlock()
+
+	for _, connection := range expired {
+		handler.complete(connection)
+	}
+}
+
+// Flush saves the pseudo-connections without echo messages after olderThan, or all the pseudo-connections if closeAll
+// is true, and returns the number of pseudo-connections saved.
+func (handler *ICMPHandler) Flush(olderThan time.Time, closeAll bool) int {
+	if handler == nil {
+		return 0
+	}
+	handler.mConnections.Lock()
+	if closeAll {
+		olderThan = time.Time{}
+	}
+	expired := handler.takeConnections(olderThan)
+	handler.mConnections.Unlock()
+
+	for _, connection := range expired {
+		handler.complete(connection)
+	}
+	return len(expired)
+}
+
+// takeConnections removes the pseudo-connections idle before olderThan, or all if olderThan is the zero time. It must
+// be called with mConnections locked.
+func (handler *ICMPHandler) takeConnections(olderThan time.Time) []*icmpConnection {
+	var expired []*icmpConnection
+	for flow, connection := range handler.connections {
+		if olderThan.IsZero() || connection.lastPacketSeen.Before(olderThan) {
+			expired = append(expired, connection)
+			delete(handler.connections, flow)
+		}
+	}
+	return expired
+}
+
+func (payloads *icmpPayloads) append(payload []byte, timestamp time.Time) {
+	if len(payloads.payload)+len(payload) > MaxDocumentSize {
+		payloads.droppedBytes += len(payload)
+		return
+	}
+	payloads.indexes = append(payloads.indexes, len(payloads.payload))
+	payloads.timestamps = append(payloads.timestamps, timestamp)
+	payloads.payload = append(payloads.payload, payload...) // the packet data could be reused, so it is copied
+}
+
+func (payloads icmpPayloads) preview() *StreamPreview {
+	prefix, firstBlockSize := payloads.payload, len(payloads.payload)
+	if len(prefix) > detectionPrefixSize {
+		prefix = prefix[:detectionPrefixSize]
+	}
+	if len(payloads.indexes) > 1 {
+		firstBlockSize = payloads.indexes[1]
+	}
+	if len(prefix) == 0 || isTextual(prefix) {
+		return nil
+	}
+	return buildStreamPreview(prefix, firstBlockSize, extractPrintableStrings(payloads.payload, nil))
+}
+
+// complete runs the rules on the payloads of the pseudo-connection and saves it with its streams.
+func (handler *ICMPHandler) complete(connection *icmpConnection) {
+	hash := connection.flow.hash()
+	connectionID := CustomRowID(hash, connection.firstPacketSeen)
+	requestsMatches := handler.scan(connection.requests.payload)
+	repliesMatches := handler.scan(connection.replies.payload)
+
+	result := Connection{
+		ID:             connectionID,
+		SourceIP:       connection.flow.requester,
+		SourceIPBytes:  ipBytes(connection.flow.requester),
+		DestinationIP:  connection.flow.responder,
+		SourcePort:     connection.flow.identifier,
+		StartedAt:      connection.firstPacketSeen,
+		ClosedAt:       connection.lastPacketSeen,
+		StartedAtNanos: connection.firstPacketSeen.UnixNano(),
+		ClosedAtNanos:  connection.lastPacketSeen.UnixNano(),
+		ClientBytes:    len(connection.requests.payload) + connection.requests.droppedBytes,
+		ServerBytes:    len(connection.replies.payload) + connection.replies.droppedBytes,
+		ProcessedAt:    time.Now(),
+		ClientLocation: handler.factory.geoIP.Lookup(connection.flow.requester),
+		ServerLocation: handler.factory.geoIP.Lookup(connection.flow.responder),
+		ClientPreview:  connection.requests.preview(),
+		ServerPreview:  connection.replies.preview(),
+		Truncated:      connection.requests.droppedBytes > 0 || connection.replies.droppedBytes > 0,
+		Sensor:         connection.flow.sensor,
+		Protocol:       ProtocolICMP,
+	}
+	handler.factory.rulesManager.FillWithMatchedRules(&result, requestsMatches, repliesMatches)
+	redactedPatterns := handler.factory.rulesManager.RedactedPatterns(result.MatchedRules)
+
+	streams := []struct {
+		payloads   icmpPayloads
+		matches    map[uint][]PatternSlice
+		fromClient bool
+		direction  uint8
+	}{
+		{connection.requests, requestsMatches, true, DirectionToClient},
+		{connection.replies, repliesMatches, false, DirectionToServer},
+	}
+	for i, stream := range streams {
+		if len(stream.payloads.payload) == 0 {
+			continue
+		}
+		for id, excludedDirection := range redactedPatterns {
+			if excludedDirection != stream.direction {
+				redactPayload(stream.payloads.payload, 0, stream.matches[id])
+			}
+		}
+
+		streamID := CustomRowID(hash&uint64(0xffffffffffffff00)|uint64(i), connection.firstPacketSeen)
+		if _, err := handler.factory.storage.Insert(ConnectionStreams).One(ConnectionStream{
+			ID:               streamID,
+			ConnectionID:     connectionID,
+			FromClient:       stream.fromClient,
+			Payload:          stream.payloads.payload,
+			PayloadString:    strings.ToValidUTF8(string(stream.payloads.payload), ""),
+			BlocksIndexes:    stream.payloads.indexes,
+			BlocksTimestamps: stream.payloads.timestamps,
+			BlocksLoss:       make([]bool, len(stream.payloads.indexes)),
+			PatternMatches:   stream.matches,
+		}); err != nil {
+			log.WithError(err).WithField("connection", connectionID).Error("failed to insert an icmp stream")
+			continue
+		}
+		if stream.fromClient {
+			result.ClientDocuments++
+		} else {
+			result.ServerDocuments++
+		}
+	}
+
+	if _, err := handler.factory.storage.Insert(Connections).One(result); err != nil {
+		log.WithError(err).WithField("connection", result).Error("failed to insert an icmp connection")
+		return
+	}
+	handler.factory.connectionSaved(result)
+}
+
+// scan returns the matches of the patterns of the rules in the payload. The icmp pseudo-connections use the database
+// of the rules not scoped to a service, and the decode layers are not applied.
+func (handler *ICMPHandler) scan(payload []byte) map[uint][]PatternSlice {
+	matches := make(map[uint][]PatternSlice)
+	if len(payload) == 0 {
+		return matches
+	}
+
+	handler.factory.mRulesDatabase.Lock()
+	database, version := handler.factory.rulesDatabase.streamDatabase(0), handler.factory.rulesDatabase.version
+	handler.factory.mRulesDatabase.Unlock()
+	if database == nil {
+		return matches
+	}
+
+	scanner := handler.factory.takeScanner()
+	if scanner.version != version {
+		if err := scanner.scratch.Realloc(database); err != nil {
+			log.WithError(err).Error("failed to realloc the scratch for the icmp payloads")
+			handler.factory.releaseScanner(scanner)
+			return matches
+		}
+	}
+
+	onMatch := func(id uint, from uint64, to uint64, _ uint, _ interface{}) error {
+		if patternSlices := matches[id]; len(patternSlices) > 0 && patternSlices[len(patternSlices)-1][0] == from {
+			patternSlices[len(patternSlices)-1][1] = to // make the regex greedy
+		} else {
+			matches[id] = append(patternSlices, PatternSlice{from, to})
+		}
+		return nil
+	}
+	startedAt := time.Now()
+	stream, err := database.Open(0, scanner.scratch, onMatch, nil)
+	if err == nil {
+		if err = stream.Scan(payload); err == nil {
+			err = stream.Close()
+		} else {
+			_ = stream.Close()
+		}
+	}
+	scanner.scannedBytes += int64(len(payload))
+	scanner.scanTime += time.Since(startedAt)
+	handler.factory.releaseScanner(scanner)
+	if err != nil {
+		log.WithError(err).Error("failed to scan the icmp payloads")
+	}
+
+	return matches
+}
+
+func (flow icmpFlow) hash() uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(strings.Join([]string{ProtocolICMP, flow.requester, flow.responder,
+		strconv.Itoa(int(flow.identifier)), flow.sensor}, "|")))
+	return hash.Sum64()
+}
@@ -0,0 +1,123 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseICMPEcho(t *testing.T) {
+	timestamp := time.Unix(1600000000, 0)
+	ipv4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4,
+		SrcIP: net.ParseIP("10.10.0.1").To4(), DstIP: net.ParseIP("10.0.0.1").To4()}
+
+	packet := serializeICMPPacket(t, timestamp, ipv4,
+		&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 42, Seq: 1},
+		gopacket.Payload("flag{tunnel}"))
+	echo, isEcho := parseICMPEcho(packet)
+	require.True(t, isEcho)
+	assert.True(t, echo.isRequest)
+	assert.EqualValues(t, 42, echo.identifier)
+	assert.Equal(t, []byte("flag{tunnel}"), echo.payload)
+	assert.Equal(t, "10.10.0.1", echo.netFlow.Src().String())
+	assert.Equal(t, timestamp, echo.timestamp)
+
+	packet = serializeICMPPacket(t, timestamp, ipv4,
+		&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0), Id: 42, Seq: 1},
+		gopacket.Payload("pong"))
+	echo, isEcho = parseICMPEcho(packet)
+	require.True(t, isEcho)
+	assert.False(t, echo.isRequest)
+
+	packet = serializeICMPPacket(t, timestamp, ipv4,
+		&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, 3)},
+		gopacket.Payload("unreachable"))
+	_, isEcho = parseICMPEcho(packet)
+	assert.False(t, isEcho)
+
+	ipv6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolICMPv6,
+		SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2")}
+	icmpv6 := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoReply, 0)}
+	require.NoError(t, icmpv6.SetNetworkLayerForChecksum(ipv6))
+	packet = serializeICMPPacket(t, timestamp, ipv6, icmpv6, &layers.ICMPv6Echo{Identifier: 7, SeqNumber: 2},
+		gopacket.Payload("flag{v6}"))
+	echo, isEcho = parseICMPEcho(packet)
+	require.True(t, isEcho)
+	assert.False(t, echo.isRequest)
+	assert.EqualValues(t, 7, echo.identifier)
+	assert.Equal(t, []byte("flag{v6}"), echo.payload)
+}
+
+func TestICMPPseudoConnections(t *testing.T) {
+	handler := NewICMPHandler(nil)
+	requester, responder := net.ParseIP("10.10.0.1").To4(), net.ParseIP("10.0.0.1").To4()
+	requestFlow := gopacket.NewFlow(layers.EndpointIPv4, requester, responder)
+	timestamp := time.Unix(1600000000, 0)
+
+	handler.lastExpiration = timestamp // the pseudo-connections are not saved before icmpExpirationInterval
+	handler.Handle(icmpEcho{requestFlow, 1, true, []byte("ping"), timestamp}, "")
+	handler.Handle(icmpEcho{requestFlow.Reverse(), 1, false, []byte("pong"), timestamp.Add(time.Second)}, "")
+	handler.Handle(icmpEcho{requestFlow, 1, true, []byte("again"), timestamp.Add(2 * time.Second)}, "")
+	handler.Handle(icmpEcho{requestFlow, 2, true, []byte("other"), timestamp}, "")
+
+	connection := handler.connections[icmpFlow{"10.10.0.1", "10.0.0.1", 1, ""}]
+	require.NotNil(t, connection)
+	assert.Equal(t, []byte("pingagain"), connection.requests.payload)
+	assert.Equal(t, []int{0, 4}, connection.requests.indexes)
+	assert.Equal(t, []byte("pong"), connection.replies.payload)
+	assert.Equal(t, timestamp, connection.firstPacketSeen)
+	assert.Equal(t, timestamp.Add(2*time.Second), connection.lastPacketSeen)
+	assert.Len(t, handler.connections, 2)
+
+	handler.mConnections.Lock()
+	expired := handler.takeConnections(timestamp.Add(time.Second))
+	handler.mConnections.Unlock()
+	require.Len(t, expired, 1)
+	assert.EqualValues(t, 2, expired[0].flow.identifier)
+	assert.Len(t, handler.connections, 1)
+
+	var payloads icmpPayloads
+	payloads.append(make([]byte, MaxDocumentSize), timestamp)
+	payloads.append([]byte("dropped"), timestamp)
+	assert.Equal(t, 7, payloads.droppedBytes)
+	assert.Len(t, payloads.indexes, 1)
+
+	assert.NotEqual(t, icmpFlow{"a", "b", 1, ""}.hash(), icmpFlow{"a", "b", 2, ""}.hash())
+}
+
+func serializeICMPPacket(t *testing.T, timestamp time.Time,
+	serializableLayers ...gopacket.SerializableLayer) gopacket.Packet {
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buffer, options, serializableLayers...))
+
+	var firstLayer gopacket.Decoder = layers.LayerTypeIPv4
+	if _, isIPv6 := serializableLayers[0].(*layers.IPv6); isIPv6 {
+		firstLayer = layers.LayerTypeIPv6
+	}
+	packet := gopacket.NewPacket(buffer.Bytes(), firstLayer, gopacket.Default)
+	packet.Metadata().Timestamp = timestamp
+	return packet
+}
@@ -0,0 +1,197 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const ingestionFiltersSettingsKey = "ingestion_filters"
+
+// IngestionFiltersSettings select the traffic which is imported. The packets of the services in DeniedPorts, or of
+// the clients in DeniedNetworks, are discarded before being processed, so nothing is stored about them. If
+// AllowedPorts or AllowedNetworks are not empty, only the packets of the listed services or clients are imported.
+type IngestionFiltersSettings struct {
+	AllowedPorts    []uint16 `json:"allowed_ports" binding:"dive,min=1" bson:"allowed_ports"`
+	DeniedPorts     []uint16 `json:"denied_ports" binding:"dive,min=1" bson:"denied_ports"`
+	AllowedNetworks []string `json:"allowed_networks" binding:"dive,cidr" bson:"allowed_networks"`
+	DeniedNetworks  []string `json:"denied_networks" binding:"dive,cidr" bson:"denied_networks"`
+}
+
+type IngestionFilters struct {
+	storage  Storage
+	settings IngestionFiltersSettings
+	filter   *ingestionFilter
+	mutex    sync.Mutex
+}
+
+// ingestionFilter is the compiled form of the settings, used for each packet.
+type ingestionFilter struct {
+	allowedPorts    map[uint16]bool
+	deniedPorts     map[uint16]bool
+	allowedNetworks []*net.IPNet
+	deniedNetworks  []*net.IPNet
+}
+
+func NewIngestionFilters(storage Storage) *IngestionFilters {
+	filters := &IngestionFilters{
+		storage: storage,
+	}
+
+	if err := LoadSettings(storage, ingestionFiltersSettingsKey, &filters.settings); err != nil {
+		log.WithError(err).Panic("failed to retrieve ingestion filters settings")
+	}
+	filter, err := compileIngestionFilter(filters.settings)
+	if err != nil {
+		log.WithError(err).Panic("failed to compile the ingestion filters")
+	}
+	filters.filter = filter
+
+	return filters
+}
+
+func (filters *IngestionFilters) GetSettings() IngestionFiltersSettings {
+	filters.mutex.Lock()
+	defer filters.mutex.Unlock()
+
+	return filters.settings
+}
+
+func (filters *IngestionFilters) SetSettings(settings IngestionFiltersSettings) error {
+	if _, err := compileIngestionFilter(settings); err != nil {
+		return err
+	}
+	if err := SaveSettings(filters.storage, ingestionFiltersSettingsKey, settings); err != nil {
+		return err
+	}
+
+	return filters.apply(settings)
+}
+
+// ReloadSettings reads the settings again from the database, discarding the ones in memory.
+func (filters *IngestionFilters) ReloadSettings() error {
+	var settings IngestionFiltersSettings
+	if err := LoadSettings(filters.storage, ingestionFiltersSettingsKey, &settings); err != nil {
+		return err
+	}
+
+	return filters.apply(settings)
+}
+
+func (filters *IngestionFilters) apply(settings IngestionFiltersSettings) error {
+	filter, err := compileIngestionFilter(settings)
+	if err != nil {
+		return err
+	}
+
+	filters.mutex.Lock()
+	filters.settings = settings
+	filters.filter = filter
+	filters.mutex.Unlock()
+
+	return nil
+}
+
+// currentFilter returns the filter currently in use, or nil if filters is nil. The filter can be kept while importing a
+// pcap, the changes of the settings are applied to the next pcaps.
+func (filters *IngestionFilters) currentFilter() *ingestionFilter {
+	if filters == nil {
+		return nil
+	}
+
+	filters.mutex.Lock()
+	defer filters.mutex.Unlock()
+
+	return filters.filter
+}
+
+func compileIngestionFilter(settings IngestionFiltersSettings) (*ingestionFilter, error) {
+	filter := &ingestionFilter{
+		allowedPorts: make(map[uint16]bool, len(settings.AllowedPorts)),
+		deniedPorts:  make(map[uint16]bool, len(settings.DeniedPorts)),
+	}
+	for _, port := range settings.AllowedPorts {
+		filter.allowedPorts[port] = true
+	}
+	for _, port := range settings.DeniedPorts {
+		filter.deniedPorts[port] = true
+	}
+
+	var err error
+	if filter.allowedNetworks, err = parseNetworks(settings.AllowedNetworks); err != nil {
+		return nil, err
+	}
+	if filter.deniedNetworks, err = parseNetworks(settings.DeniedNetworks); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// denies reports whether the packets exchanged by the client with the service are discarded. A nil filter does not
+// deny anything.
+func (filter *ingestionFilter) denies(client net.IP, servicePort uint16) bool {
+	if filter == nil {
+		return false
+	}
+	if filter.deniedPorts[servicePort] || containsIP(filter.deniedNetworks, client) {
+		return true
+	}
+	if len(filter.allowedPorts) > 0 && !filter.allowedPorts[servicePort] {
+		return true
+	}
+	if len(filter.allowedNetworks) > 0 && !containsIP(filter.allowedNetworks, client) {
+		return true
+	}
+	return false
+}
+
+// deniesAddress reports if the packets of the client are discarded regardless of the port, as the icmp messages.
+func (filter *ingestionFilter) deniesAddress(client net.IP) bool {
+	if filter == nil {
+		return false
+	}
+	if containsIP(filter.deniedNetworks, client) {
+		return true
+	}
+	return len(filter.allowedNetworks) > 0 && !containsIP(filter.allowedNetworks, client)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngestionFilterDenies(t *testing.T) {
+	var nilFilter *ingestionFilter
+	assert.False(t, nilFilter.denies(net.ParseIP("10.0.0.1"), 22))
+	assert.Nil(t, (*IngestionFilters)(nil).currentFilter())
+
+	filter, err := compileIngestionFilter(IngestionFiltersSettings{
+		DeniedPorts:    []uint16{22},
+		DeniedNetworks: []string{"10.60.0.0/16"},
+	})
+	require.NoError(t, err)
+	assert.True(t, filter.denies(net.ParseIP("10.0.0.1"), 22))
+	assert.True(t, filter.denies(net.ParseIP("10.60.3.4"), 80))
+	assert.False(t, filter.denies(net.ParseIP("10.0.0.1"), 80))
+
+	filter, err = compileIngestionFilter(IngestionFiltersSettings{
+		AllowedPorts:    []uint16{80, 8080},
+		AllowedNetworks: []string{"10.0.0.0/8", "fd00::/8"},
+		DeniedNetworks:  []string{"10.60.0.0/16"},
+	})
+	require.NoError(t, err)
+	assert.False(t, filter.denies(net.ParseIP("10.0.0.1"), 8080))
+	assert.False(t, filter.denies(net.ParseIP("fd00::1"), 80))
+	assert.True(t, filter.denies(net.ParseIP("10.0.0.1"), 443))
+	assert.True(t, filter.denies(net.ParseIP("192.168.0.1"), 80))
+	assert.True(t, filter.denies(net.ParseIP("10.60.0.1"), 80))
+
+	_, err = compileIngestionFilter(IngestionFiltersSettings{DeniedNetworks: []string{"10.0.0.0"}})
+	assert.Error(t, err)
+}
+
+func TestIngestionFiltersSettings(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Settings)
+
+	filters := NewIngestionFilters(wrapper.Storage)
+	assert.False(t, filters.currentFilter().denies(net.ParseIP("10.0.0.1"), 22))
+
+	settings := IngestionFiltersSettings{DeniedPorts: []uint16{22}}
+	require.NoError(t, filters.SetSettings(settings))
+	assert.Equal(t, settings, filters.GetSettings())
+	assert.True(t, filters.currentFilter().denies(net.ParseIP("10.0.0.1"), 22))
+	assert.Error(t, filters.SetSettings(IngestionFiltersSettings{AllowedNetworks: []string{"invalid"}}))
+
+	reloaded := NewIngestionFilters(wrapper.Storage)
+	assert.Equal(t, settings, reloaded.GetSettings())
+	assert.True(t, reloaded.currentFilter().denies(net.ParseIP("10.0.0.1"), 22))
+
+	wrapper.Destroy(t)
+}
@@ -0,0 +1,167 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const lagWatchdogSettingsKey = "lag_watchdog"
+const lagCheckInterval = 10 * time.Second
+
+// LagWatchdogSettings contain the maximum lag, in seconds, between the wall clock and the most recent packet imported
+// before the clients are alerted. Zero disables the watchdog.
+type LagWatchdogSettings struct {
+	MaxLag int `json:"max_lag" binding:"min=0" bson:"max_lag"`
+}
+
+type IngestionStatus struct {
+	Lagging      bool      `json:"lagging"`
+	Lag          int64     `json:"lag"`
+	NewestPacket time.Time `json:"newest_packet"`
+	LastCheck    time.Time `json:"last_check"`
+	LaggingSince time.Time `json:"lagging_since,omitempty"`
+}
+
+// LagWatchdog periodically compares the timestamp of the most recent packet imported with the wall clock and notifies
+// the clients when the ingestion falls behind more than the maximum lag, and when it catches up. The lag is not
+// checked until the first packet is imported.
+type LagWatchdog struct {
+	storage                Storage
+	pcapImporter           *PcapImporter
+	notificationController *NotificationController
+	settings               LagWatchdogSettings
+	status                 IngestionStatus
+	mutex                  sync.Mutex
+	stop                   chan struct{}
+	stopOnce               sync.Once
+}
+
+func NewLagWatchdog(storage Storage, pcapImporter *PcapImporter,
+	notificationController *NotificationController) *LagWatchdog {
+	watchdog := &LagWatchdog{
+		storage:                storage,
+		pcapImporter:           pcapImporter,
+		notificationController: notificationController,
+		stop:                   make(chan struct{}),
+	}
+
+	if err := LoadSettings(storage, lagWatchdogSettingsKey, &watchdog.settings); err != nil {
+		log.WithError(err).Panic("failed to retrieve lag watchdog settings")
+	}
+
+	return watchdog
+}
+
+func (lw *LagWatchdog) GetSettings() LagWatchdogSettings {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+
+	return lw.settings
+}
+
+func (lw *LagWatchdog) SetSettings(settings LagWatchdogSettings) error {
+	if err := SaveSettings(lw.storage, lagWatchdogSettingsKey, settings); err != nil {
+		return err
+	}
+
+	lw.mutex.Lock()
+	lw.settings = settings
+	lw.mutex.Unlock()
+
+	return nil
+}
+
+// ReloadSettings reads the settings again from the database, discarding the ones in memory.
+func (lw *LagWatchdog) ReloadSettings() error {
+	var settings LagWatchdogSettings
+	if err := LoadSettings(lw.storage, lagWatchdogSettingsKey, &settings); err != nil {
+		return err
+	}
+
+	lw.mutex.Lock()
+	lw.settings = settings
+	lw.mutex.Unlock()
+
+	return nil
+}
+
+func (lw *LagWatchdog) GetStatus() IngestionStatus {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+
+	return lw.status
+}
+
+// Run checks the lag periodically, and returns when the watchdog is stopped.
+func (lw *LagWatchdog) Run() {
+	for {
+		lw.Check()
+
+		select {
+		case <-time.After(lagCheckInterval):
+		case <-lw.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the periodic checks.
+func (lw *LagWatchdog) Stop() {
+	lw.stopOnce.Do(func() {
+		close(lw.stop)
+	})
+}
+
+func (lw *LagWatchdog) Check() {
+	newestPacket := lw.pcapImporter.NewestPacket()
+	now := time.Now()
+
+	lw.mutex.Lock()
+	wasLagging := lw.status.Lagging
+	lw.status.LastCheck = now
+	lw.status.NewestPacket = newestPacket
+	if newestPacket.IsZero() {
+		lw.status.Lag = 0
+	} else {
+		lw.status.Lag = now.Sub(newestPacket).Milliseconds()
+	}
+	maxLag := time.Duration(lw.settings.MaxLag) * time.Second
+	if maxLag > 0 && !newestPacket.IsZero() && now.Sub(newestPacket) > maxLag {
+		if !wasLagging {
+			lw.status.Lagging = true
+			lw.status.LaggingSince = now
+		}
+	} else {
+		lw.status.Lagging = false
+		lw.status.LaggingSince = time.Time{}
+	}
+	status := lw.status
+	lw.mutex.Unlock()
+
+	if !wasLagging && status.Lagging {
+		log.WithField("lag", status.Lag).Warn("ingestion is lagging behind")
+		lw.notificationController.Notify("ingestion.lagging", status)
+	} else if wasLagging && !status.Lagging {
+		log.Info("ingestion caught up")
+		lw.notificationController.Notify("ingestion.recovered", status)
+	}
+}
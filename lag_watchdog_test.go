@@ -0,0 +1,79 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLagWatchdog(t *testing.T) {
+	pcapImporter := &PcapImporter{}
+	watchdog := &LagWatchdog{pcapImporter: pcapImporter, settings: LagWatchdogSettings{MaxLag: 60}}
+
+	// no packets imported yet
+	watchdog.Check()
+	assert.False(t, watchdog.GetStatus().Lagging)
+	assert.Zero(t, watchdog.GetStatus().NewestPacket)
+
+	newestPacket := time.Now().Add(-30 * time.Minute)
+	pcapImporter.updateNewestPacket(newestPacket)
+	pcapImporter.updateNewestPacket(newestPacket.Add(-time.Hour)) // older packets are ignored
+	assert.Equal(t, newestPacket.UnixNano(), pcapImporter.NewestPacket().UnixNano())
+
+	watchdog.Check()
+	status := watchdog.GetStatus()
+	assert.True(t, status.Lagging)
+	assert.GreaterOrEqual(t, status.Lag, int64(30*time.Minute/time.Millisecond))
+	laggingSince := status.LaggingSince
+	assert.NotZero(t, laggingSince)
+
+	watchdog.Check()
+	assert.Equal(t, laggingSince, watchdog.GetStatus().LaggingSince)
+
+	pcapImporter.updateNewestPacket(time.Now())
+	watchdog.Check()
+	status = watchdog.GetStatus()
+	assert.False(t, status.Lagging)
+	assert.Zero(t, status.LaggingSince)
+
+	// the watchdog is disabled without a maximum lag
+	watchdog = &LagWatchdog{pcapImporter: &PcapImporter{}}
+	watchdog.pcapImporter.updateNewestPacket(newestPacket)
+	watchdog.Check()
+	assert.False(t, watchdog.GetStatus().Lagging)
+}
+
+func TestLagWatchdogStop(t *testing.T) {
+	watchdog := &LagWatchdog{pcapImporter: &PcapImporter{}, stop: make(chan struct{})}
+	stopped := make(chan struct{})
+	go func() {
+		watchdog.Run()
+		close(stopped)
+	}()
+
+	watchdog.Stop()
+	watchdog.Stop() // stopping twice doesn't panic
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the watchdog is still running after being stopped")
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// metricsContentType is the content type of the Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+const (
+	metricCounter = "counter"
+	metricGauge   = "gauge"
+	metricSummary = "summary"
+)
+
+var metricsLabelsReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metricSample struct {
+	suffix string
+	labels []string // pairs of name and value
+	value  float64
+}
+
+// metricsWriter writes the metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	sb strings.Builder
+}
+
+func (mw *metricsWriter) write(name, kind, help string, samples ...metricSample) {
+	mw.sb.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind))
+	for _, sample := range samples {
+		mw.sb.WriteString(name)
+		mw.sb.WriteString(sample.suffix)
+		if len(sample.labels) > 0 {
+			labels := make([]string, 0, len(sample.labels)/2)
+			for i := 0; i+1 < len(sample.labels); i += 2 {
+				labels = append(labels, fmt.Sprintf(`%s="%s"`, sample.labels[i],
+					metricsLabelsReplacer.Replace(sample.labels[i+1])))
+			}
+			mw.sb.WriteString("{" + strings.Join(labels, ",") + "}")
+		}
+		mw.sb.WriteString(" " + strconv.FormatFloat(sample.value, 'g', -1, 64) + "\n")
+	}
+}
+
+func (mw *metricsWriter) single(name, kind, help string, value float64) {
+	mw.write(name, kind, help, metricSample{value: value})
+}
+
+func (mw *metricsWriter) String() string {
+	return mw.sb.String()
+}
+
+// CollectMetrics returns the internal counters of the active project in the Prometheus text exposition format. The
+// project must be configured.
+func CollectMetrics(projectContext *ProjectContext) string {
+	var mw metricsWriter
+
+	imports := projectContext.PcapImporter.ImportMetrics()
+	sensors := projectContext.SensorIngestion.GetSensors()
+	processedPackets := imports.ProcessedPackets
+	connectedSensors := 0
+	for _, sensor := range sensors {
+		processedPackets += sensor.ReceivedPackets
+		if sensor.Connected {
+			connectedSensors++
+		}
+	}
+	mw.single("caronte_processed_packets_total", metricCounter,
+		"Packets read from the pcaps and received from the sensors.", float64(processedPackets))
+
+	assembly := projectContext.PcapImporter.AssemblyMetrics()
+	mw.single("caronte_reassembled_streams_total", metricCounter, "Streams reassembled.",
+		float64(assembly.ReassembledStreams))
+	mw.single("caronte_saved_connections_total", metricCounter, "Connections saved in the database.",
+		float64(assembly.SavedConnections))
+
+	ruleIDs := make([]RowID, 0, len(assembly.RuleMatches))
+	for id := range assembly.RuleMatches {
+		ruleIDs = append(ruleIDs, id)
+	}
+	sort.Slice(ruleIDs, func(i, j int) bool {
+		return ruleIDs[i].Hex() < ruleIDs[j].Hex()
+	})
+	ruleMatches := make([]metricSample, 0, len(ruleIDs))
+	for _, id := range ruleIDs {
+		name := ""
+		if rule, isPresent := projectContext.RulesManager.GetRule(id); isPresent {
+			name = rule.Name
+		}
+		ruleMatches = append(ruleMatches, metricSample{labels: []string{"rule_id", id.Hex(), "rule_name", name},
+			value: float64(assembly.RuleMatches[id])})
+	}
+	mw.write("caronte_rule_matches_total", metricCounter, "Connections matched by each rule.", ruleMatches...)
+
+	scanner := projectContext.PcapImporter.ScannerMetrics()
+	mw.single("caronte_scanned_bytes_total", metricCounter, "Bytes scanned with the patterns of the rules.",
+		float64(scanner.ScannedBytes))
+	mw.single("caronte_scan_seconds_total", metricCounter, "Time spent scanning with the patterns of the rules.",
+		scanner.scanTime.Seconds())
+	mw.single("caronte_scratch_allocations_total", metricCounter, "Hyperscan scratch spaces allocated.",
+		float64(scanner.ScratchAllocations))
+	mw.single("caronte_scratch_reuses_total", metricCounter, "Hyperscan scratch spaces taken from the pool.",
+		float64(scanner.ScratchReuses))
+	mw.single("caronte_idle_scratches", metricGauge, "Hyperscan scratch spaces in the pool.",
+		float64(scanner.IdleScratches))
+
+	inserts := projectContext.Storage.InsertMetrics()
+	mw.write("caronte_mongo_insert_seconds", metricSummary, "Duration of the inserts in the database.",
+		metricSample{suffix: "_sum", value: inserts.Duration},
+		metricSample{suffix: "_count", value: float64(inserts.Count)})
+
+	mw.write("caronte_pcap_imports", metricGauge, "Pcaps waiting to be imported and being imported.",
+		metricSample{labels: []string{"status", ImportStatusQueued}, value: float64(imports.QueuedImports)},
+		metricSample{labels: []string{"status", ImportStatusImporting}, value: float64(imports.ActiveImports)})
+	mw.single("caronte_pcap_import_slots", metricGauge, "Pcaps which can be imported concurrently.",
+		float64(imports.ImportSlots))
+	mw.single("caronte_idle_assemblers", metricGauge, "Assemblers in the pool of the pcap importer.",
+		float64(imports.IdleAssemblers))
+	mw.single("caronte_connected_sensors", metricGauge, "Remote sensors connected.", float64(connectedSensors))
+	mw.single("caronte_goroutines", metricGauge, "Goroutines running.", float64(runtime.NumGoroutine()))
+
+	return mw.String()
+}
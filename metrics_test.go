@@ -0,0 +1,60 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsWriter(t *testing.T) {
+	var mw metricsWriter
+	mw.single("caronte_goroutines", metricGauge, "Goroutines running.", 12)
+	mw.write("caronte_rule_matches_total", metricCounter, "Connections matched by each rule.",
+		metricSample{labels: []string{"rule_id", "1", "rule_name", `flag "out"`}, value: 3},
+		metricSample{labels: []string{"rule_id", "2", "rule_name", "back\\slash\n"}, value: 0.5})
+	mw.write("caronte_mongo_insert_seconds", metricSummary, "Duration of the inserts in the database.",
+		metricSample{suffix: "_sum", value: 1.25}, metricSample{suffix: "_count", value: 1e7})
+
+	assert.Equal(t, "# HELP caronte_goroutines Goroutines running.\n"+
+		"# TYPE caronte_goroutines gauge\n"+
+		"caronte_goroutines 12\n"+
+		"# HELP caronte_rule_matches_total Connections matched by each rule.\n"+
+		"# TYPE caronte_rule_matches_total counter\n"+
+		`caronte_rule_matches_total{rule_id="1",rule_name="flag \"out\""} 3`+"\n"+
+		`caronte_rule_matches_total{rule_id="2",rule_name="back\\slash\n"} 0.5`+"\n"+
+		"# HELP caronte_mongo_insert_seconds Duration of the inserts in the database.\n"+
+		"# TYPE caronte_mongo_insert_seconds summary\n"+
+		"caronte_mongo_insert_seconds_sum 1.25\n"+
+		"caronte_mongo_insert_seconds_count 1e+07\n", mw.String())
+}
+
+func TestOperationTimer(t *testing.T) {
+	var nilTimer *operationTimer
+	nilTimer.observe(time.Now())
+	assert.Equal(t, OperationMetrics{}, nilTimer.metrics())
+
+	timer := &operationTimer{}
+	timer.observe(time.Now().Add(-time.Second))
+	timer.observe(time.Now().Add(-time.Second))
+	metrics := timer.metrics()
+	assert.Equal(t, int64(2), metrics.Count)
+	assert.True(t, metrics.Duration >= 2)
+}
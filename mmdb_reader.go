@@ -0,0 +1,323 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// mmdbMetadataMarker precedes the metadata section, which is at the end of the MaxMind DB files
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const mmdbMetadataMaxSize = 128 * 1024
+const mmdbDataSectionSeparator = 16
+const mmdbMaxDecodeDepth = 32
+
+// mmdbReader reads the databases in the MaxMind DB format, such as GeoLite2-Country and GeoLite2-ASN. The records are
+// decoded into generic values: maps, slices, strings, []byte, bool, float64, int64 and uint64.
+type mmdbReader struct {
+	buffer       []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	databaseType string
+	dataSection  []byte
+	ipv4Start    uint
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newMMDBReader(buffer)
+}
+
+func newMMDBReader(buffer []byte) (*mmdbReader, error) {
+	searchStart := len(buffer) - mmdbMetadataMaxSize
+	if searchStart < 0 {
+		searchStart = 0
+	}
+	markerIndex := bytes.LastIndex(buffer[searchStart:], mmdbMetadataMarker)
+	if markerIndex < 0 {
+		return nil, errors.New("invalid MaxMind DB file: metadata not found")
+	}
+	metadataSection := buffer[searchStart+markerIndex+len(mmdbMetadataMarker):]
+
+	value, _, err := mmdbDecoder{metadataSection}.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MaxMind DB metadata: %v", err)
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid MaxMind DB metadata: not a map")
+	}
+	nodeCount, _ := metadata["node_count"].(uint64)
+	recordSize, _ := metadata["record_size"].(uint64)
+	ipVersion, _ := metadata["ip_version"].(uint64)
+	databaseType, _ := metadata["database_type"].(string)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("unsupported MaxMind DB record size %d", recordSize)
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported MaxMind DB ip version %d", ipVersion)
+	}
+
+	treeSize := nodeCount * recordSize / 4
+	dataStart := treeSize + mmdbDataSectionSeparator
+	if dataStart > uint64(searchStart+markerIndex) {
+		return nil, errors.New("invalid MaxMind DB file: search tree out of bounds")
+	}
+
+	reader := &mmdbReader{
+		buffer:       buffer,
+		nodeCount:    uint(nodeCount),
+		recordSize:   uint(recordSize),
+		ipVersion:    uint(ipVersion),
+		databaseType: databaseType,
+		dataSection:  buffer[dataStart : searchStart+markerIndex],
+	}
+	// the IPv4 addresses are stored in the IPv6 databases in the ::/96 subnet
+	if reader.ipVersion == 6 {
+		for i := 0; i < 96 && reader.ipv4Start < reader.nodeCount; i++ {
+			reader.ipv4Start = reader.readNode(reader.ipv4Start, 0)
+		}
+	}
+
+	return reader, nil
+}
+
+// lookup returns the record of the network containing ip, or nil if the database doesn't contain it.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node, bitsCount := uint(0), 128
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip, bitsCount = ipv4, 32
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < bitsCount && node < r.nodeCount; i++ {
+		bit := (ip[i>>3] >> (7 - uint(i&7))) & 1
+		node = r.readNode(node, uint(bit))
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	} else if node < r.nodeCount {
+		return nil, errors.New("invalid MaxMind DB file: search tree too deep")
+	}
+
+	offset := node - r.nodeCount - mmdbDataSectionSeparator
+	if offset >= uint(len(r.dataSection)) {
+		return nil, errors.New("invalid MaxMind DB file: record out of bounds")
+	}
+	value, _, err := mmdbDecoder{r.dataSection}.decode(offset, 0)
+	return value, err
+}
+
+func (r *mmdbReader) readNode(node, bit uint) uint {
+	nodeBytes := r.buffer[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		offset := bit * 3
+		return uint(nodeBytes[offset])<<16 | uint(nodeBytes[offset+1])<<8 | uint(nodeBytes[offset+2])
+	case 28:
+		if bit == 0 {
+			return uint(nodeBytes[3]&0xf0)<<20 | uint(nodeBytes[0])<<16 | uint(nodeBytes[1])<<8 | uint(nodeBytes[2])
+		}
+		return uint(nodeBytes[3]&0x0f)<<24 | uint(nodeBytes[4])<<16 | uint(nodeBytes[5])<<8 | uint(nodeBytes[6])
+	default:
+		return uint(binary.BigEndian.Uint32(nodeBytes[bit*4:]))
+	}
+}
+
+// Types of the fields of the MaxMind DB data section
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBoolean
+	mmdbFloat
+)
+
+type mmdbDecoder struct {
+	buffer []byte
+}
+
+// decode returns the value at offset and the offset of the next field.
+func (d mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDecodeDepth {
+		return nil, 0, errors.New("maximum data structure depth exceeded")
+	}
+	if offset >= uint(len(d.buffer)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+
+	control := d.buffer[offset]
+	offset++
+	fieldType := uint(control >> 5)
+	if fieldType == mmdbPointer {
+		pointer, next, err := d.decodePointer(control, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer, depth+1)
+		return value, next, err
+	}
+	if fieldType == mmdbExtended {
+		if offset >= uint(len(d.buffer)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+		fieldType = 7 + uint(d.buffer[offset])
+		offset++
+	}
+
+	size := uint(control & 0x1f)
+	if size >= 29 {
+		sizeBytes := size - 28
+		if offset+sizeBytes > uint(len(d.buffer)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+		extra := d.readUint(offset, sizeBytes)
+		offset += sizeBytes
+		switch sizeBytes {
+		case 1:
+			size = 29 + extra
+		case 2:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+
+	switch fieldType {
+	case mmdbMap:
+		values := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map keys must be strings")
+			}
+			value, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values[keyString] = value
+			offset = next
+		}
+		return values, offset, nil
+	case mmdbArray:
+		values := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, value)
+			offset = next
+		}
+		return values, offset, nil
+	case mmdbBoolean:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(d.buffer)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+	next := offset + size
+	switch fieldType {
+	case mmdbString:
+		return string(d.buffer[offset:next]), next, nil
+	case mmdbBytes, mmdbUint128:
+		return append([]byte{}, d.buffer[offset:next]...), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(d.buffer[offset:])), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(d.buffer[offset:]))), next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, errors.New("invalid unsigned integer size")
+		}
+		return uint64(d.readUint(offset, size)), next, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errors.New("invalid integer size")
+		}
+		return int64(int32(d.readUint(offset, size))), next, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown data type %d", fieldType)
+	}
+}
+
+func (d mmdbDecoder) decodePointer(control byte, offset uint) (uint, uint, error) {
+	pointerSize := uint((control>>3)&0x3) + 1
+	if offset+pointerSize > uint(len(d.buffer)) {
+		return 0, 0, errors.New("unexpected end of data")
+	}
+
+	value := d.readUint(offset, pointerSize)
+	switch pointerSize {
+	case 1:
+		value |= uint(control&0x7) << 8
+	case 2:
+		value = (value | uint(control&0x7)<<16) + 2048
+	case 3:
+		value = (value | uint(control&0x7)<<24) + 526336
+	}
+
+	return value, offset + pointerSize, nil
+}
+
+func (d mmdbDecoder) readUint(offset, size uint) uint {
+	var value uint
+	for _, b := range d.buffer[offset : offset+size] {
+		value = value<<8 | uint(b)
+	}
+	return value
+}
@@ -18,11 +18,14 @@
 package main
 
 import (
+	"encoding/json"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -31,15 +34,20 @@ const (
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
 	maxMessageSize = 512
+	// sendBufferSize is the number of events queued for each client, which are disconnected if they can't keep up
+	sendBufferSize = 256
 )
 
+// NotificationController sends the events to the websocket clients. The events of the components of a project are
+// sent through the controller returned by ForProject, and they are delivered only while the project is active.
 type NotificationController struct {
 	upgrader           websocket.Upgrader
 	clients            map[net.Addr]*client
-	broadcast          chan interface{}
+	broadcast          chan gin.H
 	register           chan *client
 	unregister         chan *client
 	applicationContext *ApplicationContext
+	project            *RowID
 }
 
 func NewNotificationController(applicationContext *ApplicationContext) *NotificationController {
@@ -49,7 +57,7 @@ func NewNotificationController(applicationContext *ApplicationContext) *Notifica
 			WriteBufferSize: 1024,
 		},
 		clients:            make(map[net.Addr]*client),
-		broadcast:          make(chan interface{}),
+		broadcast:          make(chan gin.H),
 		register:           make(chan *client),
 		unregister:         make(chan *client),
 		applicationContext: applicationContext,
@@ -60,6 +68,14 @@ type client struct {
 	conn                   *websocket.Conn
 	send                   chan interface{}
 	notificationController *NotificationController
+	events                 []string
+	mEvents                sync.RWMutex
+}
+
+// subscription is the message sent by the clients to choose the events to receive. Each event is either the name of
+// an event (e.g. connections.new) or a prefix followed by * (e.g. rules.*). An empty list subscribes to all the events.
+type subscription struct {
+	Events []string `json:"events"`
 }
 
 func (wc *NotificationController) NotificationHandler(w http.ResponseWriter, r *http.Request) error {
@@ -71,8 +87,9 @@ func (wc *NotificationController) NotificationHandler(w http.ResponseWriter, r *
 
 	client := &client{
 		conn:                   conn,
-		send:                   make(chan interface{}),
+		send:                   make(chan interface{}, sendBufferSize),
 		notificationController: wc,
+		events:                 parseEvents(r.URL.Query()["events"]),
 	}
 	wc.register <- client
 	go client.readPump()
@@ -88,7 +105,7 @@ func (wc *NotificationController) Run() {
 			wc.clients[client.conn.RemoteAddr()] = client
 			payload := gin.H{"event": "connected", "message": gin.H{
 				"version":           wc.applicationContext.Version,
-				"is_configured":     wc.applicationContext.IsConfigured,
+				"is_configured":     wc.applicationContext.ActiveProject().IsConfigured,
 				"connected_clients": len(wc.clients),
 			}}
 			client.send <- payload
@@ -106,7 +123,15 @@ func (wc *NotificationController) Run() {
 					Info("[-] a websocket client disconnected")
 			}
 		case payload := <-wc.broadcast:
+			if project, isPresent := payload["project"]; isPresent &&
+				project != wc.applicationContext.ActiveProject().Project.ID {
+				continue // the events of the projects which are not active are discarded
+			}
+			event, _ := payload["event"].(string)
 			for _, client := range wc.clients {
+				if !client.isSubscribed(event) {
+					continue
+				}
 				select {
 				case client.send <- payload:
 				default:
@@ -119,7 +144,54 @@ func (wc *NotificationController) Run() {
 }
 
 func (wc *NotificationController) Notify(event string, message interface{}) {
-	wc.broadcast <- gin.H{"event": event, "message": message}
+	if wc == nil {
+		return
+	}
+	payload := gin.H{"event": event, "message": message}
+	if wc.project != nil {
+		payload["project"] = *wc.project
+	}
+	wc.broadcast <- payload
+}
+
+// ForProject returns a controller which sends the events of the components of a project, tagged with the project id.
+func (wc *NotificationController) ForProject(projectID RowID) *NotificationController {
+	if wc == nil {
+		return nil
+	}
+	projectController := *wc
+	projectController.project = &projectID
+	return &projectController
+}
+
+// isSubscribed returns true if the client has chosen to receive the events of type event.
+func (c *client) isSubscribed(event string) bool {
+	c.mEvents.RLock()
+	defer c.mEvents.RUnlock()
+
+	if len(c.events) == 0 {
+		return true
+	}
+	for _, subscribedEvent := range c.events {
+		if subscribedEvent == event || strings.HasSuffix(subscribedEvent, "*") &&
+			strings.HasPrefix(event, strings.TrimSuffix(subscribedEvent, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseEvents splits the events passed as comma separated values.
+func parseEvents(values []string) []string {
+	var events []string
+	for _, value := range values {
+		for _, event := range strings.Split(value, ",") {
+			if event = strings.TrimSpace(event); event != "" {
+				events = append(events, event)
+			}
+		}
+	}
+	return events
 }
 
 func (c *client) readPump() {
@@ -130,13 +202,24 @@ func (c *client) readPump() {
 	}
 	c.conn.SetPongHandler(func(string) error { return c.conn.SetReadDeadline(time.Now().Add(pongWait)) })
 	for {
-		if _, _, err := c.conn.ReadMessage(); err != nil {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
 				log.WithError(err).WithField("remote_address", c.conn.RemoteAddr()).
 					Warn("unexpected websocket disconnection")
 			}
 			break
 		}
+
+		var message subscription
+		if err := json.Unmarshal(data, &message); err != nil {
+			log.WithError(err).WithField("remote_address", c.conn.RemoteAddr()).
+				Warn("invalid websocket subscription message")
+			continue
+		}
+		c.mEvents.Lock()
+		c.events = parseEvents(message.Events)
+		c.mEvents.Unlock()
 	}
 
 	c.close()
@@ -0,0 +1,108 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotificationsSubscription(t *testing.T) {
+	notificationController := NewNotificationController(&ApplicationContext{activeProject: &ProjectContext{},
+		Version: "test"})
+	go notificationController.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = notificationController.NotificationHandler(w, r)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+
+		"?events=rules.*,pcap.completed", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	readEvent := func() string {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		var payload map[string]interface{}
+		require.NoError(t, conn.ReadJSON(&payload))
+		return payload["event"].(string)
+	}
+	assert.Equal(t, "connected", readEvent())
+
+	notificationController.Notify("connections.new", nil)
+	notificationController.Notify("rules.matched", nil)
+	notificationController.Notify("pcap.completed", nil)
+	assert.Equal(t, "rules.matched", readEvent())
+	assert.Equal(t, "pcap.completed", readEvent())
+
+	require.NoError(t, conn.WriteJSON(subscription{Events: []string{"connections.new"}}))
+	// the subscription is updated asynchronously, wait for the new connections to be received
+	for event := ""; event != "connections.new"; event = readEvent() {
+		notificationController.Notify("pcap.completed", nil)
+		notificationController.Notify("connections.new", nil)
+	}
+}
+
+func TestNotificationsProjects(t *testing.T) {
+	applicationContext := &ApplicationContext{activeProject: &ProjectContext{Project: DefaultProject()}}
+	notificationController := NewNotificationController(applicationContext)
+	go notificationController.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = notificationController.NotificationHandler(w, r)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	readPayload := func() map[string]interface{} {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		var payload map[string]interface{}
+		require.NoError(t, conn.ReadJSON(&payload))
+		return payload
+	}
+	assert.Equal(t, "connected", readPayload()["event"])
+
+	// the events of the projects which are not active are discarded
+	notificationController.ForProject(NewRowID()).Notify("connections.new", nil)
+	notificationController.ForProject(ZeroRowID).Notify("rules.matched", nil)
+	notificationController.Notify("users.new", nil)
+	payload := readPayload()
+	assert.Equal(t, "rules.matched", payload["event"])
+	assert.Equal(t, RowID(ZeroRowID).Hex(), payload["project"])
+	payload = readPayload()
+	assert.Equal(t, "users.new", payload["event"])
+	assert.NotContains(t, payload, "project")
+}
+
+func TestNotifyWithoutController(t *testing.T) {
+	var notificationController *NotificationController
+	assert.NotPanics(t, func() {
+		notificationController.Notify("connections.new", nil)
+		notificationController.ForProject(ZeroRowID).Notify("connections.new", nil)
+	})
+}
@@ -0,0 +1,70 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+// #cgo pkg-config: libbrotlidec
+// #include <stdlib.h>
+// #include <brotli/decode.h>
+import "C"
+
+import (
+	"errors"
+	"io"
+)
+
+const brotliBufferSize = 64 * 1024
+
+// decodeBrotli decompresses a brotli stream with libbrotlidec. The decompression stops after maxSize bytes, so the
+// compressed bombs are not expanded completely. If the stream is truncated, the bytes decoded until then are returned
+// with io.ErrUnexpectedEOF.
+func decodeBrotli(content []byte, maxSize int) ([]byte, error) {
+	state := C.BrotliDecoderCreateInstance(nil, nil, nil)
+	if state == nil {
+		return nil, errors.New("failed to create the brotli decoder")
+	}
+	defer C.BrotliDecoderDestroyInstance(state)
+
+	// the buffers are allocated by C, because the decoder receives pointers to the pointers to them
+	input := C.CBytes(content)
+	defer C.free(input)
+	buffer := C.malloc(brotliBufferSize)
+	defer C.free(buffer)
+
+	availableIn := C.size_t(len(content))
+	nextIn := (*C.uint8_t)(input)
+	var decoded []byte
+	for {
+		availableOut := C.size_t(brotliBufferSize)
+		nextOut := (*C.uint8_t)(buffer)
+		result := C.BrotliDecoderDecompressStream(state, &availableIn, &nextIn, &availableOut, &nextOut, nil)
+		decoded = append(decoded, C.GoBytes(buffer, C.int(brotliBufferSize-availableOut))...)
+
+		switch result {
+		case C.BROTLI_DECODER_RESULT_SUCCESS:
+			return decoded, nil
+		case C.BROTLI_DECODER_RESULT_NEEDS_MORE_OUTPUT:
+			if len(decoded) >= maxSize {
+				return decoded[:maxSize], nil
+			}
+		case C.BROTLI_DECODER_RESULT_NEEDS_MORE_INPUT:
+			return decoded, io.ErrUnexpectedEOF
+		default:
+			return nil, errors.New(C.GoString(C.BrotliDecoderErrorString(C.BrotliDecoderGetErrorCode(state))))
+		}
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxHTTPBodySize is the maximum size of the decoded bodies, the longer ones are truncated
+const MaxHTTPBodySize = 1024 * 1024
+
+const (
+	BodyEncodingText   = "text"
+	BodyEncodingBase64 = "base64"
+)
+
+// HTTPExchange is a request with its response, in the order they appear in the connection. Response is nil if the
+// server did not reply or if the response can't be parsed.
+type HTTPExchange struct {
+	Index    int                  `json:"index" bson:"index"`
+	Request  *HTTPRequestMessage  `json:"request" bson:"request"`
+	Response *HTTPResponseMessage `json:"response" bson:"response,omitempty"`
+}
+
+type HTTPRequestMessage struct {
+	Method   string            `json:"method" bson:"method"`
+	URL      string            `json:"url" bson:"url"`
+	Protocol string            `json:"protocol" bson:"protocol"`
+	Host     string            `json:"host" bson:"host"`
+	Headers  map[string]string `json:"headers" bson:"headers"`
+	Trailer  map[string]string `json:"trailer,omitempty" bson:"trailer,omitempty"`
+	HTTPBody `bson:",inline"`
+}
+
+type HTTPResponseMessage struct {
+	Status     string            `json:"status" bson:"status"`
+	StatusCode int               `json:"status_code" bson:"status_code"`
+	Protocol   string            `json:"protocol" bson:"protocol"`
+	Headers    map[string]string `json:"headers" bson:"headers"`
+	Trailer    map[string]string `json:"trailer,omitempty" bson:"trailer,omitempty"`
+	HTTPBody   `bson:",inline"`
+}
+
+// HTTPBody is the body of a message after removing the transfer encoding and the content encoding. The bodies
+// which are not valid utf-8 strings are encoded in base64. If the content encoding is not supported, the body is
+// left encoded and DecodingError is set.
+type HTTPBody struct {
+	Body            string `json:"body" bson:"body"`
+	BodyEncoding    string `json:"body_encoding" bson:"body_encoding"`
+	BodySize        int    `json:"body_size" bson:"body_size"`
+	BodyTruncated   bool   `json:"body_truncated" bson:"body_truncated"`
+	ContentEncoding string `json:"content_encoding,omitempty" bson:"content_encoding,omitempty"`
+	DecodingError   string `json:"decoding_error,omitempty" bson:"decoding_error,omitempty"`
+}
+
+// ParseHTTPExchanges reconstructs the http requests sent by the client and the responses sent by the server from the
+// reassembled streams of a connection. The parsing stops at the first message which is not valid http.
+func ParseHTTPExchanges(clientPayload, serverPayload []byte) []HTTPExchange {
+	clientReader := bufio.NewReader(bytes.NewReader(clientPayload))
+	serverReader := bufio.NewReader(bytes.NewReader(serverPayload))
+
+	var exchanges []HTTPExchange
+	responsesParsable := true
+	for index := 0; ; index++ {
+		request, err := http.ReadRequest(clientReader)
+		if err != nil {
+			break
+		}
+		exchange := HTTPExchange{
+			Index: index,
+			Request: &HTTPRequestMessage{
+				Method:   request.Method,
+				URL:      request.URL.String(),
+				Protocol: request.Proto,
+				Host:     request.Host,
+				Headers:  JoinArrayMap(request.Header),
+			},
+		}
+		exchange.Request.HTTPBody = readBody(request.Body, request.Header.Get("Content-Encoding"))
+		exchange.Request.Trailer = trailerMap(request.Trailer)
+
+		if responsesParsable {
+			if response, err := readFinalResponse(serverReader, request); err == nil {
+				exchange.Response = &HTTPResponseMessage{
+					Status:     response.Status,
+					StatusCode: response.StatusCode,
+					Protocol:   response.Proto,
+					Headers:    JoinArrayMap(response.Header),
+				}
+				exchange.Response.HTTPBody = readBody(response.Body, response.Header.Get("Content-Encoding"))
+				exchange.Response.Trailer = trailerMap(response.Trailer)
+			} else {
+				responsesParsable = false
+			}
+		}
+
+		exchanges = append(exchanges, exchange)
+	}
+
+	return exchanges
+}
+
+// readFinalResponse skips the informational responses (e.g. 100 Continue) sent before the response of request.
+func readFinalResponse(reader *bufio.Reader, request *http.Request) (*http.Response, error) {
+	for {
+		response, err := http.ReadResponse(reader, request)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode >= 200 || response.StatusCode == http.StatusSwitchingProtocols {
+			return response, nil
+		}
+		_ = response.Body.Close()
+	}
+}
+
+func readBody(body io.ReadCloser, contentEncoding string) HTTPBody {
+	defer body.Close()
+
+	// the body must be read entirely, otherwise the next messages can't be parsed
+	rawBody, err := ioutil.ReadAll(body)
+	result := HTTPBody{ContentEncoding: strings.ToLower(strings.TrimSpace(contentEncoding))}
+	if err != nil {
+		result.DecodingError = err.Error()
+	}
+
+	decodedBody := rawBody
+	if result.ContentEncoding != "" && result.ContentEncoding != "identity" && len(rawBody) > 0 {
+		if decoded, err := decodeContent(rawBody, result.ContentEncoding); err != nil {
+			result.DecodingError = err.Error()
+		} else {
+			decodedBody = decoded
+		}
+	}
+
+	result.BodySize = len(decodedBody)
+	if len(decodedBody) > MaxHTTPBodySize {
+		decodedBody = decodedBody[:MaxHTTPBodySize]
+		result.BodyTruncated = true
+	}
+	if utf8.Valid(decodedBody) {
+		result.Body = string(decodedBody)
+		result.BodyEncoding = BodyEncodingText
+	} else {
+		result.Body = base64.StdEncoding.EncodeToString(decodedBody)
+		result.BodyEncoding = BodyEncodingBase64
+	}
+
+	return result
+}
+
+// decodeContent removes the content encodings, applied in the order they are listed.
+func decodeContent(content []byte, contentEncoding string) ([]byte, error) {
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var reader io.Reader
+		var err error
+		switch encoding := strings.TrimSpace(encodings[i]); encoding {
+		case "gzip", "x-gzip":
+			reader, err = gzip.NewReader(bytes.NewReader(content))
+		case "deflate":
+			// deflate should be zlib wrapped, but some servers send the raw deflate stream
+			if reader, err = zlib.NewReader(bytes.NewReader(content)); err != nil {
+				reader, err = flate.NewReader(bytes.NewReader(content)), nil
+			}
+		case "br":
+			decoded, err := decodeBrotli(content, MaxHTTPBodySize+1)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return nil, err
+			}
+			content = decoded
+			continue
+		case "identity", "":
+			continue
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %s", encoding)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		decoded, err := ioutil.ReadAll(io.LimitReader(reader, MaxHTTPBodySize+1))
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		content = decoded
+	}
+
+	return content, nil
+}
+
+func trailerMap(trailer http.Header) map[string]string {
+	if len(trailer) == 0 {
+		return nil
+	}
+	return JoinArrayMap(trailer)
+}
@@ -0,0 +1,589 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	classifiersSettingsKey           = "classifiers"
+	classifiersStateKey              = "classifiers_state"
+	classifiersPollInterval          = 5 * time.Second
+	classifiersSettleDelay           = 2 * time.Second // connections being inserted may have older processed_at
+	maxClassifiedConnectionsPerRound = 100
+	defaultClassifierTimeout         = 10
+	defaultClassifierMaxPayloadSize  = 64 * 1024
+	maxClassifierOutputSize          = 1024 * 1024
+)
+
+const (
+	ClassifierTypeHTTP    = "http"
+	ClassifierTypeProcess = "process"
+)
+
+// PayloadClassifier labels the payloads of a connection, e.g. with a machine learning model. The labels returned are
+// stored in the classifications of the connection under the name of the classifier.
+type PayloadClassifier interface {
+	Classify(c context.Context, request ClassificationRequest) ([]ClassificationLabel, error)
+}
+
+// ClassificationRequest is sent to the classifiers, as JSON for the external ones. The payloads are encoded in base64
+// and are truncated to the maximum payload size of the classifier.
+type ClassificationRequest struct {
+	ConnectionID    RowID     `json:"connection_id"`
+	SourceIP        string    `json:"ip_src"`
+	DestinationIP   string    `json:"ip_dst"`
+	SourcePort      uint16    `json:"port_src"`
+	DestinationPort uint16    `json:"port_dst"`
+	StartedAt       time.Time `json:"started_at"`
+	ClosedAt        time.Time `json:"closed_at"`
+	ClientPayload   []byte    `json:"client_payload"`
+	ServerPayload   []byte    `json:"server_payload"`
+	Truncated       bool      `json:"truncated"`
+}
+
+type ClassificationLabel struct {
+	Label string  `json:"label" binding:"required" bson:"label"`
+	Score float64 `json:"score" bson:"score"`
+}
+
+// Classifications contains the labels assigned to a connection by each classifier.
+type Classifications map[string][]ClassificationLabel
+
+// classificationResponse is the body expected from the external classifiers.
+type classificationResponse struct {
+	Labels []ClassificationLabel `json:"labels"`
+}
+
+// ClassifierSettings configure an external classifier: an http endpoint which receives the requests with POST, or a
+// local process started for each connection, which reads the request from stdin and writes the response to stdout.
+// The executable of a process must be one of those allowed when the server is started.
+// Timeout is in seconds. If ServicesPorts is not empty only the connections of those services are classified.
+type ClassifierSettings struct {
+	Name           string   `json:"name" binding:"required,max=32,excludesall=.$ " bson:"name"`
+	Type           string   `json:"type" binding:"oneof=http process" bson:"type"`
+	Enabled        bool     `json:"enabled" bson:"enabled"`
+	URL            string   `json:"url" binding:"required_if=Type http,omitempty,url" bson:"url,omitempty"`
+	Command        []string `json:"command" binding:"required_if=Type process" bson:"command,omitempty"`
+	ServicesPorts  []uint16 `json:"services_ports" bson:"services_ports,omitempty"`
+	Timeout        uint     `json:"timeout" bson:"timeout"`
+	MaxPayloadSize int      `json:"max_payload_size" binding:"min=0" bson:"max_payload_size"`
+}
+
+type ClassifiersSettings struct {
+	Classifiers []ClassifierSettings `json:"classifiers" binding:"dive" bson:"classifiers"`
+}
+
+type ClassifierStatistics struct {
+	Classified int       `json:"classified"`
+	Errors     int       `json:"errors"`
+	LastError  string    `json:"last_error,omitempty"`
+	LastRunAt  time.Time `json:"last_run_at,omitempty"`
+}
+
+type classifiersState struct {
+	LastProcessedAt time.Time `bson:"last_processed_at"`
+	LastID          RowID     `bson:"last_id"`
+}
+
+type classifierEntry struct {
+	settings   ClassifierSettings
+	classifier PayloadClassifier
+}
+
+// PayloadClassifiers periodically sends the new connections to the enabled classifiers and stores the labels returned
+// on the connections. When there are no enabled classifiers the connections are skipped, and are not classified later.
+type PayloadClassifiers struct {
+	storage                Storage
+	notificationController *NotificationController
+	allowedExecutables     map[string]bool
+	settings               ClassifiersSettings
+	classifiers            []classifierEntry
+	registered             map[string]classifierEntry
+	statistics             map[string]*ClassifierStatistics
+	state                  classifiersState
+	mutex                  sync.Mutex
+	mClassify              sync.Mutex
+	ctx                    context.Context
+	cancelFunc             context.CancelFunc
+}
+
+// NewPayloadClassifiers creates the classifiers configured in the settings. The process classifiers can only start
+// one of the allowedExecutables, which are absolute paths.
+func NewPayloadClassifiers(storage Storage, allowedExecutables []string,
+	notificationController *NotificationController) *PayloadClassifiers {
+	pc := &PayloadClassifiers{
+		storage:                storage,
+		notificationController: notificationController,
+		allowedExecutables:     make(map[string]bool, len(allowedExecutables)),
+		registered:             make(map[string]classifierEntry),
+		statistics:             make(map[string]*ClassifierStatistics),
+	}
+	pc.ctx, pc.cancelFunc = context.WithCancel(context.Background())
+
+	for _, executable := range allowedExecutables {
+		if !filepath.IsAbs(executable) {
+			log.WithField("executable", executable).Warn("ignored a classifier executable without an absolute path")
+			continue
+		}
+		pc.allowedExecutables[filepath.Clean(executable)] = true
+	}
+
+	var settings ClassifiersSettings
+	if err := LoadSettings(storage, classifiersSettingsKey, &settings); err != nil {
+		log.WithError(err).Panic("failed to retrieve classifiers settings")
+	}
+	if err := LoadSettings(storage, classifiersStateKey, &pc.state); err != nil {
+		log.WithError(err).Panic("failed to retrieve classifiers state")
+	}
+	if err := pc.applySettings(settings); err != nil {
+		log.WithError(err).Error("invalid classifiers settings")
+	}
+
+	return pc
+}
+
+// RegisterClassifier adds a classifier implemented in Go, which is always enabled for all the services. If
+// maxPayloadSize is zero the default maximum payload size is used.
+func (pc *PayloadClassifiers) RegisterClassifier(name string, maxPayloadSize int, classifier PayloadClassifier) {
+	if maxPayloadSize == 0 {
+		maxPayloadSize = defaultClassifierMaxPayloadSize
+	}
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	pc.registered[name] = classifierEntry{
+		settings:   ClassifierSettings{Name: name, Enabled: true, MaxPayloadSize: maxPayloadSize},
+		classifier: classifier,
+	}
+}
+
+func (pc *PayloadClassifiers) GetSettings() ClassifiersSettings {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	return pc.settings
+}
+
+func (pc *PayloadClassifiers) SetSettings(settings ClassifiersSettings) error {
+	if err := pc.validateSettings(settings); err != nil {
+		return err
+	}
+	if err := SaveSettings(pc.storage, classifiersSettingsKey, settings); err != nil {
+		return err
+	}
+
+	return pc.applySettings(settings)
+}
+
+// ReloadSettings reads the settings again from the database, discarding the ones in memory.
+func (pc *PayloadClassifiers) ReloadSettings() error {
+	var settings ClassifiersSettings
+	if err := LoadSettings(pc.storage, classifiersSettingsKey, &settings); err != nil {
+		return err
+	}
+
+	return pc.applySettings(settings)
+}
+
+func (pc *PayloadClassifiers) applySettings(settings ClassifiersSettings) error {
+	if err := pc.validateSettings(settings); err != nil {
+		return err
+	}
+	if settings.Classifiers == nil {
+		settings.Classifiers = []ClassifierSettings{}
+	}
+
+	classifiers := make([]classifierEntry, 0, len(settings.Classifiers))
+	for _, classifierSettings := range settings.Classifiers {
+		if classifierSettings.Timeout == 0 {
+			classifierSettings.Timeout = defaultClassifierTimeout
+		}
+		if classifierSettings.MaxPayloadSize == 0 {
+			classifierSettings.MaxPayloadSize = defaultClassifierMaxPayloadSize
+		}
+		classifiers = append(classifiers, classifierEntry{
+			settings:   classifierSettings,
+			classifier: newExternalClassifier(classifierSettings),
+		})
+	}
+
+	pc.mutex.Lock()
+	pc.settings = settings
+	pc.classifiers = classifiers
+	pc.mutex.Unlock()
+
+	return nil
+}
+
+func (pc *PayloadClassifiers) validateSettings(settings ClassifiersSettings) error {
+	names := make(map[string]bool)
+	for _, classifier := range settings.Classifiers {
+		if names[classifier.Name] {
+			return fmt.Errorf("duplicate classifier name %s", classifier.Name)
+		}
+		names[classifier.Name] = true
+		if classifier.Type == ClassifierTypeProcess &&
+			(len(classifier.Command) == 0 || !pc.allowedExecutables[classifier.Command[0]]) {
+			return fmt.Errorf("the command of the classifier %s is not an allowed executable", classifier.Name)
+		}
+	}
+	return nil
+}
+
+// GetStatistics returns the number of connections classified and the errors of each classifier.
+func (pc *PayloadClassifiers) GetStatistics() map[string]ClassifierStatistics {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	statistics := make(map[string]ClassifierStatistics, len(pc.statistics))
+	for name, classifierStatistics := range pc.statistics {
+		statistics[name] = *classifierStatistics
+	}
+	return statistics
+}
+
+// Run classifies the new connections periodically, and returns when the classifiers are stopped.
+func (pc *PayloadClassifiers) Run() {
+	for {
+		if _, err := pc.ClassifyNew(pc.ctx); err != nil && pc.ctx.Err() == nil {
+			log.WithError(err).Error("failed to classify connections")
+		}
+
+		select {
+		case <-time.After(classifiersPollInterval):
+		case <-pc.ctx.Done():
+			return
+		}
+	}
+}
+
+// Stop stops the periodic classification and the classifiers running.
+func (pc *PayloadClassifiers) Stop() {
+	pc.cancelFunc()
+}
+
+// ClassifyNew classifies the connections processed since the last round and returns how many have been classified.
+func (pc *PayloadClassifiers) ClassifyNew(c context.Context) (int, error) {
+	pc.mClassify.Lock()
+	defer pc.mClassify.Unlock()
+
+	until := time.Now().Add(-classifiersSettleDelay)
+	classifiers := pc.enabledClassifiers()
+	if len(classifiers) == 0 {
+		pc.state = classifiersState{LastProcessedAt: until}
+		if err := SaveSettings(pc.storage, classifiersStateKey, pc.state); err != nil {
+			log.WithError(err).Error("failed to save classifiers state")
+		}
+		return 0, nil
+	}
+
+	query := pc.storage.Find(Connections).Context(c).
+		Filter(OrderedDocument{{"processed_at", UnorderedDocument{"$lte": until}}}).
+		Sort("processed_at", true).Sort("_id", true).Limit(maxClassifiedConnectionsPerRound)
+	if !pc.state.LastProcessedAt.IsZero() {
+		query = query.Filter(OrderedDocument{{"$or", []UnorderedDocument{
+			{"processed_at": UnorderedDocument{"$gt": pc.state.LastProcessedAt}},
+			{"processed_at": pc.state.LastProcessedAt, "_id": UnorderedDocument{"$gt": pc.state.LastID}},
+		}}})
+	}
+	var connections []Connection
+	if err := query.All(&connections); err != nil {
+		return 0, err
+	}
+
+	for _, connection := range connections {
+		pc.classify(c, connection, classifiers)
+		pc.state.LastProcessedAt = connection.ProcessedAt
+		pc.state.LastID = connection.ID
+	}
+	if len(connections) > 0 {
+		if err := SaveSettings(pc.storage, classifiersStateKey, pc.state); err != nil {
+			log.WithError(err).Error("failed to save classifiers state")
+		}
+	}
+
+	return len(connections), nil
+}
+
+// ClassifyConnection classifies again a connection with all the enabled classifiers. Returns false if the connection
+// does not exist.
+func (pc *PayloadClassifiers) ClassifyConnection(c context.Context,
+	connectionID RowID) (Classifications, bool) {
+	var connection Connection
+	if err := pc.storage.Find(Connections).Context(c).Filter(byID(connectionID)).First(&connection); err != nil {
+		log.WithError(err).WithField("id", connectionID).Panic("failed to get connection")
+	}
+	if connection.ID.IsZero() {
+		return nil, false
+	}
+
+	return pc.classify(c, connection, pc.enabledClassifiers()), true
+}
+
+func (pc *PayloadClassifiers) enabledClassifiers() []classifierEntry {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	classifiers := make([]classifierEntry, 0, len(pc.classifiers)+len(pc.registered))
+	for _, entry := range pc.classifiers {
+		if entry.settings.Enabled {
+			classifiers = append(classifiers, entry)
+		}
+	}
+	for _, entry := range pc.registered {
+		classifiers = append(classifiers, entry)
+	}
+	return classifiers
+}
+
+func (pc *PayloadClassifiers) classify(c context.Context, connection Connection,
+	classifiers []classifierEntry) Classifications {
+	classifications := make(Classifications)
+	var clientPayload, serverPayload []byte
+	var payloadsSize int
+	for _, entry := range classifiers {
+		if len(entry.settings.ServicesPorts) > 0 && !containsPort(entry.settings.ServicesPorts,
+			connection.DestinationPort) {
+			continue
+		}
+		if entry.settings.MaxPayloadSize > payloadsSize || clientPayload == nil {
+			clientPayload, serverPayload = pc.readPayloads(c, connection.ID, entry.settings.MaxPayloadSize)
+			payloadsSize = entry.settings.MaxPayloadSize
+		}
+
+		request := ClassificationRequest{
+			ConnectionID:    connection.ID,
+			SourceIP:        connection.SourceIP,
+			DestinationIP:   connection.DestinationIP,
+			SourcePort:      connection.SourcePort,
+			DestinationPort: connection.DestinationPort,
+			StartedAt:       connection.StartedAt,
+			ClosedAt:        connection.ClosedAt,
+			ClientPayload:   truncatePayload(clientPayload, entry.settings.MaxPayloadSize),
+			ServerPayload:   truncatePayload(serverPayload, entry.settings.MaxPayloadSize),
+		}
+		request.Truncated = len(request.ClientPayload) < connection.ClientBytes ||
+			len(request.ServerPayload) < connection.ServerBytes
+
+		ctx, cancel := context.WithTimeout(c, time.Duration(entry.settings.Timeout)*time.Second)
+		if entry.settings.Timeout == 0 {
+			ctx, cancel = context.WithCancel(c)
+		}
+		labels, err := entry.classifier.Classify(ctx, request)
+		cancel()
+		pc.updateStatistics(entry.settings.Name, err)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"classifier": entry.settings.Name,
+				"connection_id": connection.ID}).Warn("failed to classify connection")
+			continue
+		}
+		if labels == nil {
+			labels = []ClassificationLabel{}
+		}
+		classifications[entry.settings.Name] = labels
+	}
+
+	if len(classifications) > 0 {
+		update := make(UnorderedDocument, len(classifications))
+		for name, labels := range classifications {
+			update["classifications."+name] = labels
+		}
+		if _, err := pc.storage.Update(Connections).Context(c).Filter(byID(connection.ID)).
+			One(update); err != nil {
+			log.WithError(err).WithField("connection_id", connection.ID).Error("failed to save classifications")
+		} else {
+			pc.notificationController.Notify("connections.classified", gin.H{
+				"connection_id":   connection.ID,
+				"classifications": classifications,
+			})
+		}
+	}
+
+	return classifications
+}
+
+func (pc *PayloadClassifiers) updateStatistics(name string, err error) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	statistics, isPresent := pc.statistics[name]
+	if !isPresent {
+		statistics = &ClassifierStatistics{}
+		pc.statistics[name] = statistics
+	}
+	statistics.LastRunAt = time.Now()
+	if err != nil {
+		statistics.Errors++
+		statistics.LastError = err.Error()
+	} else {
+		statistics.Classified++
+	}
+}
+
+// readPayloads returns the first maxSize bytes of the client and of the server streams of a connection.
+func (pc *PayloadClassifiers) readPayloads(c context.Context, connectionID RowID, maxSize int) ([]byte, []byte) {
+	var streams []ConnectionStream
+	if err := pc.storage.Find(ConnectionStreams).Context(c).
+		Filter(OrderedDocument{{"connection_id", connectionID}}).
+		Projection(OrderedDocument{{"from_client", 1}, {"document_index", 1}, {"payload", 1}}).
+		Sort("document_index", true).All(&streams); err != nil {
+		log.WithError(err).WithField("connection_id", connectionID).Panic("failed to get connection streams")
+	}
+
+	clientPayload, serverPayload := make([]byte, 0), make([]byte, 0)
+	for _, stream := range streams {
+		if stream.FromClient && len(clientPayload) < maxSize {
+			clientPayload = append(clientPayload, truncatePayload(stream.Payload, maxSize-len(clientPayload))...)
+		} else if !stream.FromClient && len(serverPayload) < maxSize {
+			serverPayload = append(serverPayload, truncatePayload(stream.Payload, maxSize-len(serverPayload))...)
+		}
+	}
+	return clientPayload, serverPayload
+}
+
+func truncatePayload(payload []byte, maxSize int) []byte {
+	if maxSize > 0 && len(payload) > maxSize {
+		return payload[:maxSize]
+	}
+	return payload
+}
+
+func containsPort(ports []uint16, port uint16) bool {
+	for _, elem := range ports {
+		if elem == port {
+			return true
+		}
+	}
+	return false
+}
+
+func newExternalClassifier(settings ClassifierSettings) PayloadClassifier {
+	if settings.Type == ClassifierTypeProcess {
+		return processClassifier{command: settings.Command}
+	}
+	return httpClassifier{url: settings.URL, client: &http.Client{}}
+}
+
+// httpClassifier sends the requests to an http endpoint with POST and reads the labels from the response body.
+type httpClassifier struct {
+	url    string
+	client *http.Client
+}
+
+func (hc httpClassifier) Classify(c context.Context, request ClassificationRequest) ([]ClassificationLabel, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	httpRequest, err := http.NewRequestWithContext(c, http.MethodPost, hc.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	response, err := hc.client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("classifier responded with status %d", response.StatusCode)
+	}
+
+	return decodeClassificationResponse(json.NewDecoder(io.LimitReader(response.Body, maxClassifierOutputSize)))
+}
+
+// processClassifier starts the command for each request, writes the request to its stdin and reads the labels from
+// its stdout.
+type processClassifier struct {
+	command []string
+}
+
+func (pc processClassifier) Classify(c context.Context, request ClassificationRequest) ([]ClassificationLabel, error) {
+	if len(pc.command) == 0 {
+		return nil, errors.New("empty classifier command")
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	command := exec.CommandContext(c, pc.command[0], pc.command[1:]...)
+	command.Stdin = bytes.NewReader(body)
+	stdout := &limitedBuffer{limit: maxClassifierOutputSize}
+	stderr := &limitedBuffer{limit: maxClassifierOutputSize}
+	command.Stdout = stdout
+	command.Stderr = stderr
+	err = command.Run()
+	if stdout.exceeded {
+		return nil, errors.New("classifier output is too large")
+	} else if err != nil {
+		return nil, fmt.Errorf("classifier process failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return decodeClassificationResponse(json.NewDecoder(&stdout.buffer))
+}
+
+func decodeClassificationResponse(decoder *json.Decoder) ([]ClassificationLabel, error) {
+	var response classificationResponse
+	if err := decoder.Decode(&response); err != nil {
+		return nil, fmt.Errorf("invalid classifier response: %v", err)
+	}
+	for _, label := range response.Labels {
+		if label.Label == "" {
+			return nil, errors.New("invalid classifier response: empty label")
+		}
+	}
+	return response.Labels, nil
+}
+
+// limitedBuffer is a buffer which refuses the writes after limit bytes. The buffer is not embedded, otherwise
+// io.Copy would use its ReadFrom and ignore the limit.
+type limitedBuffer struct {
+	buffer   bytes.Buffer
+	limit    int
+	exceeded bool
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	if lb.buffer.Len()+len(p) > lb.limit {
+		lb.exceeded = true
+		return 0, errors.New("buffer limit exceeded")
+	}
+	return lb.buffer.Write(p)
+}
+
+func (lb *limitedBuffer) String() string {
+	return lb.buffer.String()
+}
@@ -0,0 +1,168 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testPayloadClassifier struct {
+	requests []ClassificationRequest
+}
+
+func (tc *testPayloadClassifier) Classify(_ context.Context,
+	request ClassificationRequest) ([]ClassificationLabel, error) {
+	tc.requests = append(tc.requests, request)
+	return []ClassificationLabel{{Label: "exploit", Score: 0.9}}, nil
+}
+
+func TestHTTPClassifier(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ClassificationRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		if string(request.ClientPayload) == "large" {
+			_, _ = w.Write([]byte(`{"labels":[{"label":"` + strings.Repeat("a", maxClassifierOutputSize) + `"}]}`))
+			return
+		}
+		if string(request.ClientPayload) != "GET / HTTP/1.1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"labels":[{"label":"benign","score":0.75}]}`))
+	}))
+	defer server.Close()
+
+	classifier := newExternalClassifier(ClassifierSettings{Type: ClassifierTypeHTTP, URL: server.URL})
+	labels, err := classifier.Classify(context.Background(), ClassificationRequest{
+		ClientPayload: []byte("GET / HTTP/1.1"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []ClassificationLabel{{Label: "benign", Score: 0.75}}, labels)
+
+	_, err = classifier.Classify(context.Background(), ClassificationRequest{})
+	assert.Error(t, err)
+
+	// the responses longer than maxClassifierOutputSize are truncated
+	_, err = classifier.Classify(context.Background(), ClassificationRequest{ClientPayload: []byte("large")})
+	assert.Error(t, err)
+}
+
+func TestProcessClassifier(t *testing.T) {
+	classifier := newExternalClassifier(ClassifierSettings{Type: ClassifierTypeProcess,
+		Command: []string{"sh", "-c", `cat > /dev/null; echo '{"labels":[{"label":"exploit","score":1}]}'`}})
+	labels, err := classifier.Classify(context.Background(), ClassificationRequest{ClientPayload: []byte("payload")})
+	require.NoError(t, err)
+	assert.Equal(t, []ClassificationLabel{{Label: "exploit", Score: 1}}, labels)
+
+	classifier = newExternalClassifier(ClassifierSettings{Type: ClassifierTypeProcess,
+		Command: []string{"sh", "-c", `echo '{"labels":[{"score":1}]}'`}})
+	_, err = classifier.Classify(context.Background(), ClassificationRequest{})
+	assert.Error(t, err)
+
+	classifier = newExternalClassifier(ClassifierSettings{Type: ClassifierTypeProcess,
+		Command: []string{"sh", "-c", "exit 1"}})
+	_, err = classifier.Classify(context.Background(), ClassificationRequest{})
+	assert.Error(t, err)
+
+	classifier = newExternalClassifier(ClassifierSettings{Type: ClassifierTypeProcess,
+		Command: []string{"sh", "-c", "cat > /dev/null; head -c 2000000 /dev/zero"}})
+	_, err = classifier.Classify(context.Background(), ClassificationRequest{})
+	assert.EqualError(t, err, "classifier output is too large")
+}
+
+func TestValidateClassifiersSettings(t *testing.T) {
+	classifiers := &PayloadClassifiers{allowedExecutables: map[string]bool{"/usr/bin/classifier": true}}
+	assert.NoError(t, classifiers.validateSettings(ClassifiersSettings{Classifiers: []ClassifierSettings{
+		{Name: "remote", Type: ClassifierTypeHTTP, URL: "http://localhost"},
+		{Name: "model", Type: ClassifierTypeProcess, Command: []string{"/usr/bin/classifier", "--model", "x"}},
+	}}))
+	assert.Error(t, classifiers.validateSettings(ClassifiersSettings{Classifiers: []ClassifierSettings{
+		{Name: "model", Type: ClassifierTypeProcess, Command: []string{"sh", "-c", "id"}},
+	}}))
+	assert.Error(t, classifiers.validateSettings(ClassifiersSettings{Classifiers: []ClassifierSettings{
+		{Name: "model", Type: ClassifierTypeProcess},
+	}}))
+}
+
+func TestPayloadClassifiers(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Settings)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+
+	classifiers := NewPayloadClassifiers(wrapper.Storage, []string{"/bin/true"}, nil)
+	assert.Error(t, classifiers.SetSettings(ClassifiersSettings{Classifiers: []ClassifierSettings{
+		{Name: "model", Type: ClassifierTypeHTTP, URL: "http://localhost"},
+		{Name: "model", Type: ClassifierTypeProcess, Command: []string{"/bin/true"}},
+	}}))
+
+	processedAt := time.Now().Add(-time.Minute)
+	connectionID := NewRowID()
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(Connection{
+		ID: connectionID, DestinationPort: 80, ProcessedAt: processedAt, ClientBytes: 8, ServerBytes: 4,
+	})
+	require.NoError(t, err)
+	_, err = wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).Many([]interface{}{
+		ConnectionStream{ID: NewRowID(), ConnectionID: connectionID, FromClient: true, DocumentIndex: 0,
+			Payload: []byte("clie")},
+		ConnectionStream{ID: NewRowID(), ConnectionID: connectionID, FromClient: false, DocumentIndex: 0,
+			Payload: []byte("serv")},
+		ConnectionStream{ID: NewRowID(), ConnectionID: connectionID, FromClient: true, DocumentIndex: 1,
+			Payload: []byte("nt")},
+	})
+	require.NoError(t, err)
+
+	classifier := &testPayloadClassifier{}
+	classifiers.RegisterClassifier("model", 6, classifier)
+	classified, err := classifiers.ClassifyNew(wrapper.Context)
+	require.NoError(t, err)
+	assert.Equal(t, 1, classified)
+	require.Len(t, classifier.requests, 1)
+	assert.Equal(t, []byte("client"), classifier.requests[0].ClientPayload)
+	assert.Equal(t, []byte("serv"), classifier.requests[0].ServerPayload)
+	assert.True(t, classifier.requests[0].Truncated)
+
+	var connection Connection
+	require.NoError(t, wrapper.Storage.Find(Connections).Context(wrapper.Context).Filter(byID(connectionID)).
+		First(&connection))
+	assert.Equal(t, Classifications{"model": {{Label: "exploit", Score: 0.9}}}, connection.Classifications)
+	assert.Equal(t, 1, classifiers.GetStatistics()["model"].Classified)
+
+	// the connections already classified are skipped
+	classified, err = classifiers.ClassifyNew(wrapper.Context)
+	require.NoError(t, err)
+	assert.Zero(t, classified)
+
+	classifications, found := classifiers.ClassifyConnection(wrapper.Context, connectionID)
+	assert.True(t, found)
+	assert.Len(t, classifications, 1)
+	assert.Len(t, classifier.requests, 2)
+	_, found = classifiers.ClassifyConnection(wrapper.Context, NewRowID())
+	assert.False(t, found)
+
+	wrapper.Destroy(t)
+}
@@ -0,0 +1,167 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The decoders which can be enabled on the patterns. The matching pipeline scans also the encoded runs of the
+// streams decoded with the decoders of each pattern, up to MaxDecodeDepth nested layers (e.g. url>base64).
+const DecodeLayerURL = "url"
+const DecodeLayerBase64 = "base64"
+const DecodeLayerHex = "hex"
+const MaxDecodeDepth = 2
+
+// maxDecodedChunks is the maximum number of decoded runs scanned for each document
+const maxDecodedChunks = 1024
+
+var payloadDecoders = []struct {
+	layer  string
+	regex  *regexp.Regexp
+	decode func(encoded []byte) ([]byte, bool)
+}{
+	{DecodeLayerURL, regexp.MustCompile(`[^\s"'<>]*%[0-9A-Fa-f]{2}[^\s"'<>]*`), decodeURL},
+	{DecodeLayerBase64, regexp.MustCompile(`[A-Za-z0-9+/_-]{16,}={0,2}`), decodeBase64},
+	{DecodeLayerHex, regexp.MustCompile(`(?:[0-9A-Fa-f]{2}){8,}`), decodeHex},
+}
+
+// decodedChunk is an encoded run of a document decoded with one or more layers. Start and end are the offsets of the
+// outermost encoded run in the document, so that the matches found in the decoded data can be highlighted.
+type decodedChunk struct {
+	layers []string
+	start  int
+	end    int
+	data   []byte
+}
+
+// Layer returns the decoders applied to obtain the chunk, from the outermost (e.g. url>base64).
+func (dc decodedChunk) Layer() string {
+	return strings.Join(dc.layers, ">")
+}
+
+// decodeChunks returns the encoded runs of data decoded with the enabled layers, nested up to MaxDecodeDepth times.
+func decodeChunks(data []byte, enabledLayers map[string]bool) []decodedChunk {
+	var chunks []decodedChunk
+	var decodeRecursive func(data []byte, parent *decodedChunk)
+	decodeRecursive = func(data []byte, parent *decodedChunk) {
+		for _, decoder := range payloadDecoders {
+			if !enabledLayers[decoder.layer] {
+				continue
+			}
+			for _, match := range decoder.regex.FindAllIndex(data, -1) {
+				if len(chunks) >= maxDecodedChunks {
+					return
+				}
+				decoded, ok := decoder.decode(data[match[0]:match[1]])
+				if !ok {
+					continue
+				}
+
+				chunk := decodedChunk{layers: []string{decoder.layer}, start: match[0], end: match[1], data: decoded}
+				if parent != nil {
+					chunk.layers = append(append([]string{}, parent.layers...), decoder.layer)
+					chunk.start, chunk.end = parent.start, parent.end
+				}
+				chunks = append(chunks, chunk)
+				if len(chunk.layers) < MaxDecodeDepth {
+					decodeRecursive(decoded, &chunk)
+				}
+			}
+		}
+	}
+	decodeRecursive(data, nil)
+
+	return chunks
+}
+
+// normalizeDecodeLayers returns the decode layers of a pattern sorted and without duplicates.
+func normalizeDecodeLayers(layers []string) []string {
+	if len(layers) == 0 {
+		return nil
+	}
+	present := make(map[string]bool)
+	normalized := make([]string, 0, len(layers))
+	for _, layer := range layers {
+		if !present[layer] {
+			present[layer] = true
+			normalized = append(normalized, layer)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// layersEnabled reports if all the layers of a decoded chunk are enabled on a pattern.
+func layersEnabled(patternLayers []string, chunkLayers []string) bool {
+	for _, chunkLayer := range chunkLayers {
+		enabled := false
+		for _, patternLayer := range patternLayers {
+			if patternLayer == chunkLayer {
+				enabled = true
+				break
+			}
+		}
+		if !enabled {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeURL(encoded []byte) ([]byte, bool) {
+	decoded, err := url.QueryUnescape(string(encoded))
+	if err != nil {
+		if decoded, err = url.PathUnescape(string(encoded)); err != nil {
+			return nil, false
+		}
+	}
+	return []byte(decoded), true
+}
+
+func decodeBase64(encoded []byte) ([]byte, bool) {
+	trimmed := strings.TrimRight(string(encoded), "=")
+	encoding := base64.RawStdEncoding
+	if strings.ContainsAny(trimmed, "-_") {
+		if strings.ContainsAny(trimmed, "+/") {
+			return nil, false
+		}
+		encoding = base64.RawURLEncoding
+	}
+	if len(trimmed)%4 == 1 {
+		trimmed = trimmed[:len(trimmed)-1]
+	}
+	decoded, err := encoding.DecodeString(trimmed)
+	if err != nil {
+		return nil, false
+	}
+	return decoded, true
+}
+
+func decodeHex(encoded []byte) ([]byte, bool) {
+	decoded, err := hex.DecodeString(string(encoded))
+	if err != nil {
+		return nil, false
+	}
+	return decoded, true
+}
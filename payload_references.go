@@ -0,0 +1,110 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxStreamReferences is the maximum number of distinct references extracted from each stream
+const maxStreamReferences = 256
+
+var (
+	urlRegex      = regexp.MustCompile(`(?i)\b(?:https?|ftps?|wss?)://[^\s"'<>\x60{}|\\^\x00-\x1f\x7f-\xff]+`)
+	hostnameRegex = regexp.MustCompile(`(?i)\b(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,24}\b`)
+	ipv4Regex     = regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4][0-9]|1[0-9][0-9]|[1-9]?[0-9])\.){3}` +
+		`(?:25[0-5]|2[0-4][0-9]|1[0-9][0-9]|[1-9]?[0-9])\b`)
+)
+
+// hostnamesTLDs are the top level domains accepted for the hostnames found outside urls. Without this restriction
+// file names and object properties (e.g. index.html, os.path) would be extracted as hostnames.
+var hostnamesTLDs = map[string]bool{
+	"com": true, "net": true, "org": true, "io": true, "dev": true, "app": true, "info": true, "biz": true,
+	"edu": true, "gov": true, "it": true, "eu": true, "de": true, "fr": true, "uk": true, "us": true, "ru": true,
+	"cn": true, "local": true, "localhost": true, "internal": true, "lan": true, "intranet": true, "corp": true,
+	"home": true, "ctf": true, "test": true, "example": true, "invalid": true, "onion": true,
+}
+
+// extractReferences adds to references the urls, the hostnames and the ip addresses found in data. The hosts of the
+// urls are added as well, so that the connections can be searched by host regardless of the referencing form.
+// Hostnames are lowercase, urls are left untouched.
+func extractReferences(data []byte, references map[string]bool) {
+	add := func(reference string) bool {
+		if len(references) >= maxStreamReferences {
+			return false
+		}
+		references[reference] = true
+		return true
+	}
+
+	for _, match := range urlRegex.FindAll(data, -1) {
+		rawURL := strings.TrimRight(string(match), ".,;:!?)]")
+		if !add(rawURL) {
+			return
+		}
+		if parsedURL, err := url.Parse(rawURL); err == nil && parsedURL.Hostname() != "" {
+			if !add(strings.ToLower(parsedURL.Hostname())) {
+				return
+			}
+		}
+	}
+
+	for _, match := range hostnameRegex.FindAll(data, -1) {
+		hostname := strings.ToLower(string(match))
+		if !hostnamesTLDs[hostname[strings.LastIndexByte(hostname, '.')+1:]] {
+			continue
+		}
+		if !add(hostname) {
+			return
+		}
+	}
+
+	for _, match := range ipv4Regex.FindAll(data, -1) {
+		if ip := net.ParseIP(string(match)); ip != nil && !ip.IsUnspecified() {
+			if !add(ip.String()) {
+				return
+			}
+		}
+	}
+}
+
+// mergeReferences returns the sorted union of the references of the two streams of a connection.
+func mergeReferences(clientReferences, serverReferences map[string]bool) []string {
+	if len(clientReferences) == 0 && len(serverReferences) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]bool, len(clientReferences)+len(serverReferences))
+	for reference := range clientReferences {
+		merged[reference] = true
+	}
+	for reference := range serverReferences {
+		merged[reference] = true
+	}
+
+	references := make([]string, 0, len(merged))
+	for reference := range merged {
+		references = append(references, reference)
+	}
+	sort.Strings(references)
+	return references
+}
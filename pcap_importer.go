@@ -20,17 +20,20 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/tcpassembly"
 	log "github.com/sirupsen/logrus"
+	"math"
 	"net"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -38,16 +41,38 @@ const PcapsBasePath = "pcaps/"
 const ProcessingPcapsBasePath = PcapsBasePath + "processing/"
 const initialAssemblerPoolSize = 16
 const importUpdateProgressInterval = 100 * time.Millisecond
+const maxConcurrentImports = 2
+
+// pcap files have a global header of 24 bytes and each packet record has a header of 16 bytes, they are used to
+// estimate the bytes read of the pcap file while importing
+const pcapGlobalHeaderSize = 24
+const pcapRecordHeaderSize = 16
+
+const (
+	ImportStatusQueued    = "queued"
+	ImportStatusImporting = "importing"
+	ImportStatusCompleted = "completed"
+	ImportStatusCancelled = "cancelled"
+	ImportStatusFailed    = "failed"
+)
 
 type PcapImporter struct {
+	newestPacket           int64 // unix nanoseconds, accessed atomically
+	processedPackets       int64 // accessed atomically
 	storage                Storage
+	streamFactory          *BiDirectionalStreamFactory
 	streamPool             *tcpassembly.StreamPool
+	icmpHandler            *ICMPHandler
 	assemblers             []*tcpassembly.Assembler
 	sessions               map[string]ImportingSession
 	mAssemblers            sync.Mutex
 	mSessions              sync.Mutex
-	serverNet              net.IPNet
+	serverNet              IPNetworks
+	ingestionFilters       *IngestionFilters
 	notificationController *NotificationController
+	pendingImports         sync.WaitGroup
+	importSlots            chan struct{}
+	draining               bool
 }
 
 type ImportingSession struct {
@@ -55,19 +80,33 @@ type ImportingSession struct {
 	StartedAt         time.Time            `json:"started_at" bson:"started_at"`
 	Size              int64                `json:"size" bson:"size"`
 	CompletedAt       time.Time            `json:"completed_at" bson:"completed_at,omitempty"`
+	Status            string               `json:"status" bson:"status"`
+	ProcessedBytes    int64                `json:"processed_bytes" bson:"processed_bytes"`
+	Progress          float64              `json:"progress" bson:"progress"`
 	ProcessedPackets  int                  `json:"processed_packets" bson:"processed_packets"`
 	InvalidPackets    int                  `json:"invalid_packets" bson:"invalid_packets"`
+	FilteredPackets   int                  `json:"filtered_packets" bson:"filtered_packets"`
+	ICMPPackets       int                  `json:"icmp_packets" bson:"icmp_packets"`
+	Connections       int                  `json:"connections" bson:"connections"`
 	PacketsPerService map[uint16]flowCount `json:"packets_per_service" bson:"packets_per_service"`
 	ImportingError    string               `json:"importing_error" bson:"importing_error,omitempty"`
+	BPFFilter         string               `json:"bpf_filter,omitempty" bson:"bpf_filter,omitempty"`
 	cancelFunc        context.CancelFunc
 	completed         chan string
 }
 
 type flowCount [2]int
 
-func NewPcapImporter(storage Storage, serverNet net.IPNet, rulesManager RulesManager,
-	notificationController *NotificationController) *PcapImporter {
-	streamPool := tcpassembly.NewStreamPool(NewBiDirectionalStreamFactory(storage, serverNet, rulesManager))
+func NewPcapImporter(storage Storage, serverNet IPNetworks, rulesManager RulesManager,
+	servicesDetector *ServicesDetector, storageLimits *StorageLimits, geoIP *GeoIP, ingestionFilters *IngestionFilters,
+	scriptsController *ScriptsController, notificationController *NotificationController) *PcapImporter {
+	streamFactory := NewBiDirectionalStreamFactory(storage, serverNet, rulesManager)
+	streamFactory.detector = servicesDetector
+	streamFactory.scriptsController = scriptsController
+	streamFactory.storageLimits = storageLimits
+	streamFactory.geoIP = geoIP
+	streamFactory.notificationController = notificationController
+	streamPool := tcpassembly.NewStreamPool(streamFactory)
 
 	var result []ImportingSession
 	if err := storage.Find(ImportingSessions).All(&result); err != nil {
@@ -80,21 +119,31 @@ func NewPcapImporter(storage Storage, serverNet net.IPNet, rulesManager RulesMan
 
 	return &PcapImporter{
 		storage:                storage,
+		streamFactory:          streamFactory,
 		streamPool:             streamPool,
+		icmpHandler:            NewICMPHandler(streamFactory),
 		assemblers:             make([]*tcpassembly.Assembler, 0, initialAssemblerPoolSize),
 		sessions:               sessions,
 		mAssemblers:            sync.Mutex{},
 		mSessions:              sync.Mutex{},
 		serverNet:              serverNet,
+		ingestionFilters:       ingestionFilters,
 		notificationController: notificationController,
+		importSlots:            make(chan struct{}, maxConcurrentImports),
 	}
 }
 
 // Import a pcap file to the database. The pcap file must be present at the fileName path. If the pcap is already
 // going to be imported or if it has been already imported in the past the function returns an error. Otherwise it
-// create a new session and starts to import the pcap, and returns immediately the session name (that is the sha256
-// of the pcap).
+// create a new session and queues the pcap to be imported, and returns immediately the session name (that is the
+// sha256 of the pcap). The pcaps whose import failed or has been cancelled can be imported again.
 func (pi *PcapImporter) ImportPcap(fileName string, flushAll bool) (string, error) {
+	return pi.ImportPcapWithFilter(fileName, flushAll, "")
+}
+
+// ImportPcapWithFilter imports the pcap like ImportPcap, but only the packets which satisfy the BPF filter are
+// processed, e.g. "ip6 and tcp port 8080". The filter is compiled for the link type of the pcap before queuing it.
+func (pi *PcapImporter) ImportPcapWithFilter(fileName string, flushAll bool, bpfFilter string) (string, error) {
 	switch filepath.Ext(fileName) {
 	case ".pcap":
 	case ".pcapng":
@@ -102,6 +151,12 @@ func (pi *PcapImporter) ImportPcap(fileName string, flushAll bool) (string, erro
 		deleteProcessingFile(fileName)
 		return "", errors.New("invalid file extension")
 	}
+	if bpfFilter != "" {
+		if err := checkBPFFilter(ProcessingPcapsBasePath+fileName, bpfFilter); err != nil {
+			deleteProcessingFile(fileName)
+			return "", err
+		}
+	}
 
 	hash, err := Sha256Sum(ProcessingPcapsBasePath + fileName)
 	if err != nil {
@@ -110,7 +165,13 @@ func (pi *PcapImporter) ImportPcap(fileName string, flushAll bool) (string, erro
 	}
 
 	pi.mSessions.Lock()
-	if _, isPresent := pi.sessions[hash]; isPresent {
+	if pi.draining {
+		pi.mSessions.Unlock()
+		deleteProcessingFile(fileName)
+		return "", errors.New("importer is shutting down")
+	}
+	if session, isPresent := pi.sessions[hash]; isPresent &&
+		session.Status != ImportStatusFailed && session.Status != ImportStatusCancelled {
 		pi.mSessions.Unlock()
 		deleteProcessingFile(fileName)
 		return hash, errors.New("pcap already processed")
@@ -121,15 +182,33 @@ func (pi *PcapImporter) ImportPcap(fileName string, flushAll bool) (string, erro
 		ID:                hash,
 		StartedAt:         time.Now(),
 		Size:              FileSize(ProcessingPcapsBasePath + fileName),
+		Status:            ImportStatusQueued,
 		PacketsPerService: make(map[uint16]flowCount),
+		BPFFilter:         bpfFilter,
 		cancelFunc:        cancelFunc,
 		completed:         make(chan string),
 	}
 
 	pi.sessions[hash] = session
+	pi.pendingImports.Add(1)
 	pi.mSessions.Unlock()
 
-	go pi.parsePcap(session, fileName, flushAll, ctx)
+	go func() {
+		defer pi.pendingImports.Done()
+
+		select {
+		case pi.importSlots <- struct{}{}:
+		case <-ctx.Done():
+			pi.progressUpdate(session, fileName, ImportStatusCancelled, "import process cancelled")
+			return
+		}
+		defer func() {
+			<-pi.importSlots
+		}()
+
+		session.Status = ImportStatusImporting
+		pi.parsePcap(session, fileName, flushAll, ctx)
+	}()
 
 	return hash, nil
 }
@@ -164,6 +243,36 @@ func (pi *PcapImporter) CancelSession(sessionID string) bool {
 	return isPresent
 }
 
+// Drain rejects the new imports and waits for the ones in progress to complete, then flushes all the connections
+// still open in the assemblers. If the context expires before, the imports in progress are cancelled.
+func (pi *PcapImporter) Drain(c context.Context) error {
+	pi.mSessions.Lock()
+	pi.draining = true
+	pi.mSessions.Unlock()
+
+	completed := make(chan struct{})
+	go func() {
+		pi.pendingImports.Wait()
+		close(completed)
+	}()
+
+	select {
+	case <-completed:
+	case <-c.Done():
+		pi.mSessions.Lock()
+		for _, session := range pi.sessions {
+			if session.cancelFunc != nil {
+				session.cancelFunc()
+			}
+		}
+		pi.mSessions.Unlock()
+		<-completed
+	}
+
+	pi.FlushConnections(time.Now(), true)
+	return c.Err()
+}
+
 func (pi *PcapImporter) FlushConnections(olderThen time.Time, closeAll bool) (flushed, closed int) {
 	assembler := pi.takeAssembler()
 	flushed, closed = assembler.FlushWithOptions(tcpassembly.FlushOptions{
@@ -171,31 +280,34 @@ func (pi *PcapImporter) FlushConnections(olderThen time.Time, closeAll bool) (fl
 		CloseAll: closeAll,
 	})
 	pi.releaseAssembler(assembler)
+	closed += pi.icmpHandler.Flush(olderThen, closeAll)
 	return
 }
 
 // Read the pcap and save the tcp stream flow to the database
 func (pi *PcapImporter) parsePcap(session ImportingSession, fileName string, flushAll bool, ctx context.Context) {
-	handle, err := pcap.OpenOffline(ProcessingPcapsBasePath + fileName)
+	source, err := openPcapSource(ProcessingPcapsBasePath+fileName, session.BPFFilter)
 	if err != nil {
-		pi.progressUpdate(session, fileName, false, "failed to process pcap")
+		pi.progressUpdate(session, fileName, ImportStatusFailed, "failed to process pcap")
 		log.WithError(err).WithFields(log.Fields{"session": session, "fileName": fileName}).
 			Error("failed to open pcap")
 		return
 	}
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	packetSource := source.packets
 	packetSource.NoCopy = true
 	assembler := pi.takeAssembler()
+	ingestionFilter := pi.ingestionFilters.currentFilter()
 	packets := packetSource.Packets()
 	updateProgressInterval := time.Tick(importUpdateProgressInterval)
+	session.ProcessedBytes = source.headersSize
 
 	for {
 		select {
 		case <-ctx.Done():
-			handle.Close()
+			source.close()
 			pi.releaseAssembler(assembler)
-			pi.progressUpdate(session, fileName, false, "import process cancelled")
+			pi.progressUpdate(session, fileName, ImportStatusCancelled, "import process cancelled")
 			return
 		default:
 		}
@@ -206,17 +318,32 @@ func (pi *PcapImporter) parsePcap(session ImportingSession, fileName string, flu
 				if flushAll {
 					connectionsClosed := assembler.FlushAll()
 					log.Debugf("connections closed after flush: %v", connectionsClosed)
+					pi.icmpHandler.Flush(time.Time{}, true)
 				}
-				handle.Close()
+				source.close()
 				pi.releaseAssembler(assembler)
-				pi.progressUpdate(session, fileName, true, "")
+				pi.progressUpdate(session, fileName, ImportStatusCompleted, "")
 				pi.notificationController.Notify("pcap.completed", session)
 
 				return
 			}
 
 			session.ProcessedPackets++
-
+			atomic.AddInt64(&pi.processedPackets, 1)
+			session.ProcessedBytes += int64(source.recordHeaderSize + packet.Metadata().CaptureLength)
+			pi.updateNewestPacket(packet.Metadata().Timestamp)
+
+			if echo, isEcho := parseICMPEcho(packet); isEcho {
+				if !pi.isServiceFlow(echo.netFlow) {
+					session.InvalidPackets++
+				} else if ingestionFilter.deniesAddress(pi.outsideAddress(echo.netFlow)) {
+					session.FilteredPackets++
+				} else {
+					session.ICMPPackets++
+					pi.icmpHandler.Handle(echo, "")
+				}
+				continue
+			}
 			if packet.NetworkLayer() == nil || packet.TransportLayer() == nil ||
 				packet.TransportLayer().LayerType() != layers.LayerTypeTCP { // invalid packet
 				session.InvalidPackets++
@@ -225,20 +352,30 @@ func (pi *PcapImporter) parsePcap(session ImportingSession, fileName string, flu
 
 			tcp := packet.TransportLayer().(*layers.TCP)
 			var servicePort uint16
+			var client net.IP
 			var index int
 
 			isDstServer := pi.serverNet.Contains(packet.NetworkLayer().NetworkFlow().Dst().Raw())
 			isSrcServer := pi.serverNet.Contains(packet.NetworkLayer().NetworkFlow().Src().Raw())
 			if isDstServer && !isSrcServer {
 				servicePort = uint16(tcp.DstPort)
+				client = packet.NetworkLayer().NetworkFlow().Src().Raw()
 				index = 0
 			} else if isSrcServer && !isDstServer {
 				servicePort = uint16(tcp.SrcPort)
+				client = packet.NetworkLayer().NetworkFlow().Dst().Raw()
 				index = 1
 			} else {
 				session.InvalidPackets++
 				continue
 			}
+			if ingestionFilter.denies(client, servicePort) {
+				session.FilteredPackets++
+				continue
+			}
+			if tcp.SYN && !tcp.ACK {
+				session.Connections++
+			}
 			fCount, isPresent := session.PacketsPerService[servicePort]
 			if !isPresent {
 				fCount = flowCount{0, 0}
@@ -248,15 +385,40 @@ func (pi *PcapImporter) parsePcap(session ImportingSession, fileName string, flu
 
 			assembler.AssembleWithTimestamp(packet.NetworkLayer().NetworkFlow(), tcp, packet.Metadata().Timestamp)
 		case <-updateProgressInterval:
-			pi.progressUpdate(session, fileName, false, "")
+			pi.progressUpdate(session, fileName, ImportStatusImporting, "")
+		}
+	}
+}
+
+// NewestPacket returns the timestamp of the most recent packet imported, or the zero time if no packet has been
+// imported since the start.
+func (pi *PcapImporter) NewestPacket() time.Time {
+	if newestPacket := atomic.LoadInt64(&pi.newestPacket); newestPacket > 0 {
+		return time.Unix(0, newestPacket)
+	}
+	return time.Time{}
+}
+
+func (pi *PcapImporter) updateNewestPacket(timestamp time.Time) {
+	nanoseconds := timestamp.UnixNano()
+	for {
+		newestPacket := atomic.LoadInt64(&pi.newestPacket)
+		if nanoseconds <= newestPacket || atomic.CompareAndSwapInt64(&pi.newestPacket, newestPacket, nanoseconds) {
+			return
 		}
 	}
 }
 
-func (pi *PcapImporter) progressUpdate(session ImportingSession, fileName string, completed bool, err string) {
+func (pi *PcapImporter) progressUpdate(session ImportingSession, fileName string, status string, err string) {
+	completed := status == ImportStatusCompleted
 	if completed {
 		session.CompletedAt = time.Now()
+		session.Progress = 100
+	} else if session.Size > 0 {
+		// the size of the records of pcapng files is different, the progress is only an estimate
+		session.Progress = math.Min(99, float64(session.ProcessedBytes)*100/float64(session.Size))
 	}
+	session.Status = status
 	session.ImportingError = err
 
 	packetsPerService := session.PacketsPerService
@@ -270,7 +432,9 @@ func (pi *PcapImporter) progressUpdate(session ImportingSession, fileName string
 	pi.mSessions.Unlock()
 
 	if completed || session.ImportingError != "" {
-		if _, _err := pi.storage.Insert(ImportingSessions).One(session); _err != nil {
+		var upsertResults interface{}
+		if _, _err := pi.storage.Update(ImportingSessions).Upsert(&upsertResults).
+			Filter(OrderedDocument{{"_id", session.ID}}).One(session); _err != nil {
 			log.WithError(_err).WithField("session", session).Error("failed to insert importing stats")
 		}
 		if completed {
@@ -282,6 +446,129 @@ func (pi *PcapImporter) progressUpdate(session ImportingSession, fileName string
 	}
 }
 
+// ImportMetrics describe the pcaps waiting to be imported and the workers of the importer.
+type ImportMetrics struct {
+	ProcessedPackets int64 `json:"processed_packets"`
+	QueuedImports    int   `json:"queued_imports"`
+	ActiveImports    int   `json:"active_imports"`
+	ImportSlots      int   `json:"import_slots"`
+	IdleAssemblers   int   `json:"idle_assemblers"`
+}
+
+// ImportMetrics returns the packets read from the pcaps since the start and the current backlog of the imports.
+func (pi *PcapImporter) ImportMetrics() ImportMetrics {
+	metrics := ImportMetrics{
+		ProcessedPackets: atomic.LoadInt64(&pi.processedPackets),
+		ImportSlots:      maxConcurrentImports,
+	}
+
+	pi.mSessions.Lock()
+	for _, session := range pi.sessions {
+		switch session.Status {
+		case ImportStatusQueued:
+			metrics.QueuedImports++
+		case ImportStatusImporting:
+			metrics.ActiveImports++
+		}
+	}
+	pi.mSessions.Unlock()
+
+	pi.mAssemblers.Lock()
+	metrics.IdleAssemblers = len(pi.assemblers)
+	pi.mAssemblers.Unlock()
+
+	return metrics
+}
+
+// AssemblyMetrics returns the metrics of the reassembly of the connections.
+func (pi *PcapImporter) AssemblyMetrics() AssemblyMetrics {
+	return pi.streamFactory.AssemblyMetrics()
+}
+
+// ScannerMetrics returns the metrics of the scratch spaces used to match the patterns of the rules.
+func (pi *PcapImporter) ScannerMetrics() ScannerMetrics {
+	return pi.streamFactory.ScannerMetrics()
+}
+
+// NewSensorAssembler returns an assembler whose connections are tagged with the name of the sensor. The assembler is
+// not shared with the imports of the pcaps and it must be used by a single goroutine.
+func (pi *PcapImporter) NewSensorAssembler(sensor string) *tcpassembly.Assembler {
+	return tcpassembly.NewAssembler(tcpassembly.NewStreamPool(sensorStreamFactory{pi.streamFactory, sensor}))
+}
+
+// isServiceFlow reports whether exactly one of the endpoints of the flow belongs to the server network.
+func (pi *PcapImporter) isServiceFlow(netFlow gopacket.Flow) bool {
+	return pi.serverNet.Contains(netFlow.Src().Raw()) != pi.serverNet.Contains(netFlow.Dst().Raw())
+}
+
+// pcapSource is an opened pcap or pcapng file, with the sizes of its headers used to estimate the bytes read.
+type pcapSource struct {
+	packets          *gopacket.PacketSource
+	close            func()
+	headersSize      int64
+	recordHeaderSize int
+}
+
+// openPcapSource opens a pcap with libpcap, or a pcapng with pcapngSource. The format is detected from the content
+// of the file. If bpfFilter is not empty, only the packets which satisfy the filter are read.
+func openPcapSource(filePath string, bpfFilter string) (pcapSource, error) {
+	if ng, err := isPcapng(filePath); err != nil {
+		return pcapSource{}, err
+	} else if ng {
+		source, err := openPcapngSource(filePath, bpfFilter)
+		if err != nil {
+			return pcapSource{}, err
+		}
+		return pcapSource{gopacket.NewPacketSource(source, source), source.Close, pcapngHeadersSize,
+			pcapngRecordHeaderSize}, nil
+	}
+
+	handle, err := pcap.OpenOffline(filePath)
+	if err != nil {
+		return pcapSource{}, err
+	}
+	if bpfFilter != "" {
+		if err := handle.SetBPFFilter(bpfFilter); err != nil {
+			handle.Close()
+			return pcapSource{}, err
+		}
+	}
+	return pcapSource{gopacket.NewPacketSource(handle, handle.LinkType()), handle.Close, pcapGlobalHeaderSize,
+		pcapRecordHeaderSize}, nil
+}
+
+// checkBPFFilter returns an error if the filter can't be compiled for the link type of the pcap. The link types of
+// the interfaces of a pcapng are known only when the packets are read, so its filter is compiled for ethernet.
+func checkBPFFilter(filePath string, bpfFilter string) error {
+	if ng, err := isPcapng(filePath); err != nil {
+		return err
+	} else if ng {
+		if _, err := pcap.NewBPF(layers.LinkTypeEthernet, captureSnapshotLength, bpfFilter); err != nil {
+			return fmt.Errorf("invalid bpf filter: %s", err.Error())
+		}
+		return nil
+	}
+
+	handle, err := pcap.OpenOffline(filePath)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	if err := handle.SetBPFFilter(bpfFilter); err != nil {
+		return fmt.Errorf("invalid bpf filter: %s", err.Error())
+	}
+	return nil
+}
+
+// outsideAddress returns the address of a service flow which is not in the server network.
+func (pi *PcapImporter) outsideAddress(netFlow gopacket.Flow) net.IP {
+	if pi.serverNet.Contains(netFlow.Src().Raw()) {
+		return netFlow.Dst().Raw()
+	}
+	return netFlow.Src().Raw()
+}
+
 func (pi *PcapImporter) takeAssembler() *tcpassembly.Assembler {
 	pi.mAssemblers.Lock()
 	defer pi.mAssemblers.Unlock()
@@ -19,6 +19,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/tcpassembly"
@@ -55,6 +56,10 @@ func TestImportPcap(t *testing.T) {
 	assert.Equal(t, 0, session.InvalidPackets)
 	assert.Equal(t, map[uint16]flowCount{9999: {10004, 5004}}, session.PacketsPerService)
 	assert.Zero(t, session.ImportingError)
+	assert.Equal(t, ImportStatusCompleted, session.Status)
+	assert.Equal(t, float64(100), session.Progress)
+	assert.Equal(t, session.Size, session.ProcessedBytes)
+	assert.NotZero(t, session.Connections)
 
 	checkSessionEquals(t, wrapper, session)
 
@@ -64,6 +69,29 @@ func TestImportPcap(t *testing.T) {
 	wrapper.Destroy(t)
 }
 
+func TestImportPcapWithIngestionFilters(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	pcapImporter := newTestPcapImporter(wrapper, "172.17.0.3")
+	filter, err := compileIngestionFilter(IngestionFiltersSettings{DeniedPorts: []uint16{9999}})
+	require.NoError(t, err)
+	pcapImporter.ingestionFilters = &IngestionFilters{filter: filter}
+
+	fileName := copyToProcessing(t, "ping_pong_10000.pcap")
+	sessionID, err := pcapImporter.ImportPcap(fileName, false)
+	require.NoError(t, err)
+
+	session := waitSessionCompletion(t, pcapImporter, sessionID)
+	assert.Equal(t, 15008, session.ProcessedPackets)
+	assert.Equal(t, 15008, session.FilteredPackets)
+	assert.Empty(t, session.PacketsPerService)
+	assert.Zero(t, session.Connections)
+	assert.Equal(t, ImportStatusCompleted, session.Status)
+
+	assert.NoError(t, os.Remove(PcapsBasePath+session.ID+".pcap"))
+
+	wrapper.Destroy(t)
+}
+
 func TestCancelImportSession(t *testing.T) {
 	wrapper := NewTestStorageWrapper(t)
 	pcapImporter := newTestPcapImporter(wrapper, "172.17.0.3")
@@ -82,12 +110,25 @@ func TestCancelImportSession(t *testing.T) {
 	assert.Equal(t, 0, session.InvalidPackets)
 	// assert.Equal(t, map[uint16]flowCount{}, session.PacketsPerService)
 	assert.NotZero(t, session.ImportingError)
+	assert.Equal(t, ImportStatusCancelled, session.Status)
 
 	checkSessionEquals(t, wrapper, session)
 
 	assert.Error(t, os.Remove(ProcessingPcapsBasePath + fileName))
 	assert.Error(t, os.Remove(PcapsBasePath + sessionID + ".pcap"))
 
+	// a cancelled pcap can be imported again
+	fileName = copyToProcessing(t, "ping_pong_10000.pcap")
+	reimportedSessionID, err := pcapImporter.ImportPcap(fileName, false)
+	require.NoError(t, err)
+	assert.Equal(t, sessionID, reimportedSessionID)
+
+	session = waitSessionCompletion(t, pcapImporter, sessionID)
+	assert.Equal(t, ImportStatusCompleted, session.Status)
+	assert.Zero(t, session.ImportingError)
+	checkSessionEquals(t, wrapper, session)
+	assert.NoError(t, os.Remove(PcapsBasePath + sessionID + ".pcap"))
+
 	wrapper.Destroy(t)
 }
 
@@ -114,6 +155,57 @@ func TestImportNoTcpPackets(t *testing.T) {
 	wrapper.Destroy(t)
 }
 
+func TestImportPcapQueue(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	pcapImporter := newTestPcapImporter(wrapper, "172.17.0.3")
+	pcapImporter.importSlots = make(chan struct{}, 1)
+
+	firstSessionID, err := pcapImporter.ImportPcap(copyToProcessing(t, "ping_pong_10000.pcap"), false)
+	require.NoError(t, err)
+	secondSessionID, err := pcapImporter.ImportPcap(copyToProcessing(t, "icmp.pcap"), false)
+	require.NoError(t, err)
+
+	session, isPresent := pcapImporter.GetSession(secondSessionID)
+	require.True(t, isPresent)
+	assert.Contains(t, []string{ImportStatusQueued, ImportStatusImporting}, session.Status)
+
+	firstSession := waitSessionCompletion(t, pcapImporter, firstSessionID)
+	secondSession := waitSessionCompletion(t, pcapImporter, secondSessionID)
+	assert.Equal(t, ImportStatusCompleted, firstSession.Status)
+	assert.Equal(t, ImportStatusCompleted, secondSession.Status)
+	assert.False(t, secondSession.CompletedAt.Before(firstSession.CompletedAt))
+	assert.Len(t, pcapImporter.importSlots, 0)
+
+	assert.NoError(t, os.Remove(PcapsBasePath+firstSessionID+".pcap"))
+	assert.NoError(t, os.Remove(PcapsBasePath+secondSessionID+".pcap"))
+
+	wrapper.Destroy(t)
+}
+
+func TestDrainPcapImporter(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	pcapImporter := newTestPcapImporter(wrapper, "172.17.0.3")
+
+	fileName := copyToProcessing(t, "ping_pong_10000.pcap")
+	sessionID, err := pcapImporter.ImportPcap(fileName, false)
+	require.NoError(t, err)
+
+	assert.NoError(t, pcapImporter.Drain(context.Background()))
+	session, isPresent := pcapImporter.GetSession(sessionID)
+	assert.True(t, isPresent)
+	assert.NotZero(t, session.CompletedAt)
+	assert.Zero(t, session.ImportingError)
+
+	rejectedFileName := copyToProcessing(t, "icmp.pcap")
+	_, err = pcapImporter.ImportPcap(rejectedFileName, false)
+	assert.Error(t, err)
+	assert.Error(t, os.Remove(ProcessingPcapsBasePath+rejectedFileName))
+
+	assert.NoError(t, os.Remove(PcapsBasePath+sessionID+".pcap"))
+
+	wrapper.Destroy(t)
+}
+
 func newTestPcapImporter(wrapper *TestStorageWrapper, serverAddress string) *PcapImporter {
 	wrapper.AddCollection(ImportingSessions)
 
@@ -126,8 +218,9 @@ func newTestPcapImporter(wrapper *TestStorageWrapper, serverAddress string) *Pca
 		sessions:    make(map[string]ImportingSession),
 		mAssemblers: sync.Mutex{},
 		mSessions:   sync.Mutex{},
-		serverNet:   *ParseIPNet(serverAddress),
+		serverNet:   ParseIPNetworks(serverAddress),
 		notificationController: NewNotificationController(nil),
+		importSlots: make(chan struct{}, maxConcurrentImports),
 	}
 }
 
@@ -0,0 +1,133 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapngMagic is the block type of the section header block, which starts the pcapng files
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// pcapng files have a section header block and an interface description block of at least 28 and 20 bytes, and each
+// packet is in an enhanced packet block with 32 bytes of headers, they are used to estimate the bytes read
+const pcapngHeadersSize = 48
+const pcapngRecordHeaderSize = 32
+
+// isPcapng reports whether the file is a pcapng, regardless of its extension.
+func isPcapng(filePath string) (bool, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(pcapngMagic))
+	if _, err := io.ReadFull(file, magic); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return bytes.Equal(magic, pcapngMagic), nil
+}
+
+// pcapngSource reads the packets of a pcapng file. Unlike libpcap, the interfaces described in the file can have
+// different link types, and each packet is decoded with the link type of its interface. The timestamps are converted
+// with the resolution of each interface, so the nanoseconds are preserved. pcapngSource is both the data source and
+// the decoder of a gopacket.PacketSource, which decodes each packet right after reading it.
+type pcapngSource struct {
+	file      *os.File
+	reader    *pcapgo.NgReader
+	linkType  layers.LinkType
+	bpfFilter string
+	filters   map[layers.LinkType]*pcap.BPF
+}
+
+// openPcapngSource opens a pcapng file. If bpfFilter is not empty, only the packets which satisfy the filter are
+// read, and the filter is compiled for the link type of each interface.
+func openPcapngSource(filePath string, bpfFilter string) (*pcapngSource, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := pcapgo.NewNgReader(file, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return &pcapngSource{
+		file:      file,
+		reader:    reader,
+		bpfFilter: bpfFilter,
+		filters:   make(map[layers.LinkType]*pcap.BPF),
+	}, nil
+}
+
+func (s *pcapngSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, captureInfo, err := s.reader.ReadPacketData()
+		if err != nil {
+			return nil, captureInfo, err
+		}
+		linkType := s.reader.LinkType()
+		if len(captureInfo.AncillaryData) > 0 {
+			if interfaceLinkType, ok := captureInfo.AncillaryData[0].(layers.LinkType); ok {
+				linkType = interfaceLinkType
+			}
+		}
+
+		if s.bpfFilter != "" {
+			filter, err := s.filter(linkType)
+			if err != nil {
+				return nil, captureInfo, err
+			}
+			if !filter.Matches(captureInfo, data) {
+				continue
+			}
+		}
+		s.linkType = linkType
+		return data, captureInfo, nil
+	}
+}
+
+// Decode decodes the last packet read with the link type of its interface.
+func (s *pcapngSource) Decode(data []byte, builder gopacket.PacketBuilder) error {
+	return s.linkType.Decode(data, builder)
+}
+
+func (s *pcapngSource) Close() {
+	_ = s.file.Close()
+}
+
+func (s *pcapngSource) filter(linkType layers.LinkType) (*pcap.BPF, error) {
+	if filter, isPresent := s.filters[linkType]; isPresent {
+		return filter, nil
+	}
+	filter, err := pcap.NewBPF(linkType, captureSnapshotLength, s.bpfFilter)
+	if err != nil {
+		return nil, err
+	}
+	s.filters[linkType] = filter
+	return filter, nil
+}
@@ -0,0 +1,98 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPcapngSource(t *testing.T) {
+	directory, err := ioutil.TempDir("", "caronte-pcapng")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	serialize := func(serializableLayers ...gopacket.SerializableLayer) []byte {
+		buffer := gopacket.NewSerializeBuffer()
+		options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		require.NoError(t, gopacket.SerializeLayers(buffer, options, serializableLayers...))
+		return buffer.Bytes()
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.ParseIP("10.10.10.1"), DstIP: net.ParseIP("10.10.10.10")}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 8080, SYN: true}
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+	ethernet := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4}
+
+	// two interfaces with different link types, which libpcap can't read
+	fileName := filepath.Join(directory, "capture.pcap")
+	file, err := os.Create(fileName)
+	require.NoError(t, err)
+	writer, err := pcapgo.NewNgWriter(file, layers.LinkTypeEthernet)
+	require.NoError(t, err)
+	rawInterface := pcapgo.DefaultNgInterface
+	rawInterface.LinkType = layers.LinkTypeRaw
+	rawID, err := writer.AddInterface(rawInterface)
+	require.NoError(t, err)
+
+	timestamp := time.Unix(1600000000, 123456789)
+	packets := [][]byte{serialize(ethernet, ip, tcp), serialize(ip, tcp)}
+	for i, data := range packets {
+		interfaceIndex := 0
+		if i == 1 {
+			interfaceIndex = rawID
+		}
+		require.NoError(t, writer.WritePacket(gopacket.CaptureInfo{Timestamp: timestamp.Add(time.Duration(i)),
+			CaptureLength: len(data), Length: len(data), InterfaceIndex: interfaceIndex}, data))
+	}
+	require.NoError(t, writer.Flush())
+	require.NoError(t, file.Close())
+
+	ng, err := isPcapng(fileName)
+	require.NoError(t, err)
+	assert.True(t, ng)
+	ng, err = isPcapng("test_data/ping_pong_10000.pcap")
+	require.NoError(t, err)
+	assert.False(t, ng)
+
+	source, err := openPcapngSource(fileName, "")
+	require.NoError(t, err)
+	defer source.Close()
+	packetSource := gopacket.NewPacketSource(source, source)
+	for i := range packets {
+		packet, err := packetSource.NextPacket()
+		require.NoError(t, err)
+		require.NotNil(t, packet.TransportLayer())
+		assert.Equal(t, layers.LayerTypeTCP, packet.TransportLayer().LayerType())
+		assert.Equal(t, "10.10.10.1", packet.NetworkLayer().NetworkFlow().Src().String())
+		assert.Equal(t, timestamp.Add(time.Duration(i)).UnixNano(), packet.Metadata().Timestamp.UnixNano())
+	}
+	_, err = packetSource.NextPacket()
+	assert.Error(t, err)
+}
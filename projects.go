@@ -0,0 +1,182 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultProjectName = "default"
+const activeProjectSettingsKey = "active_project"
+
+var projectNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Project is a separate capture session, e.g. a CTF, whose rules, connections, services and settings are saved in a
+// database on its own. The default project uses the database passed at the start.
+type Project struct {
+	ID        RowID     `json:"id" bson:"_id"`
+	Name      string    `json:"name" bson:"name"`
+	Database  string    `json:"database" bson:"database"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// NewProject contains the name and the configuration of a project to create. The new project has the auth
+// requirement of the active project, since the accounts are shared between all the projects.
+type NewProject struct {
+	Name   string `json:"name" binding:"required,max=32"`
+	Config Config `json:"config" binding:"required"`
+}
+
+func DefaultProject() Project {
+	return Project{ID: ZeroRowID, Name: defaultProjectName}
+}
+
+type ProjectsController struct {
+	storage            *MongoStorage
+	applicationContext *ApplicationContext
+	projects           map[RowID]Project
+	mutex              sync.Mutex
+}
+
+// NewProjectsController loads the projects saved in the main database and activates the project which was active
+// before the restart.
+func NewProjectsController(storage *MongoStorage, applicationContext *ApplicationContext) *ProjectsController {
+	var projects []Project
+	if err := storage.Find(Projects).All(&projects); err != nil {
+		log.WithError(err).Panic("failed to retrieve projects")
+	}
+	var activeID RowID
+	if err := LoadSettings(storage, activeProjectSettingsKey, &activeID); err != nil {
+		log.WithError(err).Panic("failed to retrieve the active project")
+	}
+
+	defaultProject := DefaultProject()
+	defaultProject.Database = storage.DatabaseName()
+	pc := &ProjectsController{
+		storage:            storage,
+		applicationContext: applicationContext,
+		projects:           map[RowID]Project{defaultProject.ID: defaultProject},
+	}
+	for _, project := range projects {
+		pc.projects[project.ID] = project
+	}
+
+	if project, isPresent := pc.projects[activeID]; isPresent && activeID != defaultProject.ID {
+		if err := applicationContext.SwitchProject(project, pc.openStorage); err != nil {
+			log.WithError(err).WithField("project", project.Name).Error("failed to activate the project")
+		}
+	}
+
+	return pc
+}
+
+func (pc *ProjectsController) GetProjects() []Project {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	projects := make([]Project, 0, len(pc.projects))
+	for _, project := range pc.projects {
+		projects = append(projects, project)
+	}
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].CreatedAt.Before(projects[j].CreatedAt)
+	})
+	return projects
+}
+
+func (pc *ProjectsController) GetActiveProject() Project {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	return pc.projects[pc.applicationContext.ActiveProject().Project.ID]
+}
+
+// CreateProject saves a new project and the configuration of its database. The project is not activated.
+func (pc *ProjectsController) CreateProject(c context.Context, newProject NewProject) (Project, error) {
+	if !projectNamePattern.MatchString(newProject.Name) {
+		return Project{}, errors.New("the name can contain only lowercase letters, digits, dashes and underscores")
+	}
+	if newProject.Config.ServerNetworks() == nil {
+		return Project{}, errors.New("invalid server address")
+	}
+	if _, err := regexp.Compile(newProject.Config.FlagRegex); err != nil {
+		return Project{}, errors.New("invalid flag regex")
+	}
+	project := Project{
+		ID:        NewRowID(),
+		Name:      newProject.Name,
+		Database:  pc.storage.DatabaseName() + "_" + newProject.Name,
+		CreatedAt: time.Now(),
+	}
+
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	for _, other := range pc.projects {
+		if other.Name == project.Name {
+			return Project{}, errors.New("duplicate name")
+		}
+	}
+
+	projectStorage, err := pc.openStorage(project)
+	if err != nil {
+		return Project{}, err
+	}
+	newProject.Config.AuthRequired = pc.applicationContext.ActiveProject().Config.AuthRequired
+	if err := SaveSettings(projectStorage, "config", newProject.Config); err != nil {
+		return Project{}, err
+	}
+	if _, err := pc.storage.Insert(Projects).Context(c).One(project); err != nil {
+		return Project{}, errors.New("duplicate name")
+	}
+	pc.projects[project.ID] = project
+
+	return project, nil
+}
+
+// ActivateProject makes the project identified by id the active one, starting its components if it is activated for
+// the first time. Returns false if the project does not exist.
+func (pc *ProjectsController) ActivateProject(id RowID) (bool, error) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	project, isPresent := pc.projects[id]
+	if !isPresent {
+		return false, nil
+	}
+	if err := pc.applicationContext.SwitchProject(project, pc.openStorage); err != nil {
+		return true, err
+	}
+	if err := SaveSettings(pc.storage, activeProjectSettingsKey, id); err != nil {
+		log.WithError(err).WithField("project", project.Name).Error("failed to save the active project")
+	}
+
+	return true, nil
+}
+
+func (pc *ProjectsController) openStorage(project Project) (Storage, error) {
+	if project.Database == pc.storage.DatabaseName() {
+		return pc.storage, nil
+	}
+	return pc.storage.Database(project.Database)
+}
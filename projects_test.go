@@ -0,0 +1,90 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestProjectsController(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+
+	appContext, err := CreateApplicationContext(wrapper.Storage, "test")
+	require.NoError(t, err)
+	appContext.SetNotificationController(NewNotificationController(appContext))
+	appContext.SetConfig(Config{ServerAddress: "10.10.10.10", FlagRegex: "FLAG{test}", AuthRequired: true})
+	defaultStorage := appContext.ActiveProject().Storage
+
+	controller := NewProjectsController(wrapper.Storage, appContext)
+	projects := controller.GetProjects()
+	require.Len(t, projects, 1)
+	assert.Equal(t, defaultProjectName, projects[0].Name)
+	assert.Equal(t, wrapper.DbName, projects[0].Database)
+	assert.Equal(t, projects[0], controller.GetActiveProject())
+
+	config := Config{ServerAddress: "10.10.20.10", FlagRegex: "FLAG{other}"}
+	_, err = controller.CreateProject(wrapper.Context, NewProject{Name: "Invalid Name", Config: config})
+	assert.Error(t, err)
+	_, err = controller.CreateProject(wrapper.Context, NewProject{Name: defaultProjectName, Config: config})
+	assert.Error(t, err)
+	_, err = controller.CreateProject(wrapper.Context, NewProject{Name: "ctf",
+		Config: Config{ServerAddress: "invalid", FlagRegex: "FLAG{other}"}})
+	assert.Error(t, err)
+
+	project, err := controller.CreateProject(wrapper.Context, NewProject{Name: "ctf", Config: config})
+	require.NoError(t, err)
+	assert.Equal(t, wrapper.DbName+"_ctf", project.Database)
+	assert.Len(t, controller.GetProjects(), 2)
+	assert.Equal(t, defaultProjectName, controller.GetActiveProject().Name)
+
+	isPresent, err := controller.ActivateProject(NewRowID())
+	assert.False(t, isPresent)
+	assert.NoError(t, err)
+
+	isPresent, err = controller.ActivateProject(project.ID)
+	assert.True(t, isPresent)
+	require.NoError(t, err)
+	assert.Equal(t, project, controller.GetActiveProject())
+	assert.True(t, appContext.ActiveProject().IsConfigured)
+	assert.Equal(t, "10.10.20.10", appContext.ActiveProject().Config.ServerAddress)
+	assert.True(t, appContext.ActiveProject().Config.AuthRequired) // inherited from the active project
+	assert.NotEqual(t, defaultStorage, appContext.ActiveProject().Storage)
+	// only the flag rules of the project
+	assert.Len(t, appContext.ActiveProject().RulesManager.GetRules(), 2)
+
+	// the active project is restored after a restart
+	restartedContext, err := CreateApplicationContext(wrapper.Storage, "test")
+	require.NoError(t, err)
+	restartedContext.SetNotificationController(NewNotificationController(restartedContext))
+	restartedContext.Configure()
+	restartedController := NewProjectsController(wrapper.Storage, restartedContext)
+	assert.Equal(t, project.ID, restartedController.GetActiveProject().ID)
+	assert.Equal(t, "10.10.20.10", restartedContext.ActiveProject().Config.ServerAddress)
+
+	isPresent, err = controller.ActivateProject(ZeroRowID)
+	assert.True(t, isPresent)
+	require.NoError(t, err)
+	assert.Equal(t, defaultStorage, appContext.ActiveProject().Storage)
+	assert.Equal(t, "10.10.10.10", appContext.ActiveProject().Config.ServerAddress)
+
+	assert.NoError(t, appContext.Shutdown(wrapper.Context))
+	assert.NoError(t, restartedContext.Shutdown(wrapper.Context))
+	wrapper.Destroy(t)
+}
@@ -0,0 +1,612 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const proxySettingsKey = "proxy"
+
+// The modes of the proxy listeners: tcp forwards all the connections to a fixed target, socks5 and http let the
+// clients choose the target with a SOCKS5 handshake or with the HTTP CONNECT method.
+const (
+	ProxyModeTCP    = "tcp"
+	ProxyModeSocks5 = "socks5"
+	ProxyModeHTTP   = "http"
+)
+
+const (
+	proxyDialTimeout      = 10 * time.Second
+	proxyHandshakeTimeout = 10 * time.Second
+	proxyBufferSize       = 32 * 1024
+	// proxyChunksQueueSize is the number of chunks waiting to be recorded, then the forwarding slows down
+	proxyChunksQueueSize = 1024
+	proxyFlushInterval   = 30 * time.Second
+)
+
+var errProxyTargetNotAllowed = errors.New("the target is not an address of the server")
+
+// ProxyListener is a port where the proxy accepts the connections to forward to the services of the server. Target is
+// the address of the service, required in tcp mode. Only the addresses of the server can be targets, so that the
+// proxy can't be used to reach other hosts.
+type ProxyListener struct {
+	Name          string `json:"name" binding:"required,max=64" bson:"name"`
+	Mode          string `json:"mode" binding:"required,oneof=tcp socks5 http" bson:"mode"`
+	ListenAddress string `json:"listen_address" binding:"required" bson:"listen_address"`
+	Target        string `json:"target" binding:"required_if=Mode tcp" bson:"target,omitempty"`
+	Enabled       bool   `json:"enabled" bson:"enabled"`
+}
+
+type ProxySettings struct {
+	Listeners []ProxyListener `json:"listeners" binding:"dive" bson:"listeners"`
+}
+
+type ProxyListenerStatus struct {
+	Name                string    `json:"name"`
+	Listening           bool      `json:"listening"`
+	ActiveConnections   int64     `json:"active_connections"`
+	TotalConnections    int64     `json:"total_connections"`
+	RejectedConnections int64     `json:"rejected_connections"`
+	ClientBytes         int64     `json:"client_bytes"`
+	ServerBytes         int64     `json:"server_bytes"`
+	LastActivity        time.Time `json:"last_activity,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+// InlineProxy forwards the connections accepted by its listeners to the services of the server, and records both the
+// directions of the forwarded traffic as chunks of streams, processed as the chunks sent by the sensors. The
+// connections are tagged with the sensor proxy:<listener name>.
+type InlineProxy struct {
+	storage                Storage
+	pcapImporter           *PcapImporter
+	notificationController *NotificationController
+	settings               ProxySettings
+	statuses               map[string]*ProxyListenerStatus
+	cancelFunc             context.CancelFunc
+	stopped                chan struct{}
+	mutex                  sync.Mutex
+	// mStatuses protects statuses and their values, which are updated by the proxied connections
+	mStatuses sync.Mutex
+}
+
+func NewInlineProxy(storage Storage, pcapImporter *PcapImporter,
+	notificationController *NotificationController) *InlineProxy {
+	ip := &InlineProxy{
+		storage:                storage,
+		pcapImporter:           pcapImporter,
+		notificationController: notificationController,
+		statuses:               make(map[string]*ProxyListenerStatus),
+	}
+
+	if err := LoadSettings(storage, proxySettingsKey, &ip.settings); err != nil {
+		log.WithError(err).Panic("failed to retrieve proxy settings")
+	}
+	if err := ip.start(); err != nil {
+		log.WithError(err).Error("failed to start the proxy listeners")
+	}
+
+	return ip
+}
+
+func (ip *InlineProxy) GetSettings() ProxySettings {
+	ip.mutex.Lock()
+	defer ip.mutex.Unlock()
+
+	return ProxySettings{Listeners: append([]ProxyListener{}, ip.settings.Listeners...)}
+}
+
+// SetSettings saves the settings and restarts the listeners. The connections in progress are closed.
+func (ip *InlineProxy) SetSettings(settings ProxySettings) error {
+	if err := ip.validate(settings); err != nil {
+		return err
+	}
+
+	ip.mutex.Lock()
+	defer ip.mutex.Unlock()
+
+	if err := SaveSettings(ip.storage, proxySettingsKey, settings); err != nil {
+		return err
+	}
+
+	return ip.apply(settings)
+}
+
+// ReloadSettings reads the settings again from the database, discarding the ones in memory, and restarts the
+// listeners.
+func (ip *InlineProxy) ReloadSettings() error {
+	var settings ProxySettings
+	if err := LoadSettings(ip.storage, proxySettingsKey, &settings); err != nil {
+		return err
+	}
+	if err := ip.validate(settings); err != nil {
+		return err
+	}
+
+	ip.mutex.Lock()
+	defer ip.mutex.Unlock()
+
+	return ip.apply(settings)
+}
+
+func (ip *InlineProxy) GetListeners() []ProxyListenerStatus {
+	ip.mStatuses.Lock()
+	defer ip.mStatuses.Unlock()
+
+	listeners := make([]ProxyListenerStatus, 0, len(ip.statuses))
+	for _, status := range ip.statuses {
+		listeners = append(listeners, *status)
+	}
+	sort.Slice(listeners, func(i, j int) bool {
+		return listeners[i].Name < listeners[j].Name
+	})
+	return listeners
+}
+
+// Stop closes the listeners and the connections in progress, and waits the traffic forwarded until then to be
+// recorded. It is used when shutting down.
+func (ip *InlineProxy) Stop() {
+	ip.mutex.Lock()
+	defer ip.mutex.Unlock()
+
+	ip.stop()
+}
+
+func (ip *InlineProxy) validate(settings ProxySettings) error {
+	names := make(map[string]bool, len(settings.Listeners))
+	for _, listener := range settings.Listeners {
+		if names[listener.Name] {
+			return fmt.Errorf("duplicate listener name %s", listener.Name)
+		}
+		names[listener.Name] = true
+		if _, _, err := net.SplitHostPort(listener.ListenAddress); err != nil {
+			return fmt.Errorf("invalid listen address of %s: %s", listener.Name, err.Error())
+		}
+		if listener.Mode == ProxyModeTCP {
+			if _, err := ip.resolveTarget(listener.Target); err != nil {
+				return fmt.Errorf("invalid target of %s: %s", listener.Name, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// apply must be called with the mutex held.
+func (ip *InlineProxy) apply(settings ProxySettings) error {
+	ip.stop()
+	ip.settings = settings
+
+	return ip.start()
+}
+
+// start opens the enabled listeners. The listeners which can't be opened are reported in their status, and the
+// error of the first of them is returned. Must be called with the mutex held.
+func (ip *InlineProxy) start() error {
+	ip.mStatuses.Lock()
+	ip.statuses = make(map[string]*ProxyListenerStatus, len(ip.settings.Listeners))
+	for _, listener := range ip.settings.Listeners {
+		ip.statuses[listener.Name] = &ProxyListenerStatus{Name: listener.Name}
+	}
+	ip.mStatuses.Unlock()
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	ip.cancelFunc = cancelFunc
+	ip.stopped = make(chan struct{})
+
+	var firstErr error
+	var servers sync.WaitGroup
+	for _, listener := range ip.settings.Listeners {
+		if !listener.Enabled {
+			continue
+		}
+		netListener, err := net.Listen("tcp", listener.ListenAddress)
+		if err != nil {
+			ip.listenerError(listener.Name, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to listen on %s: %s", listener.ListenAddress, err.Error())
+			}
+			continue
+		}
+
+		ip.updateStatus(listener.Name, func(status *ProxyListenerStatus) {
+			status.Listening = true
+		})
+		servers.Add(1)
+		go func(listener ProxyListener, netListener net.Listener) {
+			defer servers.Done()
+			ip.serve(ctx, listener, netListener)
+		}(listener, netListener)
+	}
+	go func(stopped chan struct{}) {
+		servers.Wait()
+		close(stopped)
+	}(ip.stopped)
+
+	return firstErr
+}
+
+// stop must be called with the mutex held.
+func (ip *InlineProxy) stop() {
+	if ip.cancelFunc == nil {
+		return
+	}
+
+	ip.cancelFunc()
+	<-ip.stopped
+	ip.cancelFunc = nil
+}
+
+// serve accepts the connections of a listener until the context is cancelled. The chunks of all the connections are
+// recorded by a single goroutine, because the assembler of the listener can't be shared.
+func (ip *InlineProxy) serve(ctx context.Context, listener ProxyListener, netListener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		_ = netListener.Close()
+	}()
+
+	sensor := "proxy:" + listener.Name
+	session := &sensorSession{
+		importer:  ip.pcapImporter,
+		sensor:    sensor,
+		assembler: ip.pcapImporter.NewSensorAssembler(sensor),
+		chunks:    make(map[sensorChunkFlow]*sensorChunkState),
+	}
+	chunks := make(chan sensorChunk, proxyChunksQueueSize)
+	recorded := make(chan struct{})
+	go ip.record(listener.Name, session, chunks, recorded)
+
+	var connections sync.WaitGroup
+	for {
+		conn, err := netListener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				ip.listenerError(listener.Name, err)
+			}
+			break
+		}
+
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			ip.handleConnection(ctx, listener, conn, chunks)
+		}()
+	}
+
+	connections.Wait()
+	close(chunks)
+	<-recorded
+	ip.updateStatus(listener.Name, func(status *ProxyListenerStatus) {
+		status.Listening = false
+	})
+}
+
+// record processes the chunks of the forwarded traffic until chunks is closed. The idle connections are flushed
+// periodically, since the proxy has no packets time.
+func (ip *InlineProxy) record(name string, session *sensorSession, chunks chan sensorChunk, recorded chan struct{}) {
+	defer close(recorded)
+	defer session.assembler.FlushAll()
+
+	ticker := time.NewTicker(proxyFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				return
+			}
+			if err := session.processChunk(chunk); err != nil {
+				log.WithError(err).WithField("listener", name).Debug("failed to record a proxied chunk")
+			}
+		case <-ticker.C:
+			session.assembler.FlushOlderThan(time.Now().Add(-sensorConnectionsIdle))
+		}
+	}
+}
+
+// handleConnection reads the target of the connection, if the mode of the listener requires it, connects to the
+// target and forwards the traffic in both the directions until both are closed.
+func (ip *InlineProxy) handleConnection(ctx context.Context, listener ProxyListener, clientConn net.Conn,
+	chunks chan sensorChunk) {
+	connCtx, cancelConn := context.WithCancel(ctx)
+	defer cancelConn()
+	go func() {
+		<-connCtx.Done()
+		_ = clientConn.Close()
+	}()
+
+	ip.updateStatus(listener.Name, func(status *ProxyListenerStatus) {
+		status.TotalConnections++
+		status.LastActivity = time.Now()
+	})
+
+	reader := bufio.NewReaderSize(clientConn, proxyBufferSize)
+	_ = clientConn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	var serverConn net.Conn
+	target, err := readTarget(listener, reader, clientConn)
+	if err == nil {
+		serverConn, err = ip.dialTarget(target)
+		err = replyHandshake(listener.Mode, clientConn, err)
+	}
+	if err != nil {
+		if serverConn != nil {
+			_ = serverConn.Close()
+		}
+		ip.updateStatus(listener.Name, func(status *ProxyListenerStatus) {
+			status.RejectedConnections++
+			status.LastError = err.Error()
+		})
+		log.WithError(err).WithField("listener", listener.Name).WithField("client", clientConn.RemoteAddr()).
+			Debug("proxy connection rejected")
+		return
+	}
+	_ = clientConn.SetDeadline(time.Time{})
+	go func() {
+		<-connCtx.Done()
+		_ = serverConn.Close()
+	}()
+
+	ip.updateStatus(listener.Name, func(status *ProxyListenerStatus) {
+		status.ActiveConnections++
+	})
+	defer ip.updateStatus(listener.Name, func(status *ProxyListenerStatus) {
+		status.ActiveConnections--
+	})
+
+	clientAddress, serverAddress := clientConn.RemoteAddr().(*net.TCPAddr), serverConn.RemoteAddr().(*net.TCPAddr)
+	record := func(fromServer bool, data []byte, end bool) {
+		chunks <- sensorChunk{
+			Timestamp:  time.Now(),
+			ClientIP:   clientAddress.IP,
+			ClientPort: uint16(clientAddress.Port),
+			ServerIP:   serverAddress.IP,
+			ServerPort: uint16(serverAddress.Port),
+			FromServer: fromServer,
+			Data:       data,
+			End:        end,
+		}
+		ip.updateStatus(listener.Name, func(status *ProxyListenerStatus) {
+			if fromServer {
+				status.ServerBytes += int64(len(data))
+			} else {
+				status.ClientBytes += int64(len(data))
+			}
+			status.LastActivity = time.Now()
+		})
+	}
+
+	var forwarders sync.WaitGroup
+	forwarders.Add(2)
+	go func() {
+		defer forwarders.Done()
+		forwardProxied(reader, serverConn, func(data []byte, end bool) { record(false, data, end) })
+	}()
+	go func() {
+		defer forwarders.Done()
+		forwardProxied(serverConn, clientConn, func(data []byte, end bool) { record(true, data, end) })
+	}()
+	forwarders.Wait()
+}
+
+// dialTarget connects to target, which must be an address of the server.
+func (ip *InlineProxy) dialTarget(target string) (net.Conn, error) {
+	address, err := ip.resolveTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("tcp", address.String(), proxyDialTimeout)
+}
+
+// resolveTarget returns the address of target, which must be an address of the server with a port.
+func (ip *InlineProxy) resolveTarget(target string) (*net.TCPAddr, error) {
+	address, err := net.ResolveTCPAddr("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	if address.Port == 0 {
+		return nil, errors.New("the target port is required")
+	}
+	if !ip.pcapImporter.serverNet.Contains(address.IP) {
+		return nil, errProxyTargetNotAllowed
+	}
+	return address, nil
+}
+
+func (ip *InlineProxy) updateStatus(name string, update func(status *ProxyListenerStatus)) {
+	ip.mStatuses.Lock()
+	defer ip.mStatuses.Unlock()
+
+	if status, isPresent := ip.statuses[name]; isPresent {
+		update(status)
+	}
+}
+
+func (ip *InlineProxy) listenerError(name string, err error) {
+	log.WithError(err).WithField("listener", name).Error("proxy listener error")
+	ip.updateStatus(name, func(status *ProxyListenerStatus) {
+		status.LastError = err.Error()
+	})
+	ip.notificationController.Notify("proxy.error", gin.H{"listener": name, "error": err.Error()})
+}
+
+// forwardProxied copies src to dst until src is closed, passing to record each block of data read and then the end
+// of the stream. The write side of dst is closed at the end, so that the peer receives the end of the stream too.
+func forwardProxied(src io.Reader, dst net.Conn, record func(data []byte, end bool)) {
+	buffer := make([]byte, proxyBufferSize)
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buffer[:n])
+			record(data, false)
+			if _, err := dst.Write(data); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	record(nil, true)
+	if tcpConn, ok := dst.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+}
+
+// readTarget returns the target of a connection, reading the one requested by the client with the protocol of the
+// listener mode.
+func readTarget(listener ProxyListener, reader *bufio.Reader, clientConn io.Writer) (string, error) {
+	switch listener.Mode {
+	case ProxyModeTCP:
+		return listener.Target, nil
+	case ProxyModeSocks5:
+		return readSocksTarget(reader, clientConn)
+	case ProxyModeHTTP:
+		return readConnectTarget(reader)
+	default:
+		return "", errors.New("invalid proxy mode")
+	}
+}
+
+// readSocksTarget performs the SOCKS5 handshake, without authentication, and returns the target of the CONNECT
+// command. The other commands are not supported.
+func readSocksTarget(reader *bufio.Reader, conn io.Writer) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if header[0] != 5 {
+		return "", errors.New("unsupported socks version")
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+	noAuth := false
+	for _, method := range methods {
+		noAuth = noAuth || method == 0
+	}
+	if !noAuth {
+		_, _ = conn.Write([]byte{5, 0xff})
+		return "", errors.New("socks authentication not supported")
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return "", err
+	}
+	if request[0] != 5 || request[1] != 1 {
+		return "", errors.New("only the socks connect command is supported")
+	}
+	var host string
+	switch request[3] {
+	case 1, 4:
+		address := make([]byte, net.IPv4len)
+		if request[3] == 4 {
+			address = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, address); err != nil {
+			return "", err
+		}
+		host = net.IP(address).String()
+	case 3:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, length)
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", errors.New("invalid socks address type")
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// readConnectTarget reads an HTTP CONNECT request and returns its target. The other methods are not supported.
+func readConnectTarget(reader *bufio.Reader) (string, error) {
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return "", err
+	}
+	if request.Method != http.MethodConnect {
+		return "", errors.New("only the http connect method is supported")
+	}
+	return request.Host, nil
+}
+
+// replyHandshake tells the client whether the connection to the requested target has been established, with the
+// protocol of the listener mode. Returns the error of the connection, or the one of the reply.
+func replyHandshake(mode string, conn io.Writer, err error) error {
+	var reply []byte
+	switch mode {
+	case ProxyModeSocks5:
+		code := byte(0)
+		if err == errProxyTargetNotAllowed {
+			code = 2
+		} else if _, isNetError := err.(net.Error); isNetError {
+			code = 5
+		} else if err != nil {
+			code = 1
+		}
+		reply = []byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0}
+	case ProxyModeHTTP:
+		status := http.StatusOK
+		if err == errProxyTargetNotAllowed {
+			status = http.StatusForbidden
+		} else if _, isNetError := err.(net.Error); isNetError {
+			status = http.StatusBadGateway
+		} else if err != nil {
+			status = http.StatusBadRequest
+		}
+		reply = []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status)))
+	}
+
+	if len(reply) > 0 {
+		if _, writeErr := conn.Write(reply); writeErr != nil && err == nil {
+			return writeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,218 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSocksTarget(t *testing.T) {
+	request := []byte{5, 1, 0, 5, 1, 0, 1, 10, 10, 10, 10, 0, 80}
+	reply := &bytes.Buffer{}
+	target, err := readSocksTarget(bufio.NewReader(bytes.NewReader(request)), reply)
+	require.NoError(t, err)
+	assert.Equal(t, "10.10.10.10:80", target)
+	assert.Equal(t, []byte{5, 0}, reply.Bytes())
+
+	request = append([]byte{5, 1, 0, 5, 1, 0, 3, 7}, []byte("vulnbox")...)
+	target, err = readSocksTarget(bufio.NewReader(bytes.NewReader(append(request, 31, 144))), ioutil.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, "vulnbox:8080", target)
+
+	request = append([]byte{5, 1, 0, 5, 1, 0, 4}, net.ParseIP("fd00::1")...)
+	target, err = readSocksTarget(bufio.NewReader(bytes.NewReader(append(request, 0, 22))), ioutil.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, "[fd00::1]:22", target)
+
+	reply.Reset()
+	_, err = readSocksTarget(bufio.NewReader(bytes.NewReader([]byte{5, 1, 2})), reply)
+	assert.Error(t, err)
+	assert.Equal(t, []byte{5, 0xff}, reply.Bytes())
+	_, err = readSocksTarget(bufio.NewReader(bytes.NewReader([]byte{5, 1, 0, 5, 2, 0, 1})), ioutil.Discard)
+	assert.Error(t, err)
+	_, err = readSocksTarget(bufio.NewReader(bytes.NewReader([]byte{4, 1, 0})), ioutil.Discard)
+	assert.Error(t, err)
+}
+
+func TestReadConnectTarget(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("CONNECT 10.10.10.10:443 HTTP/1.1\r\nHost: 10.10.10.10:443\r\n\r\nhello"))
+	target, err := readConnectTarget(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "10.10.10.10:443", target)
+	remaining, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(remaining))
+
+	_, err = readConnectTarget(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: 10.10.10.10\r\n\r\n")))
+	assert.Error(t, err)
+}
+
+func TestReplyHandshake(t *testing.T) {
+	reply := &bytes.Buffer{}
+	assert.NoError(t, replyHandshake(ProxyModeTCP, reply, nil))
+	assert.Zero(t, reply.Len())
+
+	assert.NoError(t, replyHandshake(ProxyModeSocks5, reply, nil))
+	assert.Equal(t, []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}, reply.Bytes())
+	reply.Reset()
+	assert.Equal(t, errProxyTargetNotAllowed, replyHandshake(ProxyModeSocks5, reply, errProxyTargetNotAllowed))
+	assert.Equal(t, byte(2), reply.Bytes()[1])
+
+	reply.Reset()
+	assert.NoError(t, replyHandshake(ProxyModeHTTP, reply, nil))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\n", reply.String())
+	reply.Reset()
+	assert.Error(t, replyHandshake(ProxyModeHTTP, reply, errors.New("invalid")))
+	assert.Equal(t, "HTTP/1.1 400 Bad Request\r\n\r\n", reply.String())
+}
+
+func TestForwardProxied(t *testing.T) {
+	src, dst := net.Pipe()
+	var recorded []string
+	go forwardProxied(strings.NewReader("hello"), src, func(data []byte, end bool) {
+		if end {
+			recorded = append(recorded, "end")
+		} else {
+			recorded = append(recorded, string(data))
+		}
+	})
+
+	received, err := ioutil.ReadAll(dst)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(received))
+	assert.Equal(t, []string{"hello", "end"}, recorded)
+}
+
+func TestInlineProxy(t *testing.T) {
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echoListener.Close()
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+
+	// the proxied connections are not recorded because the client has an address of the server
+	proxy := &InlineProxy{pcapImporter: &PcapImporter{serverNet: ParseIPNetworks("127.0.0.1")}}
+	settings := ProxySettings{Listeners: []ProxyListener{
+		{Name: "tcp", Mode: ProxyModeTCP, ListenAddress: freeAddress(t), Target: echoListener.Addr().String(),
+			Enabled: true},
+		{Name: "socks5", Mode: ProxyModeSocks5, ListenAddress: freeAddress(t), Enabled: true},
+		{Name: "http", Mode: ProxyModeHTTP, ListenAddress: freeAddress(t), Enabled: true},
+		{Name: "disabled", Mode: ProxyModeSocks5, ListenAddress: freeAddress(t)},
+	}}
+	require.NoError(t, proxy.validate(settings))
+	proxy.mutex.Lock()
+	require.NoError(t, proxy.apply(settings))
+	proxy.mutex.Unlock()
+
+	echo := func(conn net.Conn, reader io.Reader) {
+		_, err := conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+		received, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(received))
+		_ = conn.Close()
+	}
+
+	conn, err := net.Dial("tcp", settings.Listeners[0].ListenAddress)
+	require.NoError(t, err)
+	echo(conn, conn)
+
+	conn, err = net.Dial("tcp", settings.Listeners[1].ListenAddress)
+	require.NoError(t, err)
+	echoAddress := echoListener.Addr().(*net.TCPAddr)
+	_, err = conn.Write(append([]byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1},
+		byte(echoAddress.Port>>8), byte(echoAddress.Port)))
+	require.NoError(t, err)
+	reply := make([]byte, 12)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{5, 0, 5, 0}, reply[:4])
+	echo(conn, conn)
+
+	conn, err = net.Dial("tcp", settings.Listeners[2].ListenAddress)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("CONNECT 10.0.0.1:80 HTTP/1.1\r\nHost: 10.0.0.1:80\r\n\r\n"))
+	require.NoError(t, err)
+	response, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 403 Forbidden\r\n\r\n", string(response))
+	_ = conn.Close()
+
+	conn, err = net.Dial("tcp", settings.Listeners[2].ListenAddress)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("CONNECT " + echoListener.Addr().String() + " HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	echo(conn, reader)
+
+	proxy.Stop()
+	listeners := proxy.GetListeners()
+	require.Len(t, listeners, 4)
+	assert.Equal(t, "disabled", listeners[0].Name)
+	assert.Zero(t, listeners[0].TotalConnections)
+	assert.Equal(t, ProxyListenerStatus{Name: "http", TotalConnections: 2, RejectedConnections: 1, ClientBytes: 4,
+		ServerBytes: 4, LastActivity: listeners[1].LastActivity, LastError: errProxyTargetNotAllowed.Error()},
+		listeners[1])
+	assert.Equal(t, int64(4), listeners[2].ClientBytes)
+	assert.Equal(t, int64(4), listeners[3].ServerBytes)
+	for _, listener := range listeners {
+		assert.False(t, listener.Listening)
+		assert.Zero(t, listener.ActiveConnections)
+	}
+
+	assert.Error(t, proxy.validate(ProxySettings{Listeners: []ProxyListener{
+		{Name: "tcp", Mode: ProxyModeTCP, ListenAddress: ":8080", Target: "10.0.0.1:80"}}}))
+	assert.Error(t, proxy.validate(ProxySettings{Listeners: []ProxyListener{
+		{Name: "tcp", Mode: ProxyModeTCP, ListenAddress: ":8080", Target: "127.0.0.1"}}}))
+	assert.Error(t, proxy.validate(ProxySettings{Listeners: []ProxyListener{
+		{Name: "socks5", Mode: ProxyModeSocks5, ListenAddress: ":8080"},
+		{Name: "socks5", Mode: ProxyModeSocks5, ListenAddress: ":8081"}}}))
+}
+
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().String()
+}
@@ -0,0 +1,110 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const queryLimitsSettingsKey = "query_limits"
+const (
+	defaultQueryMaxTime      = 5000
+	defaultQueryMaxDocuments = 100000
+)
+
+// QueryLimitsSettings bound the expensive queries of the list endpoints. MaxTime is the number of milliseconds a
+// query can run in the database, MaxDocuments is the maximum number of documents a search can collect. When a limit
+// is reached the results read until then are returned as partial. Zero disables a limit.
+type QueryLimitsSettings struct {
+	MaxTime      int `json:"max_time" binding:"min=0,max=600000" bson:"max_time"`
+	MaxDocuments int `json:"max_documents" binding:"min=0" bson:"max_documents"`
+}
+
+type QueryLimits struct {
+	storage  Storage
+	settings QueryLimitsSettings
+	mutex    sync.Mutex
+}
+
+func NewQueryLimits(storage Storage) *QueryLimits {
+	ql := &QueryLimits{
+		storage:  storage,
+		settings: QueryLimitsSettings{MaxTime: defaultQueryMaxTime, MaxDocuments: defaultQueryMaxDocuments},
+	}
+
+	if err := LoadSettings(storage, queryLimitsSettingsKey, &ql.settings); err != nil {
+		log.WithError(err).Panic("failed to retrieve query limits settings")
+	}
+
+	return ql
+}
+
+func (ql *QueryLimits) GetSettings() QueryLimitsSettings {
+	ql.mutex.Lock()
+	defer ql.mutex.Unlock()
+
+	return ql.settings
+}
+
+func (ql *QueryLimits) SetSettings(settings QueryLimitsSettings) error {
+	if err := SaveSettings(ql.storage, queryLimitsSettingsKey, settings); err != nil {
+		return err
+	}
+
+	ql.mutex.Lock()
+	ql.settings = settings
+	ql.mutex.Unlock()
+
+	return nil
+}
+
+// ReloadSettings reads the settings again from the database, discarding the ones in memory.
+func (ql *QueryLimits) ReloadSettings() error {
+	settings := QueryLimitsSettings{MaxTime: defaultQueryMaxTime, MaxDocuments: defaultQueryMaxDocuments}
+	if err := LoadSettings(ql.storage, queryLimitsSettingsKey, &settings); err != nil {
+		return err
+	}
+
+	ql.mutex.Lock()
+	ql.settings = settings
+	ql.mutex.Unlock()
+
+	return nil
+}
+
+// MaxTime returns the maximum execution time of the queries, or zero if unlimited. If ql is nil the default is used.
+func (ql *QueryLimits) MaxTime() time.Duration {
+	if ql == nil {
+		return defaultQueryMaxTime * time.Millisecond
+	}
+
+	return time.Duration(ql.GetSettings().MaxTime) * time.Millisecond
+}
+
+// MaxDocuments returns the maximum number of documents collected by the searches, or zero if unlimited. If ql is nil
+// the default is used.
+func (ql *QueryLimits) MaxDocuments() int {
+	if ql == nil {
+		return defaultQueryMaxDocuments
+	}
+
+	return ql.GetSettings().MaxDocuments
+}
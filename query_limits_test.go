@@ -0,0 +1,64 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLimitsDefaults(t *testing.T) {
+	var queryLimits *QueryLimits
+	assert.Equal(t, defaultQueryMaxTime*time.Millisecond, queryLimits.MaxTime())
+	assert.Equal(t, defaultQueryMaxDocuments, queryLimits.MaxDocuments())
+}
+
+func TestPartialSearch(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Settings)
+	wrapper.AddCollection(Searches)
+	wrapper.AddCollection(ConnectionStreams)
+
+	queryLimits := NewQueryLimits(wrapper.Storage)
+	assert.Equal(t, QueryLimitsSettings{MaxTime: defaultQueryMaxTime, MaxDocuments: defaultQueryMaxDocuments},
+		queryLimits.GetSettings())
+	require.NoError(t, queryLimits.SetSettings(QueryLimitsSettings{MaxDocuments: 2}))
+	assert.Zero(t, queryLimits.MaxTime())
+
+	var streams []interface{}
+	for i := 0; i < 3; i++ {
+		streams = append(streams, ConnectionStream{ID: NewRowID(), ConnectionID: NewRowID(), PayloadString: "flag"})
+	}
+	_, err := wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).Many(streams)
+	require.NoError(t, err)
+
+	searchController := NewSearchController(wrapper.Storage, queryLimits)
+	search := searchController.PerformSearch(wrapper.Context, SearchOptions{RegexSearch: RegexSearch{Pattern: "fl.g"}})
+	assert.True(t, search.Partial)
+	assert.Equal(t, 2, search.AffectedConnectionsCount)
+
+	require.NoError(t, queryLimits.SetSettings(QueryLimitsSettings{MaxDocuments: 3}))
+	search = searchController.PerformSearch(wrapper.Context, SearchOptions{RegexSearch: RegexSearch{Pattern: "fl.g"}})
+	assert.False(t, search.Partial)
+	assert.Equal(t, 3, search.AffectedConnectionsCount)
+
+	wrapper.Destroy(t)
+}
@@ -0,0 +1,306 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const retentionSettingsKey = "retention"
+const retentionCheckInterval = time.Minute
+const retentionBatchSize = 1000
+
+// retentionCollections are the collections whose size is bounded by the retention settings
+var retentionCollections = []string{Connections, ConnectionStreams, HTTPExchanges, Statistics}
+
+// RetentionSettings bound the data kept in the database: MaxAge is in seconds and is compared with the time of the
+// first packet of the connections, MaxTotalSize is in bytes and is compared with the size of the documents of the
+// connections, the streams, the http exchanges and the statistics. Zero means unlimited. The connections matched by
+// one of the KeepMatchedRules are never pruned.
+type RetentionSettings struct {
+	MaxAge           int     `json:"max_age" binding:"min=0" bson:"max_age"`
+	MaxTotalSize     int64   `json:"max_total_size" binding:"min=0" bson:"max_total_size"`
+	KeepMatchedRules []RowID `json:"keep_matched_rules" bson:"keep_matched_rules"`
+}
+
+type RetentionReport struct {
+	StartedAt          time.Time `json:"started_at"`
+	Duration           int64     `json:"duration"`
+	DeletedConnections int64     `json:"deleted_connections"`
+	FreedBytes         int64     `json:"freed_bytes"`
+	Error              string    `json:"error,omitempty"`
+}
+
+type StorageStats struct {
+	Collections             map[string]CollectionStats `json:"collections"`
+	TotalSize               int64                      `json:"total_size"`
+	Retention               RetentionSettings          `json:"retention"`
+	LastPruning             *RetentionReport           `json:"last_pruning"`
+	TotalDeletedConnections int64                      `json:"total_deleted_connections"`
+	TotalFreedBytes         int64                      `json:"total_freed_bytes"`
+}
+
+// RetentionJanitor periodically deletes the connections, with their streams and http exchanges, and the statistics
+// older than the maximum age, and then the oldest connections until the database is smaller than the maximum size.
+type RetentionJanitor struct {
+	storage                 Storage
+	notificationController  *NotificationController
+	settings                RetentionSettings
+	lastPruning             *RetentionReport
+	totalDeletedConnections int64
+	totalFreedBytes         int64
+	mutex                   sync.Mutex
+	mPrune                  sync.Mutex
+	ctx                     context.Context
+	cancelFunc              context.CancelFunc
+}
+
+func NewRetentionJanitor(storage Storage, notificationController *NotificationController) *RetentionJanitor {
+	janitor := &RetentionJanitor{
+		storage:                storage,
+		notificationController: notificationController,
+	}
+	janitor.ctx, janitor.cancelFunc = context.WithCancel(context.Background())
+
+	if err := LoadSettings(storage, retentionSettingsKey, &janitor.settings); err != nil {
+		log.WithError(err).Panic("failed to retrieve retention settings")
+	}
+
+	return janitor
+}
+
+func (rj *RetentionJanitor) GetSettings() RetentionSettings {
+	rj.mutex.Lock()
+	defer rj.mutex.Unlock()
+
+	return rj.settings
+}
+
+func (rj *RetentionJanitor) SetSettings(settings RetentionSettings) error {
+	if err := SaveSettings(rj.storage, retentionSettingsKey, settings); err != nil {
+		return err
+	}
+
+	rj.mutex.Lock()
+	rj.settings = settings
+	rj.mutex.Unlock()
+
+	return nil
+}
+
+// ReloadSettings reads the settings again from the database, discarding the ones in memory.
+func (rj *RetentionJanitor) ReloadSettings() error {
+	var settings RetentionSettings
+	if err := LoadSettings(rj.storage, retentionSettingsKey, &settings); err != nil {
+		return err
+	}
+
+	rj.mutex.Lock()
+	rj.settings = settings
+	rj.mutex.Unlock()
+
+	return nil
+}
+
+// Run prunes the old data periodically, and returns when the janitor is stopped.
+func (rj *RetentionJanitor) Run() {
+	for {
+		if settings := rj.GetSettings(); settings.MaxAge > 0 || settings.MaxTotalSize > 0 {
+			report := rj.Prune(rj.ctx)
+			if report.Error != "" && rj.ctx.Err() == nil {
+				log.WithField("error", report.Error).Error("failed to prune old data")
+			}
+		}
+
+		select {
+		case <-time.After(retentionCheckInterval):
+		case <-rj.ctx.Done():
+			return
+		}
+	}
+}
+
+// Stop stops the periodic pruning and the pruning running.
+func (rj *RetentionJanitor) Stop() {
+	rj.cancelFunc()
+}
+
+// Prune deletes the data past the limits of the current settings and returns what has been freed. The clients are
+// notified only if something has been deleted.
+func (rj *RetentionJanitor) Prune(c context.Context) RetentionReport {
+	rj.mPrune.Lock()
+	defer rj.mPrune.Unlock()
+
+	settings := rj.GetSettings()
+	report := RetentionReport{StartedAt: time.Now()}
+	err := rj.prune(c, settings, &report)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	report.Duration = time.Now().Sub(report.StartedAt).Milliseconds()
+
+	rj.mutex.Lock()
+	rj.lastPruning = &report
+	rj.totalDeletedConnections += report.DeletedConnections
+	rj.totalFreedBytes += report.FreedBytes
+	rj.mutex.Unlock()
+
+	if report.DeletedConnections > 0 || report.FreedBytes > 0 {
+		log.WithField("report", report).Info("old data pruned")
+		rj.notificationController.Notify("storage.pruned", report)
+	}
+
+	return report
+}
+
+func (rj *RetentionJanitor) prune(c context.Context, settings RetentionSettings, report *RetentionReport) error {
+	sizeBefore, _, err := rj.collectionsStats(c)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if sizeAfter, _, err := rj.collectionsStats(c); err == nil && sizeAfter < sizeBefore {
+			report.FreedBytes = sizeBefore - sizeAfter
+		}
+	}()
+
+	if settings.MaxAge > 0 {
+		cutoff := time.Now().Add(-time.Duration(settings.MaxAge) * time.Second)
+		deleted, err := rj.pruneConnections(c, settings, OrderedDocument{{"_id",
+			UnorderedDocument{"$lt": CustomRowID(0, cutoff)}}}, 0)
+		report.DeletedConnections += deleted
+		if err != nil {
+			return err
+		}
+
+		if err := rj.storage.Delete(Statistics).Context(c).
+			Filter(OrderedDocument{{"_id", UnorderedDocument{"$lt": cutoff}}}).Many(); err != nil &&
+			err != ErrNothingToDelete {
+			return err
+		}
+	}
+
+	if settings.MaxTotalSize > 0 {
+		totalSize, stats, err := rj.collectionsStats(c)
+		if err != nil {
+			return err
+		}
+		connectionsCount := stats[Connections].Documents
+		if totalSize > settings.MaxTotalSize && connectionsCount > 0 {
+			// the size of a connection is estimated as the average size, including its streams and statistics
+			averageSize := totalSize / connectionsCount
+			if averageSize == 0 {
+				averageSize = 1
+			}
+			excess := (totalSize - settings.MaxTotalSize + averageSize - 1) / averageSize
+			deleted, err := rj.pruneConnections(c, settings, OrderedDocument{}, excess)
+			report.DeletedConnections += deleted
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// pruneConnections deletes, from the oldest, the connections which satisfy filter and are not matched by the rules to
+// keep, together with their streams, http exchanges and annotations. If limit is greater than zero at most limit
+// connections are deleted. It returns the number of connections deleted.
+func (rj *RetentionJanitor) pruneConnections(c context.Context, settings RetentionSettings, filter OrderedDocument,
+	limit int64) (int64, error) {
+	if len(settings.KeepMatchedRules) > 0 {
+		filter = append(filter, Entry{Key: "matched_rules", Value: UnorderedDocument{"$nin": settings.KeepMatchedRules}})
+	}
+
+	var deleted int64
+	for limit <= 0 || deleted < limit {
+		batchSize := int64(retentionBatchSize)
+		if limit > 0 && limit-deleted < batchSize {
+			batchSize = limit - deleted
+		}
+
+		var connections []Connection
+		if err := rj.storage.Find(Connections).Context(c).Filter(filter).Projection(OrderedDocument{{"_id", 1}}).
+			Sort("_id", true).Limit(batchSize).All(&connections); err != nil {
+			return deleted, err
+		}
+		if len(connections) == 0 {
+			break
+		}
+
+		ids := make([]RowID, len(connections))
+		for i, connection := range connections {
+			ids[i] = connection.ID
+		}
+		for _, collectionName := range []string{ConnectionStreams, HTTPExchanges, StreamAnnotations, Extractions} {
+			if err := rj.storage.Delete(collectionName).Context(c).
+				Filter(OrderedDocument{{"connection_id", UnorderedDocument{"$in": ids}}}).Many(); err != nil &&
+				err != ErrNothingToDelete {
+				return deleted, err
+			}
+		}
+		if err := rj.storage.Delete(Connections).Context(c).
+			Filter(OrderedDocument{{"_id", UnorderedDocument{"$in": ids}}}).Many(); err != nil &&
+			err != ErrNothingToDelete {
+			return deleted, err
+		}
+		deleted += int64(len(ids))
+	}
+
+	return deleted, nil
+}
+
+func (rj *RetentionJanitor) collectionsStats(c context.Context) (int64, map[string]CollectionStats, error) {
+	var totalSize int64
+	stats := make(map[string]CollectionStats, len(retentionCollections))
+	for _, collectionName := range retentionCollections {
+		collectionStats, err := rj.storage.Stats(c, collectionName)
+		if err != nil {
+			return 0, nil, err
+		}
+		stats[collectionName] = collectionStats
+		totalSize += collectionStats.Size
+	}
+
+	return totalSize, stats, nil
+}
+
+// GetStats returns the size of the collections bounded by the retention settings and the space freed by the janitor.
+func (rj *RetentionJanitor) GetStats(c context.Context) (StorageStats, error) {
+	totalSize, collections, err := rj.collectionsStats(c)
+	if err != nil {
+		return StorageStats{}, err
+	}
+
+	rj.mutex.Lock()
+	defer rj.mutex.Unlock()
+
+	return StorageStats{
+		Collections:             collections,
+		TotalSize:               totalSize,
+		Retention:               rj.settings,
+		LastPruning:             rj.lastPruning,
+		TotalDeletedConnections: rj.totalDeletedConnections,
+		TotalFreedBytes:         rj.totalFreedBytes,
+	}, nil
+}
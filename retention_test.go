@@ -0,0 +1,124 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionJanitor(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Settings)
+	for _, collectionName := range retentionCollections {
+		wrapper.AddCollection(collectionName)
+	}
+
+	janitor := NewRetentionJanitor(wrapper.Storage, nil)
+	assert.Equal(t, RetentionSettings{}, janitor.GetSettings())
+
+	now := time.Now()
+	keptRule := NewRowID()
+	oldID, oldMatchedID := CustomRowID(1, now.Add(-2*time.Hour)), CustomRowID(2, now.Add(-2*time.Hour))
+	recentIDs := []RowID{CustomRowID(3, now.Add(-3*time.Minute)), CustomRowID(4, now.Add(-2*time.Minute)),
+		CustomRowID(5, now.Add(-time.Minute))}
+	connections := []interface{}{
+		Connection{ID: oldID},
+		Connection{ID: oldMatchedID, MatchedRules: []RowID{keptRule}},
+	}
+	var streams []interface{}
+	for _, id := range append([]RowID{oldID, oldMatchedID}, recentIDs...) {
+		streams = append(streams, ConnectionStream{ID: NewRowID(), ConnectionID: id, Payload: make([]byte, 1000)})
+	}
+	for _, id := range recentIDs {
+		connections = append(connections, Connection{ID: id})
+	}
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).Many(connections)
+	require.NoError(t, err)
+	_, err = wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).Many(streams)
+	require.NoError(t, err)
+	_, err = wrapper.Storage.Insert(Statistics).Context(wrapper.Context).Many([]interface{}{
+		StatisticRecord{RangeStart: now.Add(-2 * time.Hour).Truncate(time.Minute)},
+		StatisticRecord{RangeStart: now.Truncate(time.Minute)},
+	})
+	require.NoError(t, err)
+
+	checkRemaining := func(expectedConnections []RowID, expectedStatistics int) {
+		var remaining []Connection
+		require.NoError(t, wrapper.Storage.Find(Connections).Context(wrapper.Context).Sort("_id", true).
+			All(&remaining))
+		ids := make([]RowID, len(remaining))
+		for i, connection := range remaining {
+			ids[i] = connection.ID
+		}
+		assert.Equal(t, expectedConnections, ids)
+
+		var remainingStreams []ConnectionStream
+		require.NoError(t, wrapper.Storage.Find(ConnectionStreams).Context(wrapper.Context).All(&remainingStreams))
+		assert.Len(t, remainingStreams, len(expectedConnections))
+		for _, stream := range remainingStreams {
+			assert.Contains(t, expectedConnections, stream.ConnectionID)
+		}
+
+		var records []StatisticRecord
+		require.NoError(t, wrapper.Storage.Find(Statistics).Context(wrapper.Context).All(&records))
+		assert.Len(t, records, expectedStatistics)
+	}
+
+	// without limits nothing is deleted
+	report := janitor.Prune(wrapper.Context)
+	assert.Empty(t, report.Error)
+	assert.Zero(t, report.DeletedConnections)
+	checkRemaining(append([]RowID{oldID, oldMatchedID}, recentIDs...), 2)
+
+	settings := RetentionSettings{MaxAge: 3600, KeepMatchedRules: []RowID{keptRule}}
+	require.NoError(t, janitor.SetSettings(settings))
+	report = janitor.Prune(wrapper.Context)
+	assert.Empty(t, report.Error)
+	assert.Equal(t, int64(1), report.DeletedConnections)
+	assert.Greater(t, report.FreedBytes, int64(1000))
+	checkRemaining(append([]RowID{oldMatchedID}, recentIDs...), 1)
+
+	stats, err := janitor.GetStats(wrapper.Context)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), stats.Collections[Connections].Documents)
+	assert.Equal(t, settings, stats.Retention)
+	assert.Equal(t, &report, stats.LastPruning)
+	assert.Equal(t, report.FreedBytes, stats.TotalFreedBytes)
+
+	// the oldest connections are deleted until the size is below the limit
+	settings.MaxTotalSize = stats.TotalSize - stats.TotalSize/5
+	require.NoError(t, janitor.SetSettings(settings))
+	report = janitor.Prune(wrapper.Context)
+	assert.Empty(t, report.Error)
+	assert.Equal(t, int64(1), report.DeletedConnections)
+	checkRemaining(append([]RowID{oldMatchedID}, recentIDs[1:]...), 1)
+
+	stats, err = janitor.GetStats(wrapper.Context)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, stats.TotalSize, settings.MaxTotalSize)
+	assert.Equal(t, int64(2), stats.TotalDeletedConnections)
+
+	require.NoError(t, janitor.ReloadSettings())
+	assert.Equal(t, settings, janitor.GetSettings())
+
+	wrapper.Destroy(t)
+}
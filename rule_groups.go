@@ -0,0 +1,207 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RuleGroup organizes the rules in namespaces. A rule belongs to at most one group, set with the group_id of the rule.
+type RuleGroup struct {
+	ID          RowID  `json:"id" bson:"_id,omitempty"`
+	Name        string `json:"name" binding:"min=3" bson:"name"`
+	Color       string `json:"color" binding:"hexcolor" bson:"color"`
+	Description string `json:"description" binding:"max=4096" bson:"description,omitempty"`
+}
+
+func (rm *rulesManagerImpl) AddRuleGroup(context context.Context, group RuleGroup) (RowID, error) {
+	rm.mutex.Lock()
+	if rm.groupByNameLocal(group.Name) != nil {
+		rm.mutex.Unlock()
+		return EmptyRowID(), errors.New("rule group name must be unique")
+	}
+	group.ID = NewRowID()
+	rm.groups[group.ID] = group
+	rm.mutex.Unlock()
+
+	if _, err := rm.storage.Insert(RuleGroups).Context(context).One(group); err != nil {
+		log.WithError(err).WithField("group", group).Panic("failed to insert rule group on database")
+	}
+
+	return group.ID, nil
+}
+
+func (rm *rulesManagerImpl) GetRuleGroup(id RowID) (RuleGroup, bool) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	group, isPresent := rm.groups[id]
+	return group, isPresent
+}
+
+func (rm *rulesManagerImpl) GetRuleGroups() []RuleGroup {
+	rm.mutex.Lock()
+	groups := make([]RuleGroup, 0, len(rm.groups))
+	for _, group := range rm.groups {
+		groups = append(groups, group)
+	}
+	rm.mutex.Unlock()
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+
+	return groups
+}
+
+func (rm *rulesManagerImpl) UpdateRuleGroup(context context.Context, id RowID, group RuleGroup) (bool, error) {
+	rm.mutex.Lock()
+	if _, isPresent := rm.groups[id]; !isPresent {
+		rm.mutex.Unlock()
+		return false, nil
+	}
+	if sameName := rm.groupByNameLocal(group.Name); sameName != nil && sameName.ID != id {
+		rm.mutex.Unlock()
+		return false, errors.New("already exists another rule group with the same name")
+	}
+	group.ID = id
+	rm.groups[id] = group
+	rm.mutex.Unlock()
+
+	if _, err := rm.storage.Update(RuleGroups).Context(context).Filter(byID(id)).
+		One(UnorderedDocument{"name": group.Name, "color": group.Color, "description": group.Description}); err != nil {
+		log.WithError(err).WithField("group", group).Panic("failed to update rule group on database")
+	}
+
+	return true, nil
+}
+
+// DeleteRuleGroup deletes the group and removes its rules from it. The rules are not deleted.
+func (rm *rulesManagerImpl) DeleteRuleGroup(context context.Context, id RowID) (bool, error) {
+	rm.mutex.Lock()
+	if _, isPresent := rm.groups[id]; !isPresent {
+		rm.mutex.Unlock()
+		return false, nil
+	}
+	delete(rm.groups, id)
+	for _, rule := range rm.rulesOfGroupLocal(id) {
+		rule.GroupID = nil
+		rm.rules[rule.ID] = rule
+		rm.rulesByName[rule.Name] = rule
+	}
+	rm.mutex.Unlock()
+
+	// the rules are removed from the group before the group is deleted, so that they never refer to a missing group
+	if _, err := rm.storage.Update(Rules).Context(context).Filter(OrderedDocument{{"group_id", id}}).
+		Many(UnorderedDocument{"group_id": nil}); err != nil {
+		log.WithError(err).WithField("group", id).Panic("failed to remove the rules from the group on database")
+	}
+	if err := rm.storage.Delete(RuleGroups).Context(context).Filter(byID(id)).One(); err != nil {
+		log.WithError(err).WithField("group", id).Panic("failed to delete rule group on database")
+	}
+
+	return true, nil
+}
+
+// SetRuleGroupEnabled enables or disables all the rules of the group, except the archived ones, and returns the ids
+// of the rules changed. The database is not compiled again, unless some rules extend the capture: the patterns of the
+// disabled rules stay in the database and are ignored when the connections are matched, so the group can be enabled
+// again immediately.
+func (rm *rulesManagerImpl) SetRuleGroupEnabled(context context.Context, id RowID, enabled bool) ([]RowID, bool) {
+	rm.mutex.Lock()
+	if _, isPresent := rm.groups[id]; !isPresent {
+		rm.mutex.Unlock()
+		return nil, false
+	}
+	changed := make([]RowID, 0)
+	for _, rule := range rm.rulesOfGroupLocal(id) {
+		if rule.Archived || rule.Enabled == enabled {
+			continue
+		}
+		rule.Enabled = enabled
+		rm.rules[rule.ID] = rule
+		rm.rulesByName[rule.Name] = rule
+		changed = append(changed, rule.ID)
+	}
+	rm.updateStreamPatternsLocal()
+	rm.mutex.Unlock()
+
+	if len(changed) > 0 {
+		if _, err := rm.storage.Update(Rules).Context(context).
+			Filter(OrderedDocument{{"_id", UnorderedDocument{"$in": changed}}}).
+			Many(UnorderedDocument{"enabled": enabled}); err != nil {
+			log.WithError(err).WithField("group", id).Panic("failed to toggle the rules of the group on database")
+		}
+	}
+
+	sort.Slice(changed, func(i, j int) bool {
+		return changed[i].Hex() < changed[j].Hex()
+	})
+	return changed, true
+}
+
+// checkGroupLocal returns an error if the rules can't be assigned to the group. Must be called with the mutex held.
+func (rm *rulesManagerImpl) checkGroupLocal(groupID *RowID) error {
+	if groupID == nil {
+		return nil
+	}
+	if _, isPresent := rm.groups[*groupID]; !isPresent {
+		return errors.New("rule group not found")
+	}
+	return nil
+}
+
+func (rm *rulesManagerImpl) groupByNameLocal(name string) *RuleGroup {
+	for _, group := range rm.groups {
+		if group.Name == name {
+			return &group
+		}
+	}
+	return nil
+}
+
+func (rm *rulesManagerImpl) rulesOfGroupLocal(id RowID) []Rule {
+	var rules []Rule
+	for _, rule := range rm.rules {
+		if rule.GroupID != nil && *rule.GroupID == id {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// withRuleGroup returns the filter with the rules of its group, so that the query selects the connections which
+// matched at least one of them. The connections are not selected at all if the group has no rules.
+func withRuleGroup(rulesManager RulesManager, filter ConnectionsFilter) ConnectionsFilter {
+	groupID, _ := RowIDFromHex(filter.RuleGroup)
+	if groupID.IsZero() {
+		return filter
+	}
+
+	filter.groupRules = make([]RowID, 0)
+	for _, rule := range rulesManager.GetRules() {
+		if rule.GroupID != nil && *rule.GroupID == groupID {
+			filter.groupRules = append(filter.groupRules, rule.ID)
+		}
+	}
+	return filter
+}
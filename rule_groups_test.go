@@ -0,0 +1,94 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleGroups(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+	wrapper.AddCollection(RuleGroups)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+
+	groupID, err := rulesManager.AddRuleGroup(wrapper.Context, RuleGroup{Name: "web", Color: "#fff"})
+	require.NoError(t, err)
+	_, err = rulesManager.AddRuleGroup(wrapper.Context, RuleGroup{Name: "web", Color: "#000"})
+	assert.Error(t, err)
+
+	missingGroup := NewRowID()
+	_, err = rulesManager.AddRule(wrapper.Context, Rule{Name: "orphan", Color: "#fff", GroupID: &missingGroup,
+		Patterns: []Pattern{{Regex: "orphan"}}})
+	assert.Error(t, err)
+	firstRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "sqli", Color: "#fff", GroupID: &groupID,
+		Patterns: []Pattern{{Regex: "union select"}}})
+	require.NoError(t, err)
+	secondRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "lfi", Color: "#fff", GroupID: &groupID,
+		Patterns: []Pattern{{Regex: "\\.\\./"}}})
+	require.NoError(t, err)
+
+	changed, isPresent := rulesManager.SetRuleGroupEnabled(wrapper.Context, groupID, false)
+	require.True(t, isPresent)
+	assert.ElementsMatch(t, []RowID{firstRule, secondRule}, changed)
+	rule, _ := rulesManager.GetRule(firstRule)
+	assert.False(t, rule.Enabled)
+	changed, _ = rulesManager.SetRuleGroupEnabled(wrapper.Context, groupID, false)
+	assert.Empty(t, changed)
+	_, isPresent = rulesManager.SetRuleGroupEnabled(wrapper.Context, missingGroup, true)
+	assert.False(t, isPresent)
+
+	filter := withRuleGroup(rulesManager, ConnectionsFilter{RuleGroup: groupID.Hex()})
+	assert.ElementsMatch(t, []RowID{firstRule, secondRule}, filter.groupRules)
+
+	updated, err := rulesManager.UpdateRuleGroup(wrapper.Context, groupID, RuleGroup{Name: "pwn", Color: "#000"})
+	require.NoError(t, err)
+	assert.True(t, updated)
+
+	otherRulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	group, isPresent := otherRulesManager.GetRuleGroup(groupID)
+	require.True(t, isPresent)
+	assert.Equal(t, "pwn", group.Name)
+	rule, _ = otherRulesManager.GetRule(secondRule)
+	assert.False(t, rule.Enabled)
+	assert.Equal(t, &groupID, rule.GroupID)
+
+	deleted, err := rulesManager.DeleteRuleGroup(wrapper.Context, groupID)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	rule, _ = rulesManager.GetRule(firstRule)
+	assert.Nil(t, rule.GroupID)
+	assert.Empty(t, rulesManager.GetRuleGroups())
+
+	wrapper.Destroy(t)
+}
+
+func TestRuleGroupQuery(t *testing.T) {
+	ruleID := NewRowID()
+	assert.Equal(t, OrderedDocument{{"matched_rules", UnorderedDocument{"$in": []RowID{ruleID}}}},
+		ConnectionsFilter{groupRules: []RowID{ruleID}}.Query().Document())
+	assert.Equal(t, OrderedDocument{{"matched_rules", UnorderedDocument{"$in": []RowID{}}}},
+		withRuleGroup(&TestRulesManager{}, ConnectionsFilter{RuleGroup: ruleID.Hex()}).Query().Document())
+	assert.Equal(t, OrderedDocument{}, withRuleGroup(&TestRulesManager{}, ConnectionsFilter{}).Query().Document())
+}
@@ -21,6 +21,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
@@ -35,6 +37,35 @@ const DirectionBoth = 0
 const DirectionToServer = 1
 const DirectionToClient = 2
 
+const flagInRuleName = "flag_in"
+const flagOutRuleName = "flag_out"
+
+// shardingMinPatterns is the number of patterns from which a database is compiled for each service with scoped rules
+const shardingMinPatterns = 100
+
+// maxDatabasePatterns and maxDatabaseSize are the budget of the rules database: the rules which would exceed it are
+// rejected, instead of making the compilation fail or exhausting the memory
+const maxDatabasePatterns = 10000
+const maxDatabaseSize = 512 << 20
+
+// rulesExpirationInterval is how often the temporary rules are checked for expiration
+const rulesExpirationInterval = 10 * time.Second
+
+const DatabaseStatusReady = "ready"
+const DatabaseStatusCompiling = "compiling"
+const DatabaseStatusError = "error"
+
+// ErrRulesNotSaved is returned when the rules can't be saved on database. The rules in memory are left unchanged.
+var ErrRulesNotSaved = errors.New("failed to save the rules on database")
+
+// The actions applied to the connections matched by a rule. All the rules tag the connections with their ids, the
+// hide and mark actions also set the hidden and marked flags, the redact action overwrites the matched bytes in the
+// stored payloads with RedactionByte.
+const RuleActionTag = "tag"
+const RuleActionHide = "hide"
+const RuleActionMark = "mark"
+const RuleActionRedact = "redact"
+
 type RegexFlags struct {
 	Caseless        bool `json:"caseless" bson:"caseless,omitempty"`                 // Set case-insensitive matching.
 	DotAll          bool `json:"dot_all" bson:"dot_all,omitempty"`                   // Matching a `.` will not exclude newlines.
@@ -49,12 +80,14 @@ type Pattern struct {
 	MinOccurrences uint       `json:"min_occurrences" bson:"min_occurrences,omitempty"`
 	MaxOccurrences uint       `json:"max_occurrences" binding:"omitempty,gtefield=MinOccurrences" bson:"max_occurrences,omitempty"`
 	Direction      uint8      `json:"direction" binding:"omitempty,max=2" bson:"direction,omitempty"`
+	DecodeLayers   []string   `json:"decode_layers" binding:"max=3,dive,oneof=url base64 hex" bson:"decode_layers,omitempty"`
+	Negate         bool       `json:"negate" bson:"negate,omitempty"`
 	internalID     uint
 }
 
 type Filter struct {
 	ServicePort   uint16 `json:"service_port" bson:"service_port,omitempty"`
-	ClientAddress string `json:"client_address" binding:"omitempty,ip" bson:"client_address,omitempty"`
+	ClientAddress string `json:"client_address" binding:"omitempty,ip|cidr" bson:"client_address,omitempty"`
 	ClientPort    uint16 `json:"client_port" bson:"client_port,omitempty"`
 	MinDuration   uint   `json:"min_duration" bson:"min_duration,omitempty"`
 	MaxDuration   uint   `json:"max_duration" binding:"omitempty,gtefield=MinDuration" bson:"max_duration,omitempty"`
@@ -63,20 +96,64 @@ type Filter struct {
 }
 
 type Rule struct {
-	ID       RowID     `json:"id" bson:"_id,omitempty"`
-	Name     string    `json:"name" binding:"min=3" bson:"name"`
-	Color    string    `json:"color" binding:"hexcolor" bson:"color"`
-	Notes    string    `json:"notes" bson:"notes,omitempty"`
-	Enabled  bool      `json:"enabled" bson:"enabled"`
-	Patterns []Pattern `json:"patterns" bson:"patterns"`
-	Filter   Filter    `json:"filter" bson:"filter,omitempty"`
-	Version  int64     `json:"version" bson:"version"`
+	ID            RowID     `json:"id" bson:"_id,omitempty"`
+	Name          string    `json:"name" binding:"min=3" bson:"name"`
+	Color         string    `json:"color" binding:"hexcolor" bson:"color"`
+	Notes         string    `json:"notes" bson:"notes,omitempty"`
+	Enabled       bool      `json:"enabled" bson:"enabled"`
+	Patterns      []Pattern `json:"patterns" bson:"patterns"`
+	Filter        Filter    `json:"filter" bson:"filter,omitempty"`
+	Action        string    `json:"action" binding:"omitempty,oneof=tag hide mark redact" bson:"action,omitempty"`
+	ExtendCapture bool      `json:"extend_capture" bson:"extend_capture,omitempty"`
+	Services      []uint16  `json:"services" binding:"dive,min=1" bson:"services,omitempty"`
+	TTL           uint      `json:"ttl,omitempty" binding:"max=10080" bson:"-"`
+	ExpiresAt     time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	Archived      bool      `json:"archived" bson:"archived,omitempty"`
+	GroupID       *RowID    `json:"group_id,omitempty" bson:"group_id,omitempty"`
+	Version       int64     `json:"version" bson:"version"`
+}
+
+// The operations of the bulk rules requests
+const (
+	RuleOperationCreate  = "create"
+	RuleOperationUpdate  = "update"
+	RuleOperationDelete  = "delete"
+	RuleOperationEnable  = "enable"
+	RuleOperationDisable = "disable"
+)
+
+// RuleOperation is an item of a bulk rules request. Rule is required by the create and update operations, ID by all
+// the operations except create. The updates change only the name, the color, the action, the services, the
+// group and the extend capture option of the rules.
+type RuleOperation struct {
+	Operation string `json:"operation" binding:"required,oneof=create update delete enable disable"`
+	ID        RowID  `json:"id"`
+	Rule      *Rule  `json:"rule"`
+}
+
+type RuleOperationResult struct {
+	Operation string `json:"operation"`
+	ID        RowID  `json:"id"`
+	Applied   bool   `json:"applied"`
+	Error     string `json:"error,omitempty"`
 }
 
 type RulesDatabase struct {
-	database     hyperscan.StreamDatabase
-	databaseSize int
-	version      RowID
+	database              hyperscan.StreamDatabase
+	databaseSize          int
+	version               RowID
+	decodeLayers          map[uint][]string
+	extendCapturePatterns map[uint]bool
+	redactPatterns        map[uint]bool
+	shards                *rulesDatabaseShards
+}
+
+// rulesDatabaseShards contain a database for each service with scoped rules, with the patterns of all the rules which
+// can match the connections of that service, and a database with only the unscoped patterns, used for the connections
+// of the other services. global is nil if all the patterns are scoped.
+type rulesDatabaseShards struct {
+	services map[uint16]hyperscan.StreamDatabase
+	global   hyperscan.StreamDatabase
 }
 
 type RulesManager interface {
@@ -84,18 +161,88 @@ type RulesManager interface {
 	GetRule(id RowID) (Rule, bool)
 	UpdateRule(context context.Context, id RowID, rule Rule) (bool, error)
 	GetRules() []Rule
+	SetFlag(context context.Context, flagRegex string) error
+	GetStatus() RulesDatabaseStatus
+	GetBudget() RulesBudget
+	EstimateRule(rule Rule) (RulesBudget, error)
+	BulkRules(context context.Context, operations []RuleOperation) ([]RuleOperationResult, error)
 	FillWithMatchedRules(connection *Connection, clientMatches map[uint][]PatternSlice, serverMatches map[uint][]PatternSlice)
+	RedactedPatterns(matchedRules []RowID) map[uint]uint8
+	RulePatterns(id RowID) map[uint]uint8
+	SuppressMatchedRules(connection *Connection, suppressedRules []RowID)
+	PatternsServices() map[uint]map[uint16]bool
 	DatabaseUpdateChannel() chan RulesDatabase
+	AddRuleGroup(context context.Context, group RuleGroup) (RowID, error)
+	GetRuleGroup(id RowID) (RuleGroup, bool)
+	GetRuleGroups() []RuleGroup
+	UpdateRuleGroup(context context.Context, id RowID, group RuleGroup) (bool, error)
+	DeleteRuleGroup(context context.Context, id RowID) (bool, error)
+	SetRuleGroupEnabled(context context.Context, id RowID, enabled bool) ([]RowID, bool)
+	Stop()
+}
+
+// RulesDatabaseStatus describes the state of the hyperscan database compilation. Version is the id of the last rule
+// included in the database currently in use, PendingVersion is the id of the last rule waiting to be compiled.
+type RulesDatabaseStatus struct {
+	Status          string    `json:"status"`
+	Version         RowID     `json:"version"`
+	PendingVersion  RowID     `json:"pending_version"`
+	PatternsCount   int       `json:"patterns_count"`
+	CompiledAt      time.Time `json:"compiled_at"`
+	CompileDuration int64     `json:"compile_duration"`
+	ShardsCount     int       `json:"shards_count"`
+	DatabaseSize    int       `json:"database_size"`
+	StreamStateSize int       `json:"stream_state_size"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// RulesBudget reports how much of the budget of the rules database is used, with NewPatterns patterns added to the
+// current ones. The size of the database is estimated from the average size of the patterns of the last compiled
+// database. Usage is the highest between the patterns and the size ratios.
+type RulesBudget struct {
+	PatternsCount         int     `json:"patterns_count"`
+	NewPatterns           int     `json:"new_patterns"`
+	MaxPatterns           int     `json:"max_patterns"`
+	DatabaseSize          int     `json:"database_size"`
+	EstimatedDatabaseSize int     `json:"estimated_database_size"`
+	MaxDatabaseSize       int     `json:"max_database_size"`
+	StreamStateSize       int     `json:"stream_state_size"`
+	Usage                 float64 `json:"usage"`
+	Fits                  bool    `json:"fits"`
+}
+
+type budgetExceededError struct {
+	budget RulesBudget
+}
+
+func (err budgetExceededError) Error() string {
+	return fmt.Sprintf("the rules database would exceed its budget (%d/%d patterns, about %d/%d bytes)",
+		err.budget.PatternsCount, err.budget.MaxPatterns, err.budget.EstimatedDatabaseSize,
+		err.budget.MaxDatabaseSize)
 }
 
 type rulesManagerImpl struct {
 	storage         Storage
 	rules           map[RowID]Rule
 	rulesByName     map[string]Rule
+	groups          map[RowID]RuleGroup
 	patterns        []*hyperscan.Pattern
 	patternsIds     map[string]uint
+	decodeLayers    map[uint][]string
+	extendCapture   map[uint]bool
+	redactPatterns  map[uint]bool
+	scopedPatterns  map[uint]map[uint16]bool
+	shardingMin     int
+	maxPatterns     int
+	maxDatabaseSize int
+	rulesCounter    uint64
 	mutex           sync.Mutex
 	databaseUpdated chan RulesDatabase
+	compileRequests chan struct{}
+	checkPatterns   bool // false while the rules saved in the database, already checked, are loaded
+	stop            chan struct{}
+	stopOnce        sync.Once
+	status          RulesDatabaseStatus
 	validate        *validator.Validate
 }
 
@@ -104,71 +251,80 @@ func LoadRulesManager(storage Storage, flagRegex string) (RulesManager, error) {
 	if err := storage.Find(Rules).Sort("_id", true).All(&rules); err != nil {
 		return nil, err
 	}
+	var groups []RuleGroup
+	if err := storage.Find(RuleGroups).All(&groups); err != nil {
+		return nil, err
+	}
 
 	rulesManager := rulesManagerImpl{
 		storage:         storage,
 		rules:           make(map[RowID]Rule),
 		rulesByName:     make(map[string]Rule),
+		groups:          make(map[RowID]RuleGroup, len(groups)),
 		patterns:        make([]*hyperscan.Pattern, 0),
 		patternsIds:     make(map[string]uint),
+		decodeLayers:    make(map[uint][]string),
+		extendCapture:   make(map[uint]bool),
+		redactPatterns:  make(map[uint]bool),
+		scopedPatterns:  make(map[uint]map[uint16]bool),
+		shardingMin:     shardingMinPatterns,
+		maxPatterns:     maxDatabasePatterns,
+		maxDatabaseSize: maxDatabaseSize,
 		mutex:           sync.Mutex{},
 		databaseUpdated: make(chan RulesDatabase, 1),
+		compileRequests: make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+		status:          RulesDatabaseStatus{Status: DatabaseStatusReady},
 		validate:        validator.New(),
 	}
+	for _, group := range groups {
+		rulesManager.groups[group.ID] = group
+	}
 
 	for _, rule := range rules {
 		if err := rulesManager.validateAndAddRuleLocal(&rule); err != nil {
 			return nil, err
 		}
 	}
+	rulesManager.rulesCounter = uint64(len(rules))
+	rulesManager.checkPatterns = true
 
-	// if there are no rules in database (e.g. first run), set flagRegex as first rule
+	// if there are no rules in database (e.g. first run), set flagRegex as first rules
 	if len(rulesManager.rules) == 0 {
-		_, _ = rulesManager.AddRule(context.Background(), Rule{
-			Name:  "flag_out",
-			Color: "#e53935",
-			Notes: "Mark connections where the flags are stolen",
-			Patterns: []Pattern{
-				{Regex: flagRegex, Direction: DirectionToClient, Flags: RegexFlags{Utf8Mode: true}},
-			},
-		})
-		_, _ = rulesManager.AddRule(context.Background(), Rule{
-			Name:  "flag_in",
-			Color: "#43A047",
-			Notes: "Mark connections where the flags are placed",
-			Patterns: []Pattern{
-				{Regex: flagRegex, Direction: DirectionToServer, Flags: RegexFlags{Utf8Mode: true}},
-			},
-		})
-	} else {
-		if err := rulesManager.generateDatabase(rules[len(rules)-1].ID); err != nil {
+		if err := rulesManager.SetFlag(context.Background(), flagRegex); err != nil {
 			return nil, err
 		}
+	} else {
+		rulesManager.mutex.Lock()
+		rulesManager.generateDatabase(rules[len(rules)-1].ID)
+		rulesManager.mutex.Unlock()
 	}
 
+	go rulesManager.compileWorker()
+	go rulesManager.expirationWorker()
+
 	return &rulesManager, nil
 }
 
 func (rm *rulesManagerImpl) AddRule(context context.Context, rule Rule) (RowID, error) {
 	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
 
-	rule.ID = CustomRowID(uint64(len(rm.rules)), time.Now())
+	snapshot := rm.snapshotLocal()
+	rule.ID = rm.newRuleIDLocal()
 	rule.Enabled = true
 
 	if err := rm.validateAndAddRuleLocal(&rule); err != nil {
-		rm.mutex.Unlock()
+		rm.restoreLocal(snapshot)
 		return EmptyRowID(), err
 	}
 
-	if err := rm.generateDatabase(rule.ID); err != nil {
-		rm.mutex.Unlock()
-		log.WithError(err).WithField("rule", rule).Panic("failed to generate database")
-	}
-	rm.mutex.Unlock()
-
 	if _, err := rm.storage.Insert(Rules).Context(context).One(rule); err != nil {
-		log.WithError(err).WithField("rule", rule).Panic("failed to insert rule on database")
+		log.WithError(err).WithField("rule", rule).Error("failed to insert rule on database")
+		rm.restoreLocal(snapshot)
+		return EmptyRowID(), ErrRulesNotSaved
 	}
+	rm.generateDatabase(rule.ID)
 
 	return rule.ID, nil
 }
@@ -188,21 +344,38 @@ func (rm *rulesManagerImpl) UpdateRule(context context.Context, id RowID, rule R
 	if isPresent && sameName.ID != id {
 		return false, errors.New("already exists another rule with the same name")
 	}
+	if err := rm.validate.Var(rule.Services, "dive,min=1"); err != nil {
+		return false, err
+	}
+	rm.mutex.Lock()
+	err := rm.checkGroupLocal(rule.GroupID)
+	rm.mutex.Unlock()
+	if err != nil {
+		return false, err
+	}
 
 	updated, err := rm.storage.Update(Rules).Context(context).Filter(OrderedDocument{{"_id", id}}).
-		One(UnorderedDocument{"name": rule.Name, "color": rule.Color})
+		One(UnorderedDocument{"name": rule.Name, "color": rule.Color, "action": rule.Action,
+			"services": rule.Services, "group_id": rule.GroupID, "extend_capture": rule.ExtendCapture})
 	if err != nil {
-		log.WithError(err).WithField("rule", rule).Panic("failed to update rule on database")
+		log.WithError(err).WithField("rule", rule).Error("failed to update rule on database")
+		return true, ErrRulesNotSaved
 	}
 
 	if updated {
 		rm.mutex.Lock()
+		delete(rm.rulesByName, newRule.Name)
 		newRule.Name = rule.Name
 		newRule.Color = rule.Color
+		newRule.Action = rule.Action
+		newRule.Services = rule.Services
+		newRule.GroupID = rule.GroupID
+		newRule.ExtendCapture = rule.ExtendCapture
 
-		delete(rm.rulesByName, newRule.Name)
 		rm.rulesByName[newRule.Name] = newRule
 		rm.rules[id] = newRule
+		rm.updatePatternsServicesLocal()
+		rm.updateStreamPatternsLocal()
 		rm.mutex.Unlock()
 	}
 
@@ -223,82 +396,544 @@ func (rm *rulesManagerImpl) GetRules() []Rule {
 	return rules
 }
 
-func (rm *rulesManagerImpl) FillWithMatchedRules(connection *Connection, clientMatches map[uint][]PatternSlice,
-	serverMatches map[uint][]PatternSlice) {
-	rm.mutex.Lock()
-
-	filterFunctions := []func(rule Rule) bool{
-		func(rule Rule) bool {
-			return rule.Filter.ClientAddress == "" || connection.SourceIP == rule.Filter.ClientAddress
-		},
-		func(rule Rule) bool {
-			return rule.Filter.ClientPort == 0 || connection.SourcePort == rule.Filter.ClientPort
-		},
-		func(rule Rule) bool {
-			return rule.Filter.ServicePort == 0 || connection.DestinationPort == rule.Filter.ServicePort
-		},
-		func(rule Rule) bool {
-			return rule.Filter.MinDuration == 0 || uint(connection.ClosedAt.Sub(connection.StartedAt).Milliseconds()) >=
-				rule.Filter.MinDuration
-		},
-		func(rule Rule) bool {
-			return rule.Filter.MaxDuration == 0 || uint(connection.ClosedAt.Sub(connection.StartedAt).Milliseconds()) <=
-				rule.Filter.MaxDuration
-		},
-		func(rule Rule) bool {
-			return rule.Filter.MinBytes == 0 || uint(connection.ClientBytes+connection.ServerBytes) >=
-				rule.Filter.MinBytes
+// SetFlag creates or updates the pair of rules which match the flags: flag_in marks the connections where the flags
+// are sent to the server (e.g. placed by the checker or submitted by us to other teams), flag_out marks the
+// connections where the flags are sent to the client (e.g. stolen from our services).
+func (rm *rulesManagerImpl) SetFlag(context context.Context, flagRegex string) error {
+	flagRules := []Rule{
+		{
+			Name:  flagOutRuleName,
+			Color: "#e53935",
+			Notes: "Mark connections where the flags are stolen",
+			Patterns: []Pattern{
+				{Regex: flagRegex, Direction: DirectionToClient, Flags: RegexFlags{Utf8Mode: true}},
+			},
 		},
-		func(rule Rule) bool {
-			return rule.Filter.MaxBytes == 0 || uint(connection.ClientBytes+connection.ServerBytes) <=
-				rule.Filter.MinBytes
+		{
+			Name:  flagInRuleName,
+			Color: "#43A047",
+			Notes: "Mark connections where the flags are placed",
+			Patterns: []Pattern{
+				{Regex: flagRegex, Direction: DirectionToServer, Flags: RegexFlags{Utf8Mode: true}},
+			},
 		},
 	}
 
-	connection.MatchedRules = make([]RowID, 0)
-	for _, rule := range rm.rules {
-		matching := true
-		for _, f := range filterFunctions {
-			if !f(rule) {
-				matching = false
-				break
+	var updatedVersion RowID
+	for _, flagRule := range flagRules {
+		rm.mutex.Lock()
+		existingRule, isPresent := rm.rulesByName[flagRule.Name]
+		rm.mutex.Unlock()
+
+		if !isPresent {
+			if _, err := rm.AddRule(context, flagRule); err != nil {
+				return err
 			}
+			continue
 		}
 
-		for _, p := range rule.Patterns {
-			checkOccurrences := func(occurrences []PatternSlice) bool {
-				return (p.MinOccurrences == 0 || uint(len(occurrences)) >= p.MinOccurrences) &&
-					(p.MaxOccurrences == 0 || uint(len(occurrences)) <= p.MaxOccurrences)
+		rm.mutex.Lock()
+		if err := rm.validateAndAddPatternsLocal(flagRule.Patterns); err != nil {
+			rm.mutex.Unlock()
+			return err
+		}
+		if len(existingRule.Patterns) == 1 && existingRule.Patterns[0].internalID == flagRule.Patterns[0].internalID {
+			rm.mutex.Unlock()
+			continue
+		}
+		existingRule.Patterns = flagRule.Patterns
+		rm.rules[existingRule.ID] = existingRule
+		rm.rulesByName[existingRule.Name] = existingRule
+		rm.updatePatternsServicesLocal()
+		rm.mutex.Unlock()
+
+		if _, err := rm.storage.Update(Rules).Context(context).Filter(OrderedDocument{{"_id", existingRule.ID}}).
+			One(UnorderedDocument{"patterns": existingRule.Patterns}); err != nil {
+			return err
+		}
+		updatedVersion = existingRule.ID
+	}
+
+	if !updatedVersion.IsZero() {
+		rm.mutex.Lock()
+		rm.generateDatabase(updatedVersion)
+		rm.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// BulkRules applies the operations atomically: if one of them fails none is applied, and the error of the failed
+// operation is reported in the results. If a rule can't be saved on the database, the changes already saved are
+// rolled back. The database is regenerated once at the end, if new rules have been created.
+// The deleted rules are no longer matched, but their patterns are kept in the database until the next restart.
+func (rm *rulesManagerImpl) BulkRules(context context.Context, operations []RuleOperation) ([]RuleOperationResult,
+	error) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	results := make([]RuleOperationResult, len(operations))
+	snapshot := rm.snapshotLocal()
+	var created []interface{}
+	var lastCreated RowID
+
+	for i, operation := range operations {
+		results[i] = RuleOperationResult{Operation: operation.Operation, ID: operation.ID}
+		err := func() error {
+			if operation.Operation != RuleOperationCreate {
+				if _, isPresent := rm.rules[operation.ID]; !isPresent {
+					return errors.New("rule not found")
+				}
 			}
-			clientOccurrences, clientPresent := clientMatches[p.internalID]
-			serverOccurrences, serverPresent := serverMatches[p.internalID]
 
-			if p.Direction == DirectionToServer {
-				if !clientPresent || !checkOccurrences(clientOccurrences) {
-					matching = false
-					break
+			switch operation.Operation {
+			case RuleOperationCreate:
+				if operation.Rule == nil {
+					return errors.New("rule is required")
 				}
-			} else if p.Direction == DirectionToClient {
-				if !serverPresent || !checkOccurrences(serverOccurrences) {
-					matching = false
-					break
+				rule := *operation.Rule
+				rule.ID = rm.newRuleIDLocal()
+				rule.Enabled = true
+				rule.Patterns = append([]Pattern{}, rule.Patterns...)
+				if err := rm.validateAndAddRuleLocal(&rule); err != nil {
+					return err
 				}
-			} else {
-				if !(clientPresent || serverPresent) || !checkOccurrences(append(clientOccurrences, serverOccurrences...)) {
-					matching = false
-					break
+				results[i].ID = rule.ID
+				created = append(created, rule)
+				lastCreated = rule.ID
+			case RuleOperationUpdate:
+				if operation.Rule == nil {
+					return errors.New("rule is required")
 				}
+				existingRule := rm.rules[operation.ID]
+				if sameName, isPresent := rm.rulesByName[operation.Rule.Name]; isPresent && sameName.ID != operation.ID {
+					return errors.New("already exists another rule with the same name")
+				}
+				if err := rm.validate.Var(operation.Rule.Services, "dive,min=1"); err != nil {
+					return err
+				}
+				if err := rm.checkGroupLocal(operation.Rule.GroupID); err != nil {
+					return err
+				}
+				delete(rm.rulesByName, existingRule.Name)
+				existingRule.Name = operation.Rule.Name
+				existingRule.Color = operation.Rule.Color
+				existingRule.Action = operation.Rule.Action
+				existingRule.Services = operation.Rule.Services
+				existingRule.GroupID = operation.Rule.GroupID
+				existingRule.ExtendCapture = operation.Rule.ExtendCapture
+				rm.rules[existingRule.ID] = existingRule
+				rm.rulesByName[existingRule.Name] = existingRule
+			case RuleOperationDelete:
+				existingRule := rm.rules[operation.ID]
+				if existingRule.Name == flagInRuleName || existingRule.Name == flagOutRuleName {
+					return errors.New("flag rules can't be deleted")
+				}
+				delete(rm.rules, existingRule.ID)
+				delete(rm.rulesByName, existingRule.Name)
+			case RuleOperationEnable, RuleOperationDisable:
+				existingRule := rm.rules[operation.ID]
+				existingRule.Enabled = operation.Operation == RuleOperationEnable
+				if existingRule.Enabled && existingRule.Archived {
+					// the archived rules are restored as permanent rules
+					existingRule.Archived = false
+					existingRule.ExpiresAt = time.Time{}
+				}
+				rm.rules[existingRule.ID] = existingRule
+				rm.rulesByName[existingRule.Name] = existingRule
+			default:
+				return errors.New("invalid operation")
 			}
+			return nil
+		}()
+
+		if err != nil {
+			results[i].Error = err.Error()
+			rm.restoreLocal(snapshot)
+			return results, fmt.Errorf("operation %d failed: %s", i, err.Error())
 		}
+	}
+
+	if len(created) > 0 {
+		if _, err := rm.storage.Insert(Rules).Context(context).Many(created); err != nil {
+			log.WithError(err).Error("failed to insert rules on database")
+			// the insert stops at the first error, remove the rules which have been inserted before
+			rm.rollbackBulkRules(context, snapshot, nil, created)
+			rm.restoreLocal(snapshot)
+			return results, ErrRulesNotSaved
+		}
+	}
+	var saveErr error
+	saved := make([]RuleOperation, 0, len(operations))
+	for i, operation := range operations {
+		rule, isPresent := rm.rules[operation.ID]
+		switch {
+		case operation.Operation == RuleOperationCreate:
+			continue
+		case operation.Operation == RuleOperationDelete:
+			saveErr = rm.storage.Delete(Rules).Context(context).Filter(byID(operation.ID)).One()
+		case isPresent:
+			_, saveErr = rm.storage.Update(Rules).Context(context).Filter(byID(rule.ID)).One(bulkUpdateDocument(rule))
+		}
+		if saveErr != nil {
+			log.WithError(saveErr).WithField("operation", operation).Error("failed to apply rule operation on database")
+			results[i].Error = ErrRulesNotSaved.Error()
+			break
+		}
+		saved = append(saved, operation)
+	}
+	if saveErr != nil {
+		rm.rollbackBulkRules(context, snapshot, saved, created)
+		rm.restoreLocal(snapshot)
+		return results, ErrRulesNotSaved
+	}
+
+	for i := range results {
+		results[i].Applied = true
+	}
+	rm.updatePatternsServicesLocal()
+	rm.updateStreamPatternsLocal()
+	if !lastCreated.IsZero() {
+		rm.generateDatabase(lastCreated)
+	}
+
+	return results, nil
+}
 
-		if matching {
+// bulkUpdateDocument returns the fields of the rule changed by the bulk operations.
+func bulkUpdateDocument(rule Rule) UnorderedDocument {
+	return UnorderedDocument{"name": rule.Name, "color": rule.Color, "action": rule.Action, "enabled": rule.Enabled,
+		"services": rule.Services, "archived": rule.Archived, "expires_at": rule.ExpiresAt, "group_id": rule.GroupID,
+		"extend_capture": rule.ExtendCapture}
+}
+
+// rollbackBulkRules undoes on the database the operations already saved when one of them fails: the updated rules are
+// saved again as they were in snapshot, the deleted ones are inserted again and the created ones are removed. If the
+// rollback fails too, the error is logged and the database is left inconsistent with the rules in memory.
+func (rm *rulesManagerImpl) rollbackBulkRules(context context.Context, snapshot rulesSnapshot,
+	saved []RuleOperation, created []interface{}) {
+	restored := make(map[RowID]bool)
+	for i := len(saved) - 1; i >= 0; i-- {
+		id := saved[i].ID
+		if restored[id] {
+			continue
+		}
+		restored[id] = true
+		previous := snapshot.rules[id]
+
+		var err error
+		if saved[i].Operation == RuleOperationDelete {
+			_, err = rm.storage.Insert(Rules).Context(context).One(previous)
+		} else {
+			_, err = rm.storage.Update(Rules).Context(context).Filter(byID(id)).One(bulkUpdateDocument(previous))
+		}
+		if err != nil {
+			log.WithError(err).WithField("rule", previous).Error("failed to rollback rule operation on database")
+		}
+	}
+
+	if len(created) > 0 {
+		createdIDs := make([]RowID, 0, len(created))
+		for _, rule := range created {
+			createdIDs = append(createdIDs, rule.(Rule).ID)
+		}
+		if err := rm.storage.Delete(Rules).Context(context).
+			Filter(OrderedDocument{{"_id", UnorderedDocument{"$in": createdIDs}}}).Many(); err != nil {
+			log.WithError(err).Error("failed to remove the created rules on database")
+		}
+	}
+}
+
+// rulesSnapshot is a copy of the state of the rules manager, used to rollback the bulk operations
+type rulesSnapshot struct {
+	rules         map[RowID]Rule
+	rulesByName   map[string]Rule
+	patternsCount int
+	patternsIds   map[string]uint
+	decodeLayers  map[uint][]string
+	rulesCounter  uint64
+}
+
+func (rm *rulesManagerImpl) snapshotLocal() rulesSnapshot {
+	snapshot := rulesSnapshot{
+		rules:         make(map[RowID]Rule, len(rm.rules)),
+		rulesByName:   make(map[string]Rule, len(rm.rulesByName)),
+		patternsCount: len(rm.patterns),
+		patternsIds:   make(map[string]uint, len(rm.patternsIds)),
+		decodeLayers:  make(map[uint][]string, len(rm.decodeLayers)),
+		rulesCounter:  rm.rulesCounter,
+	}
+	for id, rule := range rm.rules {
+		snapshot.rules[id] = rule
+	}
+	for name, rule := range rm.rulesByName {
+		snapshot.rulesByName[name] = rule
+	}
+	for key, id := range rm.patternsIds {
+		snapshot.patternsIds[key] = id
+	}
+	for id, layers := range rm.decodeLayers {
+		snapshot.decodeLayers[id] = layers
+	}
+	return snapshot
+}
+
+func (rm *rulesManagerImpl) restoreLocal(snapshot rulesSnapshot) {
+	rm.rules = snapshot.rules
+	rm.rulesByName = snapshot.rulesByName
+	rm.patterns = rm.patterns[:snapshot.patternsCount]
+	rm.patternsIds = snapshot.patternsIds
+	rm.decodeLayers = snapshot.decodeLayers
+	rm.rulesCounter = snapshot.rulesCounter
+	rm.updatePatternsServicesLocal()
+	rm.updateStreamPatternsLocal()
+}
+
+// newRuleIDLocal returns the id of a new rule. Must be called with the mutex held.
+func (rm *rulesManagerImpl) newRuleIDLocal() RowID {
+	id := CustomRowID(rm.rulesCounter, time.Now())
+	rm.rulesCounter++
+	return id
+}
+
+func (rm *rulesManagerImpl) GetStatus() RulesDatabaseStatus {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	return rm.status
+}
+
+func (rm *rulesManagerImpl) GetBudget() RulesBudget {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	return rm.budgetLocal(0)
+}
+
+// EstimateRule reports the budget of the rules database if the patterns of rule were added, without adding them. The
+// patterns already used by other rules are shared, so they are not counted.
+func (rm *rulesManagerImpl) EstimateRule(rule Rule) (RulesBudget, error) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	snapshot := rm.snapshotLocal()
+	err := rm.validateAndAddPatternsLocal(append([]Pattern{}, rule.Patterns...))
+	newPatterns := len(rm.patterns) - snapshot.patternsCount
+	rm.restoreLocal(snapshot)
+	if exceeded, ok := err.(budgetExceededError); ok {
+		return exceeded.budget, nil
+	} else if err != nil {
+		return RulesBudget{}, err
+	}
+
+	return rm.budgetLocal(newPatterns), nil
+}
+
+// budgetLocal returns the budget of the rules database with newPatterns more patterns. Must be called with the mutex
+// held.
+func (rm *rulesManagerImpl) budgetLocal(newPatterns int) RulesBudget {
+	budget := RulesBudget{
+		PatternsCount:         len(rm.patterns) + newPatterns,
+		NewPatterns:           newPatterns,
+		MaxPatterns:           rm.maxPatterns,
+		DatabaseSize:          rm.status.DatabaseSize,
+		EstimatedDatabaseSize: rm.status.DatabaseSize,
+		MaxDatabaseSize:       rm.maxDatabaseSize,
+		StreamStateSize:       rm.status.StreamStateSize,
+	}
+	if rm.status.PatternsCount > 0 {
+		budget.EstimatedDatabaseSize = rm.status.DatabaseSize * budget.PatternsCount / rm.status.PatternsCount
+	}
+	budget.Usage = float64(budget.PatternsCount) / float64(budget.MaxPatterns)
+	if sizeUsage := float64(budget.EstimatedDatabaseSize) / float64(budget.MaxDatabaseSize); sizeUsage > budget.Usage {
+		budget.Usage = sizeUsage
+	}
+	budget.Fits = budget.PatternsCount <= budget.MaxPatterns && budget.EstimatedDatabaseSize <= budget.MaxDatabaseSize
+
+	return budget
+}
+
+func (rm *rulesManagerImpl) FillWithMatchedRules(connection *Connection, clientMatches map[uint][]PatternSlice,
+	serverMatches map[uint][]PatternSlice) {
+	rm.mutex.Lock()
+
+	connection.MatchedRules = make([]RowID, 0)
+	for _, rule := range rm.rules {
+		if !rule.Enabled {
+			continue
+		}
+
+		if rule.matchesConnection(connection) && rule.matchesPatterns(clientMatches, serverMatches) {
 			connection.MatchedRules = append(connection.MatchedRules, rule.ID)
+			switch rule.Action {
+			case RuleActionHide:
+				connection.Hidden = true
+			case RuleActionMark:
+				connection.Marked = true
+			}
 		}
 	}
 
+	if flagOutRule, isPresent := rm.rulesByName[flagOutRuleName]; isPresent && len(flagOutRule.Patterns) > 0 {
+		connection.FlagsOut = len(serverMatches[flagOutRule.Patterns[0].internalID])
+	}
+	if flagInRule, isPresent := rm.rulesByName[flagInRuleName]; isPresent && len(flagInRule.Patterns) > 0 {
+		connection.FlagsIn = len(clientMatches[flagInRule.Patterns[0].internalID])
+	}
+
 	rm.mutex.Unlock()
 }
 
+// RedactedPatterns returns the internal ids of the patterns of the matched rules with the redact action, each one with
+// the direction in which its matches must be redacted.
+func (rm *rulesManagerImpl) RedactedPatterns(matchedRules []RowID) map[uint]uint8 {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	patterns := make(map[uint]uint8)
+	for _, id := range matchedRules {
+		if rule, isPresent := rm.rules[id]; isPresent && rule.Action == RuleActionRedact {
+			for _, pattern := range rule.Patterns {
+				if pattern.Negate {
+					continue
+				}
+				if direction, isPresent := patterns[pattern.internalID]; isPresent && direction != pattern.Direction {
+					patterns[pattern.internalID] = DirectionBoth
+				} else {
+					patterns[pattern.internalID] = pattern.Direction
+				}
+			}
+		}
+	}
+
+	return patterns
+}
+
+// RulePatterns returns the internal ids of the patterns of a rule which are not negated, each one with the direction
+// in which it is evaluated. Returns nil if the rule does not exist.
+func (rm *rulesManagerImpl) RulePatterns(id RowID) map[uint]uint8 {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	rule, isPresent := rm.rules[id]
+	if !isPresent {
+		return nil
+	}
+	patterns := make(map[uint]uint8, len(rule.Patterns))
+	for _, pattern := range rule.Patterns {
+		if !pattern.Negate {
+			patterns[pattern.internalID] = pattern.Direction
+		}
+	}
+	return patterns
+}
+
+// SuppressMatchedRules removes some rules from the rules matched by a connection. The hidden and the marked flags are
+// cleared only if they were set by a suppressed rule and none of the remaining rules sets them.
+func (rm *rulesManagerImpl) SuppressMatchedRules(connection *Connection, suppressedRules []RowID) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	matchedRules := make([]RowID, 0, len(connection.MatchedRules))
+	suppressedActions, remainingActions := make(map[string]bool), make(map[string]bool)
+	for _, id := range connection.MatchedRules {
+		rule, isPresent := rm.rules[id]
+		if containsRowID(suppressedRules, id) {
+			if isPresent {
+				suppressedActions[rule.Action] = true
+			}
+			continue
+		}
+		matchedRules = append(matchedRules, id)
+		if isPresent {
+			remainingActions[rule.Action] = true
+		}
+	}
+	if suppressedActions[RuleActionHide] && !remainingActions[RuleActionHide] {
+		connection.Hidden = false
+	}
+	if suppressedActions[RuleActionMark] && !remainingActions[RuleActionMark] {
+		connection.Marked = false
+	}
+	connection.MatchedRules = matchedRules
+}
+
+// PatternsServices returns, for each pattern used only by rules scoped to some services, the ports of the services
+// where the pattern is evaluated. The patterns not present are evaluated on all the connections. The returned map must
+// not be modified.
+func (rm *rulesManagerImpl) PatternsServices() map[uint]map[uint16]bool {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	return rm.scopedPatterns
+}
+
+// updatePatternsServicesLocal computes again the services of the patterns after the rules have changed. The map is
+// replaced instead of being updated, because it is shared with the stream handlers. Must be called with the mutex held.
+func (rm *rulesManagerImpl) updatePatternsServicesLocal() {
+	patternsServices := make(map[uint]map[uint16]bool)
+	unscopedPatterns := make(map[uint]bool)
+	for _, rule := range rm.rules {
+		services := rule.servicesScope()
+		for _, pattern := range rule.Patterns {
+			if len(services) == 0 {
+				unscopedPatterns[pattern.internalID] = true
+				continue
+			}
+			ports, isPresent := patternsServices[pattern.internalID]
+			if !isPresent {
+				ports = make(map[uint16]bool)
+				patternsServices[pattern.internalID] = ports
+			}
+			for _, port := range services {
+				ports[port] = true
+			}
+		}
+	}
+	for id := range unscopedPatterns {
+		delete(patternsServices, id)
+	}
+
+	changed := !reflect.DeepEqual(rm.scopedPatterns, patternsServices)
+	rm.scopedPatterns = patternsServices
+	// the shards must be compiled again, otherwise the streams of a service could miss the patterns of its rules
+	if changed && len(rm.patterns) >= rm.shardingMin && !rm.status.PendingVersion.IsZero() {
+		rm.generateDatabase(rm.status.PendingVersion)
+	}
+}
+
+// updateStreamPatternsLocal computes again the patterns of the enabled rules which extend the capture of the streams,
+// and the patterns of the enabled rules which redact their matches. They are sent to the stream handlers with the
+// database, so a new database is compiled if they have changed. Must be called with the mutex held.
+func (rm *rulesManagerImpl) updateStreamPatternsLocal() {
+	extendCapture := make(map[uint]bool)
+	redactPatterns := make(map[uint]bool)
+	for _, rule := range rm.rules {
+		if !rule.Enabled {
+			continue
+		}
+		for _, pattern := range rule.Patterns {
+			if pattern.Negate {
+				continue
+			}
+			if rule.ExtendCapture {
+				extendCapture[pattern.internalID] = true
+			}
+			if rule.Action == RuleActionRedact {
+				redactPatterns[pattern.internalID] = true
+			}
+		}
+	}
+
+	changed := !reflect.DeepEqual(rm.extendCapture, extendCapture) ||
+		!reflect.DeepEqual(rm.redactPatterns, redactPatterns)
+	rm.extendCapture = extendCapture
+	rm.redactPatterns = redactPatterns
+	if changed && !rm.status.PendingVersion.IsZero() {
+		rm.generateDatabase(rm.status.PendingVersion)
+	}
+}
+
 func (rm *rulesManagerImpl) DatabaseUpdateChannel() chan RulesDatabase {
 	return rm.databaseUpdated
 }
@@ -307,13 +942,49 @@ func (rm *rulesManagerImpl) validateAndAddRuleLocal(rule *Rule) error {
 	if _, alreadyPresent := rm.rulesByName[rule.Name]; alreadyPresent {
 		return errors.New("rule name must be unique")
 	}
+	if err := rm.validate.Var(rule.Action, "omitempty,oneof=tag hide mark redact"); err != nil {
+		return err
+	}
+	if err := rm.validate.Var(rule.Services, "dive,min=1"); err != nil {
+		return err
+	}
+	if err := rm.validate.Var(rule.TTL, "max=10080"); err != nil {
+		return err
+	}
+	if err := rm.checkGroupLocal(rule.GroupID); err != nil {
+		return err
+	}
+
+	if err := rm.validateAndAddPatternsLocal(rule.Patterns); err != nil {
+		return err
+	}
+
+	if rule.TTL > 0 {
+		rule.ExpiresAt = time.Now().Add(time.Duration(rule.TTL) * time.Minute)
+		rule.TTL = 0
+	}
+	rm.rules[rule.ID] = *rule
+	rm.rulesByName[rule.Name] = *rule
+	rm.updatePatternsServicesLocal()
+	rm.updateStreamPatternsLocal()
+
+	return nil
+}
 
-	newPatterns := make([]*hyperscan.Pattern, 0, len(rule.Patterns))
+// validateAndAddPatternsLocal compiles the patterns and assigns to each of them the internal id used by hyperscan.
+// Patterns already registered by other rules are shared, the new ones are appended only if all the patterns are valid.
+func (rm *rulesManagerImpl) validateAndAddPatternsLocal(patterns []Pattern) error {
+	newPatterns := make([]*hyperscan.Pattern, 0, len(patterns))
+	newKeys := make([]string, 0, len(patterns))
+	newDecodeLayers := make([][]string, 0, len(patterns))
 	duplicatePatterns := make(map[string]bool)
-	for i, pattern := range rule.Patterns {
+	for i, pattern := range patterns {
 		if err := rm.validate.Struct(pattern); err != nil {
 			return err
 		}
+		if err := rm.validate.Var(pattern.DecodeLayers, "max=3,dive,oneof=url base64 hex"); err != nil {
+			return err
+		}
 
 		regex := pattern.Regex
 		if !strings.HasPrefix(regex, "/") {
@@ -322,58 +993,453 @@ func (rm *rulesManagerImpl) validateAndAddRuleLocal(rule *Rule) error {
 		if !strings.HasSuffix(regex, "/") {
 			regex = fmt.Sprintf("%s/", regex)
 		}
-		rule.Patterns[i].Regex = regex
+		patterns[i].Regex = regex
 
 		compiledPattern, err := pattern.BuildPattern()
 		if err != nil {
 			return err
 		}
+		// patterns with different decode layers can't be shared, because their matches are different
+		decodeLayers := normalizeDecodeLayers(pattern.DecodeLayers)
+		patterns[i].DecodeLayers = decodeLayers
 		regex = compiledPattern.String()
+		if len(decodeLayers) > 0 {
+			regex = fmt.Sprintf("%s#%s", regex, strings.Join(decodeLayers, ","))
+		}
 		if _, isPresent := duplicatePatterns[regex]; isPresent {
 			return errors.New("duplicate pattern")
 		}
 		if existingPattern, isPresent := rm.patternsIds[regex]; isPresent {
-			rule.Patterns[i].internalID = existingPattern
+			patterns[i].internalID = existingPattern
 			continue
 		}
 
 		id := len(rm.patternsIds) + len(newPatterns)
-		rule.Patterns[i].internalID = uint(id)
+		patterns[i].internalID = uint(id)
 		compiledPattern.Id = id
 		newPatterns = append(newPatterns, compiledPattern)
+		newKeys = append(newKeys, regex)
+		newDecodeLayers = append(newDecodeLayers, decodeLayers)
 		duplicatePatterns[regex] = true
 	}
 
+	if budget := rm.budgetLocal(len(newPatterns)); len(newPatterns) > 0 && !budget.Fits {
+		return budgetExceededError{budget}
+	}
+	if err := rm.checkPatternsCompile(newPatterns); err != nil {
+		return err
+	}
+
 	startID := len(rm.patterns)
 	for id, pattern := range newPatterns {
 		rm.patterns = append(rm.patterns, pattern)
-		regex := pattern.String()
+		regex := newKeys[id]
 		rm.patternsIds[regex[strings.IndexByte(regex, ':')+1:]] = uint(startID + id)
+		if len(newDecodeLayers[id]) > 0 {
+			rm.decodeLayers[uint(startID+id)] = newDecodeLayers[id]
+		}
 	}
 
-	rm.rules[rule.ID] = *rule
-	rm.rulesByName[rule.Name] = *rule
-
 	return nil
 }
 
-func (rm *rulesManagerImpl) generateDatabase(version RowID) error {
-	database, err := hyperscan.NewStreamDatabase(rm.patterns...)
+// checkPatternsCompile compiles a database with only the new patterns, so that the patterns not supported by hyperscan
+// are refused before the rules are saved instead of making the compilation of the whole database fail later.
+func (rm *rulesManagerImpl) checkPatternsCompile(newPatterns []*hyperscan.Pattern) error {
+	if !rm.checkPatterns || len(newPatterns) == 0 {
+		return nil
+	}
+
+	database, err := hyperscan.NewStreamDatabase(newPatterns...)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid pattern: %v", err)
 	}
+	return database.Close()
+}
+
+// generateDatabase schedules the compilation of the hyperscan database with the current patterns. Multiple requests
+// made while a compilation is running are coalesced into a single one. Must be called with the mutex held.
+func (rm *rulesManagerImpl) generateDatabase(version RowID) {
+	rm.status.Status = DatabaseStatusCompiling
+	rm.status.PendingVersion = version
+
+	select {
+	case rm.compileRequests <- struct{}{}:
+	default: // a compilation is already scheduled and it will include the new patterns
+	}
+}
+
+// Stop stops the workers which compile the rules database and expire the temporary rules. The rules can still be
+// modified, but the database used to scan the connections is not updated anymore.
+func (rm *rulesManagerImpl) Stop() {
+	rm.stopOnce.Do(func() {
+		close(rm.stop)
+	})
+}
+
+func (rm *rulesManagerImpl) isStopped() bool {
+	select {
+	case <-rm.stop:
+		return true
+	default:
+		return false
+	}
+}
 
-	go func() {
-		rm.databaseUpdated <- RulesDatabase{
-			database:     database,
-			databaseSize: len(rm.patterns),
-			version:      version,
+func (rm *rulesManagerImpl) compileWorker() {
+	for {
+		select {
+		case <-rm.stop:
+			return
+		case <-rm.compileRequests:
+		}
+		if rm.isStopped() { // the requests made after Stop are ignored
+			return
 		}
-	}()
 
+		rm.mutex.Lock()
+		patterns := make([]*hyperscan.Pattern, len(rm.patterns))
+		copy(patterns, rm.patterns)
+		decodeLayers := make(map[uint][]string, len(rm.decodeLayers))
+		for id, layers := range rm.decodeLayers {
+			decodeLayers[id] = layers
+		}
+		extendCapturePatterns := make(map[uint]bool, len(rm.extendCapture))
+		for id := range rm.extendCapture {
+			extendCapturePatterns[id] = true
+		}
+		redactPatterns := make(map[uint]bool, len(rm.redactPatterns))
+		for id := range rm.redactPatterns {
+			redactPatterns[id] = true
+		}
+		version := rm.status.PendingVersion
+		scopedPatterns := rm.scopedPatterns
+		shardingMin := rm.shardingMin
+		rm.mutex.Unlock()
+
+		startTime := time.Now()
+		database, err := hyperscan.NewStreamDatabase(patterns...)
+		var shards *rulesDatabaseShards
+		if err == nil && len(scopedPatterns) > 0 && len(patterns) >= shardingMin {
+			if shards, err = compileShards(patterns, scopedPatterns); err != nil {
+				_ = database.Close()
+			}
+		}
+		duration := time.Now().Sub(startTime)
+
+		rm.mutex.Lock()
+		rm.status.CompileDuration = duration.Milliseconds()
+		if err != nil {
+			rm.status.Error = err.Error()
+			log.WithError(err).WithField("version", version).Error("failed to compile rules database")
+		} else {
+			rm.status.Error = ""
+			rm.status.Version = version
+			rm.status.PatternsCount = len(patterns)
+			rm.status.ShardsCount = shards.count()
+			rm.status.DatabaseSize, rm.status.StreamStateSize = databaseSizes(database, shards)
+			rm.status.CompiledAt = time.Now()
+		}
+		if rm.status.PendingVersion == version {
+			if err != nil {
+				rm.status.Status = DatabaseStatusError
+			} else {
+				rm.status.Status = DatabaseStatusReady
+			}
+		}
+		rm.mutex.Unlock()
+
+		if err == nil {
+			select {
+			case rm.databaseUpdated <- RulesDatabase{
+				database:              database,
+				databaseSize:          len(patterns),
+				version:               version,
+				decodeLayers:          decodeLayers,
+				extendCapturePatterns: extendCapturePatterns,
+				redactPatterns:        redactPatterns,
+				shards:                shards,
+			}:
+			case <-rm.stop: // nobody is waiting for the database anymore
+				_ = database.Close()
+				shards.close()
+				return
+			}
+		}
+	}
+}
+
+// compileShards compiles a database for each service with scoped patterns, and a database with the unscoped patterns.
+func compileShards(patterns []*hyperscan.Pattern,
+	scopedPatterns map[uint]map[uint16]bool) (*rulesDatabaseShards, error) {
+	shards := &rulesDatabaseShards{services: make(map[uint16]hyperscan.StreamDatabase)}
+	servicesPatterns := make(map[uint16][]*hyperscan.Pattern)
+	var globalPatterns []*hyperscan.Pattern
+	for _, pattern := range patterns {
+		if services, isScoped := scopedPatterns[uint(pattern.Id)]; isScoped {
+			for port := range services {
+				servicesPatterns[port] = append(servicesPatterns[port], pattern)
+			}
+		} else {
+			globalPatterns = append(globalPatterns, pattern)
+		}
+	}
+
+	for port, servicePatterns := range servicesPatterns {
+		database, err := hyperscan.NewStreamDatabase(append(servicePatterns, globalPatterns...)...)
+		if err != nil {
+			shards.close()
+			return nil, err
+		}
+		shards.services[port] = database
+	}
+	if len(globalPatterns) > 0 {
+		database, err := hyperscan.NewStreamDatabase(globalPatterns...)
+		if err != nil {
+			shards.close()
+			return nil, err
+		}
+		shards.global = database
+	}
+
+	return shards, nil
+}
+
+// databaseSizes returns the total size of the database and of its shards, and the size of the state of a stream,
+// which is allocated for each stream open while scanning.
+func databaseSizes(database hyperscan.StreamDatabase, shards *rulesDatabaseShards) (int, int) {
+	databaseSize, _ := database.Size()
+	streamStateSize, _ := database.StreamSize()
+	if shards != nil {
+		for _, shard := range shards.services {
+			size, _ := shard.Size()
+			databaseSize += size
+		}
+		if shards.global != nil {
+			size, _ := shards.global.Size()
+			databaseSize += size
+		}
+	}
+	return databaseSize, streamStateSize
+}
+
+func (shards *rulesDatabaseShards) count() int {
+	if shards == nil {
+		return 0
+	}
+	return len(shards.services)
+}
+
+func (shards *rulesDatabaseShards) close() {
+	if shards == nil {
+		return
+	}
+	for _, database := range shards.services {
+		_ = database.Close()
+	}
+	if shards.global != nil {
+		_ = shards.global.Close()
+	}
+}
+
+// streamDatabase returns the database used to scan the streams of the service with the given port.
+func (rd RulesDatabase) streamDatabase(servicePort uint16) hyperscan.StreamDatabase {
+	if rd.shards != nil {
+		if database, isPresent := rd.shards.services[servicePort]; isPresent {
+			return database
+		}
+		if rd.shards.global != nil {
+			return rd.shards.global
+		}
+	}
+	return rd.database
+}
+
+// allocScratch allocates the scratch space to be used with all the databases, including the shards.
+func (rd RulesDatabase) allocScratch(scratch *hyperscan.Scratch) error {
+	if err := scratch.Realloc(rd.database); err != nil {
+		return err
+	}
+	if rd.shards != nil {
+		for _, database := range rd.shards.services {
+			if err := scratch.Realloc(database); err != nil {
+				return err
+			}
+		}
+		if rd.shards.global != nil {
+			return scratch.Realloc(rd.shards.global)
+		}
+	}
 	return nil
 }
 
+func (rm *rulesManagerImpl) expirationWorker() {
+	ticker := time.NewTicker(rulesExpirationInterval)
+	defer ticker.Stop()
+
+	for {
+		rm.expireRules(context.Background())
+		select {
+		case <-rm.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireRules disables and archives the temporary rules whose TTL has expired, and returns their ids.
+func (rm *rulesManagerImpl) expireRules(context context.Context) []RowID {
+	now := time.Now()
+	rm.mutex.Lock()
+	var expired []Rule
+	for _, rule := range rm.rules {
+		if !rule.ExpiresAt.IsZero() && !rule.Archived && !rule.ExpiresAt.After(now) {
+			rule.Enabled = false
+			rule.Archived = true
+			rm.rules[rule.ID] = rule
+			rm.rulesByName[rule.Name] = rule
+			expired = append(expired, rule)
+		}
+	}
+	if len(expired) > 0 {
+		rm.updateStreamPatternsLocal()
+	}
+	rm.mutex.Unlock()
+
+	ids := make([]RowID, 0, len(expired))
+	for _, rule := range expired {
+		if _, err := rm.storage.Update(Rules).Context(context).Filter(byID(rule.ID)).
+			One(UnorderedDocument{"enabled": false, "archived": true}); err != nil {
+			log.WithError(err).WithField("rule", rule.ID).Error("failed to archive expired rule")
+		}
+		log.WithField("rule", rule.Name).Info("temporary rule expired")
+		ids = append(ids, rule.ID)
+	}
+
+	return ids
+}
+
+// servicesScope returns the ports of the services whose connections can be matched by the rule, or nil if the rule
+// can match the connections of all the services.
+func (rule Rule) servicesScope() []uint16 {
+	if rule.Filter.ServicePort != 0 {
+		return []uint16{rule.Filter.ServicePort}
+	}
+	return rule.Services
+}
+
+// appliesToService returns true if the rule is not scoped or if it is scoped to the service with the given port.
+func (rule Rule) appliesToService(port uint16) bool {
+	if len(rule.Services) == 0 {
+		return true
+	}
+	for _, service := range rule.Services {
+		if service == port {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesClientAddress checks if the address is the client address of the filter, or if it is in its prefix. The
+// addresses are compared parsed, because an IPv6 address can be written in many forms.
+func (filter Filter) matchesClientAddress(address string) bool {
+	if filter.ClientAddress == "" {
+		return true
+	}
+	ip := net.ParseIP(address)
+	if _, network, err := net.ParseCIDR(filter.ClientAddress); err == nil {
+		return ip != nil && network.Contains(ip)
+	}
+	return ip != nil && ip.Equal(net.ParseIP(filter.ClientAddress))
+}
+
+// matchesConnection checks if the connection satisfies the filter and the services of the rule.
+func (rule Rule) matchesConnection(connection *Connection) bool {
+	filterFunctions := []func(rule Rule) bool{
+		func(rule Rule) bool {
+			return rule.Filter.matchesClientAddress(connection.SourceIP)
+		},
+		func(rule Rule) bool {
+			return rule.Filter.ClientPort == 0 || connection.SourcePort == rule.Filter.ClientPort
+		},
+		func(rule Rule) bool {
+			return rule.Filter.ServicePort == 0 || connection.DestinationPort == rule.Filter.ServicePort
+		},
+		func(rule Rule) bool {
+			return rule.appliesToService(connection.DestinationPort)
+		},
+		func(rule Rule) bool {
+			return rule.Filter.MinDuration == 0 || uint(connection.ClosedAt.Sub(connection.StartedAt).Milliseconds()) >=
+				rule.Filter.MinDuration
+		},
+		func(rule Rule) bool {
+			return rule.Filter.MaxDuration == 0 || uint(connection.ClosedAt.Sub(connection.StartedAt).Milliseconds()) <=
+				rule.Filter.MaxDuration
+		},
+		func(rule Rule) bool {
+			return rule.Filter.MinBytes == 0 || uint(connection.ClientBytes+connection.ServerBytes) >=
+				rule.Filter.MinBytes
+		},
+		func(rule Rule) bool {
+			return rule.Filter.MaxBytes == 0 || uint(connection.ClientBytes+connection.ServerBytes) <=
+				rule.Filter.MinBytes
+		},
+		func(rule Rule) bool {
+			// the absence of a pattern is known only if the streams were scanned until the end
+			return !connection.Truncated || !rule.hasNegatedPatterns()
+		},
+	}
+
+	for _, f := range filterFunctions {
+		if !f(rule) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesPatterns checks if the matches of the two directions of a connection, indexed by the internal ids of the
+// patterns, satisfy all the patterns of the rule. The negated patterns are satisfied when they don't match, so the
+// matches must be of the whole streams.
+func (rule Rule) matchesPatterns(clientMatches map[uint][]PatternSlice, serverMatches map[uint][]PatternSlice) bool {
+	for _, p := range rule.Patterns {
+		if p.matches(clientMatches, serverMatches) == p.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule Rule) hasNegatedPatterns() bool {
+	for _, p := range rule.Patterns {
+		if p.Negate {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks if the occurrences of the pattern in its direction are within the limits of the pattern, ignoring
+// Negate.
+func (p Pattern) matches(clientMatches map[uint][]PatternSlice, serverMatches map[uint][]PatternSlice) bool {
+	checkOccurrences := func(occurrences []PatternSlice) bool {
+		return (p.MinOccurrences == 0 || uint(len(occurrences)) >= p.MinOccurrences) &&
+			(p.MaxOccurrences == 0 || uint(len(occurrences)) <= p.MaxOccurrences)
+	}
+	clientOccurrences, clientPresent := clientMatches[p.internalID]
+	serverOccurrences, serverPresent := serverMatches[p.internalID]
+
+	switch p.Direction {
+	case DirectionToServer:
+		return clientPresent && checkOccurrences(clientOccurrences)
+	case DirectionToClient:
+		return serverPresent && checkOccurrences(serverOccurrences)
+	default:
+		return (clientPresent || serverPresent) && checkOccurrences(append(clientOccurrences, serverOccurrences...))
+	}
+}
+
 func (p *Pattern) BuildPattern() (*hyperscan.Pattern, error) {
 	hp, err := hyperscan.ParsePattern(p.Regex)
 	if err != nil {
@@ -18,9 +18,11 @@
 package main
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/flier/gohs/hyperscan"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -32,7 +34,6 @@ func TestAddAndGetAllRules(t *testing.T) {
 	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
 	require.NoError(t, err)
 	impl := rulesManager.(*rulesManagerImpl)
-	checkVersion(t, rulesManager, impl.rulesByName["flag_out"].ID)
 	checkVersion(t, rulesManager, impl.rulesByName["flag_in"].ID)
 	emptyRule := Rule{Name: "empty", Color: "#fff", Enabled: true}
 	emptyID, err := rulesManager.AddRule(wrapper.Context, emptyRule)
@@ -213,7 +214,6 @@ func TestFillWithMatchedRules(t *testing.T) {
 	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
 	require.NoError(t, err)
 	impl := rulesManager.(*rulesManagerImpl)
-	checkVersion(t, rulesManager, impl.rulesByName["flag_out"].ID)
 	checkVersion(t, rulesManager, impl.rulesByName["flag_in"].ID)
 
 	emptyRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "empty", Color: "#fff"})
@@ -290,13 +290,719 @@ func TestFillWithMatchedRules(t *testing.T) {
 	wrapper.Destroy(t)
 }
 
-func checkVersion(t *testing.T, rulesManager RulesManager, id RowID) {
-	timeout := time.Tick(1 * time.Second)
+func TestRuleMatchesConnection(t *testing.T) {
+	now := time.Now()
+	connection := &Connection{
+		SourceIP:        "10.10.10.10",
+		SourcePort:      60000,
+		DestinationPort: 80,
+		ClientBytes:     32,
+		ServerBytes:     32,
+		StartedAt:       now,
+		ClosedAt:        now.Add(3 * time.Second),
+	}
+
+	assert.True(t, Rule{}.matchesConnection(connection))
+	assert.True(t, Rule{Filter: Filter{ServicePort: 80, ClientAddress: "10.10.10.10", ClientPort: 60000,
+		MinDuration: 2000, MaxDuration: 4000}}.matchesConnection(connection))
+	assert.False(t, Rule{Filter: Filter{ServicePort: 8080}}.matchesConnection(connection))
+	assert.False(t, Rule{Filter: Filter{MinDuration: 4000}}.matchesConnection(connection))
+	assert.False(t, Rule{Services: []uint16{8080}}.matchesConnection(connection))
+	assert.True(t, Rule{Filter: Filter{ClientAddress: "10.10.0.0/16"}}.matchesConnection(connection))
+	assert.False(t, Rule{Filter: Filter{ClientAddress: "10.11.0.0/16"}}.matchesConnection(connection))
+
+	connection.SourceIP = "fd00:10::1"
+	assert.True(t, Rule{Filter: Filter{ClientAddress: "fd00:10:0::0:1"}}.matchesConnection(connection))
+	assert.True(t, Rule{Filter: Filter{ClientAddress: "fd00:10::/32"}}.matchesConnection(connection))
+	assert.False(t, Rule{Filter: Filter{ClientAddress: "fd00:11::/32"}}.matchesConnection(connection))
+	assert.False(t, Rule{Filter: Filter{ClientAddress: "10.10.10.10"}}.matchesConnection(connection))
+
+	rule := Rule{Patterns: []Pattern{
+		{Direction: DirectionToServer, MinOccurrences: 1, internalID: 1},
+		{Direction: DirectionBoth, MaxOccurrences: 2, internalID: 2},
+	}}
+	assert.True(t, rule.matchesPatterns(map[uint][]PatternSlice{1: {{0, 1}}, 2: {{0, 1}}},
+		map[uint][]PatternSlice{2: {{0, 1}}}))
+	assert.False(t, rule.matchesPatterns(map[uint][]PatternSlice{2: {{0, 1}}}, map[uint][]PatternSlice{1: {{0, 1}}}))
+	assert.False(t, rule.matchesPatterns(map[uint][]PatternSlice{1: {{0, 1}}, 2: {{0, 1}, {1, 2}}},
+		map[uint][]PatternSlice{2: {{0, 1}}}))
+}
+
+func TestNegatedPatterns(t *testing.T) {
+	// a request to /admin without the authorization header
+	rule := Rule{Patterns: []Pattern{
+		{Direction: DirectionToServer, internalID: 1},
+		{Direction: DirectionToServer, Negate: true, internalID: 2},
+	}}
+	assert.True(t, rule.matchesPatterns(map[uint][]PatternSlice{1: {{0, 1}}}, map[uint][]PatternSlice{2: {{0, 1}}}))
+	assert.False(t, rule.matchesPatterns(map[uint][]PatternSlice{1: {{0, 1}}, 2: {{0, 1}}}, map[uint][]PatternSlice{}))
+	assert.False(t, rule.matchesPatterns(map[uint][]PatternSlice{}, map[uint][]PatternSlice{}))
+	connection := &Connection{}
+	assert.True(t, rule.matchesConnection(connection))
+	connection.Truncated = true
+	assert.False(t, rule.matchesConnection(connection))
+	assert.True(t, Rule{Patterns: []Pattern{{internalID: 1}}}.matchesConnection(connection))
+}
+
+func TestFillWithNegatedPatterns(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	impl := rulesManager.(*rulesManagerImpl)
+	negatedRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "negated", Color: "#fff",
+		Patterns: []Pattern{{Regex: "authorization", Direction: DirectionToServer, Negate: true}}})
+	require.NoError(t, err)
+	checkVersion(t, rulesManager, negatedRule)
+	negatedID := impl.rules[negatedRule].Patterns[0].internalID
+
+	// a rule made only of negated patterns matches the connections without occurrences of the patterns
+	connection := &Connection{}
+	rulesManager.FillWithMatchedRules(connection, map[uint][]PatternSlice{}, map[uint][]PatternSlice{})
+	assert.Equal(t, []RowID{negatedRule}, connection.MatchedRules)
+	rulesManager.FillWithMatchedRules(connection, map[uint][]PatternSlice{negatedID: {{0, 1}}},
+		map[uint][]PatternSlice{})
+	assert.Empty(t, connection.MatchedRules)
+	rulesManager.FillWithMatchedRules(connection, map[uint][]PatternSlice{},
+		map[uint][]PatternSlice{negatedID: {{0, 1}}})
+	assert.Equal(t, []RowID{negatedRule}, connection.MatchedRules)
+
+	// the patterns could occur in the part of a truncated connection which was not scanned
+	connection = &Connection{Truncated: true}
+	rulesManager.FillWithMatchedRules(connection, map[uint][]PatternSlice{}, map[uint][]PatternSlice{})
+	assert.Empty(t, connection.MatchedRules)
+
+	wrapper.Destroy(t)
+}
+
+func TestRuleActions(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+
+	_, err = rulesManager.AddRule(wrapper.Context, Rule{Name: "invalid", Color: "#fff", Action: "drop"})
+	assert.Error(t, err)
+
+	hideRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "healthcheck", Color: "#fff",
+		Action: RuleActionHide, Patterns: []Pattern{{Regex: "GET /health", Direction: DirectionToServer}}})
+	require.NoError(t, err)
+	markRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "exploit", Color: "#fff",
+		Action: RuleActionMark, Patterns: []Pattern{{Regex: "UNION SELECT", Direction: DirectionToServer}}})
+	require.NoError(t, err)
+	redactRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "credentials", Color: "#fff",
+		Action: RuleActionRedact, Patterns: []Pattern{
+			{Regex: "password=\\w+", Direction: DirectionToServer},
+			{Regex: "token=\\w+"},
+		}})
+	require.NoError(t, err)
+	checkVersion(t, rulesManager, redactRule)
+
+	patternID := func(ruleID RowID, index int) uint {
+		rule, isPresent := rulesManager.GetRule(ruleID)
+		require.True(t, isPresent)
+		return rule.Patterns[index].internalID
+	}
+
+	conn := &Connection{}
+	rulesManager.FillWithMatchedRules(conn, map[uint][]PatternSlice{patternID(hideRule, 0): {{0, 11}}},
+		map[uint][]PatternSlice{})
+	assert.ElementsMatch(t, []RowID{hideRule}, conn.MatchedRules)
+	assert.True(t, conn.Hidden)
+	assert.False(t, conn.Marked)
+	assert.Empty(t, rulesManager.RedactedPatterns(conn.MatchedRules))
+
+	conn = &Connection{}
+	rulesManager.FillWithMatchedRules(conn, map[uint][]PatternSlice{patternID(markRule, 0): {{0, 12}},
+		patternID(redactRule, 0): {{20, 34}}}, map[uint][]PatternSlice{patternID(redactRule, 1): {{5, 15}}})
+	assert.ElementsMatch(t, []RowID{markRule, redactRule}, conn.MatchedRules)
+	assert.False(t, conn.Hidden)
+	assert.True(t, conn.Marked)
+	assert.Equal(t, map[uint]uint8{patternID(redactRule, 0): DirectionToServer,
+		patternID(redactRule, 1): DirectionBoth}, rulesManager.RedactedPatterns(conn.MatchedRules))
+	// the streams keep the documents in memory until the connection is redacted
+	impl := rulesManager.(*rulesManagerImpl)
+	assert.Equal(t, map[uint]bool{patternID(redactRule, 0): true, patternID(redactRule, 1): true},
+		impl.redactPatterns)
+
+	updated, err := rulesManager.UpdateRule(wrapper.Context, redactRule, Rule{Name: "credentials", Color: "#000",
+		Action: RuleActionTag})
+	require.NoError(t, err)
+	assert.True(t, updated)
+	assert.Empty(t, rulesManager.RedactedPatterns(conn.MatchedRules))
+	assert.Empty(t, impl.redactPatterns)
+
+	wrapper.Destroy(t)
+}
+
+func TestBulkRules(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	impl := rulesManager.(*rulesManagerImpl)
+	flagInID := impl.rulesByName[flagInRuleName].ID
+	checkVersion(t, rulesManager, flagInID)
+
+	existingRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "existing", Color: "#fff"})
+	require.NoError(t, err)
+	checkVersion(t, rulesManager, existingRule)
+	patternsCount := len(impl.patterns)
+
+	// the second operation fails, nothing is applied
+	results, err := rulesManager.BulkRules(wrapper.Context, []RuleOperation{
+		{Operation: RuleOperationCreate, Rule: &Rule{Name: "first", Color: "#fff",
+			Patterns: []Pattern{{Regex: "first"}}}},
+		{Operation: RuleOperationCreate, Rule: &Rule{Name: "existing", Color: "#fff"}},
+	})
+	assert.Error(t, err)
+	require.Len(t, results, 2)
+	assert.False(t, results[0].Applied)
+	assert.Empty(t, results[0].Error)
+	assert.NotEmpty(t, results[1].Error)
+	assert.Len(t, rulesManager.GetRules(), 3)
+	assert.Len(t, impl.patterns, patternsCount)
+
+	_, err = rulesManager.BulkRules(wrapper.Context, []RuleOperation{
+		{Operation: RuleOperationDelete, ID: flagInID},
+	})
+	assert.Error(t, err)
+	_, err = rulesManager.BulkRules(wrapper.Context, []RuleOperation{
+		{Operation: RuleOperationEnable, ID: NewRowID()},
+	})
+	assert.Error(t, err)
+
+	results, err = rulesManager.BulkRules(wrapper.Context, []RuleOperation{
+		{Operation: RuleOperationCreate, Rule: &Rule{Name: "first", Color: "#fff",
+			Patterns: []Pattern{{Regex: "first"}}}},
+		{Operation: RuleOperationCreate, Rule: &Rule{Name: "second", Color: "#fff",
+			Patterns: []Pattern{{Regex: "second"}}}},
+		{Operation: RuleOperationUpdate, ID: existingRule, Rule: &Rule{Name: "renamed", Color: "#000"}},
+		{Operation: RuleOperationDisable, ID: existingRule},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+	for _, result := range results {
+		assert.True(t, result.Applied)
+		assert.Empty(t, result.Error)
+	}
+	firstRule, secondRule := results[0].ID, results[1].ID
+	checkVersion(t, rulesManager, secondRule) // a single database generation
+	assert.Len(t, impl.patterns, patternsCount+2)
+
+	rule, isPresent := rulesManager.GetRule(existingRule)
+	require.True(t, isPresent)
+	assert.Equal(t, "renamed", rule.Name)
+	assert.False(t, rule.Enabled)
+
+	conn := &Connection{}
+	rulesManager.FillWithMatchedRules(conn, map[uint][]PatternSlice{}, map[uint][]PatternSlice{})
+	assert.Empty(t, conn.MatchedRules) // the existing rule is disabled
+
+	_, err = rulesManager.BulkRules(wrapper.Context, []RuleOperation{
+		{Operation: RuleOperationDelete, ID: firstRule},
+		{Operation: RuleOperationEnable, ID: existingRule},
+	})
+	require.NoError(t, err)
+	_, isPresent = rulesManager.GetRule(firstRule)
+	assert.False(t, isPresent)
+
+	// the changes are persisted
+	otherRulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	rules := otherRulesManager.GetRules()
+	assert.Len(t, rules, 4)
+	rule, isPresent = otherRulesManager.GetRule(existingRule)
+	require.True(t, isPresent)
+	assert.Equal(t, "renamed", rule.Name)
+	assert.True(t, rule.Enabled)
+	_, isPresent = otherRulesManager.GetRule(secondRule)
+	assert.True(t, isPresent)
+	otherRulesManager.Stop()
+
+	// if a rule can't be saved, the operations already saved are rolled back
+	require.NoError(t, wrapper.Storage.Delete(Rules).Context(wrapper.Context).Filter(byID(secondRule)).One())
+	results, err = rulesManager.BulkRules(wrapper.Context, []RuleOperation{
+		{Operation: RuleOperationCreate, Rule: &Rule{Name: "third", Color: "#fff"}},
+		{Operation: RuleOperationUpdate, ID: existingRule, Rule: &Rule{Name: "renamed_again", Color: "#fff"}},
+		{Operation: RuleOperationDelete, ID: secondRule},
+	})
+	assert.Equal(t, ErrRulesNotSaved, err)
+	require.Len(t, results, 3)
+	assert.NotEmpty(t, results[2].Error)
+	for _, result := range results {
+		assert.False(t, result.Applied)
+	}
+	_, isPresent = rulesManager.GetRule(secondRule)
+	assert.True(t, isPresent)
+	var storedRules []Rule
+	require.NoError(t, wrapper.Storage.Find(Rules).Context(wrapper.Context).
+		Filter(OrderedDocument{{"name", UnorderedDocument{"$in": []string{"third", "renamed_again"}}}}).
+		All(&storedRules))
+	assert.Empty(t, storedRules)
+	var storedRule Rule
+	require.NoError(t, wrapper.Storage.Find(Rules).Context(wrapper.Context).Filter(byID(existingRule)).
+		First(&storedRule))
+	assert.Equal(t, "renamed", storedRule.Name)
+	assert.Equal(t, "#000", storedRule.Color)
+
+	wrapper.Destroy(t)
+}
+
+func TestSetFlag(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	impl := rulesManager.(*rulesManagerImpl)
+	flagOutID := impl.rulesByName["flag_out"].ID
+	flagInID := impl.rulesByName["flag_in"].ID
+	checkVersion(t, rulesManager, flagInID)
+
+	assert.NoError(t, rulesManager.SetFlag(wrapper.Context, "FLAG{test}"))
+	select {
+	case <-rulesManager.DatabaseUpdateChannel():
+		t.Fatal("database should not be regenerated if the flag regex is not changed")
+	default:
+	}
+
+	assert.NoError(t, rulesManager.SetFlag(wrapper.Context, "FLAG{new}"))
+	checkVersion(t, rulesManager, flagInID)
+
+	flagOutRule, isPresent := rulesManager.GetRule(flagOutID)
+	assert.True(t, isPresent)
+	assert.Equal(t, []Pattern{{Regex: "/FLAG{new}/", Direction: DirectionToClient, Flags: RegexFlags{Utf8Mode: true},
+		internalID: 1}}, flagOutRule.Patterns)
+	flagInRule, isPresent := rulesManager.GetRule(flagInID)
+	assert.True(t, isPresent)
+	assert.Equal(t, []Pattern{{Regex: "/FLAG{new}/", Direction: DirectionToServer, Flags: RegexFlags{Utf8Mode: true},
+		internalID: 1}}, flagInRule.Patterns)
+
+	var storedRule Rule
+	assert.NoError(t, wrapper.Storage.Find(Rules).Context(wrapper.Context).Filter(byID(flagOutID)).First(&storedRule))
+	assert.Equal(t, "/FLAG{new}/", storedRule.Patterns[0].Regex)
 
+	conn := &Connection{}
+	rulesManager.FillWithMatchedRules(conn, map[uint][]PatternSlice{1: {{0, 0}}},
+		map[uint][]PatternSlice{1: {{0, 0}, {0, 0}}})
+	assert.ElementsMatch(t, []RowID{flagOutID, flagInID}, conn.MatchedRules)
+	assert.Equal(t, 1, conn.FlagsIn)
+	assert.Equal(t, 2, conn.FlagsOut)
+
+	wrapper.Destroy(t)
+}
+
+func TestRulesDatabaseStatus(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	impl := rulesManager.(*rulesManagerImpl)
+	checkVersion(t, rulesManager, impl.rulesByName["flag_in"].ID)
+
+	status := rulesManager.GetStatus()
+	assert.Equal(t, DatabaseStatusReady, status.Status)
+	assert.Equal(t, impl.rulesByName["flag_in"].ID, status.Version)
+	assert.Equal(t, 1, status.PatternsCount)
+	assert.Empty(t, status.Error)
+
+	var lastRuleID RowID
+	for i := 0; i < 10; i++ {
+		lastRuleID, err = rulesManager.AddRule(wrapper.Context, Rule{
+			Name:     fmt.Sprintf("rule%d", i),
+			Color:    "#fff",
+			Patterns: []Pattern{{Regex: fmt.Sprintf("pattern%d", i)}},
+		})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, lastRuleID, rulesManager.GetStatus().PendingVersion)
+	checkVersion(t, rulesManager, lastRuleID)
+
+	status = rulesManager.GetStatus()
+	assert.Equal(t, DatabaseStatusReady, status.Status)
+	assert.Equal(t, lastRuleID, status.Version)
+	assert.Equal(t, 11, status.PatternsCount)
+
+	wrapper.Destroy(t)
+}
+
+func TestExtendCaptureRules(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	impl := rulesManager.(*rulesManagerImpl)
+	checkVersion(t, rulesManager, impl.rulesByName["flag_in"].ID)
+
+	rule := Rule{Name: "extend", Color: "#fff", ExtendCapture: true,
+		Patterns: []Pattern{{Regex: "extend"}, {Regex: "negated", Negate: true}}}
+	ruleID, err := rulesManager.AddRule(wrapper.Context, rule)
+	require.NoError(t, err)
+	checkVersion(t, rulesManager, ruleID)
+	extendPattern := impl.rules[ruleID].Patterns[0].internalID
+	assert.Equal(t, map[uint]bool{extendPattern: true}, impl.extendCapture)
+
+	rule.ExtendCapture = false
+	updated, err := rulesManager.UpdateRule(wrapper.Context, ruleID, rule)
+	require.NoError(t, err)
+	require.True(t, updated)
+	assert.Empty(t, impl.extendCapture)
 	select {
 	case database := <-rulesManager.DatabaseUpdateChannel():
-		assert.Equal(t, id, database.version)
-	case <-timeout:
-		t.Fatal("timeout")
+		assert.Empty(t, database.extendCapturePatterns)
+	case <-time.After(time.Second):
+		t.Fatal("the database should be compiled again when the extended capture patterns change")
 	}
+	var storedRule Rule
+	require.NoError(t, wrapper.Storage.Find(Rules).Context(wrapper.Context).Filter(byID(ruleID)).First(&storedRule))
+	assert.False(t, storedRule.ExtendCapture)
+
+	rule.ExtendCapture = true
+	_, err = rulesManager.BulkRules(wrapper.Context, []RuleOperation{
+		{Operation: RuleOperationUpdate, ID: ruleID, Rule: &rule}})
+	require.NoError(t, err)
+	assert.Equal(t, map[uint]bool{extendPattern: true}, impl.extendCapture)
+	require.NoError(t, wrapper.Storage.Find(Rules).Context(wrapper.Context).Filter(byID(ruleID)).First(&storedRule))
+	assert.True(t, storedRule.ExtendCapture)
+
+	// the disabled rules don't extend the capture
+	_, err = rulesManager.BulkRules(wrapper.Context, []RuleOperation{{Operation: RuleOperationDisable, ID: ruleID}})
+	require.NoError(t, err)
+	assert.Empty(t, impl.extendCapture)
+
+	wrapper.Destroy(t)
+}
+
+func TestStopRulesManager(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	impl := rulesManager.(*rulesManagerImpl)
+	checkVersion(t, rulesManager, impl.rulesByName["flag_in"].ID)
+
+	rulesManager.Stop()
+	rulesManager.Stop()
+	_, err = rulesManager.AddRule(wrapper.Context, Rule{Name: "stopped", Color: "#fff",
+		Patterns: []Pattern{{Regex: "stopped"}}})
+	require.NoError(t, err)
+	select {
+	case <-rulesManager.DatabaseUpdateChannel():
+		t.Fatal("the database should not be compiled after the rules manager is stopped")
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.Equal(t, DatabaseStatusCompiling, rulesManager.GetStatus().Status)
+
+	wrapper.Destroy(t)
+}
+
+// checkVersion waits until the database with the specified version is compiled. Since the compilation requests are
+// coalesced, the databases of the previous versions may be skipped.
+func checkVersion(t *testing.T, rulesManager RulesManager, id RowID) {
+	timeout := time.After(1 * time.Second)
+
+	for {
+		select {
+		case database := <-rulesManager.DatabaseUpdateChannel():
+			if database.version == id {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timeout")
+			return
+		}
+	}
+}
+
+func TestRuleServicesScope(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+
+	_, err = rulesManager.AddRule(wrapper.Context, Rule{Name: "invalid", Color: "#fff", Services: []uint16{0}})
+	assert.Error(t, err)
+
+	scopedRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "scoped", Color: "#fff",
+		Services: []uint16{80, 8080}, Patterns: []Pattern{{Regex: "scoped"}, {Regex: "shared"}}})
+	require.NoError(t, err)
+	globalRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "global", Color: "#fff",
+		Patterns: []Pattern{{Regex: "shared"}}})
+	require.NoError(t, err)
+	checkVersion(t, rulesManager, globalRule)
+
+	scopedPattern := rulesManager.(*rulesManagerImpl).rules[scopedRule].Patterns[0].internalID
+	sharedPattern := rulesManager.(*rulesManagerImpl).rules[scopedRule].Patterns[1].internalID
+	assert.Equal(t, map[uint]map[uint16]bool{scopedPattern: {80: true, 8080: true}}, rulesManager.PatternsServices())
+
+	matches := map[uint][]PatternSlice{scopedPattern: {{0, 6}}, sharedPattern: {{0, 6}}}
+	conn := &Connection{DestinationPort: 8080}
+	rulesManager.FillWithMatchedRules(conn, matches, map[uint][]PatternSlice{})
+	assert.ElementsMatch(t, []RowID{scopedRule, globalRule}, conn.MatchedRules)
+	conn = &Connection{DestinationPort: 22}
+	rulesManager.FillWithMatchedRules(conn, matches, map[uint][]PatternSlice{})
+	assert.ElementsMatch(t, []RowID{globalRule}, conn.MatchedRules)
+
+	updated, err := rulesManager.UpdateRule(wrapper.Context, scopedRule, Rule{Name: "scoped", Color: "#fff",
+		Services: []uint16{22}})
+	require.NoError(t, err)
+	assert.True(t, updated)
+	rule, _ := rulesManager.GetRule(scopedRule)
+	assert.Equal(t, []uint16{22}, rule.Services)
+	assert.Equal(t, map[uint]map[uint16]bool{scopedPattern: {22: true}}, rulesManager.PatternsServices())
+	rulesManager.FillWithMatchedRules(conn, matches, map[uint][]PatternSlice{})
+	assert.ElementsMatch(t, []RowID{scopedRule, globalRule}, conn.MatchedRules)
+
+	var stored Rule
+	require.NoError(t, wrapper.Storage.Find(Rules).Context(wrapper.Context).Filter(byID(scopedRule)).First(&stored))
+	assert.Equal(t, []uint16{22}, stored.Services)
+
+	_, err = rulesManager.BulkRules(wrapper.Context, []RuleOperation{{Operation: RuleOperationUpdate, ID: scopedRule,
+		Rule: &Rule{Name: "scoped", Color: "#fff"}}})
+	require.NoError(t, err)
+	assert.Empty(t, rulesManager.PatternsServices())
+
+	wrapper.Destroy(t)
+}
+
+func TestTemporaryRules(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	impl := rulesManager.(*rulesManagerImpl)
+
+	_, err = rulesManager.AddRule(wrapper.Context, Rule{Name: "too_long", Color: "#fff", TTL: 100000})
+	assert.Error(t, err)
+
+	temporaryRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "temporary", Color: "#fff", TTL: 10})
+	require.NoError(t, err)
+	permanentRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "permanent", Color: "#fff"})
+	require.NoError(t, err)
+	rule, _ := rulesManager.GetRule(temporaryRule)
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), rule.ExpiresAt, time.Minute)
+	assert.Zero(t, rule.TTL)
+
+	assert.Empty(t, impl.expireRules(wrapper.Context))
+
+	impl.mutex.Lock()
+	rule.ExpiresAt = time.Now().Add(-time.Second)
+	impl.rules[temporaryRule] = rule
+	impl.mutex.Unlock()
+	assert.Equal(t, []RowID{temporaryRule}, impl.expireRules(wrapper.Context))
+	assert.Empty(t, impl.expireRules(wrapper.Context))
+
+	rule, _ = rulesManager.GetRule(temporaryRule)
+	assert.False(t, rule.Enabled)
+	assert.True(t, rule.Archived)
+	rule, _ = rulesManager.GetRule(permanentRule)
+	assert.True(t, rule.Enabled)
+
+	var stored Rule
+	require.NoError(t, wrapper.Storage.Find(Rules).Context(wrapper.Context).Filter(byID(temporaryRule)).
+		First(&stored))
+	assert.False(t, stored.Enabled)
+	assert.True(t, stored.Archived)
+
+	// enabling an archived rule makes it permanent
+	_, err = rulesManager.BulkRules(wrapper.Context, []RuleOperation{{Operation: RuleOperationEnable,
+		ID: temporaryRule}})
+	require.NoError(t, err)
+	rule, _ = rulesManager.GetRule(temporaryRule)
+	assert.True(t, rule.Enabled)
+	assert.False(t, rule.Archived)
+	assert.Zero(t, rule.ExpiresAt)
+
+	wrapper.Destroy(t)
+}
+
+func TestCompileShards(t *testing.T) {
+	var patterns []*hyperscan.Pattern
+	for i, regex := range []string{"/global/", "/http/", "/shared/"} {
+		pattern, err := hyperscan.ParsePattern(regex)
+		require.NoError(t, err)
+		pattern.Id = i
+		patterns = append(patterns, pattern)
+	}
+	database, err := hyperscan.NewStreamDatabase(patterns...)
+	require.NoError(t, err)
+	shards, err := compileShards(patterns, map[uint]map[uint16]bool{1: {80: true}, 2: {80: true, 8080: true}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, shards.count())
+
+	rulesDatabase := RulesDatabase{database: database, shards: shards}
+	scratch, err := hyperscan.NewScratch(database)
+	require.NoError(t, err)
+	require.NoError(t, rulesDatabase.allocScratch(scratch))
+
+	scan := func(servicePort uint16) []uint {
+		var matches []uint
+		stream, err := rulesDatabase.streamDatabase(servicePort).Open(0, scratch,
+			func(id uint, _, _ uint64, _ uint, _ interface{}) error {
+				matches = append(matches, id)
+				return nil
+			}, nil)
+		require.NoError(t, err)
+		require.NoError(t, stream.Scan([]byte("global http shared")))
+		require.NoError(t, stream.Close())
+		return matches
+	}
+	assert.ElementsMatch(t, []uint{0, 1, 2}, scan(80))
+	assert.ElementsMatch(t, []uint{0, 2}, scan(8080))
+	assert.ElementsMatch(t, []uint{0}, scan(22))
+	assert.Equal(t, database, RulesDatabase{database: database}.streamDatabase(80))
+
+	shards.close()
+	require.NoError(t, scratch.Free())
+	require.NoError(t, database.Close())
+}
+
+func TestRulesDatabaseSharding(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	impl := rulesManager.(*rulesManagerImpl)
+	impl.mutex.Lock()
+	impl.shardingMin = 0
+	impl.mutex.Unlock()
+
+	filterRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "filter", Color: "#fff",
+		Filter: Filter{ServicePort: 80}, Patterns: []Pattern{{Regex: "http"}}})
+	require.NoError(t, err)
+	checkVersion(t, rulesManager, filterRule)
+	assert.Equal(t, 1, rulesManager.GetStatus().ShardsCount)
+	assert.Equal(t, map[uint16]bool{80: true},
+		rulesManager.PatternsServices()[impl.rules[filterRule].Patterns[0].internalID])
+
+	scopedRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "scoped", Color: "#fff",
+		Services: []uint16{8080}, Patterns: []Pattern{{Regex: "tcp"}}})
+	require.NoError(t, err)
+	checkVersion(t, rulesManager, scopedRule)
+	assert.Equal(t, 2, rulesManager.GetStatus().ShardsCount)
+
+	// changing the scope of a rule compiles the shards again
+	_, err = rulesManager.UpdateRule(wrapper.Context, scopedRule, Rule{Name: "scoped", Color: "#fff",
+		Services: []uint16{80}})
+	require.NoError(t, err)
+	checkVersion(t, rulesManager, scopedRule)
+	assert.Equal(t, 1, rulesManager.GetStatus().ShardsCount)
+
+	wrapper.Destroy(t)
+}
+
+func TestRulesBudget(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	impl := rulesManager.(*rulesManagerImpl)
+	patternsCount := rulesManager.GetBudget().PatternsCount
+	impl.mutex.Lock()
+	impl.maxPatterns = patternsCount + 1
+	impl.mutex.Unlock()
+
+	budget, err := rulesManager.EstimateRule(Rule{Patterns: []Pattern{{Regex: "first"}, {Regex: "second"}}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, budget.NewPatterns)
+	assert.Equal(t, patternsCount+2, budget.PatternsCount)
+	assert.False(t, budget.Fits)
+	budget, err = rulesManager.EstimateRule(Rule{Patterns: []Pattern{{Regex: "FLAG{test}",
+		Flags: RegexFlags{Utf8Mode: true}}}})
+	require.NoError(t, err)
+	assert.Zero(t, budget.NewPatterns) // shared with the flag rules
+	assert.True(t, budget.Fits)
+	_, err = rulesManager.EstimateRule(Rule{Patterns: []Pattern{{Regex: "invalid("}}})
+	assert.Error(t, err)
+	assert.Equal(t, patternsCount, rulesManager.GetBudget().PatternsCount)
+
+	_, err = rulesManager.AddRule(wrapper.Context, Rule{Name: "exceeding", Color: "#fff",
+		Patterns: []Pattern{{Regex: "first"}, {Regex: "second"}}})
+	assert.IsType(t, budgetExceededError{}, err)
+	_, isPresent := impl.rulesByName["exceeding"]
+	assert.False(t, isPresent)
+
+	id, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "fitting", Color: "#fff",
+		Patterns: []Pattern{{Regex: "first"}}})
+	require.NoError(t, err)
+	checkVersion(t, rulesManager, id)
+	budget = rulesManager.GetBudget()
+	assert.Equal(t, patternsCount+1, budget.PatternsCount)
+	assert.Greater(t, budget.DatabaseSize, 0)
+	assert.Greater(t, budget.StreamStateSize, 0)
+	assert.Equal(t, 1.0, budget.Usage)
+	assert.True(t, budget.Fits)
+
+	wrapper.Destroy(t)
+}
+
+func TestUncompilablePatterns(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	impl := rulesManager.(*rulesManagerImpl)
+	checkVersion(t, rulesManager, impl.rulesByName["flag_in"].ID)
+	patternsCount := rulesManager.GetBudget().PatternsCount
+
+	// the pattern is valid, but it is too large to be compiled with the start of match
+	tooLarge := Pattern{Regex: "foo.{1,20000}bar"}
+	_, err = rulesManager.EstimateRule(Rule{Patterns: []Pattern{tooLarge}})
+	assert.Error(t, err)
+	_, err = rulesManager.AddRule(wrapper.Context, Rule{Name: "too_large", Color: "#fff", Patterns: []Pattern{tooLarge}})
+	assert.Error(t, err)
+	_, err = rulesManager.BulkRules(wrapper.Context, []RuleOperation{{Operation: RuleOperationCreate,
+		Rule: &Rule{Name: "too_large", Color: "#fff", Patterns: []Pattern{tooLarge}}}})
+	assert.Error(t, err)
+
+	_, isPresent := impl.rulesByName["too_large"]
+	assert.False(t, isPresent)
+	assert.Equal(t, patternsCount, rulesManager.GetBudget().PatternsCount)
+	var storedRules []Rule
+	require.NoError(t, wrapper.Storage.Find(Rules).Context(wrapper.Context).
+		Filter(OrderedDocument{{"name", "too_large"}}).All(&storedRules))
+	assert.Empty(t, storedRules)
+	assert.Equal(t, DatabaseStatusReady, rulesManager.GetStatus().Status)
+
+	wrapper.Destroy(t)
+}
+
+func TestRulesBudgetEstimation(t *testing.T) {
+	rm := &rulesManagerImpl{
+		patterns:        make([]*hyperscan.Pattern, 10),
+		maxPatterns:     100,
+		maxDatabaseSize: 2000,
+		status:          RulesDatabaseStatus{PatternsCount: 5, DatabaseSize: 500, StreamStateSize: 20},
+	}
+
+	budget := rm.budgetLocal(0)
+	assert.Equal(t, 10, budget.PatternsCount)
+	assert.Equal(t, 1000, budget.EstimatedDatabaseSize)
+	assert.Equal(t, 0.5, budget.Usage)
+	assert.True(t, budget.Fits)
+
+	budget = rm.budgetLocal(15)
+	assert.Equal(t, 25, budget.PatternsCount)
+	assert.Equal(t, 15, budget.NewPatterns)
+	assert.Equal(t, 2500, budget.EstimatedDatabaseSize)
+	assert.Equal(t, 1.25, budget.Usage)
+	assert.False(t, budget.Fits)
+
+	rm.status = RulesDatabaseStatus{}
+	budget = rm.budgetLocal(0)
+	assert.Zero(t, budget.EstimatedDatabaseSize)
+	assert.Equal(t, 0.1, budget.Usage)
+	assert.True(t, budget.Fits)
 }
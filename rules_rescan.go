@@ -0,0 +1,554 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flier/gohs/hyperscan"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RescanStatusQueued    = "queued"
+	RescanStatusRunning   = "running"
+	RescanStatusCompleted = "completed"
+	RescanStatusCancelled = "cancelled"
+	RescanStatusFailed    = "failed"
+)
+
+const rescanBatchSize = 100
+const rescanQueueSize = 64
+
+// RuleRescan is the state of the backfill of a rule on the stored connections. TotalConnections is the number of
+// connections in the database when the rescan started, and it is only an estimate of the connections to scan, because
+// the connections excluded by the filter of the rule are skipped without being counted.
+type RuleRescan struct {
+	RuleID             RowID     `json:"rule_id"`
+	Status             string    `json:"status"`
+	TotalConnections   int64     `json:"total_connections"`
+	ScannedConnections int64     `json:"scanned_connections"`
+	MatchedConnections int64     `json:"matched_connections"`
+	QueuedAt           time.Time `json:"queued_at"`
+	StartedAt          time.Time `json:"started_at"`
+	CompletedAt        time.Time `json:"completed_at"`
+	Error              string    `json:"error,omitempty"`
+}
+
+type ruleRescanJob struct {
+	rescan     RuleRescan
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+}
+
+// RulesRescanner runs the patterns of the rules on the payloads of the connections already in the database, so that
+// the rules created after the traffic has been imported match also the historical connections. The rescans are queued
+// and executed one at a time, with the patterns compiled in a hyperscan block database.
+type RulesRescanner struct {
+	storage                Storage
+	rulesManager           RulesManager
+	notificationController *NotificationController
+	rescans                map[RowID]*ruleRescanJob
+	queue                  chan *ruleRescanJob
+	stop                   chan struct{}
+	mutex                  sync.Mutex
+}
+
+func NewRulesRescanner(storage Storage, rulesManager RulesManager,
+	notificationController *NotificationController) *RulesRescanner {
+	return &RulesRescanner{
+		storage:                storage,
+		rulesManager:           rulesManager,
+		notificationController: notificationController,
+		rescans:                make(map[RowID]*ruleRescanJob),
+		queue:                  make(chan *ruleRescanJob, rescanQueueSize),
+		stop:                   make(chan struct{}),
+	}
+}
+
+// Rescan queues the rescan of the rule. A rule can't be rescanned while a previous rescan is queued or running.
+func (rr *RulesRescanner) Rescan(ruleID RowID) (RuleRescan, error) {
+	rule, isPresent := rr.rulesManager.GetRule(ruleID)
+	if !isPresent {
+		return RuleRescan{}, errors.New("rule not found")
+	}
+	if !rule.Enabled {
+		return RuleRescan{}, errors.New("rule is disabled")
+	}
+
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if job, isPresent := rr.rescans[ruleID]; isPresent &&
+		(job.rescan.Status == RescanStatusQueued || job.rescan.Status == RescanStatusRunning) {
+		return RuleRescan{}, errors.New("rescan already in progress")
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	job := &ruleRescanJob{
+		rescan: RuleRescan{
+			RuleID:   ruleID,
+			Status:   RescanStatusQueued,
+			QueuedAt: time.Now(),
+		},
+		ctx:        ctx,
+		cancelFunc: cancelFunc,
+	}
+	select {
+	case rr.queue <- job:
+	default:
+		cancelFunc()
+		return RuleRescan{}, errors.New("too many rescans queued")
+	}
+	rr.rescans[ruleID] = job
+
+	return job.rescan, nil
+}
+
+func (rr *RulesRescanner) GetRescan(ruleID RowID) (RuleRescan, bool) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if job, isPresent := rr.rescans[ruleID]; isPresent {
+		return job.rescan, true
+	}
+	return RuleRescan{}, false
+}
+
+func (rr *RulesRescanner) GetRescans() []RuleRescan {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	rescans := make([]RuleRescan, 0, len(rr.rescans))
+	for _, job := range rr.rescans {
+		rescans = append(rescans, job.rescan)
+	}
+	return rescans
+}
+
+// CancelRescan stops the rescan of the rule. The connections already updated keep the rule in their matched rules.
+func (rr *RulesRescanner) CancelRescan(ruleID RowID) bool {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	job, isPresent := rr.rescans[ruleID]
+	if !isPresent || (job.rescan.Status != RescanStatusQueued && job.rescan.Status != RescanStatusRunning) {
+		return false
+	}
+	job.cancelFunc()
+	if job.rescan.Status == RescanStatusQueued {
+		job.rescan.Status = RescanStatusCancelled
+		job.rescan.CompletedAt = time.Now()
+	}
+	return true
+}
+
+// Stop cancels all the rescans queued or running, and makes Run return.
+func (rr *RulesRescanner) Stop() {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	select {
+	case <-rr.stop:
+	default:
+		close(rr.stop)
+	}
+	for _, job := range rr.rescans {
+		job.cancelFunc()
+		if job.rescan.Status == RescanStatusQueued {
+			job.rescan.Status = RescanStatusCancelled
+			job.rescan.CompletedAt = time.Now()
+		}
+	}
+}
+
+// Run executes the queued rescans one at a time, and returns when the rescanner is stopped.
+func (rr *RulesRescanner) Run() {
+	for {
+		var job *ruleRescanJob
+		select {
+		case <-rr.stop:
+			return
+		case job = <-rr.queue:
+		}
+
+		rr.mutex.Lock()
+		if job.rescan.Status != RescanStatusQueued { // cancelled while queued
+			rr.mutex.Unlock()
+			continue
+		}
+		job.rescan.Status = RescanStatusRunning
+		job.rescan.StartedAt = time.Now()
+		rr.mutex.Unlock()
+		rr.notify(job)
+
+		err := rr.rescanRule(job)
+
+		rr.mutex.Lock()
+		switch {
+		case job.ctx.Err() != nil:
+			job.rescan.Status = RescanStatusCancelled
+		case err != nil:
+			job.rescan.Status = RescanStatusFailed
+			job.rescan.Error = err.Error()
+			log.WithError(err).WithField("rule_id", job.rescan.RuleID).Error("failed to rescan the connections")
+		default:
+			job.rescan.Status = RescanStatusCompleted
+		}
+		job.rescan.CompletedAt = time.Now()
+		job.cancelFunc()
+		rr.mutex.Unlock()
+		rr.notify(job)
+	}
+}
+
+func (rr *RulesRescanner) rescanRule(job *ruleRescanJob) error {
+	rule, isPresent := rr.rulesManager.GetRule(job.rescan.RuleID)
+	if !isPresent {
+		return errors.New("rule not found")
+	}
+	if len(rule.Patterns) == 0 {
+		return nil
+	}
+
+	database, decodeLayers, err := compileRescanDatabase(rule)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = database.Close()
+	}()
+	scratch, err := hyperscan.NewScratch(database)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = scratch.Free()
+	}()
+
+	if stats, err := rr.storage.Stats(job.ctx, Connections); err == nil {
+		rr.mutex.Lock()
+		job.rescan.TotalConnections = stats.Documents
+		rr.mutex.Unlock()
+	}
+
+	lastID := EmptyRowID()
+	for {
+		var connections []Connection
+		find := rr.storage.Find(Connections).Context(job.ctx).Filter(rescanConnectionsFilter(rule)).
+			Sort("_id", true).Limit(rescanBatchSize)
+		if !lastID.IsZero() {
+			find = find.Filter(OrderedDocument{{"_id", UnorderedDocument{"$gt": lastID}}})
+		}
+		if err := find.All(&connections); err != nil {
+			return err
+		}
+		if len(connections) == 0 {
+			return nil
+		}
+
+		for i := range connections {
+			if err := job.ctx.Err(); err != nil {
+				return err
+			}
+			matched, err := rr.rescanConnection(job.ctx, rule, &connections[i], database, scratch, decodeLayers)
+			if err != nil {
+				return err
+			}
+
+			rr.mutex.Lock()
+			job.rescan.ScannedConnections++
+			if matched {
+				job.rescan.MatchedConnections++
+			}
+			rr.mutex.Unlock()
+		}
+		lastID = connections[len(connections)-1].ID
+	}
+}
+
+// rescanConnection scans the payloads of the connection and, if the connection satisfies the rule, adds the rule to its
+// matched rules, applies the action of the rule and counts the match in the statistics, as the reassembly does.
+func (rr *RulesRescanner) rescanConnection(c context.Context, rule Rule, connection *Connection,
+	database hyperscan.BlockDatabase, scratch *hyperscan.Scratch, decodeLayers map[uint][]string) (bool, error) {
+	if !rule.matchesConnection(connection) {
+		return false, nil
+	}
+
+	var streams []ConnectionStream
+	if err := rr.storage.Find(ConnectionStreams).Context(c).
+		Filter(OrderedDocument{{"connection_id", connection.ID}}).
+		Projection(OrderedDocument{{"from_client", 1}, {"document_index", 1}, {"payload", 1}}).
+		Sort("document_index", true).All(&streams); err != nil {
+		return false, err
+	}
+
+	clientMatches, serverMatches, err := scanConnectionStreams(streams, database, scratch, decodeLayers)
+	if err != nil {
+		return false, err
+	}
+	if !rule.matchesPatterns(clientMatches, serverMatches) {
+		return false, nil
+	}
+
+	update := UnorderedDocument{"$addToSet": UnorderedDocument{"matched_rules": rule.ID}}
+	switch rule.Action {
+	case RuleActionHide:
+		update["$set"] = UnorderedDocument{"hidden": true}
+	case RuleActionMark:
+		update["$set"] = UnorderedDocument{"marked": true}
+	case RuleActionRedact:
+		fields, err := rr.redactConnection(c, rule, connection, streams, clientMatches, serverMatches)
+		if err != nil {
+			return false, err
+		}
+		if len(fields) > 0 {
+			update["$set"] = fields
+		}
+	}
+	if _, err := rr.storage.Update(Connections).Context(c).Filter(byID(connection.ID)).OneComplex(update); err != nil {
+		return false, err
+	}
+
+	var results interface{}
+	rangeStart := connection.StartedAt.Unix() / 60 // the statistic records are grouped by minutes
+	if _, err := rr.storage.Update(Statistics).Context(c).Upsert(&results).
+		Filter(OrderedDocument{{"_id", time.Unix(rangeStart*60, 0)}}).
+		OneComplex(UnorderedDocument{"$inc": UnorderedDocument{
+			fmt.Sprintf("matched_rules.%s", rule.ID.Hex()): 1,
+		}}); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// redactConnection overwrites with RedactionByte the slices matched by the patterns of the rule in the stored
+// documents of the connection, and returns the fields of the connection built from the secrets: the previews, the
+// references and the fingerprints, computed again on the redacted payloads. The streams must be sorted by document
+// index.
+func (rr *RulesRescanner) redactConnection(c context.Context, rule Rule, connection *Connection,
+	streams []ConnectionStream, clientMatches, serverMatches map[uint][]PatternSlice) (UnorderedDocument, error) {
+	var clientSlices, serverSlices []PatternSlice
+	for _, pattern := range rule.Patterns {
+		if pattern.Negate {
+			continue
+		}
+		if pattern.Direction != DirectionToClient {
+			clientSlices = append(clientSlices, clientMatches[pattern.internalID]...)
+		}
+		if pattern.Direction != DirectionToServer {
+			serverSlices = append(serverSlices, serverMatches[pattern.internalID]...)
+		}
+	}
+
+	var secrets [][]byte
+	clientFingerprint, serverFingerprint := newMinHash(), newMinHash()
+	var clientLength, serverLength uint64
+	for _, stream := range streams {
+		var redacted [][]byte
+		if stream.FromClient {
+			redacted = redactPayload(stream.Payload, clientLength, clientSlices)
+			clientFingerprint.Write(stream.Payload)
+			clientLength += uint64(len(stream.Payload))
+		} else {
+			redacted = redactPayload(stream.Payload, serverLength, serverSlices)
+			serverFingerprint.Write(stream.Payload)
+			serverLength += uint64(len(stream.Payload))
+		}
+		if len(redacted) == 0 {
+			continue
+		}
+		secrets = append(secrets, redacted...)
+		if _, err := rr.storage.Update(ConnectionStreams).Context(c).Filter(byID(stream.ID)).
+			One(UnorderedDocument{
+				"payload":        stream.Payload,
+				"payload_string": strings.ToValidUTF8(string(stream.Payload), ""),
+			}); err != nil {
+			return nil, err
+		}
+	}
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+
+	references := make([]string, 0, len(connection.References))
+	presentReferences := make(map[string]bool, len(connection.References))
+	for _, reference := range connection.References {
+		if reference = redactString(reference, secrets); !presentReferences[reference] {
+			presentReferences[reference] = true
+			references = append(references, reference)
+		}
+	}
+	clientMinHash, serverMinHash := clientFingerprint.Signature(), serverFingerprint.Signature()
+	fields := UnorderedDocument{
+		"references":     references,
+		"client_minhash": clientMinHash,
+		"server_minhash": serverMinHash,
+		"minhash_bands":  fingerprintBands(clientMinHash, serverMinHash),
+	}
+	if connection.ClientPreview != nil {
+		fields["client_preview"] = redactPreview(connection.ClientPreview, clientSlices, secrets)
+	}
+	if connection.ServerPreview != nil {
+		fields["server_preview"] = redactPreview(connection.ServerPreview, serverSlices, secrets)
+	}
+	return fields, nil
+}
+
+// redactPreview overwrites with RedactionByte the matches in the bytes of the preview, which are the first bytes of
+// the stream, and removes the secrets from its strings.
+func redactPreview(preview *StreamPreview, matches []PatternSlice, secrets [][]byte) *StreamPreview {
+	if prefix, err := hex.DecodeString(preview.Hex); err == nil {
+		redactPayload(prefix, 0, matches)
+		preview.Hex = hex.EncodeToString(prefix)
+	}
+	for i := range preview.Strings {
+		preview.Strings[i] = redactString(preview.Strings[i], secrets)
+	}
+	return preview
+}
+
+func (rr *RulesRescanner) notify(job *ruleRescanJob) {
+	rescan, _ := rr.GetRescan(job.rescan.RuleID)
+	rr.notificationController.Notify("rules.rescan", rescan)
+}
+
+// compileRescanDatabase compiles the patterns of the rule in a block database, with the same ids used by the rules
+// manager, and returns the decode layers of the patterns which have them.
+func compileRescanDatabase(rule Rule) (hyperscan.BlockDatabase, map[uint][]string, error) {
+	patterns := make([]*hyperscan.Pattern, 0, len(rule.Patterns))
+	decodeLayers := make(map[uint][]string)
+	for _, pattern := range rule.Patterns {
+		compiledPattern, err := pattern.BuildPattern()
+		if err != nil {
+			return nil, nil, err
+		}
+		compiledPattern.Id = int(pattern.internalID)
+		patterns = append(patterns, compiledPattern)
+		if len(pattern.DecodeLayers) > 0 {
+			decodeLayers[pattern.internalID] = pattern.DecodeLayers
+		}
+	}
+
+	database, err := hyperscan.NewBlockDatabase(patterns...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return database, decodeLayers, nil
+}
+
+// rescanConnectionsFilter selects the connections not yet matched by the rule, restricted to the ones allowed by the
+// address and ports filters and by the services of the rule. The other filters are checked on each connection.
+func rescanConnectionsFilter(rule Rule) OrderedDocument {
+	filter := OrderedDocument{{"matched_rules", UnorderedDocument{"$ne": rule.ID}}}
+	if _, network, err := net.ParseCIDR(rule.Filter.ClientAddress); err == nil {
+		filter = append(filter, ConnectionsQuery{}.ClientSubnet(network).Document()...)
+	} else if ip := net.ParseIP(rule.Filter.ClientAddress); ip != nil {
+		filter = append(filter, OrderedDocument{{"ip_src", ip.String()}}...)
+	}
+	if rule.Filter.ClientPort != 0 {
+		filter = append(filter, OrderedDocument{{"port_src", rule.Filter.ClientPort}}...)
+	}
+	if rule.Filter.ServicePort != 0 {
+		filter = append(filter, OrderedDocument{{"port_dst", rule.Filter.ServicePort}}...)
+	} else if services := rule.servicesScope(); len(services) > 0 {
+		filter = append(filter, OrderedDocument{{"port_dst", UnorderedDocument{"$in": services}}}...)
+	}
+	return filter
+}
+
+// scanConnectionStreams scans the payloads of each direction as a single block, and the runs of the payloads decoded
+// with the layers of the patterns, like the stream handlers do during the import. The streams must be sorted by
+// document index.
+func scanConnectionStreams(streams []ConnectionStream, database hyperscan.BlockDatabase, scratch *hyperscan.Scratch,
+	decodeLayers map[uint][]string) (map[uint][]PatternSlice, map[uint][]PatternSlice, error) {
+	enabledLayers := make(map[string]bool)
+	for _, layers := range decodeLayers {
+		for _, layer := range layers {
+			enabledLayers[layer] = true
+		}
+	}
+
+	scanDirection := func(fromClient bool) (map[uint][]PatternSlice, error) {
+		matches := make(map[uint][]PatternSlice)
+		var payload []byte
+		var documentsStarts []int
+		for _, stream := range streams {
+			if stream.FromClient == fromClient {
+				documentsStarts = append(documentsStarts, len(payload))
+				payload = append(payload, stream.Payload...)
+			}
+		}
+
+		onMatch := func(id uint, from uint64, to uint64, _ uint, _ interface{}) error {
+			matches[id] = append(matches[id], PatternSlice{from, to})
+			return nil
+		}
+		if err := database.Scan(payload, scratch, onMatch, nil); err != nil {
+			return nil, err
+		}
+		if len(enabledLayers) == 0 {
+			return matches, nil
+		}
+
+		for i, start := range documentsStarts {
+			end := len(payload)
+			if i+1 < len(documentsStarts) {
+				end = documentsStarts[i+1]
+			}
+			for _, chunk := range decodeChunks(payload[start:end], enabledLayers) {
+				lastMatches := make(map[uint]uint64)
+				onDecodedMatch := func(id uint, from uint64, _ uint64, _ uint, _ interface{}) error {
+					if !layersEnabled(decodeLayers[id], chunk.layers) {
+						return nil
+					}
+					if lastFrom, isPresent := lastMatches[id]; isPresent && lastFrom == from {
+						return nil
+					}
+					lastMatches[id] = from
+					matches[id] = append(matches[id],
+						PatternSlice{uint64(start + chunk.start), uint64(start + chunk.end)})
+					return nil
+				}
+				if err := database.Scan(chunk.data, scratch, onDecodedMatch, nil); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		return matches, nil
+	}
+
+	clientMatches, err := scanDirection(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverMatches, err := scanDirection(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return clientMatches, serverMatches, nil
+}
@@ -0,0 +1,181 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRescanConnectionsFilter(t *testing.T) {
+	ruleID := NewRowID()
+
+	filter := rescanConnectionsFilter(Rule{ID: ruleID})
+	assert.Equal(t, OrderedDocument{{"matched_rules", UnorderedDocument{"$ne": ruleID}}}, filter)
+
+	filter = rescanConnectionsFilter(Rule{ID: ruleID, Filter: Filter{ClientAddress: "10.10.10.10", ClientPort: 60000,
+		ServicePort: 80}, Services: []uint16{8080}})
+	assert.Equal(t, OrderedDocument{
+		{"matched_rules", UnorderedDocument{"$ne": ruleID}},
+		{"ip_src", "10.10.10.10"},
+		{"port_src", uint16(60000)},
+		{"port_dst", uint16(80)},
+	}, filter)
+
+	filter = rescanConnectionsFilter(Rule{ID: ruleID, Filter: Filter{ClientAddress: "FD00:0:0:0::0001"}})
+	assert.Equal(t, OrderedDocument{
+		{"matched_rules", UnorderedDocument{"$ne": ruleID}},
+		{"ip_src", "fd00::1"},
+	}, filter)
+
+	filter = rescanConnectionsFilter(Rule{ID: ruleID, Filter: Filter{ClientAddress: "10.10.0.0/16"}})
+	assert.Equal(t, OrderedDocument{
+		{"matched_rules", UnorderedDocument{"$ne": ruleID}},
+		{"ip_src", UnorderedDocument{"$regex": `^10\.10\.`}},
+	}, filter)
+
+	filter = rescanConnectionsFilter(Rule{ID: ruleID, Services: []uint16{8080, 9090}})
+	assert.Equal(t, OrderedDocument{
+		{"matched_rules", UnorderedDocument{"$ne": ruleID}},
+		{"port_dst", UnorderedDocument{"$in": []uint16{8080, 9090}}},
+	}, filter)
+}
+
+func TestRulesRescanner(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+	wrapper.AddCollection(Statistics)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	rescanner := NewRulesRescanner(wrapper.Storage, rulesManager, nil)
+	stopped := make(chan bool)
+	go func() {
+		rescanner.Run()
+		stopped <- true
+	}()
+
+	matchingID, otherID := NewRowID(), NewRowID()
+	_, err = wrapper.Storage.Insert(Connections).Context(wrapper.Context).Many([]interface{}{
+		Connection{ID: matchingID, DestinationPort: 80, MatchedRules: []RowID{}},
+		Connection{ID: otherID, DestinationPort: 80, MatchedRules: []RowID{}},
+	})
+	require.NoError(t, err)
+	_, err = wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).Many([]interface{}{
+		ConnectionStream{ID: NewRowID(), ConnectionID: matchingID, FromClient: true, Payload: []byte("GET /ex")},
+		ConnectionStream{ID: NewRowID(), ConnectionID: matchingID, FromClient: true, DocumentIndex: 1,
+			Payload: []byte("ploit HTTP/1.1")},
+		ConnectionStream{ID: NewRowID(), ConnectionID: otherID, FromClient: true, Payload: []byte("GET / HTTP/1.1")},
+	})
+	require.NoError(t, err)
+
+	ruleID, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "exploit", Color: "#fff", Action: RuleActionMark,
+		Patterns: []Pattern{{Regex: "exploit", Direction: DirectionToServer}}})
+	require.NoError(t, err)
+
+	_, err = rescanner.Rescan(NewRowID())
+	assert.Error(t, err)
+	rescan, err := rescanner.Rescan(ruleID)
+	require.NoError(t, err)
+	assert.Equal(t, RescanStatusQueued, rescan.Status)
+
+	assert.Eventually(t, func() bool {
+		rescan, _ = rescanner.GetRescan(ruleID)
+		return rescan.Status == RescanStatusCompleted
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(2), rescan.ScannedConnections)
+	assert.Equal(t, int64(1), rescan.MatchedConnections)
+	assert.False(t, rescanner.CancelRescan(ruleID))
+
+	var connection Connection
+	require.NoError(t, wrapper.Storage.Find(Connections).Context(wrapper.Context).Filter(byID(matchingID)).
+		First(&connection))
+	assert.Equal(t, []RowID{ruleID}, connection.MatchedRules)
+	assert.True(t, connection.Marked)
+	require.NoError(t, wrapper.Storage.Find(Connections).Context(wrapper.Context).Filter(byID(otherID)).
+		First(&connection))
+	assert.Empty(t, connection.MatchedRules)
+
+	// the connections already matched are not scanned again
+	rescan, err = rescanner.Rescan(ruleID)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		rescan, _ = rescanner.GetRescan(ruleID)
+		return rescan.Status == RescanStatusCompleted
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(1), rescan.ScannedConnections)
+
+	var statistics []StatisticRecord
+	require.NoError(t, wrapper.Storage.Find(Statistics).Context(wrapper.Context).All(&statistics))
+	require.Len(t, statistics, 1)
+	assert.Equal(t, map[string]int64{ruleID.Hex(): 1}, statistics[0].MatchedRules)
+
+	// the secrets matched by the rules with the redact action are removed from the payloads and the previews
+	secretID, secretStreamID := NewRowID(), NewRowID()
+	_, err = wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(Connection{ID: secretID,
+		DestinationPort: 80, MatchedRules: []RowID{}, References: []string{"token=s3cr3t.example.com"},
+		ClientPreview: &StreamPreview{Hex: hex.EncodeToString([]byte("\x00token=s3cr3t")),
+			Strings: []string{"token=s3cr3t"}}})
+	require.NoError(t, err)
+	_, err = wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).One(ConnectionStream{
+		ID: secretStreamID, ConnectionID: secretID, FromClient: true, Payload: []byte("\x00token=s3cr3t")})
+	require.NoError(t, err)
+	redactRuleID, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "secrets", Color: "#fff",
+		Action: RuleActionRedact, Patterns: []Pattern{{Regex: "s3cr3t", Direction: DirectionToServer}}})
+	require.NoError(t, err)
+	_, err = rescanner.Rescan(redactRuleID)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		rescan, _ = rescanner.GetRescan(redactRuleID)
+		return rescan.Status == RescanStatusCompleted
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(1), rescan.MatchedConnections)
+
+	var stream ConnectionStream
+	require.NoError(t, wrapper.Storage.Find(ConnectionStreams).Context(wrapper.Context).Filter(byID(secretStreamID)).
+		First(&stream))
+	assert.Equal(t, "\x00token=******", string(stream.Payload))
+	require.NoError(t, wrapper.Storage.Find(Connections).Context(wrapper.Context).Filter(byID(secretID)).
+		First(&connection))
+	assert.Equal(t, []RowID{redactRuleID}, connection.MatchedRules)
+	assert.Equal(t, []string{"token=******.example.com"}, connection.References)
+	assert.Equal(t, hex.EncodeToString([]byte("\x00token=******")), connection.ClientPreview.Hex)
+	assert.Equal(t, []string{"token=******"}, connection.ClientPreview.Strings)
+	assert.NotEmpty(t, connection.ClientMinHash)
+
+	rescanner.Stop()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the rescanner should stop")
+	}
+	wrapper.Destroy(t)
+}
+
+func TestRedactPreview(t *testing.T) {
+	preview := redactPreview(&StreamPreview{Hex: hex.EncodeToString([]byte("\x00\x01key=s3cr3t")),
+		Strings: []string{"key=s3cr3t", "other"}}, []PatternSlice{{6, 12}, {100, 110}}, [][]byte{[]byte("s3cr3t")})
+	assert.Equal(t, hex.EncodeToString([]byte("\x00\x01key=******")), preview.Hex)
+	assert.Equal(t, []string{"key=******", "other"}, preview.Strings)
+}
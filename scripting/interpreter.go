@@ -0,0 +1,670 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package scripting is an interpreter of a subset of Lua, used to run the scripts of the users inside the process.
+// The scripts can only use the values passed by the host and a small standard library, without access to files,
+// network or processes, and each run is bounded by a budget of instructions, of allocated memory and of nested calls.
+//
+// The supported language is Lua 5.3 without varargs, goto, metatables, coroutines and bitwise operators; all the
+// numbers are floats. The patterns of the string library are replaced by the regex library, which uses the Go
+// regular expressions.
+package scripting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	ErrInstructionsLimit = errors.New("instructions limit exceeded")
+	ErrMemoryLimit       = errors.New("memory limit exceeded")
+	ErrDepthLimit        = errors.New("stack overflow")
+)
+
+// checkInterval is the number of instructions after which the context of a run is checked.
+const checkInterval = 1024
+
+// the memory accounted for the values created by the scripts, in bytes.
+const (
+	tableSize   = 64
+	entrySize   = 32
+	closureSize = 64
+)
+
+// Error is a syntax or a runtime error of a script.
+type Error struct {
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Limits bounds the resources used by a run. Instructions counts the statements and the expressions evaluated, plus
+// the work done by the library functions, Memory the bytes allocated by the strings and by the tables created by the
+// script, also if they are released later, and Depth the nested function calls.
+type Limits struct {
+	Instructions int64
+	Memory       int64
+	Depth        int
+}
+
+// Program is a compiled script, which can be run many times, also concurrently.
+type Program struct {
+	body *block
+}
+
+// Compile parses the source of a script. The error returned is an *Error, with the line of the syntax error.
+func Compile(source string) (*Program, error) {
+	body, err := parse(source)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{body}, nil
+}
+
+// Run executes the program with the standard library and the globals. The run stops with an error when the budget of
+// limits is exhausted or when the context is done.
+func (p *Program) Run(c context.Context, globals map[string]Value, limits Limits) error {
+	it := &interpreter{ctx: c, limits: limits, globals: NewTable()}
+	openLibrary(it)
+	for name, value := range globals {
+		if function, isFunction := value.(Function); isFunction {
+			value = &builtin{name: name, function: function}
+		}
+		it.globals.Set(name, value)
+	}
+
+	return catch(func() {
+		it.execBlock(p.body, &scope{})
+	})
+}
+
+// catch runs f and returns the errors raised with panic by the parser and by the interpreter.
+func catch(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case *Error:
+				err = e
+			case error:
+				err = e
+			default:
+				panic(r)
+			}
+		}
+	}()
+	f()
+	return nil
+}
+
+type interpreter struct {
+	ctx          context.Context
+	limits       Limits
+	globals      *Table
+	instructions int64
+	memory       int64
+	depth        int
+	line         int
+}
+
+// scope contains the local variables of a block. The variables are pointers, shared with the closures which
+// capture them.
+type scope struct {
+	parent *scope
+	names  []string
+	values []*Value
+}
+
+func (s *scope) declare(name string, value Value) {
+	s.names = append(s.names, name)
+	s.values = append(s.values, &value)
+}
+
+func (s *scope) lookup(name string) *Value {
+	for current := s; current != nil; current = current.parent {
+		for i := len(current.names) - 1; i >= 0; i-- {
+			if current.names[i] == name {
+				return current.values[i]
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	flowNormal = iota
+	flowBreak
+	flowReturn
+)
+
+// raise stops the script with a runtime error at the current line.
+func (it *interpreter) raise(err error) {
+	panic(&Error{Line: it.line, Err: err})
+}
+
+func (it *interpreter) raisef(format string, args ...interface{}) {
+	it.raise(fmt.Errorf(format, args...))
+}
+
+// step accounts for n instructions, and checks the context periodically.
+func (it *interpreter) step(n int64) {
+	before := it.instructions
+	it.instructions += n
+	if it.instructions > it.limits.Instructions {
+		it.raise(ErrInstructionsLimit)
+	}
+	if before/checkInterval != it.instructions/checkInterval {
+		if err := it.ctx.Err(); err != nil {
+			it.raise(err)
+		}
+	}
+}
+
+// allocate accounts for n bytes of memory. The library functions allocate the memory before creating their values,
+// so that the values which exceed the limit are never created.
+func (it *interpreter) allocate(n int) {
+	it.memory += int64(n)
+	if n < 0 || it.memory > it.limits.Memory {
+		it.raise(ErrMemoryLimit)
+	}
+}
+
+func (it *interpreter) execBlock(body *block, s *scope) (int, []Value) {
+	for _, statement := range body.statements {
+		if flow, values := it.execStatement(statement, s); flow != flowNormal {
+			return flow, values
+		}
+	}
+	return flowNormal, nil
+}
+
+func (it *interpreter) execStatement(statement statement, s *scope) (int, []Value) {
+	it.step(1)
+	switch st := statement.(type) {
+	case *localStatement:
+		it.line = st.line
+		values := it.evalList(st.expressions, s)
+		for i, name := range st.names {
+			var value Value
+			if i < len(values) {
+				value = values[i]
+			}
+			s.declare(name, value)
+		}
+	case *localFunctionStatement:
+		s.declare(st.name, nil)
+		*s.lookup(st.name) = it.newClosure(st.function, s)
+	case *assignStatement:
+		it.line = st.line
+		it.assign(st, s)
+	case *callStatement:
+		it.call(st.call, s)
+	case *doStatement:
+		return it.execBlock(st.body, &scope{parent: s})
+	case *whileStatement:
+		for isTrue(it.eval(st.condition, s)) {
+			if flow, values := it.loopIteration(st.body, &scope{parent: s}); flow == flowBreak {
+				break
+			} else if flow == flowReturn {
+				return flow, values
+			}
+		}
+	case *repeatStatement:
+		for {
+			// the condition can use the local variables of the body
+			bodyScope := &scope{parent: s}
+			if flow, values := it.loopIteration(st.body, bodyScope); flow == flowBreak {
+				break
+			} else if flow == flowReturn {
+				return flow, values
+			}
+			if isTrue(it.eval(st.condition, bodyScope)) {
+				break
+			}
+		}
+	case *ifStatement:
+		for i, condition := range st.conditions {
+			if isTrue(it.eval(condition, s)) {
+				return it.execBlock(st.blocks[i], &scope{parent: s})
+			}
+		}
+		if st.elseBlock != nil {
+			return it.execBlock(st.elseBlock, &scope{parent: s})
+		}
+	case *numericForStatement:
+		return it.numericFor(st, s)
+	case *genericForStatement:
+		return it.genericFor(st, s)
+	case *returnStatement:
+		return flowReturn, it.evalList(st.expressions, s)
+	case *breakStatement:
+		return flowBreak, nil
+	}
+	return flowNormal, nil
+}
+
+// loopIteration executes the body of a loop, accounting for an instruction also if the body is empty.
+func (it *interpreter) loopIteration(body *block, s *scope) (int, []Value) {
+	it.step(1)
+	return it.execBlock(body, s)
+}
+
+func (it *interpreter) numericFor(st *numericForStatement, s *scope) (int, []Value) {
+	it.line = st.line
+	start, limit, step := it.forNumber(st.start, s, "initial"), it.forNumber(st.limit, s, "limit"), 1.0
+	if st.step != nil {
+		step = it.forNumber(st.step, s, "step")
+	}
+	if step == 0 {
+		it.raisef("'for' step is zero")
+	}
+
+	for i := start; step > 0 && i <= limit || step < 0 && i >= limit; i += step {
+		bodyScope := &scope{parent: s}
+		bodyScope.declare(st.name, i)
+		if flow, values := it.loopIteration(st.body, bodyScope); flow == flowBreak {
+			break
+		} else if flow == flowReturn {
+			return flow, values
+		}
+	}
+	return flowNormal, nil
+}
+
+func (it *interpreter) forNumber(e expression, s *scope, name string) float64 {
+	number, isNumber := it.eval(e, s).(float64)
+	if !isNumber {
+		it.raisef("'for' %s value must be a number", name)
+	}
+	return number
+}
+
+func (it *interpreter) genericFor(st *genericForStatement, s *scope) (int, []Value) {
+	it.line = st.line
+	values := it.evalList(st.expressions, s)
+	for len(values) < 3 {
+		values = append(values, nil)
+	}
+	function, state, control := values[0], values[1], values[2]
+
+	for {
+		it.line = st.line
+		results := it.callValue(function, []Value{state, control})
+		if len(results) == 0 || results[0] == nil {
+			return flowNormal, nil
+		}
+		control = results[0]
+
+		bodyScope := &scope{parent: s}
+		for i, name := range st.names {
+			var value Value
+			if i < len(results) {
+				value = results[i]
+			}
+			bodyScope.declare(name, value)
+		}
+		if flow, values := it.loopIteration(st.body, bodyScope); flow == flowBreak {
+			return flowNormal, nil
+		} else if flow == flowReturn {
+			return flow, values
+		}
+	}
+}
+
+func (it *interpreter) assign(st *assignStatement, s *scope) {
+	// the objects and the keys of the targets are evaluated before the values
+	type reference struct {
+		table *Table
+		key   Value
+	}
+	references := make([]reference, len(st.targets))
+	for i, target := range st.targets {
+		if index, isIndex := target.(*indexExpression); isIndex {
+			object := it.eval(index.object, s)
+			table, isTable := object.(*Table)
+			if !isTable {
+				it.line = index.line
+				it.raisef("attempt to index a %s value", typeName(object))
+			}
+			references[i] = reference{table, it.eval(index.key, s)}
+		}
+	}
+
+	values := it.evalList(st.expressions, s)
+	for i, target := range st.targets {
+		var value Value
+		if i < len(values) {
+			value = values[i]
+		}
+		if name, isName := target.(*nameExpression); isName {
+			if variable := s.lookup(name.name); variable != nil {
+				*variable = value
+			} else {
+				it.setIndex(it.globals, name.name, value)
+			}
+		} else {
+			it.setIndex(references[i].table, references[i].key, value)
+		}
+	}
+}
+
+func (it *interpreter) setIndex(table *Table, key, value Value) {
+	if key == nil {
+		it.raisef("table index is nil")
+	} else if number, isNumber := key.(float64); isNumber && math.IsNaN(number) {
+		it.raisef("table index is NaN")
+	}
+	if value != nil && !table.has(key) {
+		it.allocate(entrySize)
+	}
+	table.Set(key, value)
+}
+
+// evalList evaluates a list of expressions. All the values of the last expression are kept, if it is a call, while
+// the other expressions are truncated to their first value.
+func (it *interpreter) evalList(expressions []expression, s *scope) []Value {
+	values := make([]Value, 0, len(expressions))
+	for i, e := range expressions {
+		if call, isCall := e.(*callExpression); isCall && i == len(expressions)-1 {
+			values = append(values, it.call(call, s)...)
+		} else {
+			values = append(values, it.eval(e, s))
+		}
+	}
+	return values
+}
+
+func (it *interpreter) eval(e expression, s *scope) Value {
+	it.step(1)
+	switch ex := e.(type) {
+	case *constantExpression:
+		return ex.value
+	case *nameExpression:
+		if variable := s.lookup(ex.name); variable != nil {
+			return *variable
+		}
+		return it.globals.Get(ex.name)
+	case *indexExpression:
+		object := it.eval(ex.object, s)
+		key := it.eval(ex.key, s)
+		it.line = ex.line
+		return it.index(object, key)
+	case *callExpression:
+		if values := it.call(ex, s); len(values) > 0 {
+			return values[0]
+		}
+		return nil
+	case *parenthesesExpression:
+		return it.eval(ex.inner, s)
+	case *functionExpression:
+		return it.newClosure(ex, s)
+	case *tableExpression:
+		return it.newTable(ex, s)
+	case *unaryExpression:
+		operand := it.eval(ex.operand, s)
+		it.line = ex.line
+		return it.unary(ex.operator, operand)
+	case *binaryExpression:
+		return it.binary(ex, s)
+	}
+	panic(fmt.Sprintf("unknown expression %T", e))
+}
+
+func (it *interpreter) index(object, key Value) Value {
+	switch o := object.(type) {
+	case *Table:
+		if key == nil {
+			return nil
+		}
+		return o.Get(key)
+	case string: // the methods of the strings, as s:upper()
+		if library, isTable := it.globals.Get("string").(*Table); isTable {
+			return library.Get(key)
+		}
+		return nil
+	}
+	it.raisef("attempt to index a %s value", typeName(object))
+	return nil
+}
+
+func (it *interpreter) newClosure(function *functionExpression, s *scope) *closure {
+	it.allocate(closureSize)
+	return &closure{function, s}
+}
+
+func (it *interpreter) newTable(ex *tableExpression, s *scope) *Table {
+	it.allocate(tableSize + entrySize*len(ex.fields))
+	table := NewTable()
+	position := 0.0 // the positional fields keep their index also after the nil values
+	for i, field := range ex.fields {
+		if field.key != nil {
+			key := it.eval(field.key, s)
+			value := it.eval(field.value, s)
+			it.line = ex.line
+			if key == nil {
+				it.raisef("table index is nil")
+			} else if number, isNumber := key.(float64); isNumber && math.IsNaN(number) {
+				it.raisef("table index is NaN")
+			}
+			table.Set(key, value)
+			continue
+		}
+
+		var values []Value
+		if call, isCall := field.value.(*callExpression); isCall && i == len(ex.fields)-1 {
+			values = it.call(call, s)
+			it.allocate(entrySize * len(values))
+		} else {
+			values = []Value{it.eval(field.value, s)}
+		}
+		for _, value := range values {
+			position++
+			table.Set(position, value)
+		}
+	}
+	return table
+}
+
+func (it *interpreter) call(ex *callExpression, s *scope) []Value {
+	function := it.eval(ex.function, s)
+	var arguments []Value
+	if ex.method != "" {
+		it.line = ex.line
+		object := function
+		function = it.index(object, ex.method)
+		arguments = append(arguments, object)
+	}
+	arguments = append(arguments, it.evalList(ex.arguments, s)...)
+	it.line = ex.line
+	return it.callValue(function, arguments)
+}
+
+// callValue calls a function of the script or of the host. The line of the caller is restored after the call, so
+// that the errors raised later are reported at the right line.
+func (it *interpreter) callValue(function Value, arguments []Value) []Value {
+	line := it.line
+	defer func() {
+		it.line = line
+	}()
+
+	switch f := function.(type) {
+	case *builtin:
+		results, err := f.function(arguments)
+		if err != nil {
+			it.line = line
+			if _, isError := err.(*Error); isError {
+				panic(err)
+			}
+			it.raise(err)
+		}
+		return results
+	case *closure:
+		it.depth++
+		if it.depth > it.limits.Depth {
+			it.raise(ErrDepthLimit)
+		}
+		defer func() {
+			it.depth--
+		}()
+
+		functionScope := &scope{parent: f.scope}
+		for i, name := range f.function.parameters {
+			var value Value
+			if i < len(arguments) {
+				value = arguments[i]
+			}
+			functionScope.declare(name, value)
+		}
+		_, results := it.execBlock(f.function.body, functionScope)
+		return results
+	}
+	it.raisef("attempt to call a %s value", typeName(function))
+	return nil
+}
+
+func (it *interpreter) unary(operator string, operand Value) Value {
+	switch operator {
+	case "not":
+		return !isTrue(operand)
+	case "-":
+		if number, isNumber := toNumber(operand); isNumber {
+			return -number
+		}
+		it.raisef("attempt to perform arithmetic on a %s value", typeName(operand))
+	case "#":
+		switch o := operand.(type) {
+		case string:
+			return float64(len(o))
+		case *Table:
+			return float64(o.Len())
+		}
+		it.raisef("attempt to get length of a %s value", typeName(operand))
+	}
+	return nil
+}
+
+func (it *interpreter) binary(ex *binaryExpression, s *scope) Value {
+	left := it.eval(ex.left, s)
+	switch ex.operator {
+	case "and":
+		if !isTrue(left) {
+			return left
+		}
+		return it.eval(ex.right, s)
+	case "or":
+		if isTrue(left) {
+			return left
+		}
+		return it.eval(ex.right, s)
+	}
+
+	right := it.eval(ex.right, s)
+	it.line = ex.line
+	switch ex.operator {
+	case "==":
+		return left == right
+	case "~=":
+		return left != right
+	case "<":
+		return it.less(left, right)
+	case ">":
+		return it.less(right, left)
+	case "<=":
+		return !it.less(right, left)
+	case ">=":
+		return !it.less(left, right)
+	case "..":
+		return it.concat(left, right)
+	}
+	return it.arithmetic(ex.operator, left, right)
+}
+
+func (it *interpreter) less(left, right Value) bool {
+	if l, isNumber := left.(float64); isNumber {
+		if r, isNumber := right.(float64); isNumber {
+			return l < r
+		}
+	}
+	if l, isString := left.(string); isString {
+		if r, isString := right.(string); isString {
+			return l < r
+		}
+	}
+	if typeName(left) == typeName(right) {
+		it.raisef("attempt to compare two %s values", typeName(left))
+	}
+	it.raisef("attempt to compare %s with %s", typeName(left), typeName(right))
+	return false
+}
+
+func (it *interpreter) concat(left, right Value) string {
+	l, r := it.concatOperand(left), it.concatOperand(right)
+	it.allocate(len(l) + len(r))
+	return l + r
+}
+
+func (it *interpreter) concatOperand(value Value) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return formatNumber(v)
+	}
+	it.raisef("attempt to concatenate a %s value", typeName(value))
+	return ""
+}
+
+func (it *interpreter) arithmetic(operator string, left, right Value) float64 {
+	l, isNumber := toNumber(left)
+	if !isNumber {
+		it.raisef("attempt to perform arithmetic on a %s value", typeName(left))
+	}
+	r, isNumber := toNumber(right)
+	if !isNumber {
+		it.raisef("attempt to perform arithmetic on a %s value", typeName(right))
+	}
+
+	switch operator {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	case "/":
+		return l / r
+	case "//":
+		return math.Floor(l / r)
+	case "%": // the result has the sign of the divisor
+		m := math.Mod(l, r)
+		if m != 0 && (m < 0) != (r < 0) {
+			m += r
+		}
+		return m
+	case "^":
+		return math.Pow(l, r)
+	}
+	panic(fmt.Sprintf("unknown operator %s", operator))
+}
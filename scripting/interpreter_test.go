@@ -0,0 +1,502 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scripting
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testLimits = Limits{Instructions: 1000000, Memory: 1024 * 1024, Depth: 100}
+
+// runWithLimits runs the source and returns the values passed to the function result.
+func runWithLimits(source string, limits Limits) ([]Value, error) {
+	program, err := Compile(source)
+	if err != nil {
+		return nil, err
+	}
+	var results []Value
+	err = program.Run(context.Background(), map[string]Value{
+		"result": Function(func(arguments []Value) ([]Value, error) {
+			results = append(results, arguments...)
+			return nil, nil
+		}),
+	}, limits)
+	return results, err
+}
+
+func run(t *testing.T, source string) []Value {
+	results, err := runWithLimits(source, testLimits)
+	require.NoError(t, err, source)
+	return results
+}
+
+func runError(t *testing.T, source string) error {
+	_, err := runWithLimits(source, testLimits)
+	require.Error(t, err, source)
+	return err
+}
+
+func TestInterpreterOperators(t *testing.T) {
+	assert.Equal(t, []Value{7.0, 9.0, 2.0, 1.0, 2.0, 0.5, 3.0, 8.0, true, false},
+		run(t, `result(1 + 2 * 3, (1 + 2) * 3, 7 // 3, 7 % 3, -7 % 3, 1 / 2, #"abc", 2 ^ 3, 1 < 2, "a" > "b")`))
+	assert.Equal(t, []Value{-1.0, -2.0, 1.5, -4.0, 512.0, 0.125},
+		run(t, `result(7 % -4, -7 // 4, 5.5 % 2, -2 ^ 2, 2 ^ 3 ^ 2, 2 ^ -3)`))
+	assert.Equal(t, []Value{"a1", "b", 10.0, nil, false, "1.5x"},
+		run(t, `result("a" .. 1, nil or "b", false and 1 or 10, nil and 1, not 0, 1.5 .. "x")`))
+	// the strings are converted to numbers by the arithmetic operators, but not by the comparisons
+	assert.Equal(t, []Value{11.0, 17.0, -3.0, false, true, true},
+		run(t, `result("10" + 1, "0x10" + 1, -"3", 1 == "1", "10" < "9", {} ~= {})`))
+	assert.Equal(t, []Value{true, false, true, true, false},
+		run(t, `local t = {} local u = t result(t == u, 1 ~= 1, 2 <= 2, "a" <= "b", "b" >= "c")`))
+	assert.Equal(t, []Value{"inf", "-inf", "nan", "1e+15", "0.1", "3"},
+		run(t, `result(tostring(1 / 0), tostring(-1 / 0), tostring(0 / 0), tostring(1e15), tostring(0.1),
+			tostring(3.0))`))
+	// and and or evaluate the right operand only if needed
+	assert.Equal(t, []Value{1.0, false},
+		run(t, `result(1 or error("evaluated"), false and error("evaluated"))`))
+}
+
+func TestInterpreterVariables(t *testing.T) {
+	assert.Equal(t, []Value{2.0, 1.0, 3.0, nil},
+		run(t, `local a, b = 1, 2 a, b = b, a local c, d = 3 result(a, b, c, d)`))
+	assert.Equal(t, []Value{"inner", "outer", "global"},
+		run(t, `
+			g = "global"
+			local x = "outer"
+			do local x = "inner" result(x) end
+			result(x, g)`))
+	// the local variable is declared after its value is evaluated
+	assert.Equal(t, []Value{1.0, 2.0},
+		run(t, `local x = 1 do local x = x + 1 result(1, x) end`))
+	// the targets are evaluated before the values
+	assert.Equal(t, []Value{"a", nil},
+		run(t, `local t = {} local i = 1 i, t[i] = 2, "a" result(t[1], t[2])`))
+	assert.Equal(t, []Value{1.0, 2.0, nil},
+		run(t, `local function f() return 1, 2, 3 end local a, b = f() local t = {f(), nil} result(a, b, t[2])`))
+	// the parentheses and the calls which are not the last expression are truncated to the first value
+	assert.Equal(t, []Value{1.0, true, 1.0, 4.0, 1.0, 2.0, 3.0},
+		run(t, `local function f() return 1, 2, 3 end local x, y = (f()) result(x, y == nil, f(), 4, f())`))
+}
+
+func TestInterpreterControlFlow(t *testing.T) {
+	assert.Equal(t, []Value{55.0, 4.0, 30.0, 3.0},
+		run(t, `
+			local sum = 0
+			for i = 1, 10 do sum = sum + i end
+			local count = 0
+			for i = 10, 1, -3 do count = count + 1 end
+			local n = 0
+			while true do
+				n = n + 10
+				if n >= 30 then break end
+			end
+			local steps = 0
+			for i = 0, 1, 0.5 do steps = steps + 1 end
+			result(sum, count, n, steps)`))
+	assert.Equal(t, []Value{"b", "c", "d"},
+		run(t, `
+			for _, x in ipairs({1, 2, 3}) do
+				if x == 1 then result("b") elseif x == 2 then result("c") else result("d") end
+			end`))
+	// the condition of repeat sees the local variables of the body
+	assert.Equal(t, []Value{3.0},
+		run(t, `local i = 0 repeat local done = i >= 3 i = i + 1 until done result(i - 1)`))
+	// break exits only the innermost loop, return exits the function from any loop
+	assert.Equal(t, []Value{6.0, "found 2 3"},
+		run(t, `
+			local count = 0
+			for i = 1, 3 do
+				for j = 1, 3 do
+					if j > 2 then break end
+					count = count + 1
+				end
+			end
+			local function find()
+				for i = 1, 3 do
+					for j = 1, 3 do
+						if i * j == 6 then return "found " .. i .. " " .. j end
+					end
+				end
+			end
+			result(count, find())`))
+	// the loop variable is a copy, and the limit is evaluated once
+	assert.Equal(t, []Value{3.0},
+		run(t, `local n = 3 local count = 0 for i = 1, n do i = i * 10 n = 10 count = count + 1 end result(count)`))
+	assert.Empty(t, run(t, `for i = 1, 0 do result(i) end for i = 1, 2, -1 do result(i) end`))
+}
+
+func TestInterpreterFunctions(t *testing.T) {
+	assert.Equal(t, []Value{1.0, 2.0, 3.0, 120.0},
+		run(t, `
+			local function counter()
+				local n = 0
+				return function() n = n + 1 return n end
+			end
+			local next_value = counter()
+			result(next_value(), next_value(), next_value())
+			local function factorial(n) if n <= 1 then return 1 end return n * factorial(n - 1) end
+			result(factorial(5))`))
+	// each iteration has its own loop variable
+	assert.Equal(t, []Value{1.0, 2.0, 3.0},
+		run(t, `
+			local functions = {}
+			for i = 1, 3 do functions[i] = function() return i end end
+			result(functions[1](), functions[2](), functions[3]())`))
+	// the missing arguments are nil and the extra ones are dropped
+	assert.Equal(t, []Value{1.0, nil, "x"},
+		run(t, `local function f(a, b) return a, b end local a, b = f(1) result(a, b, (f("x", "y", "z")))`))
+	assert.Equal(t, []Value{"object", 42.0, "ABC"},
+		run(t, `
+			local object = {name = "object", value = 41}
+			function object:get() return self.name end
+			function object.increment(self, n) self.value = self.value + n return self.value end
+			result(object:get(), object:increment(1), ("abc"):upper())`))
+	assert.Equal(t, []Value{"s", 1.0},
+		run(t, `local function f(t) return t end result(f"s", f{1}[1])`))
+	// a function without return has no values
+	assert.Equal(t, []Value{0.0},
+		run(t, `local function f() end result(select("#", f()))`))
+}
+
+func TestInterpreterTables(t *testing.T) {
+	assert.Equal(t, []Value{"a=1", "b=2", "c=3", 3.0, "x y z"},
+		run(t, `
+			local t = {a = 1, b = 2}
+			t.c = 3
+			for k, v in pairs(t) do result(k .. "=" .. v) end
+			local list = {}
+			for _, v in ipairs({"x", "y", "z"}) do table.insert(list, v) end
+			result(#list, table.concat(list, " "))`))
+	// the integer keys are moved to the array when the sequence reaches them
+	assert.Equal(t, []Value{4.0, 2.0, 4.0, 1.0},
+		run(t, `
+			local t = {}
+			t[3] = "c" t[4] = "d" t[1] = "a"
+			t[2] = "b"
+			local before = #t
+			t[4] = nil t[3] = nil
+			result(before + 0, #t)
+			local u = {[1] = 1, [2] = 2, [2.0] = 3, [4] = 4}
+			result(u[2] + 1, u[1])`))
+	// pairs visits the keys in insertion order, and the keys can be cleared while iterating
+	assert.Equal(t, []Value{"1=a", "2=b", "x=1", "y=2", "z=3", 0.0},
+		run(t, `
+			local t = {"a", "b", x = 1, y = 2}
+			t.z = 3
+			for k, v in pairs(t) do result(k .. "=" .. v) t[k] = nil end
+			local count = 0
+			for _ in pairs(t) do count = count + 1 end
+			result(count)`))
+	assert.Equal(t, []Value{"table", true, 1.0, nil},
+		run(t, `local t = {} t[t] = true t[1.5] = 1 result(type(t), t[t], t[1.5], t[2])`))
+	assert.Equal(t, []Value{"a", "b", "c", 3.0},
+		run(t, `local t = {"a", (function() return "b", "c" end)()} result(t[1], t[2], t[3], #t)`))
+	assert.Equal(t, []Value{1.0, nil, 4.0, 2.0},
+		run(t, `local t = {1, nil, x = 1, nil, 4} result(t[1], t[2], t[4], #t + 1)`))
+
+	assert.EqualError(t, runError(t, `local t = {} t[nil] = 1`), "line 1: table index is nil")
+	assert.EqualError(t, runError(t, `local t = {} t[0/0] = 1`), "line 1: table index is NaN")
+	assert.EqualError(t, runError(t, `local t = {[nil] = 1}`), "line 1: table index is nil")
+	assert.EqualError(t, runError(t, "local t = {}\nfor k in pairs(t) do end\nnext(t, 'missing')"),
+		"line 3: invalid key to 'next'")
+}
+
+func TestInterpreterRuntimeErrors(t *testing.T) {
+	for source, message := range map[string]string{
+		"local x\nx()":                                "line 2: attempt to call a nil value",
+		"local t = {}\n\nt.a.b = 1":                   "line 3: attempt to index a nil value",
+		"local s = nil\nreturn s.x":                   "line 2: attempt to index a nil value",
+		"return 1 + {}":                               "line 1: attempt to perform arithmetic on a table value",
+		"return 'a' * 2":                              "line 1: attempt to perform arithmetic on a string value",
+		"return -{}":                                  "line 1: attempt to perform arithmetic on a table value",
+		"return #5":                                   "line 1: attempt to get length of a number value",
+		"return 1 < 'a'":                              "line 1: attempt to compare number with string",
+		"return {} < {}":                              "line 1: attempt to compare two table values",
+		"return 'a' .. true":                          "line 1: attempt to concatenate a boolean value",
+		"return 'a' .. {}":                            "line 1: attempt to concatenate a table value",
+		"for i = 1, 'x' do end":                       "line 1: 'for' limit value must be a number",
+		"for i = 1, 2, 0 do end":                      "line 1: 'for' step is zero",
+		"for k in 5 do end":                           "line 1: attempt to call a number value",
+		"error('custom message')":                     "line 1: custom message",
+		"\nassert(1 == 2)":                            "line 2: assertion failed!",
+		"assert(false, 'with message')":               "line 1: with message",
+		"local function f()\nerror('in f')\nend\nf()": "line 2: in f",
+		"local function f()\n  return nil + 1\nend\nlocal x = f()": "line 2: attempt to perform arithmetic on a nil value",
+	} {
+		err := runError(t, source)
+		assert.EqualError(t, err, message, source)
+		var scriptError *Error
+		assert.True(t, errors.As(err, &scriptError), source)
+	}
+
+	// the line of the caller is restored after a call, so the following errors are reported correctly
+	assert.EqualError(t, runError(t, "local function f()\nreturn 1\nend\nlocal x = f() + {}"),
+		"line 4: attempt to perform arithmetic on a table value")
+}
+
+func TestInterpreterHost(t *testing.T) {
+	program, err := Compile(`
+		local t = input.values
+		output(#t, t[1], input.name, input.count + 1, input.data, input.nested.ok)
+		local a, b = twice(21)
+		output(a, b)
+		fail("x")`)
+	require.NoError(t, err)
+
+	input := NewTable()
+	values := NewTable()
+	values.Append("first")
+	values.Append(2)
+	input.Set("values", values)
+	input.Set("name", "caronte")
+	input.Set("count", uint16(41))
+	input.Set("data", []byte{0x00, 0xff})
+	nested := NewTable()
+	nested.Set("ok", true)
+	input.Set("nested", nested)
+
+	var outputs []Value
+	hostError := errors.New("host failure")
+	err = program.Run(context.Background(), map[string]Value{
+		"input": input,
+		"output": Function(func(arguments []Value) ([]Value, error) {
+			outputs = append(outputs, arguments...)
+			return nil, nil
+		}),
+		"twice": Function(func(arguments []Value) ([]Value, error) {
+			return []Value{arguments[0], arguments[0].(float64) * 2}, nil
+		}),
+		"fail": Function(func(arguments []Value) ([]Value, error) {
+			return nil, hostError
+		}),
+	}, testLimits)
+	assert.Equal(t, []Value{2.0, "first", "caronte", 42.0, "\x00\xff", true, 21.0, 42.0}, outputs)
+	// the errors of the host functions are raised at the line of the call
+	assert.EqualError(t, err, "line 6: host failure")
+	assert.True(t, errors.Is(err, hostError))
+
+	// the errors of the host functions which are already script errors are not wrapped again
+	_, err = runWithLimits(`result(1)`, testLimits)
+	require.NoError(t, err)
+	program, err = Compile("\n\nraise()")
+	require.NoError(t, err)
+	err = program.Run(context.Background(), map[string]Value{
+		"raise": Function(func(arguments []Value) ([]Value, error) {
+			return nil, &Error{Line: 10, Err: errors.New("inner")}
+		}),
+	}, testLimits)
+	assert.EqualError(t, err, "line 10: inner")
+}
+
+func TestInterpreterConcurrentRuns(t *testing.T) {
+	program, err := Compile(`
+		local sum = 0
+		for i = 1, n do sum = sum + i end
+		counter = (counter or 0) + 1
+		output(sum, counter)`)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	results := make([][]Value, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := program.Run(context.Background(), map[string]Value{
+				"n": i * 100,
+				"output": Function(func(arguments []Value) ([]Value, error) {
+					results[i] = arguments
+					return nil, nil
+				}),
+			}, testLimits)
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	// the globals of a run are not shared with the other runs
+	for i, values := range results {
+		n := float64(i * 100)
+		assert.Equal(t, []Value{n * (n + 1) / 2, 1.0}, values)
+	}
+}
+
+func TestInstructionsLimit(t *testing.T) {
+	// the statement and the constant expression are two instructions
+	_, err := runWithLimits(`local x = 1`, Limits{Instructions: 2, Memory: 0, Depth: 0})
+	assert.NoError(t, err)
+	_, err = runWithLimits(`local x = 1`, Limits{Instructions: 1, Memory: 0, Depth: 0})
+	assert.True(t, errors.Is(err, ErrInstructionsLimit))
+
+	for _, source := range []string{
+		`while true do end`,
+		`repeat until false`,
+		`for i = 1, math.huge do end`,
+		`local function f() end while true do f() end`,
+		`for k, v in function() return 1 end do end`,
+		`local s = string.rep("x", 1000) for i = 1, 1e9 do s:find("y") end`,
+		`local s = string.rep("x", 100000) for i = 1, 1e9 do regex.match(s, "y+z") end`,
+		`local t = {} for i = 1, 10000 do t[i] = 10001 - i end table.sort(t, function(a, b) return a < b end)`,
+		`string.rep("", 1e12)`,
+	} {
+		_, err := runWithLimits(source, Limits{Instructions: 100000, Memory: 1024 * 1024, Depth: 10})
+		assert.True(t, errors.Is(err, ErrInstructionsLimit), source)
+		var scriptError *Error
+		assert.True(t, errors.As(err, &scriptError), source)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	// a table is accounted 64 bytes, and the concatenation the length of the result
+	_, err := runWithLimits(`local t = {}`, Limits{Instructions: 100, Memory: 64})
+	assert.NoError(t, err)
+	_, err = runWithLimits(`local t = {}`, Limits{Instructions: 100, Memory: 63})
+	assert.True(t, errors.Is(err, ErrMemoryLimit))
+	_, err = runWithLimits(`local s = "ab" .. "cd"`, Limits{Instructions: 100, Memory: 4})
+	assert.NoError(t, err)
+	_, err = runWithLimits(`local s = "ab" .. "cd"`, Limits{Instructions: 100, Memory: 3})
+	assert.True(t, errors.Is(err, ErrMemoryLimit))
+
+	for _, source := range []string{
+		`local s = "x" for i = 1, 64 do s = s .. s end`,
+		`local t = {} for i = 1, 1e9 do t[i] = i end`,
+		`local t = {} for i = 1, 1e9 do t["k" .. i] = true end`,
+		`for i = 1, 1e9 do local t = {} end`, // the memory released is still accounted
+		`for i = 1, 1e9 do local f = function() end end`,
+		`local s = "x" .. "y" for i = 1, 1e9 do local u = s:upper() end`,
+		`string.rep("x", 1e12)`,
+		`string.rep("x", 2 ^ 63)`,
+		`string.rep("x", 1e6)`,
+		`string.rep("x", 1000, string.rep("y", 1000))`,
+		`local s = string.rep("x", 100000) for i = 1, 1e9 do s = s:sub(1) end`,
+		`local s = string.rep("x", 100000) string.hex(s .. s)`,
+		`local s = string.rep("x,", 100000) local parts = string.split(s, ",")`,
+		`local s = string.rep("x", 100000) regex.replace(s, "x", "$0$0$0$0")`,
+		`local s = string.rep("x", 100000) regex.find_all(s, "x")`,
+		`local s = string.rep("x", 100000) for i = 1, 1e9 do regex.match(s, "(x+)") end`,
+		`local s = string.rep("x", 100000) string.byte(s, 1, -1)`,
+		`for i = 1, 1e9 do local s = string.format("%99d", i) end`,
+		`for i = 1, 1e9 do local s = tostring(i) end`,
+		`local t = {} for i = 1, 1e9 do table.insert(t, i) end`,
+		`local t = {string.rep("x", 1000)} for i = 1, 1e9 do table.concat(t) end`,
+		`local s = string.rep("x", 100000) string.reverse(s) string.lower(s) string.upper(s)`,
+		`local function f() return string.byte(string.rep("x", 10000), 1, -1) end local t = {f()}`,
+	} {
+		_, err := runWithLimits(source, Limits{Instructions: 100000000, Memory: 256 * 1024, Depth: 10})
+		assert.True(t, errors.Is(err, ErrMemoryLimit), source)
+	}
+}
+
+func TestDepthLimit(t *testing.T) {
+	// f(10) calls f 11 times
+	source := `local function f(n) if n > 0 then return f(n - 1) end end f(10)`
+	_, err := runWithLimits(source, Limits{Instructions: 1000, Memory: 1024, Depth: 11})
+	assert.NoError(t, err)
+	_, err = runWithLimits(source, Limits{Instructions: 1000, Memory: 1024, Depth: 10})
+	assert.True(t, errors.Is(err, ErrDepthLimit))
+
+	for _, source := range []string{
+		`local function f() return f() end f()`,
+		`local function f() return 1 + f() end f()`,
+		`local function f() table.sort({2, 1}, function(a, b) f() return a < b end) end f()`,
+		`local t = {} function t:m() return self:m() end t:m()`,
+	} {
+		_, err := runWithLimits(source, Limits{Instructions: 100000000, Memory: 1024 * 1024, Depth: 200})
+		assert.True(t, errors.Is(err, ErrDepthLimit), source)
+	}
+
+	// the depth is released when the functions return
+	_, err = runWithLimits(`local function f() end for i = 1, 1000 do f() end`,
+		Limits{Instructions: 100000, Memory: 1024, Depth: 1})
+	assert.NoError(t, err)
+}
+
+func TestRunContext(t *testing.T) {
+	program, err := Compile(`while true do end`)
+	require.NoError(t, err)
+	limits := Limits{Instructions: 1 << 62, Memory: 1024, Depth: 10}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = program.Run(ctx, nil, limits)
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = program.Run(ctx, nil, limits)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+	// the context is checked also while the library functions run
+	program, err = Compile(`local s = string.rep("x", 1000) while true do s:find("y") end`)
+	require.NoError(t, err)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = program.Run(ctx, nil, Limits{Instructions: 1 << 62, Memory: 1024 * 1024, Depth: 10})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestRunUnexpectedValues(t *testing.T) {
+	// the values which the scripts can't handle are never exposed as Go panics
+	for _, source := range []string{
+		`local s = ("abc"):sub(0 / 0)`,
+		`local s = ("abc"):sub(1, 0 / 0)`,
+		`local s = ("abc"):byte(0 / 0)`,
+		`local s = ("abc"):find("b", 0 / 0)`,
+		`local s = ("abc"):find("b", 1e300)`,
+		`local s = ("abc"):find("b", -1e300)`,
+		`local s = ("abc"):sub(1e300, -1e300)`,
+		`local s = string.rep("x", 0 / 0)`,
+		`local s = string.rep("x", -1e300)`,
+		`local s = string.char(0 / 0)`,
+		`local s = string.format("%d %x %c %5.2f", 0 / 0, 1e300, -1, 0 / 0)`,
+		`local s = select(0 / 0, 1)`,
+		`local s = select(-1e300, 1)`,
+		`local t = {} table.insert(t, 0 / 0, 1)`,
+		`local t = {1} table.remove(t, 0 / 0)`,
+		`local s = table.concat({1, 2}, ",", 0 / 0, 0 / 0)`,
+		`local s = tonumber("10", 0 / 0)`,
+		`local t = string.split("a,b", ",", 0 / 0)`,
+		`local t = regex.find_all("aaa", "a", 0 / 0)`,
+		`local t = {} t[1e300] = 1 t[-1] = 2 t[0] = 3 t[2 ^ 53] = 4`,
+		`for i = 0 / 0, 10 do end`,
+		`local x = math.floor(0 / 0) + math.max(0 / 0, 1)`,
+	} {
+		assert.NotPanics(t, func() {
+			_, err := runWithLimits(source, testLimits)
+			if err != nil {
+				assert.NotContains(t, err.Error(), "runtime error", source)
+			}
+		}, source)
+	}
+}
+
+func TestRunLargeScripts(t *testing.T) {
+	// many statements and long expressions are fine, as long as the nesting is bounded
+	source := strings.Repeat("local x = 1 + 2 + 3\n", 10000) + "result(x)"
+	assert.Equal(t, []Value{6.0}, run(t, source))
+}
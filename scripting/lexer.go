@@ -0,0 +1,290 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scripting
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	tokenEOF = iota
+	tokenName
+	tokenNumber
+	tokenString
+	tokenKeyword // keywords and symbols
+)
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true, "false": true, "for": true,
+	"function": true, "if": true, "in": true, "local": true, "nil": true, "not": true, "or": true, "repeat": true,
+	"return": true, "then": true, "true": true, "until": true, "while": true,
+}
+
+// symbols are ordered by length, so that the longest symbol is matched first.
+var symbols = []string{"...", "..", "==", "~=", "<=", ">=", "//", "+", "-", "*", "/", "%", "^", "#", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ";", ":", ",", "."}
+
+type token struct {
+	kind   int
+	text   string // the name, the keyword, the symbol or the value of the string
+	number float64
+	line   int
+}
+
+type lexer struct {
+	source string
+	offset int
+	line   int
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) *Error {
+	return &Error{Line: l.line, Err: fmt.Errorf(format, args...)}
+}
+
+// next returns the next token of the source.
+func (l *lexer) next() (token, error) {
+	if err := l.skipSpacesAndComments(); err != nil {
+		return token{}, err
+	}
+	if l.offset >= len(l.source) {
+		return token{kind: tokenEOF, line: l.line}, nil
+	}
+
+	c := l.source[l.offset]
+	switch {
+	case isLetter(c):
+		start := l.offset
+		for l.offset < len(l.source) && (isLetter(l.source[l.offset]) || isDigit(l.source[l.offset])) {
+			l.offset++
+		}
+		name := l.source[start:l.offset]
+		if keywords[name] {
+			return token{kind: tokenKeyword, text: name, line: l.line}, nil
+		}
+		return token{kind: tokenName, text: name, line: l.line}, nil
+	case isDigit(c) || c == '.' && l.offset+1 < len(l.source) && isDigit(l.source[l.offset+1]):
+		return l.readNumber()
+	case c == '"' || c == '\'':
+		return l.readString(c)
+	case c == '[' && l.longBracketLevel() >= 0:
+		line := l.line
+		value, err := l.readLongString()
+		return token{kind: tokenString, text: value, line: line}, err
+	}
+
+	for _, symbol := range symbols {
+		if strings.HasPrefix(l.source[l.offset:], symbol) {
+			l.offset += len(symbol)
+			if symbol == "..." {
+				return token{}, l.errorf("varargs are not supported")
+			}
+			return token{kind: tokenKeyword, text: symbol, line: l.line}, nil
+		}
+	}
+	return token{}, l.errorf("unexpected symbol near '%c'", c)
+}
+
+func (l *lexer) skipSpacesAndComments() error {
+	for l.offset < len(l.source) {
+		switch c := l.source[l.offset]; {
+		case c == '\n':
+			l.line++
+			l.offset++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			l.offset++
+		case strings.HasPrefix(l.source[l.offset:], "--"):
+			l.offset += 2
+			if l.offset < len(l.source) && l.source[l.offset] == '[' && l.longBracketLevel() >= 0 {
+				if _, err := l.readLongString(); err != nil {
+					return err
+				}
+				continue
+			}
+			for l.offset < len(l.source) && l.source[l.offset] != '\n' {
+				l.offset++
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) readNumber() (token, error) {
+	start := l.offset
+	if strings.HasPrefix(l.source[l.offset:], "0x") || strings.HasPrefix(l.source[l.offset:], "0X") {
+		l.offset += 2
+		for l.offset < len(l.source) && isHexDigit(l.source[l.offset]) {
+			l.offset++
+		}
+		value, err := strconv.ParseUint(l.source[start+2:l.offset], 16, 64)
+		if err != nil {
+			return token{}, l.errorf("malformed number near '%s'", l.source[start:l.offset])
+		}
+		return token{kind: tokenNumber, number: float64(value), line: l.line}, nil
+	}
+
+	for l.offset < len(l.source) {
+		c := l.source[l.offset]
+		if (c == '+' || c == '-') && (l.source[l.offset-1] == 'e' || l.source[l.offset-1] == 'E') ||
+			isDigit(c) || c == '.' || c == 'e' || c == 'E' {
+			l.offset++
+		} else {
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(l.source[start:l.offset], 64)
+	if err != nil {
+		return token{}, l.errorf("malformed number near '%s'", l.source[start:l.offset])
+	}
+	return token{kind: tokenNumber, number: value, line: l.line}, nil
+}
+
+func (l *lexer) readString(quote byte) (token, error) {
+	line := l.line
+	l.offset++
+	var builder strings.Builder
+	for {
+		if l.offset >= len(l.source) || l.source[l.offset] == '\n' {
+			return token{}, l.errorf("unfinished string")
+		}
+		c := l.source[l.offset]
+		l.offset++
+		if c == quote {
+			return token{kind: tokenString, text: builder.String(), line: line}, nil
+		} else if c != '\\' {
+			builder.WriteByte(c)
+			continue
+		}
+
+		if l.offset >= len(l.source) {
+			return token{}, l.errorf("unfinished string")
+		}
+		c = l.source[l.offset]
+		l.offset++
+		switch c {
+		case 'n':
+			builder.WriteByte('\n')
+		case 't':
+			builder.WriteByte('\t')
+		case 'r':
+			builder.WriteByte('\r')
+		case 'a':
+			builder.WriteByte('\a')
+		case 'b':
+			builder.WriteByte('\b')
+		case 'f':
+			builder.WriteByte('\f')
+		case 'v':
+			builder.WriteByte('\v')
+		case '\\', '"', '\'':
+			builder.WriteByte(c)
+		case '\n':
+			l.line++
+			builder.WriteByte('\n')
+		case 'x':
+			if l.offset+2 > len(l.source) || !isHexDigit(l.source[l.offset]) || !isHexDigit(l.source[l.offset+1]) {
+				return token{}, l.errorf("hexadecimal digit expected")
+			}
+			value, _ := strconv.ParseUint(l.source[l.offset:l.offset+2], 16, 8)
+			builder.WriteByte(byte(value))
+			l.offset += 2
+		case 'z':
+			for l.offset < len(l.source) && strings.IndexByte(" \t\r\n\f\v", l.source[l.offset]) >= 0 {
+				if l.source[l.offset] == '\n' {
+					l.line++
+				}
+				l.offset++
+			}
+		case 'u':
+			end := strings.IndexByte(l.source[l.offset:], '}')
+			if !strings.HasPrefix(l.source[l.offset:], "{") || end < 0 {
+				return token{}, l.errorf("missing braces in \\u escape")
+			}
+			value, err := strconv.ParseUint(l.source[l.offset+1:l.offset+end], 16, 32)
+			if err != nil || value > utf8.MaxRune {
+				return token{}, l.errorf("invalid unicode escape")
+			}
+			builder.WriteRune(rune(value))
+			l.offset += end + 1
+		default:
+			if !isDigit(c) {
+				return token{}, l.errorf("invalid escape sequence '\\%c'", c)
+			}
+			start := l.offset - 1
+			for l.offset < len(l.source) && l.offset-start < 3 && isDigit(l.source[l.offset]) {
+				l.offset++
+			}
+			value, _ := strconv.Atoi(l.source[start:l.offset])
+			if value > 255 {
+				return token{}, l.errorf("decimal escape too large")
+			}
+			builder.WriteByte(byte(value))
+		}
+	}
+}
+
+// longBracketLevel returns the number of '=' of the long bracket which starts at the current offset, or -1 if the
+// current offset is not the start of a long bracket.
+func (l *lexer) longBracketLevel() int {
+	level := 0
+	for l.offset+level+1 < len(l.source) && l.source[l.offset+level+1] == '=' {
+		level++
+	}
+	if l.offset+level+1 < len(l.source) && l.source[l.offset+level+1] == '[' {
+		return level
+	}
+	return -1
+}
+
+func (l *lexer) readLongString() (string, error) {
+	level := l.longBracketLevel()
+	l.offset += level + 2
+	if strings.HasPrefix(l.source[l.offset:], "\r\n") {
+		l.offset += 2
+		l.line++
+	} else if strings.HasPrefix(l.source[l.offset:], "\n") {
+		l.offset++
+		l.line++
+	}
+
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(l.source[l.offset:], closing)
+	if end < 0 {
+		return "", l.errorf("unfinished long string")
+	}
+	value := l.source[l.offset : l.offset+end]
+	l.line += strings.Count(value, "\n")
+	l.offset += end + len(closing)
+	return value, nil
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
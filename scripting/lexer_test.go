@@ -0,0 +1,166 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scripting
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tokenize(source string) ([]token, error) {
+	l := lexer{source: source, line: 1}
+	var tokens []token
+	for {
+		next, err := l.next()
+		if err != nil {
+			return tokens, err
+		}
+		if next.kind == tokenEOF {
+			return tokens, nil
+		}
+		tokens = append(tokens, next)
+	}
+}
+
+func TestLexerTokens(t *testing.T) {
+	tokens, err := tokenize("local x_1 = y ~= 2 .. 'a' -- comment\nreturn ... ")
+	require.Error(t, err) // varargs
+	assert.Equal(t, []token{
+		{kind: tokenKeyword, text: "local", line: 1},
+		{kind: tokenName, text: "x_1", line: 1},
+		{kind: tokenKeyword, text: "=", line: 1},
+		{kind: tokenName, text: "y", line: 1},
+		{kind: tokenKeyword, text: "~=", line: 1},
+		{kind: tokenNumber, number: 2, line: 1},
+		{kind: tokenKeyword, text: "..", line: 1},
+		{kind: tokenString, text: "a", line: 1},
+		{kind: tokenKeyword, text: "return", line: 2},
+	}, tokens)
+
+	tokens, err = tokenize("a//b<=c>=d==e;f:g[h]{i}#j^k%l")
+	require.NoError(t, err)
+	var texts []string
+	for _, token := range tokens {
+		texts = append(texts, token.text)
+	}
+	assert.Equal(t, []string{"a", "//", "b", "<=", "c", ">=", "d", "==", "e", ";", "f", ":", "g", "[", "h", "]",
+		"{", "i", "}", "#", "j", "^", "k", "%", "l"}, texts)
+}
+
+func TestLexerNumbers(t *testing.T) {
+	for source, number := range map[string]float64{
+		"42":     42,
+		"3.25":   3.25,
+		".5":     0.5,
+		"5.":     5,
+		"1e3":    1000,
+		"2E-2":   0.02,
+		"1.5e+2": 150,
+		"0xff":   255,
+		"0XA0":   160,
+	} {
+		tokens, err := tokenize(source)
+		require.NoError(t, err, source)
+		require.Len(t, tokens, 1, source)
+		assert.Equal(t, tokenNumber, tokens[0].kind, source)
+		assert.Equal(t, number, tokens[0].number, source)
+	}
+
+	for _, source := range []string{"1..2", "1e", "0x", "3.4.5", "0x1ffffffffffffffff"} {
+		_, err := tokenize(source)
+		assert.EqualError(t, err, "line 1: malformed number near '"+source+"'", source)
+	}
+}
+
+func TestLexerStrings(t *testing.T) {
+	for source, value := range map[string]string{
+		`"plain"`:                 "plain",
+		`'single "quotes"'`:       `single "quotes"`,
+		`"\n\t\r\a\b\f\v"`:        "\n\t\r\a\b\f\v",
+		`"\\ \" \'"`:              `\ " '`,
+		`"\x41\x6a"`:              "Aj",
+		`"\65\066\0067"`:          "AB\x067",
+		`"\255\0"`:                "\xff\x00",
+		`"\u{48}\u{20AC}"`:        "H€",
+		"\"a\\z  \n\t  b\"":       "ab",
+		"\"line\\\nbreak\"":       "line\nbreak",
+		"[[long]]":                "long",
+		"[[\nfirst newline]]":     "first newline",
+		"[==[with ]] and ]=]]==]": "with ]] and ]=]",
+		"[[multi\nline]]":         "multi\nline",
+	} {
+		tokens, err := tokenize(source)
+		require.NoError(t, err, source)
+		require.Len(t, tokens, 1, source)
+		assert.Equal(t, tokenString, tokens[0].kind, source)
+		assert.Equal(t, value, tokens[0].text, source)
+	}
+}
+
+func TestLexerComments(t *testing.T) {
+	tokens, err := tokenize("a -- line comment\n--[[ long\ncomment ]] b --[==[ ]] ]==] c\n-- last")
+	require.NoError(t, err)
+	require.Len(t, tokens, 3)
+	assert.Equal(t, token{kind: tokenName, text: "a", line: 1}, tokens[0])
+	assert.Equal(t, token{kind: tokenName, text: "b", line: 3}, tokens[1])
+	assert.Equal(t, token{kind: tokenName, text: "c", line: 3}, tokens[2])
+
+	// a comment which starts with [ but not with a long bracket is a line comment
+	tokens, err = tokenize("--[ not long\nd")
+	require.NoError(t, err)
+	assert.Equal(t, []token{{kind: tokenName, text: "d", line: 2}}, tokens)
+}
+
+func TestLexerLines(t *testing.T) {
+	tokens, err := tokenize("a\r\nb\n\n[[x\ny]] c 'd\\\ne' f")
+	require.NoError(t, err)
+	var lines []int
+	for _, token := range tokens {
+		lines = append(lines, token.line)
+	}
+	// the tokens which span multiple lines have the line where they start
+	assert.Equal(t, []int{1, 2, 4, 5, 5, 6}, lines)
+}
+
+func TestLexerErrors(t *testing.T) {
+	for source, message := range map[string]string{
+		`"unfinished`:          "line 1: unfinished string",
+		"'new\nline'":          "line 1: unfinished string",
+		`"escape at the end\`:  "line 1: unfinished string",
+		`"\q"`:                 `line 1: invalid escape sequence '\q'`,
+		`"\x4"`:                "line 1: hexadecimal digit expected",
+		`"\xzz"`:               "line 1: hexadecimal digit expected",
+		`"\256"`:               "line 1: decimal escape too large",
+		`"\u48"`:               `line 1: missing braces in \u escape`,
+		`"\u{110000}"`:         "line 1: invalid unicode escape",
+		`"\u{zz}"`:             "line 1: invalid unicode escape",
+		"\n[[unfinished":       "line 2: unfinished long string",
+		"--[==[ unfinished ]]": "line 1: unfinished long string",
+		"a @ b":                "line 1: unexpected symbol near '@'",
+		"a ~ b":                "line 1: unexpected symbol near '~'",
+		"\n\nf(...)":           "line 3: varargs are not supported",
+	} {
+		_, err := tokenize(source)
+		assert.EqualError(t, err, message, source)
+		var scriptError *Error
+		assert.True(t, errors.As(err, &scriptError), source)
+	}
+}
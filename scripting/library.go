@@ -0,0 +1,683 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scripting
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxPatternLength bounds the regular expressions, whose compilation and matching cost grow with their length.
+const maxPatternLength = 1024
+
+// bytesPerInstruction is the number of bytes processed by the library functions for each instruction accounted.
+const bytesPerInstruction = 64
+
+type library struct {
+	it      *interpreter
+	regexps map[string]*regexp.Regexp
+	next    *builtin // returned by pairs, also if the script redefines next
+}
+
+// openLibrary adds to the globals the functions of the standard library available to the scripts.
+func openLibrary(it *interpreter) {
+	lib := &library{it: it, regexps: make(map[string]*regexp.Regexp)}
+	register := func(table *Table, name string, function func(arguments []Value) []Value) *builtin {
+		value := &builtin{name: name, function: func(arguments []Value) ([]Value, error) {
+			return function(arguments), nil
+		}}
+		table.Set(name, value)
+		return value
+	}
+
+	register(it.globals, "type", lib.typeOf)
+	register(it.globals, "tostring", lib.toString)
+	register(it.globals, "tonumber", lib.toNumber)
+	lib.next = register(it.globals, "next", lib.nextKey)
+	register(it.globals, "pairs", lib.pairs)
+	register(it.globals, "ipairs", lib.ipairs)
+	register(it.globals, "error", lib.error)
+	register(it.globals, "assert", lib.assert)
+	register(it.globals, "select", lib.selectArguments)
+
+	stringLibrary := NewTable()
+	register(stringLibrary, "len", lib.stringLen)
+	register(stringLibrary, "sub", lib.stringSub)
+	register(stringLibrary, "upper", lib.stringUpper)
+	register(stringLibrary, "lower", lib.stringLower)
+	register(stringLibrary, "rep", lib.stringRep)
+	register(stringLibrary, "reverse", lib.stringReverse)
+	register(stringLibrary, "find", lib.stringFind)
+	register(stringLibrary, "byte", lib.stringByte)
+	register(stringLibrary, "char", lib.stringChar)
+	register(stringLibrary, "format", lib.stringFormat)
+	register(stringLibrary, "split", lib.stringSplit)
+	register(stringLibrary, "trim", lib.stringTrim)
+	register(stringLibrary, "hex", lib.stringHex)
+	it.globals.Set("string", stringLibrary)
+
+	regexLibrary := NewTable()
+	register(regexLibrary, "match", lib.regexMatch)
+	register(regexLibrary, "find_all", lib.regexFindAll)
+	register(regexLibrary, "replace", lib.regexReplace)
+	it.globals.Set("regex", regexLibrary)
+
+	tableLibrary := NewTable()
+	register(tableLibrary, "insert", lib.tableInsert)
+	register(tableLibrary, "remove", lib.tableRemove)
+	register(tableLibrary, "concat", lib.tableConcat)
+	register(tableLibrary, "sort", lib.tableSort)
+	it.globals.Set("table", tableLibrary)
+
+	mathLibrary := NewTable()
+	register(mathLibrary, "floor", lib.mathFunction("floor", math.Floor))
+	register(mathLibrary, "ceil", lib.mathFunction("ceil", math.Ceil))
+	register(mathLibrary, "abs", lib.mathFunction("abs", math.Abs))
+	register(mathLibrary, "sqrt", lib.mathFunction("sqrt", math.Sqrt))
+	register(mathLibrary, "max", lib.mathMax)
+	register(mathLibrary, "min", lib.mathMin)
+	mathLibrary.Set("huge", math.Inf(1))
+	mathLibrary.Set("pi", math.Pi)
+	it.globals.Set("math", mathLibrary)
+}
+
+// argument returns the argument i, or nil if it is missing.
+func argument(arguments []Value, i int) Value {
+	if i < len(arguments) {
+		return arguments[i]
+	}
+	return nil
+}
+
+func (lib *library) checkString(arguments []Value, i int, function string) string {
+	switch v := argument(arguments, i).(type) {
+	case string:
+		return v
+	case float64:
+		return formatNumber(v)
+	}
+	lib.it.raisef("bad argument #%d to '%s' (string expected, got %s)", i+1, function,
+		typeName(argument(arguments, i)))
+	return ""
+}
+
+func (lib *library) checkNumber(arguments []Value, i int, function string) float64 {
+	number, isNumber := toNumber(argument(arguments, i))
+	if !isNumber {
+		lib.it.raisef("bad argument #%d to '%s' (number expected, got %s)", i+1, function,
+			typeName(argument(arguments, i)))
+	}
+	return number
+}
+
+func (lib *library) optionalNumber(arguments []Value, i int, function string, defaultValue float64) float64 {
+	if argument(arguments, i) == nil {
+		return defaultValue
+	}
+	return lib.checkNumber(arguments, i, function)
+}
+
+func (lib *library) checkTable(arguments []Value, i int, function string) *Table {
+	table, isTable := argument(arguments, i).(*Table)
+	if !isTable {
+		lib.it.raisef("bad argument #%d to '%s' (table expected, got %s)", i+1, function,
+			typeName(argument(arguments, i)))
+	}
+	return table
+}
+
+// process accounts for the instructions needed to process n bytes.
+func (lib *library) process(n int) {
+	lib.it.step(int64(n/bytesPerInstruction + 1))
+}
+
+// newString accounts for the memory of a string of n bytes, before it is created.
+func (lib *library) newString(n int) {
+	lib.process(n)
+	lib.it.allocate(n)
+}
+
+func (lib *library) newTable(entries int) *Table {
+	lib.it.allocate(tableSize + entrySize*entries)
+	return NewTable()
+}
+
+func (lib *library) typeOf(arguments []Value) []Value {
+	if len(arguments) == 0 {
+		lib.it.raisef("bad argument #1 to 'type' (value expected)")
+	}
+	return []Value{typeName(arguments[0])}
+}
+
+func (lib *library) toString(arguments []Value) []Value {
+	s := ToString(argument(arguments, 0))
+	lib.newString(len(s))
+	return []Value{s}
+}
+
+func (lib *library) toNumber(arguments []Value) []Value {
+	base := lib.optionalNumber(arguments, 1, "tonumber", 10)
+	if base == 10 {
+		if number, isNumber := toNumber(argument(arguments, 0)); isNumber {
+			return []Value{number}
+		}
+		return []Value{nil}
+	}
+
+	if base < 2 || base > 36 || base != math.Floor(base) {
+		lib.it.raisef("bad argument #2 to 'tonumber' (base out of range)")
+	}
+	s := strings.ToLower(strings.TrimSpace(lib.checkString(arguments, 0, "tonumber")))
+	number, err := strconv.ParseInt(s, int(base), 64)
+	if err != nil {
+		return []Value{nil}
+	}
+	return []Value{float64(number)}
+}
+
+func (lib *library) nextKey(arguments []Value) []Value {
+	table := lib.checkTable(arguments, 0, "next")
+	key, value, isValid := table.next(argument(arguments, 1))
+	if !isValid {
+		lib.it.raisef("invalid key to 'next'")
+	}
+	return []Value{key, value}
+}
+
+func (lib *library) pairs(arguments []Value) []Value {
+	table := lib.checkTable(arguments, 0, "pairs")
+	return []Value{lib.next, table, nil}
+}
+
+func (lib *library) ipairs(arguments []Value) []Value {
+	table := lib.checkTable(arguments, 0, "ipairs")
+	iterator := &builtin{name: "ipairs_iterator", function: func(arguments []Value) ([]Value, error) {
+		i := lib.checkNumber(arguments, 1, "ipairs_iterator") + 1
+		if value := table.Get(i); value != nil {
+			return []Value{i, value}, nil
+		}
+		return []Value{nil}, nil
+	}}
+	return []Value{iterator, table, 0.0}
+}
+
+func (lib *library) error(arguments []Value) []Value {
+	lib.it.raise(errors.New(ToString(argument(arguments, 0))))
+	return nil
+}
+
+func (lib *library) assert(arguments []Value) []Value {
+	if !isTrue(argument(arguments, 0)) {
+		message := "assertion failed!"
+		if len(arguments) > 1 {
+			message = ToString(arguments[1])
+		}
+		lib.it.raise(errors.New(message))
+	}
+	return arguments
+}
+
+func (lib *library) selectArguments(arguments []Value) []Value {
+	if argument(arguments, 0) == "#" {
+		return []Value{float64(len(arguments) - 1)}
+	}
+	// the index is checked as a float, because it may overflow the integers
+	n := lib.checkNumber(arguments, 0, "select")
+	if n < 0 {
+		n += float64(len(arguments))
+	}
+	if !(n >= 1) {
+		lib.it.raisef("bad argument #1 to 'select' (index out of range)")
+	} else if n >= float64(len(arguments)) {
+		return nil
+	}
+	return arguments[int(n):]
+}
+
+func (lib *library) stringLen(arguments []Value) []Value {
+	return []Value{float64(len(lib.checkString(arguments, 0, "len")))}
+}
+
+// stringRange converts the indexes i and j of the strings, starting from 1 and negative from the end, to a range of
+// the string. The range is empty if one of the indexes is NaN.
+func stringRange(length int, i, j float64) (int, int) {
+	if math.IsNaN(i) || math.IsNaN(j) {
+		return 0, 0
+	}
+	if i < 0 {
+		i = math.Max(float64(length)+i+1, 1)
+	} else if i == 0 {
+		i = 1
+	}
+	if j < 0 {
+		j = float64(length) + j + 1
+	} else if j > float64(length) {
+		j = float64(length)
+	}
+	if i > j {
+		return 0, 0
+	}
+	return int(i) - 1, int(j)
+}
+
+func (lib *library) stringSub(arguments []Value) []Value {
+	s := lib.checkString(arguments, 0, "sub")
+	start, end := stringRange(len(s), lib.optionalNumber(arguments, 1, "sub", 1),
+		lib.optionalNumber(arguments, 2, "sub", -1))
+	lib.newString(end - start)
+	return []Value{s[start:end]}
+}
+
+func (lib *library) stringUpper(arguments []Value) []Value {
+	s := lib.checkString(arguments, 0, "upper")
+	lib.newString(len(s))
+	return []Value{strings.ToUpper(s)}
+}
+
+func (lib *library) stringLower(arguments []Value) []Value {
+	s := lib.checkString(arguments, 0, "lower")
+	lib.newString(len(s))
+	return []Value{strings.ToLower(s)}
+}
+
+func (lib *library) stringRep(arguments []Value) []Value {
+	s := lib.checkString(arguments, 0, "rep")
+	n := lib.checkNumber(arguments, 1, "rep")
+	separator := ""
+	if argument(arguments, 2) != nil {
+		separator = lib.checkString(arguments, 2, "rep")
+	}
+	if !(n >= 1) { // also if n is NaN
+		return []Value{""}
+	}
+	// the limits are checked as floats before, because n may overflow the integers
+	if n*float64(len(s)+len(separator)) > float64(lib.it.limits.Memory) {
+		lib.it.raise(ErrMemoryLimit)
+	} else if n > float64(lib.it.limits.Instructions) {
+		lib.it.raise(ErrInstructionsLimit)
+	}
+	count := int(n)
+	lib.it.step(int64(count))
+	size := count*(len(s)+len(separator)) - len(separator)
+	lib.newString(size)
+	var builder strings.Builder
+	builder.Grow(size)
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			builder.WriteString(separator)
+		}
+		builder.WriteString(s)
+	}
+	return []Value{builder.String()}
+}
+
+func (lib *library) stringReverse(arguments []Value) []Value {
+	s := lib.checkString(arguments, 0, "reverse")
+	lib.newString(len(s))
+	reversed := make([]byte, len(s))
+	for i := range s {
+		reversed[len(s)-1-i] = s[i]
+	}
+	return []Value{string(reversed)}
+}
+
+// stringFind finds a plain substring, since the patterns are not supported. Returns the start and the end of the
+// first occurrence after init, or nil.
+func (lib *library) stringFind(arguments []Value) []Value {
+	s := lib.checkString(arguments, 0, "find")
+	substring := lib.checkString(arguments, 1, "find")
+	init := lib.optionalNumber(arguments, 2, "find", 1)
+	if init < 0 {
+		init = math.Max(float64(len(s))+init+1, 1)
+	} else if init == 0 {
+		init = 1
+	}
+	if !(init <= float64(len(s)+1)) { // also if init is NaN
+		return []Value{nil}
+	}
+	start := int(init) - 1
+	lib.process(len(s) - start)
+	index := strings.Index(s[start:], substring)
+	if index < 0 {
+		return []Value{nil}
+	}
+	return []Value{float64(start + index + 1), float64(start + index + len(substring))}
+}
+
+func (lib *library) stringByte(arguments []Value) []Value {
+	s := lib.checkString(arguments, 0, "byte")
+	i := lib.optionalNumber(arguments, 1, "byte", 1)
+	start, end := stringRange(len(s), i, lib.optionalNumber(arguments, 2, "byte", i))
+	lib.it.allocate(entrySize * (end - start))
+	values := make([]Value, 0, end-start)
+	for _, c := range []byte(s[start:end]) {
+		values = append(values, float64(c))
+	}
+	return values
+}
+
+func (lib *library) stringChar(arguments []Value) []Value {
+	lib.newString(len(arguments))
+	bytes := make([]byte, len(arguments))
+	for i := range arguments {
+		c := lib.checkNumber(arguments, i, "char")
+		if c < 0 || c > 255 || c != math.Floor(c) {
+			lib.it.raisef("bad argument #%d to 'char' (value out of range)", i+1)
+		}
+		bytes[i] = byte(c)
+	}
+	return []Value{string(bytes)}
+}
+
+// stringFormat supports the directives %d, %i, %x, %X, %o, %c, %f, %e, %g, %s and %q, with the flags, the width
+// and the precision of Lua, which are limited to two digits.
+func (lib *library) stringFormat(arguments []Value) []Value {
+	format := lib.checkString(arguments, 0, "format")
+	var builder strings.Builder
+	next := 1
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			builder.WriteByte(format[i])
+			continue
+		}
+		if i+1 < len(format) && format[i+1] == '%' {
+			builder.WriteByte('%')
+			i++
+			continue
+		}
+
+		start := i
+		for i++; i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0; i++ {
+		}
+		i = lib.skipDigits(format, i, start)
+		if i < len(format) && format[i] == '.' {
+			i = lib.skipDigits(format, i+1, start)
+		}
+		if i >= len(format) {
+			lib.it.raisef("invalid conversion '%s' to 'format'", format[start:])
+		}
+
+		spec := format[start:i]
+		var formatted string
+		switch verb := format[i]; verb {
+		case 'd', 'i':
+			formatted = fmt.Sprintf(spec+"d", int64(lib.checkNumber(arguments, next, "format")))
+		case 'x', 'X', 'o':
+			formatted = fmt.Sprintf(spec+string(verb), int64(lib.checkNumber(arguments, next, "format")))
+		case 'c':
+			formatted = string([]byte{byte(lib.checkNumber(arguments, next, "format"))})
+		case 'f', 'e', 'E', 'g', 'G':
+			formatted = fmt.Sprintf(spec+string(verb), lib.checkNumber(arguments, next, "format"))
+		case 's':
+			formatted = fmt.Sprintf(spec+"s", ToString(argument(arguments, next)))
+		case 'q':
+			formatted = strconv.Quote(lib.checkString(arguments, next, "format"))
+		default:
+			lib.it.raisef("invalid conversion '%s' to 'format'", format[start:i+1])
+		}
+		next++
+		lib.newString(len(formatted))
+		builder.WriteString(formatted)
+	}
+	return []Value{builder.String()}
+}
+
+// skipDigits skips the width or the precision of a directive of format, which starts at start.
+func (lib *library) skipDigits(format string, i int, start int) int {
+	for digits := 0; i < len(format) && isDigit(format[i]); i, digits = i+1, digits+1 {
+		if digits == 2 {
+			lib.it.raisef("invalid conversion '%s' to 'format'", format[start:i+1])
+		}
+	}
+	return i
+}
+
+// stringSplit splits a string around each occurrence of the separator, at most n times if n is given.
+func (lib *library) stringSplit(arguments []Value) []Value {
+	s := lib.checkString(arguments, 0, "split")
+	separator := lib.checkString(arguments, 1, "split")
+	n := int(lib.optionalNumber(arguments, 2, "split", -1))
+	lib.process(len(s))
+	count := strings.Count(s, separator) + 1
+	if n >= 0 && n < count {
+		count = n
+	}
+	table := lib.newTable(count)
+	lib.it.allocate(len(s))
+	for _, part := range strings.SplitN(s, separator, n) {
+		table.Append(part)
+	}
+	return []Value{table}
+}
+
+func (lib *library) stringTrim(arguments []Value) []Value {
+	s := lib.checkString(arguments, 0, "trim")
+	lib.process(len(s))
+	return []Value{strings.TrimSpace(s)}
+}
+
+// stringHex encodes a string in hexadecimal, which is useful to print the binary payloads.
+func (lib *library) stringHex(arguments []Value) []Value {
+	s := lib.checkString(arguments, 0, "hex")
+	lib.newString(len(s) * 2)
+	return []Value{fmt.Sprintf("%x", s)}
+}
+
+// compile compiles and caches a regular expression. The Go regular expressions run in linear time, so the cost of a
+// match is bounded by the length of the input times the length of the pattern.
+func (lib *library) compile(arguments []Value, function string) *regexp.Regexp {
+	pattern := lib.checkString(arguments, 1, function)
+	if len(pattern) > maxPatternLength {
+		lib.it.raisef("bad argument #2 to '%s' (pattern too long)", function)
+	}
+	if re, isPresent := lib.regexps[pattern]; isPresent {
+		return re
+	}
+	lib.process(len(pattern) * bytesPerInstruction)
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		lib.it.raisef("bad argument #2 to '%s' (%v)", function, err)
+	}
+	lib.regexps[pattern] = re
+	return re
+}
+
+func (lib *library) matchCost(s string, re *regexp.Regexp) {
+	lib.it.step(int64(len(s)/8+1) * int64(len(re.String())/16+1))
+}
+
+// regexMatch returns the captures of the first match of the pattern, or the whole match if the pattern has no
+// captures. Returns nil if the pattern doesn't match.
+func (lib *library) regexMatch(arguments []Value) []Value {
+	s := lib.checkString(arguments, 0, "match")
+	re := lib.compile(arguments, "match")
+	lib.matchCost(s, re)
+	match := re.FindStringSubmatch(s)
+	if match == nil {
+		return []Value{nil}
+	}
+	if len(match) > 1 {
+		match = match[1:]
+	}
+	values := make([]Value, len(match))
+	for i, capture := range match {
+		lib.it.allocate(len(capture))
+		values[i] = capture
+	}
+	return values
+}
+
+// regexFindAll returns a table with the first n matches of the pattern, or all the matches if n is not given. Each
+// match is the first capture, if the pattern has captures, or the whole match.
+func (lib *library) regexFindAll(arguments []Value) []Value {
+	s := lib.checkString(arguments, 0, "find_all")
+	re := lib.compile(arguments, "find_all")
+	n := int(lib.optionalNumber(arguments, 2, "find_all", -1))
+	lib.matchCost(s, re)
+	matches := re.FindAllStringSubmatch(s, n)
+	table := lib.newTable(len(matches))
+	for _, match := range matches {
+		value := match[0]
+		if len(match) > 1 {
+			value = match[1]
+		}
+		lib.it.allocate(len(value))
+		table.Append(value)
+	}
+	return []Value{table}
+}
+
+// regexReplace replaces all the matches of the pattern with the replacement, where $1 is the first capture.
+func (lib *library) regexReplace(arguments []Value) []Value {
+	s := lib.checkString(arguments, 0, "replace")
+	re := lib.compile(arguments, "replace")
+	replacement := lib.checkString(arguments, 2, "replace")
+	lib.matchCost(s, re)
+	// each $ of the replacement expands to a capture, which is not longer than the match
+	expansions := strings.Count(replacement, "$")
+	var result []byte
+	last := 0
+	for _, match := range re.FindAllStringSubmatchIndex(s, -1) {
+		lib.newString(match[0] - last + len(replacement) + expansions*(match[1]-match[0]))
+		result = append(result, s[last:match[0]]...)
+		result = re.ExpandString(result, replacement, s, match)
+		last = match[1]
+	}
+	lib.newString(len(s) - last)
+	return []Value{string(append(result, s[last:]...))}
+}
+
+func (lib *library) tableInsert(arguments []Value) []Value {
+	table := lib.checkTable(arguments, 0, "insert")
+	lib.it.allocate(entrySize)
+	if len(arguments) < 3 {
+		table.Append(argument(arguments, 1))
+		return nil
+	}
+
+	position := lib.checkNumber(arguments, 1, "insert")
+	if position < 1 || position > float64(table.Len()+1) || position != math.Floor(position) {
+		lib.it.raisef("bad argument #2 to 'insert' (position out of bounds)")
+	}
+	lib.process(table.Len() * entrySize)
+	for i := float64(table.Len()); i >= position; i-- {
+		table.Set(i+1, table.Get(i))
+	}
+	table.Set(position, arguments[2])
+	return nil
+}
+
+func (lib *library) tableRemove(arguments []Value) []Value {
+	table := lib.checkTable(arguments, 0, "remove")
+	length := float64(table.Len())
+	if length == 0 {
+		return []Value{nil}
+	}
+	position := lib.optionalNumber(arguments, 1, "remove", length)
+	if position < 1 || position > length || position != math.Floor(position) {
+		lib.it.raisef("bad argument #2 to 'remove' (position out of bounds)")
+	}
+	lib.process(table.Len() * entrySize)
+	value := table.Get(position)
+	for i := position; i < length; i++ {
+		table.Set(i, table.Get(i+1))
+	}
+	table.Set(length, nil)
+	return []Value{value}
+}
+
+func (lib *library) tableConcat(arguments []Value) []Value {
+	table := lib.checkTable(arguments, 0, "concat")
+	separator := ""
+	if argument(arguments, 1) != nil {
+		separator = lib.checkString(arguments, 1, "concat")
+	}
+	start := lib.optionalNumber(arguments, 2, "concat", 1)
+	end := lib.optionalNumber(arguments, 3, "concat", float64(table.Len()))
+
+	var parts []string
+	size := 0
+	for i := start; i <= end; i++ {
+		lib.it.step(1)
+		var part string
+		switch v := table.Get(i).(type) {
+		case string:
+			part = v
+		case float64:
+			part = formatNumber(v)
+		default:
+			lib.it.raisef("invalid value (at index %s) in table for 'concat'", formatNumber(i))
+		}
+		if len(parts) > 0 {
+			size += len(separator)
+		}
+		size += len(part)
+		parts = append(parts, part)
+	}
+	lib.newString(size)
+	return []Value{strings.Join(parts, separator)}
+}
+
+// tableSort sorts the array of a table, with the < operator or with the comparison function.
+func (lib *library) tableSort(arguments []Value) []Value {
+	table := lib.checkTable(arguments, 0, "sort")
+	comparator := argument(arguments, 1)
+	values := make([]Value, table.Len())
+	for i := range values {
+		values[i] = table.Get(float64(i + 1))
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		lib.it.step(1)
+		if comparator == nil {
+			return lib.it.less(values[i], values[j])
+		}
+		results := lib.it.callValue(comparator, []Value{values[i], values[j]})
+		return len(results) > 0 && isTrue(results[0])
+	})
+	for i, value := range values {
+		table.Set(float64(i+1), value)
+	}
+	return nil
+}
+
+func (lib *library) mathFunction(name string, function func(float64) float64) func(arguments []Value) []Value {
+	return func(arguments []Value) []Value {
+		return []Value{function(lib.checkNumber(arguments, 0, name))}
+	}
+}
+
+func (lib *library) mathMax(arguments []Value) []Value {
+	result := lib.checkNumber(arguments, 0, "max")
+	for i := 1; i < len(arguments); i++ {
+		result = math.Max(result, lib.checkNumber(arguments, i, "max"))
+	}
+	return []Value{result}
+}
+
+func (lib *library) mathMin(arguments []Value) []Value {
+	result := lib.checkNumber(arguments, 0, "min")
+	for i := 1; i < len(arguments); i++ {
+		result = math.Min(result, lib.checkNumber(arguments, i, "min"))
+	}
+	return []Value{result}
+}
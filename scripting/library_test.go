@@ -0,0 +1,191 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scripting
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBaseLibrary(t *testing.T) {
+	assert.Equal(t, []Value{"table", "number", "string", "boolean", "nil", "function", "function"},
+		run(t, `result(type({}), type(1), type(""), type(true), type(nil), type(print or type), type(function() end))`))
+	assert.Equal(t, []Value{42.0, 255.0, nil, 16.0, -2.5, 5.0, 35.0, nil, nil, nil},
+		run(t, `result(tonumber("42"), tonumber("ff", 16), tonumber("x"), tonumber(" 0x10 "), tonumber("-2.5"),
+			tonumber("101", 2), tonumber("z", 36), tonumber("2", 2), tonumber({}), tonumber("inf"))`))
+	assert.Equal(t, []Value{"nil", "true", "12", "1.5", "abc"},
+		run(t, `result(tostring(nil), tostring(true), tostring(12), tostring(1.5), tostring("abc"))`))
+	assert.True(t, strings.HasPrefix(run(t, `result(tostring({}))`)[0].(string), "table: 0x"))
+	assert.Equal(t, []Value{3.0, "b", "c", "c"},
+		run(t, `result(select("#", 1, 2, 3), select(2, "a", "b", "c")) result(select(-1, "a", "b", "c"))`))
+	assert.Empty(t, run(t, `result(select(5, 1, 2))`))
+	assert.Equal(t, []Value{1.0, "a", nil, nil},
+		run(t, `local t = {"a"} local k, v = next(t) result(k, v, next(t, k)) result(next({}))`)[:4])
+	assert.Equal(t, []Value{1.0, "x", 2.0},
+		run(t, `result(assert(1, "x", 2))`))
+
+	assert.EqualError(t, runError(t, `type()`), "line 1: bad argument #1 to 'type' (value expected)")
+	assert.EqualError(t, runError(t, `tonumber("1", 99)`), "line 1: bad argument #2 to 'tonumber' (base out of range)")
+	assert.EqualError(t, runError(t, `pairs(1)`), "line 1: bad argument #1 to 'pairs' (table expected, got number)")
+	assert.EqualError(t, runError(t, `ipairs()`), "line 1: bad argument #1 to 'ipairs' (table expected, got nil)")
+	assert.EqualError(t, runError(t, `select(0, 1)`), "line 1: bad argument #1 to 'select' (index out of range)")
+	assert.EqualError(t, runError(t, `select(-5, 1)`), "line 1: bad argument #1 to 'select' (index out of range)")
+	assert.Contains(t, runError(t, `error({})`).Error(), "line 1: table: 0x")
+	assert.EqualError(t, runError(t, `error()`), "line 1: nil")
+
+	// ipairs stops at the first nil, pairs is not confused by a script which redefines next
+	assert.Equal(t, []Value{1.0, 2.0, "k"},
+		run(t, `
+			for i in ipairs({1, 2, nil, 4}) do result(i) end
+			next = nil
+			for k in pairs({k = 1}) do result(k) end`))
+}
+
+func TestStringLibrary(t *testing.T) {
+	assert.Equal(t, []Value{3.0, 0.0, 2.0},
+		run(t, `result(string.len("abc"), ("").len(""), #("ab"))`))
+	assert.Equal(t, []Value{"bc", "bc", "c", "abc", "", "ab", "", "abc", ""},
+		run(t, `local s = "abc"
+			result(s:sub(2), s:sub(2, 3), s:sub(-1), s:sub(0), s:sub(4), s:sub(-10, 2), s:sub(3, 2), s:sub(1, 10),
+				s:sub(0 / 0))`))
+	assert.Equal(t, []Value{"ABC", "abc", "cba", "x-x-x", "xxx", "", ""},
+		run(t, `result(("abc"):upper(), ("ABC"):lower(), ("abc"):reverse(), string.rep("x", 3, "-"),
+			string.rep("x", 3), string.rep("x", 0), string.rep("x", 0 / 0))`))
+	assert.Equal(t, []Value{2.0, 3.0, nil, 4.0, 4.0, 4.0, 1.0, 0.0, nil, nil},
+		run(t, `local s = "abcabc"
+			result(s:find("bc"))
+			result(s:find("x"), s:find("a", 2))
+			result((s:find("a", -3)), (s:find("", 1)), (s:find("", 7)) - 7, s:find("", 8), s:find("a", 0 / 0))`))
+	// find is plain, the special characters are not patterns
+	assert.Equal(t, []Value{2.0, 3.0},
+		run(t, `result(string.find("a.*b", ".*"))`))
+	assert.Equal(t, []Value{97.0, 98.0, 99.0, 99.0, "abc", ""},
+		run(t, `result(("abc"):byte(1, -1)) result(("abc"):byte(-1), string.char(97, 98, 99), string.char())`))
+	assert.Equal(t, []Value{"a,b,,c", 2.0, "a|b,c", "6162ff", "x y", ""},
+		run(t, `
+			local parts = string.split("a,b,,c", ",")
+			local two = string.split("a,b,c", ",", 2)
+			result(table.concat(parts, ","), #two, table.concat(two, "|"), string.hex("ab\xff"),
+				string.trim("  x y \n"), string.trim(""))`))
+
+	assert.Equal(t, []Value{"0042|ff|FF|  a|b  |17|3.14|1.0e+00|x|\"a\\n\"|100%|nil|+5| 5|-3|7"},
+		run(t, `result(string.format("%04d|%x|%X|%3s|%-3s|%o|%.2f|%.1e|%c|%q|100%%|%s|%+d|% d|%i|%g",
+			42, 255, 255, "a", "b", 15, 3.14159, 1, 120, "a\n", nil, 5, 5, -3.7, 7))`))
+	assert.Equal(t, []Value{"1.5 true"},
+		run(t, `result(string.format("%s %s", 1.5, true))`))
+
+	for source, message := range map[string]string{
+		`string.len({})`:             "line 1: bad argument #1 to 'len' (string expected, got table)",
+		`string.rep("x")`:            "line 1: bad argument #2 to 'rep' (number expected, got nil)",
+		`string.char(256)`:           "line 1: bad argument #1 to 'char' (value out of range)",
+		`string.char(97, 1.5)`:       "line 1: bad argument #2 to 'char' (value out of range)",
+		`string.format("%d", "x")`:   "line 1: bad argument #2 to 'format' (number expected, got string)",
+		`string.format("%100d", 1)`:  "line 1: invalid conversion '%100' to 'format'",
+		`string.format("%.100f", 1)`: "line 1: invalid conversion '%.100' to 'format'",
+		`string.format("%y", 1)`:     "line 1: invalid conversion '%y' to 'format'",
+		`string.format("%5")`:        "line 1: invalid conversion '%5' to 'format'",
+		`string.format("%q", {})`:    "line 1: bad argument #2 to 'format' (string expected, got table)",
+		`string.split("a")`:          "line 1: bad argument #2 to 'split' (string expected, got nil)",
+		`local s = "abc" s:find({})`: "line 1: bad argument #2 to 'find' (string expected, got table)",
+		`string.unknown("a")`:        "line 1: attempt to call a nil value",
+		`("abc"):unknown()`:          "line 1: attempt to call a nil value",
+	} {
+		assert.EqualError(t, runError(t, source), message, source)
+	}
+}
+
+func TestRegexLibrary(t *testing.T) {
+	assert.Equal(t, []Value{"1", "2", "FLAG{x}", nil},
+		run(t, `
+			result(regex.match("id=1;key=2", "id=(\\d+);key=(\\d+)"))
+			result(regex.match("a FLAG{x} b", "FLAG\\{\\w+\\}"), regex.match("abc", "\\d"))`))
+	assert.Equal(t, []Value{2.0, "FLAG{1}", "FLAG{2}", 1.0, "2", 0.0},
+		run(t, `
+			local flags = regex.find_all("FLAG{1} FLAG{2}", "FLAG\\{\\d\\}")
+			local first = regex.find_all("FLAG{1} FLAG{2}", "FLAG\\{\\d\\}", 1)
+			local captures = regex.find_all("k=1 k=2", "k=(\\d)")
+			result(#flags, flags[1], flags[2], #first, captures[2], #regex.find_all("abc", "\\d"))`))
+	assert.Equal(t, []Value{"x=*;y=*", "b-a", "abc", "[aa][bb]"},
+		run(t, `result(regex.replace("x=1;y=2", "\\d", "*"), regex.replace("a-b", "(\\w)-(\\w)", "$2-$1"),
+			regex.replace("abc", "\\d", "x"), regex.replace("ab", "(\\w)", "[$1$1]"))`))
+
+	// the regular expressions are cached for the whole run
+	assert.Equal(t, []Value{1000.0},
+		run(t, `local n = 0 for i = 1, 1000 do if regex.match("x" .. i, "^x\\d+$") then n = n + 1 end end result(n)`))
+
+	assert.EqualError(t, runError(t, `regex.match("a", "(")`),
+		"line 1: bad argument #2 to 'match' (error parsing regexp: missing closing ): `(`)")
+	assert.EqualError(t, runError(t, `regex.match("a", string.rep("a", 1025))`),
+		"line 1: bad argument #2 to 'match' (pattern too long)")
+	assert.EqualError(t, runError(t, `regex.replace("a", "a")`),
+		"line 1: bad argument #3 to 'replace' (string expected, got nil)")
+}
+
+func TestTableLibrary(t *testing.T) {
+	assert.Equal(t, []Value{"a b c d", "b c d", "c", 2.0, "a,b", nil},
+		run(t, `
+			local t = {"b"}
+			table.insert(t, "d")
+			table.insert(t, 1, "a")
+			table.insert(t, 3, "c")
+			result(table.concat(t, " "))
+			local first = table.remove(t, 1)
+			result(table.concat(t, " "), t[2])
+			table.remove(t)
+			result(#t, table.concat({"a", "b"}, ","), table.remove({}))`))
+	assert.Equal(t, []Value{"1-2-3", "b", "", "2,3"},
+		run(t, `result(table.concat({1, 2, 3}, "-"), table.concat({"a", "b", "c"}, "", 2, 2),
+			table.concat({}), table.concat({1, 2, 3}, ",", 2))`))
+	assert.Equal(t, []Value{"1 2 3 4", "d c b a", "x:1 y:2 z:3"},
+		run(t, `
+			local numbers = {3, 1, 4, 2}
+			table.sort(numbers)
+			local letters = {"a", "c", "b", "d"}
+			table.sort(letters, function(a, b) return a > b end)
+			local items = {{k = "z", v = 3}, {k = "x", v = 1}, {k = "y", v = 2}}
+			table.sort(items, function(a, b) return a.v < b.v end)
+			local parts = {}
+			for _, item in ipairs(items) do table.insert(parts, item.k .. ":" .. item.v) end
+			result(table.concat(numbers, " "), table.concat(letters, " "), table.concat(parts, " "))`))
+
+	for source, message := range map[string]string{
+		`table.insert({}, 3, "x")`:     "line 1: bad argument #2 to 'insert' (position out of bounds)",
+		`table.insert(nil, "x")`:       "line 1: bad argument #1 to 'insert' (table expected, got nil)",
+		`table.remove({1}, 2)`:         "line 1: bad argument #2 to 'remove' (position out of bounds)",
+		`table.concat({1, {}, 3})`:     "line 1: invalid value (at index 2) in table for 'concat'",
+		`table.concat({1}, ",", 1, 2)`: "line 1: invalid value (at index 2) in table for 'concat'",
+		`table.sort({1, "a"})`:         "line 1: attempt to compare string with number",
+		"\ntable.sort({1, 2}, function(a, b) error(\"in comparator\") end)": "line 2: in comparator",
+	} {
+		assert.EqualError(t, runError(t, source), message, source)
+	}
+}
+
+func TestMathLibrary(t *testing.T) {
+	assert.Equal(t, []Value{1.0, -2.0, 2.0, 3.0, 4.0, 9.0, -1.0, math.Inf(1), math.Pi},
+		run(t, `result(math.floor(1.5), math.floor(-1.5), math.ceil(1.2), math.abs(-3), math.sqrt(16),
+			math.max(1, 9, 3), math.min(1, -1, 3), math.huge, math.pi)`))
+	assert.Equal(t, []Value{2.0},
+		run(t, `result(math.floor("2.5"))`))
+	assert.EqualError(t, runError(t, `math.floor("x")`),
+		"line 1: bad argument #1 to 'floor' (number expected, got string)")
+	assert.EqualError(t, runError(t, `math.max()`), "line 1: bad argument #1 to 'max' (number expected, got nil)")
+}
@@ -0,0 +1,588 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scripting
+
+import "fmt"
+
+// maxNestingLevel bounds the nesting of the blocks and of the expressions, so that the parser and the interpreter,
+// which are recursive, can't exhaust the stack.
+const maxNestingLevel = 200
+
+type expression interface{}
+
+type constantExpression struct {
+	value Value
+}
+
+type nameExpression struct {
+	name string
+}
+
+type indexExpression struct {
+	object, key expression
+	line        int
+}
+
+type callExpression struct {
+	function  expression
+	method    string // not empty for the method calls object:method(arguments)
+	arguments []expression
+	line      int
+}
+
+type functionExpression struct {
+	parameters []string
+	body       *block
+}
+
+type binaryExpression struct {
+	operator    string
+	left, right expression
+	line        int
+}
+
+type unaryExpression struct {
+	operator string
+	operand  expression
+	line     int
+}
+
+type tableExpression struct {
+	fields []tableField
+	line   int
+}
+
+// tableField is a field of a table constructor. The key is nil for the positional fields.
+type tableField struct {
+	key, value expression
+}
+
+// parenthesesExpression truncates the values of a call to the first one.
+type parenthesesExpression struct {
+	inner expression
+}
+
+type statement interface{}
+
+type block struct {
+	statements []statement
+}
+
+type localStatement struct {
+	names       []string
+	expressions []expression
+	line        int
+}
+
+type localFunctionStatement struct {
+	name     string
+	function *functionExpression
+}
+
+type assignStatement struct {
+	targets     []expression
+	expressions []expression
+	line        int
+}
+
+type callStatement struct {
+	call *callExpression
+}
+
+type doStatement struct {
+	body *block
+}
+
+type whileStatement struct {
+	condition expression
+	body      *block
+}
+
+type repeatStatement struct {
+	body      *block
+	condition expression
+}
+
+type ifStatement struct {
+	conditions []expression
+	blocks     []*block
+	elseBlock  *block
+}
+
+type numericForStatement struct {
+	name               string
+	start, limit, step expression
+	body               *block
+	line               int
+}
+
+type genericForStatement struct {
+	names       []string
+	expressions []expression
+	body        *block
+	line        int
+}
+
+type returnStatement struct {
+	expressions []expression
+}
+
+type breakStatement struct{}
+
+// binaryPriorities are the left and the right priorities of the binary operators. The right priority lower than
+// the left one makes an operator right associative.
+var binaryPriorities = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {9, 8}, "+": {10, 10}, "-": {10, 10},
+	"*": {11, 11}, "/": {11, 11}, "//": {11, 11}, "%": {11, 11},
+	"^": {14, 13},
+}
+
+const unaryPriority = 12
+
+type parser struct {
+	lexer   lexer
+	current token
+	ahead   *token
+	level   int
+}
+
+func parse(source string) (*block, error) {
+	p := &parser{lexer: lexer{source: source, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	var body *block
+	err := catch(func() {
+		body = p.block()
+		if p.current.kind != tokenEOF {
+			panic(p.unexpected())
+		}
+	})
+	return body, err
+}
+
+func (p *parser) advance() error {
+	if p.ahead != nil {
+		p.current, p.ahead = *p.ahead, nil
+		return nil
+	}
+	next, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.current = next
+	return nil
+}
+
+func (p *parser) next() {
+	if err := p.advance(); err != nil {
+		panic(err)
+	}
+}
+
+func (p *parser) peek() token {
+	if p.ahead == nil {
+		ahead, err := p.lexer.next()
+		if err != nil {
+			panic(err)
+		}
+		p.ahead = &ahead
+	}
+	return *p.ahead
+}
+
+func (p *parser) is(keyword string) bool {
+	return p.current.kind == tokenKeyword && p.current.text == keyword
+}
+
+func (p *parser) accept(keyword string) bool {
+	if p.is(keyword) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(keyword string) {
+	if !p.accept(keyword) {
+		panic(p.errorf("'%s' expected near %s", keyword, p.describe()))
+	}
+}
+
+func (p *parser) expectName() string {
+	if p.current.kind != tokenName {
+		panic(p.errorf("name expected near %s", p.describe()))
+	}
+	name := p.current.text
+	p.next()
+	return name
+}
+
+func (p *parser) errorf(format string, args ...interface{}) *Error {
+	return &Error{Line: p.current.line, Err: fmt.Errorf(format, args...)}
+}
+
+func (p *parser) unexpected() *Error {
+	return p.errorf("unexpected symbol near %s", p.describe())
+}
+
+func (p *parser) describe() string {
+	switch p.current.kind {
+	case tokenEOF:
+		return "<eof>"
+	case tokenNumber:
+		return fmt.Sprintf("'%v'", p.current.number)
+	case tokenString:
+		return fmt.Sprintf("%q", p.current.text)
+	default:
+		return fmt.Sprintf("'%s'", p.current.text)
+	}
+}
+
+func (p *parser) enter() {
+	p.level++
+	if p.level > maxNestingLevel {
+		panic(p.errorf("too many nested levels"))
+	}
+}
+
+func (p *parser) leave() {
+	p.level--
+}
+
+// blockEnds reports if the current token closes a block.
+func (p *parser) blockEnds() bool {
+	return p.current.kind == tokenEOF || p.is("end") || p.is("else") || p.is("elseif") || p.is("until")
+}
+
+func (p *parser) block() *block {
+	p.enter()
+	defer p.leave()
+
+	body := &block{}
+	for !p.blockEnds() {
+		if p.is("return") {
+			p.next()
+			var expressions []expression
+			if !p.blockEnds() && !p.is(";") {
+				expressions = p.expressionList()
+			}
+			p.accept(";")
+			body.statements = append(body.statements, &returnStatement{expressions})
+			if !p.blockEnds() {
+				panic(p.errorf("'end' expected near %s", p.describe()))
+			}
+			break
+		}
+		if statement := p.statement(); statement != nil {
+			body.statements = append(body.statements, statement)
+		}
+	}
+	return body
+}
+
+func (p *parser) statement() statement {
+	line := p.current.line
+	switch {
+	case p.accept(";"):
+		return nil
+	case p.accept("break"):
+		return &breakStatement{}
+	case p.accept("do"):
+		body := p.block()
+		p.expect("end")
+		return &doStatement{body}
+	case p.accept("while"):
+		condition := p.expression()
+		p.expect("do")
+		body := p.block()
+		p.expect("end")
+		return &whileStatement{condition, body}
+	case p.accept("repeat"):
+		body := p.block()
+		p.expect("until")
+		return &repeatStatement{body, p.expression()}
+	case p.accept("if"):
+		return p.ifStatement()
+	case p.accept("for"):
+		return p.forStatement(line)
+	case p.accept("function"):
+		return p.functionStatement(line)
+	case p.accept("local"):
+		if p.accept("function") {
+			name := p.expectName()
+			return &localFunctionStatement{name, p.functionBody(false)}
+		}
+		names := []string{p.expectName()}
+		for p.accept(",") {
+			names = append(names, p.expectName())
+		}
+		var expressions []expression
+		if p.accept("=") {
+			expressions = p.expressionList()
+		}
+		return &localStatement{names, expressions, line}
+	}
+
+	target := p.suffixedExpression()
+	if p.is("=") || p.is(",") {
+		targets := []expression{target}
+		for p.accept(",") {
+			targets = append(targets, p.suffixedExpression())
+		}
+		for _, target := range targets {
+			switch target.(type) {
+			case *nameExpression, *indexExpression:
+			default:
+				panic(p.errorf("syntax error near %s", p.describe()))
+			}
+		}
+		p.expect("=")
+		return &assignStatement{targets, p.expressionList(), line}
+	}
+	call, isCall := target.(*callExpression)
+	if !isCall {
+		panic(p.errorf("syntax error near %s", p.describe()))
+	}
+	return &callStatement{call}
+}
+
+func (p *parser) ifStatement() statement {
+	statement := &ifStatement{}
+	for {
+		statement.conditions = append(statement.conditions, p.expression())
+		p.expect("then")
+		statement.blocks = append(statement.blocks, p.block())
+		if !p.accept("elseif") {
+			break
+		}
+	}
+	if p.accept("else") {
+		statement.elseBlock = p.block()
+	}
+	p.expect("end")
+	return statement
+}
+
+func (p *parser) forStatement(line int) statement {
+	name := p.expectName()
+	if p.accept("=") {
+		statement := &numericForStatement{name: name, line: line}
+		statement.start = p.expression()
+		p.expect(",")
+		statement.limit = p.expression()
+		if p.accept(",") {
+			statement.step = p.expression()
+		}
+		p.expect("do")
+		statement.body = p.block()
+		p.expect("end")
+		return statement
+	}
+
+	names := []string{name}
+	for p.accept(",") {
+		names = append(names, p.expectName())
+	}
+	p.expect("in")
+	expressions := p.expressionList()
+	p.expect("do")
+	body := p.block()
+	p.expect("end")
+	return &genericForStatement{names, expressions, body, line}
+}
+
+// functionStatement parses the function declarations, as function name.field:method() end, which are assignments
+// of a function to a variable or to a field.
+func (p *parser) functionStatement(line int) statement {
+	var target expression = &nameExpression{p.expectName()}
+	isMethod := false
+	for p.is(".") || p.is(":") {
+		isMethod = p.is(":")
+		p.next()
+		target = &indexExpression{target, &constantExpression{p.expectName()}, line}
+		if isMethod {
+			break
+		}
+	}
+	return &assignStatement{[]expression{target}, []expression{p.functionBody(isMethod)}, line}
+}
+
+func (p *parser) functionBody(isMethod bool) *functionExpression {
+	function := &functionExpression{}
+	if isMethod {
+		function.parameters = append(function.parameters, "self")
+	}
+	p.expect("(")
+	if !p.is(")") {
+		function.parameters = append(function.parameters, p.expectName())
+		for p.accept(",") {
+			function.parameters = append(function.parameters, p.expectName())
+		}
+	}
+	p.expect(")")
+	function.body = p.block()
+	p.expect("end")
+	return function
+}
+
+func (p *parser) expressionList() []expression {
+	expressions := []expression{p.expression()}
+	for p.accept(",") {
+		expressions = append(expressions, p.expression())
+	}
+	return expressions
+}
+
+func (p *parser) expression() expression {
+	return p.subExpression(0)
+}
+
+// subExpression parses the expressions whose binary operators have a left priority greater than limit.
+func (p *parser) subExpression(limit int) expression {
+	p.enter()
+	defer p.leave()
+
+	var left expression
+	if p.is("not") || p.is("-") || p.is("#") {
+		operator, line := p.current.text, p.current.line
+		p.next()
+		left = &unaryExpression{operator, p.subExpression(unaryPriority), line}
+	} else {
+		left = p.simpleExpression()
+	}
+
+	for p.current.kind == tokenKeyword {
+		operator := p.current.text
+		priorities, isBinary := binaryPriorities[operator]
+		if !isBinary || priorities[0] <= limit {
+			break
+		}
+		line := p.current.line
+		p.next()
+		left = &binaryExpression{operator, left, p.subExpression(priorities[1]), line}
+	}
+	return left
+}
+
+func (p *parser) simpleExpression() expression {
+	switch {
+	case p.current.kind == tokenNumber:
+		value := p.current.number
+		p.next()
+		return &constantExpression{value}
+	case p.current.kind == tokenString:
+		value := p.current.text
+		p.next()
+		return &constantExpression{value}
+	case p.accept("nil"):
+		return &constantExpression{nil}
+	case p.accept("true"):
+		return &constantExpression{true}
+	case p.accept("false"):
+		return &constantExpression{false}
+	case p.is("{"):
+		return p.tableConstructor()
+	case p.accept("function"):
+		return p.functionBody(false)
+	}
+	return p.suffixedExpression()
+}
+
+func (p *parser) primaryExpression() expression {
+	if p.current.kind == tokenName {
+		return &nameExpression{p.expectName()}
+	}
+	if p.accept("(") {
+		inner := p.expression()
+		p.expect(")")
+		return &parenthesesExpression{inner}
+	}
+	panic(p.unexpected())
+}
+
+func (p *parser) suffixedExpression() expression {
+	p.enter()
+	defer p.leave()
+
+	expression := p.primaryExpression()
+	for {
+		line := p.current.line
+		switch {
+		case p.accept("."):
+			expression = &indexExpression{expression, &constantExpression{p.expectName()}, line}
+		case p.accept("["):
+			key := p.expression()
+			p.expect("]")
+			expression = &indexExpression{expression, key, line}
+		case p.accept(":"):
+			method := p.expectName()
+			expression = &callExpression{expression, method, p.callArguments(), line}
+		case p.is("(") || p.is("{") || p.current.kind == tokenString:
+			expression = &callExpression{expression, "", p.callArguments(), line}
+		default:
+			return expression
+		}
+	}
+}
+
+func (p *parser) callArguments() []expression {
+	switch {
+	case p.current.kind == tokenString:
+		value := p.current.text
+		p.next()
+		return []expression{&constantExpression{value}}
+	case p.is("{"):
+		return []expression{p.tableConstructor()}
+	}
+
+	p.expect("(")
+	if p.accept(")") {
+		return nil
+	}
+	arguments := p.expressionList()
+	p.expect(")")
+	return arguments
+}
+
+func (p *parser) tableConstructor() expression {
+	table := &tableExpression{line: p.current.line}
+	p.expect("{")
+	for !p.is("}") {
+		if p.accept("[") {
+			key := p.expression()
+			p.expect("]")
+			p.expect("=")
+			table.fields = append(table.fields, tableField{key, p.expression()})
+		} else if p.current.kind == tokenName && p.peek().kind == tokenKeyword && p.peek().text == "=" {
+			key := &constantExpression{p.expectName()}
+			p.expect("=")
+			table.fields = append(table.fields, tableField{key, p.expression()})
+		} else {
+			table.fields = append(table.fields, tableField{nil, p.expression()})
+		}
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	p.expect("}")
+	return table
+}
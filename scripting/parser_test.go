@@ -0,0 +1,220 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scripting
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// describeExpression prints an expression in prefix notation, to check the structure built by the parser.
+func describeExpression(e expression) string {
+	switch ex := e.(type) {
+	case *constantExpression:
+		if s, isString := ex.value.(string); isString {
+			return fmt.Sprintf("%q", s)
+		}
+		return ToString(ex.value)
+	case *nameExpression:
+		return ex.name
+	case *indexExpression:
+		return fmt.Sprintf("(index %s %s)", describeExpression(ex.object), describeExpression(ex.key))
+	case *callExpression:
+		parts := []string{"call", describeExpression(ex.function)}
+		if ex.method != "" {
+			parts[0] = "method " + ex.method
+		}
+		for _, argument := range ex.arguments {
+			parts = append(parts, describeExpression(argument))
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	case *functionExpression:
+		return fmt.Sprintf("(function (%s) %d)", strings.Join(ex.parameters, " "), len(ex.body.statements))
+	case *binaryExpression:
+		return fmt.Sprintf("(%s %s %s)", ex.operator, describeExpression(ex.left), describeExpression(ex.right))
+	case *unaryExpression:
+		return fmt.Sprintf("(%s %s)", ex.operator, describeExpression(ex.operand))
+	case *tableExpression:
+		parts := []string{"table"}
+		for _, field := range ex.fields {
+			if field.key == nil {
+				parts = append(parts, describeExpression(field.value))
+			} else {
+				parts = append(parts, fmt.Sprintf("[%s]=%s", describeExpression(field.key),
+					describeExpression(field.value)))
+			}
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	case *parenthesesExpression:
+		return fmt.Sprintf("(paren %s)", describeExpression(ex.inner))
+	}
+	return fmt.Sprintf("<%T>", e)
+}
+
+func parseExpression(t *testing.T, source string) string {
+	body, err := parse("return " + source)
+	require.NoError(t, err, source)
+	require.Len(t, body.statements, 1, source)
+	statement, isReturn := body.statements[0].(*returnStatement)
+	require.True(t, isReturn, source)
+	require.Len(t, statement.expressions, 1, source)
+	return describeExpression(statement.expressions[0])
+}
+
+func TestParserExpressions(t *testing.T) {
+	for source, expected := range map[string]string{
+		"1 + 2 * 3":              "(+ 1 (* 2 3))",
+		"(1 + 2) * 3":            "(* (paren (+ 1 2)) 3)",
+		"1 - 2 - 3":              "(- (- 1 2) 3)",
+		"2 ^ 3 ^ 2":              "(^ 2 (^ 3 2))",
+		"-2 ^ 2":                 "(- (^ 2 2))",
+		"2 ^ -3":                 "(^ 2 (- 3))",
+		"not a == b":             "(== (not a) b)",
+		"#t + 1":                 "(+ (# t) 1)",
+		`"a" .. "b" .. "c"`:      `(.. "a" (.. "b" "c"))`,
+		"1 + 2 .. 3":             "(.. (+ 1 2) 3)",
+		"a or b and c":           "(or a (and b c))",
+		"a and b or c":           "(or (and a b) c)",
+		"a < b == c >= d":        "(>= (== (< a b) c) d)",
+		"a ~= b and c <= d":      "(and (~= a b) (<= c d))",
+		"7 // 2 % 3 / 4":         "(/ (% (// 7 2) 3) 4)",
+		"a.b.c":                  `(index (index a "b") "c")`,
+		"a[b][1]":                "(index (index a b) 1)",
+		"f(1, 2)(3)":             "(call (call f 1 2) 3)",
+		"o:m(1)":                 "(method m o 1)",
+		`f "s"`:                  `(call f "s")`,
+		"f {1}":                  "(call f (table 1))",
+		"s:upper():lower()":      "(method lower (method upper s))",
+		"{1, x = 2, [3] = 4; 5}": `(table 1 ["x"]=2 [3]=4 5)`,
+		"{f(), g()}":             "(table (call f) (call g))",
+		"{}":                     "(table)",
+		"function(a, b) end":     "(function (a b) 0)",
+		"nil == false":           "(== nil false)",
+		"true":                   "true",
+	} {
+		assert.Equal(t, expected, parseExpression(t, source), source)
+	}
+}
+
+func TestParserStatements(t *testing.T) {
+	body, err := parse(`
+		local a, b = 1
+		local function f(x) return x end
+		a, b.c = b, a
+		f(a)
+		do end
+		while a do break end
+		repeat until true
+		if a then elseif b then else end
+		for i = 1, 10, 2 do end
+		for k, v in pairs(t) do end
+		function o.p:m() end
+		;;
+		return`)
+	require.NoError(t, err)
+
+	var kinds []string
+	for _, statement := range body.statements {
+		kinds = append(kinds, fmt.Sprintf("%T", statement))
+	}
+	assert.Equal(t, []string{"*scripting.localStatement", "*scripting.localFunctionStatement",
+		"*scripting.assignStatement", "*scripting.callStatement", "*scripting.doStatement",
+		"*scripting.whileStatement", "*scripting.repeatStatement", "*scripting.ifStatement",
+		"*scripting.numericForStatement", "*scripting.genericForStatement", "*scripting.assignStatement",
+		"*scripting.returnStatement"}, kinds)
+
+	local := body.statements[0].(*localStatement)
+	assert.Equal(t, []string{"a", "b"}, local.names)
+	assert.Len(t, local.expressions, 1)
+	assert.Equal(t, 2, local.line)
+
+	conditional := body.statements[7].(*ifStatement)
+	assert.Len(t, conditional.conditions, 2)
+	assert.NotNil(t, conditional.elseBlock)
+
+	loop := body.statements[8].(*numericForStatement)
+	assert.Equal(t, "i", loop.name)
+	assert.Equal(t, "2", describeExpression(loop.step))
+
+	// the methods declared with : have the implicit parameter self
+	method := body.statements[10].(*assignStatement)
+	assert.Equal(t, `(index (index o "p") "m")`, describeExpression(method.targets[0]))
+	assert.Equal(t, "(function (self) 0)", describeExpression(method.expressions[0]))
+}
+
+func TestParserErrors(t *testing.T) {
+	for source, message := range map[string]string{
+		"local x = ":                "line 1: unexpected symbol near <eof>",
+		"if x then\n  y = \n end":   "line 3: unexpected symbol near 'end'",
+		"f(":                        "line 1: unexpected symbol near <eof>",
+		"\n\nreturn 1 2":            "line 3: 'end' expected near '2'",
+		"x":                         "line 1: syntax error near <eof>",
+		"f() = 1":                   "line 1: syntax error near '='",
+		"1 = 2":                     "line 1: unexpected symbol near '1'",
+		"while true end":            "line 1: 'do' expected near 'end'",
+		"for i = 1 do end":          "line 1: ',' expected near 'do'",
+		"for 1 in x do end":         "line 1: name expected near '1'",
+		"for a, b = 1, 2 do end":    "line 1: 'in' expected near '='",
+		"function f(a, 1) end":      "line 1: name expected near '1'",
+		"local function () end":     "line 1: name expected near '('",
+		"t = {1 2}":                 "line 1: '}' expected near '2'",
+		"t = {[1] 2}":               "line 1: '=' expected near '2'",
+		"if x then":                 "line 1: 'end' expected near <eof>",
+		"repeat x = 1":              "line 1: 'until' expected near <eof>",
+		"x = 1 end":                 "line 1: unexpected symbol near 'end'",
+		"o:m":                       "line 1: '(' expected near <eof>",
+		"return return":             "line 1: unexpected symbol near 'return'",
+		"goto continue":             "line 1: syntax error near 'continue'",
+		"x = 'a' 'b'":               `line 1: unexpected symbol near "b"`,
+		"\n\nlocal s = 'unfinished": "line 3: unfinished string",
+	} {
+		_, err := parse(source)
+		assert.EqualError(t, err, message, source)
+	}
+}
+
+func TestParserNesting(t *testing.T) {
+	// the nesting is bounded, so that the recursive parser and interpreter can't exhaust the stack
+	for _, source := range []string{
+		"return " + strings.Repeat("(", 1000) + "1" + strings.Repeat(")", 1000),
+		strings.Repeat("do ", 1000) + strings.Repeat("end ", 1000),
+		"return " + strings.Repeat("- ", 1000) + "1",
+		"return " + strings.Repeat("not ", 1000) + "1",
+		"return " + strings.Repeat("{", 1000) + strings.Repeat("}", 1000),
+		"return " + strings.Repeat("f(", 1000) + strings.Repeat(")", 1000),
+		"return 1" + strings.Repeat(" .. 1", 1000),
+		"return 2" + strings.Repeat(" ^ 2", 1000),
+		strings.Repeat("if x then ", 1000) + strings.Repeat("end ", 1000),
+		strings.Repeat("x = function() ", 1000) + strings.Repeat("end ", 1000),
+	} {
+		_, err := parse(source)
+		assert.EqualError(t, err, "line 1: too many nested levels", source[:20])
+	}
+
+	_, err := parse("return " + strings.Repeat("(", 50) + "1" + strings.Repeat(")", 50))
+	assert.NoError(t, err)
+	_, err = parse(strings.Repeat("do ", 50) + strings.Repeat("end ", 50))
+	assert.NoError(t, err)
+	// the operators which are left associative don't nest
+	_, err = parse("return 1" + strings.Repeat(" + 1", 10000))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,305 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scripting
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Value is a value of a script: nil, bool, float64, string, *Table or a function.
+type Value = interface{}
+
+// Function is a Go function which can be called by the scripts. The error is raised in the script.
+type Function func(arguments []Value) ([]Value, error)
+
+// builtin wraps the functions called by the scripts, which can't be compared or used as keys otherwise.
+type builtin struct {
+	name     string
+	function Function
+}
+
+type closure struct {
+	function *functionExpression
+	scope    *scope
+}
+
+// Table is the only data structure of the scripts. The values with the keys 1..n are kept in an array, the others in
+// a map which remembers the insertion order, so that pairs iterates the tables always in the same order.
+type Table struct {
+	array   []Value
+	hash    map[Value]int // the position of the keys in entries
+	entries []tableEntry
+	removed int // the removed entries, whose key is nil
+}
+
+type tableEntry struct {
+	key, value Value
+}
+
+func NewTable() *Table {
+	return &Table{}
+}
+
+// Get returns the value of the key, or nil.
+func (t *Table) Get(key Value) Value {
+	key = normalize(key)
+	if index, isIndex := arrayIndex(key); isIndex && index < len(t.array) {
+		return t.array[index]
+	}
+	if position, isPresent := t.hash[key]; isPresent {
+		return t.entries[position].value
+	}
+	return nil
+}
+
+// Set sets the value of the key. The Go integers, the byte slices and the Functions are converted to the values of
+// the scripts. Set panics if the key is nil or NaN, or if the value can't be converted.
+func (t *Table) Set(key, value Value) {
+	key, value = normalize(key), normalize(value)
+	if key == nil {
+		panic("table index is nil")
+	} else if number, isNumber := key.(float64); isNumber && math.IsNaN(number) {
+		panic("table index is NaN")
+	}
+
+	index, isIndex := arrayIndex(key)
+	switch {
+	case isIndex && index < len(t.array):
+		t.array[index] = value
+		for len(t.array) > 0 && t.array[len(t.array)-1] == nil {
+			t.array = t.array[:len(t.array)-1]
+		}
+	case isIndex && index == len(t.array) && value != nil:
+		t.removeEntry(key)
+		t.array = append(t.array, value)
+		// the following keys are moved from the map to the array
+		for next := float64(len(t.array) + 1); ; next++ {
+			position, isPresent := t.hash[next]
+			if !isPresent || t.entries[position].value == nil {
+				break
+			}
+			t.array = append(t.array, t.entries[position].value)
+			t.removeEntry(next)
+		}
+	default:
+		if position, isPresent := t.hash[key]; isPresent {
+			t.entries[position].value = value
+		} else if value != nil {
+			t.compact()
+			if t.hash == nil {
+				t.hash = make(map[Value]int)
+			}
+			t.hash[key] = len(t.entries)
+			t.entries = append(t.entries, tableEntry{key, value})
+		}
+	}
+}
+
+// Append sets the value of the key Len() + 1.
+func (t *Table) Append(value Value) {
+	t.Set(float64(len(t.array)+1), value)
+}
+
+// Len returns the length of the sequence 1..n of the table.
+func (t *Table) Len() int {
+	return len(t.array)
+}
+
+// has reports if the key is present, to account for the memory used by the new keys.
+func (t *Table) has(key Value) bool {
+	return t.Get(key) != nil
+}
+
+// next returns the key and the value which follow key, starting from the array, or nil when there are no more keys.
+// The entries assigned to nil are skipped. Returns false if the key is not in the table.
+func (t *Table) next(key Value) (Value, Value, bool) {
+	start := 0
+	if key != nil {
+		if index, isIndex := arrayIndex(key); isIndex && index < len(t.array) {
+			start = index + 1
+		} else if position, isPresent := t.hash[key]; isPresent {
+			start = len(t.array) + position + 1
+		} else if isIndex { // the last values of the array have been cleared while iterating
+			start = len(t.array)
+		} else {
+			return nil, nil, false
+		}
+	}
+
+	for i := start; i < len(t.array); i++ {
+		if t.array[i] != nil {
+			return float64(i + 1), t.array[i], true
+		}
+	}
+	if start < len(t.array) {
+		start = len(t.array)
+	}
+	for i := start - len(t.array); i < len(t.entries); i++ {
+		if t.entries[i].key != nil && t.entries[i].value != nil {
+			return t.entries[i].key, t.entries[i].value, true
+		}
+	}
+	return nil, nil, true
+}
+
+func (t *Table) removeEntry(key Value) {
+	if position, isPresent := t.hash[key]; isPresent {
+		t.entries[position] = tableEntry{}
+		delete(t.hash, key)
+		t.removed++
+	}
+}
+
+// compact drops the removed entries, when they are the most. It is called only before adding a new key, which is
+// not allowed while iterating the table, so it doesn't break the iterations in progress.
+func (t *Table) compact() {
+	if t.removed < 16 || t.removed < len(t.entries)/2 {
+		return
+	}
+	entries := make([]tableEntry, 0, len(t.entries)-t.removed)
+	for _, entry := range t.entries {
+		if entry.key != nil {
+			t.hash[entry.key] = len(entries)
+			entries = append(entries, entry)
+		}
+	}
+	t.entries, t.removed = entries, 0
+}
+
+// arrayIndex returns the index in the array of the integer keys greater than 0.
+func arrayIndex(key Value) (int, bool) {
+	number, isNumber := key.(float64)
+	if !isNumber || number < 1 || number > math.MaxInt32 || number != math.Floor(number) {
+		return 0, false
+	}
+	return int(number) - 1, true
+}
+
+// normalize converts the Go values to the values of the scripts.
+func normalize(value Value) Value {
+	switch v := value.(type) {
+	case nil, bool, float64, string, *Table, *builtin, *closure:
+		return v
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case uint:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case uint16:
+		return float64(v)
+	case uint8:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case []byte:
+		return string(v)
+	case Function:
+		return &builtin{name: "?", function: v}
+	}
+	panic(fmt.Sprintf("unsupported value of type %T", value))
+}
+
+func typeName(value Value) string {
+	switch value.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *Table:
+		return "table"
+	default:
+		return "function"
+	}
+}
+
+func isTrue(value Value) bool {
+	return value != nil && value != false
+}
+
+// ToString converts a value to a string, as the tostring function of the scripts.
+func ToString(value Value) string {
+	switch v := value.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return formatNumber(v)
+	case string:
+		return v
+	case *builtin:
+		return fmt.Sprintf("function: builtin: %s", v.name)
+	default:
+		return fmt.Sprintf("%s: %p", typeName(v), v)
+	}
+}
+
+func formatNumber(number float64) string {
+	switch {
+	case math.IsInf(number, 1):
+		return "inf"
+	case math.IsInf(number, -1):
+		return "-inf"
+	case math.IsNaN(number):
+		return "nan"
+	case number == math.Floor(number) && math.Abs(number) < 1e15:
+		return strconv.FormatInt(int64(number), 10)
+	}
+	return strconv.FormatFloat(number, 'g', 14, 64)
+}
+
+// toNumber converts the numbers and the strings which contain a number, decimal or hexadecimal.
+func toNumber(value Value) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		s := strings.TrimSpace(v)
+		negative := strings.HasPrefix(s, "-")
+		if hex := strings.TrimPrefix(s, "-"); strings.HasPrefix(hex, "0x") || strings.HasPrefix(hex, "0X") {
+			number, err := strconv.ParseUint(hex[2:], 16, 64)
+			if err != nil {
+				return 0, false
+			}
+			if negative {
+				return -float64(number), true
+			}
+			return float64(number), true
+		}
+		if strings.ContainsAny(s, "nN") { // inf and nan are not numbers for the scripts
+			return 0, false
+		}
+		number, err := strconv.ParseFloat(s, 64)
+		return number, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,738 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eciavatta/caronte/scripting"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultScriptTimeout      = 5
+	defaultScriptInstructions = 1000000
+	defaultScriptMemoryLimit  = 16
+	maxScriptDepth            = 100
+	maxScriptResults          = 256 // tags and extractions set by each run of a script
+	maxScriptMatches          = 64  // matched slices sent to a script for each rule
+	maxScriptMatchSize        = 4096
+	maxExtractionNameLength   = 64
+	maxExtractionValueLength  = 4096
+	defaultExtractionsLimit   = 100
+	scriptsQueueSize          = 256
+	scriptsWorkers            = 2
+)
+
+// Script is a Lua program run when one of the rules in RulesIDs matches a connection, before the connection is saved.
+// The script is run by the embedded interpreter of the scripting package, which has no access to files, network or
+// processes. It reads the globals connection and matches, and calls tag, extract and suppress. A run is stopped
+// after Timeout seconds, after InstructionsLimit instructions or when it allocates more than MemoryLimit megabytes.
+type Script struct {
+	ID                RowID   `json:"id" bson:"_id"`
+	Name              string  `json:"name" binding:"required,min=3" bson:"name"`
+	Source            string  `json:"source" binding:"required,max=65536" bson:"source"`
+	RulesIDs          []RowID `json:"rules_ids" binding:"required,min=1" bson:"rules_ids"`
+	Timeout           uint    `json:"timeout" binding:"max=60" bson:"timeout"`
+	InstructionsLimit uint    `json:"instructions_limit" binding:"max=100000000" bson:"instructions_limit"`
+	MemoryLimit       uint    `json:"memory_limit" binding:"max=256" bson:"memory_limit"`
+	Enabled           bool    `json:"enabled" bson:"enabled"`
+}
+
+// ScriptMatch is a slice of the client or of the server stream matched by a pattern of a rule. From and To are the
+// offsets of the slice in the stream.
+type ScriptMatch struct {
+	RuleID     RowID
+	FromClient bool
+	From       uint64
+	To         uint64
+	Payload    []byte
+}
+
+// ScriptResponse collects the results of a run of a script. Tags are added to the connection, Extractions are saved
+// in the extractions collection and, if Suppress is set, the rules of the script are removed from the matched rules.
+type ScriptResponse struct {
+	Tags        []string
+	Extractions []ScriptExtraction
+	Suppress    bool
+}
+
+type ScriptExtraction struct {
+	Name  string
+	Value string
+}
+
+// Extraction is a field extracted by a script from a connection, e.g. a flag id.
+type Extraction struct {
+	ID           RowID     `json:"id" bson:"_id"`
+	ConnectionID RowID     `json:"connection_id" bson:"connection_id"`
+	ScriptID     RowID     `json:"script_id" bson:"script_id"`
+	ServicePort  uint16    `json:"service_port" bson:"service_port"`
+	Name         string    `json:"name" bson:"name"`
+	Value        string    `json:"value" bson:"value"`
+	ExtractedAt  time.Time `json:"extracted_at" bson:"extracted_at"`
+}
+
+type ExtractionsFilter struct {
+	ConnectionID string `form:"connection_id" binding:"omitempty,hexadecimal,len=24"`
+	ScriptID     string `form:"script_id" binding:"omitempty,hexadecimal,len=24"`
+	Name         string `form:"name"`
+	Limit        int64  `form:"limit" binding:"omitempty,min=1,max=1000"`
+}
+
+// ScriptStatistics counts the runs of a script. Dropped counts the connections not processed by the script because
+// the queue was full.
+type ScriptStatistics struct {
+	Runs        int       `json:"runs"`
+	Errors      int       `json:"errors"`
+	Dropped     int       `json:"dropped"`
+	Suppressed  int       `json:"suppressed"`
+	Extractions int       `json:"extractions"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastRunAt   time.Time `json:"last_run_at,omitempty"`
+}
+
+type ScriptStatus struct {
+	Script
+	Statistics ScriptStatistics `json:"statistics"`
+}
+
+type compiledScript struct {
+	Script
+	program *scripting.Program // nil if the stored source is not valid
+}
+
+// scriptsHook is a connection whose scripts are waiting to be run, which is saved by save with the results of the
+// scripts. The slices matched by the rules are kept with the position of the documents, and the payloads are read by
+// the worker.
+type scriptsHook struct {
+	connection Connection
+	scripts    []compiledScript
+	slices     map[RowID]ruleSlices
+	client     storedStream
+	server     storedStream
+	save       func(connection Connection)
+}
+
+type ruleSlices struct {
+	client, server []PatternSlice
+}
+
+// ScriptsController keeps the scripts in memory and runs them on the connections which match their rules. The
+// connections are queued by the reassembly and processed by a fixed number of workers, so that the scripts never
+// slow down the ingestion: when the queue is full the connections are saved without running the scripts.
+type ScriptsController struct {
+	storage                Storage
+	rulesManager           RulesManager
+	notificationController *NotificationController
+	scripts                map[RowID]compiledScript
+	statistics             map[RowID]*ScriptStatistics
+	queue                  chan scriptsHook
+	ctx                    context.Context
+	cancelFunc             context.CancelFunc
+	workers                sync.WaitGroup
+	stopped                bool
+	mutex                  sync.Mutex
+}
+
+func NewScriptsController(storage Storage, rulesManager RulesManager,
+	notificationController *NotificationController) *ScriptsController {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	sc := &ScriptsController{
+		storage:                storage,
+		rulesManager:           rulesManager,
+		notificationController: notificationController,
+		scripts:                make(map[RowID]compiledScript),
+		statistics:             make(map[RowID]*ScriptStatistics),
+		queue:                  make(chan scriptsHook, scriptsQueueSize),
+		ctx:                    ctx,
+		cancelFunc:             cancelFunc,
+	}
+
+	var scripts []Script
+	if err := storage.Find(Scripts).All(&scripts); err != nil {
+		log.WithError(err).Panic("failed to retrieve scripts")
+	}
+	for _, script := range scripts {
+		program, err := scripting.Compile(script.Source)
+		if err != nil {
+			log.WithError(err).WithField("script", script.Name).Error("failed to compile script")
+			sc.scriptStatistics(script.ID).LastError = err.Error()
+		}
+		sc.scripts[script.ID] = compiledScript{script, program}
+	}
+
+	return sc
+}
+
+// Run starts the workers which run the queued scripts, and returns when the controller is stopped.
+func (sc *ScriptsController) Run() {
+	sc.mutex.Lock()
+	if sc.stopped {
+		sc.mutex.Unlock()
+		return
+	}
+	sc.workers.Add(scriptsWorkers)
+	sc.mutex.Unlock()
+
+	for i := 0; i < scriptsWorkers; i++ {
+		go func() {
+			defer sc.workers.Done()
+			for {
+				select {
+				case hook := <-sc.queue:
+					sc.runHook(hook)
+				case <-sc.ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	sc.workers.Wait()
+}
+
+// Stop stops the workers and the scripts running, and waits for the workers to exit. The connections still queued are
+// saved without running their scripts.
+func (sc *ScriptsController) Stop() {
+	sc.mutex.Lock()
+	sc.stopped = true
+	sc.mutex.Unlock()
+	sc.cancelFunc()
+	sc.workers.Wait()
+
+	for {
+		select {
+		case hook := <-sc.queue:
+			hook.save(hook.connection)
+		default:
+			return
+		}
+	}
+}
+
+func (sc *ScriptsController) GetScripts() []ScriptStatus {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	scripts := make([]ScriptStatus, 0, len(sc.scripts))
+	for id := range sc.scripts {
+		scripts = append(scripts, sc.scriptStatus(id))
+	}
+	sort.Slice(scripts, func(i, j int) bool {
+		return scripts[i].Name < scripts[j].Name
+	})
+	return scripts
+}
+
+func (sc *ScriptsController) GetScript(id RowID) (ScriptStatus, bool) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	if _, isPresent := sc.scripts[id]; !isPresent {
+		return ScriptStatus{}, false
+	}
+	return sc.scriptStatus(id), true
+}
+
+func (sc *ScriptsController) AddScript(c context.Context, script Script) (RowID, error) {
+	program, err := sc.validateScript(script)
+	if err != nil {
+		return EmptyRowID(), err
+	}
+	script.ID = NewRowID()
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if _, err := sc.storage.Insert(Scripts).Context(c).One(script); err != nil {
+		return EmptyRowID(), errors.New("duplicate name")
+	}
+	sc.scripts[script.ID] = compiledScript{script, program}
+
+	return script.ID, nil
+}
+
+// UpdateScript replaces a script. Returns false if the script does not exist.
+func (sc *ScriptsController) UpdateScript(c context.Context, id RowID, script Script) (bool, error) {
+	script.ID = id
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if _, isPresent := sc.scripts[id]; !isPresent {
+		return false, nil
+	}
+	program, err := sc.validateScript(script)
+	if err != nil {
+		return true, err
+	}
+
+	if _, err := sc.storage.Update(Scripts).Context(c).Filter(byID(id)).One(script); err != nil {
+		return true, errors.New("duplicate name")
+	}
+	sc.scripts[id] = compiledScript{script, program}
+
+	return true, nil
+}
+
+// DeleteScript removes a script. The fields already extracted by the script are kept.
+func (sc *ScriptsController) DeleteScript(c context.Context, id RowID) bool {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if _, isPresent := sc.scripts[id]; !isPresent {
+		return false
+	}
+
+	if err := sc.storage.Delete(Scripts).Context(c).Filter(byID(id)).One(); err != nil {
+		log.WithError(err).WithField("id", id).Panic("failed to delete script")
+	}
+	delete(sc.scripts, id)
+	delete(sc.statistics, id)
+
+	return true
+}
+
+// GetExtractions returns the fields extracted by the scripts, the most recent first.
+func (sc *ScriptsController) GetExtractions(c context.Context, filter ExtractionsFilter) []Extraction {
+	query := sc.storage.Find(Extractions).Context(c).Sort("_id", false)
+	if filter.ConnectionID != "" {
+		connectionID, _ := RowIDFromHex(filter.ConnectionID)
+		query = query.Filter(OrderedDocument{{"connection_id", connectionID}})
+	}
+	if filter.ScriptID != "" {
+		scriptID, _ := RowIDFromHex(filter.ScriptID)
+		query = query.Filter(OrderedDocument{{"script_id", scriptID}})
+	}
+	if filter.Name != "" {
+		query = query.Filter(OrderedDocument{{"name", filter.Name}})
+	}
+	if filter.Limit == 0 {
+		filter.Limit = defaultExtractionsLimit
+	}
+
+	var extractions []Extraction
+	if err := query.Limit(filter.Limit).All(&extractions); err != nil {
+		log.WithError(err).WithField("filter", filter).Panic("failed to retrieve extractions")
+	}
+	if extractions == nil {
+		extractions = []Extraction{}
+	}
+	return extractions
+}
+
+// EnqueueHooks queues a connection, before it is saved, for the enabled scripts bound to the rules it matched. The
+// connection is saved by save when the scripts have run. It never blocks: if there are no scripts to run, if the
+// controller is stopped or if the queue is full it returns false, and the connection must be saved by the caller. The
+// connections not queued because the queue is full are counted in the statistics of the scripts.
+func (sc *ScriptsController) EnqueueHooks(connection Connection, client, server *StreamHandler,
+	save func(connection Connection)) bool {
+	scripts := sc.boundScripts(connection.MatchedRules)
+	if len(scripts) == 0 {
+		return false
+	}
+
+	hook := scriptsHook{
+		connection: connection,
+		scripts:    scripts,
+		slices:     make(map[RowID]ruleSlices),
+		client:     client.storedStream(),
+		server:     server.storedStream(),
+		save:       save,
+	}
+	for _, script := range scripts {
+		for _, ruleID := range script.RulesIDs {
+			if _, isPresent := hook.slices[ruleID]; !isPresent && containsRowID(connection.MatchedRules, ruleID) {
+				hook.slices[ruleID] = sc.ruleSlices(ruleID, client, server)
+			}
+		}
+	}
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if sc.stopped {
+		return false
+	}
+	select {
+	case sc.queue <- hook:
+		return true
+	default:
+		for _, script := range scripts {
+			if _, isPresent := sc.scripts[script.ID]; isPresent {
+				sc.scriptStatistics(script.ID).Dropped++
+			}
+		}
+		log.WithField("connection_id", connection.ID).Warn("scripts queue is full, connection saved without scripts")
+		return false
+	}
+}
+
+// runHook runs the scripts of a queued connection and saves it. The tags returned by the scripts are added to the
+// connection and the suppressed rules are removed from its matched rules before it is saved. If the controller is
+// stopped the connection is saved without running the scripts.
+func (sc *ScriptsController) runHook(hook scriptsHook) {
+	if sc.ctx.Err() != nil {
+		hook.save(hook.connection)
+		return
+	}
+
+	matches := make(map[RowID][]ScriptMatch, len(hook.slices))
+	for ruleID, slices := range hook.slices {
+		matches[ruleID] = append(sc.streamMatches(ruleID, hook.client, slices.client),
+			sc.streamMatches(ruleID, hook.server, slices.server)...)
+	}
+
+	var tags []string
+	var extractions []Extraction
+	var suppressedRules []RowID
+	for _, script := range hook.scripts {
+		var rules []RowID
+		var scriptMatches []ScriptMatch
+		for _, ruleID := range script.RulesIDs {
+			if ruleMatches, isPresent := matches[ruleID]; isPresent {
+				rules = append(rules, ruleID)
+				scriptMatches = append(scriptMatches, ruleMatches...)
+			}
+		}
+
+		response, err := runScript(sc.ctx, script, hook.connection, rules, scriptMatches)
+		if err != nil {
+			sc.updateStatistics(script.ID, 0, false, err)
+			log.WithError(err).WithFields(log.Fields{"script": script.Name,
+				"connection_id": hook.connection.ID}).Warn("failed to run script")
+			continue
+		}
+
+		tags = mergeTags(tags, response.Tags)
+		scriptExtractions := newExtractions(hook.connection, script.ID, response.Extractions)
+		extractions = append(extractions, scriptExtractions...)
+		if response.Suppress {
+			suppressedRules = append(suppressedRules, rules...)
+		}
+		sc.updateStatistics(script.ID, len(scriptExtractions), response.Suppress, nil)
+	}
+
+	connection := hook.connection
+	connection.Tags = mergeTags(connection.Tags, tags)
+	if len(suppressedRules) > 0 {
+		sc.rulesManager.SuppressMatchedRules(&connection, suppressedRules)
+	}
+	hook.save(connection)
+	sc.SaveExtractions(extractions)
+
+	if len(tags) > 0 {
+		sc.notificationController.Notify("scripts.tagged", gin.H{
+			"connection_id": connection.ID,
+			"tags":          tags,
+		})
+	}
+	if len(suppressedRules) > 0 {
+		sc.notificationController.Notify("scripts.suppressed", gin.H{
+			"connection_id":    connection.ID,
+			"suppressed_rules": suppressedRules,
+		})
+	}
+}
+
+// SaveExtractions inserts the extractions of the scripts.
+func (sc *ScriptsController) SaveExtractions(extractions []Extraction) {
+	if len(extractions) == 0 {
+		return
+	}
+
+	documents := make([]interface{}, len(extractions))
+	for i, extraction := range extractions {
+		documents[i] = extraction
+	}
+	if _, err := sc.storage.Insert(Extractions).Many(documents); err != nil {
+		log.WithError(err).WithField("connection_id", extractions[0].ConnectionID).Error("failed to save extractions")
+		return
+	}
+	sc.notificationController.Notify("extractions.new", extractions)
+}
+
+// validateScript checks the rules of a script and compiles its source.
+func (sc *ScriptsController) validateScript(script Script) (*scripting.Program, error) {
+	for _, ruleID := range script.RulesIDs {
+		if _, isPresent := sc.rulesManager.GetRule(ruleID); !isPresent {
+			return nil, fmt.Errorf("rule %s does not exist", ruleID.Hex())
+		}
+	}
+	program, err := scripting.Compile(script.Source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source: %v", err)
+	}
+	return program, nil
+}
+
+func (sc *ScriptsController) boundScripts(matchedRules []RowID) []compiledScript {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	var scripts []compiledScript
+	for _, script := range sc.scripts {
+		if !script.Enabled || script.program == nil {
+			continue
+		}
+		for _, ruleID := range script.RulesIDs {
+			if containsRowID(matchedRules, ruleID) {
+				scripts = append(scripts, script)
+				break
+			}
+		}
+	}
+	sort.Slice(scripts, func(i, j int) bool {
+		return scripts[i].Name < scripts[j].Name
+	})
+	return scripts
+}
+
+// ruleSlices returns the first slices of the streams matched by the patterns of a rule, ordered by offset.
+func (sc *ScriptsController) ruleSlices(ruleID RowID, client, server *StreamHandler) ruleSlices {
+	var slices ruleSlices
+	for id, direction := range sc.rulesManager.RulePatterns(ruleID) {
+		if direction != DirectionToClient {
+			slices.client = append(slices.client, client.patternMatches[id]...)
+		}
+		if direction != DirectionToServer {
+			slices.server = append(slices.server, server.patternMatches[id]...)
+		}
+	}
+
+	slices.client = firstSlices(slices.client, maxScriptMatches)
+	slices.server = firstSlices(slices.server, maxScriptMatches-len(slices.client))
+	return slices
+}
+
+// streamMatches reads from the stored documents of a stream the payloads of the slices.
+func (sc *ScriptsController) streamMatches(ruleID RowID, stream storedStream, slices []PatternSlice) []ScriptMatch {
+	payloads := stream.readMatches(sc.storage, slices, maxScriptMatchSize)
+	matches := make([]ScriptMatch, len(slices))
+	for i, slice := range slices {
+		matches[i] = ScriptMatch{
+			RuleID:     ruleID,
+			FromClient: stream.isClient,
+			From:       slice[0],
+			To:         slice[1],
+			Payload:    payloads[i],
+		}
+	}
+	return matches
+}
+
+func (sc *ScriptsController) updateStatistics(id RowID, extractions int, suppressed bool, err error) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	if _, isPresent := sc.scripts[id]; !isPresent {
+		return // deleted while running
+	}
+	statistics := sc.scriptStatistics(id)
+	statistics.Runs++
+	statistics.LastRunAt = time.Now()
+	statistics.Extractions += extractions
+	if suppressed {
+		statistics.Suppressed++
+	}
+	if err != nil {
+		statistics.Errors++
+		statistics.LastError = err.Error()
+	}
+}
+
+// scriptStatistics returns the statistics of a script, creating them if missing. The mutex must be held.
+func (sc *ScriptsController) scriptStatistics(id RowID) *ScriptStatistics {
+	statistics, isPresent := sc.statistics[id]
+	if !isPresent {
+		statistics = &ScriptStatistics{}
+		sc.statistics[id] = statistics
+	}
+	return statistics
+}
+
+func (sc *ScriptsController) scriptStatus(id RowID) ScriptStatus {
+	status := ScriptStatus{Script: sc.scripts[id].Script}
+	if statistics, isPresent := sc.statistics[id]; isPresent {
+		status.Statistics = *statistics
+	}
+	return status
+}
+
+// firstSlices returns the first limit slices, ordered by offset.
+func firstSlices(slices []PatternSlice, limit int) []PatternSlice {
+	sort.Slice(slices, func(i, j int) bool {
+		return slices[i][0] < slices[j][0]
+	})
+	if len(slices) > limit {
+		slices = slices[:limit]
+	}
+	return slices
+}
+
+// runScript runs a script on a connection. The script reads the metadata of the connection and the rules of the
+// script matched by the connection from the global connection, and the matched slices from the global matches.
+func runScript(c context.Context, script compiledScript, connection Connection, rules []RowID,
+	matches []ScriptMatch) (ScriptResponse, error) {
+	timeout, instructions, memoryLimit := script.Timeout, script.InstructionsLimit, script.MemoryLimit
+	if timeout == 0 {
+		timeout = defaultScriptTimeout
+	}
+	if instructions == 0 {
+		instructions = defaultScriptInstructions
+	}
+	if memoryLimit == 0 {
+		memoryLimit = defaultScriptMemoryLimit
+	}
+	ctx, cancel := context.WithTimeout(c, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	var response ScriptResponse
+	globals := map[string]scripting.Value{
+		"connection": connectionTable(connection, rules),
+		"matches":    matchesTable(matches),
+		"tag": scripting.Function(func(arguments []scripting.Value) ([]scripting.Value, error) {
+			tag, isString := scriptArgument(arguments, 0).(string)
+			if !isString {
+				return nil, errors.New("bad argument #1 to 'tag' (string expected)")
+			} else if len(response.Tags) >= maxScriptResults {
+				return nil, errors.New("too many tags")
+			}
+			response.Tags = append(response.Tags, tag)
+			return nil, nil
+		}),
+		"extract": scripting.Function(func(arguments []scripting.Value) ([]scripting.Value, error) {
+			name, isString := scriptArgument(arguments, 0).(string)
+			if !isString {
+				return nil, errors.New("bad argument #1 to 'extract' (string expected)")
+			} else if len(response.Extractions) >= maxScriptResults {
+				return nil, errors.New("too many extractions")
+			}
+			response.Extractions = append(response.Extractions, ScriptExtraction{
+				Name:  name,
+				Value: scripting.ToString(scriptArgument(arguments, 1)),
+			})
+			return nil, nil
+		}),
+		"suppress": scripting.Function(func(arguments []scripting.Value) ([]scripting.Value, error) {
+			response.Suppress = true
+			return nil, nil
+		}),
+	}
+
+	err := script.program.Run(ctx, globals, scripting.Limits{
+		Instructions: int64(instructions),
+		Memory:       int64(memoryLimit) * 1024 * 1024,
+		Depth:        maxScriptDepth,
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ScriptResponse{}, fmt.Errorf("script timed out after %d seconds", timeout)
+	} else if err != nil {
+		return ScriptResponse{}, err
+	}
+	return response, nil
+}
+
+func connectionTable(connection Connection, rules []RowID) *scripting.Table {
+	table := scripting.NewTable()
+	table.Set("id", connection.ID.Hex())
+	table.Set("ip_src", connection.SourceIP)
+	table.Set("ip_dst", connection.DestinationIP)
+	table.Set("port_src", connection.SourcePort)
+	table.Set("port_dst", connection.DestinationPort)
+	table.Set("started_at", float64(connection.StartedAt.UnixNano())/float64(time.Second))
+	table.Set("closed_at", float64(connection.ClosedAt.UnixNano())/float64(time.Second))
+	table.Set("client_bytes", connection.ClientBytes)
+	table.Set("server_bytes", connection.ServerBytes)
+	table.Set("matched_rules", rowIDsTable(connection.MatchedRules))
+	table.Set("rules", rowIDsTable(rules))
+	return table
+}
+
+func matchesTable(matches []ScriptMatch) *scripting.Table {
+	table := scripting.NewTable()
+	for _, match := range matches {
+		entry := scripting.NewTable()
+		entry.Set("rule_id", match.RuleID.Hex())
+		entry.Set("from_client", match.FromClient)
+		entry.Set("from", match.From)
+		entry.Set("to", match.To)
+		entry.Set("payload", match.Payload)
+		table.Append(entry)
+	}
+	return table
+}
+
+func rowIDsTable(ids []RowID) *scripting.Table {
+	table := scripting.NewTable()
+	for _, id := range ids {
+		table.Append(id.Hex())
+	}
+	return table
+}
+
+func scriptArgument(arguments []scripting.Value, i int) scripting.Value {
+	if i < len(arguments) {
+		return arguments[i]
+	}
+	return nil
+}
+
+// newExtractions validates the fields extracted by a script. The fields without a name, or with a name or a value too
+// long, are discarded.
+func newExtractions(connection Connection, scriptID RowID, fields []ScriptExtraction) []Extraction {
+	extractedAt := time.Now()
+	extractions := make([]Extraction, 0, len(fields))
+	for _, field := range fields {
+		if field.Name == "" || len(field.Name) > maxExtractionNameLength ||
+			len(field.Value) > maxExtractionValueLength {
+			continue
+		}
+		extractions = append(extractions, Extraction{
+			ID:           NewRowID(),
+			ConnectionID: connection.ID,
+			ScriptID:     scriptID,
+			ServicePort:  connection.DestinationPort,
+			Name:         field.Name,
+			Value:        field.Value,
+			ExtractedAt:  extractedAt,
+		})
+	}
+	return extractions
+}
+
+// mergeTags adds the new tags to the tags of a connection. The tags are trimmed, and the empty, the duplicates and the
+// tags longer than 64 characters are discarded.
+func mergeTags(tags []string, newTags []string) []string {
+	presentTags := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		presentTags[tag] = true
+	}
+	for _, tag := range newTags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || len(tag) > 64 || presentTags[tag] {
+			continue
+		}
+		presentTags[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
@@ -0,0 +1,248 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/eciavatta/caronte/scripting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunScript(t *testing.T) {
+	ruleID := NewRowID()
+	connection := Connection{ID: NewRowID(), SourceIP: "10.10.10.1", DestinationPort: 8080,
+		MatchedRules: []RowID{ruleID}}
+	matches := []ScriptMatch{
+		{RuleID: ruleID, FromClient: true, From: 10, To: 20, Payload: []byte("flag_id=42")},
+		{RuleID: ruleID, FromClient: false, From: 5, To: 15, Payload: []byte("benign")},
+	}
+	script := compileScript(t, `
+		assert(connection.port_dst == 8080 and connection.rules[1] == connection.matched_rules[1])
+		for _, match in ipairs(matches) do
+			local id = regex.match(match.payload, "flag_id=(\\d+)")
+			if id and match.from_client then
+				extract("flag_id", id)
+				tag("flag-id")
+			end
+		end
+		if connection.ip_src:find("10.10.") == 1 then
+			tag(" team ")
+		end
+		if #matches > 1 then
+			suppress()
+		end
+	`)
+	response, err := runScript(context.Background(), script, connection, []RowID{ruleID}, matches)
+	require.NoError(t, err)
+	assert.Equal(t, ScriptResponse{Tags: []string{"flag-id", " team "}, Extractions: []ScriptExtraction{{
+		Name: "flag_id", Value: "42"}}, Suppress: true}, response)
+
+	response, err = runScript(context.Background(), compileScript(t, `tag(42)`), connection, nil, nil)
+	assert.Error(t, err)
+	response, err = runScript(context.Background(), compileScript(t, `error("failed")`), connection, nil, nil)
+	assert.EqualError(t, err, "line 1: failed")
+	for _, sandboxed := range []string{"os", "io", "require", "load", "dofile", "debug", "package"} {
+		_, err = runScript(context.Background(), compileScript(t, sandboxed+`.x()`), connection, nil, nil)
+		assert.Error(t, err, sandboxed)
+	}
+}
+
+func TestRunScriptLimits(t *testing.T) {
+	script := compileScript(t, `while true do end`)
+	script.InstructionsLimit = 10000
+	_, err := runScript(context.Background(), script, Connection{}, nil, nil)
+	assert.True(t, errors.Is(err, scripting.ErrInstructionsLimit))
+
+	script = compileScript(t, `local s = "x" for i = 1, 64 do s = s .. s end`)
+	script.MemoryLimit = 1
+	_, err = runScript(context.Background(), script, Connection{}, nil, nil)
+	assert.True(t, errors.Is(err, scripting.ErrMemoryLimit))
+
+	script = compileScript(t, `local t = {} for i = 1, 1000000 do t[i] = {} end`)
+	script.InstructionsLimit = 100000000
+	script.MemoryLimit = 1
+	_, err = runScript(context.Background(), script, Connection{}, nil, nil)
+	assert.True(t, errors.Is(err, scripting.ErrMemoryLimit))
+
+	script = compileScript(t, `string.rep("x", 1e12)`)
+	_, err = runScript(context.Background(), script, Connection{}, nil, nil)
+	assert.True(t, errors.Is(err, scripting.ErrMemoryLimit))
+
+	script = compileScript(t, `local function f(n) return f(n + 1) end f(1)`)
+	_, err = runScript(context.Background(), script, Connection{}, nil, nil)
+	assert.True(t, errors.Is(err, scripting.ErrDepthLimit))
+
+	script = compileScript(t, `for i = 1, 1000 do tag("tag" .. i) end`)
+	_, err = runScript(context.Background(), script, Connection{}, nil, nil)
+	assert.EqualError(t, err, "line 1: too many tags")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	script = compileScript(t, `while true do end`)
+	script.InstructionsLimit = 100000000
+	_, err = runScript(ctx, script, Connection{}, nil, nil)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestScriptResponseValidation(t *testing.T) {
+	assert.Equal(t, []string{"exploit", "ctf"}, mergeTags([]string{"exploit"},
+		[]string{" ctf ", "", "exploit", "ctf"}))
+
+	connection := Connection{ID: NewRowID(), DestinationPort: 8080}
+	scriptID := NewRowID()
+	extractions := newExtractions(connection, scriptID, []ScriptExtraction{
+		{Name: "flag_id", Value: "42"},
+		{Name: "", Value: "empty"},
+		{Name: "long", Value: string(make([]byte, maxExtractionValueLength+1))},
+	})
+	require.Len(t, extractions, 1)
+	assert.Equal(t, connection.ID, extractions[0].ConnectionID)
+	assert.Equal(t, scriptID, extractions[0].ScriptID)
+	assert.Equal(t, uint16(8080), extractions[0].ServicePort)
+	assert.Equal(t, "flag_id", extractions[0].Name)
+	assert.Equal(t, "42", extractions[0].Value)
+}
+
+func TestScriptsController(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+	wrapper.AddCollection(Scripts)
+	wrapper.AddCollection(Extractions)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	hideRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "noise", Color: "#fff",
+		Action: RuleActionHide, Patterns: []Pattern{{Regex: "noise", Direction: DirectionToServer}}})
+	require.NoError(t, err)
+	markRule, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "exploit", Color: "#fff",
+		Action: RuleActionMark, Patterns: []Pattern{{Regex: "exploit"}, {Regex: "benign", Negate: true}}})
+	require.NoError(t, err)
+
+	patterns := rulesManager.RulePatterns(markRule)
+	assert.Len(t, patterns, 1)
+	for _, direction := range patterns {
+		assert.Equal(t, uint8(DirectionBoth), direction)
+	}
+	assert.Nil(t, rulesManager.RulePatterns(NewRowID()))
+
+	connection := Connection{MatchedRules: []RowID{hideRule, markRule}, Hidden: true, Marked: true}
+	rulesManager.SuppressMatchedRules(&connection, []RowID{hideRule})
+	assert.Equal(t, []RowID{markRule}, connection.MatchedRules)
+	assert.False(t, connection.Hidden)
+	assert.True(t, connection.Marked)
+	// the flags not set by the suppressed rules are kept
+	connection = Connection{MatchedRules: []RowID{markRule}, Hidden: true, Marked: true}
+	rulesManager.SuppressMatchedRules(&connection, []RowID{markRule})
+	assert.Empty(t, connection.MatchedRules)
+	assert.True(t, connection.Hidden)
+	assert.False(t, connection.Marked)
+
+	scriptsController := NewScriptsController(wrapper.Storage, rulesManager, nil)
+	_, err = scriptsController.AddScript(wrapper.Context, Script{Name: "missing", Source: "suppress()",
+		RulesIDs: []RowID{NewRowID()}})
+	assert.Error(t, err)
+	_, err = scriptsController.AddScript(wrapper.Context, Script{Name: "invalid", Source: "suppress(",
+		RulesIDs: []RowID{markRule}})
+	assert.Error(t, err)
+	scriptID, err := scriptsController.AddScript(wrapper.Context, Script{Name: "flag_ids",
+		Source: `tag("exploit") extract("flag_id", #matches) suppress()`, RulesIDs: []RowID{markRule}, Enabled: true})
+	require.NoError(t, err)
+	_, err = scriptsController.AddScript(wrapper.Context, Script{Name: "flag_ids", Source: "suppress()",
+		RulesIDs: []RowID{markRule}})
+	assert.Error(t, err)
+
+	assert.Len(t, scriptsController.boundScripts([]RowID{markRule}), 1)
+	assert.Empty(t, scriptsController.boundScripts([]RowID{hideRule}))
+
+	// the connections are saved after the scripts have run
+	connection = Connection{ID: NewRowID(), MatchedRules: []RowID{hideRule, markRule}, Hidden: true, Marked: true,
+		Tags: []string{"manual"}}
+	var savedConnections []Connection
+	save := func(connection Connection) {
+		savedConnections = append(savedConnections, connection)
+	}
+	for i := 0; i < scriptsQueueSize; i++ {
+		assert.True(t, scriptsController.EnqueueHooks(connection, &StreamHandler{isClient: true}, &StreamHandler{},
+			save))
+	}
+	assert.False(t, scriptsController.EnqueueHooks(connection, &StreamHandler{isClient: true}, &StreamHandler{}, save))
+	assert.False(t, scriptsController.EnqueueHooks(Connection{MatchedRules: []RowID{hideRule}}, &StreamHandler{},
+		&StreamHandler{}, save), "the connections without scripts are saved by the caller")
+	status, _ := scriptsController.GetScript(scriptID)
+	assert.Equal(t, 1, status.Statistics.Dropped)
+	scriptsController.runHook(<-scriptsController.queue)
+	require.Len(t, savedConnections, 1)
+	assert.Equal(t, []string{"manual", "exploit"}, savedConnections[0].Tags)
+	assert.Equal(t, []RowID{hideRule}, savedConnections[0].MatchedRules)
+	assert.True(t, savedConnections[0].Hidden)
+	assert.False(t, savedConnections[0].Marked)
+	extractions := scriptsController.GetExtractions(wrapper.Context, ExtractionsFilter{ScriptID: scriptID.Hex()})
+	require.Len(t, extractions, 1)
+	assert.Equal(t, "0", extractions[0].Value)
+	status, _ = scriptsController.GetScript(scriptID)
+	assert.Equal(t, 1, status.Statistics.Runs)
+	assert.Equal(t, 1, status.Statistics.Suppressed)
+
+	// the connections still queued are saved without running the scripts
+	scriptsController.Stop()
+	require.Len(t, savedConnections, scriptsQueueSize)
+	assert.Equal(t, connection, savedConnections[scriptsQueueSize-1])
+	assert.False(t, scriptsController.EnqueueHooks(connection, &StreamHandler{}, &StreamHandler{}, save))
+	status, _ = scriptsController.GetScript(scriptID)
+	assert.Equal(t, 1, status.Statistics.Runs)
+
+	isPresent, err := scriptsController.UpdateScript(wrapper.Context, scriptID, Script{Name: "flag_ids",
+		Source: "suppress()", RulesIDs: []RowID{markRule}, Enabled: false})
+	require.NoError(t, err)
+	assert.True(t, isPresent)
+	assert.Empty(t, scriptsController.boundScripts([]RowID{markRule}))
+	isPresent, _ = scriptsController.UpdateScript(wrapper.Context, NewRowID(), Script{})
+	assert.False(t, isPresent)
+
+	otherController := NewScriptsController(wrapper.Storage, rulesManager, nil)
+	script, isPresent := otherController.GetScript(scriptID)
+	require.True(t, isPresent)
+	assert.Equal(t, "flag_ids", script.Name)
+	assert.Equal(t, "suppress()", script.Source)
+	assert.Len(t, otherController.GetScripts(), 1)
+
+	connectionID := NewRowID()
+	scriptsController.SaveExtractions(newExtractions(Connection{ID: connectionID}, scriptID,
+		[]ScriptExtraction{{Name: "flag_id", Value: "42"}, {Name: "flag_id", Value: "43"}}))
+	extractions = scriptsController.GetExtractions(wrapper.Context,
+		ExtractionsFilter{ConnectionID: connectionID.Hex()})
+	assert.Len(t, extractions, 2)
+	assert.Empty(t, scriptsController.GetExtractions(wrapper.Context,
+		ExtractionsFilter{ConnectionID: NewRowID().Hex()}))
+
+	assert.True(t, scriptsController.DeleteScript(wrapper.Context, scriptID))
+	assert.False(t, scriptsController.DeleteScript(wrapper.Context, scriptID))
+	assert.Empty(t, scriptsController.GetScripts())
+
+	wrapper.Destroy(t)
+}
+
+func compileScript(t *testing.T, source string) compiledScript {
+	program, err := scripting.Compile(source)
+	require.NoError(t, err)
+	return compiledScript{Script{Source: source}, program}
+}
@@ -40,6 +40,7 @@ type PerformedSearch struct {
 	FinishedAt               time.Time     `bson:"finished_at" json:"finished_at"`
 	UpdatedAt                time.Time     `bson:"updated_at" json:"updated_at"`
 	Timeout                  time.Duration `bson:"timeout" json:"timeout"`
+	Partial                  bool          `bson:"partial" json:"partial"`
 }
 
 type SearchOptions struct {
@@ -66,11 +67,12 @@ type RegexSearch struct {
 
 type SearchController struct {
 	storage           Storage
+	queryLimits       *QueryLimits
 	performedSearches []PerformedSearch
 	mutex             sync.Mutex
 }
 
-func NewSearchController(storage Storage) *SearchController {
+func NewSearchController(storage Storage, queryLimits *QueryLimits) *SearchController {
 	var searches []PerformedSearch
 	if err := storage.Find(Searches).Limit(maxRecentSearches).All(&searches); err != nil {
 		log.WithError(err).Panic("failed to retrieve performed searches")
@@ -82,6 +84,7 @@ func NewSearchController(storage Storage) *SearchController {
 
 	return &SearchController{
 		storage:           storage,
+		queryLimits:       queryLimits,
 		performedSearches: searches,
 	}
 }
@@ -107,6 +110,8 @@ func (sc *SearchController) GetPerformedSearch(id RowID) PerformedSearch {
 	return performedSearch
 }
 
+// PerformSearch finds the connections whose streams satisfy the search options. The search is stopped when the timeout
+// expires or when the maximum number of documents is reached, and in that case the search is marked as partial.
 func (sc *SearchController) PerformSearch(c context.Context, options SearchOptions) PerformedSearch {
 	findQuery := sc.storage.Find(ConnectionStreams).Projection(OrderedDocument{{"connection_id", 1}}).Context(c)
 	timeout := options.Timeout * secondsToNano
@@ -114,6 +119,10 @@ func (sc *SearchController) PerformSearch(c context.Context, options SearchOptio
 		timeout = maxSearchTimeout
 	}
 	findQuery = findQuery.MaxTime(timeout)
+	maxDocuments := sc.queryLimits.MaxDocuments()
+	if maxDocuments > 0 {
+		findQuery = findQuery.Limit(int64(maxDocuments) + 1)
+	}
 
 	if !options.TextSearch.isZero() {
 		var text string
@@ -160,9 +169,14 @@ func (sc *SearchController) PerformSearch(c context.Context, options SearchOptio
 
 	var connections []ConnectionStream
 	startedAt := time.Now()
-	if err := findQuery.All(&connections); err != nil {
+	partial, err := findQuery.AllPartial(&connections)
+	if err != nil {
 		log.WithError(err).Error("oh no")
 	}
+	if maxDocuments > 0 && len(connections) > maxDocuments {
+		connections = connections[:maxDocuments]
+		partial = true
+	}
 	affectedConnections := uniqueConnectionIds(connections)
 
 	finishedAt := time.Now()
@@ -175,6 +189,7 @@ func (sc *SearchController) PerformSearch(c context.Context, options SearchOptio
 		FinishedAt:               finishedAt,
 		UpdatedAt:                finishedAt,
 		Timeout:                  options.Timeout,
+		Partial:                  partial,
 	}
 	if _, err := sc.storage.Insert(Searches).Context(c).One(performedSearch); err != nil {
 		log.WithError(err).Panic("failed to insert a new performed search")
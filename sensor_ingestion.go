@@ -0,0 +1,763 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const sensorsSettingsKey = "sensors"
+
+var errEmptySensorsToken = errors.New("the token of the sensors can't be empty")
+
+const (
+	// sensorMaxFrameSize is the maximum size of a message sent by a sensor, without the length prefix
+	sensorMaxFrameSize = 256 * 1024
+	// sensorAckWindow is the maximum number of messages a sensor can send before waiting for an ack
+	sensorAckWindow       = 1024
+	sensorAckInterval     = sensorAckWindow / 2
+	sensorHelloTimeout    = 10 * time.Second
+	sensorMaxNameLength   = 64
+	sensorFlushInterval   = 10000
+	sensorConnectionsIdle = 2 * time.Minute
+)
+
+// protobuf field numbers of the messages described in sensor.proto
+const (
+	sensorMessageHello  protowire.Number = 1
+	sensorMessagePacket protowire.Number = 2
+	sensorMessageChunk  protowire.Number = 3
+)
+
+// SensorsSettings are the settings of the listener which receives the traffic of the remote sensors. Token is never
+// returned by the API, so it must be sent each time the settings are updated, and it is required when the listener is
+// enabled.
+type SensorsSettings struct {
+	Enabled       bool   `json:"enabled" bson:"enabled"`
+	ListenAddress string `json:"listen_address" binding:"required_if=Enabled true" bson:"listen_address"`
+	Token         string `json:"token,omitempty" binding:"required_if=Enabled true" bson:"token"`
+}
+
+type SensorStatus struct {
+	Name            string    `json:"name"`
+	Connected       bool      `json:"connected"`
+	RemoteAddress   string    `json:"remote_address"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	LastActivity    time.Time `json:"last_activity,omitempty"`
+	ReceivedPackets int64     `json:"received_packets"`
+	ReceivedChunks  int64     `json:"received_chunks"`
+	ReceivedBytes   int64     `json:"received_bytes"`
+	InvalidMessages int64     `json:"invalid_messages"`
+	LastError       string    `json:"last_error,omitempty"`
+}
+
+// SensorIngestion receives the packets captured by remote sensors, or the chunks of the streams already reassembled
+// by them, and processes them as the imported pcaps. The connections are tagged with the name of the sensor.
+type SensorIngestion struct {
+	storage                Storage
+	pcapImporter           *PcapImporter
+	notificationController *NotificationController
+	settings               SensorsSettings
+	sensors                map[string]*SensorStatus
+	cancelFunc             context.CancelFunc
+	stopped                chan struct{}
+	mutex                  sync.Mutex
+	// mSensors protects sensors and their values, which are updated by the connections of the sensors
+	mSensors sync.Mutex
+}
+
+func NewSensorIngestion(storage Storage, pcapImporter *PcapImporter,
+	notificationController *NotificationController) *SensorIngestion {
+	si := &SensorIngestion{
+		storage:                storage,
+		pcapImporter:           pcapImporter,
+		notificationController: notificationController,
+		sensors:                make(map[string]*SensorStatus),
+	}
+
+	if err := LoadSettings(storage, sensorsSettingsKey, &si.settings); err != nil {
+		log.WithError(err).Panic("failed to retrieve sensors settings")
+	}
+	if si.settings.Enabled {
+		if err := si.start(); err != nil {
+			log.WithError(err).WithField("address", si.settings.ListenAddress).Error("failed to listen for sensors")
+		}
+	}
+
+	return si
+}
+
+func (si *SensorIngestion) GetSettings() SensorsSettings {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+
+	settings := si.settings
+	settings.Token = ""
+	return settings
+}
+
+func (si *SensorIngestion) SetSettings(settings SensorsSettings) error {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+
+	if settings.Enabled && settings.Token == "" {
+		return errEmptySensorsToken
+	}
+	if err := SaveSettings(si.storage, sensorsSettingsKey, settings); err != nil {
+		return err
+	}
+
+	return si.apply(settings)
+}
+
+// ReloadSettings reads the settings again from the database, discarding the ones in memory. The listener is restarted
+// and the sensors connected must connect again.
+func (si *SensorIngestion) ReloadSettings() error {
+	var settings SensorsSettings
+	if err := LoadSettings(si.storage, sensorsSettingsKey, &settings); err != nil {
+		return err
+	}
+
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+
+	return si.apply(settings)
+}
+
+func (si *SensorIngestion) GetSensors() []SensorStatus {
+	si.mSensors.Lock()
+	defer si.mSensors.Unlock()
+
+	sensors := make([]SensorStatus, 0, len(si.sensors))
+	for _, status := range si.sensors {
+		sensors = append(sensors, *status)
+	}
+	sort.Slice(sensors, func(i, j int) bool {
+		return sensors[i].Name < sensors[j].Name
+	})
+	return sensors
+}
+
+// Stop closes the listener and the connections of the sensors, and waits the connections received until then to be
+// processed. It is used when shutting down.
+func (si *SensorIngestion) Stop() {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+
+	si.stop()
+}
+
+// apply must be called with the mutex held.
+func (si *SensorIngestion) apply(settings SensorsSettings) error {
+	if settings.Enabled && settings.Token == "" {
+		return errEmptySensorsToken
+	}
+	si.stop()
+	si.settings = settings
+	if !settings.Enabled {
+		return nil
+	}
+
+	return si.start()
+}
+
+// start must be called with the mutex held.
+func (si *SensorIngestion) start() error {
+	listener, err := net.Listen("tcp", si.settings.ListenAddress)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	si.cancelFunc = cancelFunc
+	si.stopped = make(chan struct{})
+	go si.serve(ctx, listener, si.settings.Token, si.stopped)
+
+	return nil
+}
+
+// stop must be called with the mutex held.
+func (si *SensorIngestion) stop() {
+	if si.cancelFunc == nil {
+		return
+	}
+
+	si.cancelFunc()
+	<-si.stopped
+	si.cancelFunc = nil
+}
+
+func (si *SensorIngestion) serve(ctx context.Context, listener net.Listener, token string, stopped chan struct{}) {
+	defer close(stopped)
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).Error("failed to accept sensor connections")
+				si.notificationController.Notify("sensors.error", gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			si.handleSensor(ctx, conn, token)
+		}()
+	}
+}
+
+// handleSensor receives the messages of a sensor until it disconnects. The messages are processed in the order they
+// are received and the sensor is acknowledged every sensorAckInterval messages: the sensors must not send more than
+// sensorAckWindow messages not acknowledged, so that they slow down if the packets are not processed fast enough.
+func (si *SensorIngestion) handleSensor(ctx context.Context, conn net.Conn, token string) {
+	connCtx, cancelConn := context.WithCancel(ctx)
+	defer cancelConn()
+	go func() {
+		<-connCtx.Done()
+		_ = conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	hello, err := si.receiveHello(conn, reader, token)
+	if err != nil {
+		log.WithError(err).WithField("client", conn.RemoteAddr()).Warn("sensor rejected")
+		_ = writeSensorFrame(conn, encodeSensorAck(sensorAck{Error: err.Error()}))
+		return
+	}
+	defer si.disconnected(hello.Sensor)
+	si.notificationController.Notify("sensors.connected", gin.H{"sensor": hello.Sensor})
+
+	session := &sensorSession{
+		importer:  si.pcapImporter,
+		sensor:    hello.Sensor,
+		assembler: si.pcapImporter.NewSensorAssembler(hello.Sensor),
+		linkType:  hello.LinkType,
+		chunks:    make(map[sensorChunkFlow]*sensorChunkState),
+	}
+	defer session.assembler.FlushAll()
+
+	if err := writeSensorFrame(conn, encodeSensorAck(sensorAck{Window: sensorAckWindow})); err != nil {
+		si.sensorError(hello.Sensor, err)
+		return
+	}
+
+	var received uint64
+	for {
+		frame, err := readSensorFrame(reader)
+		if err != nil {
+			if err != io.EOF && connCtx.Err() == nil {
+				si.sensorError(hello.Sensor, err)
+			}
+			return
+		}
+
+		message, err := decodeSensorMessage(frame)
+		if err == nil {
+			err = session.process(message)
+		}
+		si.updateSensor(hello.Sensor, func(status *SensorStatus) {
+			status.LastActivity = time.Now()
+			status.ReceivedBytes += int64(len(frame))
+			switch message.(type) {
+			case sensorPacket:
+				status.ReceivedPackets++
+			case sensorChunk:
+				status.ReceivedChunks++
+			}
+			if err != nil {
+				status.InvalidMessages++
+			}
+		})
+		if _, isHello := message.(sensorHello); isHello {
+			err = errors.New("sensor already identified")
+			_ = writeSensorFrame(conn, encodeSensorAck(sensorAck{Received: received, Error: err.Error()}))
+			si.sensorError(hello.Sensor, err)
+			return
+		}
+
+		received++
+		if received%sensorAckInterval == 0 {
+			if err := writeSensorFrame(conn, encodeSensorAck(sensorAck{Received: received})); err != nil {
+				si.sensorError(hello.Sensor, err)
+				return
+			}
+		}
+	}
+}
+
+// receiveHello reads the first message of a sensor, which must identify it, and registers the sensor.
+func (si *SensorIngestion) receiveHello(conn net.Conn, reader *bufio.Reader, token string) (sensorHello, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(sensorHelloTimeout)); err != nil {
+		return sensorHello{}, err
+	}
+	frame, err := readSensorFrame(reader)
+	if err != nil {
+		return sensorHello{}, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return sensorHello{}, err
+	}
+
+	message, err := decodeSensorMessage(frame)
+	if err != nil {
+		return sensorHello{}, err
+	}
+	hello, isHello := message.(sensorHello)
+	if !isHello {
+		return sensorHello{}, errors.New("the first message must be a hello")
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(hello.Token), []byte(token)) != 1 {
+		return sensorHello{}, errors.New("invalid token")
+	}
+	if hello.Sensor == "" || len(hello.Sensor) > sensorMaxNameLength {
+		return sensorHello{}, fmt.Errorf("the name of the sensor must have from 1 to %v characters",
+			sensorMaxNameLength)
+	}
+
+	si.mSensors.Lock()
+	defer si.mSensors.Unlock()
+	if status, isPresent := si.sensors[hello.Sensor]; isPresent && status.Connected {
+		return sensorHello{}, errors.New("sensor already connected")
+	}
+	si.sensors[hello.Sensor] = &SensorStatus{
+		Name:          hello.Sensor,
+		Connected:     true,
+		RemoteAddress: conn.RemoteAddr().String(),
+		ConnectedAt:   time.Now(),
+	}
+
+	return hello, nil
+}
+
+func (si *SensorIngestion) updateSensor(sensor string, update func(status *SensorStatus)) {
+	si.mSensors.Lock()
+	update(si.sensors[sensor])
+	si.mSensors.Unlock()
+}
+
+func (si *SensorIngestion) sensorError(sensor string, err error) {
+	log.WithError(err).WithField("sensor", sensor).Warn("sensor disconnected")
+	si.updateSensor(sensor, func(status *SensorStatus) {
+		status.LastError = err.Error()
+	})
+	si.notificationController.Notify("sensors.error", gin.H{"sensor": sensor, "error": err.Error()})
+}
+
+func (si *SensorIngestion) disconnected(sensor string) {
+	si.updateSensor(sensor, func(status *SensorStatus) {
+		status.Connected = false
+	})
+	si.notificationController.Notify("sensors.disconnected", gin.H{"sensor": sensor})
+}
+
+// sensorSession processes the messages of a connected sensor. The streams of the sensor are reassembled by its own
+// assembler, which is used only by the goroutine receiving the messages.
+type sensorSession struct {
+	importer  *PcapImporter
+	sensor    string
+	assembler *tcpassembly.Assembler
+	linkType  layers.LinkType
+	chunks    map[sensorChunkFlow]*sensorChunkState
+	processed int
+	newest    time.Time
+}
+
+// sensorChunkFlow identifies the streams sent as chunks. The addresses are the raw bytes of the ips.
+type sensorChunkFlow struct {
+	clientIP   string
+	serverIP   string
+	clientPort uint16
+	serverPort uint16
+}
+
+// sensorChunkState keeps the sequence numbers of the segments created from the chunks, for both the directions.
+type sensorChunkState struct {
+	seq   [2]uint32
+	ended [2]bool
+}
+
+func (s *sensorSession) process(message interface{}) error {
+	var err error
+	switch message := message.(type) {
+	case sensorPacket:
+		err = s.processPacket(message)
+	case sensorChunk:
+		err = s.processChunk(message)
+	default:
+		return nil
+	}
+
+	// the connections of the sensors are flushed using the time of the packets, which can be in the past
+	s.processed++
+	if s.processed%sensorFlushInterval == 0 {
+		s.assembler.FlushOlderThan(s.newest.Add(-sensorConnectionsIdle))
+	}
+	return err
+}
+
+func (s *sensorSession) processPacket(message sensorPacket) error {
+	packet := gopacket.NewPacket(message.Data, s.linkType, gopacket.NoCopy)
+	if echo, isEcho := parseICMPEcho(packet); isEcho {
+		if !s.importer.isServiceFlow(echo.netFlow) {
+			return errors.New("packet not directed to or from the server network")
+		}
+		if !s.importer.ingestionFilters.currentFilter().deniesAddress(s.importer.outsideAddress(echo.netFlow)) {
+			echo.timestamp = message.Timestamp
+			s.importer.updateNewestPacket(message.Timestamp)
+			s.importer.icmpHandler.Handle(echo, s.sensor)
+		}
+		return nil
+	}
+	if packet.NetworkLayer() == nil || packet.TransportLayer() == nil ||
+		packet.TransportLayer().LayerType() != layers.LayerTypeTCP {
+		return errors.New("not a tcp packet")
+	}
+	netFlow := packet.NetworkLayer().NetworkFlow()
+	if !s.importer.isServiceFlow(netFlow) {
+		return errors.New("packet not directed to or from the server network")
+	}
+	tcp := packet.TransportLayer().(*layers.TCP)
+	client, servicePort := net.IP(netFlow.Src().Raw()), uint16(tcp.DstPort)
+	if s.importer.serverNet.Contains(client) {
+		client, servicePort = netFlow.Dst().Raw(), uint16(tcp.SrcPort)
+	}
+	if s.importer.ingestionFilters.currentFilter().denies(client, servicePort) {
+		return nil
+	}
+
+	s.assemble(netFlow, tcp, message.Timestamp)
+	return nil
+}
+
+// processChunk converts a chunk in a tcp segment of the stream, so that the chunks are handled as the packets. The
+// first chunk of a stream opens the connection in both the directions, and the connection is closed after the last
+// chunk of both the directions.
+func (s *sensorSession) processChunk(message sensorChunk) error {
+	clientIP, serverIP := normalizeIP(message.ClientIP), normalizeIP(message.ServerIP)
+	if clientIP == nil || serverIP == nil || len(clientIP) != len(serverIP) {
+		return errors.New("invalid chunk addresses")
+	}
+	clientEndpoint, serverEndpoint := layers.NewIPEndpoint(clientIP), layers.NewIPEndpoint(serverIP)
+	clientFlow, _ := gopacket.FlowFromEndpoints(clientEndpoint, serverEndpoint)
+	if !s.importer.isServiceFlow(clientFlow) || s.importer.serverNet.Contains(clientIP) {
+		return errors.New("chunk not directed to the server network")
+	}
+	if s.importer.ingestionFilters.currentFilter().denies(clientIP, message.ServerPort) {
+		return nil
+	}
+
+	flow := sensorChunkFlow{string(clientIP), string(serverIP), message.ClientPort, message.ServerPort}
+	state, isPresent := s.chunks[flow]
+	if !isPresent {
+		state = &sensorChunkState{}
+		s.chunks[flow] = state
+		serverFlow := clientFlow.Reverse()
+		s.assemble(clientFlow, chunkSegment(message.ClientPort, message.ServerPort, 0, nil, true, false),
+			message.Timestamp)
+		s.assemble(serverFlow, chunkSegment(message.ServerPort, message.ClientPort, 0, nil, true, false),
+			message.Timestamp)
+		state.seq = [2]uint32{1, 1}
+	}
+
+	netFlow, srcPort, dstPort, direction := clientFlow, message.ClientPort, message.ServerPort, 0
+	if message.FromServer {
+		netFlow, srcPort, dstPort, direction = clientFlow.Reverse(), message.ServerPort, message.ClientPort, 1
+	}
+	if state.ended[direction] {
+		return errors.New("chunk received after the end of the stream")
+	}
+	if len(message.Data) > 0 {
+		s.assemble(netFlow, chunkSegment(srcPort, dstPort, state.seq[direction], message.Data, false, false),
+			message.Timestamp)
+		state.seq[direction] += uint32(len(message.Data))
+	}
+	if message.End {
+		s.assemble(netFlow, chunkSegment(srcPort, dstPort, state.seq[direction], nil, false, true), message.Timestamp)
+		state.seq[direction]++
+		state.ended[direction] = true
+		if state.ended[0] && state.ended[1] {
+			delete(s.chunks, flow)
+		}
+	}
+
+	return nil
+}
+
+func (s *sensorSession) assemble(netFlow gopacket.Flow, tcp *layers.TCP, timestamp time.Time) {
+	if timestamp.After(s.newest) {
+		s.newest = timestamp
+	}
+	s.importer.updateNewestPacket(timestamp)
+	s.assembler.AssembleWithTimestamp(netFlow, tcp, timestamp)
+}
+
+// chunkSegment creates the tcp segment carrying the data of a chunk. The segment is serialized and decoded again
+// because the assembler uses the ports set only when a segment is decoded.
+func chunkSegment(srcPort, dstPort uint16, seq uint32, data []byte, syn, fin bool) *layers.TCP {
+	segment := &layers.TCP{
+		SrcPort:    layers.TCPPort(srcPort),
+		DstPort:    layers.TCPPort(dstPort),
+		Seq:        seq,
+		SYN:        syn,
+		FIN:        fin,
+		ACK:        !syn,
+		PSH:        len(data) > 0,
+		Window:     65535,
+		DataOffset: 5,
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{}, segment, gopacket.Payload(data)); err != nil {
+		log.WithError(err).Panic("failed to serialize a chunk segment")
+	}
+
+	decoded := &layers.TCP{}
+	if err := decoded.DecodeFromBytes(buffer.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+		log.WithError(err).Panic("failed to decode a chunk segment")
+	}
+	return decoded
+}
+
+func normalizeIP(ip net.IP) net.IP {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4
+	}
+	if len(ip) == net.IPv6len {
+		return ip
+	}
+	return nil
+}
+
+type sensorHello struct {
+	Sensor   string
+	Token    string
+	LinkType layers.LinkType
+}
+
+type sensorPacket struct {
+	Timestamp time.Time
+	Data      []byte
+}
+
+type sensorChunk struct {
+	Timestamp  time.Time
+	ClientIP   net.IP
+	ClientPort uint16
+	ServerIP   net.IP
+	ServerPort uint16
+	FromServer bool
+	Data       []byte
+	End        bool
+}
+
+type sensorAck struct {
+	Received uint64
+	Error    string
+	Window   uint32
+}
+
+// readSensorFrame reads a message prefixed by its length, a 32 bit big endian integer.
+func readSensorFrame(reader io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > sensorMaxFrameSize {
+		return nil, fmt.Errorf("message of %v bytes exceeds the maximum size of %v bytes", size, sensorMaxFrameSize)
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+func writeSensorFrame(writer io.Writer, message []byte) error {
+	frame := make([]byte, 4, 4+len(message))
+	binary.BigEndian.PutUint32(frame, uint32(len(message)))
+	_, err := writer.Write(append(frame, message...))
+	return err
+}
+
+// decodeSensorMessage decodes a SensorMessage, returning the message it contains: a sensorHello, a sensorPacket or a
+// sensorChunk.
+func decodeSensorMessage(frame []byte) (interface{}, error) {
+	var message interface{}
+	err := consumeProtoFields(frame, func(number protowire.Number, _ uint64, value []byte) error {
+		var err error
+		switch number {
+		case sensorMessageHello:
+			message, err = decodeSensorHello(value)
+		case sensorMessagePacket:
+			message, err = decodeSensorPacket(value)
+		case sensorMessageChunk:
+			message, err = decodeSensorChunk(value)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if message == nil {
+		return nil, errors.New("empty sensor message")
+	}
+
+	return message, nil
+}
+
+func decodeSensorHello(data []byte) (sensorHello, error) {
+	var hello sensorHello
+	err := consumeProtoFields(data, func(number protowire.Number, varint uint64, value []byte) error {
+		switch number {
+		case 1:
+			hello.Sensor = string(value)
+		case 2:
+			hello.Token = string(value)
+		case 3:
+			hello.LinkType = layers.LinkType(varint)
+		}
+		return nil
+	})
+	if err == nil && hello.LinkType == 0 {
+		hello.LinkType = layers.LinkTypeEthernet
+	}
+	return hello, err
+}
+
+func decodeSensorPacket(data []byte) (sensorPacket, error) {
+	var packet sensorPacket
+	err := consumeProtoFields(data, func(number protowire.Number, varint uint64, value []byte) error {
+		switch number {
+		case 1:
+			packet.Timestamp = time.Unix(0, int64(varint))
+		case 2:
+			packet.Data = value
+		}
+		return nil
+	})
+	return packet, err
+}
+
+func decodeSensorChunk(data []byte) (sensorChunk, error) {
+	var chunk sensorChunk
+	err := consumeProtoFields(data, func(number protowire.Number, varint uint64, value []byte) error {
+		switch number {
+		case 1:
+			chunk.Timestamp = time.Unix(0, int64(varint))
+		case 2:
+			chunk.ClientIP = value
+		case 3:
+			chunk.ClientPort = uint16(varint)
+		case 4:
+			chunk.ServerIP = value
+		case 5:
+			chunk.ServerPort = uint16(varint)
+		case 6:
+			chunk.FromServer = varint != 0
+		case 7:
+			chunk.Data = value
+		case 8:
+			chunk.End = varint != 0
+		}
+		return nil
+	})
+	return chunk, err
+}
+
+func encodeSensorAck(ack sensorAck) []byte {
+	var message []byte
+	if ack.Received > 0 {
+		message = protowire.AppendTag(message, 1, protowire.VarintType)
+		message = protowire.AppendVarint(message, ack.Received)
+	}
+	if ack.Error != "" {
+		message = protowire.AppendTag(message, 2, protowire.BytesType)
+		message = protowire.AppendString(message, ack.Error)
+	}
+	if ack.Window > 0 {
+		message = protowire.AppendTag(message, 3, protowire.VarintType)
+		message = protowire.AppendVarint(message, uint64(ack.Window))
+	}
+	return message
+}
+
+// consumeProtoFields calls handle for each field of a protobuf message. The value of the varint fields is passed in
+// varint, the value of the length-delimited fields in bytes. The fields of the other types are skipped.
+func consumeProtoFields(message []byte, handle func(number protowire.Number, varint uint64, bytes []byte) error) error {
+	for len(message) > 0 {
+		number, fieldType, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		message = message[n:]
+
+		var err error
+		switch fieldType {
+		case protowire.VarintType:
+			var value uint64
+			if value, n = protowire.ConsumeVarint(message); n >= 0 {
+				err = handle(number, value, nil)
+			}
+		case protowire.BytesType:
+			var value []byte
+			if value, n = protowire.ConsumeBytes(message); n >= 0 {
+				err = handle(number, 0, value)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(number, fieldType, message)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err != nil {
+			return err
+		}
+		message = message[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestSensorFrames(t *testing.T) {
+	var buffer bytes.Buffer
+	require.NoError(t, writeSensorFrame(&buffer, []byte("first")))
+	require.NoError(t, writeSensorFrame(&buffer, []byte{}))
+
+	frame, err := readSensorFrame(&buffer)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("first"), frame)
+	frame, err = readSensorFrame(&buffer)
+	require.NoError(t, err)
+	assert.Len(t, frame, 0)
+	_, err = readSensorFrame(&buffer)
+	assert.Equal(t, io.EOF, err)
+
+	buffer.Write([]byte{0, 0, 0, 10, 1, 2})
+	_, err = readSensorFrame(&buffer)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], sensorMaxFrameSize+1)
+	_, err = readSensorFrame(bytes.NewReader(length[:]))
+	assert.Error(t, err)
+}
+
+func TestDecodeSensorMessages(t *testing.T) {
+	var hello []byte
+	hello = protowire.AppendTag(hello, 1, protowire.BytesType)
+	hello = protowire.AppendString(hello, "sensor-1")
+	hello = protowire.AppendTag(hello, 2, protowire.BytesType)
+	hello = protowire.AppendString(hello, "token")
+	hello = protowire.AppendTag(hello, 99, protowire.Fixed32Type) // unknown fields are skipped
+	hello = protowire.AppendFixed32(hello, 42)
+	message, err := decodeSensorMessage(wrapSensorMessage(sensorMessageHello, hello))
+	require.NoError(t, err)
+	assert.Equal(t, sensorHello{Sensor: "sensor-1", Token: "token", LinkType: layers.LinkTypeEthernet}, message)
+
+	timestamp := time.Unix(1600000000, 123456789)
+	var packet []byte
+	packet = protowire.AppendTag(packet, 1, protowire.VarintType)
+	packet = protowire.AppendVarint(packet, uint64(timestamp.UnixNano()))
+	packet = protowire.AppendTag(packet, 2, protowire.BytesType)
+	packet = protowire.AppendBytes(packet, []byte{1, 2, 3})
+	message, err = decodeSensorMessage(wrapSensorMessage(sensorMessagePacket, packet))
+	require.NoError(t, err)
+	assert.Equal(t, sensorPacket{Timestamp: timestamp, Data: []byte{1, 2, 3}}, message)
+
+	var chunk []byte
+	chunk = protowire.AppendTag(chunk, 2, protowire.BytesType)
+	chunk = protowire.AppendBytes(chunk, []byte{10, 0, 0, 1})
+	chunk = protowire.AppendTag(chunk, 3, protowire.VarintType)
+	chunk = protowire.AppendVarint(chunk, 40000)
+	chunk = protowire.AppendTag(chunk, 5, protowire.VarintType)
+	chunk = protowire.AppendVarint(chunk, 8080)
+	chunk = protowire.AppendTag(chunk, 6, protowire.VarintType)
+	chunk = protowire.AppendVarint(chunk, 1)
+	message, err = decodeSensorMessage(wrapSensorMessage(sensorMessageChunk, chunk))
+	require.NoError(t, err)
+	decodedChunk := message.(sensorChunk)
+	assert.Equal(t, net.IP{10, 0, 0, 1}, decodedChunk.ClientIP)
+	assert.Equal(t, uint16(40000), decodedChunk.ClientPort)
+	assert.Equal(t, uint16(8080), decodedChunk.ServerPort)
+	assert.True(t, decodedChunk.FromServer)
+	assert.False(t, decodedChunk.End)
+
+	_, err = decodeSensorMessage(nil)
+	assert.Error(t, err)
+	_, err = decodeSensorMessage([]byte{0x0a, 0x05, 0x01})
+	assert.Error(t, err)
+}
+
+func TestEncodeSensorAck(t *testing.T) {
+	ack := encodeSensorAck(sensorAck{Received: 512, Error: "invalid token", Window: sensorAckWindow})
+
+	decoded := sensorAck{}
+	err := consumeProtoFields(ack, func(number protowire.Number, varint uint64, value []byte) error {
+		switch number {
+		case 1:
+			decoded.Received = varint
+		case 2:
+			decoded.Error = string(value)
+		case 3:
+			decoded.Window = uint32(varint)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, sensorAck{Received: 512, Error: "invalid token", Window: sensorAckWindow}, decoded)
+	assert.Len(t, encodeSensorAck(sensorAck{}), 0)
+}
+
+func TestChunkSegment(t *testing.T) {
+	segment := chunkSegment(40000, 8080, 1, []byte("payload"), false, false)
+	assert.Equal(t, layers.TCPPort(40000), segment.SrcPort)
+	assert.Equal(t, layers.TCPPort(8080), segment.DstPort)
+	assert.Equal(t, uint32(1), segment.Seq)
+	assert.Equal(t, []byte("payload"), segment.Payload)
+	assert.True(t, segment.ACK)
+	assert.True(t, segment.PSH)
+	assert.False(t, segment.SYN)
+	assert.Equal(t, "40000", segment.TransportFlow().Src().String())
+	assert.Equal(t, "8080", segment.TransportFlow().Dst().String())
+
+	segment = chunkSegment(8080, 40000, 0, nil, true, false)
+	assert.True(t, segment.SYN)
+	assert.False(t, segment.ACK)
+	assert.Len(t, segment.Payload, 0)
+
+	assert.Equal(t, net.IP{10, 0, 0, 1}, normalizeIP(net.ParseIP("10.0.0.1")))
+	assert.Len(t, normalizeIP(net.ParseIP("fd00::1")), net.IPv6len)
+	assert.Nil(t, normalizeIP(net.IP{1, 2, 3}))
+}
+
+func TestReceiveHelloToken(t *testing.T) {
+	receiveHello := func(sensorToken, token string) error {
+		var hello []byte
+		hello = protowire.AppendTag(hello, 1, protowire.BytesType)
+		hello = protowire.AppendString(hello, "sensor-1")
+		hello = protowire.AppendTag(hello, 2, protowire.BytesType)
+		hello = protowire.AppendString(hello, sensorToken)
+
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		go func() {
+			_ = writeSensorFrame(client, wrapSensorMessage(sensorMessageHello, hello))
+		}()
+		si := &SensorIngestion{sensors: make(map[string]*SensorStatus)}
+		_, err := si.receiveHello(server, bufio.NewReader(server), token)
+		return err
+	}
+
+	assert.NoError(t, receiveHello("token", "token"))
+	assert.Error(t, receiveHello("other", "token"))
+	assert.Error(t, receiveHello("", "")) // a listener without token never accepts the sensors
+}
+
+func wrapSensorMessage(number protowire.Number, message []byte) []byte {
+	wrapped := protowire.AppendTag(nil, number, protowire.BytesType)
+	return protowire.AppendBytes(wrapped, message)
+}
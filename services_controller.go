@@ -20,16 +20,39 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type Service struct {
-	Port  uint16 `json:"port" bson:"_id"`
-	Name  string `json:"name" binding:"min=3" bson:"name"`
-	Color string `json:"color" binding:"hexcolor" bson:"color"`
-	Notes string `json:"notes" bson:"notes"`
+	Port             uint16           `json:"port" bson:"_id"`
+	Name             string           `json:"name" binding:"min=3" bson:"name"`
+	Color            string           `json:"color" binding:"hexcolor" bson:"color"`
+	Notes            string           `json:"notes" bson:"notes"`
+	RepositoryURL    string           `json:"repository_url" binding:"omitempty,url" bson:"repository_url,omitempty"`
+	Handlers         []ServiceHandler `json:"handlers,omitempty" binding:"-" bson:"handlers,omitempty"`
+	GoldenConnection *RowID           `json:"golden_connection,omitempty" binding:"-" bson:"golden_connection,omitempty"`
+}
+
+// ServiceHandler associates an endpoint of a service to the source file which handles it. Method is empty if the
+// handler accepts all the methods. Path segments starting with : or enclosed in {} match any value, and a path
+// ending with * matches all the paths with the same prefix. Handler is a path relative to the repository,
+// optionally followed by :line (e.g. app/auth.py:42).
+type ServiceHandler struct {
+	Method  string `json:"method,omitempty" bson:"method,omitempty"`
+	Path    string `json:"path" bson:"path"`
+	Handler string `json:"handler" bson:"handler"`
+}
+
+// HandlerAnnotation is the handler of a request found in the connection messages.
+type HandlerAnnotation struct {
+	ServiceHandler
+	SourceURL string `json:"source_url,omitempty"`
 }
 
 type ServicesController struct {
@@ -59,6 +82,12 @@ func NewServicesController(storage Storage) *ServicesController {
 func (sc *ServicesController) SetService(c context.Context, service Service) error {
 	sc.mutex.Lock()
 	defer sc.mutex.Unlock()
+	if service.Handlers == nil { // the handlers are changed only by SetServiceHandlers
+		service.Handlers = sc.services[service.Port].Handlers
+	}
+	if service.GoldenConnection == nil { // the golden connection is changed only by SetGoldenConnection
+		service.GoldenConnection = sc.services[service.Port].GoldenConnection
+	}
 	var upsert interface{}
 	updated, err := sc.storage.Update(Services).Context(c).Filter(OrderedDocument{{"_id", service.Port}}).
 		Upsert(&upsert).One(service)
@@ -93,3 +122,148 @@ func (sc *ServicesController) DeleteService(c context.Context, service Service)
 		return nil
 	}
 }
+
+// SetServiceHandlers replaces the handlers of the service on port. Endpoints is a map from the endpoints, in the
+// form "[METHOD ]/path", to the handlers. Returns false if the service does not exist.
+func (sc *ServicesController) SetServiceHandlers(c context.Context, port uint16,
+	endpoints map[string]string) (bool, error) {
+	handlers, err := parseServiceHandlers(endpoints)
+	if err != nil {
+		return false, err
+	}
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	service, isPresent := sc.services[port]
+	if !isPresent {
+		return false, nil
+	}
+
+	if _, err := sc.storage.Update(Services).Context(c).Filter(OrderedDocument{{"_id", port}}).
+		One(UnorderedDocument{"handlers": handlers}); err != nil {
+		log.WithError(err).WithField("port", port).Panic("failed to update service handlers")
+	}
+	service.Handlers = handlers
+	sc.services[port] = service
+	return true, nil
+}
+
+// SetGoldenConnection sets the connection used as baseline for the diffs of the connections of the service on port,
+// or removes it if connectionID is nil. Returns false if the service does not exist.
+func (sc *ServicesController) SetGoldenConnection(c context.Context, port uint16, connectionID *RowID) bool {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	service, isPresent := sc.services[port]
+	if !isPresent {
+		return false
+	}
+
+	update := UnorderedDocument{"$set": UnorderedDocument{"golden_connection": connectionID}}
+	if connectionID == nil {
+		update = UnorderedDocument{"$unset": UnorderedDocument{"golden_connection": ""}}
+	}
+	if _, err := sc.storage.Update(Services).Context(c).Filter(OrderedDocument{{"_id", port}}).
+		OneComplex(update); err != nil {
+		log.WithError(err).WithField("port", port).Panic("failed to update the service golden connection")
+	}
+	service.GoldenConnection = connectionID
+	sc.services[port] = service
+	return true
+}
+
+// FindHandler returns the handler of the request with method and requestURL, with the link to the source file if
+// the repository of the service is set. If more handlers match, the one with the longest path is returned.
+func (s Service) FindHandler(method, requestURL string) (HandlerAnnotation, bool) {
+	parsedURL, err := url.Parse(requestURL)
+	if err != nil {
+		return HandlerAnnotation{}, false
+	}
+
+	var found *ServiceHandler
+	for i, handler := range s.Handlers {
+		if handler.Method != "" && !strings.EqualFold(handler.Method, method) {
+			continue
+		}
+		if !matchEndpointPath(handler.Path, parsedURL.Path) {
+			continue
+		}
+		if found == nil || len(handler.Path) > len(found.Path) {
+			found = &s.Handlers[i]
+		}
+	}
+	if found == nil {
+		return HandlerAnnotation{}, false
+	}
+
+	annotation := HandlerAnnotation{ServiceHandler: *found}
+	if s.RepositoryURL != "" {
+		file, line := found.Handler, ""
+		if index := strings.LastIndexByte(file, ':'); index > 0 {
+			file, line = file[:index], file[index+1:]
+		}
+		annotation.SourceURL = strings.TrimSuffix(s.RepositoryURL, "/") + "/" + strings.TrimPrefix(file, "/")
+		if line != "" {
+			annotation.SourceURL += "#L" + line
+		}
+	}
+	return annotation, true
+}
+
+func parseServiceHandlers(endpoints map[string]string) ([]ServiceHandler, error) {
+	handlers := make([]ServiceHandler, 0, len(endpoints))
+	for endpoint, handler := range endpoints {
+		var method, path string
+		if fields := strings.Fields(endpoint); len(fields) == 1 {
+			path = fields[0]
+		} else if len(fields) == 2 {
+			method, path = strings.ToUpper(fields[0]), fields[1]
+		} else {
+			return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+		}
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid endpoint %q: path must start with /", endpoint)
+		}
+		if strings.TrimSpace(handler) == "" {
+			return nil, fmt.Errorf("empty handler for endpoint %q", endpoint)
+		}
+		handlers = append(handlers, ServiceHandler{Method: method, Path: path, Handler: strings.TrimSpace(handler)})
+	}
+
+	sort.Slice(handlers, func(i, j int) bool {
+		if handlers[i].Path == handlers[j].Path {
+			return handlers[i].Method < handlers[j].Method
+		}
+		return handlers[i].Path < handlers[j].Path
+	})
+	return handlers, nil
+}
+
+func matchEndpointPath(pattern, path string) bool {
+	isPrefix := strings.HasSuffix(pattern, "*")
+	if isPrefix {
+		pattern = strings.TrimSuffix(pattern, "*")
+	} else {
+		pattern, path = strings.TrimSuffix(pattern, "/"), strings.TrimSuffix(path, "/")
+	}
+
+	patternSegments := strings.Split(pattern, "/")
+	pathSegments := strings.Split(path, "/")
+	if len(pathSegments) < len(patternSegments) || !isPrefix && len(pathSegments) != len(patternSegments) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		isParameter := strings.HasPrefix(segment, ":") ||
+			strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+		if isParameter && pathSegments[i] != "" {
+			continue
+		}
+		if isPrefix && i == len(patternSegments)-1 { // the last segment before * can be partial
+			if !strings.HasPrefix(pathSegments[i], segment) {
+				return false
+			}
+		} else if segment != pathSegments[i] {
+			return false
+		}
+	}
+	return true
+}
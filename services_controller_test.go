@@ -0,0 +1,112 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindServiceHandler(t *testing.T) {
+	handlers, err := parseServiceHandlers(map[string]string{
+		"/":                  "app/main.py:10",
+		"post /login":        "app/auth.py:42",
+		"/users/:id/profile": "app/users.py:7",
+		"/api/{version}/*":   "app/api/router.py",
+		"/static/*":          "app/static.py",
+	})
+	require.NoError(t, err)
+	service := Service{Port: 80, Name: "web", RepositoryURL: "https://git.example.com/team/web/", Handlers: handlers}
+
+	findHandler := func(method, requestURL string) string {
+		annotation, isPresent := service.FindHandler(method, requestURL)
+		if !isPresent {
+			return ""
+		}
+		return annotation.Handler
+	}
+	assert.Equal(t, "app/main.py:10", findHandler("GET", "/"))
+	assert.Equal(t, "app/auth.py:42", findHandler("POST", "/login?next=/"))
+	assert.Equal(t, "", findHandler("GET", "/login"))
+	assert.Equal(t, "app/users.py:7", findHandler("GET", "/users/1337/profile/"))
+	assert.Equal(t, "", findHandler("GET", "/users//profile"))
+	assert.Equal(t, "app/api/router.py", findHandler("DELETE", "/api/v2/notes/1"))
+	assert.Equal(t, "app/static.py", findHandler("GET", "http://web/static/style.css"))
+	assert.Equal(t, "", findHandler("GET", "/static"))
+
+	annotation, isPresent := service.FindHandler("POST", "/login")
+	require.True(t, isPresent)
+	assert.Equal(t, "POST", annotation.Method)
+	assert.Equal(t, "https://git.example.com/team/web/app/auth.py#L42", annotation.SourceURL)
+
+	_, err = parseServiceHandlers(map[string]string{"login": "app/auth.py"})
+	assert.Error(t, err)
+	_, err = parseServiceHandlers(map[string]string{"/login": " "})
+	assert.Error(t, err)
+}
+
+func TestSetServiceHandlers(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Services)
+
+	servicesController := NewServicesController(wrapper.Storage)
+	found, err := servicesController.SetServiceHandlers(wrapper.Context, 80, map[string]string{"/": "main.go"})
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	require.NoError(t, servicesController.SetService(wrapper.Context, Service{Port: 80, Name: "web", Color: "#fff"}))
+	found, err = servicesController.SetServiceHandlers(wrapper.Context, 80, map[string]string{"/": "main.go"})
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	// the handlers are kept when the other properties of the service change
+	require.NoError(t, servicesController.SetService(wrapper.Context, Service{Port: 80, Name: "website",
+		Color: "#fff", RepositoryURL: "https://git.example.com/web"}))
+	expected := []ServiceHandler{{Path: "/", Handler: "main.go"}}
+	assert.Equal(t, expected, servicesController.GetServices()[80].Handlers)
+	assert.Equal(t, expected, NewServicesController(wrapper.Storage).GetServices()[80].Handlers)
+
+	wrapper.Destroy(t)
+}
+
+func TestSetGoldenConnection(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Services)
+
+	servicesController := NewServicesController(wrapper.Storage)
+	goldenID := NewRowID()
+	assert.False(t, servicesController.SetGoldenConnection(wrapper.Context, 80, &goldenID))
+
+	require.NoError(t, servicesController.SetService(wrapper.Context, Service{Port: 80, Name: "web", Color: "#fff"}))
+	assert.True(t, servicesController.SetGoldenConnection(wrapper.Context, 80, &goldenID))
+
+	// the golden connection is kept when the other properties of the service change
+	require.NoError(t, servicesController.SetService(wrapper.Context, Service{Port: 80, Name: "website",
+		Color: "#fff"}))
+	require.NotNil(t, servicesController.GetServices()[80].GoldenConnection)
+	assert.Equal(t, goldenID, *servicesController.GetServices()[80].GoldenConnection)
+	assert.Equal(t, goldenID, *NewServicesController(wrapper.Storage).GetServices()[80].GoldenConnection)
+
+	assert.True(t, servicesController.SetGoldenConnection(wrapper.Context, 80, nil))
+	assert.Nil(t, servicesController.GetServices()[80].GoldenConnection)
+	assert.Nil(t, NewServicesController(wrapper.Storage).GetServices()[80].GoldenConnection)
+
+	wrapper.Destroy(t)
+}
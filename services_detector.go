@@ -0,0 +1,271 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const servicesDetectionSettingsKey = "services_detection"
+
+// detectionPrefixSize is the number of bytes at the beginning of each stream used to recognize the protocol
+const detectionPrefixSize = 512
+
+var httpMethods = [][]byte{[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE ")}
+
+var protocolsColors = map[string]string{
+	"http": "#1e88e5",
+	"ssh":  "#43a047",
+	"tls":  "#8e24aa",
+	"ftp":  "#fb8c00",
+	"smtp": "#00897b",
+}
+
+type ServicesDetectionSettings struct {
+	Enabled bool `json:"enabled" bson:"enabled"`
+}
+
+// ServicesDetector recognizes the protocol of the connections directed to ports not yet registered as services and
+// creates the services automatically, with a suggested name that can be changed by the users.
+type ServicesDetector struct {
+	storage                Storage
+	servicesController     *ServicesController
+	notificationController *NotificationController
+	settings               ServicesDetectionSettings
+	examinedPorts          map[uint16]bool
+	mutex                  sync.Mutex
+}
+
+func NewServicesDetector(storage Storage, servicesController *ServicesController,
+	notificationController *NotificationController) *ServicesDetector {
+	detector := &ServicesDetector{
+		storage:                storage,
+		servicesController:     servicesController,
+		notificationController: notificationController,
+		settings:               ServicesDetectionSettings{Enabled: true},
+		examinedPorts:          make(map[uint16]bool),
+	}
+
+	if err := LoadSettings(storage, servicesDetectionSettingsKey, &detector.settings); err != nil {
+		log.WithError(err).Panic("failed to retrieve services detection settings")
+	}
+
+	return detector
+}
+
+func (sd *ServicesDetector) GetSettings() ServicesDetectionSettings {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+
+	return sd.settings
+}
+
+func (sd *ServicesDetector) SetSettings(settings ServicesDetectionSettings) error {
+	if err := SaveSettings(sd.storage, servicesDetectionSettingsKey, settings); err != nil {
+		return err
+	}
+
+	sd.mutex.Lock()
+	sd.settings = settings
+	sd.examinedPorts = make(map[uint16]bool)
+	sd.mutex.Unlock()
+
+	return nil
+}
+
+// ReloadSettings reads the settings again from the database, discarding the ones in memory.
+func (sd *ServicesDetector) ReloadSettings() error {
+	settings := ServicesDetectionSettings{Enabled: true}
+	if err := LoadSettings(sd.storage, servicesDetectionSettingsKey, &settings); err != nil {
+		return err
+	}
+
+	sd.mutex.Lock()
+	sd.settings = settings
+	sd.mutex.Unlock()
+
+	return nil
+}
+
+// Detect examines the first bytes of the client and the server streams of a connection and, if the protocol is
+// recognized and the service port is not registered yet, creates a new service. Each port is examined until a
+// protocol is recognized, then the following connections are ignored.
+func (sd *ServicesDetector) Detect(connection Connection, clientPrefix, serverPrefix []byte) {
+	servicePort := connection.DestinationPort
+
+	sd.mutex.Lock()
+	if !sd.settings.Enabled || sd.examinedPorts[servicePort] {
+		sd.mutex.Unlock()
+		return
+	}
+	sd.mutex.Unlock()
+
+	if _, isPresent := sd.servicesController.GetServices()[servicePort]; isPresent {
+		sd.setExamined(servicePort)
+		return
+	}
+
+	protocol, details := detectProtocol(clientPrefix, serverPrefix)
+	if protocol == "" {
+		return
+	}
+	sd.setExamined(servicePort)
+
+	notes := fmt.Sprintf("Detected automatically: %s", protocol)
+	if details != "" {
+		notes = fmt.Sprintf("%s (%s)", notes, details)
+	}
+	service := Service{
+		Port:  servicePort,
+		Name:  fmt.Sprintf("%s-%d", protocol, servicePort),
+		Color: protocolsColors[protocol],
+		Notes: notes,
+	}
+	if err := sd.servicesController.SetService(context.Background(), service); err != nil {
+		log.WithError(err).WithField("service", service).Warn("failed to create detected service")
+		return
+	}
+
+	log.WithField("service", service).Info("new service detected")
+	if sd.notificationController != nil {
+		sd.notificationController.Notify("services.edit", service)
+	}
+}
+
+func (sd *ServicesDetector) setExamined(port uint16) {
+	sd.mutex.Lock()
+	sd.examinedPorts[port] = true
+	sd.mutex.Unlock()
+}
+
+// detectProtocol returns the name of the protocol recognized from the first bytes of the streams, and optionally
+// some details extracted from the protocol, such as the TLS server name or the SSH banner.
+func detectProtocol(clientPrefix, serverPrefix []byte) (string, string) {
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(clientPrefix, method) && bytes.Contains(firstLine(clientPrefix), []byte(" HTTP/1.")) {
+			return "http", ""
+		}
+	}
+	if bytes.HasPrefix(serverPrefix, []byte("HTTP/1.")) {
+		return "http", ""
+	}
+
+	if bytes.HasPrefix(serverPrefix, []byte("SSH-")) {
+		return "ssh", string(bytes.TrimSpace(firstLine(serverPrefix)))
+	}
+	if bytes.HasPrefix(clientPrefix, []byte("SSH-")) {
+		return "ssh", string(bytes.TrimSpace(firstLine(clientPrefix)))
+	}
+
+	if serverName, isTLS := parseTLSClientHello(clientPrefix); isTLS {
+		if serverName != "" {
+			return "tls", fmt.Sprintf("SNI %s", serverName)
+		}
+		return "tls", ""
+	}
+
+	if bytes.HasPrefix(serverPrefix, []byte("220")) {
+		banner := bytes.ToUpper(firstLine(serverPrefix))
+		if bytes.Contains(banner, []byte("SMTP")) {
+			return "smtp", ""
+		}
+		if bytes.Contains(banner, []byte("FTP")) {
+			return "ftp", ""
+		}
+	}
+	if bytes.HasPrefix(clientPrefix, []byte("EHLO ")) || bytes.HasPrefix(clientPrefix, []byte("HELO ")) {
+		return "smtp", ""
+	}
+	if bytes.HasPrefix(serverPrefix, []byte("220")) &&
+		(bytes.HasPrefix(clientPrefix, []byte("USER ")) || bytes.HasPrefix(clientPrefix, []byte("AUTH TLS"))) {
+		return "ftp", ""
+	}
+
+	return "", ""
+}
+
+func firstLine(data []byte) []byte {
+	if index := bytes.IndexByte(data, '\n'); index >= 0 {
+		return data[:index]
+	}
+	return data
+}
+
+// parseTLSClientHello checks if data starts with a TLS handshake record containing a ClientHello and returns the
+// server name indication, if present. The record may be truncated, in which case the server name may be missing.
+func parseTLSClientHello(data []byte) (string, bool) {
+	// record header: content type (handshake), version, length; handshake header: type (client hello), length
+	if len(data) < 9 || data[0] != 0x16 || data[1] != 0x03 || data[5] != 0x01 {
+		return "", false
+	}
+
+	cursor := 9 + 2 + 32 // client version and random
+	readLength := func(size int) (int, bool) {
+		if cursor+size > len(data) {
+			return 0, false
+		}
+		var length int
+		for i := 0; i < size; i++ {
+			length = length<<8 | int(data[cursor+i])
+		}
+		cursor += size
+		return length, true
+	}
+
+	for _, size := range []int{1, 2, 1} { // session id, cipher suites, compression methods
+		length, ok := readLength(size)
+		if !ok {
+			return "", true
+		}
+		cursor += length
+	}
+	extensionsLength, ok := readLength(2)
+	if !ok {
+		return "", true
+	}
+
+	extensionsEnd := cursor + extensionsLength
+	for cursor+4 <= extensionsEnd && cursor+4 <= len(data) {
+		extensionType := binary.BigEndian.Uint16(data[cursor:])
+		extensionLength := int(binary.BigEndian.Uint16(data[cursor+2:]))
+		cursor += 4
+		if extensionType != 0 { // server_name
+			cursor += extensionLength
+			continue
+		}
+
+		// server name list length, name type (host_name), name length
+		if cursor+5 > len(data) || data[cursor+2] != 0 {
+			return "", true
+		}
+		nameLength := int(binary.BigEndian.Uint16(data[cursor+3:]))
+		if cursor+5+nameLength > len(data) {
+			return "", true
+		}
+		return string(data[cursor+5 : cursor+5+nameLength]), true
+	}
+
+	return "", true
+}
@@ -0,0 +1,108 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectProtocol(t *testing.T) {
+	checkProtocol := func(client, server []byte, expectedProtocol, expectedDetails string) {
+		protocol, details := detectProtocol(client, server)
+		assert.Equal(t, expectedProtocol, protocol)
+		assert.Equal(t, expectedDetails, details)
+	}
+
+	checkProtocol([]byte("GET /index.html HTTP/1.1\r\nHost: example\r\n"), nil, "http", "")
+	checkProtocol([]byte("GET /index.html"), []byte("HTTP/1.0 200 OK\r\n"), "http", "")
+	checkProtocol([]byte("GETTING things done"), nil, "", "")
+	checkProtocol([]byte("SSH-2.0-OpenSSH_8.2\r\n"), []byte("SSH-2.0-OpenSSH_7.4\r\n"), "ssh", "SSH-2.0-OpenSSH_7.4")
+	checkProtocol(buildClientHello("vulnbox.ctf"), nil, "tls", "SNI vulnbox.ctf")
+	checkProtocol(buildClientHello(""), nil, "tls", "")
+	checkProtocol(buildClientHello("vulnbox.ctf")[:60], nil, "tls", "")
+	checkProtocol([]byte("EHLO client\r\n"), []byte("220 mail.ctf ESMTP Postfix\r\n"), "smtp", "")
+	checkProtocol([]byte("HELO client\r\n"), nil, "smtp", "")
+	checkProtocol([]byte("USER anonymous\r\n"), []byte("220 (vsFTPd 3.0.3)\r\n"), "ftp", "")
+	checkProtocol([]byte("USER anonymous\r\n"), []byte("220 Welcome\r\n"), "ftp", "")
+	checkProtocol([]byte("flag please\n"), []byte("220 Welcome\r\n"), "", "")
+	checkProtocol(nil, nil, "", "")
+}
+
+func TestServicesDetector(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Services)
+	wrapper.AddCollection(Settings)
+
+	servicesController := NewServicesController(wrapper.Storage)
+	require.NoError(t, servicesController.SetService(wrapper.Context, Service{Port: 80, Name: "web", Color: "#fff"}))
+	detector := NewServicesDetector(wrapper.Storage, servicesController, nil)
+	assert.True(t, detector.GetSettings().Enabled)
+
+	httpRequest := []byte("GET / HTTP/1.1\r\n")
+	detector.Detect(Connection{DestinationPort: 80}, httpRequest, nil)
+	detector.Detect(Connection{DestinationPort: 8080}, []byte("unknown"), nil)
+	detector.Detect(Connection{DestinationPort: 8080}, httpRequest, nil)
+	detector.Detect(Connection{DestinationPort: 22}, nil, []byte("SSH-2.0-OpenSSH_7.4\r\n"))
+
+	services := servicesController.GetServices()
+	assert.Len(t, services, 3)
+	assert.Equal(t, "web", services[80].Name)
+	assert.Equal(t, Service{Port: 8080, Name: "http-8080", Color: "#1e88e5", Notes: "Detected automatically: http"},
+		services[8080])
+	assert.Equal(t, "ssh-22", services[22].Name)
+
+	require.NoError(t, detector.SetSettings(ServicesDetectionSettings{Enabled: false}))
+	detector.Detect(Connection{DestinationPort: 8443}, buildClientHello("vulnbox.ctf"), nil)
+	assert.Len(t, servicesController.GetServices(), 3)
+
+	otherDetector := NewServicesDetector(wrapper.Storage, servicesController, nil)
+	assert.False(t, otherDetector.GetSettings().Enabled)
+
+	wrapper.Destroy(t)
+}
+
+func buildClientHello(serverName string) []byte {
+	var extensions []byte
+	if serverName != "" {
+		name := []byte(serverName)
+		extension := make([]byte, 9, 9+len(name))
+		binary.BigEndian.PutUint16(extension[0:], 0) // server_name
+		binary.BigEndian.PutUint16(extension[2:], uint16(len(name)+5))
+		binary.BigEndian.PutUint16(extension[4:], uint16(len(name)+3))
+		extension[6] = 0 // host_name
+		binary.BigEndian.PutUint16(extension[7:], uint16(len(name)))
+		extensions = append(extension, name...)
+	}
+	// supported_groups, to check that the other extensions are skipped
+	extensions = append([]byte{0x00, 0x0a, 0x00, 0x04, 0x00, 0x02, 0x00, 0x1d}, extensions...)
+
+	body := []byte{0x03, 0x03}                  // client version
+	body = append(body, make([]byte, 32)...)    // random
+	body = append(body, 0)                      // session id
+	body = append(body, 0x00, 0x02, 0x13, 0x01) // cipher suites
+	body = append(body, 0x01, 0x00)             // compression methods
+	body = append(body, byte(len(extensions)>>8), byte(len(extensions)))
+	body = append(body, extensions...)
+
+	handshake := append([]byte{0x01, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+	return append([]byte{0x16, 0x03, 0x01, byte(len(handshake) >> 8), byte(len(handshake))}, handshake...)
+}
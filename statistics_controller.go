@@ -21,6 +21,7 @@ import (
 	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"sort"
 	"time"
 )
 
@@ -32,31 +33,46 @@ type StatisticRecord struct {
 	ServerBytesPerService map[uint16]int64 `json:"server_bytes_per_service" bson:"server_bytes_per_service"`
 	TotalBytesPerService  map[uint16]int64 `json:"total_bytes_per_service" bson:"total_bytes_per_service"`
 	DurationPerService    map[uint16]int64 `json:"duration_per_service" bson:"duration_per_service"`
+	FlagsInPerService     map[uint16]int64 `json:"flags_in_per_service" bson:"flags_in_per_service"`
+	FlagsOutPerService    map[uint16]int64 `json:"flags_out_per_service" bson:"flags_out_per_service"`
 	MatchedRules          map[string]int64 `json:"matched_rules" bson:"matched_rules"`
 }
 
+// StatisticsFilter selects the statistics records. Connections accepts the same filters of the list of the
+// connections: when they are used the records are rebuilt from the connections which satisfy them.
 type StatisticsFilter struct {
-	RangeFrom time.Time `form:"range_from"`
-	RangeTo   time.Time `form:"range_to"`
-	Ports     []uint16  `form:"ports"`
-	RulesIDs  []string  `form:"rules_ids"`
-	Metric    string    `form:"metric"`
+	RangeFrom   time.Time `form:"range_from"`
+	RangeTo     time.Time `form:"range_to"`
+	Ports       []uint16  `form:"ports"`
+	RulesIDs    []string  `form:"rules_ids"`
+	Metric      string    `form:"metric"`
+	AsOf        int64     `form:"as_of"`
+	Connections ConnectionsFilter
 }
 
 type StatisticsController struct {
 	storage         Storage
 	servicesMetrics []string
+	timelineCache   *timelineCache
 }
 
 func NewStatisticsController(storage Storage) StatisticsController {
 	return StatisticsController{
 		storage: storage,
 		servicesMetrics: []string{"connections_per_service", "client_bytes_per_service",
-			"server_bytes_per_service", "total_bytes_per_service", "duration_per_service"},
+			"server_bytes_per_service", "total_bytes_per_service", "duration_per_service",
+			"flags_in_per_service", "flags_out_per_service"},
+		timelineCache: &timelineCache{entries: make(map[string]timelineCacheEntry)},
 	}
 }
 
 func (sc *StatisticsController) GetStatistics(context context.Context, filter StatisticsFilter) []StatisticRecord {
+	connectionsFilter := filter.Connections
+	connectionsFilter.AsOf = filter.AsOf
+	if query := connectionsFilter.Query(); !query.IsEmpty() {
+		return sc.getStatisticsFromConnections(context, filter, query)
+	}
+
 	var statisticRecords []StatisticRecord
 	query := sc.storage.Find(Statistics).Context(context).Sort("_id", true)
 	if !filter.RangeFrom.IsZero() {
@@ -133,6 +149,12 @@ func (sc *StatisticsController) GetTotalStatistics(context context.Context, filt
 	if statisticsPerMinute[0].DurationPerService != nil {
 		totalStats.DurationPerService = make(map[uint16]int64)
 	}
+	if statisticsPerMinute[0].FlagsInPerService != nil {
+		totalStats.FlagsInPerService = make(map[uint16]int64)
+	}
+	if statisticsPerMinute[0].FlagsOutPerService != nil {
+		totalStats.FlagsOutPerService = make(map[uint16]int64)
+	}
 	if statisticsPerMinute[0].MatchedRules != nil {
 		totalStats.MatchedRules = make(map[string]int64)
 	}
@@ -161,8 +183,190 @@ func (sc *StatisticsController) GetTotalStatistics(context context.Context, filt
 		aggregateServicesMap(totalStats.ServerBytesPerService, record.ServerBytesPerService)
 		aggregateServicesMap(totalStats.TotalBytesPerService, record.TotalBytesPerService)
 		aggregateServicesMap(totalStats.DurationPerService, record.DurationPerService)
+		aggregateServicesMap(totalStats.FlagsInPerService, record.FlagsInPerService)
+		aggregateServicesMap(totalStats.FlagsOutPerService, record.FlagsOutPerService)
 		aggregateMatchedRulesMap(totalStats.MatchedRules, record.MatchedRules)
 	}
 
 	return totalStats
 }
+
+// getStatisticsFromConnections computes the statistics considering only the connections which satisfy the query, e.g.
+// the ones processed before filter.AsOf. The statistics records can't be used because they are updated incrementally
+// and do not keep track of the properties of the connections, so the records are rebuilt from the connections in the
+// same way as UpdateStatistics, grouping them by minute with an aggregation pipeline.
+func (sc *StatisticsController) getStatisticsFromConnections(context context.Context, filter StatisticsFilter,
+	query ConnectionsQuery) []StatisticRecord {
+	var servicesBuckets []struct {
+		ID struct {
+			RangeStart time.Time `bson:"range_start"`
+			Port       uint16    `bson:"port"`
+		} `bson:"_id"`
+		Connections int64 `bson:"connections"`
+		ClientBytes int64 `bson:"client_bytes"`
+		ServerBytes int64 `bson:"server_bytes"`
+		Duration    int64 `bson:"duration"`
+		FlagsIn     int64 `bson:"flags_in"`
+		FlagsOut    int64 `bson:"flags_out"`
+	}
+	if err := sc.storage.Aggregate(Connections).Context(context).All(statisticsPipeline(filter, query, false),
+		&servicesBuckets); err != nil {
+		log.WithError(err).WithField("filter", filter).Error("failed to aggregate connections statistics")
+		return []StatisticRecord{}
+	}
+	var rulesBuckets []struct {
+		ID struct {
+			RangeStart time.Time `bson:"range_start"`
+			Rule       RowID     `bson:"rule"`
+		} `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	if err := sc.storage.Aggregate(Connections).Context(context).All(statisticsPipeline(filter, query, true),
+		&rulesBuckets); err != nil {
+		log.WithError(err).WithField("filter", filter).Error("failed to aggregate matched rules statistics")
+		return []StatisticRecord{}
+	}
+
+	recordsMap := make(map[int64]*StatisticRecord)
+	getRecord := func(rangeStart time.Time) *StatisticRecord {
+		record, isPresent := recordsMap[rangeStart.Unix()]
+		if !isPresent {
+			record = newEmptyStatisticRecord(time.Unix(rangeStart.Unix(), 0))
+			recordsMap[rangeStart.Unix()] = record
+		}
+		return record
+	}
+	for _, bucket := range servicesBuckets {
+		record, port := getRecord(bucket.ID.RangeStart), bucket.ID.Port
+		record.ConnectionsPerService[port] += bucket.Connections
+		record.ClientBytesPerService[port] += bucket.ClientBytes
+		record.ServerBytesPerService[port] += bucket.ServerBytes
+		record.TotalBytesPerService[port] += bucket.ClientBytes + bucket.ServerBytes
+		record.DurationPerService[port] += bucket.Duration
+		record.FlagsInPerService[port] += bucket.FlagsIn
+		record.FlagsOutPerService[port] += bucket.FlagsOut
+	}
+	for _, bucket := range rulesBuckets {
+		getRecord(bucket.ID.RangeStart).MatchedRules[bucket.ID.Rule.Hex()] += bucket.Count
+	}
+
+	statisticRecords := make([]StatisticRecord, 0, len(recordsMap))
+	for _, record := range recordsMap {
+		statisticRecords = append(statisticRecords, sc.projectStatisticRecord(*record, filter))
+	}
+	sort.Slice(statisticRecords, func(i, j int) bool {
+		return statisticRecords[i].RangeStart.Before(statisticRecords[j].RangeStart)
+	})
+
+	return statisticRecords
+}
+
+// statisticsPipeline returns the pipeline which groups by minute and by service the connections selected by the
+// query, or by minute and by matched rule if byRule is true. Only the minutes in the range of the filter are kept.
+func statisticsPipeline(filter StatisticsFilter, query ConnectionsQuery, byRule bool) []OrderedDocument {
+	rangeStart := rangeStartExpression(60)
+	inRange := UnorderedDocument{}
+	if !filter.RangeFrom.IsZero() {
+		inRange["$lt"] = filter.RangeFrom
+	}
+	if !filter.RangeTo.IsZero() {
+		inRange["$gt"] = filter.RangeTo
+	}
+
+	pipeline := []OrderedDocument{{{"$match", query.Document()}}}
+	if byRule {
+		pipeline = append(pipeline,
+			OrderedDocument{{"$project", UnorderedDocument{"started_at": 1, "matched_rules": 1}}},
+			OrderedDocument{{"$unwind", "$matched_rules"}},
+			OrderedDocument{{"$group", UnorderedDocument{
+				"_id":   UnorderedDocument{"range_start": rangeStart, "rule": "$matched_rules"},
+				"count": UnorderedDocument{"$sum": 1},
+			}}})
+	} else {
+		// if one of the two parts doesn't close connection, the duration is +infinity or -infinity
+		duration := UnorderedDocument{"$subtract": []interface{}{"$closed_at", "$started_at"}}
+		pipeline = append(pipeline, OrderedDocument{{"$group", UnorderedDocument{
+			"_id":          UnorderedDocument{"range_start": rangeStart, "port": "$port_dst"},
+			"connections":  UnorderedDocument{"$sum": 1},
+			"client_bytes": UnorderedDocument{"$sum": "$client_bytes"},
+			"server_bytes": UnorderedDocument{"$sum": "$server_bytes"},
+			"duration": UnorderedDocument{"$sum": UnorderedDocument{"$cond": []interface{}{
+				UnorderedDocument{"$gt": []interface{}{UnorderedDocument{"$abs": duration}, time.Hour.Milliseconds()}},
+				0, duration}}},
+			"flags_in":  UnorderedDocument{"$sum": "$flags_in"},
+			"flags_out": UnorderedDocument{"$sum": "$flags_out"},
+		}}})
+	}
+	if len(inRange) > 0 {
+		pipeline = append(pipeline, OrderedDocument{{"$match", OrderedDocument{{"_id.range_start", inRange}}}})
+	}
+
+	return pipeline
+}
+
+// projectStatisticRecord keeps only the metrics, the ports and the rules selected by the filter, matching the
+// projection applied by GetStatistics on the statistics records.
+func (sc *StatisticsController) projectStatisticRecord(record StatisticRecord, filter StatisticsFilter) StatisticRecord {
+	isProjected := len(filter.Ports) > 0 || len(filter.RulesIDs) > 0 || filter.Metric != ""
+	projectServices := func(metric string, values map[uint16]int64) map[uint16]int64 {
+		if !isProjected {
+			return values
+		}
+		if filter.Metric != "" && filter.Metric != metric || filter.Metric == "" && len(filter.Ports) == 0 {
+			return nil
+		}
+		if len(filter.Ports) == 0 {
+			return values
+		}
+		projected := make(map[uint16]int64)
+		for _, port := range filter.Ports {
+			if value, isPresent := values[port]; isPresent {
+				projected[port] = value
+			}
+		}
+		return projected
+	}
+
+	projected := StatisticRecord{
+		RangeStart:            record.RangeStart,
+		RangeEnd:              record.RangeEnd,
+		ConnectionsPerService: projectServices("connections_per_service", record.ConnectionsPerService),
+		ClientBytesPerService: projectServices("client_bytes_per_service", record.ClientBytesPerService),
+		ServerBytesPerService: projectServices("server_bytes_per_service", record.ServerBytesPerService),
+		TotalBytesPerService:  projectServices("total_bytes_per_service", record.TotalBytesPerService),
+		DurationPerService:    projectServices("duration_per_service", record.DurationPerService),
+		FlagsInPerService:     projectServices("flags_in_per_service", record.FlagsInPerService),
+		FlagsOutPerService:    projectServices("flags_out_per_service", record.FlagsOutPerService),
+		MatchedRules:          record.MatchedRules,
+	}
+	if isProjected {
+		if filter.Metric != "" && filter.Metric != "matched_rules" ||
+			filter.Metric == "" && len(filter.RulesIDs) == 0 {
+			projected.MatchedRules = nil
+		} else if len(filter.RulesIDs) > 0 {
+			projected.MatchedRules = make(map[string]int64)
+			for _, ruleID := range filter.RulesIDs {
+				if value, isPresent := record.MatchedRules[ruleID]; isPresent {
+					projected.MatchedRules[ruleID] = value
+				}
+			}
+		}
+	}
+
+	return projected
+}
+
+func newEmptyStatisticRecord(rangeStart time.Time) *StatisticRecord {
+	return &StatisticRecord{
+		RangeStart:            rangeStart,
+		RangeEnd:              rangeStart.Add(time.Minute),
+		ConnectionsPerService: make(map[uint16]int64),
+		ClientBytesPerService: make(map[uint16]int64),
+		ServerBytesPerService: make(map[uint16]int64),
+		TotalBytesPerService:  make(map[uint16]int64),
+		DurationPerService:    make(map[uint16]int64),
+		FlagsInPerService:     make(map[uint16]int64),
+		FlagsOutPerService:    make(map[uint16]int64),
+		MatchedRules:          make(map[string]int64),
+	}
+}
@@ -0,0 +1,261 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultTimelineInterval = 60
+const maxTimelineBuckets = 10000
+
+var errTooManyTimelineBuckets = fmt.Errorf("too many buckets, the time range can contain at most %v intervals",
+	maxTimelineBuckets)
+var errInvalidTimelineRule = errors.New("invalid rule id")
+
+// timelineCacheDuration is the time for which a timeline is returned from the cache. The connections are imported
+// continuously, so the last buckets of a timeline change until they are in the past.
+const timelineCacheDuration = 10 * time.Second
+
+// TimelineFilter selects the connections counted in the timeline. Interval is the size of the buckets in seconds,
+// StartedAfter and StartedBefore are unix timestamps. If Ports or RulesIDs are not empty, only the connections of the
+// services or which matched the rules are counted, and only the matches of RulesIDs are returned.
+type TimelineFilter struct {
+	Interval      int64    `form:"interval" binding:"omitempty,min=1"`
+	StartedAfter  int64    `form:"started_after"`
+	StartedBefore int64    `form:"started_before" binding:"omitempty,gtefield=StartedAfter"`
+	Ports         []uint16 `form:"ports"`
+	RulesIDs      []string `form:"rules_ids" binding:"dive,hexadecimal,len=24"`
+}
+
+// TimelineBucket contains the number of connections started in the range, their bytes and the number of connections
+// which matched each rule.
+type TimelineBucket struct {
+	RangeStart   time.Time        `json:"range_start" bson:"_id"`
+	RangeEnd     time.Time        `json:"range_end" bson:"-"`
+	Connections  int64            `json:"connections" bson:"connections"`
+	ClientBytes  int64            `json:"client_bytes" bson:"client_bytes"`
+	ServerBytes  int64            `json:"server_bytes" bson:"server_bytes"`
+	MatchedRules map[string]int64 `json:"matched_rules" bson:"-"`
+}
+
+type timelineCacheEntry struct {
+	buckets   []TimelineBucket
+	expiresAt time.Time
+}
+
+type timelineCache struct {
+	entries map[string]timelineCacheEntry
+	mutex   sync.Mutex
+}
+
+// GetTimeline returns the buckets of the connections selected by the filter, sorted by time. Only the buckets with
+// at least a connection are returned. If the time range, or the range of the selected connections when the filter
+// doesn't bound it, contains more than maxTimelineBuckets intervals, errTooManyTimelineBuckets is returned. The
+// timelines are computed with an aggregation pipeline and they are cached for timelineCacheDuration.
+func (sc *StatisticsController) GetTimeline(c context.Context, filter TimelineFilter) ([]TimelineBucket, error) {
+	if filter.Interval == 0 {
+		filter.Interval = defaultTimelineInterval
+	}
+	rulesIDs := make([]RowID, 0, len(filter.RulesIDs))
+	for _, hex := range filter.RulesIDs {
+		id, err := RowIDFromHex(hex)
+		if err != nil {
+			return nil, errInvalidTimelineRule
+		}
+		rulesIDs = append(rulesIDs, id)
+	}
+
+	key := fmt.Sprint(filter)
+	if buckets, isPresent := sc.timelineCache.get(key); isPresent {
+		return buckets, nil
+	}
+
+	if err := sc.checkTimelineRange(c, filter, rulesIDs); err != nil {
+		return nil, err
+	}
+
+	var buckets []TimelineBucket
+	if err := sc.storage.Aggregate(Connections).Context(c).All(timelinePipeline(filter, rulesIDs, false),
+		&buckets); err != nil {
+		log.WithError(err).WithField("filter", filter).Error("failed to aggregate the timeline")
+		return nil, err
+	}
+	var ruleBuckets []struct {
+		ID struct {
+			RangeStart time.Time `bson:"range_start"`
+			Rule       RowID     `bson:"rule"`
+		} `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	if err := sc.storage.Aggregate(Connections).Context(c).All(timelinePipeline(filter, rulesIDs, true),
+		&ruleBuckets); err != nil {
+		log.WithError(err).WithField("filter", filter).Error("failed to aggregate the matched rules timeline")
+		return nil, err
+	}
+
+	// the buckets are sorted from the most recent by the pipeline, which keeps only the last ones if other connections
+	// were imported after the range was checked
+	timeline := make([]TimelineBucket, len(buckets))
+	indexes := make(map[int64]int, len(buckets))
+	for i, bucket := range buckets {
+		bucket.RangeStart = bucket.RangeStart.UTC()
+		bucket.RangeEnd = bucket.RangeStart.Add(time.Duration(filter.Interval) * time.Second)
+		bucket.MatchedRules = make(map[string]int64)
+		timeline[len(buckets)-1-i] = bucket
+		indexes[bucket.RangeStart.Unix()] = len(buckets) - 1 - i
+	}
+	for _, ruleBucket := range ruleBuckets {
+		if index, isPresent := indexes[ruleBucket.ID.RangeStart.Unix()]; isPresent {
+			timeline[index].MatchedRules[ruleBucket.ID.Rule.Hex()] = ruleBucket.Count
+		}
+	}
+
+	sc.timelineCache.put(key, timeline)
+	return timeline, nil
+}
+
+// checkTimelineRange returns errTooManyTimelineBuckets if the timeline would have more than maxTimelineBuckets
+// buckets. The missing bounds of the time range are replaced with the first and the last selected connections.
+func (sc *StatisticsController) checkTimelineRange(c context.Context, filter TimelineFilter, rulesIDs []RowID) error {
+	for _, bound := range []struct {
+		value     *int64
+		ascending bool
+	}{{&filter.StartedAfter, true}, {&filter.StartedBefore, false}} {
+		if *bound.value > 0 {
+			continue
+		}
+
+		var connection Connection
+		if err := sc.storage.Find(Connections).Context(c).Filter(timelineMatch(filter, rulesIDs)).
+			Projection(OrderedDocument{{"started_at", 1}}).Sort("started_at", bound.ascending).
+			First(&connection); err != nil {
+			log.WithError(err).WithField("filter", filter).Error("failed to find the time range of the timeline")
+			return err
+		}
+		if connection.ID.IsZero() {
+			return nil // there are no connections, the timeline is empty
+		}
+		*bound.value = connection.StartedAt.Unix()
+		if !bound.ascending {
+			*bound.value++
+		}
+	}
+
+	if (filter.StartedBefore-filter.StartedAfter)/filter.Interval > maxTimelineBuckets {
+		return errTooManyTimelineBuckets
+	}
+	return nil
+}
+
+// timelineMatch returns the filter of the connections counted in the timeline.
+func timelineMatch(filter TimelineFilter, rulesIDs []RowID) OrderedDocument {
+	match := OrderedDocument{}
+	startedAt := UnorderedDocument{}
+	if filter.StartedAfter > 0 {
+		startedAt["$gte"] = time.Unix(filter.StartedAfter, 0)
+	}
+	if filter.StartedBefore > 0 {
+		startedAt["$lt"] = time.Unix(filter.StartedBefore, 0)
+	}
+	if len(startedAt) > 0 {
+		match = append(match, Entry{Key: "started_at", Value: startedAt})
+	}
+	if len(filter.Ports) > 0 {
+		match = append(match, Entry{Key: "port_dst", Value: UnorderedDocument{"$in": filter.Ports}})
+	}
+	if len(rulesIDs) > 0 {
+		match = append(match, Entry{Key: "matched_rules", Value: UnorderedDocument{"$in": rulesIDs}})
+	}
+
+	return match
+}
+
+// timelinePipeline returns the pipeline which groups the connections selected by the filter in buckets of
+// filter.Interval seconds. If byRule is true, the connections are grouped also by matched rule and only counted.
+func timelinePipeline(filter TimelineFilter, rulesIDs []RowID, byRule bool) []OrderedDocument {
+	match := timelineMatch(filter, rulesIDs)
+
+	rangeStart := rangeStartExpression(filter.Interval)
+
+	if !byRule {
+		return []OrderedDocument{
+			{{"$match", match}},
+			{{"$group", UnorderedDocument{
+				"_id":          rangeStart,
+				"connections":  UnorderedDocument{"$sum": 1},
+				"client_bytes": UnorderedDocument{"$sum": "$client_bytes"},
+				"server_bytes": UnorderedDocument{"$sum": "$server_bytes"},
+			}}},
+			{{"$sort", UnorderedDocument{"_id": -1}}},
+			{{"$limit", maxTimelineBuckets}},
+		}
+	}
+
+	pipeline := []OrderedDocument{
+		{{"$match", match}},
+		{{"$project", UnorderedDocument{"started_at": 1, "matched_rules": 1}}},
+		{{"$unwind", "$matched_rules"}},
+	}
+	if len(rulesIDs) > 0 {
+		pipeline = append(pipeline, OrderedDocument{{"$match", OrderedDocument{{"matched_rules",
+			UnorderedDocument{"$in": rulesIDs}}}}})
+	}
+	return append(pipeline, OrderedDocument{{"$group", UnorderedDocument{
+		"_id":   UnorderedDocument{"range_start": rangeStart, "rule": "$matched_rules"},
+		"count": UnorderedDocument{"$sum": 1},
+	}}})
+}
+
+// rangeStartExpression returns the expression which computes the start of the bucket of interval seconds of a
+// connection: started_at minus the milliseconds elapsed since the start of the bucket.
+func rangeStartExpression(interval int64) UnorderedDocument {
+	return UnorderedDocument{"$subtract": []interface{}{"$started_at", UnorderedDocument{"$mod": []interface{}{
+		UnorderedDocument{"$subtract": []interface{}{"$started_at", time.Unix(0, 0)}}, interval * 1000}}}}
+}
+
+func (tc *timelineCache) get(key string) ([]TimelineBucket, bool) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	entry, isPresent := tc.entries[key]
+	if !isPresent || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.buckets, true
+}
+
+// put adds the timeline to the cache, removing the expired ones.
+func (tc *timelineCache) put(key string, buckets []TimelineBucket) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	now := time.Now()
+	for entryKey, entry := range tc.entries {
+		if now.After(entry.expiresAt) {
+			delete(tc.entries, entryKey)
+		}
+	}
+	tc.entries[key] = timelineCacheEntry{buckets: buckets, expiresAt: now.Add(timelineCacheDuration)}
+}
@@ -0,0 +1,114 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimelinePipeline(t *testing.T) {
+	ruleID := NewRowID()
+	pipeline := timelinePipeline(TimelineFilter{Interval: 30, StartedAfter: 1600000000, Ports: []uint16{80}},
+		[]RowID{ruleID}, false)
+	require.Len(t, pipeline, 4)
+	assert.Equal(t, OrderedDocument{{"$match", OrderedDocument{
+		{"started_at", UnorderedDocument{"$gte": time.Unix(1600000000, 0)}},
+		{"port_dst", UnorderedDocument{"$in": []uint16{80}}},
+		{"matched_rules", UnorderedDocument{"$in": []RowID{ruleID}}},
+	}}}, pipeline[0])
+	rangeStart := pipeline[1][0].Value.(UnorderedDocument)["_id"].(UnorderedDocument)["$subtract"].([]interface{})
+	assert.Equal(t, int64(30000), rangeStart[1].(UnorderedDocument)["$mod"].([]interface{})[1])
+
+	// only the matches of the selected rules are counted
+	pipeline = timelinePipeline(TimelineFilter{Interval: 60}, []RowID{ruleID}, true)
+	require.Len(t, pipeline, 5)
+	assert.Equal(t, OrderedDocument{{"$unwind", "$matched_rules"}}, pipeline[2])
+	assert.Equal(t, OrderedDocument{{"$match", OrderedDocument{{"matched_rules",
+		UnorderedDocument{"$in": []RowID{ruleID}}}}}}, pipeline[3])
+	assert.Len(t, timelinePipeline(TimelineFilter{Interval: 60}, nil, true), 4)
+
+	cache := &timelineCache{entries: make(map[string]timelineCacheEntry)}
+	_, isPresent := cache.get("key")
+	assert.False(t, isPresent)
+	cache.put("key", []TimelineBucket{{Connections: 1}})
+	buckets, isPresent := cache.get("key")
+	assert.True(t, isPresent)
+	assert.Equal(t, []TimelineBucket{{Connections: 1}}, buckets)
+	cache.entries["key"] = timelineCacheEntry{expiresAt: time.Now().Add(-time.Second)}
+	_, isPresent = cache.get("key")
+	assert.False(t, isPresent)
+}
+
+func TestGetTimeline(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+
+	ruleID := NewRowID()
+	startedAt := time.Unix(1600000020, 0) // start of a minute
+	connections := []interface{}{
+		Connection{ID: NewRowID(), DestinationPort: 80, StartedAt: startedAt, ClientBytes: 10, ServerBytes: 100,
+			MatchedRules: []RowID{ruleID}},
+		Connection{ID: NewRowID(), DestinationPort: 80, StartedAt: startedAt.Add(59 * time.Second), ClientBytes: 20,
+			ServerBytes: 200, MatchedRules: []RowID{}},
+		Connection{ID: NewRowID(), DestinationPort: 22, StartedAt: startedAt.Add(2 * time.Minute), ClientBytes: 30,
+			ServerBytes: 300, MatchedRules: []RowID{ruleID}},
+	}
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).Many(connections)
+	require.NoError(t, err)
+
+	controller := NewStatisticsController(wrapper.Storage)
+	timeline, err := controller.GetTimeline(wrapper.Context, TimelineFilter{})
+	require.NoError(t, err)
+	require.Len(t, timeline, 2)
+	assert.Equal(t, startedAt, timeline[0].RangeStart.Local())
+	assert.Equal(t, timeline[0].RangeStart.Add(time.Minute), timeline[0].RangeEnd)
+	assert.Equal(t, int64(2), timeline[0].Connections)
+	assert.Equal(t, int64(30), timeline[0].ClientBytes)
+	assert.Equal(t, int64(300), timeline[0].ServerBytes)
+	assert.Equal(t, map[string]int64{ruleID.Hex(): 1}, timeline[0].MatchedRules)
+	assert.Equal(t, int64(1), timeline[1].Connections)
+
+	timeline, err = controller.GetTimeline(wrapper.Context, TimelineFilter{Interval: 3600, Ports: []uint16{80}})
+	require.NoError(t, err)
+	require.Len(t, timeline, 1)
+	assert.Equal(t, int64(2), timeline[0].Connections)
+
+	timeline, err = controller.GetTimeline(wrapper.Context, TimelineFilter{Interval: 3600,
+		RulesIDs: []string{ruleID.Hex()}})
+	require.NoError(t, err)
+	require.Len(t, timeline, 1)
+	assert.Equal(t, int64(2), timeline[0].Connections)
+	assert.Equal(t, map[string]int64{ruleID.Hex(): 2}, timeline[0].MatchedRules)
+
+	_, err = controller.GetTimeline(wrapper.Context, TimelineFilter{Interval: 1, StartedAfter: 1600000000,
+		StartedBefore: 1600000000 + 2*maxTimelineBuckets})
+	assert.Equal(t, errTooManyTimelineBuckets, err)
+	// the range of the connections is used if the time range is not bounded
+	timeline, err = controller.GetTimeline(wrapper.Context, TimelineFilter{Interval: 1})
+	require.NoError(t, err)
+	assert.Len(t, timeline, 3)
+	_, err = controller.GetTimeline(wrapper.Context, TimelineFilter{Interval: 1,
+		StartedAfter: startedAt.Unix() - 2*maxTimelineBuckets})
+	assert.Equal(t, errTooManyTimelineBuckets, err)
+
+	wrapper.Destroy(t)
+}
@@ -21,12 +21,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"reflect"
+	"sync/atomic"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
 )
 
 // Collections names
@@ -39,20 +44,87 @@ const (
 	Settings          = "settings"
 	Services          = "services"
 	Statistics        = "statistics"
+	Users             = "users"
+	AuthTokens        = "auth_tokens"
+	HTTPExchanges     = "http_exchanges"
+	CaptureSources    = "capture_sources"
+	StreamAnnotations = "stream_annotations"
+	RuleGroups        = "rule_groups"
+	IngestedFiles     = "ingested_files"
+	Projects          = "projects"
+	Scripts           = "scripts"
+	Extractions       = "extractions"
 )
 
+const serverSelectionTimeout = 10 * time.Second
+const maxTimeMSExpiredCode = 50
+const operationMaxAttempts = 4
+const operationInitialBackoff = 500 * time.Millisecond
+
+// notAppliedErrorCodes are the codes of the errors returned by the server when it refuses an operation, e.g. during
+// the election of a new primary. The operations which fail with these errors can always be retried.
+var notAppliedErrorCodes = []int{6, 7, 89, 91, 189, 262, 9001, 10107, 11600, 11602, 13435, 13436}
+
 var ZeroRowID [12]byte
 
+// ErrNothingToDelete is returned by the delete operations when no document satisfies the filter
+var ErrNothingToDelete = errors.New("nothing to delete")
+
 type Storage interface {
 	Insert(collectionName string) InsertOperation
 	Update(collectionName string) UpdateOperation
 	Find(collectionName string) FindOperation
 	Delete(collectionName string) DeleteOperation
+	Aggregate(collectionName string) AggregateOperation
+	Ping(ctx context.Context) error
+	Stats(ctx context.Context, collectionName string) (CollectionStats, error)
+	InsertMetrics() OperationMetrics
+}
+
+// OperationMetrics count the operations of a kind and their total duration, retries included. Duration is in seconds.
+type OperationMetrics struct {
+	Count    int64   `json:"count"`
+	Duration float64 `json:"duration"`
+}
+
+// operationTimer accumulates the durations of the operations, it is accessed atomically.
+type operationTimer struct {
+	count    int64
+	duration int64 // nanoseconds
+}
+
+func (ot *operationTimer) observe(startTime time.Time) {
+	if ot == nil {
+		return
+	}
+	atomic.AddInt64(&ot.count, 1)
+	atomic.AddInt64(&ot.duration, int64(time.Since(startTime)))
+}
+
+func (ot *operationTimer) metrics() OperationMetrics {
+	if ot == nil {
+		return OperationMetrics{}
+	}
+	return OperationMetrics{
+		Count:    atomic.LoadInt64(&ot.count),
+		Duration: time.Duration(atomic.LoadInt64(&ot.duration)).Seconds(),
+	}
+}
+
+// CollectionStats are the statistics of a collection as reported by the server. Size is the size of the documents
+// without compression, StorageSize is the space allocated on disk, which is reused but not released after deletions.
+type CollectionStats struct {
+	Documents   int64 `json:"documents"`
+	Size        int64 `json:"size"`
+	StorageSize int64 `json:"storage_size"`
+	IndexesSize int64 `json:"indexes_size"`
 }
 
 type MongoStorage struct {
 	client      *mongo.Client
+	database    string
 	collections map[string]*mongo.Collection
+	inserts     *operationTimer
 }
 
 type OrderedDocument = bson.D
@@ -61,9 +133,18 @@ type Entry = bson.E
 type RowID = primitive.ObjectID
 
 func NewMongoStorage(uri string, port int, database string) (*MongoStorage, error) {
+	return NewMongoStorageFromURI(fmt.Sprintf("mongodb://%s:%v", uri, port), database)
+}
+
+// NewMongoStorageFromURI connects to MongoDB using a connection string, which can contain the list of the members of
+// a replica set. The driver keeps monitoring the deployment and reconnects automatically to the new primary.
+func NewMongoStorageFromURI(uri string, database string) (*MongoStorage, error) {
 	ctx := context.Background()
 	opt := options.Client()
-	opt.ApplyURI(fmt.Sprintf("mongodb://%s:%v", uri, port))
+	opt.ApplyURI(uri)
+	opt.SetRetryWrites(true)
+	opt.SetRetryReads(true)
+	opt.SetServerSelectionTimeout(serverSelectionTimeout)
 	client, err := mongo.NewClient(opt)
 	if err != nil {
 		return nil, err
@@ -73,6 +154,21 @@ func NewMongoStorage(uri string, port int, database string) (*MongoStorage, erro
 		return nil, err
 	}
 
+	return openMongoDatabase(ctx, client, database)
+}
+
+// Database returns a storage which shares the connection of this storage but reads and writes the documents of
+// another database, creating its indexes if the database is new.
+func (storage *MongoStorage) Database(database string) (*MongoStorage, error) {
+	return openMongoDatabase(context.Background(), storage.client, database)
+}
+
+// DatabaseName returns the name of the database of the storage.
+func (storage *MongoStorage) DatabaseName() string {
+	return storage.database
+}
+
+func openMongoDatabase(ctx context.Context, client *mongo.Client, database string) (*MongoStorage, error) {
 	db := client.Database(database)
 	collections := map[string]*mongo.Collection{
 		Connections:       db.Collection(Connections),
@@ -83,6 +179,16 @@ func NewMongoStorage(uri string, port int, database string) (*MongoStorage, erro
 		Settings:          db.Collection(Settings),
 		Services:          db.Collection(Services),
 		Statistics:        db.Collection(Statistics),
+		Users:             db.Collection(Users),
+		AuthTokens:        db.Collection(AuthTokens),
+		HTTPExchanges:     db.Collection(HTTPExchanges),
+		CaptureSources:    db.Collection(CaptureSources),
+		IngestedFiles:     db.Collection(IngestedFiles),
+		StreamAnnotations: db.Collection(StreamAnnotations),
+		RuleGroups:        db.Collection(RuleGroups),
+		Projects:          db.Collection(Projects),
+		Scripts:           db.Collection(Scripts),
+		Extractions:       db.Collection(Extractions),
 	}
 
 	if _, err := collections[Services].Indexes().CreateOne(ctx, mongo.IndexModel{
@@ -92,6 +198,90 @@ func NewMongoStorage(uri string, port int, database string) (*MongoStorage, erro
 		return nil, err
 	}
 
+	if _, err := collections[Connections].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{"references", 1}},
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := collections[Connections].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{"minhash_bands", 1}},
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := collections[Connections].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{"processed_at", 1}},
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := collections[Connections].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{"ip_src_bytes", 1}},
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := collections[HTTPExchanges].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{"connection_id", 1}, {"index", 1}},
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := collections[StreamAnnotations].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{"connection_id", 1}, {"from_client", 1}, {"offset", 1}},
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := collections[CaptureSources].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"name", 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := collections[Scripts].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"name", 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := collections[Extractions].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{"connection_id", 1}},
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := collections[IngestedFiles].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"source_id", 1}, {"name", 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := collections[Projects].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"name", 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := collections[Users].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"username", 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := collections[AuthTokens].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"expires_at", 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}); err != nil {
+		return nil, err
+	}
+
 	if _, err := collections[ConnectionStreams].Indexes().CreateMany(ctx, []mongo.IndexModel{
 		{
 			Keys: bson.D{{"connection_id", -1}}, // descending
@@ -105,10 +295,117 @@ func NewMongoStorage(uri string, port int, database string) (*MongoStorage, erro
 
 	return &MongoStorage{
 		client:      client,
+		database:    database,
 		collections: collections,
+		inserts:     &operationTimer{},
 	}, nil
 }
 
+// Ping checks that the primary of the deployment is reachable.
+func (storage *MongoStorage) Ping(ctx context.Context) error {
+	return storage.client.Ping(ctx, readpref.Primary())
+}
+
+// Stats returns the statistics of the collection named collectionName.
+// InsertMetrics returns the number and the total duration of the inserts since the start.
+func (storage *MongoStorage) InsertMetrics() OperationMetrics {
+	return storage.inserts.metrics()
+}
+
+func (storage *MongoStorage) Stats(ctx context.Context, collectionName string) (CollectionStats, error) {
+	collection, ok := storage.collections[collectionName]
+	if !ok {
+		return CollectionStats{}, errors.New("invalid collection: " + collectionName)
+	}
+
+	var result bson.Raw
+	err := retryOperation(ctx, true, func(_ int) (err error) {
+		result, err = collection.Database().RunCommand(ctx, bson.D{{"collStats", collection.Name()}}).DecodeBytes()
+		return
+	})
+	if err != nil {
+		return CollectionStats{}, err
+	}
+
+	lookup := func(key string) int64 {
+		value, _ := result.Lookup(key).AsInt64OK()
+		return value
+	}
+	return CollectionStats{
+		Documents:   lookup("count"),
+		Size:        lookup("size"),
+		StorageSize: lookup("storageSize"),
+		IndexesSize: lookup("totalIndexSize"),
+	}, nil
+}
+
+// retryOperation calls operation until it succeeds or the error is not transient. The operations refused by the
+// server or not sent at all are always retried, while the ones failed with network errors, which may have been
+// applied, are retried only if idempotent. The attempt number is passed to operation to detect duplicate writes.
+func retryOperation(ctx context.Context, idempotent bool, operation func(attempt int) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	backoff := operationInitialBackoff
+	var err error
+	for attempt := 0; attempt < operationMaxAttempts; attempt++ {
+		if err = operation(attempt); err == nil {
+			return nil
+		}
+		if !isNotAppliedError(err) && !(idempotent && (mongo.IsNetworkError(err) || mongo.IsTimeout(err))) {
+			return err
+		}
+
+		log.WithError(err).WithField("attempt", attempt+1).Warn("storage operation failed, retrying")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	return err
+}
+
+func isNotAppliedError(err error) bool {
+	var selectionError topology.ServerSelectionError
+	if errors.As(err, &selectionError) {
+		return true
+	}
+	var serverError mongo.ServerError
+	if errors.As(err, &serverError) {
+		for _, code := range notAppliedErrorCodes {
+			if serverError.HasErrorCode(code) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isDuplicateWrite returns true if a retried insert fails only because the documents were already inserted by a
+// previous attempt.
+func isDuplicateWrite(attempt int, err error) bool {
+	if attempt == 0 {
+		return false
+	}
+	var bulkError mongo.BulkWriteException
+	if errors.As(err, &bulkError) {
+		if bulkError.WriteConcernError != nil {
+			return false
+		}
+		for _, writeError := range bulkError.WriteErrors {
+			if writeError.Code != 11000 {
+				return false
+			}
+		}
+		return true
+	}
+	return mongo.IsDuplicateKeyError(err)
+}
+
 // InsertOne and InsertMany
 
 type InsertOperation interface {
@@ -122,6 +419,7 @@ type MongoInsertOperation struct {
 	collection    *mongo.Collection
 	ctx           context.Context
 	optInsertMany *options.InsertManyOptions
+	timer         *operationTimer
 	err           error
 }
 
@@ -140,12 +438,24 @@ func (fo MongoInsertOperation) One(document interface{}) (interface{}, error) {
 		return nil, fo.err
 	}
 
-	result, err := fo.collection.InsertOne(fo.ctx, document)
+	defer fo.timer.observe(time.Now())
+	var insertedID interface{}
+	err := retryOperation(fo.ctx, true, func(attempt int) error {
+		result, err := fo.collection.InsertOne(fo.ctx, document)
+		if err != nil {
+			if isDuplicateWrite(attempt, err) {
+				return nil
+			}
+			return err
+		}
+		insertedID = result.InsertedID
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return result.InsertedID, nil
+	return insertedID, nil
 }
 
 func (fo MongoInsertOperation) Many(documents []interface{}) ([]interface{}, error) {
@@ -153,12 +463,23 @@ func (fo MongoInsertOperation) Many(documents []interface{}) ([]interface{}, err
 		return nil, fo.err
 	}
 
-	results, err := fo.collection.InsertMany(fo.ctx, documents, fo.optInsertMany)
+	defer fo.timer.observe(time.Now())
+	var insertedIDs []interface{}
+	err := retryOperation(fo.ctx, true, func(attempt int) error {
+		results, err := fo.collection.InsertMany(fo.ctx, documents, fo.optInsertMany)
+		if results != nil {
+			insertedIDs = append(insertedIDs, results.InsertedIDs...)
+		}
+		if err != nil && !isDuplicateWrite(attempt, err) {
+			return err
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return results.InsertedIDs, nil
+	return insertedIDs, nil
 }
 
 func (storage *MongoStorage) Insert(collectionName string) InsertOperation {
@@ -166,6 +487,7 @@ func (storage *MongoStorage) Insert(collectionName string) InsertOperation {
 	op := MongoInsertOperation{
 		collection:    collection,
 		optInsertMany: options.InsertMany(),
+		timer:         storage.inserts,
 	}
 	if !ok {
 		op.err = errors.New("invalid collection: " + collectionName)
@@ -220,7 +542,11 @@ func (fo MongoUpdateOperation) One(update interface{}) (bool, error) {
 	for i := range fo.update {
 		fo.update[i].Value = update
 	}
-	result, err := fo.collection.UpdateOne(fo.ctx, fo.filter, fo.update, fo.opt)
+	var result *mongo.UpdateResult
+	err := retryOperation(fo.ctx, true, func(_ int) (err error) {
+		result, err = fo.collection.UpdateOne(fo.ctx, fo.filter, fo.update, fo.opt)
+		return
+	})
 	if err != nil {
 		return false, err
 	}
@@ -236,7 +562,12 @@ func (fo MongoUpdateOperation) OneComplex(update interface{}) (bool, error) {
 		return false, fo.err
 	}
 
-	result, err := fo.collection.UpdateOne(fo.ctx, fo.filter, update, fo.opt)
+	// complex updates may contain not idempotent operators (e.g. $inc)
+	var result *mongo.UpdateResult
+	err := retryOperation(fo.ctx, false, func(_ int) (err error) {
+		result, err = fo.collection.UpdateOne(fo.ctx, fo.filter, update, fo.opt)
+		return
+	})
 	if err != nil {
 		return false, err
 	}
@@ -255,7 +586,11 @@ func (fo MongoUpdateOperation) Many(update interface{}) (int64, error) {
 	for i := range fo.update {
 		fo.update[i].Value = update
 	}
-	result, err := fo.collection.UpdateMany(fo.ctx, fo.filter, fo.update, fo.opt)
+	var result *mongo.UpdateResult
+	err := retryOperation(fo.ctx, true, func(_ int) (err error) {
+		result, err = fo.collection.UpdateMany(fo.ctx, fo.filter, fo.update, fo.opt)
+		return
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -292,6 +627,7 @@ type FindOperation interface {
 	MaxTime(duration time.Duration) FindOperation
 	First(result interface{}) error
 	All(results interface{}) error
+	AllPartial(results interface{}) (bool, error)
 }
 
 type MongoFindOperation struct {
@@ -359,7 +695,9 @@ func (fo MongoFindOperation) First(result interface{}) error {
 		return fo.err
 	}
 
-	err := fo.collection.FindOne(fo.ctx, fo.filter, fo.optFindOne).Decode(result)
+	err := retryOperation(fo.ctx, true, func(_ int) error {
+		return fo.collection.FindOne(fo.ctx, fo.filter, fo.optFindOne).Decode(result)
+	})
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			result = nil
@@ -375,15 +713,62 @@ func (fo MongoFindOperation) All(results interface{}) error {
 	if fo.err != nil {
 		return fo.err
 	}
-	cursor, err := fo.collection.Find(fo.ctx, fo.filter, fo.optFind)
-	if err != nil {
-		return err
+	return retryOperation(fo.ctx, true, func(_ int) error {
+		cursor, err := fo.collection.Find(fo.ctx, fo.filter, fo.optFind)
+		if err != nil {
+			return err
+		}
+		return cursor.All(fo.ctx, results)
+	})
+}
+
+// AllPartial is like All, but when the MaxTime of the query expires the documents already read are kept in results and
+// the returned flag is true instead of failing. results must be a pointer to a slice.
+func (fo MongoFindOperation) AllPartial(results interface{}) (bool, error) {
+	if fo.err != nil {
+		return false, fo.err
 	}
-	err = cursor.All(fo.ctx, results)
-	if err != nil {
+	slice := reflect.ValueOf(results)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return false, errors.New("results must be a pointer to a slice")
+	}
+	slice = slice.Elem()
+
+	var cursor *mongo.Cursor
+	err := retryOperation(fo.ctx, true, func(_ int) error {
+		var err error
+		cursor, err = fo.collection.Find(fo.ctx, fo.filter, fo.optFind)
 		return err
+	})
+	if isMaxTimeExpired(err) {
+		slice.Set(reflect.MakeSlice(slice.Type(), 0, 0))
+		return true, nil
+	} else if err != nil {
+		return false, err
 	}
-	return nil
+	defer cursor.Close(context.Background())
+
+	documents := reflect.MakeSlice(slice.Type(), 0, 0)
+	for cursor.Next(fo.ctx) {
+		document := reflect.New(slice.Type().Elem())
+		if err := cursor.Decode(document.Interface()); err != nil {
+			return false, err
+		}
+		documents = reflect.Append(documents, document.Elem())
+	}
+	slice.Set(documents)
+	if err := cursor.Err(); isMaxTimeExpired(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return false, nil
+}
+
+func isMaxTimeExpired(err error) bool {
+	var serverError mongo.ServerError
+	return errors.As(err, &serverError) && serverError.HasErrorCode(maxTimeMSExpiredCode)
 }
 
 func (storage *MongoStorage) Find(collectionName string) FindOperation {
@@ -449,13 +834,25 @@ func (do MongoDeleteOperation) One() error {
 		return do.err
 	}
 
-	result, err := do.collection.DeleteOne(do.ctx, do.filter, do.opts)
+	var deletedCount int64
+	err := retryOperation(do.ctx, true, func(attempt int) error {
+		result, err := do.collection.DeleteOne(do.ctx, do.filter, do.opts)
+		if err != nil {
+			return err
+		}
+		if attempt == 0 || result.DeletedCount > 0 { // a previous attempt may have deleted the document
+			deletedCount = result.DeletedCount
+		} else {
+			deletedCount = 1
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	if result.DeletedCount == 0 {
-		return errors.New("nothing to delete")
+	if deletedCount == 0 {
+		return ErrNothingToDelete
 	}
 
 	return nil
@@ -466,14 +863,78 @@ func (do MongoDeleteOperation) Many() error {
 		return do.err
 	}
 
-	result, err := do.collection.DeleteMany(do.ctx, do.filter, do.opts)
+	var deletedCount int64
+	err := retryOperation(do.ctx, true, func(attempt int) error {
+		result, err := do.collection.DeleteMany(do.ctx, do.filter, do.opts)
+		if err != nil {
+			return err
+		}
+		if attempt == 0 || result.DeletedCount > 0 {
+			deletedCount = result.DeletedCount
+		} else {
+			deletedCount = 1
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	if result.DeletedCount == 0 {
-		return errors.New("nothing to delete")
+	if deletedCount == 0 {
+		return ErrNothingToDelete
 	}
 
 	return nil
 }
+
+// Aggregate
+
+type AggregateOperation interface {
+	Context(ctx context.Context) AggregateOperation
+	MaxTime(duration time.Duration) AggregateOperation
+	All(pipeline interface{}, results interface{}) error
+}
+
+type MongoAggregateOperation struct {
+	collection *mongo.Collection
+	ctx        context.Context
+	opts       *options.AggregateOptions
+	err        error
+}
+
+func (ao MongoAggregateOperation) Context(ctx context.Context) AggregateOperation {
+	ao.ctx = ctx
+	return ao
+}
+
+func (ao MongoAggregateOperation) MaxTime(duration time.Duration) AggregateOperation {
+	ao.opts.SetMaxTime(duration)
+	return ao
+}
+
+// All runs the pipeline, which must not contain stages with side effects (e.g. $out), and decodes all the resulting
+// documents in results.
+func (ao MongoAggregateOperation) All(pipeline interface{}, results interface{}) error {
+	if ao.err != nil {
+		return ao.err
+	}
+	return retryOperation(ao.ctx, true, func(_ int) error {
+		cursor, err := ao.collection.Aggregate(ao.ctx, pipeline, ao.opts)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ao.ctx, results)
+	})
+}
+
+func (storage *MongoStorage) Aggregate(collectionName string) AggregateOperation {
+	collection, ok := storage.collections[collectionName]
+	op := MongoAggregateOperation{
+		collection: collection,
+		opts:       options.Aggregate(),
+	}
+	if !ok {
+		op.err = errors.New("invalid collection: " + collectionName)
+	}
+	return op
+}
@@ -0,0 +1,100 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const storageLimitsSettingsKey = "storage_limits"
+
+// StorageLimitsSettings bound the payload stored for each stream: MaxStreamSize is in bytes, MaxStreamDuration is in
+// seconds and zero means unlimited. The bytes beyond the limits are counted but not stored, and the connections are
+// marked as truncated. The streams where a pattern of a rule with extend_capture matches before the limits are reached
+// use the extended limits instead, so that the interesting connections are captured in full.
+type StorageLimitsSettings struct {
+	MaxStreamSize             int `json:"max_stream_size" binding:"min=0" bson:"max_stream_size"`
+	MaxStreamDuration         int `json:"max_stream_duration" binding:"min=0" bson:"max_stream_duration"`
+	ExtendedMaxStreamSize     int `json:"extended_max_stream_size" binding:"min=0" bson:"extended_max_stream_size"`
+	ExtendedMaxStreamDuration int `json:"extended_max_stream_duration" binding:"min=0" bson:"extended_max_stream_duration"`
+}
+
+// streamLimits returns the maximum size and the maximum duration of a stream, zero if unlimited.
+func (sls StorageLimitsSettings) streamLimits(extended bool) (int, time.Duration) {
+	if extended {
+		return sls.ExtendedMaxStreamSize, time.Duration(sls.ExtendedMaxStreamDuration) * time.Second
+	}
+	return sls.MaxStreamSize, time.Duration(sls.MaxStreamDuration) * time.Second
+}
+
+type StorageLimits struct {
+	storage  Storage
+	settings StorageLimitsSettings
+	mutex    sync.Mutex
+}
+
+func NewStorageLimits(storage Storage) *StorageLimits {
+	storageLimits := &StorageLimits{storage: storage}
+
+	if err := LoadSettings(storage, storageLimitsSettingsKey, &storageLimits.settings); err != nil {
+		log.WithError(err).Panic("failed to retrieve storage limits settings")
+	}
+
+	return storageLimits
+}
+
+// GetSettings returns the current limits. A nil StorageLimits has no limits.
+func (sl *StorageLimits) GetSettings() StorageLimitsSettings {
+	if sl == nil {
+		return StorageLimitsSettings{}
+	}
+
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	return sl.settings
+}
+
+func (sl *StorageLimits) SetSettings(settings StorageLimitsSettings) error {
+	if err := SaveSettings(sl.storage, storageLimitsSettingsKey, settings); err != nil {
+		return err
+	}
+
+	sl.mutex.Lock()
+	sl.settings = settings
+	sl.mutex.Unlock()
+
+	return nil
+}
+
+// ReloadSettings reads the settings again from the database, discarding the ones in memory.
+func (sl *StorageLimits) ReloadSettings() error {
+	var settings StorageLimitsSettings
+	if err := LoadSettings(sl.storage, storageLimitsSettingsKey, &settings); err != nil {
+		return err
+	}
+
+	sl.mutex.Lock()
+	sl.settings = settings
+	sl.mutex.Unlock()
+
+	return nil
+}
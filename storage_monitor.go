@@ -0,0 +1,101 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const storageCheckInterval = 5 * time.Second
+const storageCheckTimeout = 3 * time.Second
+
+type StorageStatus struct {
+	Healthy       bool      `json:"healthy"`
+	LastCheck     time.Time `json:"last_check"`
+	Latency       int64     `json:"latency"`
+	DegradedSince time.Time `json:"degraded_since,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// StorageMonitor periodically checks that the primary of the database is reachable and notifies the clients when the
+// storage enters or leaves the degraded mode. In degraded mode the writes are retried until the primary is back.
+type StorageMonitor struct {
+	storage                Storage
+	notificationController *NotificationController
+	status                 StorageStatus
+	mutex                  sync.Mutex
+}
+
+func NewStorageMonitor(storage Storage, notificationController *NotificationController) *StorageMonitor {
+	return &StorageMonitor{
+		storage:                storage,
+		notificationController: notificationController,
+		status:                 StorageStatus{Healthy: true},
+	}
+}
+
+func (sm *StorageMonitor) GetStatus() StorageStatus {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	return sm.status
+}
+
+func (sm *StorageMonitor) Run() {
+	for {
+		sm.Check()
+		time.Sleep(storageCheckInterval)
+	}
+}
+
+func (sm *StorageMonitor) Check() {
+	ctx, cancel := context.WithTimeout(context.Background(), storageCheckTimeout)
+	startTime := time.Now()
+	err := sm.storage.Ping(ctx)
+	cancel()
+
+	sm.mutex.Lock()
+	wasHealthy := sm.status.Healthy
+	sm.status.LastCheck = time.Now()
+	sm.status.Latency = time.Now().Sub(startTime).Milliseconds()
+	if err != nil {
+		sm.status.LastError = err.Error()
+		if wasHealthy {
+			sm.status.Healthy = false
+			sm.status.DegradedSince = time.Now()
+		}
+	} else {
+		sm.status.Healthy = true
+		sm.status.DegradedSince = time.Time{}
+		sm.status.LastError = ""
+	}
+	status := sm.status
+	sm.mutex.Unlock()
+
+	if wasHealthy && !status.Healthy {
+		log.WithError(err).Warn("storage is unreachable, entering degraded mode")
+		sm.notificationController.Notify("storage.degraded", status)
+	} else if !wasHealthy && status.Healthy {
+		log.Info("storage is reachable again, leaving degraded mode")
+		sm.notificationController.Notify("storage.recovered", status)
+	}
+}
@@ -18,8 +18,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"testing"
 	"time"
 )
@@ -256,3 +260,57 @@ func TestComplexInsertManyFindMany(t *testing.T) {
 
 	wrapper.Destroy(t)
 }
+
+func TestRetryOperation(t *testing.T) {
+	notAppliedError := mongo.CommandError{Code: 10107, Message: "not primary"}
+	networkError := mongo.CommandError{Labels: []string{"NetworkError"}, Message: "connection reset"}
+	otherError := errors.New("other error")
+
+	checkAttempts := func(idempotent bool, failure error, expectedAttempts int, expectedError error) {
+		attempts := 0
+		err := retryOperation(context.Background(), idempotent, func(attempt int) error {
+			assert.Equal(t, attempts, attempt)
+			attempts++
+			if attempts == 1 {
+				return failure
+			}
+			return nil
+		})
+		assert.Equal(t, expectedAttempts, attempts)
+		assert.Equal(t, expectedError, err)
+	}
+
+	checkAttempts(false, notAppliedError, 2, nil)
+	checkAttempts(true, networkError, 2, nil)
+	checkAttempts(false, networkError, 1, networkError)
+	checkAttempts(true, otherError, 1, otherError)
+}
+
+func TestRetriedInsertIsIdempotent(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	collectionName := "retried_insert"
+	wrapper.AddCollection(collectionName)
+
+	doc := UnorderedDocument{"_id": NewRowID(), "key": "a"}
+	_, err := wrapper.Storage.Insert(collectionName).Context(wrapper.Context).One(doc)
+	require.NoError(t, err)
+
+	_, err = wrapper.Storage.Insert(collectionName).Context(wrapper.Context).One(doc)
+	assert.Error(t, err)
+	assert.False(t, isDuplicateWrite(0, err))
+	assert.True(t, isDuplicateWrite(1, err))
+
+	_, err = wrapper.Storage.Insert(collectionName).Context(wrapper.Context).StopOnFail(false).
+		Many([]interface{}{doc, UnorderedDocument{"_id": NewRowID(), "key": "b"}})
+	assert.Error(t, err)
+	assert.True(t, isDuplicateWrite(1, err))
+
+	monitor := NewStorageMonitor(wrapper.Storage, NewNotificationController(nil))
+	monitor.Check()
+	status := monitor.GetStatus()
+	assert.True(t, status.Healthy)
+	assert.NotZero(t, status.LastCheck)
+	assert.Zero(t, status.DegradedSince)
+
+	wrapper.Destroy(t)
+}
@@ -0,0 +1,172 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StreamAnnotation is a note attached by the users to a range of bytes of the client or of the server stream of a
+// connection. Offset is relative to the start of the stream of the direction, so the annotations can span multiple
+// messages.
+type StreamAnnotation struct {
+	ID           RowID     `json:"id" bson:"_id"`
+	ConnectionID RowID     `json:"connection_id" bson:"connection_id"`
+	FromClient   bool      `json:"from_client" bson:"from_client"`
+	Offset       uint64    `json:"offset" bson:"offset"`
+	Length       uint64    `json:"length" binding:"min=1" bson:"length"`
+	Text         string    `json:"text" binding:"required,max=4096" bson:"text"`
+	Color        string    `json:"color" binding:"omitempty,hexcolor" bson:"color,omitempty"`
+	Author       string    `json:"author" bson:"author,omitempty"`
+	CreatedAt    time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+// MessageAnnotation is the part of an annotation which overlaps a message. From and To are relative to the start of
+// the message, like the regex matches.
+type MessageAnnotation struct {
+	ID    RowID  `json:"id"`
+	From  uint64 `json:"from"`
+	To    uint64 `json:"to"`
+	Text  string `json:"text"`
+	Color string `json:"color,omitempty"`
+}
+
+// GetAnnotations returns the annotations of a connection, ordered by direction and offset.
+func (csc ConnectionStreamsController) GetAnnotations(c context.Context, connectionID RowID) []StreamAnnotation {
+	var annotations []StreamAnnotation
+	if err := csc.storage.Find(StreamAnnotations).Context(c).
+		Filter(OrderedDocument{{"connection_id", connectionID}}).
+		Sort("from_client", false).Sort("offset", true).All(&annotations); err != nil {
+		log.WithError(err).WithField("connection_id", connectionID).Panic("failed to get stream annotations")
+	}
+	if annotations == nil {
+		return []StreamAnnotation{}
+	}
+	return annotations
+}
+
+// AddAnnotation attaches a new annotation to a connection. Returns false if the connection does not exist, or an
+// error if the range exceeds the stream.
+func (csc ConnectionStreamsController) AddAnnotation(c context.Context, connectionID RowID,
+	annotation StreamAnnotation) (StreamAnnotation, bool, error) {
+	connection := csc.getConnection(c, connectionID)
+	if connection.ID.IsZero() {
+		return StreamAnnotation{}, false, nil
+	}
+	if err := validateAnnotationRange(connection, annotation); err != nil {
+		return StreamAnnotation{}, true, err
+	}
+
+	annotation.ID = NewRowID()
+	annotation.ConnectionID = connectionID
+	annotation.CreatedAt = time.Now()
+	annotation.UpdatedAt = annotation.CreatedAt
+	if _, err := csc.storage.Insert(StreamAnnotations).Context(c).One(annotation); err != nil {
+		log.WithError(err).WithField("annotation", annotation).Panic("failed to insert a stream annotation")
+	}
+
+	return annotation, true, nil
+}
+
+// UpdateAnnotation replaces the range, the text and the color of an annotation, keeping the author. Returns false if
+// the annotation does not exist, or an error if the range exceeds the stream.
+func (csc ConnectionStreamsController) UpdateAnnotation(c context.Context, connectionID, annotationID RowID,
+	annotation StreamAnnotation) (StreamAnnotation, bool, error) {
+	var current StreamAnnotation
+	if err := csc.storage.Find(StreamAnnotations).Context(c).
+		Filter(OrderedDocument{{"_id", annotationID}, {"connection_id", connectionID}}).First(&current); err != nil {
+		log.WithError(err).WithField("id", annotationID).Panic("failed to get a stream annotation")
+	}
+	if current.ID.IsZero() {
+		return StreamAnnotation{}, false, nil
+	}
+	if err := validateAnnotationRange(csc.getConnection(c, connectionID), annotation); err != nil {
+		return StreamAnnotation{}, true, err
+	}
+
+	current.FromClient = annotation.FromClient
+	current.Offset = annotation.Offset
+	current.Length = annotation.Length
+	current.Text = annotation.Text
+	current.Color = annotation.Color
+	current.UpdatedAt = time.Now()
+	if _, err := csc.storage.Update(StreamAnnotations).Context(c).Filter(byID(annotationID)).
+		One(UnorderedDocument{"from_client": current.FromClient, "offset": current.Offset,
+			"length": current.Length, "text": current.Text, "color": current.Color,
+			"updated_at": current.UpdatedAt}); err != nil {
+		log.WithError(err).WithField("annotation", current).Panic("failed to update a stream annotation")
+	}
+
+	return current, true, nil
+}
+
+// DeleteAnnotation returns false if the annotation does not exist.
+func (csc ConnectionStreamsController) DeleteAnnotation(c context.Context, connectionID, annotationID RowID) bool {
+	err := csc.storage.Delete(StreamAnnotations).Context(c).
+		Filter(OrderedDocument{{"_id", annotationID}, {"connection_id", connectionID}}).One()
+	if err == ErrNothingToDelete {
+		return false
+	} else if err != nil {
+		log.WithError(err).WithField("id", annotationID).Panic("failed to delete a stream annotation")
+	}
+
+	return true
+}
+
+func validateAnnotationRange(connection Connection, annotation StreamAnnotation) error {
+	streamLength := uint64(connection.ServerBytes)
+	if annotation.FromClient {
+		streamLength = uint64(connection.ClientBytes)
+	}
+	if annotation.Offset+annotation.Length > streamLength {
+		return errors.New("annotation range exceeds the stream length")
+	}
+	return nil
+}
+
+// findAnnotationsBetween returns the parts of the annotations which overlap the range [from, to) of a stream. The
+// annotations must be of the same direction of the range.
+func findAnnotationsBetween(annotations []StreamAnnotation, from, to uint64) []MessageAnnotation {
+	var messageAnnotations []MessageAnnotation
+	for _, annotation := range annotations {
+		start, end := annotation.Offset, annotation.Offset+annotation.Length
+		if start >= to || end <= from {
+			continue
+		}
+		if start < from {
+			start = from
+		}
+		if end > to {
+			end = to
+		}
+
+		messageAnnotations = append(messageAnnotations, MessageAnnotation{
+			ID:    annotation.ID,
+			From:  start - from,
+			To:    end - from,
+			Text:  annotation.Text,
+			Color: annotation.Color,
+		})
+	}
+	return messageAnnotations
+}
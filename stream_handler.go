@@ -19,41 +19,66 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"github.com/flier/gohs/hyperscan"
 	"github.com/google/gopacket/tcpassembly"
 	log "github.com/sirupsen/logrus"
+	"reflect"
 	"strings"
 	"time"
+	"unsafe"
 )
 
 const MaxDocumentSize = 1024 * 1024
 const InitialBlockCount = 1024
 const InitialPatternSliceSize = 8
+const RedactionByte = '*'
 
 // IMPORTANT:  If you use a StreamHandler, you MUST read ALL BYTES from it,
 // quickly.  Not reading available bytes will block TCP stream reassembly.  It's
 // a common pattern to do this by starting a goroutine in the factory's New
 // method:
 type StreamHandler struct {
-	connection      ConnectionHandler
-	streamFlow      StreamFlow
-	buffer          *bytes.Buffer
-	indexes         []int
-	timestamps      []time.Time
-	lossBlocks      []bool
-	currentIndex    int
-	firstPacketSeen time.Time
-	lastPacketSeen  time.Time
-	documentsIDs    []RowID
-	streamLength    int
-	patternStream   hyperscan.Stream
-	patternMatches  map[uint][]PatternSlice
-	scanner         Scanner
-	isClient        bool
+	connection       ConnectionHandler
+	streamFlow       StreamFlow
+	buffer           *bytes.Buffer
+	indexes          []int
+	timestamps       []time.Time
+	lossBlocks       []bool
+	currentIndex     int
+	firstPacketSeen  time.Time
+	lastPacketSeen   time.Time
+	documentsIDs     []RowID
+	documentsStarts  []int
+	streamLength     int
+	patternStream    hyperscan.Stream
+	patternMatches   map[uint][]PatternSlice
+	patternsDB       hyperscan.StreamDatabase
+	patternsVersion  RowID
+	patternsLayers   map[uint][]string // the decoding layers of the patterns of patternsDB
+	scanner          Scanner
+	scanning         bool
+	scanFailed       bool
+	isClient         bool
+	prefix           []byte
+	firstBlockSize   int
+	previewStrings   []string
+	references       map[string]bool
+	decodedLayers    map[uint]map[string]bool
+	limits           StorageLimitsSettings
+	extendPatterns   map[uint]bool
+	redactPatterns   map[uint]bool
+	pendingDocuments []ConnectionStream // the documents kept in memory until the secrets are redacted
+	scopedPatterns   map[uint]map[uint16]bool
+	servicePort      uint16
+	captureExtended  bool
+	truncated        bool
+	droppedBytes     int
+	fingerprint      *minHash
 }
 
-// NewReaderStream returns a new StreamHandler object.
-func NewStreamHandler(connection ConnectionHandler, streamFlow StreamFlow, scanner Scanner, isClient bool) StreamHandler {
+// NewReaderStream returns a new StreamHandler object. The pattern stream is opened on the first reassembled bytes.
+func NewStreamHandler(connection ConnectionHandler, streamFlow StreamFlow, isClient bool) StreamHandler {
 	handler := StreamHandler{
 		connection:     connection,
 		streamFlow:     streamFlow,
@@ -61,17 +86,28 @@ func NewStreamHandler(connection ConnectionHandler, streamFlow StreamFlow, scann
 		indexes:        make([]int, 0, InitialBlockCount),
 		timestamps:     make([]time.Time, 0, InitialBlockCount),
 		lossBlocks:     make([]bool, 0, InitialBlockCount),
-		documentsIDs:   make([]RowID, 0, 1),               // most of the time the stream fit in one document
-		patternMatches: make(map[uint][]PatternSlice, connection.PatternsDatabaseSize()),
-		scanner:        scanner,
+		documentsIDs:   make([]RowID, 0, 1), // most of the time the stream fit in one document
+		references:     make(map[string]bool),
+		limits:         connection.StorageLimits(),
+		scopedPatterns: connection.PatternsServices(),
+		fingerprint:    newMinHash(),
 		isClient:       isClient,
 	}
 
-	stream, err := connection.PatternsDatabase().Open(0, scanner.scratch, handler.onMatch, nil)
-	if err != nil {
-		log.WithField("streamFlow", streamFlow).WithError(err).Error("failed to create a stream")
+	// the service is the destination of the client stream and the source of the server stream
+	serviceEndpoint := streamFlow[3]
+	if !isClient {
+		serviceEndpoint = streamFlow[2]
 	}
-	handler.patternStream = stream
+	if raw := serviceEndpoint.Raw(); len(raw) == 2 {
+		handler.servicePort = binary.BigEndian.Uint16(raw)
+	}
+
+	patterns := connection.PatternsDatabase(handler.servicePort)
+	handler.patternsDB, handler.patternsVersion, handler.patternsLayers = patterns.Database, patterns.Version,
+		patterns.DecodeLayers
+	handler.extendPatterns, handler.redactPatterns = patterns.ExtendCapture, patterns.Redact
+	handler.patternMatches = make(map[uint][]PatternSlice, patterns.Size)
 
 	return handler
 }
@@ -97,6 +133,20 @@ func (sh *StreamHandler) Reassembled(reassembly []tcpassembly.Reassembly) {
 			skip = 0
 		}
 
+		if sh.truncated {
+			sh.droppedBytes += reassemblyLen - skip
+			continue
+		}
+		if allowed := sh.allowedBytes(r.Seen, reassemblyLen-skip); allowed < reassemblyLen-skip {
+			sh.droppedBytes += reassemblyLen - skip - allowed
+			sh.truncated = true
+			if allowed == 0 {
+				continue
+			}
+			r.Bytes = r.Bytes[:skip+allowed]
+		}
+
+		sh.resumeScanning()
 		if sh.buffer.Len()+len(r.Bytes)-skip > MaxDocumentSize {
 			sh.storageCurrentDocument()
 			sh.resetCurrentDocument()
@@ -111,28 +161,140 @@ func (sh *StreamHandler) Reassembled(reassembly []tcpassembly.Reassembly) {
 		sh.lossBlocks = append(sh.lossBlocks, isLoss)
 		sh.currentIndex += n
 		sh.streamLength += n
+		if sh.firstBlockSize == 0 {
+			sh.firstBlockSize = n
+		}
+
+		if len(sh.prefix) < detectionPrefixSize {
+			end := len(r.Bytes)
+			if end-skip > detectionPrefixSize-len(sh.prefix) {
+				end = skip + detectionPrefixSize - len(sh.prefix)
+			}
+			sh.prefix = append(sh.prefix, r.Bytes[skip:end]...)
+		}
 
 		if sh.patternStream != nil {
+			scanStart := time.Now()
 			err = sh.patternStream.Scan(r.Bytes)
 			if err != nil {
 				log.WithError(err).Error("failed to scan packet buffer")
 			}
+			sh.scanner.scanTime += time.Since(scanStart)
+			sh.scanner.scannedBytes += int64(len(r.Bytes))
+			if !sh.captureExtended {
+				for id := range sh.extendPatterns {
+					if len(sh.patternMatches[id]) > 0 {
+						sh.captureExtended = true
+						break
+					}
+				}
+			}
+		}
+	}
+	sh.suspendScanning()
+}
+
+// resumeScanning takes a scanner from the pool and binds its scratch space to the pattern stream, which is opened the
+// first time and then kept open until the end of the stream. The scratch spaces are held only while the reassembled
+// bytes are processed, so their number is bounded by the workers which feed the assemblers instead of by the open
+// connections.
+func (sh *StreamHandler) resumeScanning() {
+	if sh.scanning || sh.scanFailed || sh.patternsDB == nil {
+		return
+	}
+
+	sh.scanner = sh.connection.TakeScanner()
+	sh.scanning = true
+	if sh.scanner.version != sh.patternsVersion {
+		// the stream was opened on a previous database: the scratch space grows to fit both the databases
+		if err := sh.scanner.scratch.Realloc(sh.patternsDB); err != nil {
+			log.WithError(err).Error("failed to realloc the scratch for a previous database")
+			sh.patternStream = nil // never closed, the scratch bound to it may be in use by another stream
+			sh.scanFailed = true
+			return
 		}
 	}
+
+	if sh.patternStream != nil {
+		if !setStreamScratch(sh.patternStream, sh.scanner.scratch) {
+			log.WithField("streamFlow", sh.streamFlow).Error("failed to bind a scratch to the pattern stream")
+			sh.patternStream = nil
+			sh.scanFailed = true
+		}
+		return
+	}
+
+	var err error
+	sh.patternStream, err = sh.patternsDB.Open(0, sh.scanner.scratch, sh.onMatch, nil)
+	if err != nil {
+		log.WithField("streamFlow", sh.streamFlow).WithError(err).Error("failed to open a pattern stream")
+		sh.patternStream = nil
+		sh.scanFailed = true
+	}
+}
+
+// suspendScanning returns the scanner to the pool. The pattern stream stays open, and it must not be scanned until a
+// new scratch space is bound to it by resumeScanning.
+func (sh *StreamHandler) suspendScanning() {
+	if !sh.scanning {
+		return
+	}
+
+	sh.connection.ReleaseScanner(sh.scanner)
+	sh.scanner = Scanner{}
+	sh.scanning = false
+}
+
+// setStreamScratch binds a scratch space to an open pattern stream. Hyperscan uses the scratch only during the scan
+// and close calls, but gohs binds it to the stream when the stream is opened and provides no way to replace it, so
+// the field is set through reflection. Returns false if the stream is not the one implemented by gohs.
+func setStreamScratch(stream hyperscan.Stream, scratch *hyperscan.Scratch) bool {
+	streamValue := reflect.ValueOf(stream)
+	if streamValue.Kind() != reflect.Ptr || streamValue.Elem().Kind() != reflect.Struct {
+		return false
+	}
+	target := streamValue.Elem().FieldByName("scratch")
+	source := reflect.ValueOf(scratch).Elem().FieldByName("s")
+	if !target.IsValid() || !source.IsValid() || target.Type() != source.Type() {
+		return false
+	}
+
+	reflect.NewAt(target.Type(), unsafe.Pointer(target.UnsafeAddr())).Elem().
+		Set(reflect.NewAt(source.Type(), unsafe.Pointer(source.UnsafeAddr())).Elem())
+	return true
+}
+
+// allowedBytes returns how many of the next length bytes of the stream, seen at the given time, can be stored within
+// the storage limits. The extended limits are used after a pattern of a rule with extend_capture has matched.
+func (sh *StreamHandler) allowedBytes(seen time.Time, length int) int {
+	maxSize, maxDuration := sh.limits.streamLimits(sh.captureExtended)
+	if maxDuration > 0 && !sh.firstPacketSeen.IsZero() && seen.Sub(sh.firstPacketSeen) > maxDuration {
+		return 0
+	}
+	if maxSize > 0 && sh.streamLength+length > maxSize {
+		if maxSize < sh.streamLength {
+			return 0
+		}
+		return maxSize - sh.streamLength
+	}
+	return length
 }
 
 // ReassemblyComplete implements tcpassembly.Stream's ReassemblyComplete function.
 func (sh *StreamHandler) ReassemblyComplete() {
+	sh.resumeScanning()
 	if sh.patternStream != nil {
 		err := sh.patternStream.Close()
 		if err != nil {
 			log.WithError(err).Error("failed to close pattern stream")
 		}
+		sh.patternStream = nil
 	}
 
 	if sh.currentIndex > 0 {
 		sh.storageCurrentDocument()
 	}
+	sh.suspendScanning()
 	sh.connection.Complete(sh)
 }
 
@@ -149,6 +311,9 @@ func (sh *StreamHandler) resetCurrentDocument() {
 }
 
 func (sh *StreamHandler) onMatch(id uint, from uint64, to uint64, _ uint, _ interface{}) error {
+	if services, isScoped := sh.scopedPatterns[id]; isScoped && !services[sh.servicePort] {
+		return nil // the pattern is used only by rules scoped to other services
+	}
 	patternSlices, isPresent := sh.patternMatches[id]
 	if isPresent {
 		if len(patternSlices) > 0 {
@@ -169,25 +334,300 @@ func (sh *StreamHandler) onMatch(id uint, from uint64, to uint64, _ uint, _ inte
 	return nil
 }
 
+// storageCurrentDocument stores the current document. If the database of the stream has patterns of rules which redact
+// their matches, the document is kept in memory instead, and it is stored by storePendingDocuments when the connection
+// is complete, after the secrets have been redacted: the documents are either all stored or all pending.
 func (sh *StreamHandler) storageCurrentDocument() {
+	sh.scanDecodedLayers()
+
 	payload := sh.streamFlow.Hash()&uint64(0xffffffffffffff00) | uint64(len(sh.documentsIDs)) // LOL
 	streamID := CustomRowID(payload, sh.firstPacketSeen)
+	document := ConnectionStream{
+		ID:               streamID,
+		ConnectionID:     ZeroRowID,
+		DocumentIndex:    len(sh.documentsIDs),
+		Payload:          sh.buffer.Bytes(),
+		BlocksIndexes:    sh.indexes,
+		BlocksTimestamps: sh.timestamps,
+		BlocksLoss:       sh.lossBlocks,
+		PatternMatches:   sh.patternMatches,
+		FromClient:       sh.isClient,
+	}
+
+	if len(sh.redactPatterns) > 0 {
+		// the buffers are reused by the next document
+		document.Payload = append([]byte{}, sh.buffer.Bytes()...)
+		document.BlocksIndexes = append([]int{}, sh.indexes...)
+		document.BlocksTimestamps = append([]time.Time{}, sh.timestamps...)
+		document.BlocksLoss = append([]bool{}, sh.lossBlocks...)
+		document.PatternMatches = make(map[uint][]PatternSlice, len(sh.patternMatches))
+		for id, slices := range sh.patternMatches {
+			document.PatternMatches[id] = append([]PatternSlice{}, slices...)
+		}
+		sh.pendingDocuments = append(sh.pendingDocuments, document)
+		sh.documentsIDs = append(sh.documentsIDs, streamID)
+		sh.documentsStarts = append(sh.documentsStarts, sh.streamLength-sh.buffer.Len())
+		return
+	}
 
-	if _, err := sh.connection.Storage().Insert(ConnectionStreams).
-		One(ConnectionStream{
-			ID:               streamID,
-			ConnectionID:     ZeroRowID,
-			DocumentIndex:    len(sh.documentsIDs),
-			Payload:          sh.buffer.Bytes(),
-			PayloadString: 	  strings.ToValidUTF8(string(sh.buffer.Bytes()), ""),
-			BlocksIndexes:    sh.indexes,
-			BlocksTimestamps: sh.timestamps,
-			BlocksLoss:       sh.lossBlocks,
-			PatternMatches:   sh.patternMatches,
-			FromClient:       sh.isClient,
-		}); err != nil {
+	sh.indexDocument(document.Payload)
+	document.PayloadString = strings.ToValidUTF8(string(document.Payload), "")
+	if _, err := sh.connection.Storage().Insert(ConnectionStreams).One(document); err != nil {
 		log.WithError(err).Error("failed to insert connection stream")
 	} else {
 		sh.documentsIDs = append(sh.documentsIDs, streamID)
+		sh.documentsStarts = append(sh.documentsStarts, sh.streamLength-sh.buffer.Len())
+	}
+}
+
+// indexDocument extracts the references and the strings of the preview from the payload of a document which is going
+// to be stored, and adds it to the fingerprint of the stream.
+func (sh *StreamHandler) indexDocument(payload []byte) {
+	extractReferences(payload, sh.references)
+	sh.fingerprint.Write(payload)
+	if len(sh.previewStrings) < previewMaxStrings && !isTextual(sh.prefix) {
+		sh.previewStrings = extractPrintableStrings(payload, sh.previewStrings)
+	}
+}
+
+// storePendingDocuments stores the documents kept in memory, linked to the connection. The documents which can't be
+// stored are removed from the documents of the stream.
+func (sh *StreamHandler) storePendingDocuments(connectionID RowID) {
+	if len(sh.pendingDocuments) == 0 {
+		return
+	}
+
+	documentsIDs := make([]RowID, 0, len(sh.pendingDocuments))
+	documentsStarts := make([]int, 0, len(sh.pendingDocuments))
+	for i, document := range sh.pendingDocuments {
+		sh.indexDocument(document.Payload)
+		document.ConnectionID = connectionID
+		document.PayloadString = strings.ToValidUTF8(string(document.Payload), "")
+		if _, err := sh.connection.Storage().Insert(ConnectionStreams).One(document); err != nil {
+			log.WithError(err).Error("failed to insert connection stream")
+			continue
+		}
+		documentsIDs = append(documentsIDs, document.ID)
+		documentsStarts = append(documentsStarts, sh.documentsStarts[i])
+	}
+	sh.documentsIDs, sh.documentsStarts = documentsIDs, documentsStarts
+	sh.pendingDocuments = nil
+}
+
+// scanDecodedLayers scans the encoded runs of the current document decoded with the layers enabled on the patterns.
+// The matches are added to the pattern matches with the offsets of the encoded runs in the stream.
+func (sh *StreamHandler) scanDecodedLayers() {
+	if !sh.scanning || sh.scanFailed || len(sh.patternsLayers) == 0 {
+		return
+	}
+
+	enabledLayers := make(map[string]bool)
+	for _, layers := range sh.patternsLayers {
+		for _, layer := range layers {
+			enabledLayers[layer] = true
+		}
+	}
+
+	offset := sh.streamLength - sh.buffer.Len()
+	for _, chunk := range decodeChunks(sh.buffer.Bytes(), enabledLayers) {
+		lastMatches := make(map[uint]uint64)
+		onMatch := func(id uint, from uint64, _ uint64, _ uint, _ interface{}) error {
+			if services, isScoped := sh.scopedPatterns[id]; isScoped && !services[sh.servicePort] {
+				return nil // the pattern is used only by rules scoped to other services
+			}
+			if !layersEnabled(sh.patternsLayers[id], chunk.layers) {
+				return nil
+			}
+			if lastFrom, isPresent := lastMatches[id]; isPresent && lastFrom == from {
+				return nil
+			}
+			lastMatches[id] = from
+
+			sh.patternMatches[id] = append(sh.patternMatches[id],
+				PatternSlice{uint64(offset + chunk.start), uint64(offset + chunk.end)})
+			if sh.decodedLayers == nil {
+				sh.decodedLayers = make(map[uint]map[string]bool)
+			}
+			if sh.decodedLayers[id] == nil {
+				sh.decodedLayers[id] = make(map[string]bool)
+			}
+			sh.decodedLayers[id][chunk.Layer()] = true
+			return nil
+		}
+
+		stream, err := sh.patternsDB.Open(0, sh.scanner.scratch, onMatch, nil)
+		if err != nil {
+			log.WithError(err).Error("failed to open the stream of a decoded chunk")
+			return
+		}
+		if err := stream.Scan(chunk.data); err != nil {
+			log.WithError(err).Error("failed to scan a decoded chunk")
+		}
+		if err := stream.Close(); err != nil {
+			log.WithError(err).Error("failed to close the stream of a decoded chunk")
+		}
+	}
+}
+
+// redactMatches overwrites with RedactionByte the bytes matched by the given patterns in the documents and in the
+// prefix, and removes them from the strings of the preview and from the references. The pending documents are redacted
+// in memory, before they are stored; the documents already stored, because the rules have been changed after the
+// stream was opened, are patched. The patterns which must be redacted only in the excluded direction are skipped.
+func (sh *StreamHandler) redactMatches(patterns map[uint]uint8, excludedDirection uint8) {
+	var matches []PatternSlice
+	for id, direction := range patterns {
+		if direction != excludedDirection {
+			matches = append(matches, sh.patternMatches[id]...)
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+
+	secrets := redactPayload(sh.prefix, 0, matches)
+
+	for i, documentID := range sh.documentsIDs {
+		start, end := uint64(sh.documentsStarts[i]), uint64(sh.streamLength)
+		if i+1 < len(sh.documentsStarts) {
+			end = uint64(sh.documentsStarts[i+1])
+		}
+		overlaps := false
+		for _, match := range matches {
+			if match[0] < end && match[1] > start {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			continue
+		}
+		if i < len(sh.pendingDocuments) {
+			secrets = append(secrets, redactPayload(sh.pendingDocuments[i].Payload, start, matches)...)
+			continue
+		}
+
+		var document ConnectionStream
+		if err := sh.connection.Storage().Find(ConnectionStreams).Filter(byID(documentID)).
+			Projection(OrderedDocument{{"payload", 1}}).First(&document); err != nil || document.Payload == nil {
+			log.WithError(err).WithField("id", documentID).Error("failed to find the connection stream to redact")
+			continue
+		}
+		secrets = append(secrets, redactPayload(document.Payload, start, matches)...)
+		if _, err := sh.connection.Storage().Update(ConnectionStreams).Filter(byID(documentID)).
+			One(UnorderedDocument{
+				"payload":        document.Payload,
+				"payload_string": strings.ToValidUTF8(string(document.Payload), ""),
+			}); err != nil {
+			log.WithError(err).WithField("id", documentID).Error("failed to redact the connection stream")
+		}
+	}
+
+	for i := range sh.previewStrings {
+		sh.previewStrings[i] = redactString(sh.previewStrings[i], secrets)
+	}
+	references := make(map[string]bool, len(sh.references))
+	for reference := range sh.references {
+		references[redactString(reference, secrets)] = true
+	}
+	sh.references = references
+}
+
+// redactPayload overwrites with RedactionByte the bytes of payload, which starts at offset in the stream, covered by
+// the matches, and returns a copy of the bytes overwritten by each match.
+func redactPayload(payload []byte, offset uint64, matches []PatternSlice) [][]byte {
+	end := offset + uint64(len(payload))
+	var redacted [][]byte
+	for _, match := range matches {
+		from, to := match[0], match[1]
+		if from < offset {
+			from = offset
+		}
+		if to > end {
+			to = end
+		}
+		if from >= to {
+			continue
+		}
+		redacted = append(redacted, append([]byte{}, payload[from-offset:to-offset]...))
+		for i := from; i < to; i++ {
+			payload[i-offset] = RedactionByte
+		}
+	}
+	return redacted
+}
+
+// redactString overwrites with RedactionByte the occurrences of the secrets in s.
+func redactString(s string, secrets [][]byte) string {
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, string(secret), strings.Repeat(string(RedactionByte), len(secret)))
+	}
+	return s
+}
+
+// storedStream locates the documents of a stream, so that the matched slices can be read after the handler has been
+// completed. The payloads of the pending documents are read from memory.
+type storedStream struct {
+	isClient        bool
+	documentsIDs    []RowID
+	documentsStarts []int
+	length          int
+	payloads        [][]byte // the payloads of the pending documents
+}
+
+func (sh *StreamHandler) storedStream() storedStream {
+	stream := storedStream{
+		isClient:        sh.isClient,
+		documentsIDs:    append([]RowID{}, sh.documentsIDs...),
+		documentsStarts: append([]int{}, sh.documentsStarts...),
+		length:          sh.streamLength,
+	}
+	for _, document := range sh.pendingDocuments {
+		stream.payloads = append(stream.payloads, document.Payload)
+	}
+	return stream
+}
+
+// readMatches returns the bytes of the stored documents covered by each match, truncated to maxSize bytes. The
+// documents are read only once, even if they contain more matches.
+func (ss storedStream) readMatches(storage Storage, matches []PatternSlice, maxSize int) [][]byte {
+	documents := make(map[int][]byte, len(ss.payloads))
+	for i, payload := range ss.payloads {
+		documents[i] = payload
+	}
+	payloads := make([][]byte, 0, len(matches))
+	for _, match := range matches {
+		payload := make([]byte, 0)
+		for i, documentID := range ss.documentsIDs {
+			start, end := uint64(ss.documentsStarts[i]), uint64(ss.length)
+			if i+1 < len(ss.documentsStarts) {
+				end = uint64(ss.documentsStarts[i+1])
+			}
+			if match[0] >= end || match[1] <= start {
+				continue
+			}
+
+			document, isPresent := documents[i]
+			if !isPresent {
+				var stream ConnectionStream
+				if err := storage.Find(ConnectionStreams).Filter(byID(documentID)).
+					Projection(OrderedDocument{{"payload", 1}}).First(&stream); err != nil {
+					log.WithError(err).WithField("id", documentID).Error("failed to find the connection stream")
+				}
+				document = stream.Payload
+				documents[i] = document
+			}
+			from, to := match[0], match[1]
+			if from < start {
+				from = start
+			}
+			if to > start+uint64(len(document)) {
+				to = start + uint64(len(document))
+			}
+			if from < to {
+				payload = append(payload, document[from-start:to-start]...)
+			}
+		}
+		payloads = append(payloads, truncatePayload(payload, maxSize))
 	}
+	return payloads
 }
@@ -18,6 +18,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"github.com/flier/gohs/hyperscan"
 	"github.com/google/gopacket/layers"
@@ -316,10 +317,330 @@ func TestReassemblingPatternMatching(t *testing.T) {
 	wrapper.Destroy(t)
 }
 
+func TestReassemblingSwappedScratches(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(ConnectionStreams)
+	flag, err := hyperscan.ParsePattern("/flag\\{[a-z]+\\}/")
+	require.NoError(t, err)
+	flag.Flags |= hyperscan.SomLeftMost
+	end, err := hyperscan.ParsePattern("/bye$/")
+	require.NoError(t, err)
+	end.Id = 1
+	end.Flags |= hyperscan.SomLeftMost
+
+	patterns, err := hyperscan.NewStreamDatabase(flag, end)
+	require.NoError(t, err)
+	scratch, err := hyperscan.NewScratch(patterns)
+	require.NoError(t, err)
+	otherScratch, err := scratch.Clone()
+	require.NoError(t, err)
+	streamHandler := createTestStreamHandler(wrapper, patterns, scratch)
+	connection := streamHandler.connection.(*testConnectionHandler)
+	connection.otherScratch = otherScratch
+
+	// the match spans three batches, each one scanned with a different scratch of the pool
+	for i, chunk := range []string{"bye", " flag{sus", "pended} bye"} {
+		streamHandler.Reassembled([]tcpassembly.Reassembly{{
+			Bytes: []byte(chunk),
+			Start: i == 0,
+			Seen:  time.Unix(int64(i), 0),
+		}})
+		assert.Zero(t, connection.scannersTaken)
+		assert.NotNil(t, streamHandler.patternStream)
+		assert.False(t, streamHandler.scanFailed)
+	}
+
+	connection.onComplete = func(handler *StreamHandler) {}
+	streamHandler.ReassemblyComplete()
+	assert.Zero(t, connection.scannersTaken)
+
+	assert.Equal(t, map[uint][]PatternSlice{0: {{4, 19}}, 1: {{20, 23}}}, streamHandler.patternMatches)
+
+	err = scratch.Free()
+	require.NoError(t, err, "free scratch")
+	err = otherScratch.Free()
+	require.NoError(t, err, "free other scratch")
+	err = patterns.Close()
+	require.NoError(t, err, "close stream database")
+	wrapper.Destroy(t)
+}
+
+func TestReassemblingDecodedLayers(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(ConnectionStreams)
+	flag, err := hyperscan.ParsePattern("/FLAG\\{\\w+\\}/")
+	require.NoError(t, err)
+	flag.Id = 0
+	flag.Flags |= hyperscan.SomLeftMost
+	plainFlag, err := hyperscan.ParsePattern("/FLAG\\{\\w+\\}/")
+	require.NoError(t, err)
+	plainFlag.Id = 1
+	plainFlag.Flags |= hyperscan.SomLeftMost
+
+	payload := "id=1&data=RkxBR3tzZWNyZXR9&hex=464c41477b6865787d&FLAG{plain}"
+	expected := map[uint][]PatternSlice{
+		0: {{50, 61}, {10, 26}},
+		1: {{50, 61}},
+	}
+
+	patterns, err := hyperscan.NewStreamDatabase(flag, plainFlag)
+	require.NoError(t, err)
+	scratch, err := hyperscan.NewScratch(patterns)
+	require.NoError(t, err)
+	streamHandler := createTestStreamHandler(wrapper, patterns, scratch)
+	streamHandler.patternsLayers = map[uint][]string{0: {DecodeLayerBase64}}
+	streamHandler.connection.(*testConnectionHandler).onComplete = func(handler *StreamHandler) {}
+
+	streamHandler.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte(payload), Start: true, End: true,
+		Seen: time.Unix(0, 0)}})
+	streamHandler.ReassemblyComplete()
+
+	var results []ConnectionStream
+	err = wrapper.Storage.Find(ConnectionStreams).Context(wrapper.Context).All(&results)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, expected, results[0].PatternMatches)
+	assert.Equal(t, map[uint]map[string]bool{0: {DecodeLayerBase64: true}}, streamHandler.decodedLayers)
+
+	// the decoded layers are not scanned for the patterns scoped to other services
+	scopedHandler := createTestStreamHandler(wrapper, patterns, scratch)
+	scopedHandler.patternsLayers = map[uint][]string{0: {DecodeLayerBase64}}
+	scopedHandler.connection.(*testConnectionHandler).onComplete = func(handler *StreamHandler) {}
+	scopedHandler.scopedPatterns = map[uint]map[uint16]bool{0: {scopedHandler.servicePort + 1: true}}
+	scopedHandler.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte(payload), Start: true, End: true,
+		Seen: time.Unix(0, 0)}})
+	scopedHandler.ReassemblyComplete()
+	assert.Equal(t, map[uint][]PatternSlice{1: {{50, 61}}}, scopedHandler.patternMatches)
+	assert.Empty(t, scopedHandler.decodedLayers)
+
+	err = scratch.Free()
+	require.NoError(t, err, "free scratch")
+	err = patterns.Close()
+	require.NoError(t, err, "close stream database")
+	wrapper.Destroy(t)
+}
+
+func TestDecodeChunks(t *testing.T) {
+	checkChunks := func(data string, enabledLayers []string, expected ...decodedChunk) {
+		enabled := make(map[string]bool)
+		for _, layer := range enabledLayers {
+			enabled[layer] = true
+		}
+		assert.Equal(t, expected, decodeChunks([]byte(data), enabled))
+	}
+
+	checkChunks("token=RkxBR3tuZXN0ZWRfdXJsfQ%3D%3D", []string{DecodeLayerURL, DecodeLayerBase64},
+		decodedChunk{[]string{"url"}, 0, 34, []byte("token=RkxBR3tuZXN0ZWRfdXJsfQ==")},
+		decodedChunk{[]string{"url", "base64"}, 0, 34, []byte("FLAG{nested_url}")},
+		decodedChunk{[]string{"base64"}, 6, 28, []byte("FLAG{nested_url}")})
+	checkChunks("token=RkxBR3tuZXN0ZWRfdXJsfQ%3D%3D", []string{DecodeLayerBase64},
+		decodedChunk{[]string{"base64"}, 6, 28, []byte("FLAG{nested_url}")})
+	checkChunks("flag: 464c41477b6865787d;", []string{DecodeLayerHex},
+		decodedChunk{[]string{"hex"}, 6, 24, []byte("FLAG{hex}")})
+	checkChunks("nothing to decode here", []string{DecodeLayerURL, DecodeLayerBase64, DecodeLayerHex})
+
+	assert.Equal(t, "url>base64", decodedChunk{layers: []string{"url", "base64"}}.Layer())
+	assert.True(t, layersEnabled([]string{"base64", "url"}, []string{"url", "base64"}))
+	assert.False(t, layersEnabled([]string{"base64"}, []string{"url", "base64"}))
+	assert.Equal(t, []string{"base64", "hex"}, normalizeDecodeLayers([]string{"hex", "base64", "hex"}))
+}
+
+func TestReassemblingStorageLimits(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(ConnectionStreams)
+	login, err := hyperscan.ParsePattern("/login/")
+	require.NoError(t, err)
+	login.Id = 0
+	login.Flags |= hyperscan.SomLeftMost
+
+	patterns, err := hyperscan.NewStreamDatabase(login)
+	require.NoError(t, err)
+	scratch, err := hyperscan.NewScratch(patterns)
+	require.NoError(t, err)
+
+	limits := StorageLimitsSettings{MaxStreamSize: 16, ExtendedMaxStreamSize: 64, MaxStreamDuration: 10}
+	reassemble := func(extendPatterns map[uint]bool, blocks ...string) (*StreamHandler, []byte) {
+		streamHandler := createTestStreamHandler(wrapper, patterns, scratch)
+		streamHandler.limits = limits
+		streamHandler.extendPatterns = extendPatterns
+		streamHandler.connection.(*testConnectionHandler).onComplete = func(handler *StreamHandler) {}
+
+		for i, block := range blocks {
+			streamHandler.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte(block), Start: i == 0,
+				Seen: time.Unix(int64(i), 0)}})
+		}
+		streamHandler.ReassemblyComplete()
+
+		var result ConnectionStream
+		require.NoError(t, wrapper.Storage.Find(ConnectionStreams).Context(wrapper.Context).
+			Filter(byID(streamHandler.documentsIDs[0])).First(&result))
+		return &streamHandler, result.Payload
+	}
+
+	streamHandler, payload := reassemble(nil, "GET /login", " HTTP/1.1\r\n", "Host: example.com\r\n")
+	assert.Equal(t, "GET /login HTTP/", string(payload))
+	assert.True(t, streamHandler.truncated)
+	assert.False(t, streamHandler.captureExtended)
+	assert.Equal(t, 16, streamHandler.streamLength)
+	assert.Equal(t, 24, streamHandler.droppedBytes)
+
+	streamHandler, payload = reassemble(map[uint]bool{0: true}, "GET /login", " HTTP/1.1\r\n", "Host: example.com\r\n")
+	assert.Equal(t, "GET /login HTTP/1.1\r\nHost: example.com\r\n", string(payload))
+	assert.False(t, streamHandler.truncated)
+	assert.True(t, streamHandler.captureExtended)
+
+	// the bytes received after the maximum duration are not stored
+	streamHandler, payload = reassemble(nil, "a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m")
+	assert.Equal(t, "abcdefghijk", string(payload))
+	assert.True(t, streamHandler.truncated)
+	assert.Equal(t, 2, streamHandler.droppedBytes)
+
+	err = scratch.Free()
+	require.NoError(t, err, "free scratch")
+	err = patterns.Close()
+	require.NoError(t, err, "close stream database")
+	wrapper.Destroy(t)
+}
+
+func TestScopedPatternsMatches(t *testing.T) {
+	streamHandler := StreamHandler{
+		patternMatches: make(map[uint][]PatternSlice),
+		scopedPatterns: map[uint]map[uint16]bool{1: {8080: true}},
+		servicePort:    80,
+	}
+	require.NoError(t, streamHandler.onMatch(0, 0, 4, 0, nil))
+	require.NoError(t, streamHandler.onMatch(1, 0, 4, 0, nil))
+	assert.Equal(t, map[uint][]PatternSlice{0: {{0, 4}}}, streamHandler.patternMatches)
+
+	streamHandler.servicePort = 8080
+	require.NoError(t, streamHandler.onMatch(1, 0, 4, 0, nil))
+	assert.Equal(t, map[uint][]PatternSlice{0: {{0, 4}}, 1: {{0, 4}}}, streamHandler.patternMatches)
+}
+
+func TestAllowedBytes(t *testing.T) {
+	start := time.Unix(1000, 0)
+	streamHandler := &StreamHandler{firstPacketSeen: start, streamLength: 100}
+	assert.Equal(t, 50, streamHandler.allowedBytes(start.Add(time.Hour), 50))
+
+	streamHandler.limits = StorageLimitsSettings{MaxStreamSize: 120, MaxStreamDuration: 60}
+	assert.Equal(t, 20, streamHandler.allowedBytes(start, 50))
+	assert.Equal(t, 10, streamHandler.allowedBytes(start.Add(time.Minute), 10))
+	assert.Zero(t, streamHandler.allowedBytes(start.Add(time.Minute+time.Second), 10))
+
+	streamHandler.captureExtended = true
+	assert.Equal(t, 50, streamHandler.allowedBytes(start.Add(time.Hour), 50))
+	streamHandler.limits.ExtendedMaxStreamSize = 80
+	assert.Zero(t, streamHandler.allowedBytes(start, 10))
+}
+
+func TestExtractReferences(t *testing.T) {
+	references := make(map[string]bool)
+	extractReferences([]byte("GET /backup HTTP/1.1\r\nHost: 10.10.0.1\r\n\r\n"+
+		"see http://Backup.corp.local:8080/dump.tar.gz, or ask admin@Files.internal; index.html 999.1.1.1"),
+		references)
+
+	assert.Equal(t, map[string]bool{
+		"10.10.0.1": true,
+		"http://Backup.corp.local:8080/dump.tar.gz": true,
+		"backup.corp.local":                         true,
+		"files.internal":                            true,
+	}, references)
+
+	assert.Equal(t, []string{"10.10.0.1", "backup.corp.local", "files.internal"},
+		mergeReferences(map[string]bool{"files.internal": true, "10.10.0.1": true},
+			map[string]bool{"backup.corp.local": true, "10.10.0.1": true}))
+	assert.Nil(t, mergeReferences(map[string]bool{}, nil))
+
+	references = make(map[string]bool)
+	for i := 0; i < maxStreamReferences+10; i++ {
+		extractReferences([]byte(net.IPv4(10, 0, byte(i/256), byte(i%256)).String()), references)
+	}
+	assert.Len(t, references, maxStreamReferences)
+}
+
+func TestRedactPayload(t *testing.T) {
+	payload := []byte("user=admin&password=secret")
+	redactPayload(payload, 0, []PatternSlice{{11, 26}})
+	assert.Equal(t, "user=admin&***************", string(payload))
+
+	// the matches are offsets in the stream, the payload is the second document of the stream
+	payload = []byte("token=abcdef; other")
+	redacted := redactPayload(payload, 100, []PatternSlice{{90, 104}, {112, 119}, {200, 210}})
+	assert.Equal(t, "****n=abcdef*******", string(payload))
+	assert.Equal(t, [][]byte{[]byte("toke"), []byte("; other")}, redacted)
+}
+
+func TestRedactPreviewsAndReferences(t *testing.T) {
+	prefix := []byte("\x00\x01key=s3cr3t.example.com\x00")
+	handler := &StreamHandler{
+		prefix:         prefix,
+		previewStrings: []string{"key=s3cr3t.example.com", "other"},
+		references:     map[string]bool{"s3cr3t.example.com": true, "10.10.0.1": true},
+		patternMatches: map[uint][]PatternSlice{1: {{6, 12}}, 2: {{2, 5}}},
+		streamLength:   len(prefix),
+	}
+	handler.redactMatches(map[uint]uint8{1: DirectionBoth, 2: DirectionToClient}, DirectionToClient)
+	assert.Equal(t, "\x00\x01key=******.example.com\x00", string(handler.prefix))
+	assert.Equal(t, []string{"key=******.example.com", "other"}, handler.previewStrings)
+	assert.Equal(t, map[string]bool{"******.example.com": true, "10.10.0.1": true}, handler.references)
+}
+
+func TestRedactPendingDocuments(t *testing.T) {
+	handler := &StreamHandler{
+		references:      make(map[string]bool),
+		redactPatterns:  map[uint]bool{1: true},
+		patternMatches:  map[uint][]PatternSlice{1: {{4, 10}}},
+		documentsIDs:    []RowID{NewRowID(), NewRowID()},
+		documentsStarts: []int{0, 8},
+		streamLength:    16,
+		pendingDocuments: []ConnectionStream{
+			{Payload: []byte("key=s3cr")},
+			{Payload: []byte("3t; next")},
+		},
+	}
+	handler.redactMatches(map[uint]uint8{1: DirectionBoth}, DirectionToClient)
+	assert.Equal(t, "key=****", string(handler.pendingDocuments[0].Payload))
+	assert.Equal(t, "**; next", string(handler.pendingDocuments[1].Payload))
+}
+
+func TestBuildStreamPreview(t *testing.T) {
+	assert.Nil(t, buildStreamPreview(nil, 0, nil))
+	assert.Nil(t, buildStreamPreview([]byte("GET / HTTP/1.1\r\nHost: web\r\n\r\n"), 29, nil))
+
+	message := []byte("\x00\x00\x00\x0e\x01\x02menu\x00\xffchoice")
+	extractedStrings := extractPrintableStrings(message, nil)
+	assert.Equal(t, []string{"menu", "choice"}, extractedStrings)
+	preview := buildStreamPreview(message, len(message), extractedStrings)
+	require.NotNil(t, preview)
+	assert.Equal(t, "u32be", preview.LengthField)
+	assert.Equal(t, "", preview.FileType)
+	assert.Equal(t, "0000000e01026d656e7500ff63686f696365", preview.Hex)
+	assert.Equal(t, []string{"menu", "choice"}, preview.Strings)
+
+	elf := append([]byte("\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00"), make([]byte, 64)...)
+	preview = buildStreamPreview(elf, 4, nil)
+	require.NotNil(t, preview)
+	assert.Equal(t, "elf", preview.FileType)
+	assert.Len(t, preview.Hex, previewHexSize*2)
+
+	assert.Equal(t, "u16le", detectLengthField([]byte("\x05\x00abc"), 5))
+	assert.Equal(t, "", detectLengthField([]byte("\x00\x00\x00\x00abc"), 7))
+
+	var many []byte
+	for i := 0; i < previewMaxStrings+4; i++ {
+		many = append(many, []byte("string\x00")...)
+	}
+	assert.Len(t, extractPrintableStrings(many, nil), previewMaxStrings)
+	long := extractPrintableStrings(bytes.Repeat([]byte("A"), previewMaxStringLength*2), nil)
+	require.Len(t, long, 1)
+	assert.Len(t, long[0], previewMaxStringLength)
+}
+
 func createTestStreamHandler(wrapper *TestStorageWrapper, patterns hyperscan.StreamDatabase, scratch *hyperscan.Scratch) StreamHandler {
 	testConnectionHandler := &testConnectionHandler{
 		wrapper:  wrapper,
 		patterns: patterns,
+		scratch:  scratch,
 	}
 
 	srcIP := layers.NewIPEndpoint(net.ParseIP(testSrcIP))
@@ -327,14 +648,21 @@ func createTestStreamHandler(wrapper *TestStorageWrapper, patterns hyperscan.Str
 	srcPort := layers.NewTCPPortEndpoint(srcPort)
 	dstPort := layers.NewTCPPortEndpoint(dstPort)
 
-	scanner := Scanner{scratch: scratch, version: ZeroRowID}
-	return NewStreamHandler(testConnectionHandler, StreamFlow{srcIP, dstIP, srcPort, dstPort}, scanner, true) // TODO: test isClient
+	return NewStreamHandler(testConnectionHandler, StreamFlow{srcIP, dstIP, srcPort, dstPort}, true) // TODO: test isClient
 }
 
 type testConnectionHandler struct {
-	wrapper    *TestStorageWrapper
-	patterns   hyperscan.StreamDatabase
-	onComplete func(*StreamHandler)
+	wrapper        *TestStorageWrapper
+	patterns       hyperscan.StreamDatabase
+	scratch        *hyperscan.Scratch
+	otherScratch   *hyperscan.Scratch
+	scannersTaken  int
+	scannersCount  int
+	decodeLayers   map[uint][]string
+	extendPatterns map[uint]bool
+	scopedPatterns map[uint]map[uint16]bool
+	limits         StorageLimitsSettings
+	onComplete     func(*StreamHandler)
 }
 
 func (tch *testConnectionHandler) Storage() Storage {
@@ -345,12 +673,30 @@ func (tch *testConnectionHandler) Context() context.Context {
 	return tch.wrapper.Context
 }
 
-func (tch *testConnectionHandler) PatternsDatabase() hyperscan.StreamDatabase {
-	return tch.patterns
+func (tch *testConnectionHandler) PatternsDatabase(_ uint16) StreamPatterns {
+	return StreamPatterns{Database: tch.patterns, Version: ZeroRowID, Size: 8, DecodeLayers: tch.decodeLayers,
+		ExtendCapture: tch.extendPatterns}
+}
+
+func (tch *testConnectionHandler) TakeScanner() Scanner {
+	tch.scannersTaken++
+	tch.scannersCount++
+	if tch.otherScratch != nil && tch.scannersCount%2 == 0 {
+		return Scanner{scratch: tch.otherScratch, version: ZeroRowID}
+	}
+	return Scanner{scratch: tch.scratch, version: ZeroRowID}
+}
+
+func (tch *testConnectionHandler) ReleaseScanner(_ Scanner) {
+	tch.scannersTaken--
+}
+
+func (tch *testConnectionHandler) PatternsServices() map[uint]map[uint16]bool {
+	return tch.scopedPatterns
 }
 
-func (tch *testConnectionHandler) PatternsDatabaseSize() int {
-	return 8
+func (tch *testConnectionHandler) StorageLimits() StorageLimitsSettings {
+	return tch.limits
 }
 
 func (tch *testConnectionHandler) Complete(handler *StreamHandler) {
@@ -0,0 +1,291 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf16"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PayloadFormatRaw       = "raw"
+	PayloadFormatHexdump   = "hexdump"
+	PayloadFormatPrintable = "printable"
+	PayloadFormatBase64    = "base64"
+	PayloadFormatGzip      = "gzip"
+	PayloadFormatUTF16     = "utf16"
+)
+
+const defaultPayloadLength = 64 * 1024
+const maxDecodedPayloadSize = 16 * 1024 * 1024
+const hexdumpLineSize = 16
+
+var gzipMagic = []byte("\x1f\x8b")
+
+// PayloadRequest selects a range of the client or of the server stream of a connection and the view used to render
+// it. Offset and Length are relative to the stream for the raw, hexdump, printable and utf16 views, and to the decoded
+// stream for the base64 and gzip views, which must decode the whole stream.
+type PayloadRequest struct {
+	Format     string `form:"format" binding:"omitempty,oneof=raw hexdump printable base64 gzip utf16"`
+	FromClient bool   `form:"from_client"`
+	Offset     int    `form:"offset" binding:"min=0"`
+	Length     int    `form:"length" binding:"omitempty,min=1,max=1048576"`
+}
+
+// StreamPayload is a range of a stream rendered with a view. TotalLength is the length of the stream, or of the
+// decoded stream for the decoding views, and NextOffset is the offset of the next range, zero if the range is the last.
+type StreamPayload struct {
+	Format      string `json:"format"`
+	FromClient  bool   `json:"from_client"`
+	Offset      int    `json:"offset"`
+	Length      int    `json:"length"`
+	TotalLength int    `json:"total_length"`
+	NextOffset  int    `json:"next_offset"`
+	Content     string `json:"content"`
+}
+
+// GetStreamPayload returns a range of a stream of the connection rendered with the requested view. Only the stream
+// documents overlapping the range are read, except for the decoding views. Returns false if the connection does not
+// exist, or an error if the stream can't be decoded.
+func (csc ConnectionStreamsController) GetStreamPayload(c context.Context, connectionID RowID,
+	request PayloadRequest) (StreamPayload, bool, error) {
+	connection := csc.getConnection(c, connectionID)
+	if connection.ID.IsZero() {
+		return StreamPayload{}, false, nil
+	}
+
+	if request.Format == "" {
+		request.Format = PayloadFormatRaw
+	}
+	if request.Length == 0 {
+		request.Length = defaultPayloadLength
+	}
+	if request.Format == PayloadFormatUTF16 { // code units must not be split
+		request.Offset -= request.Offset % 2
+		request.Length += request.Length % 2
+	}
+
+	payload := StreamPayload{
+		Format:     request.Format,
+		FromClient: request.FromClient,
+		Offset:     request.Offset,
+	}
+
+	var data []byte
+	switch request.Format {
+	case PayloadFormatBase64, PayloadFormatGzip:
+		var decoded []byte
+		var err error
+		stream := csc.getStreamPayload(c, connectionID, request.FromClient)
+		if request.Format == PayloadFormatBase64 {
+			decoded, err = decodeBase64Payload(stream)
+		} else {
+			decoded, err = decompressGzipPayload(stream)
+		}
+		if err != nil {
+			return StreamPayload{}, true, err
+		}
+		payload.TotalLength = len(decoded)
+		if request.Offset < len(decoded) {
+			end := request.Offset + request.Length
+			if end > len(decoded) {
+				end = len(decoded)
+			}
+			data = decoded[request.Offset:end]
+		}
+	default:
+		if request.FromClient {
+			payload.TotalLength = connection.ClientBytes
+		} else {
+			payload.TotalLength = connection.ServerBytes
+		}
+		data = csc.getStreamRange(c, connectionID, request.FromClient, request.Offset, request.Length)
+	}
+
+	payload.Length = len(data)
+	if end := request.Offset + len(data); len(data) == request.Length && end < payload.TotalLength {
+		payload.NextOffset = end
+	}
+	payload.Content = renderPayload(data, request.Format, request.Offset)
+
+	return payload, true, nil
+}
+
+// getStreamRange returns length bytes of one side of a connection starting from offset, reading only the stream
+// documents which overlap the range.
+func (csc ConnectionStreamsController) getStreamRange(c context.Context, connectionID RowID, fromClient bool,
+	offset, length int) []byte {
+	var data []byte
+	documentStart := 0
+	for documentIndex := 0; len(data) < length; documentIndex++ {
+		var stream ConnectionStream
+		if err := csc.storage.Find(ConnectionStreams).Context(c).Filter(OrderedDocument{
+			{"connection_id", connectionID},
+			{"from_client", fromClient},
+			{"document_index", documentIndex},
+		}).Projection(OrderedDocument{{"payload", 1}}).First(&stream); err != nil {
+			log.WithError(err).WithField("connection_id", connectionID).Panic("failed to get a ConnectionStream")
+		}
+		if stream.ID.IsZero() {
+			break
+		}
+
+		documentEnd := documentStart + len(stream.Payload)
+		if documentEnd > offset {
+			start := 0
+			if offset > documentStart {
+				start = offset - documentStart
+			}
+			end := start + length - len(data)
+			if end > len(stream.Payload) {
+				end = len(stream.Payload)
+			}
+			data = append(data, stream.Payload[start:end]...)
+		}
+		documentStart = documentEnd
+	}
+
+	return data
+}
+
+// renderPayload returns the data in the format of the view. The offset is the position of the data in the stream,
+// used by the hexdump view.
+func renderPayload(data []byte, format string, offset int) string {
+	switch format {
+	case PayloadFormatHexdump:
+		return hexdumpAt(data, offset)
+	case PayloadFormatPrintable:
+		return escapeNonPrintable(data)
+	case PayloadFormatUTF16:
+		return decodeUTF16(data)
+	default:
+		return string(data)
+	}
+}
+
+// hexdumpAt is like hex.Dump, but the offsets of the lines start from offset instead of zero.
+func hexdumpAt(data []byte, offset int) string {
+	var sb strings.Builder
+	for i := 0; i < len(data); i += hexdumpLineSize {
+		end := i + hexdumpLineSize
+		if end > len(data) {
+			end = len(data)
+		}
+		line := hex.Dump(data[i:end])
+		sb.WriteString(fmt.Sprintf("%08x", offset+i))
+		sb.WriteString(line[8:])
+	}
+	return sb.String()
+}
+
+// escapeNonPrintable keeps the printable ASCII characters, the new lines and the tabs, and escapes the other bytes
+// with the Go notation. Backslashes are escaped to keep the result unambiguous.
+func escapeNonPrintable(data []byte) string {
+	var sb strings.Builder
+	sb.Grow(len(data))
+	for _, b := range data {
+		switch {
+		case b == '\\':
+			sb.WriteString(`\\`)
+		case b == '\n' || b == '\t' || isPrintable(b):
+			sb.WriteByte(b)
+		case b == '\r':
+			sb.WriteString(`\r`)
+		default:
+			sb.WriteString(fmt.Sprintf(`\x%02x`, b))
+		}
+	}
+	return sb.String()
+}
+
+// decodeUTF16 decodes little-endian UTF-16, or big-endian if the data starts with the byte order mark. An odd
+// trailing byte is ignored.
+func decodeUTF16(data []byte) string {
+	bigEndian := len(data) >= 2 && data[0] == 0xfe && data[1] == 0xff
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		if bigEndian {
+			units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+		} else {
+			units = append(units, uint16(data[i+1])<<8|uint16(data[i]))
+		}
+	}
+
+	var sb strings.Builder
+	for _, r := range utf16.Decode(units) {
+		if r != '\ufeff' {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// decodeBase64Payload decodes the stream ignoring the white spaces, accepting both the standard and the url alphabet,
+// with or without padding.
+func decodeBase64Payload(stream []byte) ([]byte, error) {
+	stripped := bytes.Map(func(r rune) rune {
+		if r == ' ' || r == '\n' || r == '\r' || r == '\t' {
+			return -1
+		}
+		return r
+	}, stream)
+
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding,
+		base64.RawURLEncoding} {
+		if decoded, err := encoding.DecodeString(string(stripped)); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, errors.New("the stream is not base64 encoded")
+}
+
+// decompressGzipPayload decompresses the first gzip member found in the stream, so that the compressed bodies of the
+// http messages can be decoded without removing the headers. At most maxDecodedPayloadSize bytes are decompressed,
+// and the data decompressed before the end of a truncated stream is returned without errors.
+func decompressGzipPayload(stream []byte) ([]byte, error) {
+	start := bytes.Index(stream, gzipMagic)
+	if start < 0 {
+		return nil, errors.New("the stream does not contain gzip data")
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(stream[start:]))
+	if err != nil {
+		return nil, err
+	}
+	reader.Multistream(false)
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, maxDecodedPayloadSize))
+	if err != nil && len(decompressed) == 0 {
+		return nil, err
+	}
+	return decompressed, nil
+}
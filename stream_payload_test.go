@@ -0,0 +1,111 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderPayload(t *testing.T) {
+	assert.Equal(t, "00000010  41 42 43 44 45 46 47 48  49 4a 4b 4c 4d 4e 4f 50  |ABCDEFGHIJKLMNOP|\n"+
+		"00000020  51                                                |Q|\n",
+		renderPayload([]byte("ABCDEFGHIJKLMNOPQ"), PayloadFormatHexdump, 16))
+	assert.Equal(t, "GET /\\\\ HTTP/1.1\\r\n\\x00\\xff", renderPayload([]byte("GET /\\ HTTP/1.1\r\n\x00\xff"),
+		PayloadFormatPrintable, 0))
+	assert.Equal(t, "flag", renderPayload([]byte("f\x00l\x00a\x00g\x00"), PayloadFormatUTF16, 0))
+	assert.Equal(t, "flag", renderPayload([]byte("\xfe\xff\x00f\x00l\x00a\x00g"), PayloadFormatUTF16, 0))
+	assert.Equal(t, "raw\x00", renderPayload([]byte("raw\x00"), PayloadFormatRaw, 0))
+}
+
+func TestDecodePayloads(t *testing.T) {
+	decoded, err := decodeBase64Payload([]byte("ZmxhZ3t0\r\nZXN0fQ=="))
+	require.NoError(t, err)
+	assert.Equal(t, "flag{test}", string(decoded))
+	decoded, err = decodeBase64Payload([]byte("ZmxhZ3t0ZXN0fQ"))
+	require.NoError(t, err)
+	assert.Equal(t, "flag{test}", string(decoded))
+	_, err = decodeBase64Payload([]byte("not base64!"))
+	assert.Error(t, err)
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err = writer.Write([]byte("flag{gzip}"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	response := append([]byte("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\n\r\n"), compressed.Bytes()...)
+	decoded, err = decompressGzipPayload(response)
+	require.NoError(t, err)
+	assert.Equal(t, "flag{gzip}", string(decoded))
+	_, err = decompressGzipPayload([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	assert.Error(t, err)
+}
+
+func TestGetStreamPayload(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+
+	controller := NewConnectionStreamsController(wrapper.Storage, nil)
+	connectionID := NewRowID()
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(Connection{ID: connectionID,
+		ClientBytes: 19, ServerBytes: 12})
+	require.NoError(t, err)
+	_, err = wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).Many([]interface{}{
+		ConnectionStream{ID: NewRowID(), ConnectionID: connectionID, FromClient: true, DocumentIndex: 0,
+			Payload: []byte("hello world")},
+		ConnectionStream{ID: NewRowID(), ConnectionID: connectionID, FromClient: true, DocumentIndex: 1,
+			Payload: []byte("AAAABBBB")},
+		ConnectionStream{ID: NewRowID(), ConnectionID: connectionID, FromClient: false, DocumentIndex: 0,
+			Payload: []byte("ZmxhZ3t9Cg==")},
+	})
+	require.NoError(t, err)
+
+	_, found, _ := controller.GetStreamPayload(wrapper.Context, NewRowID(), PayloadRequest{})
+	assert.False(t, found)
+
+	payload, found, err := controller.GetStreamPayload(wrapper.Context, connectionID,
+		PayloadRequest{FromClient: true, Offset: 6, Length: 8})
+	require.True(t, found)
+	require.NoError(t, err)
+	assert.Equal(t, StreamPayload{Format: PayloadFormatRaw, FromClient: true, Offset: 6, Length: 8, TotalLength: 19,
+		NextOffset: 14, Content: "worldAAA"}, payload)
+
+	payload, _, err = controller.GetStreamPayload(wrapper.Context, connectionID,
+		PayloadRequest{FromClient: true, Offset: 14})
+	require.NoError(t, err)
+	assert.Equal(t, "ABBBB", payload.Content)
+	assert.Zero(t, payload.NextOffset)
+
+	payload, _, err = controller.GetStreamPayload(wrapper.Context, connectionID,
+		PayloadRequest{Format: PayloadFormatBase64})
+	require.NoError(t, err)
+	assert.Equal(t, "flag{}\n", payload.Content)
+	assert.Equal(t, 7, payload.TotalLength)
+
+	_, found, err = controller.GetStreamPayload(wrapper.Context, connectionID,
+		PayloadRequest{FromClient: true, Format: PayloadFormatGzip})
+	assert.True(t, found)
+	assert.Error(t, err)
+
+	wrapper.Destroy(t)
+}
@@ -0,0 +1,177 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+const (
+	previewMaxStrings      = 16
+	previewMinStringLength = 4
+	previewMaxStringLength = 64
+	previewHexSize         = 32
+	// previewTextualRatio is the minimum ratio of printable characters of the textual streams
+	previewTextualRatio = 0.9
+)
+
+// StreamPreview summarizes the content of a non-textual stream, so that binary protocols are recognizable without
+// opening the connection. FileType is identified by the magic bytes, LengthField is the encoding of the integer
+// at the start of the first message which contains its length (e.g. u32be), Strings are the sequences of printable
+// characters found in the stream, as strings(1) does.
+type StreamPreview struct {
+	FileType    string   `json:"file_type,omitempty" bson:"file_type,omitempty"`
+	LengthField string   `json:"length_field,omitempty" bson:"length_field,omitempty"`
+	Strings     []string `json:"strings,omitempty" bson:"strings,omitempty"`
+	Hex         string   `json:"hex" bson:"hex"`
+}
+
+var magicBytes = []struct {
+	magic    []byte
+	fileType string
+}{
+	{[]byte("\x7fELF"), "elf"},
+	{[]byte("MZ"), "pe"},
+	{[]byte("\xfe\xed\xfa\xce"), "mach-o"},
+	{[]byte("\xfe\xed\xfa\xcf"), "mach-o"},
+	{[]byte("\xce\xfa\xed\xfe"), "mach-o"},
+	{[]byte("\xcf\xfa\xed\xfe"), "mach-o"},
+	{[]byte("\xca\xfe\xba\xbe"), "java-class"},
+	{[]byte("\x89PNG\r\n\x1a\n"), "png"},
+	{[]byte("\xff\xd8\xff"), "jpeg"},
+	{[]byte("GIF87a"), "gif"},
+	{[]byte("GIF89a"), "gif"},
+	{[]byte("%PDF-"), "pdf"},
+	{[]byte("PK\x03\x04"), "zip"},
+	{[]byte("\x1f\x8b"), "gzip"},
+	{[]byte("BZh"), "bzip2"},
+	{[]byte("\xfd7zXZ\x00"), "xz"},
+	{[]byte("7z\xbc\xaf\x27\x1c"), "7z"},
+	{[]byte("\x28\xb5\x2f\xfd"), "zstd"},
+	{[]byte("SQLite format 3\x00"), "sqlite"},
+	{[]byte("\x80\x02"), "python-pickle"},
+	{[]byte("\x80\x03"), "python-pickle"},
+	{[]byte("\x80\x04\x95"), "python-pickle"},
+	{[]byte("\x80\x05\x95"), "python-pickle"},
+	{[]byte("\xac\xed\x00\x05"), "java-serialization"},
+	{[]byte("\x16\x03"), "tls"},
+}
+
+// buildStreamPreview returns the preview of a stream given its first bytes, the size of its first block and the
+// strings extracted from it. Returns nil if the stream is empty or textual.
+func buildStreamPreview(prefix []byte, firstBlockSize int, extractedStrings []string) *StreamPreview {
+	if len(prefix) == 0 || isTextual(prefix) {
+		return nil
+	}
+
+	preview := &StreamPreview{
+		FileType:    identifyFileType(prefix),
+		LengthField: detectLengthField(prefix, firstBlockSize),
+		Strings:     extractedStrings,
+	}
+	if len(prefix) > previewHexSize {
+		preview.Hex = hex.EncodeToString(prefix[:previewHexSize])
+	} else {
+		preview.Hex = hex.EncodeToString(prefix)
+	}
+
+	return preview
+}
+
+func isTextual(data []byte) bool {
+	printable := 0
+	for _, c := range data {
+		if isPrintable(c) || c == '\r' || c == '\n' || c == '\t' {
+			printable++
+		}
+	}
+	return float64(printable) >= float64(len(data))*previewTextualRatio
+}
+
+func isPrintable(c byte) bool {
+	return c >= 0x20 && c < 0x7f
+}
+
+func identifyFileType(data []byte) string {
+	for _, magic := range magicBytes {
+		if bytes.HasPrefix(data, magic.magic) {
+			return magic.fileType
+		}
+	}
+	return ""
+}
+
+// detectLengthField checks if the first message starts with an integer equal to the length of the message, with or
+// without the integer itself. The wider integers are checked first, because they are less likely to be false
+// positives.
+func detectLengthField(data []byte, messageSize int) string {
+	if messageSize > len(data) {
+		messageSize = len(data)
+	}
+	matches := func(value uint64, width int) bool {
+		return value > 0 && (value == uint64(messageSize) || value == uint64(messageSize-width))
+	}
+
+	if messageSize > 8 && matches(binary.BigEndian.Uint64(data), 8) {
+		return "u64be"
+	}
+	if messageSize > 8 && matches(binary.LittleEndian.Uint64(data), 8) {
+		return "u64le"
+	}
+	if messageSize > 4 && matches(uint64(binary.BigEndian.Uint32(data)), 4) {
+		return "u32be"
+	}
+	if messageSize > 4 && matches(uint64(binary.LittleEndian.Uint32(data)), 4) {
+		return "u32le"
+	}
+	if messageSize > 2 && matches(uint64(binary.BigEndian.Uint16(data)), 2) {
+		return "u16be"
+	}
+	if messageSize > 2 && matches(uint64(binary.LittleEndian.Uint16(data)), 2) {
+		return "u16le"
+	}
+	if messageSize > 3 && matches(uint64(data[0]), 1) {
+		return "u8"
+	}
+	return ""
+}
+
+// extractPrintableStrings appends to extractedStrings the sequences of at least previewMinStringLength printable characters
+// found in data, until previewMaxStrings are collected. The long sequences are truncated.
+func extractPrintableStrings(data []byte, extractedStrings []string) []string {
+	start := -1
+	for i := 0; i <= len(data) && len(extractedStrings) < previewMaxStrings; i++ {
+		if i < len(data) && (isPrintable(data[i]) || data[i] == '\t') {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && i-start >= previewMinStringLength {
+			end := i
+			if end-start > previewMaxStringLength {
+				end = start + previewMaxStringLength
+			}
+			extractedStrings = append(extractedStrings, string(data[start:end]))
+		}
+		start = -1
+	}
+	return extractedStrings
+}
@@ -0,0 +1,132 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+const (
+	tlsExtensionSupportedGroups = 10
+	tlsExtensionPointFormats    = 11
+)
+
+// ja3Fingerprint returns the JA3 fingerprint of the TLS ClientHello at the start of data: the md5 of the version, the
+// cipher suites, the extensions, the elliptic curves and the point formats sent by the client. The GREASE values are
+// ignored. An empty string is returned if data does not start with a ClientHello or if it is truncated.
+func ja3Fingerprint(data []byte) string {
+	// record header: content type (handshake), version, length; handshake header: type (client hello), length
+	if len(data) < 9+2+32 || data[0] != 0x16 || data[1] != 0x03 || data[5] != 0x01 {
+		return ""
+	}
+
+	version := binary.BigEndian.Uint16(data[9:])
+	cursor := 9 + 2 + 32 // client version and random
+	readVector := func(lengthSize int) ([]byte, bool) {
+		if cursor+lengthSize > len(data) {
+			return nil, false
+		}
+		var length int
+		for i := 0; i < lengthSize; i++ {
+			length = length<<8 | int(data[cursor+i])
+		}
+		cursor += lengthSize
+		if cursor+length > len(data) {
+			return nil, false
+		}
+		vector := data[cursor : cursor+length]
+		cursor += length
+		return vector, true
+	}
+
+	var ciphers, extensions []byte
+	var ok bool
+	if _, ok = readVector(1); !ok { // session id
+		return ""
+	}
+	if ciphers, ok = readVector(2); !ok {
+		return ""
+	}
+	if _, ok = readVector(1); !ok { // compression methods
+		return ""
+	}
+	if cursor < len(data) {
+		if extensions, ok = readVector(2); !ok {
+			return ""
+		}
+	}
+
+	var extensionTypes, curves, pointFormats []string
+	for len(extensions) >= 4 {
+		extensionType := binary.BigEndian.Uint16(extensions)
+		extensionLength := int(binary.BigEndian.Uint16(extensions[2:]))
+		if 4+extensionLength > len(extensions) {
+			return ""
+		}
+		extension := extensions[4 : 4+extensionLength]
+		extensions = extensions[4+extensionLength:]
+		if isGREASE(extensionType) {
+			continue
+		}
+		extensionTypes = append(extensionTypes, strconv.Itoa(int(extensionType)))
+
+		switch extensionType {
+		case tlsExtensionSupportedGroups:
+			if len(extension) >= 2 {
+				curves = uint16Values(extension[2:])
+			}
+		case tlsExtensionPointFormats:
+			if len(extension) >= 1 {
+				for _, format := range extension[1:] {
+					pointFormats = append(pointFormats, strconv.Itoa(int(format)))
+				}
+			}
+		}
+	}
+
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(version)),
+		strings.Join(uint16Values(ciphers), "-"),
+		strings.Join(extensionTypes, "-"),
+		strings.Join(curves, "-"),
+		strings.Join(pointFormats, "-"),
+	}, ",")
+	hash := md5.Sum([]byte(ja3))
+	return hex.EncodeToString(hash[:])
+}
+
+// uint16Values returns the decimal representation of the big endian values of data, without the GREASE values.
+func uint16Values(data []byte) []string {
+	values := make([]string, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		if value := binary.BigEndian.Uint16(data[i:]); !isGREASE(value) {
+			values = append(values, strconv.Itoa(int(value)))
+		}
+	}
+	return values
+}
+
+// isGREASE reports whether value is one of the values reserved by RFC 8701, which are sent to prevent the ossification
+// of the protocol and change from one connection to another.
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
@@ -0,0 +1,66 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJA3Fingerprint(t *testing.T) {
+	appendVector := func(data []byte, lengthSize int, vector []byte) []byte {
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(vector)))
+		return append(append(data, length[2-lengthSize:]...), vector...)
+	}
+	appendExtension := func(data []byte, extensionType uint16, extension []byte) []byte {
+		data = append(data, byte(extensionType>>8), byte(extensionType))
+		return appendVector(data, 2, extension)
+	}
+
+	var extensions []byte
+	extensions = appendExtension(extensions, 0xdada, nil) // GREASE
+	extensions = appendExtension(extensions, 0, appendVector(nil, 2, []byte{0, 0, 4, 't', 'e', 's', 't'}))
+	extensions = appendExtension(extensions, 10, appendVector(nil, 2, []byte{0x2a, 0x2a, 0x00, 0x1d, 0x00, 0x17}))
+	extensions = appendExtension(extensions, 11, appendVector(nil, 1, []byte{0}))
+
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...)                                 // random
+	body = appendVector(body, 1, []byte{1, 2, 3})                            // session id
+	body = appendVector(body, 2, []byte{0x0a, 0x0a, 0x13, 0x01, 0xc0, 0x2f}) // cipher suites
+	body = appendVector(body, 1, []byte{0})                                  // compression methods
+	body = appendVector(body, 2, extensions)
+	handshake := append([]byte{0x01, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+	record := appendVector([]byte{0x16, 0x03, 0x01}, 2, handshake)
+
+	hash := md5.Sum([]byte("771,4865-49199,0-10-11,29-23,0"))
+	assert.Equal(t, hex.EncodeToString(hash[:]), ja3Fingerprint(record))
+
+	assert.Empty(t, ja3Fingerprint(record[:len(record)-3]))
+	assert.Empty(t, ja3Fingerprint([]byte("GET / HTTP/1.1\r\n\r\n")))
+	assert.Empty(t, ja3Fingerprint(nil))
+
+	assert.True(t, isGREASE(0x0a0a))
+	assert.True(t, isGREASE(0xfafa))
+	assert.False(t, isGREASE(0x0a1a))
+	assert.False(t, isGREASE(0x1301))
+}
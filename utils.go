@@ -52,10 +52,14 @@ func Sha256Sum(fileName string) (string, error) {
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
+// CustomRowID returns an id made of the timestamp, in seconds and nanoseconds, and of the lower 4 bytes of payload.
+// The ids are sorted by timestamp with the precision of nanoseconds, even if the connections are stored with the
+// precision of milliseconds.
 func CustomRowID(payload uint64, timestamp time.Time) RowID {
 	var key [12]byte
 	binary.BigEndian.PutUint32(key[0:4], uint32(timestamp.Unix()))
-	binary.BigEndian.PutUint64(key[4:12], payload)
+	binary.BigEndian.PutUint32(key[4:8], uint32(timestamp.Nanosecond()))
+	binary.BigEndian.PutUint32(key[8:12], uint32(payload))
 
 	oid, err := primitive.ObjectIDFromHex(hex.EncodeToString(key[:]))
 	if err == nil {
@@ -98,6 +102,15 @@ func byID(id RowID) OrderedDocument {
 	return OrderedDocument{{"_id", id}}
 }
 
+func containsRowID(ids []RowID, id RowID) bool {
+	for _, elem := range ids {
+		if elem == id {
+			return true
+		}
+	}
+	return false
+}
+
 func DecodeBytes(buffer []byte, format string) string {
 	switch format {
 	case "hex":
@@ -169,6 +182,41 @@ func ParseIPNet(address string) *net.IPNet {
 	return network
 }
 
+// IPNetworks are the networks of the server, e.g. the IPv4 and the IPv6 networks of a dual-stack vulnbox.
+type IPNetworks []*net.IPNet
+
+// ParseIPNetworks parses the addresses and the prefixes with ParseIPNet, and returns nil if one of them is invalid.
+func ParseIPNetworks(addresses ...string) IPNetworks {
+	networks := make(IPNetworks, 0, len(addresses))
+	for _, address := range addresses {
+		network := ParseIPNet(address)
+		if network == nil {
+			return nil
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func (networks IPNetworks) Contains(ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipBytes returns the address in the 16 bytes form, where the IPv4 addresses are mapped in the ::ffff:0:0/96 subnet,
+// so that the addresses of both the families can be compared as bytes. Returns nil if the address is invalid.
+func ipBytes(address string) []byte {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil
+	}
+	return ip.To16()
+}
+
 func Average(array []float64) float64 {
 	var sum float64
 	for _, f := range array {